@@ -9,6 +9,7 @@
 #   Use existing config:     AUTO_USE_EXISTING=true ./setup_oci_terraform.sh
 #   Auto deploy only:        AUTO_DEPLOY=true ./setup_oci_terraform.sh
 #   Skip to deploy:          SKIP_CONFIG=true ./setup_oci_terraform.sh
+#   Prometheus exporter:     ./setup_oci_terraform.sh serve-metrics
 #
 # Key features:
 #   - Completely idempotent: safe to run multiple times
@@ -27,9 +28,44 @@ set -euo pipefail
 NON_INTERACTIVE=${NON_INTERACTIVE:-false}
 AUTO_USE_EXISTING=${AUTO_USE_EXISTING:-false}
 AUTO_DEPLOY=${AUTO_DEPLOY:-false}
+# Plans that destroy or replace resources need a second confirmation (typing "destroy");
+# unattended runs (AUTO_DEPLOY/NON_INTERACTIVE) only apply them when this is true
+ALLOW_DESTROY=${ALLOW_DESTROY:-false}
+# Emit lifecycle { prevent_destroy = true } on instances (with their boot volumes) and block
+# volumes, so Terraform refuses any plan that would destroy or replace them. Regenerate with
+# --no-prevent-destroy (PREVENT_DESTROY=false) to remove them on purpose.
+PREVENT_DESTROY=${PREVENT_DESTROY:-false}
 SKIP_CONFIG=${SKIP_CONFIG:-false}
 DEBUG=${DEBUG:-false}
 FORCE_REAUTH=${FORCE_REAUTH:-false}
+DRY_RUN=${DRY_RUN:-false}   # discover and preview only: no installs, file writes, imports or applies
+# Write the files but leave init/import/plan/apply to the user; switched on automatically
+# when neither Terraform nor OpenTofu is installed and Terraform cannot be installed
+EMIT_ONLY=${EMIT_ONLY:-false}
+# File layout: "flat" runs Terraform on the generated root files; "modules" splits them into
+# modules/{network,compute-amd,compute-arm,storage} under a thin root module; "terragrunt"
+# also exports them as a Terragrunt unit in TERRAGRUNT_DIR (terragrunt.hcl + module) and
+# leaves init/plan/apply to Terragrunt
+LAYOUT=${LAYOUT:-flat}
+TERRAGRUNT_DIR=${TERRAGRUNT_DIR:-"terragrunt"}
+
+# Engine: auto (terraform, else OpenTofu when only tofu is installed), terraform or tofu
+TF_ENGINE=${TF_ENGINE:-auto}
+
+# OpenTofu state and plan encryption (tofu engine only): off, passphrase or kms. The key
+# reaches OpenTofu as TF_VAR_state_passphrase and is never written to the workspace:
+#   passphrase - from TOFU_STATE_PASSPHRASE (16+ characters)
+#   kms        - a data key generated by the OCI Vault key TOFU_STATE_KMS_KEY_ID (in vault
+#                TOFU_STATE_KMS_VAULT_ID), kept encrypted in TOFU_STATE_KEY_FILE and
+#                decrypted by the Vault on every run
+TOFU_STATE_ENCRYPTION=${TOFU_STATE_ENCRYPTION:-off}
+TOFU_STATE_PASSPHRASE=${TOFU_STATE_PASSPHRASE:-""}
+TOFU_STATE_KMS_KEY_ID=${TOFU_STATE_KMS_KEY_ID:-""}
+TOFU_STATE_KMS_VAULT_ID=${TOFU_STATE_KMS_VAULT_ID:-""}
+TOFU_STATE_KEY_FILE=${TOFU_STATE_KEY_FILE:-".tofu-state-key"}
+# Keep reading plaintext state while it is migrated: auto (while the local state is still
+# plaintext, always with a remote backend), true or false
+TOFU_STATE_FALLBACK=${TOFU_STATE_FALLBACK:-auto}
 
 # Optional Terraform remote backend (set to 'oci' to use OCI Object Storage S3-compatible backend)
 TF_BACKEND=${TF_BACKEND:-local}                # values: local | oci
@@ -41,34 +77,484 @@ TF_BACKEND_STATE_KEY=${TF_BACKEND_STATE_KEY:-"terraform.tfstate"}
 TF_BACKEND_ACCESS_KEY=${TF_BACKEND_ACCESS_KEY:-""}   # (optional) S3 access key
 TF_BACKEND_SECRET_KEY=${TF_BACKEND_SECRET_KEY:-""}   # (optional) S3 secret key
 
+# Terraform plan/apply tuning. OCI throttles bursts of instance launches with 429s,
+# so default to a lower parallelism than Terraform's built-in 10.
+TF_PARALLELISM=${TF_PARALLELISM:-4}
+TF_REFRESH=${TF_REFRESH:-true}                 # false = plan with -refresh=false (faster, trusts state)
+TF_LOCK_TIMEOUT=${TF_LOCK_TIMEOUT:-"60s"}      # how long to wait for a held state lock
+
+# Narrow a plan to some resources, force the replacement of some, or only sync state with
+# what exists (--target / --replace / --refresh-only). Space-separated resource addresses
+# or instance hostnames: TF_REPLACE="arm-2" replaces one instance without the network.
+TF_TARGETS=${TF_TARGETS:-""}
+TF_REPLACE=${TF_REPLACE:-""}
+TF_REFRESH_ONLY=${TF_REFRESH_ONLY:-false}
+
+# Version constraints written into provider.tf: the Terraform/OpenTofu CLI (required_version)
+# and the oracle/oci provider. "" keeps what provider.tf has (default ">= 1.0" and "~> 6.0").
+# An exact TF_REQUIRED_VERSION (e.g. "1.9.8") is also the version a missing Terraform is
+# installed at. Before init the run warns when the installed CLI does not satisfy it.
+TF_REQUIRED_VERSION=${TF_REQUIRED_VERSION:-""}
+OCI_PROVIDER_VERSION=${OCI_PROVIDER_VERSION:-""}
+# Platforms .terraform.lock.hcl holds provider checksums for (terraform providers lock), so
+# a lock file committed from one machine also verifies on the others; "" = this one only
+TF_LOCK_PLATFORMS=${TF_LOCK_PLATFORMS-"linux_amd64 linux_arm64 darwin_amd64 darwin_arm64 windows_amd64"}
+# Filesystem provider mirror for machines without registry access: 'mirror' downloads the
+# oci provider for TF_LOCK_PLATFORMS into it, and when it is set Terraform installs
+# providers only from there, through a generated CLI config (PROVIDER_MIRROR_CLI_CONFIG)
+PROVIDER_MIRROR_DIR=${PROVIDER_MIRROR_DIR:-""}
+PROVIDER_MIRROR_CLI_CONFIG=${PROVIDER_MIRROR_CLI_CONFIG:-".cloudcradle/provider-mirror.tfrc"}
+
+# HTTP(S) proxy for everything this script starts (oci CLI and session authenticate,
+# terraform and its provider, curl, pip, package managers). "" = HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+# from the environment (either case); "none" ignores them. localhost and the instance
+# metadata address are always added to NO_PROXY.
+PROXY=${PROXY:-""}
+
+# Reuse tfplan when config, inventory and state are unchanged since it was created
+TF_PLAN_CACHE=${TF_PLAN_CACHE:-true}
+TF_PLAN_CACHE_FILE=${TF_PLAN_CACHE_FILE:-".tfplan.cache"}
+
+# Block volumes per instance, overriding what the configuration chose: comma-separated in
+# instance order, each "0" (none) or sizes in GB joined by "+" for several volumes, e.g.
+# ARM_BLOCK_VOLUMES="100+50,0". Same as --amd-block-volumes / --arm-block-volumes.
+AMD_BLOCK_VOLUMES=${AMD_BLOCK_VOLUMES:-""}
+ARM_BLOCK_VOLUMES=${ARM_BLOCK_VOLUMES:-""}
+
+# Operating system: ubuntu, oracle-linux, almalinux, rocky or debian (also --os). Ubuntu and
+# Oracle Linux are platform images; AlmaLinux, Rocky Linux and Debian come from the
+# Marketplace and are subscribed to in marketplace_images.tf. Empty keeps the OS saved in
+# variables.tf (ubuntu for new workspaces).
+INSTANCE_OS=${INSTANCE_OS:-""}
+# Login user on the instances; empty means the image's default user for INSTANCE_OS
+SSH_USER=${SSH_USER:-""}
+
+# Ubuntu release (22.04 or 24.04) and image variant (standard, or minimal: no snapd, docs or
+# extra tooling) (also --ubuntu-version/--ubuntu-variant). Empty keeps the release pinned in
+# IMAGE_LOCK_FILE (24.04 standard for new workspaces).
+UBUNTU_VERSION=${UBUNTU_VERSION:-""}
+UBUNTU_VARIANT=${UBUNTU_VARIANT:-""}
+
+# Image OCIDs resolved per region and architecture. Commit it so re-runs (and teammates) keep
+# booting the same image; IMAGE_UPDATE=true (or --update-images) resolves the newest again.
+IMAGE_LOCK_FILE=${IMAGE_LOCK_FILE:-"images.lock.json"}
+IMAGE_UPDATE=${IMAGE_UPDATE:-false}
+
+# Bring-your-own images: custom image OCIDs (e.g. golden images) used instead of the newest
+# INSTANCE_OS image for that architecture (also --amd-image/--arm-image)
+AMD_IMAGE_OCID=${AMD_IMAGE_OCID:-""}
+ARM_IMAGE_OCID=${ARM_IMAGE_OCID:-""}
+
+# Per-instance labels: lines of "<hostname> key=value ..." applied as freeform tags
+# and usable as fleet selectors (e.g. exec --selector role=web)
+INSTANCE_LABELS_FILE=${INSTANCE_LABELS_FILE:-"instance-labels.conf"}
+
+# Declared power state: lines of "<hostname> STOPPED", maintained by the stop/start
+# commands so plans keep stopped instances stopped instead of reporting drift
+POWER_STATE_FILE=${POWER_STATE_FILE:-"power-state.conf"}
+
+# Hostname renames: lines of "<old> <new>" maintained by the rename command and turned into
+# moved blocks (renames.tf). Renamed instances keep the cloud-init they were launched with,
+# pinned in PINNED_USER_DATA_FILE (it holds the same tokens as the Terraform state).
+RENAMES_FILE=${RENAMES_FILE:-"renames.conf"}
+
+# Adopted resources: resource blocks (e.g. oci_core_instance.arm) holding resources that were
+# imported rather than created here, recorded in ADOPTED_FILE on the first import. Their
+# lifecycle ignore_changes lists the attributes in which an imported resource usually differs
+# from the template, so adopting existing infrastructure converges to a plan without changes.
+# ADOPT_IGNORE_CHANGES overrides the lists per resource type or block address, e.g.
+# "oci_core_instance=metadata,source_details;oci_core_vcn.main=" (empty: ignore nothing),
+# or is "off" to generate the templates unchanged.
+ADOPTED_FILE=${ADOPTED_FILE:-"adopted.conf"}
+ADOPT_IGNORE_CHANGES=${ADOPT_IGNORE_CHANGES:-""}
+PINNED_USER_DATA_FILE=${PINNED_USER_DATA_FILE:-".pinned-user-data.json"}
+
+# Packages compared by 'fleet packages' ("kernel" is the running kernel, "docker" the
+# client version; anything else is looked up with dpkg-query, falling back to rpm)
+FLEET_PACKAGES=${FLEET_PACKAGES:-"docker kernel openssl"}
+
+# Application data backups: lines of "<target> <schedule> <path...>" where target is as in
+# readiness checks and schedule is a systemd OnCalendar value ("_" for spaces, e.g. daily
+# or Mon..Fri_02:30). Instances push restic snapshots to BACKUP_BUCKET using instance
+# principals. Each instance has its own repository password, generated into
+# BACKUP_PASSWORDS_DIR/<hostname> and delivered through the secrets vault.
+BACKUP_SPEC_FILE=${BACKUP_SPEC_FILE:-"backups.conf"}
+BACKUP_BUCKET=${BACKUP_BUCKET:-"cloudcradle-backups"}
+BACKUP_RETENTION=${BACKUP_RETENTION:-"--keep-daily 7 --keep-weekly 4 --keep-monthly 6"}
+# rclone release the instances install for restic's Object Storage backend. Its SHA256SUMS
+# are fetched once into RCLONE_CHECKSUMS_FILE (commit it, like the lock file) and every
+# instance checks the downloaded archive against them before installing it.
+RCLONE_VERSION=${RCLONE_VERSION:-"1.68.2"}
+RCLONE_CHECKSUMS_FILE=${RCLONE_CHECKSUMS_FILE:-"rclone-SHA256SUMS"}
+BACKUP_PASSWORDS_DIR=${BACKUP_PASSWORDS_DIR:-".backup-passwords"}
+# Password shared by all repositories in earlier versions; only read so the instances can
+# add their own key to repositories created with it
+BACKUP_PASSWORD_FILE=${BACKUP_PASSWORD_FILE:-".backup-password"}
+
+# Provisioner modules: lines of "<target> <module...>" (target as in backups) enabling
+# ready-made cloud-init snippets per instance: docker k3s tailscale wireguard caddy traefik
+# node_exporter.
+# TAILSCALE_AUTH_KEY is passed to Terraform as TF_VAR_tailscale_auth_key, like DDNS_TOKEN.
+PROVISIONERS_FILE=${PROVISIONERS_FILE:-"provisioners.conf"}
+# Modules for every instance, e.g. "docker" (--provision docker); empty keeps the ones
+# saved in variables.tf, "none" removes them
+PROVISION=${PROVISION:-""}
+NODE_EXPORTER_VERSION=${NODE_EXPORTER_VERSION:-"1.8.2"}
+# Reverse proxy sites: lines of "<target> <domain> <upstream>" (target as in provisioners,
+# e.g. "arm-1 app.example.com localhost:8080"). Matching instances get REVERSE_PROXY with
+# automatic HTTPS for the domain, and ports 80/443 are opened in the security list.
+SITES_FILE=${SITES_FILE:-"sites.conf"}
+REVERSE_PROXY=${REVERSE_PROXY:-"caddy"}   # caddy | traefik
+ACME_EMAIL=${ACME_EMAIL:-""}              # Let's Encrypt account email (optional)
+TRAEFIK_VERSION=${TRAEFIK_VERSION:-"3.1.2"}
+
+# Application secrets: lines of "<target> <name> <path> [mode]" (target as in provisioners).
+# Values are stored in an OCI Vault with 'secrets set NAME'; matching instances fetch them
+# at boot through instance principals, so they never appear in user-data or Terraform state.
+SECRETS_FILE=${SECRETS_FILE:-"secrets.conf"}
+SECRETS_VAULT_NAME=${SECRETS_VAULT_NAME:-"cloudcradle-secrets"}
+if [ -n "${TAILSCALE_AUTH_KEY:-}" ]; then
+    export TF_VAR_tailscale_auth_key="$TAILSCALE_AUTH_KEY"
+fi
+
+# Compute capacity reservation for the ARM instances: "create" reserves A1.Flex capacity of
+# the ARM instances' sizes so a rebuilt instance launches into it instead of competing for
+# the shared pool, an OCID uses an existing reservation, "none" releases it and "" keeps the
+# setting saved in variables.tf. Reserved capacity no instance uses is billed.
+CAPACITY_RESERVATION=${CAPACITY_RESERVATION:-""}
+
+# Cost alerts: email address(es, comma-separated) that get a mail as soon as the actual or
+# forecast monthly spend of the tenancy goes over BUDGET_ALERT_THRESHOLD, i.e. something
+# outside the Always Free tier is billed. "" keeps the address saved in variables.tf,
+# "none" removes the budget.
+BUDGET_ALERT_EMAIL=${BUDGET_ALERT_EMAIL:-""}
+BUDGET_AMOUNT=${BUDGET_AMOUNT:-1}                       # monthly budget, in the tenancy's currency
+BUDGET_ALERT_THRESHOLD=${BUDGET_ALERT_THRESHOLD:-0.01}  # spend that triggers the alerts
+
+# Scheduled volume backups: "" (off), an Oracle-defined policy (bronze | silver | gold) or
+# custom. A custom schedule is "<daily|weekly|monthly>:<count kept>[,...]", e.g. "weekly:2".
+# Always Free includes 5 volume backups in total; the run warns when a policy would exceed it.
+VOLUME_BACKUP_POLICY=${VOLUME_BACKUP_POLICY:-""}
+VOLUME_BACKUP_SCHEDULE=${VOLUME_BACKUP_SCHEDULE:-"weekly:2"}
+VOLUME_BACKUP_VOLUMES=${VOLUME_BACKUP_VOLUMES:-"boot"}   # boot | block | all
+VOLUME_BACKUP_HOUR=${VOLUME_BACKUP_HOUR:-3}              # UTC hour of custom backups
+# Volume groups: "all" (every instance with block volumes) or a comma-separated list of
+# hostnames. Each instance's boot and block volumes then form one group that is backed up
+# by VOLUME_BACKUP_POLICY as a crash-consistent set instead of volume by volume.
+VOLUME_GROUPS=${VOLUME_GROUPS:-""}
+
+# Always Free Autonomous Databases (opt-in): comma-separated "<name>:<workload>" where
+# workload is OLTP (ATP), DW (ADW), AJD (JSON) or APEX, e.g. "appdb:OLTP,reports:DW".
+# The ADMIN password is generated into ADB_ADMIN_PASSWORD_FILE; 'adb wallet' downloads
+# connection wallets into ADB_WALLET_DIR.
+AUTONOMOUS_DATABASES=${AUTONOMOUS_DATABASES:-""}
+ADB_ADMIN_PASSWORD_FILE=${ADB_ADMIN_PASSWORD_FILE:-".adb-admin-password"}
+ADB_WALLET_DIR=${ADB_WALLET_DIR:-"wallets"}
+if [ -z "${TF_VAR_adb_admin_password:-}" ] && [ -f "$ADB_ADMIN_PASSWORD_FILE" ]; then
+    export TF_VAR_adb_admin_password="$(cat "$ADB_ADMIN_PASSWORD_FILE")"
+fi
+
+# Tag-scoped management: when set (e.g. "Managed=CloudCradle") only resources carrying this
+# freeform tag are inventoried and imported, and every generated resource gets it, so the
+# tool can coexist with manually managed infrastructure. Untagged resources still count
+# against the Free Tier limits.
+MANAGED_TAG=${MANAGED_TAG:-""}
+
+# Inventory results are kept per section (compute, network, ...) in INVENTORY_CACHE_FILE.
+# A section younger than INVENTORY_CACHE_TTL seconds is reused by subcommands (resize,
+# rebalance, whatif --live, spec serve-validation); the setup run scans again unless
+# INVENTORY_CACHE=cached (--cached). INVENTORY_CACHE=refresh (--refresh) always scans.
+INVENTORY_CACHE=${INVENTORY_CACHE:-auto}
+INVENTORY_CACHE_FILE=${INVENTORY_CACHE_FILE:-".cloudcradle/inventory.json"}
+INVENTORY_CACHE_TTL=${INVENTORY_CACHE_TTL:-600}
+
+# Per-instance and per-VCN lookups the inventory runs at the same time (1 = one by one).
+# Output is identical either way; lower it if the tenancy is throttled (HTTP 429).
+INVENTORY_CONCURRENCY=${INVENTORY_CONCURRENCY:-4}
+
+# Instances of shapes outside the Always Free offer (e.g. paid E4/A2 Flex) never count
+# against the Free Tier instance limits, but their boot volumes always count against the
+# 200GB storage allowance. Set to true to also list them, with their OCPUs and memory,
+# as "other" in the inventory summary and usage totals.
+COUNT_ALL_INSTANCES=${COUNT_ALL_INSTANCES:-false}
+
+# User-owned Terraform (*.tf) copied verbatim into the workspace on every run; never
+# backed up or overwritten by generated files. Copies are tracked in EXTRA_TF_MANIFEST.
+EXTRA_TF_DIR=${EXTRA_TF_DIR:-"extra"}
+EXTRA_TF_MANIFEST=${EXTRA_TF_MANIFEST:-".extra-tf-files"}
+
+# Security list rules, one per line: <ingress|egress> <tcp|udp|icmp|all> <ports|icmp-type|-> <cidr[,cidr...]> [description]
+# Without the file: SSH, HTTP, HTTPS and ICMP in from anywhere, everything out.
+FIREWALL_RULES_FILE=${FIREWALL_RULES_FILE:-"firewall.conf"}
+
+# Check IAM permissions for every phase before inventory and apply (see `preflight`)
+PREFLIGHT_CHECKS=${PREFLIGHT_CHECKS:-true}
+
+# Reserved (static) public IPs: "all" or comma-separated hostnames. These instances get a
+# reserved IP instead of an ephemeral one, so rebuilding them keeps the same address.
+RESERVED_PUBLIC_IPS=${RESERVED_PUBLIC_IPS:-""}
+
+# Network topology: "flat" (one public subnet) or "two-tier" (private subnet behind a NAT
+# gateway, with only the bastion host reachable from the internet)
+NETWORK_TOPOLOGY=${NETWORK_TOPOLOGY:-flat}
+BASTION_HOST=${BASTION_HOST:-""}            # two-tier: public jump host (default: first instance)
+PRIVATE_INSTANCES=${PRIVATE_INSTANCES:-""}  # two-tier: comma-separated private hosts (default: all but bastion)
+SERVICE_GATEWAY=${SERVICE_GATEWAY:-false}   # two-tier: reach Object Storage/OCI services without public egress
+
+# Network CIDRs (IPv4). Empty means: adopt the existing VCN/subnet's CIDR, otherwise
+# 10.0.0.0/16 with 10.0.1.0/24 (public) and 10.0.2.0/24 (private)
+VCN_CIDRS=${VCN_CIDRS:-""}                  # comma-separated, /16 to /30
+PUBLIC_SUBNET_CIDR=${PUBLIC_SUBNET_CIDR:-""}
+PRIVATE_SUBNET_CIDR=${PRIVATE_SUBNET_CIDR:-""}
+
+# Additional subnets: lines of "<name> <cidr> <public|private> [hostname,...]". The listed
+# instances are placed there instead of the public/private subnet above. Private subnets
+# route through the NAT gateway, so they need NETWORK_TOPOLOGY=two-tier.
+SUBNETS_FILE=${SUBNETS_FILE:-"subnets.conf"}
+
+# Dynamic DNS: instances register their public IPs on boot and every 5 minutes.
+# DDNS_TOKEN is passed to Terraform as TF_VAR_ddns_token and never written to the workspace.
+DDNS_PROVIDER=${DDNS_PROVIDER:-""}                        # duckdns | dynu
+DDNS_DOMAIN_TEMPLATE=${DDNS_DOMAIN_TEMPLATE:-"{hostname}"}  # per-instance name, e.g. "myproj-{hostname}"
+if [ -n "${DDNS_TOKEN:-}" ]; then
+    export TF_VAR_ddns_token="$DDNS_TOKEN"
+fi
+
+# Address family used by ssh/exec/env to reach instances: ipv4 | ipv6
+SSH_ADDRESS_FAMILY=${SSH_ADDRESS_FAMILY:-ipv4}
+
+# Extra login users whose public keys are published on GitHub/GitLab, e.g.
+# "github:alice,gitlab:bob". Each gets a sudo account named after the handle. Keys are
+# fetched once and cached in SSH_AUTHORIZED_USERS_CACHE (commit it) so that key changes
+# upstream don't rewrite cloud-init; set SSH_AUTHORIZED_USERS_REFRESH=true to re-fetch.
+SSH_AUTHORIZED_USERS=${SSH_AUTHORIZED_USERS:-""}
+SSH_AUTHORIZED_USERS_CACHE=${SSH_AUTHORIZED_USERS_CACHE:-".ssh-authorized-users.json"}
+SSH_AUTHORIZED_USERS_REFRESH=${SSH_AUTHORIZED_USERS_REFRESH:-false}
+GITLAB_URL=${GITLAB_URL:-"https://gitlab.com"}   # for self-hosted GitLab handles
+# Individual accounts: lines of "<name> <sudo|nosudo> <shell|-> <key-source...>" where a key
+# source is github:<handle>, gitlab:<handle> or a public key file, e.g.
+# "bob nosudo /bin/zsh keys/bob.pub". Keys are resolved like SSH_AUTHORIZED_USERS.
+USERS_FILE=${USERS_FILE:-"users.conf"}
+
+# Temporary access ('grant-access'): default lifetime and the upper bound a grant may ask for
+GRANT_ACCESS_DEFAULT_TTL=${GRANT_ACCESS_DEFAULT_TTL:-"24h"}
+GRANT_ACCESS_MAX_TTL=${GRANT_ACCESS_MAX_TTL:-"30d"}
+
+# Append-only record of access grants and revocations (tab-separated; worth committing)
+AUDIT_LOG=${AUDIT_LOG:-"audit.log"}
+
+# Post-apply readiness checks (see readiness-checks.conf; default: SSH port reachable)
+READINESS_CHECKS=${READINESS_CHECKS:-true}
+READINESS_CHECKS_FILE=${READINESS_CHECKS_FILE:-"readiness-checks.conf"}
+READINESS_REPORT_FILE=${READINESS_REPORT_FILE:-"readiness-report.json"}
+READINESS_TIMEOUT=${READINESS_TIMEOUT:-300}    # seconds to wait for each check to pass
+READINESS_INTERVAL=${READINESS_INTERVAL:-10}   # seconds between attempts
+
+# sshd hardening from cloud-init is reverted on the instance after this many seconds
+# unless the tool confirms a login over SSH after apply (see verify-ssh)
+SSH_HARDENING_REVERT_TIMEOUT=${SSH_HARDENING_REVERT_TIMEOUT:-1800}
+
+# Host hardening profile: minimal (sshd settings only), standard (+ fail2ban sshd jail) or
+# strict (+ ufw/firewalld mirroring the security list, aggressive fail2ban, stricter sshd).
+# Empty keeps the profile saved in variables.tf. HARDENING_FILE lines of "<target> <profile>"
+# override it per instance (target as in provisioners; the last matching line wins).
+HARDENING_PROFILE=${HARDENING_PROFILE:-""}
+HARDENING_FILE=${HARDENING_FILE:-"hardening.conf"}
+# sshd port on the instances; empty keeps the port saved in variables.tf (default 22).
+# The security list gets a matching rule with the CIDRs that may reach port 22.
+SSH_PORT=${SSH_PORT:-""}
+
+# cloud-init additions: lines of "timezone <zone>", "package <name...>", "var <name> <value>",
+# "runcmd <command>" and "file <path> <mode> <local template>". runcmd entries and file
+# templates are rendered per instance (${hostname}, ${vars.<name>}); the result is checked
+# to be valid YAML for every instance before cloud-init.yaml is written.
+CLOUD_INIT_FILE=${CLOUD_INIT_FILE:-"cloud-init.conf"}
+
+# New tenancies (trial provisioning, pending payment verification) reject most calls until
+# Oracle activates them. --wait-for-activation polls instead of failing.
+WAIT_FOR_ACTIVATION=${WAIT_FOR_ACTIVATION:-false}
+ACTIVATION_POLL_INTERVAL=${ACTIVATION_POLL_INTERVAL:-300}   # seconds between checks
+ACTIVATION_WAIT_TIMEOUT=${ACTIVATION_WAIT_TIMEOUT:-172800}  # give up after 48h
+
 # Retry/backoff settings for transient errors like 'Out of Capacity'
 RETRY_MAX_ATTEMPTS=${RETRY_MAX_ATTEMPTS:-8}
 RETRY_BASE_DELAY=${RETRY_BASE_DELAY:-15}  # seconds
 
+# Every capacity success/failure (timestamp, region, AD, shape) is appended here as JSON lines;
+# `capacity-stats` summarises it into best-time-to-retry hints
+CAPACITY_HISTORY_FILE=${CAPACITY_HISTORY_FILE:-".capacity-history.jsonl"}
+
+# After every successful apply instances.json, instances.env (ARM_INSTANCE_1_IP=...) and an
+# Ansible inventory.ini are written here for scripts and CI jobs (`artifacts` rewrites them)
+ARTIFACTS=${ARTIFACTS:-true}
+ARTIFACTS_DIR=${ARTIFACTS_DIR:-"artifacts"}
+
+# Provenance line at the top of every generated file: tool version, a hash of the inputs
+# (spec), the run that wrote it and a hash of the rest of the file. A later run that finds
+# the file no longer matches its hash asks before overwriting the hand edits (they are kept
+# as a .bak file either way; unattended runs overwrite). false writes files without it.
+GENERATED_HEADER=${GENERATED_HEADER:-true}
+
+# Keep secrets out of git: generating files creates (or completes) .gitignore, and before
+# apply a warning lists the private key, state and password files if git tracks them
+GIT_HYGIENE=${GIT_HYGIENE:-true}
+
+# Where the SSH private key and the S3 backend keys are kept: "file" (ssh_keys/id_rsa and
+# backend.tf) or "keychain" (macOS Keychain, libsecret's secret-tool, or Python keyring,
+# which also covers the Windows Credential Manager). With keychain the private key is only
+# written to ssh_keys/id_rsa while a command runs, and the backend keys reach Terraform as
+# AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY instead of being written into backend.tf.
+SECRET_STORE=${SECRET_STORE:-file}
+SECRET_STORE_SERVICE=${SECRET_STORE_SERVICE:-cloudcradle}
+
+# Capacity-hunt scheduler between 'Out of Capacity' apply retries:
+#   fixed     - RETRY_BASE_DELAY every time
+#   jittered  - exponential from RETRY_BASE_DELAY, randomised by +/-HUNT_JITTER_PCT
+#   adaptive  - retry quickly inside the historically best window (capacity-stats); outside
+#               it back off like jittered but never past the window opening
+HUNT_SCHEDULER=${HUNT_SCHEDULER:-jittered}
+HUNT_JITTER_PCT=${HUNT_JITTER_PCT:-20}
+HUNT_MAX_DELAY=${HUNT_MAX_DELAY:-3600}        # cap on a single wait (seconds)
+HUNT_MAX_DURATION=${HUNT_MAX_DURATION:-0}     # cap on the whole hunt (seconds, 0 = attempts only)
+HUNT_QUIET_HOURS=${HUNT_QUIET_HOURS:-""}      # local hours without retries, e.g. "23-07"
+
 # Timeout for OCI CLI calls (seconds). Set lower if your environment can be slow.
 OCI_CMD_TIMEOUT=${OCI_CMD_TIMEOUT:-20}
 # If no coreutils timeout is available, the script attempts to still run but may block on slow OCI CLI calls.
 
-# OCI CLI configuration
-OCI_CONFIG_FILE=${OCI_CONFIG_FILE:-"$HOME/.oci/config"}
-OCI_PROFILE=${OCI_PROFILE:-"DEFAULT"}
+# OCI CLI configuration. The standard OCI CLI/SDK variables are honoured so existing
+# tooling and CI secrets carry over: OCI_CLI_CONFIG_FILE, OCI_CLI_PROFILE, OCI_CLI_AUTH
+# (api_key | security_token | instance_principal | resource_principal), OCI_TENANCY, OCI_REGION.
+# A profile/region set here, with --profile/--region or by a tenancy workspace is used as
+# is; otherwise the interactive setup offers the config's profiles and subscribed regions.
+OCI_PROFILE_PINNED=false
+OCI_PROFILE_FLAG=false
+OCI_REGION_PINNED=false
+if [ -n "${OCI_PROFILE:-}${OCI_CLI_PROFILE:-}" ]; then
+    OCI_PROFILE_PINNED=true
+fi
+if [ -n "${OCI_REGION:-}${OCI_CLI_REGION:-}" ]; then
+    OCI_REGION_PINNED=true
+fi
+# Directory of the OCI CLI's config and keys. Native Windows shells (Git Bash, MSYS2,
+# Cygwin) have a $HOME of their own, while the Windows OCI CLI uses %USERPROFILE%\.oci.
+if [ -z "${OCI_DIR:-}" ]; then
+    OCI_DIR="$HOME/.oci"
+    case "${OSTYPE:-}" in
+        msys*|cygwin*)
+            if [ -n "${USERPROFILE:-}" ] && command -v cygpath >/dev/null 2>&1; then
+                OCI_DIR="$(cygpath -u "$USERPROFILE")/.oci"
+            fi
+            ;;
+    esac
+fi
+OCI_CONFIG_FILE=${OCI_CONFIG_FILE:-${OCI_CLI_CONFIG_FILE:-"$OCI_DIR/config"}}
+OCI_PROFILE=${OCI_PROFILE:-${OCI_CLI_PROFILE:-"DEFAULT"}}
+OCI_CLI_AUTH=${OCI_CLI_AUTH:-""}
+OCI_TENANCY=${OCI_TENANCY:-${OCI_CLI_TENANCY:-""}}
+OCI_REGION=${OCI_REGION:-${OCI_CLI_REGION:-""}}
 OCI_AUTH_REGION=${OCI_AUTH_REGION:-""}
+# Measure the connect time to each region's API endpoint when offering regions (the fastest
+# becomes the default for a first login); false falls back to a guess from the timezone
+REGION_LATENCY_PROBE=${REGION_LATENCY_PROBE:-true}
 OCI_CLI_CONNECTION_TIMEOUT=${OCI_CLI_CONNECTION_TIMEOUT:-10}
 OCI_CLI_READ_TIMEOUT=${OCI_CLI_READ_TIMEOUT:-60}
 OCI_CLI_MAX_RETRIES=${OCI_CLI_MAX_RETRIES:-3}
+# Client-side token bucket for OCI API calls, shared by the parallel inventory lookups:
+# at most OCI_RATE_LIMIT calls per second (0 = no limit) after a burst of OCI_RATE_BURST.
+# A 429 answer empties the bucket, so every caller pauses instead of retrying at once.
+OCI_RATE_LIMIT=${OCI_RATE_LIMIT:-10}
+OCI_RATE_BURST=${OCI_RATE_BURST:-10}
+# Attach an opc-retry-token to create/launch/action calls. The token is derived from the
+# command and this run, so a call repeated after a timeout or dropped connection is
+# recognised by OCI instead of creating a second resource.
+OCI_RETRY_TOKENS=${OCI_RETRY_TOKENS:-true}
+# bootstrap-iam: dedicated least-privilege identity created from tenancy-admin credentials
+IAM_BOOTSTRAP_USER=${IAM_BOOTSTRAP_USER:-"cloudcradle"}
+IAM_BOOTSTRAP_GROUP=${IAM_BOOTSTRAP_GROUP:-"CloudCradleOperators"}
+IAM_BOOTSTRAP_POLICY=${IAM_BOOTSTRAP_POLICY:-"CloudCradlePolicy"}
+IAM_BOOTSTRAP_PROFILE=${IAM_BOOTSTRAP_PROFILE:-"CLOUDCRADLE"}
+IAM_BOOTSTRAP_EMAIL=${IAM_BOOTSTRAP_EMAIL:-""}   # required by tenancies using identity domains
+# Defined-tag namespace marking the instances allowed to reach the backup bucket and the
+# secrets vault as themselves; bootstrap-iam creates it with the matching dynamic groups
+INSTANCE_TAG_NAMESPACE=${INSTANCE_TAG_NAMESPACE:-"cloudcradle"}
+
+# Tenancy workspaces: one directory per tenancy (state, ssh_keys/, config files) under
+# TENANCIES_DIR, each bound to an OCI CLI profile. --tenancy NAME (CLOUDCRADLE_TENANCY)
+# selects one for a run; `tenancy switch NAME` makes it the default outside a workspace.
+TENANCIES_DIR=${TENANCIES_DIR:-"${XDG_DATA_HOME:-$HOME/.local/share}/cloudcradle/tenancies"}
+CLOUDCRADLE_TENANCY=${CLOUDCRADLE_TENANCY:-""}
+TENANCY_FILE=".tenancy"
+# Session tokens (security_token_file profiles): refresh automatically when the token is
+# within this many seconds of expiry, and pick up tokens refreshed by other tools.
+SESSION_TOKEN_AUTO_REFRESH=${SESSION_TOKEN_AUTO_REFRESH:-true}
+SESSION_TOKEN_REFRESH_MARGIN=${SESSION_TOKEN_REFRESH_MARGIN:-300}
+
+# OCI access seam: every API call goes through oci_cmd, which can be pointed at a
+# different CLI (wrapper, stub) or at a directory of canned JSON responses so the
+# inventory and limit logic can be exercised without a live tenancy.
+OCI_CLI_BIN=${OCI_CLI_BIN:-oci}
+OCI_CLI_FIXTURES_DIR=${OCI_CLI_FIXTURES_DIR:-""}
 
+# Fault injection for developing and testing CloudCradle itself (also --chaos, not in
+# --help): "capacity=0.2,throttle=0.1,auth=0.05,subprocess=0.1" or one rate for all kinds.
+# Rates are probabilities per call (0-1 or N%); CHAOS_SEED makes a run reproducible.
+CHAOS=${CHAOS:-""}
+CHAOS_SEED=${CHAOS_SEED:-""}
 
+# Usage statistics (opt-in, off by default): counts of the commands, flags and phases used
+# and how often they failed, aggregated in a local file. Nothing leaves the machine unless
+# you run 'usage submit' with USAGE_STATS_SUBMIT_URL set. USAGE_STATS=true/false overrides
+# 'usage enable'/'usage disable'.
+USAGE_STATS=${USAGE_STATS:-""}
+USAGE_STATS_FILE=${USAGE_STATS_FILE:-"${XDG_STATE_HOME:-$HOME/.local/state}/cloudcradle/usage.json"}
+USAGE_STATS_SUBMIT_URL=${USAGE_STATS_SUBMIT_URL:-""}
 
-# Oracle Free Tier Limits (as of 2025)
-readonly FREE_TIER_MAX_AMD_INSTANCES=2
+# OpenTelemetry tracing (standard OTEL_* variables; disabled unless an OTLP endpoint is set).
+# Spans are exported once at exit as OTLP/HTTP JSON.
+OTEL_SERVICE_NAME=${OTEL_SERVICE_NAME:-"cloudcradle"}
+OTEL_TRACES_ENDPOINT=${OTEL_EXPORTER_OTLP_TRACES_ENDPOINT:-${OTEL_EXPORTER_OTLP_ENDPOINT:+${OTEL_EXPORTER_OTLP_ENDPOINT%/}/v1/traces}}
+OTEL_EXPORTER_OTLP_HEADERS=${OTEL_EXPORTER_OTLP_HEADERS:-""}   # k1=v1,k2=v2
+
+# Machine-readable run reports for wrappers and CI jobs (see 'schema export result event'):
+# RESULT_FILE gets one JSON document when the run exits (command, exit code, phases) and
+# EVENTS_FILE one JSON line as the run and each phase starts and ends. Empty = off.
+# Relative paths are from where the script starts, before any tenancy directory switch.
+RESULT_FILE=${RESULT_FILE:-""}
+EVENTS_FILE=${EVENTS_FILE:-""}
+[[ -z "$RESULT_FILE" || "$RESULT_FILE" == /* ]] || RESULT_FILE="$PWD/$RESULT_FILE"
+[[ -z "$EVENTS_FILE" || "$EVENTS_FILE" == /* ]] || EVENTS_FILE="$PWD/$EVENTS_FILE"
+
+# Prometheus metrics exporter (./setup_oci_terraform.sh serve-metrics)
+METRICS_PORT=${METRICS_PORT:-9877}                     # 0 = only write METRICS_FILE (node_exporter textfile collector)
+METRICS_BIND=${METRICS_BIND:-"127.0.0.1"}
+METRICS_FILE=${METRICS_FILE:-"$PWD/.metrics/cloudcradle.prom"}
+METRICS_REFRESH_INTERVAL=${METRICS_REFRESH_INTERVAL:-300}  # seconds between inventory refreshes
+
+# Service limits: "free" lowers the Always Free numbers below to the tenancy's actual limits
+# from the Limits API (some regions grant fewer A1 cores), "tenancy" uses the actual limits
+# even above Always Free (upgraded pay-as-you-go tenancies; usage beyond the free allowance
+# is billed) and "off" keeps the numbers below without asking.
+SERVICE_LIMITS=${SERVICE_LIMITS:-free}
+
+# Always Free compute only exists in the tenancy's home region, so the setup stops in any
+# other region unless this is true (or SERVICE_LIMITS=tenancy); then it only warns.
+ALLOW_NON_HOME_REGION=${ALLOW_NON_HOME_REGION:-false}
+
+# Oracle Free Tier Limits (as of 2025); the maximums are replaced by the tenancy's service
+# limits once an OCI session exists (SERVICE_LIMITS, see fetch_service_limits)
+FREE_TIER_MAX_AMD_INSTANCES=2
 readonly FREE_TIER_AMD_SHAPE="VM.Standard.E2.1.Micro"
-readonly FREE_TIER_MAX_ARM_OCPUS=4
-readonly FREE_TIER_MAX_ARM_MEMORY_GB=24
+FREE_TIER_MAX_ARM_OCPUS=4
+FREE_TIER_MAX_ARM_MEMORY_GB=24
 readonly FREE_TIER_ARM_SHAPE="VM.Standard.A1.Flex"
-readonly FREE_TIER_MAX_STORAGE_GB=200
+FREE_TIER_MAX_STORAGE_GB=200
 readonly FREE_TIER_MIN_BOOT_VOLUME_GB=47
-readonly FREE_TIER_MAX_ARM_INSTANCES=4
-readonly FREE_TIER_MAX_VCNS=2
+readonly FREE_TIER_MIN_BLOCK_VOLUME_GB=50
+FREE_TIER_MAX_ARM_INSTANCES=4
+FREE_TIER_MAX_VCNS=2
+readonly FREE_TIER_MAX_AUTONOMOUS_DBS=2
+readonly FREE_TIER_MAX_VOLUME_BACKUPS=5
 
 # Colors for output
 readonly RED='\033[0;31m'
@@ -80,14 +566,65 @@ readonly MAGENTA='\033[0;35m'
 readonly BOLD='\033[1m'
 readonly NC='\033[0m' # No Color
 
+readonly CLOUDCRADLE_VERSION="1.0.0"
+
+# Tracing state (see TRACING FUNCTIONS)
+declare -g TRACE_ID=""
+# Identifies this run in the provenance lines of the files it generates
+declare -g CLOUDCRADLE_RUN_ID="$(date -u +%Y%m%dT%H%M%SZ)-$$"
+declare -g GENERATION_SPEC_HASH=""
+# Seed for opc-retry-tokens; fixed at startup so subshells derive the same token
+declare -g OCI_RETRY_TOKEN_SEED="$$-$(date +%s)-$RANDOM$RANDOM"
+# Which create verbs the installed CLI offers --opc-retry-token for, one "<verb>\t<yes|no>"
+# line each; created by retry_token_init so subshells share it (empty = not cached)
+declare -g RETRY_TOKEN_VERBS_FILE=""
+declare -g TRACE_SPANS_FILE=""
+declare -ga TRACE_STACK_IDS=()
+declare -ga TRACE_STACK_NAMES=()
+declare -ga TRACE_STACK_STARTS=()
+declare -g METRICS_SERVER_PID=""
+declare -g KEYCHAIN_MATERIALIZED=""
+# Token bucket of this run, created by rate_limit_init (empty = no rate limiting)
+declare -g RATE_LIMIT_FILE=""
+declare -gA CHAOS_RATES=()
+declare -g CHAOS_STATE_DIR=""
+declare -g USAGE_FEATURE="setup"
+declare -ga USAGE_FLAGS=()
+declare -ga USAGE_PHASES=()
+# Run report state (see RUN REPORTS)
+declare -g RUN_STARTED_AT=""
+declare -g RUN_STARTED_MS=""
+declare -ga RUN_PHASE_NAMES=()
+declare -ga RUN_PHASE_STARTS=()
+declare -ga RUN_PHASE_RESULTS=()
+declare -g FLEET_JSON=""
+declare -g DRY_RUN_DIR=""
+declare -g LAYOUT_STAGE_DIR=""   # LAYOUT=modules: where the flat .tf files are collected
+declare -g ADOPTED_BLOCKS=""     # resource blocks holding imported resources (ADOPTED_FILE)
+declare -ga DRY_RUN_IMPORTS=()
+declare -ga TF_SELECTION_ARGS=()   # -target/-replace/-refresh-only, see prepare_terraform_selection
+
+# Pending imports: "<address>|<ocid>|<label>", run in dependency order by import_queued_resources
+declare -ga IMPORT_QUEUE=()
+declare -g SESSION_TOKEN_MTIME=""
+declare -g SESSION_TOKEN_REFRESHING=false
+declare -g OCI_LAST_ERROR=""
+
 # Global state tracking
 declare -g tenancy_ocid=""
 declare -g user_ocid=""
 declare -g region=""
+declare -g home_region=""
+# Region subscriptions of the tenancy as [{name, key, home, status}], see fetch_region_subscriptions
+declare -g REGION_SUBSCRIPTIONS=""
 declare -g fingerprint=""
 declare -g availability_domain=""
 declare -g ubuntu_image_ocid=""
 declare -g ubuntu_arm_flex_image_ocid=""
+# Marketplace subscriptions needed by the images: "amd"/"arm" => "<listing id>|<version>"
+declare -gA MARKETPLACE_IMAGES=()
+# This region's IMAGE_LOCK_FILE entry as built by fetch_instance_images
+declare -g IMAGE_LOCK_ENTRY="{}"
 declare -g ssh_public_key=""
 declare -g auth_method="security_token"
 
@@ -97,10 +634,28 @@ declare -gA EXISTING_SUBNETS=()
 declare -gA EXISTING_INTERNET_GATEWAYS=()
 declare -gA EXISTING_ROUTE_TABLES=()
 declare -gA EXISTING_SECURITY_LISTS=()
+declare -gA EXISTING_NSGS=()
+declare -gA EXISTING_RESERVED_IPS=()
 declare -gA EXISTING_AMD_INSTANCES=()
 declare -gA EXISTING_ARM_INSTANCES=()
 declare -gA EXISTING_BOOT_VOLUMES=()
+declare -gA OTHER_INSTANCES=()
+declare -gA INSTANCE_SHAPES=()
 declare -gA EXISTING_BLOCK_VOLUMES=()
+declare -gA EXISTING_AUTONOMOUS_DBS=()
+declare -gA EXISTING_CAPACITY_RESERVATIONS=()
+
+# Free Tier usage of resources outside MANAGED_TAG (counted for limits, never managed)
+declare -g UNMANAGED_AMD_INSTANCES=0
+declare -g UNMANAGED_ARM_OCPUS=0
+declare -g UNMANAGED_ARM_MEMORY_GB=0
+declare -g UNMANAGED_STORAGE_GB=0
+declare -g UNMANAGED_VCNS=0
+declare -g UNMANAGED_AUTONOMOUS_DBS=0
+
+# Existing boot/block volume backups (counted against the Always Free allowance)
+declare -g VOLUME_BACKUPS_SCHEDULED=0
+declare -g VOLUME_BACKUPS_MANUAL=0
 
 # Instance configuration
 declare -g amd_micro_instance_count=0
@@ -109,9 +664,18 @@ declare -g arm_flex_instance_count=0
 declare -g arm_flex_ocpus_per_instance=""
 declare -g arm_flex_memory_per_instance=""
 declare -g arm_flex_boot_volume_size_gb=""
+# Block volumes per instance: "0" or sizes joined by "+" (e.g. "100+50")
+declare -ga amd_block_volumes=()
 declare -ga arm_flex_block_volumes=()
 declare -ga amd_micro_hostnames=()
 declare -ga arm_flex_hostnames=()
+declare -ga FIREWALL_RULES=()
+
+# SUBNETS_FILE entries: "<name> <cidr> <public|private> <hostname,...>"
+declare -ga SUBNET_SPECS=()
+
+# lint findings: "<severity>\t<code>\t<file>\t<line>\t<message>\t<suggestion>"
+declare -ga LINT_FINDINGS=()
 
 # ============================================================================
 # LOGGING FUNCTIONS
@@ -190,2847 +754,17947 @@ print_subheader() {
 }
 
 # ============================================================================
-# UTILITY FUNCTIONS
+# CHAOS (FAULT INJECTION)
 # ============================================================================
+#
+# With CHAOS set, OCI CLI calls, terraform and ssh fail at the configured rates with the
+# same output the real failures produce, so the retry, capacity-hunting and resume paths
+# can be exercised against fixtures or a scratch tenancy. Decisions are recorded in
+# CHAOS_STATE_DIR so subshells share one sequence (and a seed replays it exactly).
 
-command_exists() {
-    command -v "$1" >/dev/null 2>&1
-}
+readonly CHAOS_KINDS="capacity throttle auth subprocess"
 
-is_wsl() {
-    grep -qiE "microsoft|wsl" /proc/version 2>/dev/null
+chaos_enabled() {
+    [ -n "$CHAOS_STATE_DIR" ]
 }
 
-default_region_for_host() {
-    # Best-effort heuristic when the user doesn't specify a region.
-    # Prefers "nearby" regions based on system timezone.
-    local tz
-    tz=$(cat /etc/timezone 2>/dev/null || true)
-    tz=${tz:-""}
-
-    case "$tz" in
-        *Chicago*|*Central*|*Winnipeg*|*Mexico_City*) echo "us-chicago-1" ;;
-        *New_York*|*Toronto*|*Montreal*|*Eastern*) echo "us-ashburn-1" ;;
-        *Los_Angeles*|*Vancouver*|*Pacific*) echo "us-sanjose-1" ;;
-        *Phoenix*|*Denver*|*Mountain*) echo "us-phoenix-1" ;;
-        *London*|*Dublin*) echo "uk-london-1" ;;
-        *Paris*|*Berlin*|*Rome*|*Madrid*|*Amsterdam*|*Stockholm*|*Zurich*|*Europe*) echo "eu-frankfurt-1" ;;
-        *Tokyo*) echo "ap-tokyo-1" ;;
-        *Seoul*) echo "ap-seoul-1" ;;
-        *Singapore*) echo "ap-singapore-1" ;;
-        *Sydney*|*Melbourne*) echo "ap-sydney-1" ;;
-        *) echo "us-chicago-1" ;;
-    esac
+# Parse CHAOS into CHAOS_RATES and wrap terraform/ssh; exits 2 on a malformed spec
+chaos_init() {
+    [ -n "$CHAOS" ] || return 0
+    local term kind rate
+    for term in ${CHAOS//,/ }; do
+        if [[ "$term" == *=* ]]; then
+            kind="${term%%=*}"
+            rate="${term#*=}"
+        else
+            kind=all
+            rate="$term"
+        fi
+        if [[ ! "$rate" =~ ^(0(\.[0-9]+)?|1(\.0+)?|\.[0-9]+|([0-9]{1,2}(\.[0-9]+)?|100)%)$ ]]; then
+            print_error "--chaos: '$rate' is not a rate (0-1 or N%)"
+            exit 2
+        fi
+        [[ "$rate" == *% ]] && rate=$(awk -v r="${rate%\%}" 'BEGIN { print r / 100 }')
+        if [ "$kind" = "all" ]; then
+            for kind in $CHAOS_KINDS; do
+                CHAOS_RATES[$kind]="$rate"
+            done
+        elif [[ " $CHAOS_KINDS " == *" $kind "* ]]; then
+            CHAOS_RATES[$kind]="$rate"
+        else
+            print_error "--chaos: unknown fault '$kind' (available: $CHAOS_KINDS)"
+            exit 2
+        fi
+    done
+    CHAOS_STATE_DIR=$(mktemp -d)
+    touch "$CHAOS_STATE_DIR/rolls" "$CHAOS_STATE_DIR/injected"
+    chaos_wrap_commands
+    print_warning "CHAOS: injecting faults ($(for kind in $CHAOS_KINDS; do printf '%s=%s ' "$kind" "${CHAOS_RATES[$kind]:-0}"; done)seed ${CHAOS_SEED:-random})" >&2
 }
 
-open_url_best_effort() {
-    local url="$1"
-    if [ -z "$url" ]; then
-        return 1
+# Succeeds with the probability configured for a fault kind
+chaos_roll() {
+    local rate="${CHAOS_RATES[$1]:-0}" n value
+    chaos_enabled || return 1
+    echo "$1" >> "$CHAOS_STATE_DIR/rolls"
+    if [ -n "$CHAOS_SEED" ]; then
+        # Arithmetic drops the padding BSD wc adds, so a seed replays the same on macOS
+        n=$(( $(wc -l < "$CHAOS_STATE_DIR/rolls") ))
+        value=$(( 16#$(printf '%s:%s' "$CHAOS_SEED" "$n" | sha256_stdin | cut -c1-4) ))
+    else
+        value=$(od -An -N2 -tu2 /dev/urandom | tr -d ' ')
     fi
+    awk -v r="$rate" -v v="$value" 'BEGIN { exit !(v / 65536 < r) }'
+}
 
-    if is_wsl && command_exists powershell.exe; then
-        # Open in Windows default browser with correct quoting (avoid cmd.exe splitting on '&')
-        powershell.exe -NoProfile -Command "Start-Process '$url'" >/dev/null 2>&1 || true
-        return 0
-    fi
+# Record and announce an injected fault
+chaos_note() {
+    printf '%s\t%s\n' "$1" "$2" >> "$CHAOS_STATE_DIR/injected"
+    print_warning "[chaos] injected $1 failure into: $2" >&2
+}
 
-    if command_exists xdg-open; then
-        xdg-open "$url" >/dev/null 2>&1 || true
-        return 0
+# Output of a simulated failed OCI CLI call (none = let the call through). Capacity
+# errors only hit launches; auth expiry looks like a lapsed session token.
+chaos_oci_fault() {
+    local cmd="$1" verb
+    chaos_enabled || return 1
+    verb=$(oci_command_verb "$cmd")
+    if [[ "$verb" == *" launch" ]] && chaos_roll capacity; then
+        chaos_note capacity "oci $verb"
+        echo 'ServiceError: {"code": "InternalError", "message": "Out of host capacity.", "status": 500, "operation_name": "launch_instance"}'
+    elif chaos_roll throttle; then
+        chaos_note throttle "oci $verb"
+        echo 'ServiceError: {"code": "TooManyRequests", "message": "Too many requests for the user", "status": 429}'
+    elif chaos_roll auth; then
+        chaos_note auth "oci $verb"
+        echo 'ServiceError: {"code": "NotAuthenticated", "message": "The required information to complete authentication was not provided or was incorrect.", "status": 401}'
+    elif chaos_roll subprocess; then
+        chaos_note subprocess "oci $verb"
+        echo "chaos: simulated OCI CLI crash"
+    else
+        return 1
     fi
+}
 
-    if command_exists open; then
-        open "$url" >/dev/null 2>&1 || true
+# Error output of a simulated failed terraform command (provider errors only for the
+# subcommands that call OCI)
+chaos_terraform_fault() {
+    local subcommand="$1"
+    case "$subcommand" in
+        apply|plan|import|refresh|destroy)
+            if [ "$subcommand" = "apply" ] && chaos_roll capacity; then
+                chaos_note capacity "terraform $subcommand"
+                printf '%s\n' "Error: 500-InternalError, Out of host capacity." \
+                    "Suggestion: The service for this resource encountered an error. Please contact support for help with service: Core Instance"
+                return 0
+            elif chaos_roll throttle; then
+                chaos_note throttle "terraform $subcommand"
+                echo "Error: 429-TooManyRequests, Too many requests for the user"
+                return 0
+            elif chaos_roll auth; then
+                chaos_note auth "terraform $subcommand"
+                echo "Error: 401-NotAuthenticated, The required information to complete authentication was not provided or was incorrect."
+                return 0
+            fi
+            ;;
+        version|fmt|-chdir=*)
+            return 1
+            ;;
+    esac
+    if chaos_roll subprocess; then
+        chaos_note subprocess "terraform $subcommand"
+        echo "chaos: simulated terraform crash"
         return 0
     fi
-
     return 1
 }
 
-read_oci_config_value() {
-    local key="$1"
-    local file="${2:-$OCI_CONFIG_FILE}"
-    local profile="${3:-$OCI_PROFILE}"
-
-    if [ ! -f "$file" ]; then
-        return 1
-    fi
-
-    awk -v key="$key" -v profile="$profile" '
-        BEGIN { section = "" }
-        /^[[:space:]]*\[/ { section = $0; next }
-        section == "["profile"]" {
-            line = $0
-            sub(/^[[:space:]]+/, "", line)
-            if (line ~ "^"key"[[:space:]]*=") {
-                sub("^"key"[[:space:]]*=", "", line)
-                gsub(/^[[:space:]]+|[[:space:]]+$/, "", line)
-                print line
-                exit
-            }
-        }
-    ' "$file"
+# Shadow the terraform and ssh binaries with functions that may fail instead of running
+chaos_wrap_commands() {
+    terraform() {
+        local fault
+        if fault=$(chaos_terraform_fault "${1:-}"); then
+            echo "$fault" >&2
+            return 1
+        fi
+        terraform_binary "$@"
+    }
+    ssh() {
+        if chaos_roll subprocess; then
+            chaos_note subprocess "ssh"
+            echo "ssh: connect to host: Connection timed out (chaos)" >&2
+            return 255
+        fi
+        ssh_binary "$@"
+    }
 }
 
-is_instance_principal_available() {
-    if ! command_exists curl; then
-        return 1
-    fi
-    # Quick reachability check to OCI metadata service (non-blocking)
-    curl -s --connect-timeout 1 --max-time 2 http://169.254.169.254/opc/v2/ >/dev/null 2>&1
+# One line per fault kind at exit, so a CI log shows what the run survived
+chaos_summary() {
+    chaos_enabled || return 0
+    local summary
+    summary=$(cut -f1 "$CHAOS_STATE_DIR/injected" | sort | uniq -c | awk '{ printf "%s%s=%s", (NR > 1 ? ", " : ""), $2, $1 }')
+    print_status "CHAOS: $(wc -l < "$CHAOS_STATE_DIR/rolls") rolls, faults injected: ${summary:-none}" >&2
+    rm -rf "$CHAOS_STATE_DIR"
 }
 
-validate_existing_oci_config() {
-    if [ ! -f "$OCI_CONFIG_FILE" ]; then
-        print_warning "OCI config not found at $OCI_CONFIG_FILE"
-        return 1
-    fi
+# ============================================================================
+# USAGE STATISTICS
+# ============================================================================
+#
+# Only fixed names are recorded - the command, global flag names (never their values) and
+# phase names - with run and failure counts. No hostnames, OCIDs, regions or config.
 
-    local cfg_auth
-    local key_file
-    local token_file
-    local pass_phrase
+usage_stats_enabled() {
+    case "$USAGE_STATS" in
+        true) return 0 ;;
+        false) return 1 ;;
+    esac
+    jq -e '.enabled == true' "$USAGE_STATS_FILE" >/dev/null 2>&1
+}
 
-    cfg_auth=$(read_oci_config_value "auth")
-    key_file=$(read_oci_config_value "key_file")
-    token_file=$(read_oci_config_value "security_token_file")
-    pass_phrase=$(read_oci_config_value "pass_phrase")
+# Remember a phase entered this run (called for every span, traced or not)
+usage_phase() {
+    [[ "$1" == cloudcradle* ]] && return 0
+    USAGE_PHASES+=("$1")
+}
 
-    if [ -n "$cfg_auth" ]; then
-        auth_method="$cfg_auth"
-    elif [ -n "$token_file" ]; then
-        auth_method="security_token"
-    elif [ -n "$key_file" ]; then
-        auth_method="api_key"
-    fi
+# Fold this run into USAGE_STATS_FILE; the last phase entered takes the blame for a failure
+usage_record() {
+    local rc="$1" failed=false
+    usage_stats_enabled || return 0
+    [ "$rc" -eq 0 ] || failed=true
+    mkdir -p "$(dirname "$USAGE_STATS_FILE")" 2>/dev/null || return 0
+    local current=""
+    [ -f "$USAGE_STATS_FILE" ] && current=$(cat "$USAGE_STATS_FILE" 2>/dev/null)
+    [ -n "$current" ] || current="{}"
+    jq -c --arg feature "$USAGE_FEATURE" --argjson failed "$failed" --arg now "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+        --argjson flags "$(printf '%s\n' "${USAGE_FLAGS[@]}" | jq -R . | jq -s -c 'map(select(length > 0)) | unique')" \
+        --argjson phases "$(printf '%s\n' "${USAGE_PHASES[@]}" | jq -R . | jq -s -c 'map(select(length > 0))')" '
+        def bump($f): .runs += 1 | .failures += (if $f then 1 else 0 end);
+        (if type == "object" then . else {} end)
+        # has(), not //: an explicit false from "usage disable" must survive a USAGE_STATS=true run
+        | .version = 1 | (if has("enabled") then . else .enabled = true end) | .since = (.since // $now) | .updated = $now
+        | .runs += 1 | .failures += (if $failed then 1 else 0 end)
+        | .features[$feature] |= (. // {runs: 0, failures: 0} | bump($failed))
+        | reduce $flags[] as $flag (.; .flags[$flag] |= (. // {runs: 0, failures: 0} | bump($failed)))
+        | reduce ($phases | unique)[] as $phase (.;
+            .phases[$phase] |= (. // {runs: 0, failures: 0} | bump($failed and $phase == ($phases | last))))' \
+        <<< "$current" > "$USAGE_STATS_FILE.tmp" 2>/dev/null \
+        && mv "$USAGE_STATS_FILE.tmp" "$USAGE_STATS_FILE"
+    rm -f "$USAGE_STATS_FILE.tmp"
+}
 
-    case "$auth_method" in
-        security_token)
-            if [ -z "$token_file" ] || [ ! -f "$token_file" ]; then
-                print_warning "security_token auth selected but security_token_file is missing"
-                return 1
+# usage [show [--json] | enable | disable | reset | submit [--yes]]
+usage_command() {
+    local action="${1:-show}"
+    case "$action" in
+        show)
+            if [ ! -f "$USAGE_STATS_FILE" ]; then
+                print_status "No usage statistics recorded (collection is $(usage_stats_enabled && echo on || echo off); 'usage enable' opts in)"
+                return 0
+            fi
+            if [ "${2:-}" = "--json" ]; then
+                jq 'del(.enabled)' "$USAGE_STATS_FILE"
+                return 0
             fi
+            print_subheader "Usage statistics ($USAGE_STATS_FILE)"
+            print_status "Collection is $(usage_stats_enabled && echo on || echo off); $(jq -r '"\(.runs // 0) runs, \(.failures // 0) failed, since \(.since // "-")"' "$USAGE_STATS_FILE")"
+            jq -r '(["features", "flags", "phases"][]) as $group | (.[$group] // {}) | to_entries
+                | sort_by(-.value.runs)[] | [$group, .key, .value.runs, .value.failures] | @tsv' "$USAGE_STATS_FILE" \
+                | while IFS=$'\t' read -r group name runs failures; do
+                    printf '  %-9s %-22s %6s runs %6s failed\n' "$group" "$name" "$runs" "$failures"
+                done
             ;;
-        api_key)
-            if [ -z "$key_file" ] || [ ! -f "$key_file" ]; then
-                print_warning "api_key auth selected but key_file is missing"
+        enable|disable)
+            mkdir -p "$(dirname "$USAGE_STATS_FILE")"
+            jq --argjson on "$([ "$action" = "enable" ] && echo true || echo false)" '.enabled = $on' \
+                <<< "$(cat "$USAGE_STATS_FILE" 2>/dev/null || echo '{}')" > "$USAGE_STATS_FILE.tmp" \
+                && mv "$USAGE_STATS_FILE.tmp" "$USAGE_STATS_FILE"
+            print_success "Usage statistics ${action}d ($USAGE_STATS_FILE)"
+            [ "$USAGE_STATS" != "" ] && print_warning "USAGE_STATS=$USAGE_STATS overrides this setting"
+            return 0
+            ;;
+        reset)
+            if [ -f "$USAGE_STATS_FILE" ]; then
+                jq '{enabled: .enabled}' "$USAGE_STATS_FILE" > "$USAGE_STATS_FILE.tmp" && mv "$USAGE_STATS_FILE.tmp" "$USAGE_STATS_FILE"
+            fi
+            print_success "Usage statistics cleared"
+            ;;
+        submit)
+            if [ -z "$USAGE_STATS_SUBMIT_URL" ]; then
+                print_error "Set USAGE_STATS_SUBMIT_URL to submit statistics (there is no default endpoint)"
+                return 2
+            fi
+            if [ ! -f "$USAGE_STATS_FILE" ]; then
+                print_error "No usage statistics recorded"
                 return 1
             fi
-            if grep -q "ENCRYPTED" "$key_file" 2>/dev/null; then
-                if [ -z "${OCI_CLI_PASSPHRASE:-$pass_phrase}" ]; then
-                    print_warning "Private key is encrypted but no passphrase provided (set OCI_CLI_PASSPHRASE or pass_phrase in config)"
-                    return 1
-                fi
+            local payload
+            payload=$(jq -c 'del(.enabled)' "$USAGE_STATS_FILE")
+            print_status "This anonymous summary would be sent to $USAGE_STATS_SUBMIT_URL:"
+            jq . <<< "$payload"
+            if [ "${2:-}" != "--yes" ] && ! confirm_action "Submit it?" "N"; then
+                return 1
             fi
-            ;;
-        instance_principal|resource_principal|oke_workload_identity|instance_obo_user)
-            if ! is_instance_principal_available; then
-                print_warning "Instance principal auth selected but OCI metadata service is unreachable"
+            if curl -fsS -o /dev/null --max-time 15 -X POST -H "Content-Type: application/json" \
+                --data-binary "$payload" "$USAGE_STATS_SUBMIT_URL"; then
+                print_success "Usage statistics submitted"
+            else
+                print_error "Submitting to $USAGE_STATS_SUBMIT_URL failed"
                 return 1
             fi
             ;;
-        "")
-            print_warning "Unable to determine auth method from config"
-            return 1
-            ;;
         *)
-            print_warning "Unsupported auth method '$auth_method' in config"
-            return 1
+            print_error "Usage: usage [show [--json] | enable | disable | reset | submit [--yes]]"
+            return 2
             ;;
     esac
+}
 
-    return 0
+# ============================================================================
+# TRACING FUNCTIONS
+# ============================================================================
+
+tracing_enabled() {
+    [ -n "$TRACE_SPANS_FILE" ]
 }
 
-# Run OCI command with proper authentication handling
-oci_cmd() {
-    local cmd="$*"
-    local result=""
-    local exit_code=0
-    local base_args
+trace_random_hex() {
+    od -An -tx1 -N"$1" /dev/urandom | tr -d ' \n'
+}
 
-    base_args="--config-file \"$OCI_CONFIG_FILE\" --profile \"$OCI_PROFILE\" --connection-timeout $OCI_CLI_CONNECTION_TIMEOUT --read-timeout $OCI_CLI_READ_TIMEOUT --max-retries $OCI_CLI_MAX_RETRIES"
-    if [ -n "${OCI_CLI_AUTH:-}" ]; then
-        base_args="$base_args --auth $OCI_CLI_AUTH"
-    elif [ -n "$auth_method" ]; then
-        base_args="$base_args --auth $auth_method"
+trace_now_nanos() {
+    if [ -n "${EPOCHREALTIME:-}" ]; then
+        echo "${EPOCHREALTIME/[.,]/}000"
+    else
+        echo "$(date +%s)000000000"
     fi
+}
 
-    # Internal helper to run with timeout when available
-    _run_oci_with_timeout() {
-        local full_cmd="oci $base_args $cmd $*"
-        if command_exists timeout; then
-            # Use coreutils timeout for safety
-            result=$(timeout "${OCI_CMD_TIMEOUT}s" bash -c "$full_cmd" </dev/null 2>&1) && exit_code=0 || exit_code=$?
-        else
-            # Fallback: run normally (may block if OCI CLI hangs)
-            result=$(eval "$full_cmd" </dev/null 2>&1) && exit_code=0 || exit_code=$?
-        fi
-    }
-
-    _run_oci_with_timeout ""
-    if [ $exit_code -eq 0 ]; then
-        echo "$result"
+# Start a trace for this run if an OTLP endpoint is configured
+trace_init() {
+    if [ -z "$OTEL_TRACES_ENDPOINT" ] || ! command_exists curl || ! command_exists jq; then
         return 0
     fi
-    if [ $exit_code -eq 124 ]; then
-        print_warning "OCI CLI call timed out after ${OCI_CMD_TIMEOUT}s"
-    fi
-
-    return 1
+    TRACE_ID=$(trace_random_hex 16)
+    TRACE_SPANS_FILE=$(mktemp)
+    trace_start "${1:-cloudcradle.run}"
+    print_debug "Tracing enabled (trace_id=$TRACE_ID, endpoint=$OTEL_TRACES_ENDPOINT)"
 }
 
-# Safe JSON parsing with jq
-safe_jq() {
-    local json="$1"
-    local query="$2"
-    local default="${3:-}"
-    
-    if [ -z "$json" ] || [ "$json" = "null" ]; then
-        echo "$default"
+# Append one finished span. Safe from subshells since spans go to a shared file.
+trace_record_span() {
+    local span_id="$1" parent_id="$2" name="$3" start="$4" end="$5" status_code="$6"
+    shift 6
+
+    local attrs="[]"
+    local kv
+    for kv in "$@"; do
+        attrs=$(jq -c --arg k "${kv%%=*}" --arg v "${kv#*=}" '. + [{key: $k, value: {stringValue: $v}}]' <<< "$attrs")
+    done
+
+    jq -nc \
+        --arg trace_id "$TRACE_ID" --arg span_id "$span_id" --arg parent_id "$parent_id" \
+        --arg name "$name" --arg start_ns "$start" --arg end_ns "$end" \
+        --argjson status "$status_code" --argjson attrs "$attrs" \
+        '{traceId: $trace_id, spanId: $span_id, name: $name, kind: 1,
+          startTimeUnixNano: $start_ns, endTimeUnixNano: $end_ns,
+          attributes: $attrs, status: {code: $status}}
+         + (if $parent_id == "" then {} else {parentSpanId: $parent_id} end)' \
+        >> "$TRACE_SPANS_FILE" 2>/dev/null || true
+}
+
+trace_current_span_id() {
+    local depth=${#TRACE_STACK_IDS[@]}
+    [ "$depth" -gt 0 ] && echo "${TRACE_STACK_IDS[$((depth - 1))]}"
+    return 0
+}
+
+# Open a span that becomes the parent of subsequent spans until trace_end
+trace_start() {
+    usage_phase "$1"
+    run_phase_start "$1"
+    tracing_enabled || return 0
+    TRACE_STACK_IDS+=("$(trace_random_hex 8)")
+    TRACE_STACK_NAMES+=("$1")
+    TRACE_STACK_STARTS+=("$(trace_now_nanos)")
+}
+
+# Close the innermost open span; status is "ok" (default) or "error"
+trace_end() {
+    run_phase_end "${1:-ok}"
+    tracing_enabled || return 0
+    local depth=${#TRACE_STACK_IDS[@]}
+    [ "$depth" -gt 0 ] || return 0
+
+    local top=$((depth - 1))
+    local span_id="${TRACE_STACK_IDS[$top]}"
+    local name="${TRACE_STACK_NAMES[$top]}"
+    local start="${TRACE_STACK_STARTS[$top]}"
+    unset "TRACE_STACK_IDS[$top]" "TRACE_STACK_NAMES[$top]" "TRACE_STACK_STARTS[$top]"
+
+    local status_code=1
+    [ "${1:-ok}" = "error" ] && status_code=2
+    trace_record_span "$span_id" "$(trace_current_span_id)" "$name" "$start" "$(trace_now_nanos)" "$status_code"
+}
+
+# Run a command inside its own span and return its exit code
+trace_run() {
+    local name="$1"
+    shift
+    usage_phase "$name"
+    if ! tracing_enabled && ! run_reports_enabled; then
+        "$@"
         return
     fi
-    
-    local result
-    result=$(echo "$json" | jq -r "$query" 2>/dev/null) || result="$default"
-    
-    if [ "$result" = "null" ] || [ -z "$result" ]; then
-        echo "$default"
+
+    local rc=0
+    trace_start "$name"
+    "$@" || rc=$?
+    if [ "$rc" -eq 0 ]; then
+        trace_end ok
     else
-        echo "$result"
+        trace_end error
     fi
+    return "$rc"
 }
 
-# Run a command with retry/backoff, detect Out-of-Capacity signals
-retry_with_backoff() {
-    local cmd="$*"
-    local attempt=1
-    local rc=1
-    local out
-
-    while [ "$attempt" -le "$RETRY_MAX_ATTEMPTS" ]; do
-        print_status "Attempt $attempt/$RETRY_MAX_ATTEMPTS: $cmd"
-        out=$(eval "$cmd" 2>&1) && rc=0 || rc=$?
+# Close any spans left open by an early exit and POST everything to the collector
+trace_flush() {
+    tracing_enabled || return 0
+    local exit_code="${1:-0}"
 
-        if [ $rc -eq 0 ]; then
-            echo "$out"
-            return 0
+    while [ ${#TRACE_STACK_IDS[@]} -gt 0 ]; do
+        if [ "$exit_code" -eq 0 ]; then
+            trace_end ok
+        else
+            trace_end error
         fi
+    done
 
-        # Detect Out-of-Capacity patterns
-        if echo "$out" | grep -i -E "out of capacity|out of host capacity|OutOfCapacity|OutOfHostCapacity" >/dev/null 2>&1; then
-            print_warning "Detected 'Out of Capacity' condition (attempt $attempt)."
-            # If we've exhausted attempts, bail
+    local payload
+    payload=$(jq -sc --arg service "$OTEL_SERVICE_NAME" \
+        '{resourceSpans: [{
+            resource: {attributes: [{key: "service.name", value: {stringValue: $service}}]},
+            scopeSpans: [{scope: {name: "cloudcradle"}, spans: .}]
+          }]}' "$TRACE_SPANS_FILE" 2>/dev/null) || payload=""
+
+    if [ -n "$payload" ]; then
+        local header_args=()
+        local header
+        IFS=',' read -r -a headers <<< "$OTEL_EXPORTER_OTLP_HEADERS"
+        for header in "${headers[@]}"; do
+            [ -n "$header" ] && header_args+=(-H "${header%%=*}: ${header#*=}")
+        done
+        if curl -s -o /dev/null --max-time 10 -X POST "$OTEL_TRACES_ENDPOINT" \
+            -H "Content-Type: application/json" "${header_args[@]}" --data-binary "$payload"; then
+            print_debug "Exported trace $TRACE_ID to $OTEL_TRACES_ENDPOINT"
         else
-            print_warning "Command failed (exit $rc)."
+            print_warning "Failed to export trace to $OTEL_TRACES_ENDPOINT"
         fi
+    fi
 
-        local sleep_time=$(( RETRY_BASE_DELAY * (2 ** (attempt - 1)) ))
-        print_status "Retrying in ${sleep_time}s..."
-        sleep $sleep_time
-        attempt=$((attempt + 1))
+    rm -f "$TRACE_SPANS_FILE"
+    TRACE_SPANS_FILE=""
+}
+
+# ============================================================================
+# RUN REPORTS
+# ============================================================================
+#
+# RESULT_FILE and EVENTS_FILE follow the phases the tracing functions open and close, so
+# they work with or without an OTLP endpoint. Phases entered in subshells only show up in
+# the event stream.
+
+run_reports_enabled() {
+    [ -n "$RESULT_FILE" ] || [ -n "$EVENTS_FILE" ]
+}
+
+run_now_ms() {
+    if [ -n "${EPOCHREALTIME:-}" ]; then
+        echo $(( ${EPOCHREALTIME/[.,]/} / 1000 ))
+    else
+        echo "$(date +%s)000"
+    fi
+}
+
+# Append one line to EVENTS_FILE: event_emit EVENT [JSON object of further fields]
+event_emit() {
+    [ -n "$EVENTS_FILE" ] || return 0
+    local fields="${2:-}"
+    [ -n "$fields" ] || fields="{}"
+    jq -nc --arg ts "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --arg run "$CLOUDCRADLE_RUN_ID" --arg event "$1" --argjson fields "$fields" \
+        '{ts: $ts, run: $run, event: $event} + $fields' >> "$EVENTS_FILE" 2>/dev/null || true
+}
+
+# The run started: run_report_start COMMAND
+run_report_start() {
+    run_reports_enabled || return 0
+    RUN_STARTED_AT=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+    RUN_STARTED_MS=$(run_now_ms)
+    event_emit run_start "$(jq -nc --arg command "$1" --arg version "$CLOUDCRADLE_VERSION" '{command: $command, version: $version}')"
+}
+
+run_phase_start() {
+    run_reports_enabled || return 0
+    # The root span is the run itself
+    [[ "$1" == cloudcradle* ]] && return 0
+    RUN_PHASE_NAMES+=("$1")
+    RUN_PHASE_STARTS+=("$(run_now_ms)")
+    event_emit phase_start "$(jq -nc --arg phase "$1" '{phase: $phase}')"
+}
+
+# Close the innermost phase; status is "ok" or "error"
+run_phase_end() {
+    local depth=${#RUN_PHASE_NAMES[@]}
+    [ "$depth" -gt 0 ] || return 0
+    local top=$((depth - 1)) name ms
+    name="${RUN_PHASE_NAMES[$top]}"
+    ms=$(( $(run_now_ms) - RUN_PHASE_STARTS[top] ))
+    unset "RUN_PHASE_NAMES[$top]" "RUN_PHASE_STARTS[$top]"
+    RUN_PHASE_RESULTS+=("$name|$1|$ms")
+    event_emit phase_end "$(jq -nc --arg phase "$name" --arg status "$1" --argjson ms "$ms" '{phase: $phase, status: $status, duration_ms: $ms}')"
+}
+
+# Close phases left open by an early exit, then emit run_end and write RESULT_FILE
+run_report_finish() {
+    local rc="$1" status=ok
+    run_reports_enabled && [ -n "$RUN_STARTED_MS" ] || return 0
+    [ "$rc" -eq 0 ] || status=error
+    while [ ${#RUN_PHASE_NAMES[@]} -gt 0 ]; do
+        run_phase_end "$status"
     done
 
-    print_error "Command failed after $RETRY_MAX_ATTEMPTS attempts"
-    echo "$out"
-    return $rc
+    local summary
+    summary=$(jq -nc --arg command "$USAGE_FEATURE" --argjson rc "$rc" --arg status "$status" \
+        --argjson ms "$(( $(run_now_ms) - RUN_STARTED_MS ))" \
+        '{command: $command, status: $status, exit_code: $rc, duration_ms: $ms}')
+    event_emit run_end "$summary"
+    [ -n "$RESULT_FILE" ] || return 0
+
+    printf '%s\n' "${RUN_PHASE_RESULTS[@]}" | jq -R -s -c --argjson summary "$summary" \
+        --arg run "$CLOUDCRADLE_RUN_ID" --arg version "$CLOUDCRADLE_VERSION" --arg started "$RUN_STARTED_AT" \
+        --arg finished "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --argjson dry_run "$([ "$DRY_RUN" = "true" ] && echo true || echo false)" '
+        [split("\n")[] | select(length > 0) | split("|") | {name: .[0], status: .[1], duration_ms: (.[2] | tonumber)}] as $phases
+        | {version: 1, run: $run, tool_version: $version} + $summary
+          + {started: $started, finished: $finished, dry_run: $dry_run, phases: $phases,
+             failed_phase: ([$phases[] | select(.status == "error") | .name] | last)}' \
+        > "$RESULT_FILE.tmp" 2>/dev/null && mv "$RESULT_FILE.tmp" "$RESULT_FILE"
+    rm -f "$RESULT_FILE.tmp"
 }
 
-# A simpler wrapper that returns true/false and sets OUT_OF_CAPACITY_DETECTED=1 when detected
-run_cmd_with_retries_and_check() {
-    local cmd="$*"
-    local out
-    # shellcheck disable=SC2034  # OUT_OF_CAPACITY_DETECTED is set for callers to inspect
-    OUT_OF_CAPACITY_DETECTED=0
+# ============================================================================
+# UTILITY FUNCTIONS
+# ============================================================================
 
-    out=$(retry_with_backoff "$cmd") || true
-    if echo "$out" | grep -i -E "out of capacity|out of host capacity|OutOfCapacity|OutOfHostCapacity" >/dev/null 2>&1; then
-        # shellcheck disable=SC2034  # exported flag for callers/tests
-        OUT_OF_CAPACITY_DETECTED=1
-    fi
+command_exists() {
+    command -v "$1" >/dev/null 2>&1
+}
 
-    # Return success if last command succeeded
-    grep -q "^\{" <<< "$out" 2>/dev/null || true
-    # We cannot rely on JSON only; instead rely on previous command exit status from retry_with_backoff
-    return $?
+is_wsl() {
+    grep -qiE "microsoft|wsl" /proc/version 2>/dev/null
 }
 
-# Automatically re-run terraform apply until success on 'Out of Capacity', with backoff
-out_of_capacity_auto_apply() {
-    print_status "Auto-retrying terraform apply until success or max attempts (${RETRY_MAX_ATTEMPTS})..."
-    local attempt=1
-    local rc=1
-    local out
+# The login browser runs on Windows: the OCI CLI cannot open it, so the setup opens its URL
+uses_windows_browser() {
+    is_wsl || is_windows
+}
 
-    while [ "$attempt" -le "$RETRY_MAX_ATTEMPTS" ]; do
-        print_status "Apply attempt $attempt/$RETRY_MAX_ATTEMPTS"
-        out=$(terraform apply -input=false tfplan 2>&1) && rc=0 || rc=$?
+# Native Windows shell: Git Bash, MSYS2 or Cygwin (not WSL, which is Linux)
+is_windows() {
+    case "${OSTYPE:-}" in
+        msys*|cygwin*|win32*) return 0 ;;
+    esac
+    case "$(uname -s 2>/dev/null)" in
+        MINGW*|MSYS*|CYGWIN*) return 0 ;;
+    esac
+    return 1
+}
 
-        if [ $rc -eq 0 ]; then
-            print_success "terraform apply succeeded"
-            return 0
+# A path from the OCI config (~/..., C:\Users\..., or a POSIX path) as this shell sees it
+oci_config_path() {
+    local path="$1"
+    [ -n "$path" ] || return 0
+    path="${path/#\~/$HOME}"
+    if [[ "$path" =~ ^[A-Za-z]:[\\/] ]]; then
+        if is_windows && command_exists cygpath; then
+            path=$(cygpath -u "$path")
+        elif is_wsl && command_exists wslpath; then
+            path=$(wslpath -u "$path")
         fi
+    fi
+    echo "$path"
+}
 
-        if echo "$out" | grep -i -E "out of capacity|out of host capacity|OutOfCapacity|OutOfHostCapacity" >/dev/null 2>&1; then
-            print_warning "Apply failed with 'Out of Capacity' - will retry"
-        else
-            print_error "terraform apply failed with non-retryable error"
-            echo "$out"
-            return $rc
-        fi
+# A path as the OCI CLI expects it in its config: a Windows path for the Windows CLI
+oci_native_path() {
+    if is_windows && command_exists cygpath; then
+        cygpath -w "$1"
+    else
+        echo "$1"
+    fi
+}
 
-        local sleep_time=$(( RETRY_BASE_DELAY * (2 ** (attempt - 1)) ))
-        print_status "Waiting ${sleep_time}s before retrying..."
-        sleep $sleep_time
-        attempt=$((attempt + 1))
+# The ssh client: OpenSSH on PATH, otherwise Windows' own ssh.exe (Git Bash without its
+# OpenSSH, WSL without openssh-client). Fails when there is none.
+ssh_client() {
+    local candidate
+    for candidate in ssh ssh.exe; do
+        type -P "$candidate" 2>/dev/null && return 0
     done
-
-    print_error "terraform apply did not succeed after $RETRY_MAX_ATTEMPTS attempts"
-    echo "$out"
+    if is_windows || is_wsl; then
+        candidate="$(oci_config_path "${SYSTEMROOT:-C:\\Windows}")/System32/OpenSSH/ssh.exe"
+        [ -x "$candidate" ] && echo "$candidate" && return 0
+    fi
     return 1
 }
 
-# Create an OCI Object Storage bucket (S3-compatible) for remote TF state if requested
-create_s3_backend_bucket() {
-    local bucket_name="$1"
-    if [ -z "$bucket_name" ]; then
-        print_error "Bucket name is empty"
-        return 1
+ssh_binary() {
+    command "$(ssh_client || echo ssh)" "$@"
+}
+
+# Route the ssh command to ssh.exe when there is no OpenSSH on PATH
+use_ssh_client() {
+    type -P ssh >/dev/null 2>&1 && return 0
+    # Keep the chaos wrapper if there is one; it already goes through ssh_binary
+    declare -F ssh >/dev/null || ssh() { ssh_binary "$@"; }
+}
+
+# Windows' ssh.exe refuses a private key other accounts can read, and chmod does not
+# change NTFS permissions: leave the current user as the only reader
+windows_protect_key() {
+    local path="$1"
+    case "$(ssh_client)" in *.exe) ;; *) return 0 ;; esac
+    command_exists icacls.exe || return 0
+    if is_windows && command_exists cygpath; then
+        path=$(cygpath -w "$path")
+    elif is_wsl && command_exists wslpath; then
+        path=$(wslpath -w "$path")
     fi
+    icacls.exe "$path" /inheritance:r /grant:r "${USERNAME:-$USER}:R" >/dev/null 2>&1 || true
+}
 
-    print_status "Creating/checking OCI Object Storage bucket: $bucket_name"
+default_region_for_host() {
+    # Best-effort heuristic when the user doesn't specify a region.
+    # Prefers "nearby" regions based on system timezone.
+    local tz
+    tz=$(cat /etc/timezone 2>/dev/null || true)
+    tz=${tz:-""}
 
-    local ns
-    ns=$(oci_cmd "os ns get --query 'data' --raw-output" 2>/dev/null) || ns=""
-    if [ -z "$ns" ]; then
-        print_error "Failed to determine Object Storage namespace"
+    case "$tz" in
+        *Chicago*|*Central*|*Winnipeg*|*Mexico_City*) echo "us-chicago-1" ;;
+        *New_York*|*Toronto*|*Montreal*|*Eastern*) echo "us-ashburn-1" ;;
+        *Los_Angeles*|*Vancouver*|*Pacific*) echo "us-sanjose-1" ;;
+        *Phoenix*|*Denver*|*Mountain*) echo "us-phoenix-1" ;;
+        *London*|*Dublin*) echo "uk-london-1" ;;
+        *Paris*|*Berlin*|*Rome*|*Madrid*|*Amsterdam*|*Stockholm*|*Zurich*|*Europe*) echo "eu-frankfurt-1" ;;
+        *Tokyo*) echo "ap-tokyo-1" ;;
+        *Seoul*) echo "ap-seoul-1" ;;
+        *Singapore*) echo "ap-singapore-1" ;;
+        *Sydney*|*Melbourne*) echo "ap-sydney-1" ;;
+        *) echo "us-chicago-1" ;;
+    esac
+}
+
+# Commercial regions probed for the first login, when no region is configured yet
+readonly OCI_PUBLIC_REGIONS="af-johannesburg-1 ap-chuncheon-1 ap-hyderabad-1 ap-melbourne-1 ap-mumbai-1
+ap-osaka-1 ap-seoul-1 ap-singapore-1 ap-sydney-1 ap-tokyo-1 ca-montreal-1 ca-toronto-1 eu-amsterdam-1
+eu-frankfurt-1 eu-madrid-1 eu-marseille-1 eu-milan-1 eu-paris-1 eu-stockholm-1 eu-zurich-1
+il-jerusalem-1 me-abudhabi-1 me-dubai-1 me-jeddah-1 mx-monterrey-1 mx-queretaro-1 sa-bogota-1
+sa-santiago-1 sa-saopaulo-1 sa-valparaiso-1 sa-vinhedo-1 uk-cardiff-1 uk-london-1 us-ashburn-1
+us-chicago-1 us-phoenix-1 us-sanjose-1"
+
+# Connect time (TCP + TLS) from this machine to each region's identity endpoint, probed in
+# parallel: "region<TAB>ms" lines, fastest first; unreachable regions are left out
+region_latencies() {
+    if [ "$REGION_LATENCY_PROBE" != "true" ] || ! command_exists curl || [ $# -eq 0 ]; then
+        return 0
+    fi
+    local dir name pids=()
+    dir=$(mktemp -d)
+    for name in "$@"; do
+        curl -o /dev/null -s --max-time 3 -w '%{time_appconnect}' "https://identity.$name.oraclecloud.com/" \
+            > "$dir/$name" 2>/dev/null &
+        pids+=($!)
+    done
+    wait "${pids[@]}" 2>/dev/null || true
+    for name in "$@"; do
+        awk -v r="$name" '$1 > 0 { printf "%s\t%d\n", r, $1 * 1000 }' "$dir/$name" 2>/dev/null
+    done | sort -t$'\t' -k2,2n
+    rm -rf "$dir"
+}
+
+# A1 launch outcomes recorded for REGION in CAPACITY_HISTORY_FILE, empty without history
+region_capacity_hint() {
+    [ -s "$CAPACITY_HISTORY_FILE" ] || return 0
+    jq -rs --arg r "$1" --arg shape "$FREE_TIER_ARM_SHAPE" '
+        [.[] | select(.region == $r and .shape == $shape)] as $events
+        | [$events[] | select(.result == "success")] as $ok
+        | if ($events | length) == 0 then empty else
+            "A1 \($ok | length)/\($events | length) launches succeeded"
+            + (if ($ok | length) > 0 then ", last \($ok | map(.ts) | max | .[0:10])" else "" end)
+          end' "$CAPACITY_HISTORY_FILE" 2>/dev/null || true
+}
+
+# "  23 ms  A1 3/10 launches succeeded, last 2026-10-01" for REGION from region_latencies output
+region_hint() {
+    local name="$1" latencies="$2" ms
+    ms=$(awk -F'\t' -v r="$name" '$1 == r { print $2 }' <<< "$latencies")
+    printf '%7s  %s' "${ms:+$ms ms}" "$(region_capacity_hint "$name")"
+}
+
+# Region for a first login: list the closest regions by measured connect time (with any
+# recorded capacity history) on stderr and print the fastest; the timezone guess otherwise
+suggest_auth_region() {
+    local latencies name i=0
+    # shellcheck disable=SC2086  # the region list is split on whitespace
+    latencies=$(region_latencies $OCI_PUBLIC_REGIONS)
+    if [ -z "$latencies" ]; then
+        default_region_for_host
+        return 0
+    fi
+    print_status "Closest OCI regions from this machine (choose your tenancy's home region if you know it):" >&2
+    while IFS=$'\t' read -r name _; do
+        printf '  %-20s%s\n' "$name" "$(region_hint "$name" "$latencies")" >&2
+        i=$((i + 1))
+        [ "$i" -lt 6 ] || break
+    done <<< "$latencies"
+    head -1 <<< "$latencies" | cut -f1
+}
+
+open_url_best_effort() {
+    local url="$1"
+    if [ -z "$url" ]; then
         return 1
     fi
 
-    # Check if bucket exists
-    if oci_cmd "os bucket get --namespace-name $ns --bucket-name $bucket_name" >/dev/null 2>&1; then
-        print_status "Bucket $bucket_name already exists in namespace $ns"
+    if uses_windows_browser; then
+        # The Windows default browser. rundll32 takes the URL as one argument; cmd's start
+        # needs '&' escaped, or it splits the URL into commands.
+        if command_exists rundll32.exe || command_exists rundll32; then
+            "$(command -v rundll32.exe || command -v rundll32)" url.dll,FileProtocolHandler "$url" >/dev/null 2>&1 || true
+            return 0
+        fi
+        if command_exists cmd.exe; then
+            cmd.exe /c start "" "${url//&/^&}" >/dev/null 2>&1 || true
+            return 0
+        fi
+    fi
+
+    if command_exists xdg-open; then
+        xdg-open "$url" >/dev/null 2>&1 || true
         return 0
     fi
 
-    if oci_cmd "os bucket create --namespace-name $ns --compartment-id $tenancy_ocid --name $bucket_name --is-versioning-enabled true" >/dev/null 2>&1; then
-        print_success "Created bucket $bucket_name in namespace $ns"
+    if command_exists open; then
+        open "$url" >/dev/null 2>&1 || true
         return 0
     fi
 
-    print_error "Failed to create bucket $bucket_name"
     return 1
 }
 
-# Configure terraform backend if TF_BACKEND=oci
-configure_terraform_backend() {
-    if [ "$TF_BACKEND" != "oci" ]; then
-        return 0
-    fi
+read_oci_config_value() {
+    local key="$1"
+    local file="${2:-$OCI_CONFIG_FILE}"
+    local profile="${3:-$OCI_PROFILE}"
 
-    if [ -z "$TF_BACKEND_BUCKET" ]; then
-        print_error "TF_BACKEND is 'oci' but TF_BACKEND_BUCKET is not set"
+    if [ ! -f "$file" ]; then
         return 1
     fi
 
-    TF_BACKEND_REGION=${TF_BACKEND_REGION:-$region}
-    TF_BACKEND_ENDPOINT=${TF_BACKEND_ENDPOINT:-"https://objectstorage.${TF_BACKEND_REGION}.oraclecloud.com"}
+    awk -v key="$key" -v profile="$profile" '
+        BEGIN { section = "" }
+        /^[[:space:]]*\[/ { section = $0; next }
+        section == "["profile"]" {
+            line = $0
+            sub(/^[[:space:]]+/, "", line)
+            if (line ~ "^"key"[[:space:]]*=") {
+                sub("^"key"[[:space:]]*=", "", line)
+                gsub(/^[[:space:]]+|[[:space:]]+$/, "", line)
+                print line
+                exit
+            }
+        }
+    ' "$file"
+}
 
-    if [ "$TF_BACKEND_CREATE_BUCKET" = "true" ]; then
-        create_s3_backend_bucket "$TF_BACKEND_BUCKET" || return 1
+is_instance_principal_available() {
+    if ! command_exists curl; then
+        return 1
     fi
-
-    # Write backend override (sensitive; keep out of VCS)
-    print_status "Writing backend.tf (do not commit -- contains sensitive values)"
-    cat > backend.tf <<EOF
-terraform {
-  backend "s3" {
-    bucket     = "$TF_BACKEND_BUCKET"
-    key        = "$TF_BACKEND_STATE_KEY"
-    region     = "$TF_BACKEND_REGION"
-    endpoint   = "$TF_BACKEND_ENDPOINT"
-    access_key = "$TF_BACKEND_ACCESS_KEY"
-    secret_key = "$TF_BACKEND_SECRET_KEY"
-    skip_credentials_validation = true
-    skip_region_validation = true
-    skip_metadata_api_check = true
-    force_path_style = true
-  }
+    # Quick reachability check to OCI metadata service (non-blocking)
+    curl -s --connect-timeout 1 --max-time 2 http://169.254.169.254/opc/v2/ >/dev/null 2>&1
 }
-EOF
-    print_warning "backend.tf written - ensure this file is in .gitignore (contains credentials if provided)"
+
+# ============================================================================
+# SESSION TOKEN HANDLING
+# ============================================================================
+
+# Absolute path of the profile's security_token_file (empty when not a session profile)
+session_token_file() {
+    local token_file
+    token_file=$(read_oci_config_value "security_token_file" 2>/dev/null || true)
+    oci_config_path "$token_file"
 }
 
-# Confirm action with user
-confirm_action() {
-    local prompt="$1"
-    local default="${2:-N}"
-    
-    if [ "$NON_INTERACTIVE" = "true" ]; then
-        [ "$default" = "Y" ] && return 0 || return 1
-    fi
-    
-    local yn_prompt
-    if [ "$default" = "Y" ]; then
-        yn_prompt="[Y/n]"
-    else
-        yn_prompt="[y/N]"
-    fi
-    
-    echo -n -e "${BLUE}$prompt $yn_prompt: ${NC}"
-    read -r response
-    response=${response:-$default}
-    
-    [[ "$response" =~ ^[Yy]$ ]]
+# Expiry of a session token (JWT "exp" claim) as epoch seconds
+session_token_expiry() {
+    local payload
+    payload=$(cut -d. -f2 "$1" 2>/dev/null | tr '_-' '/+') || return 1
+    while [ $(( ${#payload} % 4 )) -ne 0 ]; do
+        payload="${payload}="
+    done
+    echo "$payload" | base64 -d 2>/dev/null | jq -er '.exp' 2>/dev/null
 }
 
-# ============================================================================
-# INSTALLATION FUNCTIONS
-# ============================================================================
+# Called before every OCI call on session profiles: notices tokens rewritten by another
+# process (e.g. a parallel `oci session refresh`) and refreshes tokens close to expiry,
+# so long-running commands such as serve-metrics keep working past the token lifetime.
+ensure_session_token_fresh() {
+    [ "$auth_method" = "security_token" ] || return 0
+    [ "$SESSION_TOKEN_REFRESHING" = "true" ] && return 0
+    [ -z "$OCI_CLI_FIXTURES_DIR" ] || return 0
 
-install_prerequisites() {
-    print_subheader "Installing Prerequisites"
-    
-    local packages_to_install=()
-    
-    # Check for required commands
-    if ! command_exists jq; then
-        packages_to_install+=("jq")
-    fi
-    if ! command_exists curl; then
-        packages_to_install+=("curl")
+    local token_file mtime expiry now
+    token_file=$(session_token_file)
+    [ -n "$token_file" ] && [ -f "$token_file" ] || return 0
+
+    mtime=$(file_mtime "$token_file" || echo "")
+    if [ -n "$SESSION_TOKEN_MTIME" ] && [ "$mtime" != "$SESSION_TOKEN_MTIME" ]; then
+        print_debug "Session token file changed on disk; using the refreshed token" >&2
     fi
-    if ! command_exists unzip; then
-        packages_to_install+=("unzip")
+    SESSION_TOKEN_MTIME="$mtime"
+
+    expiry=$(session_token_expiry "$token_file") || return 0
+    now=$(date +%s)
+    if [ "$expiry" -le "$now" ]; then
+        print_warning "Session token for profile '$OCI_PROFILE' expired at $(jq -nr --argjson t "$expiry" '$t | todate' 2>/dev/null || echo "$expiry")" >&2
+        return 0
     fi
-    
-    if [ ${#packages_to_install[@]} -gt 0 ]; then
-        print_status "Installing required packages: ${packages_to_install[*]}"
-        if command_exists apt-get; then
-            sudo apt-get update -qq
-            sudo apt-get install -y -qq "${packages_to_install[@]}"
-        elif command_exists yum; then
-            sudo yum install -y -q "${packages_to_install[@]}"
-        elif command_exists dnf; then
-            sudo dnf install -y -q "${packages_to_install[@]}"
+    if [ "$SESSION_TOKEN_AUTO_REFRESH" = "true" ] && [ $((expiry - now)) -le "$SESSION_TOKEN_REFRESH_MARGIN" ]; then
+        print_debug "Session token expires in $((expiry - now))s; refreshing" >&2
+        SESSION_TOKEN_REFRESHING=true
+        if oci_cmd "session refresh" >/dev/null 2>&1; then
+            SESSION_TOKEN_MTIME=$(file_mtime "$token_file" || echo "")
         else
-            print_error "Cannot install packages: no supported package manager found"
-            return 1
+            print_warning "Automatic session refresh failed; run: oci session refresh --profile $OCI_PROFILE" >&2
         fi
+        SESSION_TOKEN_REFRESHING=false
     fi
-    
-    # Verify all required commands exist
-    local required_commands=("jq" "openssl" "ssh-keygen" "curl")
-    for cmd in "${required_commands[@]}"; do
-        if ! command_exists "$cmd"; then
-            print_error "Required command '$cmd' is not available"
-            return 1
-        fi
-    done
-    
-    print_success "All prerequisites installed"
 }
 
-install_oci_cli() {
-    print_subheader "OCI CLI Setup"
-    
-    # Check if OCI CLI is already installed and working
-    if command_exists oci; then
-        local version
-        version=$(oci --version 2>/dev/null | head -1) || version="unknown"
-        print_status "OCI CLI already installed: $version"
+# Principal-based auth methods need no config file or key material
+is_principal_auth() {
+    case "${1:-$auth_method}" in
+        instance_principal|resource_principal|oke_workload_identity|instance_obo_user) return 0 ;;
+    esac
+    return 1
+}
+
+validate_existing_oci_config() {
+    if [ ! -f "$OCI_CONFIG_FILE" ] && is_principal_auth "$OCI_CLI_AUTH"; then
+        auth_method="$OCI_CLI_AUTH"
+        if ! is_instance_principal_available; then
+            print_warning "$auth_method auth selected but OCI metadata service is unreachable"
+            return 1
+        fi
         return 0
     fi
-    
-    print_status "Installing OCI CLI..."
-    
-    # Check if Python is installed
-    if ! command_exists python3; then
-        print_status "Installing Python 3..."
-        if command_exists apt-get; then
-            sudo apt-get update -qq
-            sudo apt-get install -y -qq python3 python3-venv python3-pip
-        elif command_exists yum; then
-            sudo yum install -y -q python3 python3-pip
-        fi
+
+    if [ ! -f "$OCI_CONFIG_FILE" ]; then
+        print_warning "OCI config not found at $OCI_CONFIG_FILE"
+        return 1
     fi
-    
-    # Create virtual environment for OCI CLI
-    local venv_dir="$PWD/.venv"
-    if [ ! -d "$venv_dir" ]; then
-        print_status "Creating Python virtual environment..."
-        python3 -m venv "$venv_dir"
+
+    local cfg_auth
+    local key_file
+    local token_file
+    local pass_phrase
+
+    cfg_auth=$(read_oci_config_value "auth")
+    key_file=$(read_oci_config_value "key_file")
+    token_file=$(read_oci_config_value "security_token_file")
+    pass_phrase=$(read_oci_config_value "pass_phrase")
+
+    if [ -n "$OCI_CLI_AUTH" ]; then
+        auth_method="$OCI_CLI_AUTH"
+    elif [ -n "$cfg_auth" ]; then
+        auth_method="$cfg_auth"
+    elif [ -n "$token_file" ]; then
+        auth_method="security_token"
+    elif [ -n "$key_file" ]; then
+        auth_method="api_key"
     fi
-    
-    # Activate and install OCI CLI
-    # shellcheck source=/dev/null
-    # shellcheck disable=SC1091
-    source "$venv_dir/bin/activate"
-    
-    print_status "Installing OCI CLI in virtual environment..."
-    pip install --upgrade pip --quiet
-    pip install oci-cli --quiet
-    
-    # Add activation to bashrc if not already present
-    local activation_line="source $venv_dir/bin/activate"
-    if ! grep -qF "$activation_line" ~/.bashrc 2>/dev/null; then
-        { echo ""; echo "# OCI CLI virtual environment"; echo "$activation_line"; } >> ~/.bashrc
+
+    case "$auth_method" in
+        security_token)
+            token_file=$(oci_config_path "$token_file")
+            if [ -z "$token_file" ] || [ ! -f "$token_file" ]; then
+                print_warning "security_token auth selected but security_token_file is missing"
+                return 1
+            fi
+            local token_expiry
+            if token_expiry=$(session_token_expiry "$token_file") && [ "$token_expiry" -le "$(date +%s)" ]; then
+                print_warning "Session token in $token_file has expired"
+                return 1
+            fi
+            ;;
+        api_key)
+            key_file=$(oci_config_path "$key_file")
+            if [ -z "$key_file" ] || [ ! -f "$key_file" ]; then
+                print_warning "api_key auth selected but key_file is missing"
+                return 1
+            fi
+            if grep -q "ENCRYPTED" "$key_file" 2>/dev/null; then
+                if [ -z "${OCI_CLI_PASSPHRASE:-$pass_phrase}" ]; then
+                    print_warning "Private key is encrypted but no passphrase provided (set OCI_CLI_PASSPHRASE or pass_phrase in config)"
+                    return 1
+                fi
+            fi
+            ;;
+        instance_principal|resource_principal|oke_workload_identity|instance_obo_user)
+            if ! is_instance_principal_available; then
+                print_warning "Instance principal auth selected but OCI metadata service is unreachable"
+                return 1
+            fi
+            ;;
+        "")
+            print_warning "Unable to determine auth method from config"
+            return 1
+            ;;
+        *)
+            print_warning "Unsupported auth method '$auth_method' in config"
+            return 1
+            ;;
+    esac
+
+    return 0
+}
+
+# CLI verb path without options, e.g. "compute instance list"
+oci_command_verb() {
+    echo "$1" | awk '{ for (i = 1; i <= NF && $i !~ /^-/; i++) printf "%s%s", (i > 1 ? " " : ""), $i }'
+}
+
+# Non-idempotent calls (POST in the OCI API) that accept an opc-retry-token
+is_retryable_create_verb() {
+    [[ "$(oci_command_verb "$1")" =~ (^|\ )(create|launch|action|attach|copy|restore|add-user)$ ]]
+}
+
+retry_token_init() {
+    [ "$OCI_RETRY_TOKENS" = "true" ] || return 0
+    RETRY_TOKEN_VERBS_FILE=$(mktemp "${TMPDIR:-/tmp}/cloudcradle-retry-verbs.XXXXXXXX") || RETRY_TOKEN_VERBS_FILE=""
+}
+
+# Whether the installed CLI offers --opc-retry-token for VERB. The help text is read once
+# per verb and run (starting the CLI is slow) and captured whole before it is searched:
+# grep -q would stop reading early and fail the pipeline with SIGPIPE under pipefail.
+retry_token_supported() {
+    local verb="$1" cached help supported=no
+    if [ -n "$RETRY_TOKEN_VERBS_FILE" ]; then
+        cached=$(awk -F'\t' -v v="$verb" '$1 == v { print $2; exit }' "$RETRY_TOKEN_VERBS_FILE" 2>/dev/null)
+        [ -z "$cached" ] || { [ "$cached" = yes ]; return; }
     fi
-    
-    print_success "OCI CLI installed successfully"
+    # shellcheck disable=SC2086
+    help=$("$OCI_CLI_BIN" $verb --help 2>/dev/null) || help=""
+    [[ "$help" == *--opc-retry-token* ]] && supported=yes
+    [ -z "$RETRY_TOKEN_VERBS_FILE" ] || printf '%s\t%s\n' "$verb" "$supported" >> "$RETRY_TOKEN_VERBS_FILE"
+    [ "$supported" = yes ]
 }
 
-install_terraform() {
-    print_subheader "Terraform Setup"
-    
-    if command_exists terraform; then
-        local version
-        version=$(terraform version -json 2>/dev/null | jq -r '.terraform_version' 2>/dev/null) || \
-        version=$(terraform version | head -1 | awk '{print $2}' | sed 's/v//')
-        print_status "Terraform already installed: version $version"
+# Append --opc-retry-token to a create call when the installed CLI offers it for that
+# command. OCI remembers the token for 24 hours and answers a repeated call with the
+# original result, so retries after transient failures never double-create.
+with_retry_token() {
+    local cmd="$1" token
+    if [ "$OCI_RETRY_TOKENS" != "true" ] || [ -n "$OCI_CLI_FIXTURES_DIR" ] \
+        || [[ "$cmd" == *--opc-retry-token* ]] || ! is_retryable_create_verb "$cmd" \
+        || ! retry_token_supported "$(oci_command_verb "$cmd")"; then
+        echo "$cmd"
         return 0
     fi
-    
-    print_status "Installing Terraform..."
-    
-    # Try snap first on Ubuntu/Debian
-    if command_exists snap; then
-        if sudo snap install terraform --classic; then
-            print_success "Terraform installed via snap"
-            return 0
-        fi
-    fi
-    
-    # Manual installation
-    local latest_version
-    latest_version=$(curl -s https://api.github.com/repos/hashicorp/terraform/releases/latest | jq -r '.tag_name' | sed 's/v//')
-    
-    if [ -z "$latest_version" ] || [ "$latest_version" = "null" ]; then
-        latest_version="1.7.0"
-        print_warning "Could not fetch latest version, using fallback: $latest_version"
-    fi
-    
-    local arch="amd64"
-    if [ "$(uname -m)" = "aarch64" ]; then
-        arch="arm64"
-    fi
-    
-    local os="linux"
-    if [[ "$OSTYPE" == "darwin"* ]]; then
-        os="darwin"
-    fi
-    
-    local tf_url="https://releases.hashicorp.com/terraform/${latest_version}/terraform_${latest_version}_${os}_${arch}.zip"
-    local temp_dir
-    temp_dir=$(mktemp -d)
-    
-    print_status "Downloading Terraform $latest_version for ${os}_${arch}..."
-    
-    if curl -sLo "$temp_dir/terraform.zip" "$tf_url"; then
-        unzip -q "$temp_dir/terraform.zip" -d "$temp_dir"
-        sudo mv "$temp_dir/terraform" /usr/local/bin/
-        sudo chmod +x /usr/local/bin/terraform
-        rm -rf "$temp_dir"
-        
-        if command_exists terraform; then
-            print_success "Terraform installed successfully"
+    token=$(printf '%s\n%s\n' "$OCI_RETRY_TOKEN_SEED" "$cmd" | sha256_stdin)
+    echo "$cmd --opc-retry-token $token"
+}
+
+# Replay a canned response from OCI_CLI_FIXTURES_DIR. Fixtures hold exactly what the
+# CLI would print for the command (after --query), named after the verb path:
+#   compute_instance_list.json                    any "compute instance list"
+#   compute_instance_get.<ocid>.json              "compute instance get" for one resource
+# The most specific match (last OCID in the command) wins. Missing fixtures fail like an API error.
+oci_fixture_response() {
+    local cmd="$1"
+    local verb resource_id fixture
+    verb=$(oci_command_verb "$cmd" | tr ' -' '__')
+    resource_id=$(echo "$cmd" | grep -oE 'ocid1\.[A-Za-z0-9._-]+' | tail -1 || true)
+
+    for fixture in "$OCI_CLI_FIXTURES_DIR/$verb.$resource_id.json" "$OCI_CLI_FIXTURES_DIR/$verb.json"; do
+        if [ -f "$fixture" ]; then
+            cat "$fixture"
             return 0
         fi
-    fi
-    
-    rm -rf "$temp_dir"
-    print_error "Failed to install Terraform"
+    done
+
+    print_debug "No OCI fixture for '$verb' in $OCI_CLI_FIXTURES_DIR" >&2
     return 1
 }
 
-# ============================================================================
-# OCI AUTHENTICATION FUNCTIONS
-# ============================================================================
-
-detect_auth_method() {
-    if [ -f "$OCI_CONFIG_FILE" ]; then
-        local cfg_auth
-        local token_file
-        local key_file
+# Create this run's bucket state, "<micro-tokens> <last refill in microseconds>", once at
+# startup: mktemp picks an unpredictable name and creates it private, so no other user can
+# plant a symlink in its place. Subshells inherit the path, so parallel lookups share it.
+rate_limit_init() {
+    [ "${OCI_RATE_LIMIT:-0}" -gt 0 ] 2>/dev/null || return 0
+    RATE_LIMIT_FILE=$(mktemp "${TMPDIR:-/tmp}/cloudcradle-ratelimit.XXXXXXXX") || {
+        print_warning "Could not create the rate limiter state; OCI calls are not rate limited"
+        RATE_LIMIT_FILE=""
+    }
+}
 
-        cfg_auth=$(read_oci_config_value "auth")
-        token_file=$(read_oci_config_value "security_token_file")
-        key_file=$(read_oci_config_value "key_file")
+# Run "$@" holding the bucket's lock
+rate_limit_locked() {
+    file_locked "$RATE_LIMIT_FILE" "$@"
+}
 
-        if [ -n "$cfg_auth" ]; then
-            auth_method="$cfg_auth"
-        elif [ -n "$token_file" ]; then
-            auth_method="security_token"
-        elif [ -n "$key_file" ]; then
-            auth_method="api_key"
-        fi
+# file_locked FILE CMD...: run CMD holding FILE's lock (flock on FILE.lock where available,
+# otherwise a FILE.lock.d directory)
+file_locked() {
+    local file="$1"
+    shift
+    if command_exists flock; then
+        { flock 9 && "$@"; } 9>"$file.lock"
+        return
     fi
-    print_debug "Detected auth method: $auth_method (profile: $OCI_PROFILE, config: $OCI_CONFIG_FILE)"
+    local tries=0
+    until mkdir "$file.lock.d" 2>/dev/null; do
+        tries=$((tries + 1))
+        # A holder killed mid-update leaves the directory behind
+        [ $tries -lt 500 ] || rm -rf "$file.lock.d"
+        sleep 0.01
+    done
+    local rc=0
+    "$@" || rc=$?
+    rmdir "$file.lock.d" 2>/dev/null || true
+    return $rc
 }
 
-setup_oci_config() {
-    print_subheader "OCI Authentication"
-    
-    mkdir -p ~/.oci
-    
-    local existing_config_invalid=0
-    if [ -f "$OCI_CONFIG_FILE" ]; then
-        print_status "Existing OCI configuration found"
-        detect_auth_method
+# Take a token and print how long (microseconds) the caller has to wait for it. Tokens go
+# negative while calls are queued, so each waiter gets its own slot instead of spinning.
+rate_limit_reserve() {
+    local file="$RATE_LIMIT_FILE" tokens last now burst_u wait=0
+    burst_u=$((OCI_RATE_BURST * 1000000))
+    now=$(epoch_us)
+    [ ! -f "$file" ] || read -r tokens last < "$file" || true
+    tokens=${tokens:-$burst_u} last=${last:-$now}
+    tokens=$((tokens + (now - last) * OCI_RATE_LIMIT))
+    [ "$tokens" -le "$burst_u" ] || tokens=$burst_u
+    tokens=$((tokens - 1000000))
+    [ "$tokens" -ge 0 ] || wait=$(( -tokens / OCI_RATE_LIMIT ))
+    echo "$tokens $now" > "$file"
+    echo "$wait"
+}
 
-        print_status "Validating existing OCI configuration..."
+# Empty the bucket for a second after a 429 (TooManyRequests)
+rate_limit_throttled() {
+    local now
+    now=$(epoch_us)
+    echo "$(( -OCI_RATE_LIMIT * 1000000 )) $now" > "$RATE_LIMIT_FILE"
+}
 
-        if ! validate_existing_oci_config; then
-            existing_config_invalid=1
-            print_warning "Existing OCI configuration is incomplete or requires interactive input"
+# Wait for a token before an OCI API call
+rate_limit_wait() {
+    [ "${OCI_RATE_LIMIT:-0}" -gt 0 ] 2>/dev/null && [ -n "$RATE_LIMIT_FILE" ] || return 0
+    [ "${OCI_RATE_BURST:-0}" -gt 0 ] 2>/dev/null || OCI_RATE_BURST=1
+    local wait
+    wait=$(rate_limit_locked rate_limit_reserve) || return 0
+    [ "${wait:-0}" -gt 0 ] || return 0
+    print_debug "Rate limit: waiting ${wait}us for an OCI API slot" >&2
+    sleep "$(printf '%d.%06d' $((wait / 1000000)) $((wait % 1000000)))"
+}
+
+# Run OCI command with proper authentication handling
+oci_cmd() {
+    local cmd
+    cmd=$(with_retry_token "$*")
+    local result=""
+    local exit_code=0
+    local base_args
+
+    base_args="--config-file \"$OCI_CONFIG_FILE\" --profile \"$OCI_PROFILE\" --connection-timeout $OCI_CLI_CONNECTION_TIMEOUT --read-timeout $OCI_CLI_READ_TIMEOUT --max-retries $OCI_CLI_MAX_RETRIES"
+    if [ -n "$OCI_CLI_AUTH" ]; then
+        base_args="$base_args --auth $OCI_CLI_AUTH"
+    elif [ -n "$auth_method" ]; then
+        base_args="$base_args --auth $auth_method"
+    fi
+    if [ -n "$OCI_REGION" ]; then
+        base_args="$base_args --region $OCI_REGION"
+    fi
+
+    ensure_session_token_fresh
+
+    # Internal helper to run with timeout when available
+    _run_oci_with_timeout() {
+        local full_cmd="$OCI_CLI_BIN $base_args $cmd $*"
+        rate_limit_wait
+        if command_exists timeout; then
+            # Use coreutils timeout for safety
+            result=$(timeout "${OCI_CMD_TIMEOUT}s" bash -c "$full_cmd" </dev/null 2>&1) && exit_code=0 || exit_code=$?
         else
-            # Test existing configuration
-            print_status "Testing existing OCI configuration connectivity..."
-            if test_oci_connectivity; then
-                print_success "Existing OCI configuration is valid"
-                return 0
-            fi
+            # Fallback: run normally (may block if OCI CLI hangs)
+            result=$(eval "$full_cmd" </dev/null 2>&1) && exit_code=0 || exit_code=$?
         fi
+        if [ $exit_code -ne 0 ] && [[ "$result" == *TooManyRequests* ]] && [ -n "$RATE_LIMIT_FILE" ]; then
+            rate_limit_locked rate_limit_throttled || true
+        fi
+    }
 
-        print_warning "Existing configuration failed connectivity test (will retry with refresh)"
-        
-        # Check if session token expired
-        if [ "$auth_method" = "security_token" ]; then
-            print_status "Attempting to refresh session token (timeout ${OCI_CMD_TIMEOUT}s)..."
-            if oci_cmd "session refresh" >/dev/null 2>&1; then
-                if test_oci_connectivity; then
-                    print_success "Session token refreshed successfully"
-                    return 0
-                fi
-            else
-                print_warning "Session refresh failed or timed out"
+    local span_start=""
+    if tracing_enabled; then
+        span_start=$(trace_now_nanos)
+    fi
+
+    if result=$(chaos_oci_fault "$cmd"); then
+        exit_code=1
+    elif [ -n "$OCI_CLI_FIXTURES_DIR" ]; then
+        result=$(oci_fixture_response "$cmd") && exit_code=0 || exit_code=$?
+    else
+        _run_oci_with_timeout ""
+    fi
+
+    if tracing_enabled; then
+        local status_code=1
+        [ $exit_code -ne 0 ] && status_code=2
+        trace_record_span "$(trace_random_hex 8)" "$(trace_current_span_id)" "oci $(oci_command_verb "$cmd")" "$span_start" "$(trace_now_nanos)" "$status_code" \
+            "oci.profile=$OCI_PROFILE" "process.exit_code=$exit_code"
+    fi
+
+    if [ $exit_code -eq 0 ]; then
+        echo "$result"
+        return 0
+    fi
+    if [ $exit_code -eq 124 ]; then
+        print_warning "OCI CLI call timed out after ${OCI_CMD_TIMEOUT}s"
+    fi
+
+    # The token may have been refreshed externally while the call was in flight
+    if [ "$auth_method" = "security_token" ] && [ -z "$OCI_CLI_FIXTURES_DIR" ] \
+        && echo "$result" | grep -q "NotAuthenticated"; then
+        local token_file
+        token_file=$(session_token_file)
+        if [ -f "$token_file" ] && [ "$(file_mtime "$token_file")" != "$SESSION_TOKEN_MTIME" ]; then
+            SESSION_TOKEN_MTIME=$(file_mtime "$token_file" || echo "")
+            _run_oci_with_timeout ""
+            if [ $exit_code -eq 0 ]; then
+                echo "$result"
+                return 0
             fi
-            
-            print_status "Session refresh did not restore connectivity, initiating interactive authentication as a fallback..."
         fi
     fi
+
+    OCI_LAST_ERROR="$result"
+    report_account_state "$result" >&2 || true
+    return 1
+}
+
+# Safe JSON parsing with jq
+safe_jq() {
+    local json="$1"
+    local query="$2"
+    local default="${3:-}"
+    
+    if [ -z "$json" ] || [ "$json" = "null" ]; then
+        echo "$default"
+        return
+    fi
     
-    # Setup new authentication
-    print_status "Setting up browser-based authentication..."
-    print_status "This will open a browser window for you to log in to Oracle Cloud."
+    local result
+    result=$(echo "$json" | jq -r "$query" 2>/dev/null) || result="$default"
+    
+    if [ "$result" = "null" ] || [ -z "$result" ]; then
+        echo "$default"
+    else
+        echo "$result"
+    fi
+}
 
-    if [ "$NON_INTERACTIVE" = "true" ]; then
-        print_error "Cannot perform interactive authentication in non-interactive mode. Aborting."
+# Run a command with retry/backoff, detect Out-of-Capacity signals
+retry_with_backoff() {
+    local cmd="$*"
+    local attempt=1
+    local rc=1
+    local out
+
+    while [ "$attempt" -le "$RETRY_MAX_ATTEMPTS" ]; do
+        print_status "Attempt $attempt/$RETRY_MAX_ATTEMPTS: $cmd"
+        out=$(eval "$cmd" 2>&1) && rc=0 || rc=$?
+
+        if [ $rc -eq 0 ]; then
+            echo "$out"
+            return 0
+        fi
+
+        # Detect Out-of-Capacity patterns
+        if echo "$out" | grep -i -E "out of capacity|out of host capacity|OutOfCapacity|OutOfHostCapacity" >/dev/null 2>&1; then
+            print_warning "Detected 'Out of Capacity' condition (attempt $attempt)."
+            # If we've exhausted attempts, bail
+        else
+            print_warning "Command failed (exit $rc)."
+        fi
+
+        local sleep_time=$(( RETRY_BASE_DELAY * (2 ** (attempt - 1)) ))
+        print_status "Retrying in ${sleep_time}s..."
+        sleep $sleep_time
+        attempt=$((attempt + 1))
+    done
+
+    print_error "Command failed after $RETRY_MAX_ATTEMPTS attempts"
+    echo "$out"
+    return $rc
+}
+
+# A simpler wrapper that returns true/false and sets OUT_OF_CAPACITY_DETECTED=1 when detected
+run_cmd_with_retries_and_check() {
+    local cmd="$*"
+    local out rc
+    # shellcheck disable=SC2034  # OUT_OF_CAPACITY_DETECTED is set for callers to inspect
+    OUT_OF_CAPACITY_DETECTED=0
+
+    out=$(retry_with_backoff "$cmd") && rc=0 || rc=$?
+    if echo "$out" | grep -i -E "out of capacity|out of host capacity|OutOfCapacity|OutOfHostCapacity" >/dev/null 2>&1; then
+        # shellcheck disable=SC2034  # exported flag for callers/tests
+        OUT_OF_CAPACITY_DETECTED=1
+    fi
+
+    # Exit status of the last attempt (the output is not reliably JSON)
+    return $rc
+}
+
+# Options shared by every terraform command that plans (plan, destroy)
+terraform_plan_args() {
+    local args="-parallelism=$TF_PARALLELISM -lock-timeout=$TF_LOCK_TIMEOUT"
+    if [ "$TF_REFRESH" != "true" ]; then
+        args="$args -refresh=false"
+    fi
+    echo "$args"
+}
+
+# Options accepted when applying a saved plan (refresh was decided at plan time)
+terraform_apply_args() {
+    echo "-parallelism=$TF_PARALLELISM -lock-timeout=$TF_LOCK_TIMEOUT"
+}
+
+# Resource addresses Terraform knows in DIR: with "state", those in state; otherwise
+# also every resource (and module call) the configuration declares, unindexed
+terraform_known_addresses() {
+    local dir="$1" which="${2:-all}" call address
+    terraform -chdir="$dir" state list 2>/dev/null || true
+    [ "$which" = "state" ] && return 0
+    awk -F'"' '/^resource "/ { print $2 "." $4 }' "$dir"/*.tf 2>/dev/null
+    while IFS=$'\t' read -r call address; do
+        echo "module.$call"
+        echo "module.$call.$address"
+    done < <(module_resources "$dir")
+}
+
+# A --target/--replace argument as a resource address: instance hostnames become their
+# instance, other addresses move into their module with LAYOUT=modules
+resolve_terraform_address() {
+    local ref="$1" kind
+    if [[ "$ref" != *.* ]]; then
+        for kind in amd arm; do
+            instance_address "$ref" "$kind" && return 0
+        done
         return 1
     fi
+    if [[ "$ref" == module.* ]]; then
+        echo "$ref"
+    else
+        tf_address "$ref"
+    fi
+}
 
-    # Determine region to use for browser login.
-    # If we have an existing config, prefer its region (avoids the region selection prompt).
-    local auth_region
-    auth_region=$(read_oci_config_value "region" "$OCI_CONFIG_FILE" "$OCI_PROFILE" 2>/dev/null || true)
-    auth_region=${auth_region:-$OCI_AUTH_REGION}
-    auth_region=${auth_region:-$(default_region_for_host)}
+# Fill TF_SELECTION_ARGS from TF_TARGETS, TF_REPLACE and TF_REFRESH_ONLY. Targets must be
+# in state or declared in the configuration of DIR (new resources can be targeted);
+# replacements must exist in state.
+prepare_terraform_selection() {
+    local dir="${1:-.}" known state ref address bad=0
+    local -a targets replacements
+    TF_SELECTION_ARGS=()
+    [ -n "$TF_TARGETS$TF_REPLACE" ] || [ "$TF_REFRESH_ONLY" = "true" ] || return 0
 
-    # Keep this interactive (per UX request): prompt with a sane default so Enter works.
-    if [ "$NON_INTERACTIVE" != "true" ]; then
-        auth_region=$(prompt_with_default "Region for authentication" "$auth_region")
+    if [ "$TF_REFRESH_ONLY" = "true" ]; then
+        if [ -n "$TF_REPLACE" ]; then
+            print_error "--refresh-only cannot be combined with --replace: a refresh-only plan changes no resources"
+            return 1
+        fi
+        if [ "$TF_REFRESH" != "true" ]; then
+            print_error "--refresh-only cannot be combined with --no-refresh"
+            return 1
+        fi
+        TF_SELECTION_ARGS+=("-refresh-only")
     fi
 
-    # Allow forcing re-auth / new profile
-    if [ "$FORCE_REAUTH" = "true" ]; then
-        new_profile=$(prompt_with_default "Enter new profile name to create/use" "NEW_PROFILE")
-        print_status "Starting interactive session authenticate for profile '$new_profile'..."
+    state=$(terraform_known_addresses "$dir" state)
+    known=$(terraform_known_addresses "$dir" | sort -u)
+    # read -a rather than word splitting: addresses like arm["arm-1"] are glob patterns
+    read -ra targets <<< "$TF_TARGETS"
+    read -ra replacements <<< "$TF_REPLACE"
+    for ref in "${targets[@]}"; do
+        if ! address=$(resolve_terraform_address "$ref"); then
+            print_error "--target $ref: not an instance hostname or resource address"
+            bad=1
+        elif ! grep -qxF -e "$address" -e "${address%\[*\]}" <<< "$known"; then
+            print_error "--target $ref: $address is neither in state nor in the configuration"
+            grep -F "${address%%\[*}" <<< "$known" | head -5 | sed 's/^/    did you mean: /'
+            bad=1
+        else
+            TF_SELECTION_ARGS+=("-target=$address")
+        fi
+    done
+    for ref in "${replacements[@]}"; do
+        if ! address=$(resolve_terraform_address "$ref"); then
+            print_error "--replace $ref: not an instance hostname or resource address"
+            bad=1
+        elif ! grep -qxF "$address" <<< "$state" \
+            && { terraform_available || ! grep -qxF -e "$address" -e "${address%\[*\]}" <<< "$known"; }; then
+            print_error "--replace $ref: $address is not in state (replace takes one existing resource)"
+            grep -F "${address%%\[*}" <<< "$state" | head -5 | sed 's/^/    did you mean: /'
+            bad=1
+        else
+            TF_SELECTION_ARGS+=("-replace=$address")
+        fi
+    done
+    return $bad
+}
 
-        print_status "Using region '$auth_region' for authentication"
-        local auth_out
-        if is_wsl; then
-            auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1) || {
-                echo "$auth_out" >&2
-                if echo "$auth_out" | grep -i -E "config file.*is invalid|Config Errors|user .*missing" >/dev/null 2>&1; then
-                    print_warning "OCI CLI reports the config file is invalid or missing required fields. Offering repair options..."
-                    existing_config_invalid=1
-                else
-                    print_error "Authentication failed"
-                    return 1
-                fi
-            }
-            if [ "$existing_config_invalid" -ne 1 ]; then
-                echo "$auth_out"
-                local url
-                url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
-                if [ -n "$url" ]; then
-                    print_status "Opening browser for login URL (WSL)..."
-                    open_url_best_effort "$url" || true
-                fi
-            fi
+# Automatically re-run terraform apply until success on 'Out of Capacity', with backoff
+out_of_capacity_auto_apply() {
+    print_status "Auto-retrying terraform apply until success or max attempts (${RETRY_MAX_ATTEMPTS})..."
+    local attempt=1
+    local rc=1
+    local out planned_shapes started
+    planned_shapes=$(capacity_planned_shapes)
+    started=$(date +%s)
+
+    while [ "$attempt" -le "$RETRY_MAX_ATTEMPTS" ]; do
+        print_status "Apply attempt $attempt/$RETRY_MAX_ATTEMPTS"
+        # shellcheck disable=SC2046  # intentional word splitting of option list
+        out=$(terraform apply -input=false $(terraform_apply_args) tfplan 2>&1) && rc=0 || rc=$?
+
+        if [ $rc -eq 0 ]; then
+            # shellcheck disable=SC2086  # one shape per word
+            record_capacity_event success $planned_shapes
+            # The tenancy changed: the next subcommand must not reuse the old inventory
+            rm -f "$INVENTORY_CACHE_FILE"
+            print_success "terraform apply succeeded"
+            store_backup_passwords || true
+            return 0
+        fi
+
+        if echo "$out" | grep -i -E "out of capacity|out of host capacity|OutOfCapacity|OutOfHostCapacity" >/dev/null 2>&1; then
+            # shellcheck disable=SC2046,SC2086  # one shape per word
+            record_capacity_event out_of_capacity $(capacity_failed_shapes "$out" $planned_shapes)
+            print_warning "Apply failed with 'Out of Capacity' - will retry"
         else
-            if ! oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
-                print_error "Browser authentication failed or was cancelled"
-                return 1
-            fi
+            print_error "terraform apply failed with non-retryable error"
+            echo "$out"
+            report_account_state "$out" || true
+            return $rc
         fi
 
-        print_status "Authentication for profile '$new_profile' completed. Updating OCI_PROFILE to use it."
-        OCI_PROFILE="$new_profile"
-        auth_method="security_token"
+        [ "$attempt" -lt "$RETRY_MAX_ATTEMPTS" ] || break
+        local sleep_time quiet
+        # shellcheck disable=SC2086  # one shape per word
+        sleep_time=$(hunt_next_delay "$attempt" $planned_shapes)
+        if [ "$HUNT_MAX_DURATION" -gt 0 ] && [ $(( $(date +%s) - started + sleep_time )) -gt "$HUNT_MAX_DURATION" ]; then
+            print_warning "Next retry would exceed HUNT_MAX_DURATION (${HUNT_MAX_DURATION}s) - stopping the hunt"
+            break
+        fi
+        print_status "Waiting ${sleep_time}s before retrying (scheduler: $HUNT_SCHEDULER)..."
+        sleep "$sleep_time"
+        quiet=$(hunt_quiet_remaining)
+        if [ "$quiet" -gt 0 ]; then
+            print_status "Quiet hours ($HUNT_QUIET_HOURS) - pausing ${quiet}s"
+            sleep "$quiet"
+        fi
+        attempt=$((attempt + 1))
+    done
 
-        if [ "$existing_config_invalid" -eq 1 ]; then
-            # Run the same automatic delete and recreate flow
-            print_warning "Detected invalid or incomplete OCI config file during forced re-auth - AUTOMATICALLY DELETING AND FORCING FRESH AUTHENTICATION"
+    print_error "terraform apply did not succeed after $attempt attempt(s)"
+    echo "$out"
+    capacity_retry_hint
+    return 1
+}
 
-            # IMMEDIATE DELETE: Remove corrupted config without prompting
-            if [ -f "$OCI_CONFIG_FILE" ]; then
-                print_status "Backing up corrupted config to $OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)"
-                cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)" 2>/dev/null || true
-                print_status "Forcibly deleting corrupted config file: $OCI_CONFIG_FILE"
-                rm -f "$OCI_CONFIG_FILE"
-            fi
-            
-            # Delete any temp config files to start completely fresh
-            rm -f "$HOME/.oci/config.session_auth" 2>/dev/null || true
-            
-            # Create completely new profile with session auth
-            new_profile="DEFAULT"
-            print_status "Creating fresh OCI configuration with browser-based authentication for profile '$new_profile'..."
+# Create an OCI Object Storage bucket (S3-compatible) for remote TF state if requested
+create_s3_backend_bucket() {
+    local bucket_name="$1"
+    if [ -z "$bucket_name" ]; then
+        print_error "Bucket name is empty"
+        return 1
+    fi
+
+    print_status "Creating/checking OCI Object Storage bucket: $bucket_name"
+
+    local ns
+    ns=$(oci_cmd "os ns get --query 'data' --raw-output" 2>/dev/null) || ns=""
+    if [ -z "$ns" ]; then
+        print_error "Failed to determine Object Storage namespace"
+        return 1
+    fi
+
+    # Check if bucket exists
+    if oci_cmd "os bucket get --namespace-name $ns --bucket-name $bucket_name" >/dev/null 2>&1; then
+        print_status "Bucket $bucket_name already exists in namespace $ns"
+        return 0
+    fi
+
+    if oci_cmd "os bucket create --namespace-name $ns --compartment-id $tenancy_ocid --name $bucket_name --is-versioning-enabled true" >/dev/null 2>&1; then
+        print_success "Created bucket $bucket_name in namespace $ns"
+        return 0
+    fi
+
+    print_error "Failed to create bucket $bucket_name"
+    return 1
+}
+
+# Configure terraform backend if TF_BACKEND=oci
+configure_terraform_backend() {
+    if [ "$TF_BACKEND" != "oci" ]; then
+        return 0
+    fi
+
+    if [ -z "$TF_BACKEND_BUCKET" ]; then
+        print_error "TF_BACKEND is 'oci' but TF_BACKEND_BUCKET is not set"
+        return 1
+    fi
+
+    TF_BACKEND_REGION=${TF_BACKEND_REGION:-$region}
+    TF_BACKEND_ENDPOINT=${TF_BACKEND_ENDPOINT:-"https://objectstorage.${TF_BACKEND_REGION}.oraclecloud.com"}
+
+    if [ "$DRY_RUN" = "true" ]; then
+        [ "$TF_BACKEND_CREATE_BUCKET" = "true" ] && print_status "[dry-run] Would create/check bucket $TF_BACKEND_BUCKET"
+        print_status "[dry-run] Would write backend.tf (contents not shown: may contain credentials)"
+    elif [ "$TF_BACKEND_CREATE_BUCKET" = "true" ]; then
+        create_s3_backend_bucket "$TF_BACKEND_BUCKET" || return 1
+    fi
+
+    # With the keychain, the keys go there and reach Terraform through the environment
+    local credentials=""
+    if keychain_enabled; then
+        if [ "$DRY_RUN" != "true" ] && [ -n "$TF_BACKEND_ACCESS_KEY" ]; then
+            printf '%s' "$TF_BACKEND_ACCESS_KEY" | keychain_store tf-backend-access-key && export AWS_ACCESS_KEY_ID="$TF_BACKEND_ACCESS_KEY"
+        fi
+        if [ "$DRY_RUN" != "true" ] && [ -n "$TF_BACKEND_SECRET_KEY" ]; then
+            printf '%s' "$TF_BACKEND_SECRET_KEY" | keychain_store tf-backend-secret-key && export AWS_SECRET_ACCESS_KEY="$TF_BACKEND_SECRET_KEY"
+        fi
+        print_status "Backend keys are kept in the $(keychain_backend) keychain, not in backend.tf"
+    else
+        credentials="    access_key = \"$TF_BACKEND_ACCESS_KEY\"
+    secret_key = \"$TF_BACKEND_SECRET_KEY\"
+"
+    fi
+
+    # Write backend override (sensitive; keep out of VCS)
+    local backend_file="backend.tf"
+    [ "$DRY_RUN" = "true" ] && backend_file="$DRY_RUN_DIR/backend.tf"
+    [ "$DRY_RUN" = "true" ] || print_status "Writing backend.tf (do not commit -- contains sensitive values)"
+    cat > "$backend_file" <<EOF
+terraform {
+  backend "s3" {
+    bucket     = "$TF_BACKEND_BUCKET"
+    key        = "$TF_BACKEND_STATE_KEY"
+    region     = "$TF_BACKEND_REGION"
+    endpoint   = "$TF_BACKEND_ENDPOINT"
+${credentials}    skip_credentials_validation = true
+    skip_region_validation = true
+    skip_metadata_api_check = true
+    force_path_style = true
+  }
+}
+EOF
+    [ "$DRY_RUN" = "true" ] || print_warning "backend.tf written - ensure this file is in .gitignore (contains credentials if provided)"
+}
+
+# Confirm action with user
+confirm_action() {
+    local prompt="$1"
+    local default="${2:-N}"
+    
+    if [ "$NON_INTERACTIVE" = "true" ]; then
+        [ "$default" = "Y" ] && return 0 || return 1
+    fi
+    
+    local yn_prompt
+    if [ "$default" = "Y" ]; then
+        yn_prompt="[Y/n]"
+    else
+        yn_prompt="[y/N]"
+    fi
+    
+    echo -n -e "${BLUE}$prompt $yn_prompt: ${NC}"
+    read -r response
+    response=${response:-$default}
+    
+    [[ "$response" =~ ^[Yy]$ ]]
+}
+
+# Write stdin to a generated file, keeping a timestamped backup of the previous version.
+# In dry-run mode the content goes to DRY_RUN_DIR and a diff against the workspace is shown.
+write_generated_file() {
+    local path="$1"
+
+    if is_extra_tf_file "$path"; then
+        cat > /dev/null
+        print_error "Refusing to overwrite $path: it is copied from $EXTRA_TF_DIR/"
+        return 1
+    fi
+
+    # Modules layout: collected first, then split up by modularize_terraform
+    if [ -n "$LAYOUT_STAGE_DIR" ] && [[ "$path" == *.tf ]]; then
+        cat > "$LAYOUT_STAGE_DIR/$path"
+        return 0
+    fi
+
+    if [ "$DRY_RUN" = "true" ]; then
+        with_generated_header "$path" > "$DRY_RUN_DIR/$path"
+        if [ ! -f "$path" ]; then
+            print_status "[dry-run] Would create $path ($(wc -l < "$DRY_RUN_DIR/$path" | tr -d ' ') lines)"
+        elif diff -q -I '^# Generated' -I '# cloudcradle: ' "$path" "$DRY_RUN_DIR/$path" >/dev/null 2>&1; then
+            print_status "[dry-run] $path unchanged"
+        else
+            print_status "[dry-run] Would update $path:"
+            diff -u -I '^# Generated' -I '# cloudcradle: ' --label "a/$path" --label "b/$path" "$path" "$DRY_RUN_DIR/$path" || true
+        fi
+        if generated_file_edited "$path"; then
+            print_warning "[dry-run] $path was edited by hand since it was generated; a real run asks before overwriting it"
+        fi
+        return 0
+    fi
+
+    if generated_file_edited "$path"; then
+        local generated
+        generated=$(mktemp)
+        cat > "$generated"
+        print_warning "$path was edited by hand since run $(generated_file_field "$path" run) generated it"
+        print_status "Overwriting it would change:"
+        diff -u --label "a/$path (yours)" --label "b/$path (generated)" \
+            <(generated_file_body "$path") "$generated" | head -60 || true
+        if ! confirm_action "Overwrite your changes to $path? (they are kept as $path.bak.*)" "Y"; then
+            rm -f "$generated"
+            print_warning "Keeping your $path: configuration changes that affect it are not applied"
+            return 0
+        fi
+        cp "$path" "$path.bak.$(date +%Y%m%d_%H%M%S)"
+        with_generated_header "$path" < "$generated" > "$path"
+        rm -f "$generated"
+        return 0
+    fi
+
+    [ -f "$path" ] && cp "$path" "$path.bak.$(date +%Y%m%d_%H%M%S)"
+    with_generated_header "$path" > "$path"
+}
+
+# Copy stdin to stdout behind the provenance line (GENERATED_HEADER):
+#   # cloudcradle: version=<tool> spec=<inputs hash> run=<run id> sha256=<hash of the rest>
+# cloud-init.yaml is rendered by templatefile into user_data, so there the line is wrapped in
+# a template directive that renders to nothing: a new run ID must not replace the instances.
+with_generated_header() {
+    local path="$1" body line
+    if [ "$GENERATED_HEADER" != "true" ]; then
+        cat
+        return 0
+    fi
+    body=$(mktemp)
+    cat > "$body"
+    line="# cloudcradle: version=$CLOUDCRADLE_VERSION spec=${GENERATION_SPEC_HASH:-none} run=$CLOUDCRADLE_RUN_ID sha256=$(sha256_stdin < "$body")"
+    case "$path" in
+        *.yaml) echo "%{ if false }$line%{ endif ~}" ;;
+        *) echo "$line" ;;
+    esac
+    cat "$body"
+    rm -f "$body"
+}
+
+# A field of a generated file's provenance line (version, spec, run or sha256); empty
+# when the file has none
+generated_file_field() {
+    [ -f "$1" ] || return 0
+    head -1 "$1" | grep -oP "# cloudcradle: .*\\b$2=\\K[^ %]+" || true
+}
+
+# A generated file without its provenance line
+generated_file_body() {
+    sed '1{/# cloudcradle: /d}' "$1"
+}
+
+# True when a generated file carries a provenance line its content no longer matches
+generated_file_edited() {
+    local path="$1" recorded
+    recorded=$(generated_file_field "$path" sha256)
+    [ -n "$recorded" ] || return 1
+    [ "$(generated_file_body "$path" | sha256_stdin)" != "$recorded" ]
+}
+
+# Hash of what the files are generated from: the instance configuration, the settings that
+# shape the templates and the config files that exist. Written into every provenance line.
+generation_spec_hash() {
+    local f
+    {
+        declare -p amd_micro_instance_count amd_micro_boot_volume_size_gb arm_flex_instance_count \
+            arm_flex_ocpus_per_instance arm_flex_memory_per_instance arm_flex_boot_volume_size_gb \
+            amd_block_volumes arm_flex_block_volumes amd_micro_hostnames arm_flex_hostnames 2>/dev/null
+        echo "$region $INSTANCE_OS $NETWORK_TOPOLOGY $LAYOUT $PROVISION $MANAGED_TAG $RESERVED_PUBLIC_IPS $RCLONE_VERSION"
+        for f in "$FIREWALL_RULES_FILE" "$SUBNETS_FILE" "$INSTANCE_LABELS_FILE" "$PROVISIONERS_FILE" \
+            "$SITES_FILE" "$SECRETS_FILE" "$USERS_FILE" "$HARDENING_FILE" "$CLOUD_INIT_FILE" \
+            "$BACKUP_SPEC_FILE" "$RENAMES_FILE" "$POWER_STATE_FILE" "$RCLONE_CHECKSUMS_FILE"; do
+            [ -f "$f" ] || continue
+            echo "== $f"
+            generated_file_body "$f"
+        done
+    } | sha256_stdin | cut -c1-12
+}
+
+# ============================================================================
+# CORPORATE PROXY
+# ============================================================================
+
+# Export the proxy settings in both cases: curl only reads lowercase http_proxy, Go
+# (terraform, the oci provider) and Python (oci CLI, pip) read either
+configure_proxy() {
+    local https http no entry
+    if [ "$PROXY" = "none" ]; then
+        unset HTTPS_PROXY https_proxy HTTP_PROXY http_proxy ALL_PROXY all_proxy NO_PROXY no_proxy
+        return 0
+    fi
+    https="${PROXY:-${HTTPS_PROXY:-${https_proxy:-}}}"
+    http="${PROXY:-${HTTP_PROXY:-${http_proxy:-$https}}}"
+    [ -n "$https$http" ] || return 0
+
+    no="${NO_PROXY:-${no_proxy:-}}"
+    for entry in localhost 127.0.0.1 ::1 169.254.169.254; do
+        [[ ",$no," == *",$entry,"* ]] || no="${no:+$no,}$entry"
+    done
+    export HTTPS_PROXY="$https" https_proxy="$https" HTTP_PROXY="$http" http_proxy="$http"
+    export NO_PROXY="$no" no_proxy="$no"
+    print_debug "Proxy: $(proxy_display "$https") (no proxy for $no)"
+}
+
+# A proxy URL without its credentials, for output
+proxy_display() {
+    sed -E 's#://[^@/]*@#://***@#' <<< "$1"
+}
+
+proxy_enabled() {
+    [ -n "${HTTPS_PROXY:-}${HTTP_PROXY:-}" ]
+}
+
+# sudo drops the environment: pass the proxy on to package managers explicitly
+sudo_with_proxy() {
+    if proxy_enabled; then
+        sudo env "https_proxy=${HTTPS_PROXY:-}" "HTTPS_PROXY=${HTTPS_PROXY:-}" \
+            "http_proxy=${HTTP_PROXY:-}" "HTTP_PROXY=${HTTP_PROXY:-}" "no_proxy=${NO_PROXY:-}" "$@"
+    else
+        sudo "$@"
+    fi
+}
+
+# ============================================================================
+# INSTALLATION FUNCTIONS
+# ============================================================================
+
+install_prerequisites() {
+    print_subheader "Installing Prerequisites"
+    
+    local packages_to_install=()
+    
+    # Check for required commands
+    if ! command_exists jq; then
+        packages_to_install+=("jq")
+    fi
+    if ! command_exists curl; then
+        packages_to_install+=("curl")
+    fi
+    if ! command_exists unzip; then
+        packages_to_install+=("unzip")
+    fi
+    
+    if [ ${#packages_to_install[@]} -gt 0 ]; then
+        print_status "Installing required packages: ${packages_to_install[*]}"
+        if command_exists apt-get; then
+            sudo_with_proxy apt-get update -qq
+            sudo_with_proxy apt-get install -y -qq "${packages_to_install[@]}"
+        elif command_exists yum; then
+            sudo_with_proxy yum install -y -q "${packages_to_install[@]}"
+        elif command_exists dnf; then
+            sudo_with_proxy dnf install -y -q "${packages_to_install[@]}"
+        else
+            print_error "Cannot install packages: no supported package manager found"
+            return 1
+        fi
+    fi
+    
+    # Verify all required commands exist
+    local required_commands=("jq" "openssl" "ssh-keygen" "curl")
+    for cmd in "${required_commands[@]}"; do
+        if ! command_exists "$cmd"; then
+            print_error "Required command '$cmd' is not available"
+            return 1
+        fi
+    done
+    
+    print_success "All prerequisites installed"
+}
+
+install_oci_cli() {
+    print_subheader "OCI CLI Setup"
+    
+    # Check if OCI CLI is already installed and working
+    if command_exists oci; then
+        local version
+        version=$(oci --version 2>/dev/null | head -1) || version="unknown"
+        print_status "OCI CLI already installed: $version"
+        return 0
+    fi
+    
+    print_status "Installing OCI CLI..."
+    
+    # Check if Python is installed
+    if ! command_exists python3; then
+        print_status "Installing Python 3..."
+        if command_exists apt-get; then
+            sudo_with_proxy apt-get update -qq
+            sudo_with_proxy apt-get install -y -qq python3 python3-venv python3-pip
+        elif command_exists yum; then
+            sudo_with_proxy yum install -y -q python3 python3-pip
+        fi
+    fi
+    
+    # Create virtual environment for OCI CLI
+    local venv_dir="$PWD/.venv"
+    if [ ! -d "$venv_dir" ]; then
+        print_status "Creating Python virtual environment..."
+        python3 -m venv "$venv_dir"
+    fi
+    
+    # Activate and install OCI CLI
+    # shellcheck source=/dev/null
+    # shellcheck disable=SC1091
+    source "$venv_dir/bin/activate"
+    
+    print_status "Installing OCI CLI in virtual environment..."
+    pip install --upgrade pip --quiet
+    pip install oci-cli --quiet
+    
+    # Add activation to bashrc if not already present
+    local activation_line="source $venv_dir/bin/activate"
+    if ! grep -qF "$activation_line" ~/.bashrc 2>/dev/null; then
+        { echo ""; echo "# OCI CLI virtual environment"; echo "$activation_line"; } >> ~/.bashrc
+    fi
+    
+    print_success "OCI CLI installed successfully"
+}
+
+# terraform or tofu, from TF_ENGINE (auto: terraform unless only tofu is installed)
+terraform_engine() {
+    case "$TF_ENGINE" in
+        terraform|tofu) echo "$TF_ENGINE" ;;
+        *) if type -P terraform >/dev/null 2>&1 || ! type -P tofu >/dev/null 2>&1; then echo terraform; else echo tofu; fi ;;
+    esac
+}
+
+# Run terraform, or OpenTofu as the engine (same CLI and state format)
+terraform_binary() {
+    if [ "$(terraform_engine)" = "tofu" ]; then
+        command tofu "$@"
+    else
+        command terraform "$@"
+    fi
+}
+
+# True when the engine's binary exists (the chaos wrapper is a function)
+terraform_available() {
+    type -P "$(terraform_engine)" >/dev/null 2>&1
+}
+
+# Route the terraform command to OpenTofu when that is the engine
+use_terraform_engine() {
+    [ "$(terraform_engine)" = "tofu" ] || return 0
+    # Keep the chaos wrapper if there is one; it already goes through terraform_binary
+    declare -F terraform >/dev/null || terraform() { terraform_binary "$@"; }
+}
+
+install_terraform() {
+    print_subheader "Terraform Setup"
+    
+    if [ "$TF_ENGINE" = "tofu" ]; then
+        if type -P tofu >/dev/null 2>&1; then
+            use_terraform_engine
+            print_status "Using OpenTofu (TF_ENGINE=tofu): $(command tofu version | head -1)"
+            return 0
+        fi
+        print_warning "TF_ENGINE=tofu but OpenTofu is not installed: https://opentofu.org/docs/intro/install/"
+        return 1
+    fi
+
+    if type -P terraform >/dev/null 2>&1; then
+        local version
+        version=$(terraform version -json 2>/dev/null | jq -r '.terraform_version' 2>/dev/null) || \
+        version=$(terraform version | head -1 | awk '{print $2}' | sed 's/v//')
+        print_status "Terraform already installed: version $version"
+        check_terraform_version || true
+        return 0
+    fi
+    
+    if [ "$TF_ENGINE" != "terraform" ] && type -P tofu >/dev/null 2>&1; then
+        use_terraform_engine
+        print_status "Terraform not found - using OpenTofu: $(command tofu version | head -1)"
+        return 0
+    fi
+    
+    if [ "$EMIT_ONLY" = "true" ]; then
+        print_status "Emit-only mode: not installing Terraform"
+        return 1
+    fi
+    
+    print_status "Installing Terraform..."
+    
+    # An exact required_version is installed as that release (snap only has the latest)
+    local pinned_version=""
+    pinned_version=$(terraform_required_version | sed -nE 's/^=? *([0-9]+\.[0-9]+\.[0-9]+)$/\1/p')
+    
+    # Try snap first on Ubuntu/Debian (snapd has its own proxy settings, so not behind one)
+    if [ -z "$pinned_version" ] && ! proxy_enabled && command_exists snap; then
+        if sudo snap install terraform --classic; then
+            print_success "Terraform installed via snap"
+            return 0
+        fi
+    fi
+    
+    # Manual installation
+    local latest_version="$pinned_version"
+    [ -n "$latest_version" ] || \
+        latest_version=$(curl -s https://api.github.com/repos/hashicorp/terraform/releases/latest | jq -r '.tag_name' | sed 's/v//')
+    
+    if [ -z "$latest_version" ] || [ "$latest_version" = "null" ]; then
+        latest_version="1.7.0"
+        print_warning "Could not fetch latest version, using fallback: $latest_version"
+    fi
+    
+    local arch="amd64"
+    if [ "$(uname -m)" = "aarch64" ]; then
+        arch="arm64"
+    fi
+    
+    local os="linux"
+    if [[ "$OSTYPE" == "darwin"* ]]; then
+        os="darwin"
+    fi
+    
+    local tf_url="https://releases.hashicorp.com/terraform/${latest_version}/terraform_${latest_version}_${os}_${arch}.zip"
+    local temp_dir
+    temp_dir=$(mktemp -d)
+    
+    print_status "Downloading Terraform $latest_version for ${os}_${arch}..."
+    
+    if curl -sLo "$temp_dir/terraform.zip" "$tf_url"; then
+        unzip -q "$temp_dir/terraform.zip" -d "$temp_dir"
+        sudo mv "$temp_dir/terraform" /usr/local/bin/
+        sudo chmod +x /usr/local/bin/terraform
+        rm -rf "$temp_dir"
+        
+        if command_exists terraform; then
+            print_success "Terraform installed successfully"
+            return 0
+        fi
+    fi
+    
+    rm -rf "$temp_dir"
+    print_error "Failed to install Terraform"
+    return 1
+}
+
+# ============================================================================
+# TERRAFORM AND PROVIDER VERSIONS
+# ============================================================================
+
+# A constraint from provider.tf: required_version, or the oci provider's version
+provider_tf_constraint() {
+    [ -f provider.tf ] || return 0
+    case "$1" in
+        terraform) grep -oP '^\s*required_version\s*=\s*"\K[^"]*' provider.tf | head -1 ;;
+        oci) awk '/oci = \{/ { p = 1 } p && /version/ { sub(/.*= *"/, ""); sub(/".*/, ""); print; exit }' provider.tf ;;
+    esac
+}
+
+terraform_required_version() {
+    local constraint="${TF_REQUIRED_VERSION:-$(provider_tf_constraint terraform)}"
+    echo "${constraint:->= 1.0}"
+}
+
+oci_provider_version() {
+    local constraint="${OCI_PROVIDER_VERSION:-$(provider_tf_constraint oci)}"
+    echo "${constraint:-~> 6.0}"
+}
+
+# version_satisfies VERSION CONSTRAINT: Terraform constraint syntax ("~> 1.9, != 1.9.2",
+# "= 1.9.8", ">= 1.5"); pre-release suffixes are ignored
+version_satisfies() {
+    local version="${1%%-*}" constraint="$2" term op want upper
+    local -a parts fields
+    IFS=',' read -ra parts <<< "$constraint"
+    for term in "${parts[@]}"; do
+        term="${term// /}"
+        [ -n "$term" ] || continue
+        op="${term%%[0-9]*}"
+        want="${term#"$op"}"
+        case "$op" in
+            ""|"=") [ "$version" = "$want" ] || return 1 ;;
+            "!=") [ "$version" != "$want" ] || return 1 ;;
+            ">") [ "$version" != "$want" ] && version_at_least "$version" "$want" || return 1 ;;
+            ">=") version_at_least "$version" "$want" || return 1 ;;
+            "<") version_at_least "$version" "$want" && return 1 ;;
+            "<=") [ "$version" = "$want" ] || ! version_at_least "$version" "$want" || return 1 ;;
+            "~>")
+                # ~> 1.9 allows 1.x from 1.9; ~> 1.9.2 allows 1.9.x from 1.9.2
+                version_at_least "$version" "$want" || return 1
+                IFS='.' read -ra fields <<< "$want"
+                if [ ${#fields[@]} -ge 3 ]; then
+                    upper="${fields[0]}.$((fields[1] + 1))"
+                else
+                    upper="$((fields[0] + 1))"
+                fi
+                version_at_least "$version" "$upper" && return 1
+                ;;
+            *) return 1 ;;
+        esac
+    done
+    return 0
+}
+
+version_at_least() {
+    [ "$(printf '%s\n' "$2" "$1" | sort -V | head -n 1)" = "$2" ]
+}
+
+# Installed CLI version of the engine, empty when it cannot be read
+terraform_cli_version() {
+    terraform_binary version -json 2>/dev/null | jq -r '.terraform_version // empty' 2>/dev/null || true
+}
+
+# Warn before init when the installed CLI does not satisfy required_version (init would
+# refuse the configuration with a less helpful error)
+check_terraform_version() {
+    local version constraint
+    version=$(terraform_cli_version)
+    constraint=$(terraform_required_version)
+    [ -n "$version" ] || return 0
+    if ! version_satisfies "$version" "$constraint"; then
+        print_warning "$(terraform_engine) $version does not satisfy required_version \"$constraint\" (TF_REQUIRED_VERSION) - init will fail"
+        if [[ "$constraint" =~ ^=?[[:space:]]*[0-9]+\.[0-9]+\.[0-9]+$ ]]; then
+            print_status "Install it from https://releases.hashicorp.com/terraform/${constraint//[= ]/}/, or set TF_REQUIRED_VERSION to a range"
+        fi
+        return 1
+    fi
+    print_debug "$(terraform_engine) $version satisfies \"$constraint\""
+}
+
+# Platforms of TF_LOCK_PLATFORMS that .terraform.lock.hcl has no checksums for yet. Init
+# only records the local platform's h1: hash, so a provider with fewer h1: hashes than
+# platforms is missing some.
+lock_file_missing_platforms() {
+    local wanted
+    wanted=$(wc -w <<< "$TF_LOCK_PLATFORMS")
+    [ "$wanted" -gt 0 ] || return 0
+    [ -f .terraform.lock.hcl ] || { echo "$TF_LOCK_PLATFORMS"; return 0; }
+    awk -v n="$wanted" '/^provider / { if (p != "" && h < n) short = 1; p = $2; h = 0 } /"h1:/ { h++ }
+        END { if (p != "" && h < n) short = 1; exit !short }' .terraform.lock.hcl && echo "$TF_LOCK_PLATFORMS"
+    return 0
+}
+
+# lock [--platform P]...: record provider checksums for every platform in
+# .terraform.lock.hcl (TF_LOCK_PLATFORMS by default)
+terraform_lock_platforms() {
+    local -a platforms=() args=()
+    local platform
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --platform)
+                [[ "${2:-}" =~ ^[a-z]+_[a-z0-9]+$ ]] || { print_error "--platform requires os_arch (e.g. linux_arm64)"; return 2; }
+                platforms+=("$2")
+                shift 2
+                ;;
+            *) print_error "Usage: $0 lock [--platform os_arch]..."; return 2 ;;
+        esac
+    done
+    [ ${#platforms[@]} -gt 0 ] || read -ra platforms <<< "$TF_LOCK_PLATFORMS"
+    if [ ${#platforms[@]} -eq 0 ]; then
+        print_error "No platforms: set TF_LOCK_PLATFORMS or pass --platform"
+        return 2
+    fi
+    for platform in "${platforms[@]}"; do
+        args+=("-platform=$platform")
+    done
+    if [ -n "$PROVIDER_MIRROR_DIR" ]; then
+        args+=("-fs-mirror=$(mirror_path)")
+    fi
+    print_status "Locking provider checksums for ${platforms[*]}..."
+    if ! retry_with_backoff "terraform providers lock ${args[*]}" >/dev/null 2>&1; then
+        if [ -n "$PROVIDER_MIRROR_DIR" ]; then
+            print_error "terraform providers lock failed: is every platform in the mirror? ($0 mirror --platform ...)"
+        else
+            print_error "terraform providers lock failed (needs network access to the provider registry)"
+        fi
+        return 1
+    fi
+    print_success ".terraform.lock.hcl covers ${platforms[*]} - commit it with the workspace"
+}
+
+# ============================================================================
+# OFFLINE PROVIDER MIRROR
+# ============================================================================
+
+# Absolute path of a mirror directory (PROVIDER_MIRROR_DIR by default)
+mirror_path() {
+    local dir="${1:-$PROVIDER_MIRROR_DIR}"
+    [[ "$dir" == /* ]] || dir="$PWD/$dir"
+    echo "$dir"
+}
+
+# CLI config that installs every provider from the mirror and never contacts a registry
+write_mirror_cli_config() {
+    local dir
+    dir=$(mirror_path "$1")
+    mkdir -p "$(dirname "$PROVIDER_MIRROR_CLI_CONFIG")"
+    cat > "$PROVIDER_MIRROR_CLI_CONFIG" << EOF
+# Generated by $(basename "$0"): providers come from the filesystem mirror only
+provider_installation {
+  filesystem_mirror {
+    path = "$(oci_native_path "$dir" | sed 's/\\/\//g')"
+  }
+}
+EOF
+}
+
+# Point Terraform at PROVIDER_MIRROR_DIR for this run (TF_CLI_CONFIG_FILE); the config is
+# written every time, so a workspace copied to another path still finds its mirror
+use_provider_mirror() {
+    [ -n "$PROVIDER_MIRROR_DIR" ] || return 0
+    if [ ! -d "$(mirror_path)" ]; then
+        print_warning "PROVIDER_MIRROR_DIR $(mirror_path) does not exist - run '$0 mirror' where the registry is reachable"
+        return 0
+    fi
+    write_mirror_cli_config || return 0
+    TF_CLI_CONFIG_FILE="$PWD/$PROVIDER_MIRROR_CLI_CONFIG"
+    export TF_CLI_CONFIG_FILE
+    print_debug "Providers from the mirror in $(mirror_path) ($TF_CLI_CONFIG_FILE)"
+}
+
+# mirror [--dir DIR] [--platform P]...: download the providers of provider.tf for every
+# platform (TF_LOCK_PLATFORMS by default) into DIR, plus the CLI config that uses it
+mirror_command() {
+    local dir="${PROVIDER_MIRROR_DIR:-terraform-mirror}" platform
+    local -a platforms=() args=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --dir) dir="${2:?--dir requires a directory}"; shift 2 ;;
+            --platform)
+                [[ "${2:-}" =~ ^[a-z]+_[a-z0-9]+$ ]] || { print_error "--platform requires os_arch (e.g. linux_arm64)"; return 2; }
+                platforms+=("$2")
+                shift 2
+                ;;
+            *) print_error "Usage: $0 mirror [--dir DIR] [--platform os_arch]..."; return 2 ;;
+        esac
+    done
+    [ -f provider.tf ] || { print_error "No provider.tf here - run the setup (or --emit-only) first"; return 1; }
+    [ ${#platforms[@]} -gt 0 ] || read -ra platforms <<< "$TF_LOCK_PLATFORMS"
+    [ ${#platforms[@]} -gt 0 ] || platforms=("$(terraform_binary version -json 2>/dev/null | jq -r '.platform // empty')")
+    for platform in "${platforms[@]}"; do
+        args+=("-platform=$platform")
+    done
+
+    # Downloading needs the registry, so not through the mirror's own CLI config
+    [ "${TF_CLI_CONFIG_FILE:-}" != "$PWD/$PROVIDER_MIRROR_CLI_CONFIG" ] || unset TF_CLI_CONFIG_FILE
+    check_terraform_version || true
+    print_status "Mirroring $(oci_provider_version) oracle/oci for ${platforms[*]} into $dir..."
+    mkdir -p "$dir"
+    if ! retry_with_backoff "terraform providers mirror ${args[*]} $(printf '%q' "$dir")" >/dev/null 2>&1; then
+        print_error "terraform providers mirror failed (needs network access to the provider registry)"
+        return 1
+    fi
+    write_mirror_cli_config "$dir"
+    print_success "Provider mirror ready: $dir ($(du -sh "$dir" 2>/dev/null | cut -f1))"
+    print_status "Offline, copy the workspace with $dir and run: PROVIDER_MIRROR_DIR=$dir $0"
+    print_status "Plain terraform: export TF_CLI_CONFIG_FILE=\"\$PWD/$PROVIDER_MIRROR_CLI_CONFIG\""
+}
+
+# ============================================================================
+# OS KEYCHAIN
+# ============================================================================
+
+keychain_enabled() {
+    [ "$SECRET_STORE" = "keychain" ]
+}
+
+keychain_python() {
+    local python
+    for python in .venv/bin/python python3 python; do
+        command_exists "$python" && { "$python" "$@"; return; }
+    done
+    return 127
+}
+
+# Keychain tool of this machine: security (macOS), secret-tool (libsecret) or keyring
+# (Python, for the Windows Credential Manager and any other). Empty when there is none.
+keychain_backend() {
+    if [ "$(uname -s 2>/dev/null)" = "Darwin" ] && command_exists security; then
+        echo security
+    elif command_exists secret-tool; then
+        echo secret-tool
+    elif keychain_python -c 'import keyring' >/dev/null 2>&1; then
+        echo keyring
+    fi
+}
+
+# Secrets belong to one workspace: "<workspace path>:<name>"
+keychain_account() {
+    echo "$(pwd -P):$1"
+}
+
+# Store stdin as secret NAME (base64, so multi-line keys survive every backend)
+keychain_store() {
+    local account value
+    account=$(keychain_account "$1")
+    value=$(base64 | tr -d '\n')
+    case "$(keychain_backend)" in
+        # A trailing -w makes security prompt for the value (and its confirmation), so it
+        # goes in on stdin and never shows up in the process list
+        security) printf '%s\n%s\n' "$value" "$value" | security add-generic-password -U -s "$SECRET_STORE_SERVICE" -a "$account" -w >/dev/null 2>&1 ;;
+        secret-tool) printf '%s' "$value" | secret-tool store --label="CloudCradle $1" service "$SECRET_STORE_SERVICE" account "$account" ;;
+        keyring) printf '%s' "$value" | keychain_python -c 'import keyring, sys; keyring.set_password(sys.argv[1], sys.argv[2], sys.stdin.read())' "$SECRET_STORE_SERVICE" "$account" ;;
+        *) return 1 ;;
+    esac
+}
+
+# Print secret NAME; fails when it is not stored
+keychain_lookup() {
+    local account value
+    account=$(keychain_account "$1")
+    case "$(keychain_backend)" in
+        security) value=$(security find-generic-password -s "$SECRET_STORE_SERVICE" -a "$account" -w 2>/dev/null) ;;
+        secret-tool) value=$(secret-tool lookup service "$SECRET_STORE_SERVICE" account "$account" 2>/dev/null) ;;
+        keyring) value=$(keychain_python -c 'import keyring, sys; v = keyring.get_password(sys.argv[1], sys.argv[2]); print(v or ""); sys.exit(v is None)' "$SECRET_STORE_SERVICE" "$account" 2>/dev/null) ;;
+    esac
+    [ -n "${value:-}" ] || return 1
+    base64 -d <<< "$value"
+}
+
+# Runs using a key taken from the keychain each hold a file named after their PID in
+# KEY.holders; the last one to exit removes the key, so concurrent runs in one workspace
+# never lose it mid-command. Call with the KEY lock held (file_locked).
+# keychain_hold_ssh_key KEY [--adopt]: materialize KEY unless a run already did and hold it.
+# Fails (2) for a key file the user keeps on disk, unless --adopt (it was just stored).
+keychain_hold_ssh_key() {
+    local key="$1"
+    if [ ! -f "$key" ]; then
+        (umask 077 && keychain_lookup ssh-private-key > "$key") 2>/dev/null || { rm -f "$key"; return 1; }
+    elif [ ! -d "$key.holders" ] && [ "${2:-}" != "--adopt" ]; then
+        return 2
+    fi
+    mkdir -p "$key.holders" && : > "$key.holders/$$"
+}
+
+# keychain_release_ssh_key KEY: drop this run's hold (and those of runs that died); remove
+# KEY when nobody holds it any more. Call with the KEY lock held.
+keychain_release_ssh_key() {
+    local key="$1" holder
+    rm -f "$key.holders/$$"
+    for holder in "$key.holders"/*; do
+        [ -e "$holder" ] || continue
+        kill -0 "${holder##*/}" 2>/dev/null && return 0
+        rm -f "$holder"
+    done
+    rm -f "$key"
+    rmdir "$key.holders" 2>/dev/null || true
+}
+
+# Put the private key kept in the keychain at ssh_keys/id_rsa for this run; cleanup_on_exit
+# removes it again once no other run uses it
+keychain_materialize_ssh_key() {
+    local key="$PWD/ssh_keys/id_rsa" rc=0
+    [ -f "$key" ] || [ -f "$key.pub" ] || return 0
+    file_locked "$key" keychain_hold_ssh_key "$key" || rc=$?
+    case "$rc" in
+        0) KEYCHAIN_MATERIALIZED="$key" ;;
+        1) print_warning "ssh_keys/id_rsa is not in the $(keychain_backend) keychain - SSH to the instances will fail" >&2 ;;
+    esac
+    return 0
+}
+
+# Move ssh_keys/id_rsa into the keychain; the file stays until the run ends
+keychain_save_ssh_key() {
+    local key="$PWD/ssh_keys/id_rsa"
+    [ -f "$key" ] || return 0
+    [ "$KEYCHAIN_MATERIALIZED" = "$key" ] && return 0
+    # Only drop the file once the keychain gives the same key back
+    if ! keychain_store ssh-private-key < "$key" || [ "$(keychain_lookup ssh-private-key 2>/dev/null)" != "$(cat "$key")" ]; then
+        print_warning "Could not store the SSH private key in the keychain - it stays in ssh_keys/id_rsa"
+        return 0
+    fi
+    file_locked "$key" keychain_hold_ssh_key "$key" --adopt || return 0
+    KEYCHAIN_MATERIALIZED="$key"
+    print_success "SSH private key stored in the $(keychain_backend) keychain (ssh_keys/id_rsa is removed when the run ends)"
+}
+
+# Secrets a command may need, from the keychain: the SSH private key and the S3 backend
+# keys (exported for Terraform unless they are set already)
+keychain_load_secrets() {
+    keychain_enabled || return 0
+    if [ -z "$(keychain_backend)" ]; then
+        print_warning "SECRET_STORE=keychain, but no keychain was found (macOS security, secret-tool or Python keyring) - using files" >&2
+        SECRET_STORE=file
+        return 0
+    fi
+    keychain_materialize_ssh_key
+    if [ -z "${AWS_ACCESS_KEY_ID:-}" ] && [ -z "$TF_BACKEND_ACCESS_KEY" ]; then
+        AWS_ACCESS_KEY_ID=$(keychain_lookup tf-backend-access-key 2>/dev/null) && export AWS_ACCESS_KEY_ID || unset AWS_ACCESS_KEY_ID
+    fi
+    if [ -z "${AWS_SECRET_ACCESS_KEY:-}" ] && [ -z "$TF_BACKEND_SECRET_KEY" ]; then
+        AWS_SECRET_ACCESS_KEY=$(keychain_lookup tf-backend-secret-key 2>/dev/null) && export AWS_SECRET_ACCESS_KEY || unset AWS_SECRET_ACCESS_KEY
+    fi
+    return 0
+}
+
+# ============================================================================
+# OPENTOFU STATE ENCRYPTION
+# ============================================================================
+
+# True when the generated encryption block is in use
+state_encryption_enabled() {
+    [ "$TOFU_STATE_ENCRYPTION" != "off" ] && [ "$(terraform_engine)" = "tofu" ]
+}
+
+# Data key of the kms mode, base64, on stdout. It is generated once by the Vault key and
+# only its ciphertext is kept (TOFU_STATE_KEY_FILE); losing that file loses the state.
+state_data_key() {
+    local endpoint out
+    if [ -z "$TOFU_STATE_KMS_KEY_ID" ] || [ -z "$TOFU_STATE_KMS_VAULT_ID" ]; then
+        print_error "TOFU_STATE_ENCRYPTION=kms needs TOFU_STATE_KMS_KEY_ID and TOFU_STATE_KMS_VAULT_ID" >&2
+        return 1
+    fi
+    if ! out=$(oci_cmd "kms management vault get --vault-id $TOFU_STATE_KMS_VAULT_ID"); then
+        print_error "Cannot read vault $TOFU_STATE_KMS_VAULT_ID" >&2
+        return 1
+    fi
+    endpoint=$(jq -r '.data["crypto-endpoint"] // empty' <<< "$out")
+
+    if [ ! -s "$TOFU_STATE_KEY_FILE" ]; then
+        if ! out=$(oci_cmd "kms crypto generate-data-key --key-id $TOFU_STATE_KMS_KEY_ID --endpoint $endpoint \
+            --include-plaintext-key false --key-shape '{\"algorithm\": \"AES\", \"length\": 32}'"); then
+            print_error "Cannot generate a data key with $TOFU_STATE_KMS_KEY_ID" >&2
+            return 1
+        fi
+        (umask 077 && jq -r '.data.ciphertext' <<< "$out" > "$TOFU_STATE_KEY_FILE")
+        print_warning "State key created in $TOFU_STATE_KEY_FILE (encrypted by the Vault key). Keep a copy:" >&2
+        print_warning "without it, or without the Vault key, the state cannot be decrypted." >&2
+    fi
+
+    if ! out=$(oci_cmd "kms crypto decrypt --key-id $TOFU_STATE_KMS_KEY_ID --endpoint $endpoint --ciphertext $(cat "$TOFU_STATE_KEY_FILE")"); then
+        print_error "Cannot decrypt $TOFU_STATE_KEY_FILE with $TOFU_STATE_KMS_KEY_ID" >&2
+        return 1
+    fi
+    jq -r '.data.plaintext' <<< "$out"
+}
+
+# Export TF_VAR_state_passphrase for the encryption block (once per run; an exported value
+# from the environment wins)
+prepare_state_encryption() {
+    state_encryption_enabled || return 0
+    [ -z "${TF_VAR_state_passphrase:-}" ] || return 0
+
+    local key version
+    version=$(command tofu version -json 2>/dev/null | jq -r '.terraform_version // empty') || version=""
+    if [ -n "$version" ] && [ "$(printf '%s\n' 1.8.0 "$version" | sort -V | head -n 1)" != "1.8.0" ]; then
+        print_warning "OpenTofu $version: state encryption with a passphrase variable needs 1.8 or later"
+    fi
+    case "$TOFU_STATE_ENCRYPTION" in
+        passphrase)
+            if [ ${#TOFU_STATE_PASSPHRASE} -lt 16 ]; then
+                print_error "TOFU_STATE_ENCRYPTION=passphrase needs TOFU_STATE_PASSPHRASE (at least 16 characters)"
+                return 1
+            fi
+            key="$TOFU_STATE_PASSPHRASE"
+            ;;
+        kms)
+            key=$(state_data_key) || return 1
+            ;;
+    esac
+    export TF_VAR_state_passphrase="$key"
+}
+
+# True while the state may still be plaintext (see TOFU_STATE_FALLBACK)
+state_needs_fallback() {
+    case "$TOFU_STATE_FALLBACK" in
+        true) return 0 ;;
+        false) return 1 ;;
+    esac
+    [ "$TF_BACKEND" != "local" ] && return 0
+    [ -f terraform.tfstate ] && ! jq -e '.encrypted_data' terraform.tfstate >/dev/null 2>&1
+}
+
+create_terraform_encryption() {
+    print_status "Creating encryption.tf..."
+
+    if ! state_encryption_enabled; then
+        cat << 'EOF' | write_generated_file encryption.tf
+# OpenTofu state and plan encryption (TF_ENGINE=tofu with TOFU_STATE_ENCRYPTION=passphrase
+# or kms). Off: the state is stored as plaintext JSON.
+EOF
+        print_success "encryption.tf created"
+        return 0
+    fi
+
+    local fallback="" migrate=""
+    if state_needs_fallback; then
+        migrate='
+    # Reads state written before encryption was on; the next apply writes it encrypted
+    # (TOFU_STATE_FALLBACK)
+    method "unencrypted" "migrate" {}
+'
+        fallback='
+      fallback {
+        method = method.unencrypted.migrate
+      }'
+    fi
+    write_generated_file encryption.tf << EOF
+# OpenTofu state and plan encryption (TOFU_STATE_ENCRYPTION=$TOFU_STATE_ENCRYPTION)
+# The key is TF_VAR_state_passphrase, set by the setup from $([ "$TOFU_STATE_ENCRYPTION" = "kms" ] && echo "the data key in $TOFU_STATE_KEY_FILE, decrypted by the OCI Vault" || echo "TOFU_STATE_PASSPHRASE").
+# Export it yourself to run tofu by hand; without it the state cannot be read.
+
+terraform {
+  encryption {
+    key_provider "pbkdf2" "state" {
+      passphrase = var.state_passphrase
+    }
+
+    method "aes_gcm" "state" {
+      keys = key_provider.pbkdf2.state
+    }
+$migrate
+    state {
+      method   = method.aes_gcm.state
+      enforced = true$fallback
+    }
+
+    plan {
+      method   = method.aes_gcm.state
+      enforced = true
+    }
+  }
+}
+
+variable "state_passphrase" {
+  description = "Passphrase of the state and plan encryption key (never stored in the workspace)"
+  type        = string
+  sensitive   = true
+}
+EOF
+
+    print_success "encryption.tf created"
+}
+
+# ============================================================================
+# OCI AUTHENTICATION FUNCTIONS
+# ============================================================================
+
+detect_auth_method() {
+    if [ -f "$OCI_CONFIG_FILE" ]; then
+        local cfg_auth
+        local token_file
+        local key_file
+
+        cfg_auth=$(read_oci_config_value "auth")
+        token_file=$(read_oci_config_value "security_token_file")
+        key_file=$(read_oci_config_value "key_file")
+
+        if [ -n "$cfg_auth" ]; then
+            auth_method="$cfg_auth"
+        elif [ -n "$token_file" ]; then
+            auth_method="security_token"
+        elif [ -n "$key_file" ]; then
+            auth_method="api_key"
+        fi
+    fi
+    # OCI_CLI_AUTH wins over the profile, exactly as it does for the OCI CLI itself
+    if [ -n "$OCI_CLI_AUTH" ]; then
+        auth_method="$OCI_CLI_AUTH"
+    fi
+    print_debug "Detected auth method: $auth_method (profile: $OCI_PROFILE, config: $OCI_CONFIG_FILE)"
+}
+
+# Profile or region recorded in the workspace's provider.tf, i.e. what it was deployed with
+workspace_provider_value() {
+    [ -f provider.tf ] || return 0
+    sed -n "s/^[[:space:]]*$1[[:space:]]*=[[:space:]]*\"\(.*\)\"[[:space:]]*$/\1/p" provider.tf | head -1
+}
+
+# True when the workspace has resources in its local state
+workspace_has_state() {
+    [ -f terraform.tfstate ] && jq -e '(.resources // []) | length > 0' terraform.tfstate >/dev/null 2>&1
+}
+
+# Choose among the profiles of OCI_CONFIG_FILE when there are several and none was pinned
+pick_oci_profile() {
+    if [ "$NON_INTERACTIVE" = "true" ] || [ "$OCI_PROFILE_PINNED" = "true" ] || [ ! -f "$OCI_CONFIG_FILE" ]; then
+        return 0
+    fi
+    local profiles=() profile deployed default_index=1 i=1 choice auth tenancy
+    mapfile -t profiles < <(sed -n 's/^[[:space:]]*\[\(.*\)\][[:space:]]*$/\1/p' "$OCI_CONFIG_FILE")
+    [ ${#profiles[@]} -gt 1 ] || return 0
+    deployed=$(workspace_provider_value config_file_profile)
+
+    print_subheader "OCI Profile"
+    for profile in "${profiles[@]}"; do
+        auth="api key"
+        if [ -n "$(read_oci_config_value security_token_file "$OCI_CONFIG_FILE" "$profile" 2>/dev/null || true)" ]; then
+            auth="session"
+        fi
+        tenancy=$(read_oci_config_value tenancy "$OCI_CONFIG_FILE" "$profile" 2>/dev/null || true)
+        printf '  %d) %-20s %-16s %-8s %s%s\n' "$i" "$profile" \
+            "$(read_oci_config_value region "$OCI_CONFIG_FILE" "$profile" 2>/dev/null || echo -)" "$auth" \
+            "${tenancy:+tenancy ...${tenancy: -8}}" "$([ "$profile" = "$deployed" ] && echo "  (this workspace)")"
+        if [ "$profile" = "${deployed:-$OCI_PROFILE}" ]; then
+            default_index=$i
+        fi
+        i=$((i + 1))
+    done
+    choice=$(prompt_int_range "Profile (1-${#profiles[@]})" "$default_index" 1 "${#profiles[@]}")
+    profile="${profiles[choice - 1]}"
+
+    if [ -n "$deployed" ] && [ "$profile" != "$deployed" ] && workspace_has_state; then
+        print_warning "This workspace was deployed with profile [$deployed]; with [$profile] Terraform"
+        print_warning "cannot see its resources if that profile belongs to another tenancy or region"
+        confirm_action "Use [$profile] anyway?" "N" || profile="$deployed"
+    fi
+    OCI_PROFILE="$profile"
+    print_status "Using profile [$OCI_PROFILE] (skip this menu with --profile or OCI_PROFILE)"
+}
+
+# Choose among the tenancy's subscribed regions when there are several and none was pinned.
+# A session token only works in the region it was authenticated in, so switching regions
+# may go through the region mismatch fixes.
+pick_oci_region() {
+    if [ "$NON_INTERACTIVE" = "true" ] || [ "$OCI_REGION_PINNED" = "true" ]; then
+        return 0
+    fi
+    local regions=() name deployed default_index=1 i=1 choice picked latencies
+    fetch_region_subscriptions || return 0
+    mapfile -t regions < <(echo "$REGION_SUBSCRIPTIONS" | jq -r '.[]? | select(.status == "READY") | .name' 2>/dev/null)
+    [ ${#regions[@]} -gt 1 ] || return 0
+    deployed=$(workspace_provider_value region)
+    latencies=$(region_latencies "${regions[@]}")
+
+    print_subheader "Region"
+    for name in "${regions[@]}"; do
+        printf '  %d) %-20s%s%s%s\n' "$i" "$name" "$(region_hint "$name" "$latencies")" \
+            "$([ "$name" = "$home_region" ] && echo "  home region (Always Free compute)")" \
+            "$([ "$name" = "$deployed" ] && echo "  (this workspace)")"
+        if [ "$name" = "${deployed:-$region}" ]; then
+            default_index=$i
+        fi
+        i=$((i + 1))
+    done
+    choice=$(prompt_int_range "Region (1-${#regions[@]})" "$default_index" 1 "${#regions[@]}")
+    picked="${regions[choice - 1]}"
+
+    if [ -n "$deployed" ] && [ "$picked" != "$deployed" ] && workspace_has_state; then
+        print_warning "This workspace's resources are in $deployed; in $picked Terraform would plan to create them all again"
+        confirm_action "Use $picked anyway?" "N" || picked="$deployed"
+    fi
+    print_status "Using region $picked (skip this menu with --region or OCI_REGION)"
+    [ "$picked" = "$region" ] && return 0
+    use_region "$picked"
+}
+
+# The tenancy's region subscriptions and home region, from the Identity API (once per run)
+fetch_region_subscriptions() {
+    [ -z "$REGION_SUBSCRIPTIONS" ] || return 0
+    local subscriptions
+    subscriptions=$(oci_cmd "iam region-subscription list --tenancy-id $tenancy_ocid \
+        --query 'data[].{name:\"region-name\",key:\"region-key\",home:\"is-home-region\",status:status}'" 2>/dev/null) || return 1
+    jq -e 'type == "array"' <<< "$subscriptions" >/dev/null 2>&1 || return 1
+    REGION_SUBSCRIPTIONS="$subscriptions"
+    home_region=$(jq -r '[.[] | select(.home == true)][0].name // empty' <<< "$REGION_SUBSCRIPTIONS")
+}
+
+# Point the rest of this run at REGION. A session token authenticated in another region
+# goes through the region mismatch fixes.
+use_region() {
+    OCI_REGION="$1"
+    if ! oci_cmd "iam region list" >/dev/null 2>&1; then
+        resolve_session_region_mismatch || return 1
+    fi
+    region="$OCI_REGION"
+    print_status "Region: $region"
+}
+
+# Always Free compute only exists in the home region. Stop when the region is another one,
+# or is not subscribed, and offer to switch to the home region. With SERVICE_LIMITS=tenancy
+# the region can also be subscribed. ALLOW_NON_HOME_REGION=true (or tenancy mode) makes a
+# subscribed non-home region a warning.
+check_home_region() {
+    fetch_region_subscriptions || return 0
+    [ -n "$home_region" ] || return 0
+    if [ "$region" = "$home_region" ]; then
+        print_success "Region $region is the tenancy's home region"
+        return 0
+    fi
+
+    local status choice key
+    status=$(jq -r --arg r "$region" '[.[] | select(.name == $r)][0].status // "NONE"' <<< "$REGION_SUBSCRIPTIONS")
+    if [ "$status" = "READY" ] && { [ "$ALLOW_NON_HOME_REGION" = "true" ] || [ "$SERVICE_LIMITS" = "tenancy" ]; }; then
+        print_warning "Region $region is not the home region ($home_region): instances here are not Always Free"
+        return 0
+    fi
+
+    case "$status" in
+        READY) print_error "Region $region is not the tenancy's home region ($home_region); Always Free instances can only be created there" ;;
+        NONE) print_error "The tenancy is not subscribed to $region (home region: $home_region)" ;;
+        *) print_error "The tenancy's subscription to $region is $status, not ready yet (home region: $home_region)" ;;
+    esac
+    if [ "$status" = "READY" ] && [ "$(workspace_provider_value region)" = "$region" ] && workspace_has_state; then
+        print_status "  This workspace is deployed in $region; ALLOW_NON_HOME_REGION=true keeps managing it there"
+    fi
+
+    if [ "$NON_INTERACTIVE" = "true" ]; then
+        print_status "  Fix: --region $home_region (or OCI_REGION=$home_region / region=$home_region in profile [$OCI_PROFILE])"
+        if [ "$status" = "READY" ]; then
+            print_status "   or: ALLOW_NON_HOME_REGION=true to use $region for paid resources"
+        fi
+        return 1
+    fi
+
+    echo "  1) Use $home_region for this run"
+    echo "  2) Use $home_region and make it the region of profile [$OCI_PROFILE]"
+    if [ "$status" = "NONE" ] && [ "$SERVICE_LIMITS" = "tenancy" ]; then
+        echo "  3) Subscribe the tenancy to $region (permanent; everything there is billed)"
+    fi
+    echo "  q) Abort"
+    choice=$(prompt_with_default "Choose" "1")
+    case "$choice" in
+        1)
+            use_region "$home_region"
+            ;;
+        2)
+            set_oci_config_value region "$home_region"
+            print_success "Profile [$OCI_PROFILE] now uses region $home_region"
+            use_region "$home_region"
+            ;;
+        3)
+            [ "$status" = "NONE" ] && [ "$SERVICE_LIMITS" = "tenancy" ] || return 1
+            key=$(oci_cmd "iam region list" 2>/dev/null | jq -r --arg r "$region" '.data[]? | select(.name == $r) | .key' 2>/dev/null)
+            if [ -z "$key" ]; then
+                print_error "Unknown region $region"
+                return 1
+            fi
+            confirm_action "Subscribe to $region? Region subscriptions cannot be removed" "N" || return 1
+            if ! OCI_REGION="$home_region" oci_cmd "iam region-subscription create --tenancy-id $tenancy_ocid --region-key $key" >/dev/null; then
+                print_error "Subscribing to $region failed: ${OCI_LAST_ERROR:-see the OCI CLI output}"
+                return 1
+            fi
+            print_success "Subscription to $region requested; run again once it is ready (usually a few minutes)"
+            return 1
+            ;;
+        *)
+            return 1
+            ;;
+    esac
+}
+
+setup_oci_config() {
+    print_subheader "OCI Authentication"
+
+    # Re-authentication rewrites ~/.oci, so a dry run only accepts a working config
+    if [ "$DRY_RUN" = "true" ]; then
+        detect_auth_method
+        if validate_existing_oci_config && test_oci_connectivity; then
+            print_success "Existing OCI configuration is valid"
+            return 0
+        fi
+        print_error "Dry run requires a working OCI configuration (authentication would modify ~/.oci)"
+        return 1
+    fi
+    
+    # Principal auth (e.g. CI runner on an OCI instance) has nothing to log in to
+    if is_principal_auth "$OCI_CLI_AUTH"; then
+        detect_auth_method
+        if validate_existing_oci_config && test_oci_connectivity; then
+            print_success "Authenticated via $OCI_CLI_AUTH"
+            return 0
+        fi
+        print_error "OCI_CLI_AUTH=$OCI_CLI_AUTH did not yield a working session"
+        return 1
+    fi
+
+    mkdir -p "$OCI_DIR"
+    
+    local existing_config_invalid=0
+    if [ -f "$OCI_CONFIG_FILE" ]; then
+        print_status "Existing OCI configuration found"
+        detect_auth_method
+
+        print_status "Validating existing OCI configuration..."
+
+        if ! validate_existing_oci_config; then
+            existing_config_invalid=1
+            print_warning "Existing OCI configuration is incomplete or requires interactive input"
+        else
+            # Test existing configuration
+            print_status "Testing existing OCI configuration connectivity..."
+            if test_oci_connectivity; then
+                print_success "Existing OCI configuration is valid"
+                return 0
+            fi
+        fi
+
+        print_warning "Existing configuration failed connectivity test (will retry with refresh)"
+
+        # A session authenticated in another region 401s everywhere else
+        if [ "$auth_method" = "security_token" ] && [ "$existing_config_invalid" -eq 0 ] \
+            && resolve_session_region_mismatch; then
+            return 0
+        fi
+
+        # Check if session token expired
+        if [ "$auth_method" = "security_token" ]; then
+            print_status "Attempting to refresh session token (timeout ${OCI_CMD_TIMEOUT}s)..."
+            if oci_cmd "session refresh" >/dev/null 2>&1; then
+                if test_oci_connectivity; then
+                    print_success "Session token refreshed successfully"
+                    return 0
+                fi
+            else
+                print_warning "Session refresh failed or timed out"
+            fi
+            
+            print_status "Session refresh did not restore connectivity, initiating interactive authentication as a fallback..."
+        fi
+    fi
+    
+    # Setup new authentication
+    print_status "Setting up browser-based authentication..."
+    print_status "This will open a browser window for you to log in to Oracle Cloud."
+
+    if [ "$NON_INTERACTIVE" = "true" ]; then
+        print_error "Cannot perform interactive authentication in non-interactive mode. Aborting."
+        return 1
+    fi
+
+    # Determine region to use for browser login.
+    # If we have an existing config, prefer its region (avoids the region selection prompt).
+    local auth_region
+    auth_region=$(read_oci_config_value "region" "$OCI_CONFIG_FILE" "$OCI_PROFILE" 2>/dev/null || true)
+    auth_region=${auth_region:-$OCI_AUTH_REGION}
+    auth_region=${auth_region:-$(suggest_auth_region)}
+
+    # Keep this interactive (per UX request): prompt with a sane default so Enter works.
+    if [ "$NON_INTERACTIVE" != "true" ]; then
+        auth_region=$(prompt_with_default "Region for authentication" "$auth_region")
+    fi
+
+    # Allow forcing re-auth / new profile
+    if [ "$FORCE_REAUTH" = "true" ]; then
+        new_profile=$(prompt_with_default "Enter new profile name to create/use" "NEW_PROFILE")
+        print_status "Starting interactive session authenticate for profile '$new_profile'..."
+
+        print_status "Using region '$auth_region' for authentication"
+        local auth_out
+        if uses_windows_browser; then
+            auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1) || {
+                echo "$auth_out" >&2
+                if echo "$auth_out" | grep -i -E "config file.*is invalid|Config Errors|user .*missing" >/dev/null 2>&1; then
+                    print_warning "OCI CLI reports the config file is invalid or missing required fields. Offering repair options..."
+                    existing_config_invalid=1
+                else
+                    print_error "Authentication failed"
+                    return 1
+                fi
+            }
+            if [ "$existing_config_invalid" -ne 1 ]; then
+                echo "$auth_out"
+                local url
+                url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
+                if [ -n "$url" ]; then
+                    print_status "Opening the Windows browser for the login URL..."
+                    open_url_best_effort "$url" || true
+                fi
+            fi
+        else
+            if ! oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
+                print_error "Browser authentication failed or was cancelled"
+                return 1
+            fi
+        fi
+
+        print_status "Authentication for profile '$new_profile' completed. Updating OCI_PROFILE to use it."
+        OCI_PROFILE="$new_profile"
+        auth_method="security_token"
+
+        if [ "$existing_config_invalid" -eq 1 ]; then
+            # Run the same automatic delete and recreate flow
+            print_warning "Detected invalid or incomplete OCI config file during forced re-auth - AUTOMATICALLY DELETING AND FORCING FRESH AUTHENTICATION"
+
+            # IMMEDIATE DELETE: Remove corrupted config without prompting
+            if [ -f "$OCI_CONFIG_FILE" ]; then
+                print_status "Backing up corrupted config to $OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)"
+                cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)" 2>/dev/null || true
+                print_status "Forcibly deleting corrupted config file: $OCI_CONFIG_FILE"
+                rm -f "$OCI_CONFIG_FILE"
+            fi
+            
+            # Delete any temp config files to start completely fresh
+            rm -f "$OCI_DIR/config.session_auth" 2>/dev/null || true
+            
+            # Create completely new profile with session auth
+            new_profile="DEFAULT"
+            print_status "Creating fresh OCI configuration with browser-based authentication for profile '$new_profile'..."
+            print_status "This will open your browser to log into Oracle Cloud."
+            print_status ""
+            print_status "Using region '$auth_region' for authentication"
+            print_status ""
+            
+            # Use the default config location (let OCI CLI create it fresh)
+            OCI_CONFIG_FILE="$OCI_DIR/config"
+            OCI_PROFILE="$new_profile"
+            unset OCI_CLI_CONFIG_FILE
+            
+            if uses_windows_browser; then
+                if auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1); then
+                    echo "$auth_out"
+                    local url
+                    url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
+                    if [ -n "$url" ]; then
+                        print_status "Opening the Windows browser for the login URL..."
+                        open_url_best_effort "$url" || true
+                        print_status ""
+                        print_status "After completing browser authentication, press Enter to continue..."
+                        read -r
+                    fi
+                    OCI_PROFILE="$new_profile"
+                    auth_method="security_token"
+                    if test_oci_connectivity; then
+                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
+                        return 0
+                    else
+                        print_warning "Session auth completed but connectivity test failed"
+                    fi
+                else
+                    echo "$auth_out" >&2
+                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
+                    return 1
+                fi
+            else
+                if oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
+                    OCI_PROFILE="$new_profile"
+                    auth_method="security_token"
+                    if test_oci_connectivity; then
+                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
+                        return 0
+                    else
+                        print_warning "Session auth completed but connectivity test failed"
+                    fi
+                else
+                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
+                    return 1
+                fi
+            fi
+        fi
+
+        if test_oci_connectivity; then
+            print_success "OCI authentication configured successfully for profile '$new_profile'"
+            return 0
+        else
+            print_warning "Authentication succeeded but connectivity test failed for profile '$new_profile'"
+        fi
+    else
+        # If existing config was invalid, automatically fix it
+        if [ "$existing_config_invalid" -eq 1 ]; then
+            print_warning "Detected invalid or incomplete OCI config file - AUTOMATICALLY DELETING AND FORCING FRESH AUTHENTICATION"
+            
+            # IMMEDIATE DELETE: Remove corrupted config without prompting
+            if [ -f "$OCI_CONFIG_FILE" ]; then
+                print_status "Backing up corrupted config to $OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)"
+                cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)" 2>/dev/null || true
+                print_status "Forcibly deleting corrupted config file: $OCI_CONFIG_FILE"
+                rm -f "$OCI_CONFIG_FILE"
+            fi
+            
+            # Delete any temp config files to start completely fresh
+            rm -f "$OCI_DIR/config.session_auth" 2>/dev/null || true
+            
+            # Create completely new profile with session auth
+            new_profile="DEFAULT"
+            print_status "Creating fresh OCI configuration with browser-based authentication for profile '$new_profile'..."
+            print_status "This will open your browser to log into Oracle Cloud."
+            print_status ""
+            print_status "Using region '$auth_region' for authentication"
+            print_status ""
+            
+            # Use the default config location (let OCI CLI create it fresh)
+            OCI_CONFIG_FILE="$OCI_DIR/config"
+            OCI_PROFILE="$new_profile"
+            unset OCI_CLI_CONFIG_FILE
+            
+            if uses_windows_browser; then
+                if auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1); then
+                    echo "$auth_out"
+                    local url
+                    url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
+                    if [ -n "$url" ]; then
+                        print_status "Opening the Windows browser for the login URL..."
+                        open_url_best_effort "$url" || true
+                        print_status ""
+                        print_status "After completing browser authentication, press Enter to continue..."
+                        read -r
+                    fi
+                    auth_method="security_token"
+                    if test_oci_connectivity; then
+                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
+                        return 0
+                    else
+                        print_warning "Session auth completed but connectivity test failed"
+                    fi
+                else
+                    echo "$auth_out" >&2
+                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
+                    return 1
+                fi
+            else
+                if oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
+                    auth_method="security_token"
+                    if test_oci_connectivity; then
+                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
+                        return 0
+                    else
+                        print_warning "Session auth completed but connectivity test failed"
+                    fi
+                else
+                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
+                    return 1
+                fi
+            fi
+        fi
+        # Interactive authenticate (may open browser)
+        print_status "Using profile '$OCI_PROFILE' for interactive session authenticate..."
+
+        print_status "Using region '$auth_region' for authentication"
+        if uses_windows_browser; then
+            local auth_out
+            auth_out=$(oci session authenticate --no-browser --profile-name "$OCI_PROFILE" --region "$auth_region" --session-expiration-in-minutes 60 2>&1) || {
+                echo "$auth_out" >&2
+                if echo "$auth_out" | grep -i -E "config file.*is invalid|Config Errors|user .*missing" >/dev/null 2>&1; then
+                    print_warning "OCI CLI reports the config file is invalid or missing required fields. Offering repair options..."
+                    existing_config_invalid=1
+                else
+                    print_error "Authentication failed"
+                    return 1
+                fi
+            }
+            if [ "$existing_config_invalid" -ne 1 ]; then
+                echo "$auth_out"
+                local url
+                url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
+                if [ -n "$url" ]; then
+                    print_status "Opening the Windows browser for the login URL..."
+                    open_url_best_effort "$url" || true
+                fi
+            fi
+        else
+            # Capture output so we can detect invalid-config errors and offer remediation
+            auth_out=$(oci session authenticate --profile-name "$OCI_PROFILE" --region "$auth_region" --session-expiration-in-minutes 60 2>&1) || {
+                echo "$auth_out" >&2
+                if echo "$auth_out" | grep -i -E "config file.*is invalid|Config Errors|user .*missing" >/dev/null 2>&1; then
+                    print_warning "OCI CLI reports the config file is invalid or missing required fields. Offering repair options..."
+                    existing_config_invalid=1
+                else
+                    print_error "Browser authentication failed or was cancelled"
+                    return 1
+                fi
+            }
+        fi
+
+        # SHARED REPAIR FLOW: runs for both WSL and non-WSL when existing_config_invalid is set
+        if [ "$existing_config_invalid" -eq 1 ]; then
+            print_warning "Detected invalid or incomplete OCI config file - AUTOMATICALLY DELETING AND FORCING FRESH AUTHENTICATION"
+            
+            # IMMEDIATE DELETE: Remove corrupted config without prompting
+            if [ -f "$OCI_CONFIG_FILE" ]; then
+                print_status "Backing up corrupted config to $OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)"
+                cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)" 2>/dev/null || true
+                print_status "Forcibly deleting corrupted config file: $OCI_CONFIG_FILE"
+                rm -f "$OCI_CONFIG_FILE"
+            fi
+            
+            # Delete any temp config files to start completely fresh
+            rm -f "$OCI_DIR/config.session_auth" 2>/dev/null || true
+            
+            # Create completely new profile with session auth
+            new_profile="DEFAULT"
+            print_status "Creating fresh OCI configuration with browser-based authentication for profile '$new_profile'..."
             print_status "This will open your browser to log into Oracle Cloud."
             print_status ""
             print_status "Using region '$auth_region' for authentication"
             print_status ""
             
-            # Use the default config location (let OCI CLI create it fresh)
-            OCI_CONFIG_FILE="$HOME/.oci/config"
-            OCI_PROFILE="$new_profile"
-            unset OCI_CLI_CONFIG_FILE
+            # Use the default config location (let OCI CLI create it fresh)
+            OCI_CONFIG_FILE="$OCI_DIR/config"
+            OCI_PROFILE="$new_profile"
+            unset OCI_CLI_CONFIG_FILE
+            
+            if uses_windows_browser; then
+                if auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1); then
+                    echo "$auth_out"
+                    local url
+                    url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
+                    if [ -n "$url" ]; then
+                        print_status "Opening the Windows browser for the login URL..."
+                        open_url_best_effort "$url" || true
+                        print_status ""
+                        print_status "After completing browser authentication, press Enter to continue..."
+                        read -r
+                    fi
+                    auth_method="security_token"
+                    if test_oci_connectivity; then
+                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
+                        return 0
+                    else
+                        print_warning "Session auth completed but connectivity test failed"
+                    fi
+                else
+                    echo "$auth_out" >&2
+                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
+                    return 1
+                fi
+            else
+                if oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
+                    auth_method="security_token"
+                    if test_oci_connectivity; then
+                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
+                        return 0
+                    else
+                        print_warning "Session auth completed but connectivity test failed"
+                    fi
+                else
+                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
+                    return 1
+                fi
+            fi
+        fi
+
+
+        # If we got here without returning, then authentication succeeded but connectivity might have issues
+        # Let's continue anyway since the auth was successful
+        auth_method="security_token"
+
+        # Verify the new configuration
+        if test_oci_connectivity; then
+            print_success "OCI authentication configured successfully"
+            return 0
+        fi
+    fi
+
+    print_error "OCI configuration verification failed"
+    return 1
+}
+
+# Set KEY=VALUE in the current profile of OCI_CONFIG_FILE (backing the file up first)
+set_oci_config_value() {
+    local key="$1" value="$2"
+    cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.bak.$(date +%Y%m%d_%H%M%S)"
+    awk -v key="$key" -v value="$value" -v profile="[$OCI_PROFILE]" '
+        /^[[:space:]]*\[/ {
+            if (in_profile && !done) { print key "=" value; done = 1 }
+            in_profile = ($0 == profile)
+        }
+        in_profile && $0 ~ "^[[:space:]]*"key"[[:space:]]*=" { if (!done) print key "=" value; done = 1; next }
+        { print }
+        END { if (in_profile && !done) print key "=" value }
+    ' "$OCI_CONFIG_FILE" > "$OCI_CONFIG_FILE.tmp" && mv "$OCI_CONFIG_FILE.tmp" "$OCI_CONFIG_FILE"
+    chmod 600 "$OCI_CONFIG_FILE"
+}
+
+# Session tokens are only accepted in the region they were authenticated in. When the
+# configured region fails, find the region the session works in and offer to either
+# re-authenticate in the configured region or switch to the session's region.
+resolve_session_region_mismatch() {
+    local profile_region target source tenancy candidate auth_region="" subscriptions=""
+    profile_region=$(read_oci_config_value "region" 2>/dev/null || true)
+    tenancy=$(read_oci_config_value "tenancy" 2>/dev/null || true)
+    [ -n "$tenancy" ] || return 1
+    if [ -n "$OCI_REGION" ]; then
+        target="$OCI_REGION"
+        source="OCI_REGION"
+    else
+        target="$profile_region"
+        source="profile [$OCI_PROFILE]"
+    fi
+    [ -n "$target" ] || return 1
+
+    for candidate in "$profile_region" "$OCI_AUTH_REGION" "$(default_region_for_host)"; do
+        [ -n "$candidate" ] && [ "$candidate" != "$target" ] || continue
+        if subscriptions=$(OCI_REGION="$candidate" oci_cmd "iam region-subscription list --tenancy-id $tenancy \
+            --query 'data[].{name:\"region-name\",home:\"is-home-region\"}'" 2>/dev/null); then
+            auth_region="$candidate"
+            break
+        fi
+    done
+    [ -n "$auth_region" ] || return 1
+
+    local home subscribed
+    home=$(echo "$subscriptions" | jq -r '[.[]? | select(.home == true)][0].name // empty' 2>/dev/null)
+    subscribed=$(echo "$subscriptions" | jq -r --arg r "$target" '[.[]? | select(.name == $r)] | length' 2>/dev/null)
+
+    echo ""
+    print_error "Region mismatch: the session for profile '$OCI_PROFILE' was authenticated in $auth_region,"
+    print_error "but requests go to $target (from $source), where the session token is rejected (401)."
+    [ -n "$home" ] && print_status "  Tenancy home region: $home"
+    if [ "${subscribed:-0}" = "0" ]; then
+        print_warning "  The tenancy is not subscribed to $target - subscribe to it in the console or use $auth_region"
+    fi
+
+    if [ "$NON_INTERACTIVE" = "true" ]; then
+        print_status "  Fix: oci session authenticate --profile-name $OCI_PROFILE --region $target"
+        print_status "   or: use region $auth_region (unset OCI_REGION / set region=$auth_region in the profile)"
+        return 1
+    fi
+
+    echo "  1) Re-authenticate in $target"
+    echo "  2) Use $auth_region instead$([ "$source" = "OCI_REGION" ] && echo " for this run" || echo " (update region in profile [$OCI_PROFILE])")"
+    echo "  3) Do nothing"
+    local choice
+    choice=$(prompt_with_default "Choose (1-3)" "$([ "${subscribed:-0}" = "0" ] && echo 2 || echo 1)")
+    case "$choice" in
+        1)
+            if oci session authenticate --profile-name "$OCI_PROFILE" --region "$target" --session-expiration-in-minutes 60 \
+                && test_oci_connectivity; then
+                SESSION_TOKEN_MTIME=$(file_mtime "$(session_token_file)" || echo "")
+                print_success "Re-authenticated in $target"
+                return 0
+            fi
+            print_error "Re-authentication in $target failed"
+            return 1
+            ;;
+        2)
+            if [ "$source" = "OCI_REGION" ]; then
+                OCI_REGION="$auth_region"
+                print_status "Using $auth_region for this run; update OCI_REGION to make it permanent"
+            else
+                set_oci_config_value region "$auth_region"
+                print_success "Profile [$OCI_PROFILE] now uses region $auth_region"
+            fi
+            test_oci_connectivity
+            ;;
+        *)
+            return 1
+            ;;
+    esac
+}
+
+test_oci_connectivity() {
+    print_status "Testing OCI API connectivity..."
+    
+    # Method 1: List regions (simplest test)
+    print_status "Checking IAM region list (timeout ${OCI_CMD_TIMEOUT}s)..."
+    if oci_cmd "iam region list" >/dev/null 2>&1; then
+        print_debug "Connectivity test passed (region list)"
+        return 0
+    else
+        print_warning "Region list query failed or timed out"
+    fi
+    
+    # Method 2: Get tenancy info if we have it
+    local test_tenancy
+    test_tenancy=$(grep -oP '(?<=tenancy=).*' "$OCI_CONFIG_FILE" 2>/dev/null | head -1)
+    
+    if [ -n "$test_tenancy" ]; then
+        print_status "Checking IAM tenancy get (timeout ${OCI_CMD_TIMEOUT}s)..."
+        if oci_cmd "iam tenancy get --tenancy-id $test_tenancy" >/dev/null 2>&1; then
+            print_debug "Connectivity test passed (tenancy get)"
+            return 0
+        else
+            print_warning "Tenancy get failed or timed out"
+        fi
+    fi
+    
+    print_debug "All connectivity tests failed"
+    return 1
+}
+
+# ============================================================================
+# OCI RESOURCE DISCOVERY FUNCTIONS
+# ============================================================================
+
+fetch_oci_config_values() {
+    print_subheader "Fetching OCI Configuration"
+    
+    # Tenancy OCID (OCI_TENANCY overrides the profile)
+    tenancy_ocid=${OCI_TENANCY:-$(read_oci_config_value "tenancy" 2>/dev/null || true)}
+    if [ -z "$tenancy_ocid" ]; then
+        print_error "Failed to fetch tenancy OCID from config (set OCI_TENANCY)"
+        return 1
+    fi
+    print_status "Tenancy OCID: $tenancy_ocid"
+    
+    # User OCID
+    user_ocid=$(read_oci_config_value "user" 2>/dev/null || true)
+    if [ -z "$user_ocid" ] && ! is_principal_auth; then
+        # Try to get from API for session token auth
+        local user_info
+        user_info=$(oci_cmd "iam user list --compartment-id $tenancy_ocid --limit 1")
+        user_ocid=$(safe_jq "$user_info" '.data[0].id')
+    fi
+    print_status "User OCID: ${user_ocid:-N/A ($auth_method auth)}"
+    
+    # Region (OCI_REGION overrides the profile)
+    region=${OCI_REGION:-$(read_oci_config_value "region" 2>/dev/null || true)}
+    if [ -z "$region" ]; then
+        print_error "Failed to fetch region from config (set OCI_REGION)"
+        return 1
+    fi
+    print_status "Region: $region"
+    
+    # Fingerprint (only for API key auth)
+    if [ "$auth_method" = "security_token" ]; then
+        fingerprint="session_token_auth"
+    elif is_principal_auth; then
+        fingerprint="${auth_method}_auth"
+    else
+        fingerprint=$(read_oci_config_value "fingerprint" 2>/dev/null || true)
+    fi
+    print_debug "Auth fingerprint: $fingerprint"
+    
+    print_success "OCI configuration values fetched"
+}
+
+fetch_availability_domains() {
+    print_status "Fetching availability domains..."
+    
+    local ad_list
+    ad_list=$(oci_cmd "iam availability-domain list --compartment-id $tenancy_ocid --query 'data[].name' --raw-output")
+    
+    if [ -z "$ad_list" ] || [ "$ad_list" = "null" ]; then
+        print_error "Failed to fetch availability domains"
+        return 1
+    fi
+    
+    # Parse first AD
+    availability_domain=$(echo "$ad_list" | jq -r '.[0]' 2>/dev/null)
+    
+    if [ -z "$availability_domain" ] || [ "$availability_domain" = "null" ]; then
+        print_error "Failed to parse availability domain"
+        return 1
+    fi
+    
+    print_success "Availability domain: $availability_domain"
+}
+
+# Value of a service limit, for availability-domain scoped limits the one of the AD the
+# instances launch in; empty when the Limits API does not know it
+service_limit_value() {
+    local service="$1" name="$2"
+    oci_cmd "limits value list --compartment-id $tenancy_ocid --service-name $service --name $name --all \
+        --query 'data[].{scope:\"scope-type\",ad:\"availability-domain\",value:value}'" 2>/dev/null \
+        | jq -r --arg ad "$availability_domain" '[.[]? | select(.scope != "AD" or .ad == $ad) | .value][0] // empty' 2>/dev/null
+}
+
+# Replace the Always Free maximums with the tenancy's service limits (SERVICE_LIMITS)
+declare -g SERVICE_LIMITS_FETCHED=false
+fetch_service_limits() {
+    [ "$SERVICE_LIMITS" != "off" ] && [ "$SERVICE_LIMITS_FETCHED" != "true" ] || return 0
+    SERVICE_LIMITS_FETCHED=true
+
+    local storage_limit=total-free-storage-gb-regional entry var service name value
+    [ "$SERVICE_LIMITS" = "tenancy" ] && storage_limit=total-storage-gb
+    for entry in "FREE_TIER_MAX_ARM_OCPUS compute standard-a1-core-count" \
+        "FREE_TIER_MAX_ARM_MEMORY_GB compute standard-a1-memory-count" \
+        "FREE_TIER_MAX_AMD_INSTANCES compute vm-standard-e2-1-micro-count" \
+        "FREE_TIER_MAX_STORAGE_GB block-storage $storage_limit" \
+        "FREE_TIER_MAX_VCNS vcn vcn-count"; do
+        read -r var service name <<< "$entry"
+        value=$(service_limit_value "$service" "$name") || value=""
+        value=${value%%.*}
+        if [[ ! "$value" =~ ^[0-9]+$ ]]; then
+            print_debug "Service limit $service/$name unknown; using ${!var}"
+            continue
+        fi
+        [ "$value" = "${!var}" ] && continue
+        if [ "$SERVICE_LIMITS" = "tenancy" ] || [ "$value" -lt "${!var}" ]; then
+            print_status "Service limit $name: $value (Always Free: ${!var})"
+            printf -v "$var" '%s' "$value"
+        fi
+    done
+    # One OCPU per ARM instance at least
+    if [ "$SERVICE_LIMITS" = "tenancy" ] || [ "$FREE_TIER_MAX_ARM_OCPUS" -lt "$FREE_TIER_MAX_ARM_INSTANCES" ]; then
+        FREE_TIER_MAX_ARM_INSTANCES=$FREE_TIER_MAX_ARM_OCPUS
+    fi
+    if [ "$SERVICE_LIMITS" = "tenancy" ]; then
+        print_warning "SERVICE_LIMITS=tenancy: sizes are checked against the tenancy's limits, usage beyond Always Free is billed"
+    fi
+    return 0
+}
+
+# Check that a custom image exists, is available and fits the shape; prints its name
+custom_image_name() {
+    local ocid="$1" shape="$2" image state compatible
+    if [[ ! "$ocid" =~ ^ocid1\.image\. ]]; then
+        print_error "  '$ocid' is not an image OCID" >&2
+        return 1
+    fi
+    image=$(oci_cmd "compute image get \
+        --image-id '$ocid' \
+        --query 'data.{name:\"display-name\",state:\"lifecycle-state\"}'" 2>/dev/null) || image=""
+    state=$(safe_jq "$image" '.state')
+    if [ -z "$state" ] || [ "$state" = "null" ]; then
+        print_error "  Image $ocid not found (wrong region, or not shared with this tenancy)" >&2
+        return 1
+    fi
+    if [ "$state" != "AVAILABLE" ]; then
+        print_error "  Image $ocid is $state, not AVAILABLE" >&2
+        return 1
+    fi
+    compatible=$(oci_cmd "compute image-shape-compatibility-entry list \
+        --image-id '$ocid' \
+        --query 'data[].shape' \
+        --all" 2>/dev/null) || compatible=""
+    if [ -n "$compatible" ] && ! jq -e --arg s "$shape" 'index($s) != null' <<< "$compatible" >/dev/null 2>&1; then
+        print_error "  Image $ocid is not compatible with $shape" >&2
+        return 1
+    fi
+    safe_jq "$image" '.name'
+}
+
+# ============================================================================
+# OPERATING SYSTEMS
+# ============================================================================
+
+readonly SUPPORTED_OSES="ubuntu oracle-linux almalinux rocky debian"
+readonly SUPPORTED_UBUNTU_VERSIONS="22.04 24.04"
+
+os_label() {
+    case "$1" in
+        ubuntu) echo "Ubuntu" ;;
+        oracle-linux) echo "Oracle Linux" ;;
+        almalinux) echo "AlmaLinux" ;;
+        rocky) echo "Rocky Linux" ;;
+        debian) echo "Debian" ;;
+    esac
+}
+
+# operating-system name of OCI platform images (empty for Marketplace-only distros)
+os_platform_name() {
+    case "$1" in
+        ubuntu) echo "Canonical Ubuntu" ;;
+        oracle-linux) echo "Oracle Linux" ;;
+    esac
+}
+
+# Default login user of the distro's cloud images
+os_default_user() {
+    case "$1" in
+        oracle-linux) echo "opc" ;;
+        almalinux) echo "almalinux" ;;
+        rocky) echo "rocky" ;;
+        debian) echo "debian" ;;
+        *) echo "ubuntu" ;;
+    esac
+}
+
+# Settle INSTANCE_OS: the flag/variable, else the OS saved in variables.tf, else ubuntu
+resolve_instance_os() {
+    if [ -z "$INSTANCE_OS" ]; then
+        INSTANCE_OS=$(grep -oP '^\s*instance_os\s*=\s*"\K[^"]+' variables.tf 2>/dev/null | head -1) || INSTANCE_OS=""
+        INSTANCE_OS=${INSTANCE_OS:-ubuntu}
+    fi
+    if [[ ! " $SUPPORTED_OSES " == *" $INSTANCE_OS "* ]]; then
+        print_error "INSTANCE_OS must be one of: $SUPPORTED_OSES (got '$INSTANCE_OS')"
+        return 1
+    fi
+}
+
+# Settle UBUNTU_VERSION/UBUNTU_VARIANT: the flags/variables, else the release pinned in
+# IMAGE_LOCK_FILE for this region, else 24.04 standard
+resolve_ubuntu_release() {
+    local pinned pinned_version="" pinned_variant=""
+    pinned=$(jq -r --arg r "$region" '.[$r].selection // empty' "$IMAGE_LOCK_FILE" 2>/dev/null) || pinned=""
+    if [[ "$pinned" == "ubuntu "* ]]; then
+        read -r _ pinned_version pinned_variant <<< "$pinned"
+    fi
+    UBUNTU_VERSION=${UBUNTU_VERSION:-${pinned_version:-24.04}}
+    UBUNTU_VARIANT=${UBUNTU_VARIANT:-${pinned_variant:-standard}}
+    if [[ ! " $SUPPORTED_UBUNTU_VERSIONS " == *" $UBUNTU_VERSION "* ]]; then
+        print_error "UBUNTU_VERSION must be one of: $SUPPORTED_UBUNTU_VERSIONS (got '$UBUNTU_VERSION')"
+        return 1
+    fi
+    if [[ ! "$UBUNTU_VARIANT" =~ ^(standard|minimal)$ ]]; then
+        print_error "UBUNTU_VARIANT must be 'standard' or 'minimal' (got '$UBUNTU_VARIANT')"
+        return 1
+    fi
+}
+
+# What the pinned images were resolved for: "ubuntu 24.04 minimal", "rocky", ...
+image_selection() {
+    if [ "$INSTANCE_OS" = "ubuntu" ]; then
+        echo "ubuntu $UBUNTU_VERSION $UBUNTU_VARIANT"
+    else
+        echo "$INSTANCE_OS"
+    fi
+}
+
+# User to log in as: SSH_USER, else the user saved in variables.tf, else the OS default
+ssh_login_user() {
+    local user="$SSH_USER"
+    [ -n "$user" ] || user=$(grep -oP '^\s*ssh_user\s*=\s*"\K[^"]+' variables.tf 2>/dev/null | head -1) || user=""
+    if [ -z "$user" ]; then
+        resolve_instance_os >/dev/null 2>&1 || true
+        user=$(os_default_user "${INSTANCE_OS:-ubuntu}")
+    fi
+    echo "$user"
+}
+
+# sshd port: SSH_PORT, else the port saved in variables.tf, else 22
+ssh_port() {
+    local port="$SSH_PORT"
+    [ -n "$port" ] || port=$(grep -oP '^\s*ssh_port\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || port=""
+    echo "${port:-22}"
+}
+
+# cloud-init differences per distro as an HCL object: base packages, the EPEL release
+# package and packages only EPEL has (RHEL family), and the admin group
+os_settings_tf() {
+    case "$INSTANCE_OS" in
+        oracle-linux|almalinux|rocky)
+            # curl-minimal is preinstalled and conflicts with the curl package
+            jq -n -c --arg epel "$([ "$INSTANCE_OS" = "oracle-linux" ] && echo 'oracle-epel-release-el$(rpm -E %rhel)' || echo epel-release)" \
+                '{packages: ["wget", "git", "vim-enhanced", "unzip", "jq", "tmux", "net-tools", "iotop"],
+                  epel_release: $epel, epel_packages: ["htop", "ncdu"], sudo_group: "wheel"}'
+            ;;
+        *)
+            jq -n -c '{packages: ["curl", "wget", "git", "htop", "vim", "unzip", "jq", "tmux", "net-tools", "iotop", "ncdu"],
+                  epel_release: "", epel_packages: [], sudo_group: "sudo"}'
+            ;;
+    esac
+}
+
+# Newest Marketplace (partner image catalog) image of INSTANCE_OS for a shape; sets
+# RESOLVED_IMAGE_OCID, RESOLVED_IMAGE_NAME and RESOLVED_LISTING ("<listing id>|<version>")
+resolve_marketplace_image() {
+    local shape="$1" listings listing_id listing_name versions version details
+    listings=$(oci_cmd "compute pic listing list \
+        --query 'data[].{id:\"listing-id\",name:\"display-name\"}' \
+        --all" 2>/dev/null) || listings="[]"
+    while IFS=$'\t' read -r listing_id listing_name; do
+        [ -n "$listing_id" ] || continue
+        versions=$(oci_cmd "compute pic version list \
+            --listing-id '$listing_id' \
+            --query 'data[].{version:\"listing-resource-version\",published:\"time-published\"}' \
+            --all" 2>/dev/null) || continue
+        version=$(jq -r 'sort_by(.published) | last | .version // empty' <<< "$versions")
+        [ -n "$version" ] || continue
+        details=$(oci_cmd "compute pic version get \
+            --listing-id '$listing_id' \
+            --resource-version '$version' \
+            --query 'data.{image:\"listing-resource-id\",shapes:\"compatible-shapes\"}'" 2>/dev/null) || continue
+        if jq -e --arg s "$shape" '.shapes // [] | index($s) != null' <<< "$details" >/dev/null 2>&1; then
+            RESOLVED_IMAGE_OCID=$(safe_jq "$details" '.image')
+            RESOLVED_IMAGE_NAME="$listing_name $version"
+            RESOLVED_LISTING="$listing_id|$version"
+            return 0
+        fi
+    done < <(jq -r --arg name "$(os_label "$INSTANCE_OS")" \
+        '.[] | select(.name | ascii_downcase | contains($name | ascii_downcase)) | [.id, .name] | @tsv' <<< "$listings")
+    return 1
+}
+
+# Newest INSTANCE_OS image for a shape (platform image, or Marketplace for distros without one)
+resolve_os_image() {
+    local shape="$1" images os_name
+    RESOLVED_IMAGE_OCID="" RESOLVED_IMAGE_NAME="" RESOLVED_LISTING=""
+    os_name=$(os_platform_name "$INSTANCE_OS")
+    if [ -z "$os_name" ]; then
+        resolve_marketplace_image "$shape"
+        return
+    fi
+    images=$(oci_cmd "compute image list \
+        --compartment-id $tenancy_ocid \
+        --operating-system '$os_name' \
+        --shape '$shape' \
+        --sort-by TIMECREATED \
+        --sort-order DESC \
+        --query 'data[].{id:id,name:\"display-name\",version:\"operating-system-version\"}' \
+        --all")
+    # Ubuntu: only the chosen release, and Minimal images only for the minimal variant
+    if [ "$INSTANCE_OS" = "ubuntu" ]; then
+        images=$(jq -c --arg v "$UBUNTU_VERSION" --argjson minimal "$([ "$UBUNTU_VARIANT" = "minimal" ] && echo true || echo false)" \
+            '[.[]? | select((.version // "" | startswith($v)) and ((.name | test("Minimal")) == $minimal))]' <<< "$images" 2>/dev/null) || images="[]"
+    fi
+    RESOLVED_IMAGE_OCID=$(safe_jq "$images" '.[0].id')
+    RESOLVED_IMAGE_NAME=$(safe_jq "$images" '.[0].name')
+    [ -n "$RESOLVED_IMAGE_OCID" ] && [ "$RESOLVED_IMAGE_OCID" != "null" ] || RESOLVED_IMAGE_OCID=""
+    [ -n "$RESOLVED_IMAGE_OCID" ]
+}
+
+# Image of KIND (amd|arm) pinned in IMAGE_LOCK_FILE for this region and image_selection;
+# sets RESOLVED_* like resolve_os_image
+locked_image() {
+    local kind="$1" shape="$2" entry
+    [ "$IMAGE_UPDATE" != "true" ] && [ -f "$IMAGE_LOCK_FILE" ] || return 1
+    entry=$(jq -c --arg r "$region" --arg k "$kind" --arg sel "$(image_selection)" \
+        '.[$r] | select(.selection == $sel) | .[$k] // empty' "$IMAGE_LOCK_FILE" 2>/dev/null) || entry=""
+    [ -n "$entry" ] || return 1
+    RESOLVED_IMAGE_OCID=$(jq -r '.id' <<< "$entry")
+    RESOLVED_IMAGE_NAME=$(jq -r '.name' <<< "$entry")
+    RESOLVED_LISTING=$(jq -r '.listing // empty' <<< "$entry")
+    # Platform images are deprecated and eventually deleted; Marketplace versions stay listed
+    if [ -z "$RESOLVED_LISTING" ] && ! custom_image_name "$RESOLVED_IMAGE_OCID" "$shape" >/dev/null 2>&1; then
+        print_warning "  Pinned image $RESOLVED_IMAGE_NAME is no longer available - resolving a new one"
+        return 1
+    fi
+}
+
+# Image of INSTANCE_OS for KIND (amd|arm): the pinned one, else the newest. Sets RESOLVED_*
+# and RESOLVED_PINNED, and records the image in IMAGE_LOCK_ENTRY.
+resolve_instance_image() {
+    local kind="$1" shape="$2"
+    RESOLVED_PINNED=false
+    if locked_image "$kind" "$shape"; then
+        RESOLVED_PINNED=true
+    elif ! resolve_os_image "$shape"; then
+        return 1
+    fi
+    IMAGE_LOCK_ENTRY=$(jq -c --arg k "$kind" --arg id "$RESOLVED_IMAGE_OCID" --arg name "$RESOLVED_IMAGE_NAME" --arg listing "$RESOLVED_LISTING" \
+        '.[$k] = ({id: $id, name: $name} + (if $listing == "" then {} else {listing: $listing} end))' <<< "$IMAGE_LOCK_ENTRY")
+}
+
+# Store IMAGE_LOCK_ENTRY as this region's entry of IMAGE_LOCK_FILE (other regions are kept)
+write_image_lock() {
+    local lock="{}" updated
+    [ "$(jq 'del(.selection) | length' <<< "$IMAGE_LOCK_ENTRY")" -gt 0 ] || return 0
+    [ -f "$IMAGE_LOCK_FILE" ] && lock=$(jq -c . "$IMAGE_LOCK_FILE" 2>/dev/null || echo "{}")
+    updated=$(jq -S --arg r "$region" --argjson e "$IMAGE_LOCK_ENTRY" '.[$r] = $e' <<< "$lock")
+    [ "$(jq -c . <<< "$updated")" != "$(jq -S -c . <<< "$lock")" ] || return 0
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would pin the images in $IMAGE_LOCK_FILE"
+        return 0
+    fi
+    echo "$updated" > "$IMAGE_LOCK_FILE"
+    print_status "  Pinned the images in $IMAGE_LOCK_FILE (commit it; --update-images picks newer ones)"
+}
+
+# Render MARKETPLACE_IMAGES for variables.tf: {"amd": {"listing_id": ..., "version": ...}}
+marketplace_images_tf() {
+    local kind
+    for kind in "${!MARKETPLACE_IMAGES[@]}"; do
+        printf '%s\t%s\t%s\n' "$kind" "${MARKETPLACE_IMAGES[$kind]%%|*}" "${MARKETPLACE_IMAGES[$kind]#*|}"
+    done | sort | jq -Rn -c '[inputs | split("\t") | {(.[0]): {listing_id: .[1], version: .[2]}}] | add // {}'
+}
+
+fetch_instance_images() {
+    local name label saved
+    saved=$(grep -oP '^\s*instance_os\s*=\s*"\K[^"]+' variables.tf 2>/dev/null | head -1) || saved=""
+    resolve_instance_os || return 1
+    label=$(os_label "$INSTANCE_OS")
+    if [ "$INSTANCE_OS" = "ubuntu" ]; then
+        resolve_ubuntu_release || return 1
+        label="$label $UBUNTU_VERSION"
+        [ "$UBUNTU_VARIANT" = "minimal" ] && label="$label Minimal"
+    fi
+    if [ -n "$saved" ] && [ "$saved" != "$INSTANCE_OS" ]; then
+        print_warning "Switching from $(os_label "$saved") to $label: existing instances keep their OS until rebuilt, but SSH will log in as '${SSH_USER:-$(os_default_user "$INSTANCE_OS")}'"
+    fi
+    MARKETPLACE_IMAGES=()
+    IMAGE_LOCK_ENTRY=$(jq -n -c --arg sel "$(image_selection)" '{selection: $sel}')
+    if [ -n "$AMD_IMAGE_OCID" ] && [ -n "$ARM_IMAGE_OCID" ]; then
+        print_status "Using custom images for region $region..."
+    else
+        print_status "Fetching $label images for region $region..."
+    fi
+    
+    # Fetch x86 (AMD64) image, unless AMD_IMAGE_OCID overrides it
+    if [ -n "$AMD_IMAGE_OCID" ]; then
+        name=$(custom_image_name "$AMD_IMAGE_OCID" "$FREE_TIER_AMD_SHAPE") || return 1
+        ubuntu_image_ocid="$AMD_IMAGE_OCID"
+        print_success "  x86 image (custom): $name"
+    else
+        print_status "  Looking for x86 $label image..."
+        if resolve_instance_image amd "$FREE_TIER_AMD_SHAPE"; then
+            ubuntu_image_ocid="$RESOLVED_IMAGE_OCID"
+            [ -n "$RESOLVED_LISTING" ] && MARKETPLACE_IMAGES[amd]="$RESOLVED_LISTING"
+            print_success "  x86 image: $RESOLVED_IMAGE_NAME${RESOLVED_LISTING:+ (Marketplace)}$([ "$RESOLVED_PINNED" = "true" ] && echo " (pinned)")"
+            print_debug "  x86 OCID: $ubuntu_image_ocid"
+        else
+            print_warning "  No x86 $label image found - AMD instances disabled"
+            ubuntu_image_ocid=""
+        fi
+    fi
+    
+    # Fetch ARM image, unless ARM_IMAGE_OCID overrides it
+    if [ -n "$ARM_IMAGE_OCID" ]; then
+        name=$(custom_image_name "$ARM_IMAGE_OCID" "$FREE_TIER_ARM_SHAPE") || return 1
+        ubuntu_arm_flex_image_ocid="$ARM_IMAGE_OCID"
+        print_success "  ARM image (custom): $name"
+    else
+        print_status "  Looking for ARM $label image..."
+        if resolve_instance_image arm "$FREE_TIER_ARM_SHAPE"; then
+            ubuntu_arm_flex_image_ocid="$RESOLVED_IMAGE_OCID"
+            # A multi-architecture listing needs only one subscription
+            if [ -n "$RESOLVED_LISTING" ] && [ "$RESOLVED_LISTING" != "${MARKETPLACE_IMAGES[amd]:-}" ]; then
+                MARKETPLACE_IMAGES[arm]="$RESOLVED_LISTING"
+            fi
+            print_success "  ARM image: $RESOLVED_IMAGE_NAME${RESOLVED_LISTING:+ (Marketplace)}$([ "$RESOLVED_PINNED" = "true" ] && echo " (pinned)")"
+            print_debug "  ARM OCID: $ubuntu_arm_flex_image_ocid"
+        else
+            print_warning "  No ARM $label image found - ARM instances disabled"
+            ubuntu_arm_flex_image_ocid=""
+        fi
+    fi
+    if [ ${#MARKETPLACE_IMAGES[@]} -gt 0 ]; then
+        print_status "  Marketplace images are subscribed to in marketplace_images.tf (accepting their terms of use)"
+    fi
+    write_image_lock
+    print_status "  Login user: ${SSH_USER:-$(os_default_user "$INSTANCE_OS")}"
+}
+
+generate_ssh_keys() {
+    print_status "Setting up SSH keys..."
+    
+    local ssh_dir="$PWD/ssh_keys"
+    if [ "$DRY_RUN" = "true" ] && [ ! -f "$ssh_dir/id_rsa" ]; then
+        print_status "[dry-run] Would generate SSH key pair at $ssh_dir/ (using a throwaway key for the preview)"
+        ssh_dir="$DRY_RUN_DIR/ssh_keys"
+    fi
+    mkdir -p "$ssh_dir"
+    
+    if [ ! -f "$ssh_dir/id_rsa" ]; then
+        print_status "Generating new SSH key pair..."
+        ssh-keygen -t rsa -b 4096 -f "$ssh_dir/id_rsa" -N "" -q
+        chmod 600 "$ssh_dir/id_rsa"
+        chmod 644 "$ssh_dir/id_rsa.pub"
+        print_success "SSH key pair generated at $ssh_dir/"
+    else
+        print_status "Using existing SSH key pair at $ssh_dir/"
+    fi
+    if keychain_enabled && [ "$DRY_RUN" != "true" ]; then
+        keychain_save_ssh_key
+    fi
+    
+    # shellcheck disable=SC2034  # exported for Terraform/template consumption
+    ssh_public_key=$(cat "$ssh_dir/id_rsa.pub")
+}
+
+# Login name for a "<github|gitlab>:<handle>" entry (the lower-cased handle)
+ssh_authorized_user_name() {
+    local handle="${1#*:}"
+    echo "${handle,,}" | tr -c 'a-z0-9_\n-' '-'
+}
+
+# Print the public keys published for a "<github|gitlab>:<handle>" entry
+fetch_ssh_user_keys() {
+    local entry="$1" url
+    case "${entry%%:*}" in
+        github) url="https://github.com/${entry#*:}.keys" ;;
+        gitlab) url="${GITLAB_URL%/}/${entry#*:}.keys" ;;
+        *) return 1 ;;
+    esac
+    curl -fsSL --max-time 15 "$url" 2>/dev/null | grep -E '^(ssh-|ecdsa-|sk-)'
+}
+
+# Login accounts as "<name>\t<sudo>\t<shell>\t<key-source...>" lines: SSH_AUTHORIZED_USERS
+# entries (sudo, bash) followed by USERS_FILE lines
+ssh_user_entries() {
+    local entry name sudo shell sources
+    for entry in ${SSH_AUTHORIZED_USERS//,/ }; do
+        printf '%s\ttrue\t/bin/bash\t%s\n' "$(ssh_authorized_user_name "$entry")" "$entry"
+    done
+    [ -f "$USERS_FILE" ] || return 0
+    sed 's/#.*//' "$USERS_FILE" | while read -r name sudo shell sources; do
+        [ -n "$sources" ] || continue
+        [ "$shell" != "-" ] || shell=/bin/bash
+        printf '%s\t%s\t%s\t%s\n' "$name" "$([ "$sudo" = "sudo" ] && echo true || echo false)" "$shell" "$sources"
+    done
+}
+
+# Render SSH_AUTHORIZED_USERS and USERS_FILE as a single-line HCL map:
+# {"alice":{"sudo":true,"shell":"/bin/bash","keys":["ssh-ed25519 ..."]}}
+# Published keys are cached and reused unless SSH_AUTHORIZED_USERS_REFRESH=true or the
+# fetch is new; key files are read on every run.
+ssh_authorized_users_tf() {
+    local entries
+    entries=$(ssh_user_entries)
+    if [ -z "$entries" ]; then
+        echo "{}"
+        return 0
+    fi
+    local cache="{}" entry keys changed=false
+    [ -f "$SSH_AUTHORIZED_USERS_CACHE" ] && cache=$(jq -c . "$SSH_AUTHORIZED_USERS_CACHE" 2>/dev/null || echo "{}")
+
+    for entry in $(cut -f4 <<< "$entries" | tr ' ' '\n' | grep -E '^(github|gitlab):' | sort -u); do
+        if [ "$SSH_AUTHORIZED_USERS_REFRESH" != "true" ] && jq -e --arg e "$entry" 'has($e)' <<< "$cache" >/dev/null; then
+            continue
+        fi
+        if keys=$(fetch_ssh_user_keys "$entry") && [ -n "$keys" ]; then
+            cache=$(jq -c --arg e "$entry" --arg k "$keys" '. + {($e): ($k | split("\n") | map(select(length > 0)))}' <<< "$cache")
+            changed=true
+            print_status "Fetched $(echo "$keys" | wc -l) SSH key(s) for $entry" >&2
+        elif jq -e --arg e "$entry" 'has($e)' <<< "$cache" >/dev/null; then
+            print_warning "Could not fetch keys for $entry - using the cached ones" >&2
+        else
+            print_warning "No SSH keys found for $entry" >&2
+        fi
+    done
+
+    if [ "$changed" = "true" ] && [ "$DRY_RUN" != "true" ]; then
+        jq -S . <<< "$cache" > "$SSH_AUTHORIZED_USERS_CACHE"
+    fi
+
+    local name sudo shell sources source users="{}"
+    while IFS=$'\t' read -r name sudo shell sources; do
+        keys=""
+        for source in $sources; do
+            case "$source" in
+                github:*|gitlab:*)
+                    keys+=$(jq -r --arg e "$source" '.[$e] // [] | .[]' <<< "$cache")$'\n'
+                    ;;
+                *)
+                    [ -f "$source" ] && keys+=$(grep -E '^(ssh-|ecdsa-|sk-)' "$source")$'\n'
+                    ;;
+            esac
+        done
+        if [ -z "${keys//$'\n'/}" ]; then
+            print_warning "No SSH keys for user $name - the account will not be created" >&2
+            continue
+        fi
+        users=$(jq -c --arg n "$name" --argjson sudo "$sudo" --arg shell "$shell" --arg k "$keys" '
+            .[$n] = {sudo: ((.[$n].sudo // false) or $sudo), shell: $shell,
+                     keys: ((.[$n].keys // []) + ($k | split("\n") | map(select(length > 0))) | unique)}' <<< "$users")
+    done <<< "$entries"
+    echo "$users"
+}
+
+# ============================================================================
+# COMPREHENSIVE RESOURCE INVENTORY
+# ============================================================================
+
+# jq definition of managed($key; $value): true when $key is empty (MANAGED_TAG unset) or
+# the resource carries the tag, as .tags (the inventory queries) or as the freeform-tags of
+# OCI CLI output, for any resource kind
+readonly MANAGED_TAG_JQ='def managed($k; $v): $k == "" or ((.tags // ."freeform-tags" // {})[$k] == $v);'
+
+# True when MANAGED_TAG is unset or the resource JSON carries it
+has_managed_tag() {
+    [ -z "$MANAGED_TAG" ] && return 0
+    local key="${MANAGED_TAG%%=*}" value="${MANAGED_TAG#*=}"
+    echo "$1" | jq -e --arg k "$key" --arg v "$value" "$MANAGED_TAG_JQ"' managed($k; $v)' >/dev/null 2>&1
+}
+
+# Run FUNCTION on every line of stdin, INVENTORY_CONCURRENCY calls at a time in
+# subshells, and print their outputs in input order, as a serial loop would
+inventory_parallel() {
+    local fn="$1" limit="${INVENTORY_CONCURRENCY:-1}" dir line i=0 n
+    local -a pids=()
+    # Seeded fault injection draws its faults in call order, so keep that order fixed
+    [ -n "$CHAOS_SEED" ] && chaos_enabled && limit=1
+    dir=$(mktemp -d)
+    while IFS= read -r line; do
+        if [ ${#pids[@]} -ge "$limit" ]; then
+            wait "${pids[0]}" 2>/dev/null || true
+            pids=("${pids[@]:1}")
+        fi
+        "$fn" "$line" > "$dir/$i" 2>/dev/null &
+        pids+=($!)
+        i=$((i + 1))
+    done
+    wait "${pids[@]}" 2>/dev/null || true
+    for ((n = 0; n < i; n++)); do
+        cat "$dir/$n"
+    done
+    rm -rf "$dir"
+}
+
+# Globals each inventory section fills, and the function that scans it
+readonly INVENTORY_SECTIONS="compute network storage backups adb reservations"
+inventory_section_vars() {
+    case "$1" in
+        compute) echo "EXISTING_AMD_INSTANCES EXISTING_ARM_INSTANCES OTHER_INSTANCES INSTANCE_SHAPES UNMANAGED_AMD_INSTANCES UNMANAGED_ARM_OCPUS UNMANAGED_ARM_MEMORY_GB" ;;
+        network) echo "EXISTING_VCNS EXISTING_SUBNETS EXISTING_INTERNET_GATEWAYS EXISTING_ROUTE_TABLES EXISTING_SECURITY_LISTS EXISTING_NSGS EXISTING_RESERVED_IPS UNMANAGED_VCNS" ;;
+        storage) echo "EXISTING_BOOT_VOLUMES EXISTING_BLOCK_VOLUMES UNMANAGED_STORAGE_GB" ;;
+        backups) echo "VOLUME_BACKUPS_SCHEDULED VOLUME_BACKUPS_MANUAL" ;;
+        adb) echo "EXISTING_AUTONOMOUS_DBS UNMANAGED_AUTONOMOUS_DBS" ;;
+        reservations) echo "EXISTING_CAPACITY_RESERVATIONS" ;;
+    esac
+}
+inventory_section_function() {
+    case "$1" in
+        compute) echo inventory_compute_instances ;;
+        network) echo inventory_networking_resources ;;
+        storage) echo inventory_storage_resources ;;
+        backups) echo inventory_volume_backups ;;
+        adb) echo inventory_autonomous_databases ;;
+        reservations) echo inventory_capacity_reservations ;;
+    esac
+}
+
+# Tenancy, region and tag scope a cached inventory is valid for
+inventory_cache_scope() {
+    printf '%s|%s|%s' "$tenancy_ocid" "${OCI_REGION:-$region}" "$MANAGED_TAG"
+}
+
+# Seconds since SECTION was cached for the current scope; fails without a usable entry
+inventory_cache_age() {
+    local cached
+    [ -f "$INVENTORY_CACHE_FILE" ] || return 1
+    cached=$(jq -r --arg s "$1" --arg scope "$(inventory_cache_scope)" '
+        select(.scope == $scope) | .sections[$s].epoch // empty' "$INVENTORY_CACHE_FILE" 2>/dev/null)
+    [ -n "$cached" ] || return 1
+    echo $(( $(date +%s) - cached ))
+}
+
+# JSON of one inventory global: an object for associative arrays, a string otherwise
+inventory_cache_var_json() {
+    local -n inventory_value="$1"
+    local key
+    if [[ "$(declare -p "$1" 2>/dev/null)" == "declare -A"* ]]; then
+        for key in "${!inventory_value[@]}"; do
+            printf '%s\x1f%s\n' "$key" "${inventory_value[$key]}"
+        done | jq -Rn '[inputs | split("\u001f") | {key: .[0], value: (.[1:] | join("\u001f"))}] | from_entries'
+    else
+        jq -n --arg v "$inventory_value" '$v'
+    fi
+}
+
+# Record the globals of SECTION with the current time
+inventory_cache_save() {
+    local section="$1" var values="{}" cache tmp
+    [ "$DRY_RUN" = "true" ] && return 0
+    for var in $(inventory_section_vars "$section"); do
+        values=$(jq -c --arg k "$var" --argjson v "$(inventory_cache_var_json "$var")" '.[$k] = $v' <<< "$values")
+    done
+    cache="{}"
+    if [ -f "$INVENTORY_CACHE_FILE" ]; then
+        cache=$(jq -c --arg scope "$(inventory_cache_scope)" 'if .scope == $scope then . else {} end' \
+            "$INVENTORY_CACHE_FILE" 2>/dev/null) || cache="{}"
+    fi
+    mkdir -p "$(dirname "$INVENTORY_CACHE_FILE")"
+    tmp=$(mktemp "$INVENTORY_CACHE_FILE.XXXXXX") || return 0
+    jq --arg scope "$(inventory_cache_scope)" --arg s "$section" --argjson v "$values" \
+        --arg at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --argjson epoch "$(date +%s)" \
+        '.version = 1 | .scope = $scope | .sections[$s] = {scanned_at: $at, epoch: $epoch, values: $v}' \
+        <<< "$cache" > "$tmp" && mv "$tmp" "$INVENTORY_CACHE_FILE"
+    rm -f "$tmp"
+}
+
+# Restore the globals of SECTION from the cache
+inventory_cache_load() {
+    local section="$1" vars var key value
+    vars=" $(inventory_section_vars "$section") "
+    for var in $vars; do
+        if [[ "$(declare -p "$var" 2>/dev/null)" == "declare -A"* ]]; then
+            eval "$var=()"
+        else
+            printf -v "$var" '%s' 0
+        fi
+    done
+    while IFS=$'\x1f' read -r var key value; do
+        [[ "$vars" == *" $var "* ]] || continue
+        if [ -n "$key" ]; then
+            printf -v "${var}[$key]" '%s' "$value"
+        else
+            printf -v "$var" '%s' "$value"
+        fi
+    done < <(jq -r --arg s "$section" '.sections[$s].values // {} | to_entries[] | .key as $var
+        | if (.value | type) == "object" then (.value | to_entries[] | [$var, .key, .value])
+          else [$var, "", .value] end | join("\u001f")' "$INVENTORY_CACHE_FILE" 2>/dev/null)
+}
+
+# Inventory one SECTION, from the cache when INVENTORY_CACHE and its age allow it
+inventory_section() {
+    local section="$1" age
+    if [ "$INVENTORY_CACHE" = "cached" ] || { [ "$INVENTORY_CACHE" = "auto" ] && [ "$USAGE_FEATURE" != "setup" ]; }; then
+        if age=$(inventory_cache_age "$section") && [ "$age" -le "$INVENTORY_CACHE_TTL" ]; then
+            inventory_cache_load "$section"
+            print_status "Using the $section inventory from $((age / 60))m$((age % 60))s ago ($INVENTORY_CACHE_FILE; --refresh scans again)"
+            return 0
+        fi
+    fi
+    "$(inventory_section_function "$section")" || return 1
+    inventory_cache_save "$section"
+}
+
+inventory_all_resources() {
+    print_header "COMPREHENSIVE RESOURCE INVENTORY"
+    print_status "Scanning all existing OCI resources in tenancy..."
+    print_status "This ensures we never create duplicate resources."
+    if [ -n "$MANAGED_TAG" ]; then
+        print_status "Managing only resources tagged $MANAGED_TAG"
+    fi
+    echo ""
+    
+    local section
+    for section in $INVENTORY_SECTIONS; do
+        inventory_section "$section"
+    done
+    
+    display_resource_inventory
+}
+
+# The lookups behind one instance of the list (JSON): its shape config for ARM instances
+# and, when it is managed, its primary VNIC. One line "public<TAB>private<TAB>ipv6<TAB>
+# ocpus<TAB>memory", "none" and 0 for what does not apply.
+inventory_instance_lookup() {
+    local instance="$1" id shape details vnic_attachments vnic_id vnic_details
+    local public_ip=none private_ip=none ipv6_ip=none ocpus=0 memory=0
+    id=$(safe_jq "$instance" '.id')
+    shape=$(safe_jq "$instance" '.shape')
+
+    if [ -n "$id" ] && [ "$id" != "null" ]; then
+        if [ "$shape" = "$FREE_TIER_ARM_SHAPE" ]; then
+            details=$(oci_cmd "compute instance get --instance-id $id" 2>/dev/null)
+            ocpus=$(safe_jq "$details" '.data."shape-config".ocpus' "0")
+            memory=$(safe_jq "$details" '.data."shape-config"."memory-in-gbs"' "0")
+        fi
+
+        # Get VNIC information for IP addresses
+        if has_managed_tag "$instance"; then
+            vnic_attachments=$(oci_cmd "compute vnic-attachment list \
+                --compartment-id $tenancy_ocid \
+                --instance-id $id \
+                --query 'data[?\"lifecycle-state\"==\`ATTACHED\`]'" 2>/dev/null) || vnic_attachments="[]"
+            vnic_id=$(safe_jq "$vnic_attachments" '.[0]."vnic-id"')
+            if [ -n "$vnic_id" ] && [ "$vnic_id" != "null" ]; then
+                vnic_details=$(oci_cmd "network vnic get --vnic-id $vnic_id" 2>/dev/null)
+                public_ip=$(safe_jq "$vnic_details" '.data."public-ip"' "none")
+                private_ip=$(safe_jq "$vnic_details" '.data."private-ip"' "none")
+                ipv6_ip=$(safe_jq "$vnic_details" '.data."ipv6-addresses"[0]' "none")
+            fi
+        fi
+    fi
+    printf '%s\t%s\t%s\t%s\t%s\n' "${public_ip:-none}" "${private_ip:-none}" "${ipv6_ip:-none}" "${ocpus:-0}" "${memory:-0}"
+}
+
+inventory_compute_instances() {
+    print_status "Inventorying compute instances..."
+    
+    # Get ALL instances (including terminated for awareness)
+    local all_instances
+    all_instances=$(oci_cmd "compute instance list \
+        --compartment-id $tenancy_ocid \
+        --query 'data[?\"lifecycle-state\"!=\`TERMINATED\`].{id:id,name:\"display-name\",state:\"lifecycle-state\",shape:shape,ad:\"availability-domain\",created:\"time-created\",tags:\"freeform-tags\",ocpus:\"shape-config\".ocpus,memory:\"shape-config\".\"memory-in-gbs\"}' \
+        --all" 2>/dev/null) || all_instances="[]"
+    
+    if [ -z "$all_instances" ] || [ "$all_instances" = "null" ]; then
+        all_instances="[]"
+    fi
+    
+    # Clear existing tracking
+    EXISTING_AMD_INSTANCES=()
+    EXISTING_ARM_INSTANCES=()
+    OTHER_INSTANCES=()
+    INSTANCE_SHAPES=()
+    UNMANAGED_AMD_INSTANCES=0
+    UNMANAGED_ARM_OCPUS=0
+    UNMANAGED_ARM_MEMORY_GB=0
+    
+    local instance_count
+    instance_count=$(echo "$all_instances" | jq 'length' 2>/dev/null) || instance_count=0
+    
+    if [ "$instance_count" -eq 0 ]; then
+        print_status "  No existing compute instances found"
+        return 0
+    fi
+    
+    # VNIC and shape lookups run concurrently, one result line per instance in list order
+    local -a instances lookups
+    local index
+    mapfile -t instances < <(echo "$all_instances" | jq -c '.[]' 2>/dev/null)
+    mapfile -t lookups < <(printf '%s\n' "${instances[@]}" | inventory_parallel inventory_instance_lookup)
+
+    for index in "${!instances[@]}"; do
+        local instance id name state shape public_ip private_ip ipv6_ip ocpus memory
+        instance="${instances[$index]}"
+        id=$(safe_jq "$instance" '.id')
+        name=$(safe_jq "$instance" '.name')
+        state=$(safe_jq "$instance" '.state')
+        shape=$(safe_jq "$instance" '.shape')
+        IFS=$'\t' read -r public_ip private_ip ipv6_ip ocpus memory <<< "${lookups[$index]:-}"
+        
+        if [ -z "$id" ] || [ "$id" = "null" ]; then
+            continue
+        fi
+        INSTANCE_SHAPES["$id"]="$shape"
+
+        # Other shapes are paid whoever manages them; only their boot volumes touch Free Tier
+        if [ "$shape" != "$FREE_TIER_AMD_SHAPE" ] && [ "$shape" != "$FREE_TIER_ARM_SHAPE" ]; then
+            ocpus=$(safe_jq "$instance" '.ocpus' "0")
+            memory=$(safe_jq "$instance" '.memory' "0")
+            OTHER_INSTANCES["$id"]="$name|$state|$shape|${ocpus%.*}|${memory%.*}"
+            print_debug "  Found non-free-tier instance: $name ($shape)"
+            continue
+        fi
+
+        if ! has_managed_tag "$instance"; then
+            if [ "$shape" = "$FREE_TIER_AMD_SHAPE" ]; then
+                UNMANAGED_AMD_INSTANCES=$((UNMANAGED_AMD_INSTANCES + 1))
+            elif [ "$shape" = "$FREE_TIER_ARM_SHAPE" ]; then
+                UNMANAGED_ARM_OCPUS=$((UNMANAGED_ARM_OCPUS + ${ocpus%.*}))
+                UNMANAGED_ARM_MEMORY_GB=$((UNMANAGED_ARM_MEMORY_GB + ${memory%.*}))
+            fi
+            print_debug "  Skipping unmanaged instance: $name (no $MANAGED_TAG tag)"
+            continue
+        fi
+        
+        # Categorize by shape
+        if [ "$shape" = "$FREE_TIER_AMD_SHAPE" ]; then
+            EXISTING_AMD_INSTANCES["$id"]="$name|$state|$shape|${public_ip:-none}|${private_ip:-none}|${ipv6_ip:-none}"
+            print_status "  Found AMD instance: $name ($state) - IP: ${public_ip:-none}, IPv6: ${ipv6_ip:-none}"
+        elif [ "$shape" = "$FREE_TIER_ARM_SHAPE" ]; then
+            EXISTING_ARM_INSTANCES["$id"]="$name|$state|$shape|${public_ip:-none}|${private_ip:-none}|$ocpus|$memory|${ipv6_ip:-none}"
+            print_status "  Found ARM instance: $name ($state, ${ocpus}OCPUs, ${memory}GB) - IP: ${public_ip:-none}, IPv6: ${ipv6_ip:-none}"
+        fi
+    done
+    
+    print_status "  AMD instances: ${#EXISTING_AMD_INSTANCES[@]}/${FREE_TIER_MAX_AMD_INSTANCES}"
+    print_status "  ARM instances: ${#EXISTING_ARM_INSTANCES[@]}/${FREE_TIER_MAX_ARM_INSTANCES}"
+    if [ -n "$MANAGED_TAG" ]; then
+        print_status "  Unmanaged: ${UNMANAGED_AMD_INSTANCES} AMD, ${UNMANAGED_ARM_OCPUS} ARM OCPUs / ${UNMANAGED_ARM_MEMORY_GB}GB"
+    fi
+    if [ ${#OTHER_INSTANCES[@]} -gt 0 ]; then
+        print_status "  Other shapes (not Always Free): ${#OTHER_INSTANCES[@]} instance(s)"
+    fi
+}
+
+# One per-VCN query of the networking inventory: "KIND VCN_ID" in, the list as one JSON
+# line out ([] when the call fails)
+inventory_vcn_lookup() {
+    local kind="${1%% *}" vcn_id="${1#* }" query result
+    case "$kind" in
+        subnet)
+            query='data[?"lifecycle-state"==`AVAILABLE`].{id:id,name:"display-name",cidr:"cidr-block",dns:"dns-label",private:"prohibit-public-ip-on-vnic"}' ;;
+        internet-gateway|nsg)
+            query='data[?"lifecycle-state"==`AVAILABLE`].{id:id,name:"display-name"}' ;;
+        *)
+            query='data[].{id:id,name:"display-name"}' ;;
+    esac
+    result=$(oci_cmd "network $kind list \
+        --compartment-id $tenancy_ocid \
+        --vcn-id $vcn_id \
+        --query '$query'" 2>/dev/null) || result="[]"
+    jq -cs '.[0] // []' <<< "$result" 2>/dev/null || echo "[]"
+}
+
+inventory_networking_resources() {
+    print_status "Inventorying networking resources..."
+    
+    # Clear existing tracking
+    EXISTING_VCNS=()
+    EXISTING_SUBNETS=()
+    EXISTING_INTERNET_GATEWAYS=()
+    EXISTING_ROUTE_TABLES=()
+    EXISTING_SECURITY_LISTS=()
+    EXISTING_NSGS=()
+    EXISTING_RESERVED_IPS=()
+    UNMANAGED_VCNS=0
+    
+    # Get VCNs
+    local vcn_list
+    vcn_list=$(oci_cmd "network vcn list \
+        --compartment-id $tenancy_ocid \
+        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",cidr:\"cidr-block\",tags:\"freeform-tags\",rt:\"default-route-table-id\",sl:\"default-security-list-id\"}' \
+        --all" 2>/dev/null) || vcn_list="[]"
+    
+    if [ -z "$vcn_list" ] || [ "$vcn_list" = "null" ]; then
+        vcn_list="[]"
+    fi
+    
+    local -a managed_vcns=() lookups=()
+    while IFS= read -r vcn; do
+        local vcn_id vcn_name vcn_cidr
+        vcn_id=$(safe_jq "$vcn" '.id')
+        vcn_name=$(safe_jq "$vcn" '.name')
+        vcn_cidr=$(safe_jq "$vcn" '.cidr')
+        
+        if [ -z "$vcn_id" ] || [ "$vcn_id" = "null" ]; then
+            continue
+        fi
+
+        if ! has_managed_tag "$vcn"; then
+            UNMANAGED_VCNS=$((UNMANAGED_VCNS + 1))
+            print_debug "  Skipping unmanaged VCN: $vcn_name (no $MANAGED_TAG tag)"
+            continue
+        fi
+        
+        EXISTING_VCNS["$vcn_id"]="$vcn_name|$vcn_cidr"
+        print_status "  Found VCN: $vcn_name ($vcn_cidr)"
+        managed_vcns+=("$vcn")
+    done <<< "$(echo "$vcn_list" | jq -c '.[]' 2>/dev/null)"
+
+    # The subnet, gateway, route table, security list and NSG queries of every VCN run
+    # concurrently; their results come back in this order, VCN by VCN
+    local kinds="subnet internet-gateway route-table security-list nsg" kind vcn index=0
+    if [ ${#managed_vcns[@]} -gt 0 ]; then
+        mapfile -t lookups < <(
+            for vcn in "${managed_vcns[@]}"; do
+                for kind in $kinds; do
+                    printf '%s %s\n' "$kind" "$(safe_jq "$vcn" '.id')"
+                done
+            done | inventory_parallel inventory_vcn_lookup)
+    fi
+
+    for vcn in "${managed_vcns[@]}"; do
+        local vcn_id default_rt default_sl subnet_list ig_list rt_list sl_list nsg_list
+        vcn_id=$(safe_jq "$vcn" '.id')
+        default_rt=$(echo "$vcn" | jq -r '.rt // empty' 2>/dev/null)
+        default_sl=$(echo "$vcn" | jq -r '.sl // empty' 2>/dev/null)
+        subnet_list="${lookups[index]:-[]}"
+        ig_list="${lookups[index + 1]:-[]}"
+        rt_list="${lookups[index + 2]:-[]}"
+        sl_list="${lookups[index + 3]:-[]}"
+        nsg_list="${lookups[index + 4]:-[]}"
+        index=$((index + 5))
+        
+        # Subnets
+        while IFS= read -r subnet; do
+            local subnet_id subnet_name subnet_cidr subnet_dns subnet_access
+            subnet_id=$(safe_jq "$subnet" '.id')
+            subnet_name=$(safe_jq "$subnet" '.name')
+            subnet_cidr=$(safe_jq "$subnet" '.cidr')
+            subnet_dns=$(echo "$subnet" | jq -r '.dns // empty' 2>/dev/null)
+            subnet_access=$(echo "$subnet" | jq -r 'if .private then "private" else "public" end' 2>/dev/null)
+            
+            if [ -n "$subnet_id" ] && [ "$subnet_id" != "null" ]; then
+                # "<name>|<cidr>|<vcn id>|<dns label>|<public|private>"
+                EXISTING_SUBNETS["$subnet_id"]="$subnet_name|$subnet_cidr|$vcn_id|$subnet_dns|$subnet_access"
+                print_debug "    Subnet: $subnet_name ($subnet_cidr)"
+            fi
+        done <<< "$(echo "$subnet_list" | jq -c '.[]' 2>/dev/null)"
+        
+        # Internet gateways
+        while IFS= read -r ig; do
+            local ig_id ig_name
+            ig_id=$(safe_jq "$ig" '.id')
+            ig_name=$(safe_jq "$ig" '.name')
+            
+            if [ -n "$ig_id" ] && [ "$ig_id" != "null" ]; then
+                EXISTING_INTERNET_GATEWAYS["$ig_id"]="$ig_name|$vcn_id"
+            fi
+        done <<< "$(echo "$ig_list" | jq -c '.[]' 2>/dev/null)"
+        
+        # Route tables
+        while IFS= read -r rt; do
+            local rt_id rt_name
+            rt_id=$(safe_jq "$rt" '.id')
+            rt_name=$(safe_jq "$rt" '.name')
+            
+            if [ -n "$rt_id" ] && [ "$rt_id" = "$default_rt" ]; then
+                EXISTING_ROUTE_TABLES["$rt_id"]="$rt_name|$vcn_id|default"
+            elif [ -n "$rt_id" ] && [ "$rt_id" != "null" ]; then
+                EXISTING_ROUTE_TABLES["$rt_id"]="$rt_name|$vcn_id"
+            fi
+        done <<< "$(echo "$rt_list" | jq -c '.[]' 2>/dev/null)"
+        
+        # Security lists
+        while IFS= read -r sl; do
+            local sl_id sl_name
+            sl_id=$(safe_jq "$sl" '.id')
+            sl_name=$(safe_jq "$sl" '.name')
+            
+            if [ -n "$sl_id" ] && [ "$sl_id" = "$default_sl" ]; then
+                EXISTING_SECURITY_LISTS["$sl_id"]="$sl_name|$vcn_id|default"
+            elif [ -n "$sl_id" ] && [ "$sl_id" != "null" ]; then
+                EXISTING_SECURITY_LISTS["$sl_id"]="$sl_name|$vcn_id"
+            fi
+        done <<< "$(echo "$sl_list" | jq -c '.[]' 2>/dev/null)"
+
+        # Network security groups (not part of the template; listed by the import report)
+        while IFS=$'\t' read -r nsg_id nsg_name; do
+            [ -n "$nsg_id" ] && EXISTING_NSGS["$nsg_id"]="$nsg_name|$vcn_id"
+        done <<< "$(echo "$nsg_list" | jq -r '.[]? | [.id, .name] | @tsv' 2>/dev/null)"
+    done
+
+    # Reserved public IPs ("<name>|<address>|<assigned private IP id or empty>")
+    local reserved_list
+    reserved_list=$(oci_cmd "network public-ip list \
+        --compartment-id $tenancy_ocid \
+        --scope REGION --lifetime RESERVED \
+        --query 'data[].{id:id,name:\"display-name\",ip:\"ip-address\",assigned:\"assigned-entity-id\",tags:\"freeform-tags\"}' \
+        --all" 2>/dev/null) || reserved_list="[]"
+    # Reserved IPs outside MANAGED_TAG are neither imported nor cleaned up
+    while IFS=$'\t' read -r ip_id ip_name ip_address ip_assigned; do
+        [ -n "$ip_id" ] && EXISTING_RESERVED_IPS["$ip_id"]="$ip_name|$ip_address|$ip_assigned"
+    done <<< "$(echo "$reserved_list" | jq -r --arg k "${MANAGED_TAG%%=*}" --arg v "${MANAGED_TAG#*=}" "$MANAGED_TAG_JQ"'
+        .[]? | select(managed($k; $v)) | [.id, .name, .ip, (.assigned // "")] | @tsv' 2>/dev/null)"
+    
+    print_status "  VCNs: ${#EXISTING_VCNS[@]}/${FREE_TIER_MAX_VCNS}"
+    print_status "  Subnets: ${#EXISTING_SUBNETS[@]}"
+    print_status "  Internet Gateways: ${#EXISTING_INTERNET_GATEWAYS[@]}"
+    print_status "  Network security groups: ${#EXISTING_NSGS[@]}"
+    print_status "  Reserved public IPs: ${#EXISTING_RESERVED_IPS[@]}"
+}
+
+inventory_storage_resources() {
+    print_status "Inventorying storage resources..."
+    
+    EXISTING_BOOT_VOLUMES=()
+    EXISTING_BLOCK_VOLUMES=()
+    UNMANAGED_STORAGE_GB=0
+    
+    # Get boot volumes
+    local boot_list
+    boot_list=$(oci_cmd "bv boot-volume list \
+        --compartment-id $tenancy_ocid \
+        --availability-domain $availability_domain \
+        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",size:\"size-in-gbs\"}' \
+        --all" 2>/dev/null) || boot_list="[]"
+    
+    # The instance each boot volume is attached to decides whose allowance it uses
+    local attachments
+    attachments=$(oci_cmd "compute boot-volume-attachment list \
+        --compartment-id $tenancy_ocid \
+        --availability-domain $availability_domain \
+        --query 'data[?\"lifecycle-state\"==\`ATTACHED\`].{boot:\"boot-volume-id\",instance:\"instance-id\"}' \
+        --all" 2>/dev/null) || attachments="[]"
+    
+    local total_boot_gb=0
+    
+    while IFS= read -r boot; do
+        local boot_id boot_name boot_size boot_instance
+        boot_id=$(safe_jq "$boot" '.id')
+        boot_name=$(safe_jq "$boot" '.name')
+        boot_size=$(safe_jq "$boot" '.size' "0")
+        boot_instance=$(jq -r --arg b "$boot_id" '[.[]? | select(.boot == $b)][0].instance // "none"' <<< "${attachments:-[]}" 2>/dev/null) || boot_instance=none
+        
+        if [ -n "$boot_id" ] && [ "$boot_id" != "null" ]; then
+            EXISTING_BOOT_VOLUMES["$boot_id"]="$boot_name|$boot_size|${boot_instance:-none}"
+            total_boot_gb=$((total_boot_gb + boot_size))
+        fi
+    done <<< "$(echo "$boot_list" | jq -c '.[]' 2>/dev/null)"
+    
+    # Get block volumes
+    local block_list
+    block_list=$(oci_cmd "bv volume list \
+        --compartment-id $tenancy_ocid \
+        --availability-domain $availability_domain \
+        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",size:\"size-in-gbs\",tags:\"freeform-tags\"}' \
+        --all" 2>/dev/null) || block_list="[]"
+    
+    local total_block_gb=0
+    
+    while IFS= read -r block; do
+        local block_id block_name block_size
+        block_id=$(safe_jq "$block" '.id')
+        block_name=$(safe_jq "$block" '.name')
+        block_size=$(safe_jq "$block" '.size' "0")
+        
+        if [ -n "$block_id" ] && [ "$block_id" != "null" ] && ! has_managed_tag "$block"; then
+            UNMANAGED_STORAGE_GB=$((UNMANAGED_STORAGE_GB + block_size))
+        elif [ -n "$block_id" ] && [ "$block_id" != "null" ]; then
+            EXISTING_BLOCK_VOLUMES["$block_id"]="$block_name|$block_size"
+            total_block_gb=$((total_block_gb + block_size))
+        fi
+    done <<< "$(echo "$block_list" | jq -c '.[]' 2>/dev/null)"
+    
+    local total_storage=$((total_boot_gb + total_block_gb + UNMANAGED_STORAGE_GB))
+    
+    print_status "  Boot volumes: ${#EXISTING_BOOT_VOLUMES[@]} (${total_boot_gb}GB)"
+    local id detached_name detached_size detached_instance
+    for id in "${!EXISTING_BOOT_VOLUMES[@]}"; do
+        IFS='|' read -r detached_name detached_size detached_instance <<< "${EXISTING_BOOT_VOLUMES[$id]}"
+        [ "$detached_instance" = "none" ] || continue
+        print_status "    Detached: $detached_name (${detached_size}GB) - no live instance uses it"
+    done
+    print_status "  Block volumes: ${#EXISTING_BLOCK_VOLUMES[@]} (${total_block_gb}GB)"
+    print_status "  Total storage: ${total_storage}GB/${FREE_TIER_MAX_STORAGE_GB}GB"
+}
+
+inventory_volume_backups() {
+    print_status "Inventorying volume backups..."
+
+    VOLUME_BACKUPS_SCHEDULED=0
+    VOLUME_BACKUPS_MANUAL=0
+
+    local backups kind
+    for kind in "bv boot-volume-backup" "bv backup"; do
+        backups=$(oci_cmd "$kind list \
+            --compartment-id $tenancy_ocid \
+            --query 'data[?\"lifecycle-state\"!=\`TERMINATED\` && \"lifecycle-state\"!=\`TERMINATING\`].\"source-type\"' \
+            --all" 2>/dev/null) || backups="[]"
+        VOLUME_BACKUPS_SCHEDULED=$((VOLUME_BACKUPS_SCHEDULED + $(echo "$backups" | jq '[.[]? | select(. == "SCHEDULED")] | length' 2>/dev/null || echo 0)))
+        VOLUME_BACKUPS_MANUAL=$((VOLUME_BACKUPS_MANUAL + $(echo "$backups" | jq '[.[]? | select(. != "SCHEDULED")] | length' 2>/dev/null || echo 0)))
+    done
+
+    print_status "  Volume backups: $((VOLUME_BACKUPS_SCHEDULED + VOLUME_BACKUPS_MANUAL))/${FREE_TIER_MAX_VOLUME_BACKUPS} ($VOLUME_BACKUPS_SCHEDULED scheduled, $VOLUME_BACKUPS_MANUAL manual)"
+}
+
+inventory_autonomous_databases() {
+    print_status "Inventorying Always Free Autonomous Databases..."
+
+    EXISTING_AUTONOMOUS_DBS=()
+    UNMANAGED_AUTONOMOUS_DBS=0
+
+    local adb_list
+    adb_list=$(oci_cmd "db autonomous-database list \
+        --compartment-id $tenancy_ocid \
+        --query 'data[?\"is-free-tier\"==\`true\` && \"lifecycle-state\"!=\`TERMINATED\`].{id:id,name:\"db-name\",workload:\"db-workload\",state:\"lifecycle-state\",tags:\"freeform-tags\"}' \
+        --all" 2>/dev/null) || adb_list="[]"
+
+    while IFS= read -r adb; do
+        local adb_id adb_name adb_workload adb_state
+        adb_id=$(safe_jq "$adb" '.id')
+        adb_name=$(safe_jq "$adb" '.name')
+        adb_workload=$(safe_jq "$adb" '.workload')
+        adb_state=$(safe_jq "$adb" '.state')
+
+        if [ -n "$adb_id" ] && [ "$adb_id" != "null" ] && ! has_managed_tag "$adb"; then
+            UNMANAGED_AUTONOMOUS_DBS=$((UNMANAGED_AUTONOMOUS_DBS + 1))
+        elif [ -n "$adb_id" ] && [ "$adb_id" != "null" ]; then
+            EXISTING_AUTONOMOUS_DBS["$adb_id"]="$adb_name|$adb_workload|$adb_state"
+            print_status "  Found: $adb_name ($adb_workload, $adb_state)"
+        fi
+    done <<< "$(echo "$adb_list" | jq -c '.[]' 2>/dev/null)"
+
+    print_status "  Autonomous Databases: $((${#EXISTING_AUTONOMOUS_DBS[@]} + UNMANAGED_AUTONOMOUS_DBS))/${FREE_TIER_MAX_AUTONOMOUS_DBS}"
+}
+
+# A1.Flex capacity held by compute capacity reservations: id => "name|state|reserved instances|
+# used instances|reserved OCPUs|used OCPUs|reserved memory GB|used memory GB"
+inventory_capacity_reservations() {
+    print_status "Inventorying compute capacity reservations..."
+
+    EXISTING_CAPACITY_RESERVATIONS=()
+
+    local reservations
+    reservations=$(oci_cmd "compute capacity-reservation list \
+        --compartment-id $tenancy_ocid \
+        --query 'data[?\"lifecycle-state\"!=\`DELETED\` && \"lifecycle-state\"!=\`DELETING\`].{id:id,name:\"display-name\",state:\"lifecycle-state\"}' \
+        --all" 2>/dev/null) || reservations="[]"
+
+    while IFS= read -r reservation; do
+        local id name state details usage reserved used reserved_ocpus used_ocpus reserved_memory used_memory
+        id=$(safe_jq "$reservation" '.id')
+        [ -n "$id" ] && [ "$id" != "null" ] || continue
+        name=$(safe_jq "$reservation" '.name')
+        state=$(safe_jq "$reservation" '.state')
+        details=$(oci_cmd "compute capacity-reservation get --capacity-reservation-id $id" 2>/dev/null) || details="{}"
+        usage=$(echo "$details" | jq -r --arg shape "$FREE_TIER_ARM_SHAPE" '
+            [.data."instance-reservation-configs"[]? | select(."instance-shape" == $shape)]
+            | [(map(."reserved-count") | add // 0), (map(."used-count") | add // 0),
+               (map(."reserved-count" * (."instance-shape-config".ocpus // 0)) | add // 0 | floor),
+               (map(."used-count" * (."instance-shape-config".ocpus // 0)) | add // 0 | floor),
+               (map(."reserved-count" * (."instance-shape-config"."memory-in-gbs" // 0)) | add // 0 | floor),
+               (map(."used-count" * (."instance-shape-config"."memory-in-gbs" // 0)) | add // 0 | floor)]
+            | join("|")' 2>/dev/null) || usage="0|0|0|0|0|0"
+        [ "${usage%%|*}" != "0" ] || continue
+
+        EXISTING_CAPACITY_RESERVATIONS["$id"]="$name|$state|$usage"
+        IFS='|' read -r reserved used reserved_ocpus used_ocpus reserved_memory used_memory <<< "$usage"
+        print_status "  Found reservation: $name ($state) - $reserved A1 instance(s) reserved (${reserved_ocpus} OCPUs/${reserved_memory}GB), $used used (${used_ocpus} OCPUs/${used_memory}GB)"
+    done <<< "$(echo "$reservations" | jq -c '.[]?' 2>/dev/null)"
+
+    print_status "  Capacity reservations holding A1 capacity: ${#EXISTING_CAPACITY_RESERVATIONS[@]}"
+}
+
+display_resource_inventory() {
+    echo ""
+    print_header "RESOURCE INVENTORY SUMMARY"
+    
+    # Calculate totals
+    local total_amd=$((${#EXISTING_AMD_INSTANCES[@]} + UNMANAGED_AMD_INSTANCES))
+    local total_arm=${#EXISTING_ARM_INSTANCES[@]}
+    local total_arm_ocpus=$UNMANAGED_ARM_OCPUS
+    local total_arm_memory=$UNMANAGED_ARM_MEMORY_GB
+    
+    for instance_data in "${EXISTING_ARM_INSTANCES[@]}"; do
+        local ocpus memory
+        ocpus=$(echo "$instance_data" | cut -d'|' -f6)
+        memory=$(echo "$instance_data" | cut -d'|' -f7)
+        total_arm_ocpus=$((total_arm_ocpus + ocpus))
+        total_arm_memory=$((total_arm_memory + memory))
+    done
+    
+    local total_boot_gb=0
+    for boot_data in "${EXISTING_BOOT_VOLUMES[@]}"; do
+        local size
+        size=$(echo "$boot_data" | cut -d'|' -f2)
+        total_boot_gb=$((total_boot_gb + size))
+    done
+    
+    local total_block_gb=$UNMANAGED_STORAGE_GB
+    for block_data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
+        local size
+        size=$(echo "$block_data" | cut -d'|' -f2)
+        total_block_gb=$((total_block_gb + size))
+    done
+    
+    local total_storage=$((total_boot_gb + total_block_gb))
+    local other_boot_gb detached_boot_gb
+    other_boot_gb=$(boot_volume_gb other)
+    detached_boot_gb=$(boot_volume_gb detached)
+    
+    echo -e "${BOLD}Compute Resources:${NC}"
+    echo "  ┌─────────────────────────────────────────────────────────────┐"
+    echo "  │ AMD Micro Instances:  $total_amd / $FREE_TIER_MAX_AMD_INSTANCES (Free Tier limit)          │"
+    echo "  │ ARM A1 Instances:     $total_arm / $FREE_TIER_MAX_ARM_INSTANCES (up to)                    │"
+    echo "  │ ARM OCPUs Used:       $total_arm_ocpus / $FREE_TIER_MAX_ARM_OCPUS                           │"
+    echo "  │ ARM Memory Used:      ${total_arm_memory}GB / ${FREE_TIER_MAX_ARM_MEMORY_GB}GB                         │"
+    if [ "$COUNT_ALL_INSTANCES" = "true" ] && [ ${#OTHER_INSTANCES[@]} -gt 0 ]; then
+        local other_ocpus=0 other_memory=0
+        for instance_data in "${OTHER_INSTANCES[@]}"; do
+            other_ocpus=$((other_ocpus + $(echo "$instance_data" | cut -d'|' -f4)))
+            other_memory=$((other_memory + $(echo "$instance_data" | cut -d'|' -f5)))
+        done
+        echo "  ├─────────────────────────────────────────────────────────────┤"
+        printf "  │ Other (not Free):     %2d instance(s), %3d OCPUs, %4dGB       │\n" "${#OTHER_INSTANCES[@]}" "$other_ocpus" "$other_memory"
+    fi
+    echo "  └─────────────────────────────────────────────────────────────┘"
+    echo ""
+    if [ ${#EXISTING_CAPACITY_RESERVATIONS[@]} -gt 0 ]; then
+        local reservation name _state reserved used reserved_ocpus used_ocpus reserved_memory used_memory
+        echo -e "${BOLD}Capacity Reservations (A1):${NC}"
+        echo "  ┌─────────────────────────────────────────────────────────────┐"
+        for reservation in "${EXISTING_CAPACITY_RESERVATIONS[@]}"; do
+            IFS='|' read -r name _state reserved used reserved_ocpus used_ocpus reserved_memory used_memory <<< "$reservation"
+            printf "  │ %-20.20s %d/%d used  %2d/%d OCPUs  %3d/%3dGB        │\n" \
+                "$name" "$used" "$reserved" "$used_ocpus" "$reserved_ocpus" "$used_memory" "$reserved_memory"
+        done
+        echo "  └─────────────────────────────────────────────────────────────┘"
+        echo ""
+    fi
+    echo -e "${BOLD}Storage Resources:${NC}"
+    echo "  ┌─────────────────────────────────────────────────────────────┐"
+    echo "  │ Boot Volumes:         ${total_boot_gb}GB                                    │"
+    if [ $((other_boot_gb + detached_boot_gb)) -gt 0 ]; then
+        printf "  │   free-tier eligible: %3dGB                                   │\n" "$((total_boot_gb - other_boot_gb - detached_boot_gb))"
+        printf "  │   other shapes:       %3dGB                                   │\n" "$other_boot_gb"
+        printf "  │   detached:           %3dGB (no live instance)                │\n" "$detached_boot_gb"
+    fi
+    echo "  │ Block Volumes:        ${total_block_gb}GB                                    │"
+    printf "  │ Total Storage:        %3dGB / %3dGB Free Tier limit          │\n" "$total_storage" "$FREE_TIER_MAX_STORAGE_GB"
+    printf "  │ Volume Backups:       %3d / %d Always Free                    │\n" "$((VOLUME_BACKUPS_SCHEDULED + VOLUME_BACKUPS_MANUAL))" "$FREE_TIER_MAX_VOLUME_BACKUPS"
+    echo "  └─────────────────────────────────────────────────────────────┘"
+    echo ""
+    echo -e "${BOLD}Database Resources:${NC}"
+    echo "  ┌─────────────────────────────────────────────────────────────┐"
+    echo "  │ Autonomous DBs:       $((${#EXISTING_AUTONOMOUS_DBS[@]} + UNMANAGED_AUTONOMOUS_DBS)) / $FREE_TIER_MAX_AUTONOMOUS_DBS (Always Free limit)             │"
+    echo "  └─────────────────────────────────────────────────────────────┘"
+    echo ""
+    echo -e "${BOLD}Networking Resources:${NC}"
+    echo "  ┌─────────────────────────────────────────────────────────────┐"
+    echo "  │ VCNs:                 $((${#EXISTING_VCNS[@]} + UNMANAGED_VCNS)) / $FREE_TIER_MAX_VCNS (Free Tier limit)             │"
+    echo "  │ Subnets:              ${#EXISTING_SUBNETS[@]}                                       │"
+    echo "  │ Internet Gateways:    ${#EXISTING_INTERNET_GATEWAYS[@]}                                       │"
+    echo "  └─────────────────────────────────────────────────────────────┘"
+    echo ""
+    if [ -n "$MANAGED_TAG" ]; then
+        print_status "Totals include resources without the $MANAGED_TAG tag (not managed, but they use Free Tier quota)"
+        echo ""
+    fi
+    if [ ${#OTHER_INSTANCES[@]} -gt 0 ] && [ "$COUNT_ALL_INSTANCES" != "true" ]; then
+        print_status "${#OTHER_INSTANCES[@]} instance(s) of other shapes are not shown (COUNT_ALL_INSTANCES=true lists them); their boot volumes are counted"
+        echo ""
+    fi
+    
+    # Warnings for near-limit resources
+    if [ "$total_amd" -ge "$FREE_TIER_MAX_AMD_INSTANCES" ]; then
+        print_warning "AMD instance limit reached - cannot create more AMD instances"
+    fi
+    if [ "$total_arm_ocpus" -ge "$FREE_TIER_MAX_ARM_OCPUS" ]; then
+        print_warning "ARM OCPU limit reached - cannot allocate more ARM OCPUs"
+    fi
+    if [ "$total_arm_memory" -ge "$FREE_TIER_MAX_ARM_MEMORY_GB" ]; then
+        print_warning "ARM memory limit reached - cannot allocate more ARM memory"
+    fi
+    if [ "$total_storage" -ge "$FREE_TIER_MAX_STORAGE_GB" ]; then
+        print_warning "Storage limit reached - cannot create more volumes"
+    fi
+    if [ "$detached_boot_gb" -gt 0 ]; then
+        print_warning "${detached_boot_gb}GB of boot volumes belong to no live instance - reclaim them with: $0 cleanup"
+    fi
+    if [ $((${#EXISTING_VCNS[@]} + UNMANAGED_VCNS)) -ge "$FREE_TIER_MAX_VCNS" ]; then
+        print_warning "VCN limit reached - cannot create more VCNs"
+    fi
+    if [ $((VOLUME_BACKUPS_SCHEDULED + VOLUME_BACKUPS_MANUAL)) -gt "$FREE_TIER_MAX_VOLUME_BACKUPS" ]; then
+        print_warning "More than $FREE_TIER_MAX_VOLUME_BACKUPS volume backups exist - the extra ones are billed"
+    fi
+    if [ $((${#EXISTING_AUTONOMOUS_DBS[@]} + UNMANAGED_AUTONOMOUS_DBS)) -ge "$FREE_TIER_MAX_AUTONOMOUS_DBS" ]; then
+        print_warning "Autonomous Database limit reached - cannot create more Always Free databases"
+    fi
+    local reservation idle
+    for reservation in "${EXISTING_CAPACITY_RESERVATIONS[@]}"; do
+        idle=$(( $(echo "$reservation" | cut -d'|' -f3) - $(echo "$reservation" | cut -d'|' -f4) ))
+        if [ "$idle" -gt 0 ]; then
+            print_warning "Capacity reservation $(echo "$reservation" | cut -d'|' -f1) holds $idle unused A1 instance slot(s) - unused reserved capacity is billed"
+        fi
+    done
+}
+
+# Usage against the Always Free limits, as TSV: resource, used, limit, unit
+inventory_usage_rows() {
+    local data ocpus=$UNMANAGED_ARM_OCPUS memory=$UNMANAGED_ARM_MEMORY_GB boot=0 block=$UNMANAGED_STORAGE_GB
+    for data in "${EXISTING_ARM_INSTANCES[@]}"; do
+        ocpus=$((ocpus + $(cut -d'|' -f6 <<< "$data")))
+        memory=$((memory + $(cut -d'|' -f7 <<< "$data")))
+    done
+    for data in "${EXISTING_BOOT_VOLUMES[@]}"; do
+        boot=$((boot + $(cut -d'|' -f2 <<< "$data")))
+    done
+    for data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
+        block=$((block + $(cut -d'|' -f2 <<< "$data")))
+    done
+    printf 'AMD Micro instances\t%s\t%s\tinstances\n' "$((${#EXISTING_AMD_INSTANCES[@]} + UNMANAGED_AMD_INSTANCES))" "$FREE_TIER_MAX_AMD_INSTANCES"
+    printf 'ARM A1 instances\t%s\t%s\tinstances\n' "${#EXISTING_ARM_INSTANCES[@]}" "$FREE_TIER_MAX_ARM_INSTANCES"
+    printf 'ARM OCPUs\t%s\t%s\tOCPUs\n' "$ocpus" "$FREE_TIER_MAX_ARM_OCPUS"
+    printf 'ARM memory\t%s\t%s\tGB\n' "$memory" "$FREE_TIER_MAX_ARM_MEMORY_GB"
+    printf 'Block storage (boot %sGB + block %sGB)\t%s\t%s\tGB\n' "$boot" "$block" "$((boot + block))" "$FREE_TIER_MAX_STORAGE_GB"
+    printf 'Boot volumes of free-tier eligible instances\t%s\t-\tGB\n' "$((boot - $(boot_volume_gb other) - $(boot_volume_gb detached)))"
+    printf 'Boot volumes of other shapes\t%s\t-\tGB\n' "$(boot_volume_gb other)"
+    printf 'Detached boot volumes\t%s\t-\tGB\n' "$(boot_volume_gb detached)"
+    if [ "$COUNT_ALL_INSTANCES" = "true" ]; then
+        ocpus=0 memory=0
+        for data in "${OTHER_INSTANCES[@]}"; do
+            ocpus=$((ocpus + $(cut -d'|' -f4 <<< "$data")))
+            memory=$((memory + $(cut -d'|' -f5 <<< "$data")))
+        done
+        printf 'Other instances (not Always Free)\t%s\t-\tinstances\n' "${#OTHER_INSTANCES[@]}"
+        printf 'Other OCPUs (not Always Free)\t%s\t-\tOCPUs\n' "$ocpus"
+        printf 'Other memory (not Always Free)\t%s\t-\tGB\n' "$memory"
+    fi
+    printf 'Volume backups\t%s\t%s\tbackups\n' "$((VOLUME_BACKUPS_SCHEDULED + VOLUME_BACKUPS_MANUAL))" "$FREE_TIER_MAX_VOLUME_BACKUPS"
+    printf 'Autonomous Databases\t%s\t%s\tdatabases\n' "$((${#EXISTING_AUTONOMOUS_DBS[@]} + UNMANAGED_AUTONOMOUS_DBS))" "$FREE_TIER_MAX_AUTONOMOUS_DBS"
+    printf 'VCNs\t%s\t%s\tVCNs\n' "$((${#EXISTING_VCNS[@]} + UNMANAGED_VCNS))" "$FREE_TIER_MAX_VCNS"
+}
+
+# One inventory table as TSV, header first: usage, instances, volumes or network
+inventory_table() {
+    local id data name state shape public private ipv6 ocpus memory size vcn extra
+    case "$1" in
+        usage)
+            printf 'Resource\tUsed\tLimit\tFree\tUsed %%\tUnit\n'
+            inventory_usage_rows | awk -F'\t' -v OFS='\t' '{
+                free = $3 - $2; if (free < 0) free = 0
+                if ($3 == "-") free = "-"
+                print $1, $2, $3, free, ($3 > 0 ? int($2 * 100 / $3) "%" : "-"), $4 }'
+            ;;
+        instances)
+            printf 'Name\tKind\tShape\tState\tOCPUs\tMemory GB\tPublic IP\tPrivate IP\tIPv6\tOCID\n'
+            {
+                for id in "${!EXISTING_AMD_INSTANCES[@]}"; do
+                    IFS='|' read -r name state shape public private ipv6 <<< "${EXISTING_AMD_INSTANCES[$id]}"
+                    # VM.Standard.E2.1.Micro: 1/8 OCPU, 1GB
+                    printf '%s\tamd\t%s\t%s\t1/8\t1\t%s\t%s\t%s\t%s\n' "$name" "$shape" "$state" \
+                        "$public" "$private" "$ipv6" "$id"
+                done
+                for id in "${!EXISTING_ARM_INSTANCES[@]}"; do
+                    IFS='|' read -r name state shape public private ocpus memory ipv6 <<< "${EXISTING_ARM_INSTANCES[$id]}"
+                    printf '%s\tarm\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n' "$name" "$shape" "$state" \
+                        "$ocpus" "$memory" "$public" "$private" "$ipv6" "$id"
+                done
+                if [ "$COUNT_ALL_INSTANCES" = "true" ]; then
+                    for id in "${!OTHER_INSTANCES[@]}"; do
+                        IFS='|' read -r name state shape ocpus memory <<< "${OTHER_INSTANCES[$id]}"
+                        printf '%s\tother\t%s\t%s\t%s\t%s\t-\t-\t-\t%s\n' "$name" "$shape" "$state" \
+                            "$ocpus" "$memory" "$id"
+                    done
+                fi
+            } | sort
+            ;;
+        volumes)
+            printf 'Name\tType\tSize GB\tOCID\n'
+            {
+                for id in "${!EXISTING_BOOT_VOLUMES[@]}"; do
+                    IFS='|' read -r name size extra <<< "${EXISTING_BOOT_VOLUMES[$id]}"
+                    printf '%s\tboot%s\t%s\t%s\n' "$name" "$([ "$extra" = "none" ] && echo " (detached)")" "$size" "$id"
+                done
+                for id in "${!EXISTING_BLOCK_VOLUMES[@]}"; do
+                    IFS='|' read -r name size _ <<< "${EXISTING_BLOCK_VOLUMES[$id]}"
+                    printf '%s\tblock\t%s\t%s\n' "$name" "$size" "$id"
+                done
+            } | sort
+            ;;
+        network)
+            printf 'Kind\tName\tCIDR / address\tVCN\tOCID\n'
+            _vcn_name() { echo "${EXISTING_VCNS[$1]%%|*}"; }
+            {
+                for id in "${!EXISTING_VCNS[@]}"; do
+                    IFS='|' read -r name extra <<< "${EXISTING_VCNS[$id]}"
+                    printf 'vcn\t%s\t%s\t%s\t%s\n' "$name" "$extra" "$name" "$id"
+                done
+                for id in "${!EXISTING_SUBNETS[@]}"; do
+                    IFS='|' read -r name extra vcn _ data <<< "${EXISTING_SUBNETS[$id]}"
+                    printf 'subnet (%s)\t%s\t%s\t%s\t%s\n' "$data" "$name" "$extra" "$(_vcn_name "$vcn")" "$id"
+                done
+                for id in "${!EXISTING_INTERNET_GATEWAYS[@]}"; do
+                    IFS='|' read -r name vcn <<< "${EXISTING_INTERNET_GATEWAYS[$id]}"
+                    printf 'internet gateway\t%s\t\t%s\t%s\n' "$name" "$(_vcn_name "$vcn")" "$id"
+                done
+                for id in "${!EXISTING_ROUTE_TABLES[@]}"; do
+                    IFS='|' read -r name vcn _ <<< "${EXISTING_ROUTE_TABLES[$id]}"
+                    printf 'route table\t%s\t\t%s\t%s\n' "$name" "$(_vcn_name "$vcn")" "$id"
+                done
+                for id in "${!EXISTING_SECURITY_LISTS[@]}"; do
+                    IFS='|' read -r name vcn _ <<< "${EXISTING_SECURITY_LISTS[$id]}"
+                    printf 'security list\t%s\t\t%s\t%s\n' "$name" "$(_vcn_name "$vcn")" "$id"
+                done
+                for id in "${!EXISTING_NSGS[@]}"; do
+                    IFS='|' read -r name vcn <<< "${EXISTING_NSGS[$id]}"
+                    printf 'network security group\t%s\t\t%s\t%s\n' "$name" "$(_vcn_name "$vcn")" "$id"
+                done
+                for id in "${!EXISTING_RESERVED_IPS[@]}"; do
+                    IFS='|' read -r name extra _ <<< "${EXISTING_RESERVED_IPS[$id]}"
+                    printf 'reserved public IP\t%s\t%s\t\t%s\n' "$name" "$extra" "$id"
+                done
+            } | sort
+            ;;
+    esac
+}
+
+# TSV on stdin (header first) as CSV (RFC 4180 quoting) or a Markdown table
+render_table() {
+    case "$1" in
+        csv)
+            jq -Rr 'split("\t") | map(if test("[\",\n]") then "\"" + gsub("\""; "\"\"") + "\"" else . end) | join(",")'
+            ;;
+        markdown)
+            jq -Rr --slurp 'split("\n") | map(select(length > 0) | split("\t") | map(gsub("\\|"; "\\|")))
+                | (.[0] | "| " + join(" | ") + " |"), (.[0] | "|" + (map("---") | join("|")) + "|"),
+                  (.[1:][] | "| " + join(" | ") + " |")'
+            ;;
+    esac
+}
+
+# inventory [--output text|csv|markdown] [--table usage|instances|volumes|network]:
+# the tenancy inventory; csv and markdown print the tables (default all) for spreadsheets
+# and wikis, text the summary of the setup run
+inventory_command() {
+    local output=text tables="usage instances volumes network" table first=true
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --output)
+                output="${2:-}"
+                shift 2 || true
+                ;;
+            --table)
+                tables="${2:-}"
+                shift 2 || true
+                ;;
+            *)
+                print_error "Usage: inventory [--output text|csv|markdown] [--table usage|instances|volumes|network]"
+                return 2
+                ;;
+        esac
+    done
+    if [[ ! "$output" =~ ^(text|csv|markdown)$ ]]; then
+        print_error "--output must be text, csv or markdown"
+        return 2
+    fi
+    for table in $tables; do
+        if [[ ! " usage instances volumes network " == *" $table "* ]]; then
+            print_error "--table must be usage, instances, volumes or network"
+            return 2
+        fi
+    done
+
+    local section
+    for section in $INVENTORY_SECTIONS; do
+        NON_INTERACTIVE=true inventory_section "$section" </dev/null >/dev/null 2>&1 \
+            || print_warning "The $section inventory failed - its rows are missing" >&2
+    done
+    if [ "$output" = "text" ]; then
+        display_resource_inventory
+        return 0
+    fi
+
+    for table in $tables; do
+        [ "$first" = "true" ] || echo ""
+        first=false
+        if [ "$output" = "markdown" ]; then
+            case "$table" in
+                usage)     echo "### Usage vs Always Free limits" ;;
+                instances) echo "### Instances" ;;
+                volumes)   echo "### Volumes" ;;
+                network)   echo "### Network" ;;
+            esac
+            echo ""
+        fi
+        inventory_table "$table" | render_table "$output"
+    done
+}
+
+# ============================================================================
+# FREE TIER LIMIT VALIDATION
+# ============================================================================
+
+calculate_available_resources() {
+    # Calculate what's still available within Free Tier limits
+    local used_amd=$((${#EXISTING_AMD_INSTANCES[@]} + UNMANAGED_AMD_INSTANCES))
+    local used_arm_ocpus=$UNMANAGED_ARM_OCPUS
+    local used_arm_memory=$UNMANAGED_ARM_MEMORY_GB
+    local used_storage=$UNMANAGED_STORAGE_GB
+    
+    for instance_data in "${EXISTING_ARM_INSTANCES[@]}"; do
+        local ocpus memory
+        ocpus=$(echo "$instance_data" | cut -d'|' -f6)
+        memory=$(echo "$instance_data" | cut -d'|' -f7)
+        used_arm_ocpus=$((used_arm_ocpus + ocpus))
+        used_arm_memory=$((used_arm_memory + memory))
+    done
+    
+    for boot_data in "${EXISTING_BOOT_VOLUMES[@]}"; do
+        local size
+        size=$(echo "$boot_data" | cut -d'|' -f2)
+        used_storage=$((used_storage + size))
+    done
+    
+    for block_data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
+        local size
+        size=$(echo "$block_data" | cut -d'|' -f2)
+        used_storage=$((used_storage + size))
+    done
+    
+    # Export available resources
+    export AVAILABLE_AMD_INSTANCES=$((FREE_TIER_MAX_AMD_INSTANCES - used_amd))
+    export AVAILABLE_ARM_OCPUS=$((FREE_TIER_MAX_ARM_OCPUS - used_arm_ocpus))
+    export AVAILABLE_ARM_MEMORY=$((FREE_TIER_MAX_ARM_MEMORY_GB - used_arm_memory))
+    export AVAILABLE_STORAGE=$((FREE_TIER_MAX_STORAGE_GB - used_storage))
+    export USED_ARM_INSTANCES=${#EXISTING_ARM_INSTANCES[@]}
+    
+    print_debug "Available: AMD=$AVAILABLE_AMD_INSTANCES, ARM_OCPU=$AVAILABLE_ARM_OCPUS, ARM_MEM=$AVAILABLE_ARM_MEMORY, Storage=$AVAILABLE_STORAGE"
+}
+
+free_tier_violation() {
+    printf '%s\t%s\t%s\n' "$1" "$2" "$3"
+}
+
+# Free Tier violations of the loaded configuration (counts, per-instance lists and volume
+# sizes), given what is used outside it (UNMANAGED_* and orphaned volumes from inventory).
+# One "<variables.tf key>\t<code>\t<message>" line each.
+free_tier_violations() {
+    local -a ocpus memory boot
+    local total n size block spec error
+    read -r -a ocpus <<< "$arm_flex_ocpus_per_instance"
+    read -r -a memory <<< "$arm_flex_memory_per_instance"
+    read -r -a boot <<< "$arm_flex_boot_volume_size_gb"
+
+    if [ "$arm_flex_instance_count" -gt "$FREE_TIER_MAX_ARM_INSTANCES" ]; then
+        free_tier_violation arm_flex_instance_count quota-arm \
+            "$arm_flex_instance_count ARM instances, but at most $FREE_TIER_MAX_ARM_INSTANCES fit in the free OCPUs (1 each)"
+    fi
+    n=$((FREE_TIER_MAX_AMD_INSTANCES - UNMANAGED_AMD_INSTANCES))
+    if [ "$amd_micro_instance_count" -gt "$n" ]; then
+        free_tier_violation amd_micro_instance_count quota-amd \
+            "$amd_micro_instance_count AMD instances, but only $n of $FREE_TIER_MAX_AMD_INSTANCES are available"
+    fi
+    if [ ${#amd_micro_hostnames[@]} -lt "$amd_micro_instance_count" ]; then
+        free_tier_violation amd_micro_hostnames hostnames \
+            "${#amd_micro_hostnames[@]} hostname(s) for $amd_micro_instance_count AMD instances"
+    fi
+    for n in "${#ocpus[@]}:arm_flex_ocpus_per_instance" "${#memory[@]}:arm_flex_memory_per_instance" \
+        "${#boot[@]}:arm_flex_boot_volume_size_gb" "${#arm_flex_hostnames[@]}:arm_flex_hostnames"; do
+        if [ "${n%%:*}" -lt "$arm_flex_instance_count" ]; then
+            free_tier_violation "${n#*:}" arm-lists \
+                "${n%%:*} value(s) for $arm_flex_instance_count ARM instances"
+        fi
+    done
+
+    total=0
+    for size in "${ocpus[@]:0:$arm_flex_instance_count}"; do total=$((total + size)); done
+    n=$((FREE_TIER_MAX_ARM_OCPUS - UNMANAGED_ARM_OCPUS))
+    if [ "$total" -gt "$n" ]; then
+        free_tier_violation arm_flex_ocpus_per_instance quota-arm-ocpus \
+            "${total} ARM OCPUs, but only $n of $FREE_TIER_MAX_ARM_OCPUS are available"
+    fi
+    total=0
+    for size in "${memory[@]:0:$arm_flex_instance_count}"; do total=$((total + size)); done
+    n=$((FREE_TIER_MAX_ARM_MEMORY_GB - UNMANAGED_ARM_MEMORY_GB))
+    if [ "$total" -gt "$n" ]; then
+        free_tier_violation arm_flex_memory_per_instance quota-arm-memory \
+            "${total}GB ARM memory, but only ${n}GB of ${FREE_TIER_MAX_ARM_MEMORY_GB}GB is available"
+    fi
+
+    if [ "$amd_micro_instance_count" -gt 0 ] && [ "$amd_micro_boot_volume_size_gb" -lt 50 ]; then
+        free_tier_violation amd_micro_boot_volume_size_gb boot-size \
+            "Boot volumes must be at least 50GB (got ${amd_micro_boot_volume_size_gb}GB)"
+    fi
+    for size in "${boot[@]:0:$arm_flex_instance_count}"; do
+        if [ "$size" -lt 50 ]; then
+            free_tier_violation arm_flex_boot_volume_size_gb boot-size \
+                "Boot volumes must be at least 50GB (got ${size}GB)"
+            break
+        fi
+    done
+    for spec in "${amd_block_volumes[@]}" "${arm_flex_block_volumes[@]}"; do
+        if error=$(block_volume_spec_error "$spec"); then
+            free_tier_violation block_volumes block-size "$error"
+        fi
+    done
+
+    total=$((amd_micro_instance_count * amd_micro_boot_volume_size_gb))
+    for size in "${boot[@]:0:$arm_flex_instance_count}"; do total=$((total + size)); done
+    block=$(block_volume_total_gb "${amd_block_volumes[@]:0:$amd_micro_instance_count}" "${arm_flex_block_volumes[@]:0:$arm_flex_instance_count}")
+    n=$(storage_budget_gb)
+    if [ $((total + block)) -gt "$n" ]; then
+        free_tier_violation "$([ "$block" -gt 0 ] && echo block_volumes || echo arm_flex_boot_volume_size_gb)" quota-storage \
+            "${total}GB boot + ${block}GB block volumes, but only ${n}GB of ${FREE_TIER_MAX_STORAGE_GB}GB storage is available"
+    fi
+}
+
+# Always Free constraints that depend on the tenancy rather than the configuration: compute
+# only in the home region, the free shapes offered in the availability domain the instances
+# launch in, and the VCN limit. Same line format; checks whose lookup fails are skipped.
+free_tier_tenancy_violations() {
+    local shapes shape key count ad others
+    [ $((amd_micro_instance_count + arm_flex_instance_count)) -gt 0 ] || return 0
+
+    # Paid instances may run anywhere (SERVICE_LIMITS=tenancy accepts billed usage)
+    fetch_region_subscriptions || true
+    if [ -n "$home_region" ] && [ "$home_region" != "$region" ] && [ "$SERVICE_LIMITS" != "tenancy" ] \
+        && [ "$ALLOW_NON_HOME_REGION" != "true" ]; then
+        free_tier_violation region home-region \
+            "Always Free instances can only be created in the home region ($home_region), not in $region"
+    fi
+
+    # Instances launch in the first availability domain (availability_domains[0])
+    if [ -n "$availability_domain" ]; then
+        shapes=$(oci_cmd "compute shape list --compartment-id $tenancy_ocid \
+            --availability-domain $availability_domain --all --query 'data[].shape'" 2>/dev/null) || shapes=""
+        for key in amd_micro_instance_count arm_flex_instance_count; do
+            count=${!key}
+            shape=$([ "$key" = "amd_micro_instance_count" ] && echo "$FREE_TIER_AMD_SHAPE" || echo "$FREE_TIER_ARM_SHAPE")
+            [ "$count" -gt 0 ] && [ -n "$shapes" ] || continue
+            jq -e --arg s "$shape" 'index($s) != null' <<< "$shapes" >/dev/null 2>&1 && continue
+            others=""
+            while IFS= read -r ad; do
+                [ -n "$ad" ] && [ "$ad" != "$availability_domain" ] || continue
+                oci_cmd "compute shape list --compartment-id $tenancy_ocid --availability-domain $ad --all --query 'data[].shape'" 2>/dev/null \
+                    | jq -e --arg s "$shape" 'index($s) != null' >/dev/null 2>&1 && others+="${others:+, }${ad##*:}"
+            done <<< "$(oci_cmd "iam availability-domain list --compartment-id $tenancy_ocid --query 'data[].name'" 2>/dev/null | jq -r '.[]?' 2>/dev/null)"
+            free_tier_violation "$key" shape-ad \
+                "$shape is not offered in ${availability_domain##*:}, where the instances launch${others:+ (this region offers it in $others)}"
+        done
+    fi
+
+    # The setup adopts a managed VCN when one exists, otherwise it creates one
+    if [ ${#EXISTING_VCNS[@]} -eq 0 ] && [ "$UNMANAGED_VCNS" -ge "$FREE_TIER_MAX_VCNS" ]; then
+        free_tier_violation vcn_cidrs quota-vcn \
+            "A new VCN is needed, but the tenancy already has $UNMANAGED_VCNS of $FREE_TIER_MAX_VCNS Always Free VCNs"
+    fi
+}
+
+# Validate the composed configuration against every Always Free constraint before any file
+# is generated, and print all violations in one report
+check_free_tier_eligibility() {
+    local boot=$((amd_micro_instance_count * amd_micro_boot_volume_size_gb)) size block violations
+    for size in $arm_flex_boot_volume_size_gb; do
+        boot=$((boot + size))
+    done
+    block=$(block_volume_total_gb "${amd_block_volumes[@]:0:$amd_micro_instance_count}" "${arm_flex_block_volumes[@]:0:$arm_flex_instance_count}")
+    print_status "Storage: ${boot}GB boot + ${block}GB block ($(block_volume_count "${amd_block_volumes[@]:0:$amd_micro_instance_count}" "${arm_flex_block_volumes[@]:0:$arm_flex_instance_count}") volume(s)) of $(storage_budget_gb)GB available"
+
+    violations=$({ free_tier_violations; free_tier_tenancy_violations; } | cut -f2-)
+    if [ -z "$violations" ]; then
+        print_success "Configuration is eligible for the Always Free tier"
+        return 0
+    fi
+
+    print_error "The configuration does not fit the Always Free tier ($(echo "$violations" | wc -l | tr -d ' ') problem(s)):"
+    local code message orphaned
+    while IFS=$'\t' read -r code message; do
+        printf "  ${RED}✗${NC} %-16s %s\n" "$code" "$message"
+    done <<< "$violations"
+    if echo "$violations" | grep -q '^quota-storage'; then
+        [ "$UNMANAGED_STORAGE_GB" -gt 0 ] && print_status "  ${UNMANAGED_STORAGE_GB}GB is used by volumes outside MANAGED_TAG"
+        orphaned=$(orphaned_block_volume_gb)
+        [ "$orphaned" -gt 0 ] && print_status "  ${orphaned}GB is used by block volumes no instance claims (remove them with 'cleanup' once detached)"
+        orphaned=$(boot_volume_gb outside)
+        [ "$orphaned" -gt 0 ] && print_status "  ${orphaned}GB is used by boot volumes of instances this configuration does not manage ($(boot_volume_gb other)GB of them other shapes)"
+        orphaned=$(boot_volume_gb detached)
+        [ "$orphaned" -gt 0 ] && print_status "  ${orphaned}GB of that is boot volumes no instance uses any more (remove them with 'cleanup')"
+    fi
+    print_status "No files were generated; change the configuration and run again"
+    return 1
+}
+
+validate_proposed_config() {
+    local proposed_amd=$1
+    # shellcheck disable=SC2034  # keep argument for future checks
+    local proposed_arm=$2
+    local proposed_arm_ocpus=$3
+    local proposed_arm_memory=$4
+    local proposed_storage=$5
+    
+    local errors=0
+    
+    if [ "$proposed_amd" -gt "$AVAILABLE_AMD_INSTANCES" ]; then
+        print_error "Cannot create $proposed_amd AMD instances - only $AVAILABLE_AMD_INSTANCES available"
+        errors=$((errors + 1))
+    fi
+    
+    if [ "$proposed_arm_ocpus" -gt "$AVAILABLE_ARM_OCPUS" ]; then
+        print_error "Cannot allocate $proposed_arm_ocpus ARM OCPUs - only $AVAILABLE_ARM_OCPUS available"
+        errors=$((errors + 1))
+    fi
+    
+    if [ "$proposed_arm_memory" -gt "$AVAILABLE_ARM_MEMORY" ]; then
+        print_error "Cannot allocate ${proposed_arm_memory}GB ARM memory - only ${AVAILABLE_ARM_MEMORY}GB available"
+        errors=$((errors + 1))
+    fi
+    
+    if [ "$proposed_storage" -gt "$AVAILABLE_STORAGE" ]; then
+        print_error "Cannot use ${proposed_storage}GB storage - only ${AVAILABLE_STORAGE}GB available"
+        errors=$((errors + 1))
+    fi
+    
+    return $errors
+}
+
+# ============================================================================
+# PROMETHEUS METRICS EXPORTER
+# ============================================================================
+
+# Print free-tier usage in Prometheus text exposition format (uses current inventory)
+render_free_tier_metrics() {
+    local refresh_ok="${1:-1}"
+
+    # DEBUG output from the calculation must not end up in the exposition
+    calculate_available_resources >/dev/null
+
+    local used_amd=${#EXISTING_AMD_INSTANCES[@]}
+    local used_arm_ocpus=$((FREE_TIER_MAX_ARM_OCPUS - AVAILABLE_ARM_OCPUS))
+    local used_arm_memory=$((FREE_TIER_MAX_ARM_MEMORY_GB - AVAILABLE_ARM_MEMORY))
+    local used_storage=$((FREE_TIER_MAX_STORAGE_GB - AVAILABLE_STORAGE))
+
+    # Count instances per shape/state
+    local -A state_counts=()
+    local instance_data shape state key
+    for instance_data in "${EXISTING_AMD_INSTANCES[@]}" "${EXISTING_ARM_INSTANCES[@]}"; do
+        state=$(echo "$instance_data" | cut -d'|' -f2)
+        shape=$(echo "$instance_data" | cut -d'|' -f3)
+        key="$shape|$state"
+        state_counts["$key"]=$(( ${state_counts["$key"]:-0} + 1 ))
+    done
+
+    cat <<EOF
+# HELP cloudcradle_arm_ocpus_used ARM A1 OCPUs allocated to existing instances.
+# TYPE cloudcradle_arm_ocpus_used gauge
+cloudcradle_arm_ocpus_used{region="$region"} $used_arm_ocpus
+# HELP cloudcradle_arm_ocpus_free ARM A1 OCPUs still available within the Always Free limit.
+# TYPE cloudcradle_arm_ocpus_free gauge
+cloudcradle_arm_ocpus_free{region="$region"} $AVAILABLE_ARM_OCPUS
+# HELP cloudcradle_arm_ocpus_limit Always Free ARM A1 OCPU limit.
+# TYPE cloudcradle_arm_ocpus_limit gauge
+cloudcradle_arm_ocpus_limit{region="$region"} $FREE_TIER_MAX_ARM_OCPUS
+# HELP cloudcradle_arm_memory_used_gb ARM A1 memory (GB) allocated to existing instances.
+# TYPE cloudcradle_arm_memory_used_gb gauge
+cloudcradle_arm_memory_used_gb{region="$region"} $used_arm_memory
+# HELP cloudcradle_arm_memory_free_gb ARM A1 memory (GB) still available within the Always Free limit.
+# TYPE cloudcradle_arm_memory_free_gb gauge
+cloudcradle_arm_memory_free_gb{region="$region"} $AVAILABLE_ARM_MEMORY
+# HELP cloudcradle_arm_memory_limit_gb Always Free ARM A1 memory limit (GB).
+# TYPE cloudcradle_arm_memory_limit_gb gauge
+cloudcradle_arm_memory_limit_gb{region="$region"} $FREE_TIER_MAX_ARM_MEMORY_GB
+# HELP cloudcradle_storage_used_gb Boot and block volume storage (GB) in use.
+# TYPE cloudcradle_storage_used_gb gauge
+cloudcradle_storage_used_gb{region="$region"} $used_storage
+# HELP cloudcradle_storage_free_gb Storage (GB) still available within the Always Free limit.
+# TYPE cloudcradle_storage_free_gb gauge
+cloudcradle_storage_free_gb{region="$region"} $AVAILABLE_STORAGE
+# HELP cloudcradle_storage_limit_gb Always Free storage limit (GB).
+# TYPE cloudcradle_storage_limit_gb gauge
+cloudcradle_storage_limit_gb{region="$region"} $FREE_TIER_MAX_STORAGE_GB
+# HELP cloudcradle_amd_instances AMD micro instances in the tenancy.
+# TYPE cloudcradle_amd_instances gauge
+cloudcradle_amd_instances{region="$region"} $used_amd
+# HELP cloudcradle_amd_instances_limit Always Free AMD micro instance limit.
+# TYPE cloudcradle_amd_instances_limit gauge
+cloudcradle_amd_instances_limit{region="$region"} $FREE_TIER_MAX_AMD_INSTANCES
+# HELP cloudcradle_arm_instances ARM A1 instances in the tenancy.
+# TYPE cloudcradle_arm_instances gauge
+cloudcradle_arm_instances{region="$region"} ${#EXISTING_ARM_INSTANCES[@]}
+# HELP cloudcradle_instances Free-tier instances by shape and lifecycle state.
+# TYPE cloudcradle_instances gauge
+EOF
+    for key in "${!state_counts[@]}"; do
+        echo "cloudcradle_instances{region=\"$region\",shape=\"${key%%|*}\",state=\"${key##*|}\"} ${state_counts[$key]}"
+    done
+    cat <<EOF
+# HELP cloudcradle_inventory_success Whether the last inventory refresh succeeded.
+# TYPE cloudcradle_inventory_success gauge
+cloudcradle_inventory_success{region="$region"} $refresh_ok
+# HELP cloudcradle_inventory_timestamp_seconds Unix time of the last inventory refresh.
+# TYPE cloudcradle_inventory_timestamp_seconds gauge
+cloudcradle_inventory_timestamp_seconds{region="$region"} $(date +%s)
+EOF
+}
+
+# Re-inventory the tenancy and atomically replace METRICS_FILE
+refresh_metrics_file() {
+    local refresh_ok=1
+
+    # Session tokens expire after ~60 minutes; keep long-running exporters alive
+    if [ "$auth_method" = "security_token" ]; then
+        oci_cmd "session refresh" >/dev/null 2>&1 || true
+    fi
+
+    if ! test_oci_connectivity >/dev/null 2>&1; then
+        refresh_ok=0
+        print_warning "OCI connectivity check failed; exporting last known inventory"
+    else
+        {
+            inventory_compute_instances
+            inventory_storage_resources
+        } >/dev/null 2>&1 || refresh_ok=0
+    fi
+
+    render_free_tier_metrics "$refresh_ok" > "$METRICS_FILE.tmp" && mv -f "$METRICS_FILE.tmp" "$METRICS_FILE"
+    print_debug "Metrics written to $METRICS_FILE"
+}
+
+# Serve METRICS_FILE on http://METRICS_BIND:METRICS_PORT/metrics
+start_metrics_http_server() {
+    if ! command_exists python3; then
+        print_error "python3 is required to serve metrics over HTTP (set METRICS_PORT=0 to only write $METRICS_FILE)"
+        return 1
+    fi
+
+    python3 - "$METRICS_FILE" "$METRICS_BIND" "$METRICS_PORT" <<'EOF' &
+import http.server, sys
+
+path, bind, port = sys.argv[1], sys.argv[2], int(sys.argv[3])
+
+class Handler(http.server.BaseHTTPRequestHandler):
+    def do_GET(self):
+        if self.path.split("?")[0] not in ("/metrics", "/"):
+            self.send_error(404)
+            return
+        try:
+            with open(path, "rb") as f:
+                body = f.read()
+        except OSError:
+            self.send_error(503, "metrics not yet available")
+            return
+        self.send_response(200)
+        self.send_header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+http.server.ThreadingHTTPServer((bind, port), Handler).serve_forever()
+EOF
+    METRICS_SERVER_PID=$!
+    print_success "Serving metrics on http://${METRICS_BIND}:${METRICS_PORT}/metrics"
+}
+
+serve_metrics() {
+    print_header "FREE TIER METRICS EXPORTER"
+
+    mkdir -p "$(dirname "$METRICS_FILE")"
+    refresh_metrics_file
+
+    if [ "$METRICS_PORT" != "0" ]; then
+        start_metrics_http_server || return 1
+    else
+        print_status "METRICS_PORT=0: writing metrics to $METRICS_FILE only"
+    fi
+
+    print_status "Refreshing inventory every ${METRICS_REFRESH_INTERVAL}s (Ctrl+C to stop)"
+    while true; do
+        sleep "$METRICS_REFRESH_INTERVAL"
+        refresh_metrics_file
+    done
+}
+
+# ============================================================================
+# CONFIGURATION FUNCTIONS
+# ============================================================================
+
+load_existing_config() {
+    if [ ! -f "variables.tf" ]; then
+        return 1
+    fi
+    
+    print_status "Loading existing configuration from variables.tf..."
+    
+    # Load basic counts
+    amd_micro_instance_count=$(grep -oP 'amd_micro_instance_count\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || amd_micro_instance_count=0
+    amd_micro_boot_volume_size_gb=$(grep -oP 'amd_micro_boot_volume_size_gb\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || amd_micro_boot_volume_size_gb=50
+    arm_flex_instance_count=$(grep -oP 'arm_flex_instance_count\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || arm_flex_instance_count=0
+    
+    # Load ARM arrays
+    local ocpus_str memory_str boot_str
+    ocpus_str=$(grep -oP 'arm_flex_ocpus_per_instance\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || ocpus_str=""
+    memory_str=$(grep -oP 'arm_flex_memory_per_instance\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || memory_str=""
+    boot_str=$(grep -oP 'arm_flex_boot_volume_size_gb\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || boot_str=""
+    
+    arm_flex_ocpus_per_instance=$(echo "$ocpus_str" | tr ',' ' ' | tr -s ' ')
+    arm_flex_memory_per_instance=$(echo "$memory_str" | tr ',' ' ' | tr -s ' ')
+    arm_flex_boot_volume_size_gb=$(echo "$boot_str" | tr ',' ' ' | tr -s ' ')
+    
+    # Load hostnames
+    local amd_hostnames_str arm_hostnames_str
+    amd_hostnames_str=$(grep -oP 'amd_micro_hostnames\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || amd_hostnames_str=""
+    arm_hostnames_str=$(grep -oP 'arm_flex_hostnames\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || arm_hostnames_str=""
+    
+    amd_micro_hostnames=()
+    arm_flex_hostnames=()
+    
+    if [ -n "$amd_hostnames_str" ]; then
+        while IFS= read -r hostname; do
+            hostname=$(echo "$hostname" | tr -d '"' | tr -d ' ')
+            [ -n "$hostname" ] && amd_micro_hostnames+=("$hostname")
+        done <<< "$(echo "$amd_hostnames_str" | tr ',' '\n')"
+    fi
+    
+    if [ -n "$arm_hostnames_str" ]; then
+        while IFS= read -r hostname; do
+            hostname=$(echo "$hostname" | tr -d '"' | tr -d ' ')
+            [ -n "$hostname" ] && arm_flex_hostnames+=("$hostname")
+        done <<< "$(echo "$arm_hostnames_str" | tr ',' '\n')"
+    fi
+
+    load_block_volume_specs
+
+    print_success "Loaded configuration: ${amd_micro_instance_count}x AMD, ${arm_flex_instance_count}x ARM"
+    return 0
+}
+
+# ============================================================================
+# NETWORK CIDRS
+# ============================================================================
+
+ipv4_to_int() {
+    local a b c d
+    IFS=. read -r a b c d <<< "$1"
+    echo $(( (a << 24) + (b << 16) + (c << 8) + d ))
+}
+
+ipv4_cidr_valid() {
+    local cidr="$1" addr octet
+    [[ "$cidr" =~ ^([0-9]{1,3}\.){3}[0-9]{1,3}/([0-9]|[12][0-9]|3[0-2])$ ]] || return 1
+    addr="${cidr%/*}"
+    for octet in ${addr//./ }; do
+        [ "$octet" -le 255 ] || return 1
+    done
+}
+
+# "first last" address of a CIDR as integers
+ipv4_cidr_range() {
+    local ip="${1%/*}" len="${1#*/}" size start
+    size=$(( 1 << (32 - len) ))
+    start=$(( $(ipv4_to_int "$ip") & ~(size - 1) & 0xFFFFFFFF ))
+    echo "$start $(( start + size - 1 ))"
+}
+
+cidrs_overlap() {
+    local a1 a2 b1 b2
+    read -r a1 a2 <<< "$(ipv4_cidr_range "$1")"
+    read -r b1 b2 <<< "$(ipv4_cidr_range "$2")"
+    [ "$a1" -le "$b2" ] && [ "$b1" -le "$a2" ]
+}
+
+# cidr_within INNER OUTER
+cidr_within() {
+    local i1 i2 o1 o2
+    read -r i1 i2 <<< "$(ipv4_cidr_range "$1")"
+    read -r o1 o2 <<< "$(ipv4_cidr_range "$2")"
+    [ "$i1" -ge "$o1" ] && [ "$i2" -le "$o2" ]
+}
+
+# VCN the import step adopts (first managed VCN found by the inventory)
+import_target_vcn_id() {
+    echo "${!EXISTING_VCNS[@]}" | tr ' ' '\n' | head -1
+}
+
+# Existing CIDR of the import target's public ("main") or private subnet
+existing_subnet_cidr() {
+    local vcn_id="$1" want="$2" subnet_id name cidr vcn
+    for subnet_id in "${!EXISTING_SUBNETS[@]}"; do
+        IFS='|' read -r name cidr vcn _ <<< "${EXISTING_SUBNETS[$subnet_id]}"
+        [ "$vcn" = "$vcn_id" ] || continue
+        is_extra_subnet "$subnet_id" && continue
+        if [ "$want" = "private" ] && [ "$name" = "private-subnet" ]; then
+            echo "$cidr"
+            return 0
+        elif [ "$want" = "public" ] && [ "$name" != "private-subnet" ]; then
+            echo "$cidr"
+            return 0
+        fi
+    done
+}
+
+# Load SUBNETS_FILE into SUBNET_SPECS
+load_subnet_specs() {
+    SUBNET_SPECS=()
+    [ -f "$SUBNETS_FILE" ] || return 0
+    local line name cidr kind hosts
+    while IFS= read -r line; do
+        line=$(echo "$line" | sed 's/#.*//')
+        read -r name cidr kind hosts _ <<< "$line"
+        [ -n "$name" ] || continue
+        SUBNET_SPECS+=("$name $cidr $kind ${hosts:-}")
+    done < "$SUBNETS_FILE"
+}
+
+# Existing subnet adopted for a SUBNETS_FILE entry: the one in the VCN with the same display
+# name, else the one with the same CIDR
+existing_extra_subnet_id() {
+    local want_name="$1" want_cidr="$2" vcn_id="$3" subnet_id name cidr vcn by_cidr=""
+    for subnet_id in "${!EXISTING_SUBNETS[@]}"; do
+        IFS='|' read -r name cidr vcn _ <<< "${EXISTING_SUBNETS[$subnet_id]}"
+        [ "$vcn" = "$vcn_id" ] || continue
+        if [ "$name" = "$want_name" ]; then
+            echo "$subnet_id"
+            return 0
+        fi
+        [ "$cidr" = "$want_cidr" ] && by_cidr="$subnet_id"
+    done
+    echo "$by_cidr"
+}
+
+# True when an existing subnet is adopted by a SUBNETS_FILE entry (and so is neither the
+# main nor the private subnet)
+is_extra_subnet() {
+    local subnet_id="$1" vcn spec name cidr
+    vcn=$(echo "${EXISTING_SUBNETS[$subnet_id]:-}" | cut -d'|' -f3)
+    load_subnet_specs
+    for spec in "${SUBNET_SPECS[@]}"; do
+        read -r name cidr _ <<< "$spec"
+        [ "$(existing_extra_subnet_id "$name" "$cidr" "$vcn")" = "$subnet_id" ] && return 0
+    done
+    return 1
+}
+
+# Check SUBNETS_FILE against the VCN, the public/private subnets and the existing subnets
+# it adopts: validate_subnet_specs VCN_CIDRS PUBLIC_CIDR PRIVATE_CIDR
+validate_subnet_specs() {
+    local vcn_cidrs="$1" public_cidr="$2" private_cidr="$3"
+    local errors=0 i j name cidr kind hosts other other_cidr inside vcn_cidr target_id subnet_id access
+    load_subnet_specs
+    target_id=$(import_target_vcn_id)
+    for i in "${!SUBNET_SPECS[@]}"; do
+        read -r name cidr kind hosts <<< "${SUBNET_SPECS[$i]}"
+        ipv4_cidr_valid "$cidr" || continue  # reported by validate
+        inside=false
+        for vcn_cidr in ${vcn_cidrs//,/ }; do
+            cidr_within "$cidr" "$vcn_cidr" && inside=true
+        done
+        if [ "$inside" != "true" ]; then
+            print_error "Subnet $name ($cidr) is not inside the VCN CIDR(s) $vcn_cidrs"
+            errors=$((errors + 1))
+        fi
+        if cidrs_overlap "$cidr" "$public_cidr"; then
+            print_error "Subnet $name ($cidr) overlaps the public subnet $public_cidr"
+            errors=$((errors + 1))
+        fi
+        if [ "$NETWORK_TOPOLOGY" = "two-tier" ] && cidrs_overlap "$cidr" "$private_cidr"; then
+            print_error "Subnet $name ($cidr) overlaps the private subnet $private_cidr"
+            errors=$((errors + 1))
+        fi
+        for ((j=0; j<i; j++)); do
+            read -r other other_cidr _ <<< "${SUBNET_SPECS[$j]}"
+            if ipv4_cidr_valid "$other_cidr" && cidrs_overlap "$cidr" "$other_cidr"; then
+                print_error "Subnets $other ($other_cidr) and $name ($cidr) overlap"
+                errors=$((errors + 1))
+            fi
+        done
+        if [ "$kind" = "private" ] && [[ ",$hosts," == *",$(bastion_hostname),"* ]]; then
+            print_error "The bastion $(bastion_hostname) must stay public, but $SUBNETS_FILE puts it in the private subnet $name"
+            errors=$((errors + 1))
+        fi
+
+        # Public/private can't change in place: OCI would have to replace the adopted subnet
+        [ -n "$target_id" ] || continue
+        subnet_id=$(existing_extra_subnet_id "$name" "$cidr" "$target_id")
+        [ -n "$subnet_id" ] || continue
+        access=$(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f5)
+        if [ -n "$access" ] && [ "$access" != "$kind" ]; then
+            print_error "Existing subnet $(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f1) is $access, but $SUBNETS_FILE declares $name as $kind"
+            errors=$((errors + 1))
+        fi
+    done
+    [ "$errors" -eq 0 ]
+}
+
+# Check the configured CIDRs for syntax, containment and conflicts with the inventory
+validate_network_cidrs() {
+    local vcn_cidrs="${VCN_CIDRS:-10.0.0.0/16}"
+    local public_cidr="${PUBLIC_SUBNET_CIDR:-10.0.1.0/24}"
+    local private_cidr="${PRIVATE_SUBNET_CIDR:-10.0.2.0/24}"
+    local errors=0 cidr subnet label inside
+
+    for cidr in ${vcn_cidrs//,/ }; do
+        if ! ipv4_cidr_valid "$cidr" || [ "${cidr#*/}" -lt 16 ] || [ "${cidr#*/}" -gt 30 ]; then
+            print_error "Invalid VCN CIDR '$cidr' (expected an IPv4 block between /16 and /30)"
+            errors=$((errors + 1))
+        fi
+    done
+    [ "$errors" -eq 0 ] || return 1
+
+    for label in public private; do
+        subnet="$public_cidr"
+        if [ "$label" = "private" ]; then
+            [ "$NETWORK_TOPOLOGY" = "two-tier" ] || continue
+            subnet="$private_cidr"
+        fi
+        if ! ipv4_cidr_valid "$subnet"; then
+            print_error "Invalid $label subnet CIDR '$subnet'"
+            errors=$((errors + 1))
+            continue
+        fi
+        inside=false
+        for cidr in ${vcn_cidrs//,/ }; do
+            cidr_within "$subnet" "$cidr" && inside=true
+        done
+        if [ "$inside" != "true" ]; then
+            print_error "The $label subnet $subnet is not inside the VCN CIDR(s) $vcn_cidrs"
+            errors=$((errors + 1))
+        fi
+    done
+    if [ "$NETWORK_TOPOLOGY" = "two-tier" ] && [ "$errors" -eq 0 ] && cidrs_overlap "$public_cidr" "$private_cidr"; then
+        print_error "The public ($public_cidr) and private ($private_cidr) subnets overlap"
+        errors=$((errors + 1))
+    fi
+
+    # The VCN being imported must keep its CIDR, or Terraform would try to replace it
+    local target_id vcn_id name existing
+    target_id=$(import_target_vcn_id)
+    for vcn_id in "${!EXISTING_VCNS[@]}"; do
+        IFS='|' read -r name existing <<< "${EXISTING_VCNS[$vcn_id]}"
+        [ -n "$existing" ] && [ "$existing" != "null" ] || continue
+        if [ "$vcn_id" = "$target_id" ]; then
+            if [[ ",${vcn_cidrs// /}," != *",$existing,"* ]]; then
+                print_error "Existing VCN $name uses $existing, which is not in VCN_CIDRS ($vcn_cidrs); it could not be imported"
+                errors=$((errors + 1))
+            fi
+            existing=$(existing_subnet_cidr "$vcn_id" public)
+            if [ -n "$existing" ] && [ "$existing" != "$public_cidr" ]; then
+                print_error "Existing subnet in $name uses $existing but PUBLIC_SUBNET_CIDR is $public_cidr"
+                errors=$((errors + 1))
+            fi
+            continue
+        fi
+        for cidr in ${vcn_cidrs//,/ }; do
+            if cidrs_overlap "$cidr" "$existing"; then
+                print_warning "VCN CIDR $cidr overlaps existing VCN $name ($existing); they cannot be peered later"
+            fi
+        done
+    done
+
+    validate_subnet_specs "$vcn_cidrs" "$public_cidr" "$private_cidr" || errors=$((errors + 1))
+
+    [ "$errors" -eq 0 ]
+}
+
+# Resolve VCN/subnet CIDRs (adopting the existing VCN's), optionally prompt, then validate
+configure_network_cidrs() {
+    local target_id
+    target_id=$(import_target_vcn_id)
+    if [ -n "$target_id" ]; then
+        VCN_CIDRS=${VCN_CIDRS:-$(echo "${EXISTING_VCNS[$target_id]}" | cut -d'|' -f2)}
+        PUBLIC_SUBNET_CIDR=${PUBLIC_SUBNET_CIDR:-$(existing_subnet_cidr "$target_id" public)}
+        PRIVATE_SUBNET_CIDR=${PRIVATE_SUBNET_CIDR:-$(existing_subnet_cidr "$target_id" private)}
+    fi
+    VCN_CIDRS=${VCN_CIDRS:-10.0.0.0/16}
+    PUBLIC_SUBNET_CIDR=${PUBLIC_SUBNET_CIDR:-10.0.1.0/24}
+    PRIVATE_SUBNET_CIDR=${PRIVATE_SUBNET_CIDR:-10.0.2.0/24}
+
+    if [ -z "$target_id" ] && [ "$NON_INTERACTIVE" != "true" ] && [ "$AUTO_USE_EXISTING" != "true" ]; then
+        echo ""
+        print_status "Network: VCN $VCN_CIDRS, public subnet $PUBLIC_SUBNET_CIDR$([ "$NETWORK_TOPOLOGY" = "two-tier" ] && echo ", private subnet $PRIVATE_SUBNET_CIDR")$([ -f "$SUBNETS_FILE" ] && echo ", more subnets in $SUBNETS_FILE")"
+        if confirm_action "Customize network CIDRs?" "N"; then
+            while true; do
+                VCN_CIDRS=$(prompt_with_default "VCN CIDR block(s), comma-separated" "$VCN_CIDRS")
+                VCN_CIDRS=${VCN_CIDRS// /}
+                PUBLIC_SUBNET_CIDR=$(prompt_with_default "Public subnet CIDR" "$PUBLIC_SUBNET_CIDR")
+                if [ "$NETWORK_TOPOLOGY" = "two-tier" ]; then
+                    PRIVATE_SUBNET_CIDR=$(prompt_with_default "Private subnet CIDR" "$PRIVATE_SUBNET_CIDR")
+                fi
+                validate_network_cidrs && return 0
+                print_warning "Please re-enter the network CIDRs"
+            done
+        fi
+    fi
+
+    validate_network_cidrs
+}
+
+prompt_configuration() {
+    print_header "INSTANCE CONFIGURATION"
+    
+    calculate_available_resources
+    
+    echo -e "${BOLD}Available Free Tier Resources:${NC}"
+    echo "  • AMD instances:  $AVAILABLE_AMD_INSTANCES available (max $FREE_TIER_MAX_AMD_INSTANCES)"
+    echo "  • ARM OCPUs:      $AVAILABLE_ARM_OCPUS available (max $FREE_TIER_MAX_ARM_OCPUS)"
+    echo "  • ARM Memory:     ${AVAILABLE_ARM_MEMORY}GB available (max ${FREE_TIER_MAX_ARM_MEMORY_GB}GB)"
+    echo "  • Storage:        ${AVAILABLE_STORAGE}GB available (max ${FREE_TIER_MAX_STORAGE_GB}GB)"
+    echo ""
+    
+    # Check if we have existing config
+    local has_existing_config=false
+    if load_existing_config; then
+        has_existing_config=true
+    fi
+    
+    print_status "Configuration options:"
+    echo "  1) Use existing instances (manage what's already deployed)"
+    if [ "$has_existing_config" = "true" ]; then
+        echo "  2) Use saved configuration from variables.tf"
+    else
+        echo "  2) Use saved configuration from variables.tf (not available)"
+    fi
+    echo "  3) Configure new instances (respecting Free Tier limits)"
+    echo "  4) Maximum Free Tier configuration (use all available resources)"
+    echo ""
+    
+    local choice
+    while true; do
+        if [ "$AUTO_USE_EXISTING" = "true" ]; then
+            choice=1
+            print_status "Auto mode: Using existing instances"
+        elif [ "$NON_INTERACTIVE" = "true" ]; then
+            choice=1
+            print_status "Non-interactive mode: Using existing instances"
+        else
+            # Use prompt_with_default so the user sees the default inline (e.g. "[1]") as requested
+            raw_choice=$(prompt_with_default "Choose configuration (1-4)" "1")
+            # Normalize input (remove CR and trim whitespace)
+            raw_choice=$(echo "$raw_choice" | tr -d '\r' | sed 's/^[[:space:]]*//;s/[[:space:]]*$//')
+            # Validate numeric range
+            if [[ "$raw_choice" =~ ^[0-9]+$ ]] && [ "$raw_choice" -ge 1 ] && [ "$raw_choice" -le 4 ]; then
+                choice=$raw_choice
+            else
+                print_error "Please enter a number between 1 and 4 (received: '$raw_choice')"
+                continue
+            fi
+        fi
+        
+        case $choice in
+            1)
+                configure_from_existing_instances
+                break
+                ;;
+            2)
+                if [ "$has_existing_config" = "true" ]; then
+                    print_success "Using saved configuration"
+                    break
+                else
+                    print_error "No saved configuration available"
+                    continue
+                fi
+                ;;
+            3)
+                configure_custom_instances
+                break
+                ;;
+            4)
+                configure_maximum_free_tier
+                break
+                ;;
+            *)
+                print_error "Invalid choice"
+                continue
+                ;;
+        esac
+    done
+
+    configure_firewall
+    configure_network_cidrs || exit 1
+}
+
+# Populate FIREWALL_RULES from FIREWALL_RULES_FILE, or the default rule set
+load_firewall_rules() {
+    FIREWALL_RULES=()
+    if [ -f "$FIREWALL_RULES_FILE" ]; then
+        local line
+        while IFS= read -r line; do
+            line=$(echo "$line" | sed 's/#.*//;s/^[[:space:]]*//;s/[[:space:]]*$//')
+            [ -n "$line" ] && FIREWALL_RULES+=("$line")
+        done < "$FIREWALL_RULES_FILE"
+        return 0
+    fi
+    FIREWALL_RULES=(
+        "ingress tcp 22 0.0.0.0/0,::/0 SSH"
+        "ingress tcp 80,443 0.0.0.0/0,::/0 HTTP/HTTPS"
+        "ingress icmp - 0.0.0.0/0,::/0 ICMP"
+        "egress all - 0.0.0.0/0,::/0 All outbound"
+    )
+}
+
+# Interactive firewall prompts; the answers are saved to FIREWALL_RULES_FILE
+configure_firewall() {
+    load_firewall_rules
+    if [ "$NON_INTERACTIVE" = "true" ] || [ "$AUTO_USE_EXISTING" = "true" ]; then
+        return 0
+    fi
+
+    echo ""
+    print_status "Firewall rules${FIREWALL_RULES_FILE:+ ($FIREWALL_RULES_FILE)}:"
+    printf '  %s\n' "${FIREWALL_RULES[@]}"
+    if ! confirm_action "Customize firewall rules?" "N"; then
+        return 0
+    fi
+
+    local tcp_ports udp_ports allowlist ssh_allowlist port_spec
+    tcp_ports=$(prompt_with_default "TCP ports open to the allowlist (comma-separated, ranges like 8000-8100)" "80,443")
+    udp_ports=$(prompt_with_default "UDP ports (e.g. 51820 for WireGuard, empty for none)" "")
+    allowlist=$(prompt_with_default "Source CIDRs allowed for those ports" "0.0.0.0/0,::/0")
+    ssh_allowlist=$(prompt_with_default "Source CIDRs allowed for SSH (22)" "$allowlist")
+
+    FIREWALL_RULES=("ingress tcp 22 ${ssh_allowlist// /} SSH")
+    for port_spec in ${tcp_ports//,/ }; do
+        [ "$port_spec" = "22" ] && continue
+        FIREWALL_RULES+=("ingress tcp $port_spec ${allowlist// /}")
+    done
+    for port_spec in ${udp_ports//,/ }; do
+        FIREWALL_RULES+=("ingress udp $port_spec ${allowlist// /}")
+    done
+    if confirm_action "Allow ICMP (ping, path MTU discovery)?" "Y"; then
+        FIREWALL_RULES+=("ingress icmp - ${allowlist// /} ICMP")
+    fi
+    FIREWALL_RULES+=("egress all - 0.0.0.0/0,::/0 All outbound")
+
+    {
+        echo "# <ingress|egress> <tcp|udp|icmp|all> <ports|icmp-type|-> <cidr[,cidr...]> [description]"
+        printf '%s\n' "${FIREWALL_RULES[@]}"
+    } | write_generated_file "$FIREWALL_RULES_FILE"
+}
+
+configure_from_existing_instances() {
+    print_status "Configuring based on existing instances..."
+    
+    # Use existing AMD instances
+    amd_micro_instance_count=${#EXISTING_AMD_INSTANCES[@]}
+    amd_micro_hostnames=()
+    amd_block_volumes=()
+
+    for instance_data in "${EXISTING_AMD_INSTANCES[@]}"; do
+        local name
+        name=$(echo "$instance_data" | cut -d'|' -f1)
+        amd_micro_hostnames+=("$name")
+        amd_block_volumes+=("$(existing_block_volume_spec "$name")")
+    done
+    
+    # Use existing ARM instances
+    arm_flex_instance_count=${#EXISTING_ARM_INSTANCES[@]}
+    arm_flex_hostnames=()
+    arm_flex_ocpus_per_instance=""
+    arm_flex_memory_per_instance=""
+    arm_flex_boot_volume_size_gb=""
+    arm_flex_block_volumes=()
+    
+    for instance_data in "${EXISTING_ARM_INSTANCES[@]}"; do
+        local name ocpus memory
+        name=$(echo "$instance_data" | cut -d'|' -f1)
+        ocpus=$(echo "$instance_data" | cut -d'|' -f6)
+        memory=$(echo "$instance_data" | cut -d'|' -f7)
+        
+        arm_flex_hostnames+=("$name")
+        arm_flex_ocpus_per_instance+="$ocpus "
+        arm_flex_memory_per_instance+="$memory "
+        arm_flex_boot_volume_size_gb+="50 "  # Default, will be updated from state
+        arm_flex_block_volumes+=("$(existing_block_volume_spec "$name")")
+    done
+    
+    # Trim trailing spaces
+    arm_flex_ocpus_per_instance=$(echo "$arm_flex_ocpus_per_instance" | xargs)
+    arm_flex_memory_per_instance=$(echo "$arm_flex_memory_per_instance" | xargs)
+    arm_flex_boot_volume_size_gb=$(echo "$arm_flex_boot_volume_size_gb" | xargs)
+    
+    # Set defaults if no instances exist
+    if [ "$amd_micro_instance_count" -eq 0 ] && [ "$arm_flex_instance_count" -eq 0 ]; then
+        print_status "No existing instances found, using default configuration"
+        amd_micro_instance_count=0
+        arm_flex_instance_count=1
+        arm_flex_ocpus_per_instance="4"
+        arm_flex_memory_per_instance="24"
+        arm_flex_boot_volume_size_gb="200"
+        arm_flex_hostnames=("arm-instance-1")
+        arm_flex_block_volumes=(0)
+    fi
+    
+    amd_micro_boot_volume_size_gb=50
+    
+    print_success "Configuration: ${amd_micro_instance_count}x AMD, ${arm_flex_instance_count}x ARM"
+}
+
+configure_custom_instances() {
+    print_status "Custom instance configuration..."
+    
+    local remaining_storage block
+    remaining_storage=$(storage_budget_gb)
+
+    # AMD instances
+    amd_micro_instance_count=$(prompt_int_range "Number of AMD instances (0-$AVAILABLE_AMD_INSTANCES)" "0" "0" "$AVAILABLE_AMD_INSTANCES")
+
+    amd_micro_hostnames=()
+    amd_block_volumes=()
+    if [ "$amd_micro_instance_count" -gt 0 ]; then
+        amd_micro_boot_volume_size_gb=$(prompt_int_range "AMD boot volume size GB (50-100)" "50" "50" "100")
+        remaining_storage=$((remaining_storage - amd_micro_instance_count * amd_micro_boot_volume_size_gb))
+
+        for ((i=1; i<=amd_micro_instance_count; i++)); do
+            echo -n -e "${BLUE}Hostname for AMD instance $i [amd-instance-$i]: ${NC}"
+            read -r hostname
+            hostname=${hostname:-"amd-instance-$i"}
+            amd_micro_hostnames+=("$hostname")
+
+            block=$(prompt_block_volumes "  Block volumes for $hostname" "$remaining_storage")
+            amd_block_volumes+=("$block")
+            remaining_storage=$((remaining_storage - $(block_volume_total_gb "$block")))
+        done
+    else
+        amd_micro_boot_volume_size_gb=50
+    fi
+    
+    # ARM instances
+    if [ -n "$ubuntu_arm_flex_image_ocid" ] && [ "$AVAILABLE_ARM_OCPUS" -gt 0 ]; then
+        arm_flex_instance_count=$(prompt_int_range "Number of ARM instances (0-4)" "1" "0" "4")
+        
+        arm_flex_hostnames=()
+        arm_flex_ocpus_per_instance=""
+        arm_flex_memory_per_instance=""
+        arm_flex_boot_volume_size_gb=""
+        arm_flex_block_volumes=()
+        
+        local remaining_ocpus=$AVAILABLE_ARM_OCPUS
+        local remaining_memory=$AVAILABLE_ARM_MEMORY
+        
+        for ((i=1; i<=arm_flex_instance_count; i++)); do
+            echo ""
+            print_status "ARM instance $i configuration (remaining: ${remaining_ocpus} OCPUs, ${remaining_memory}GB RAM):"
+            
+            echo -n -e "${BLUE}  Hostname [arm-instance-$i]: ${NC}"
+            read -r hostname
+            hostname=${hostname:-"arm-instance-$i"}
+            arm_flex_hostnames+=("$hostname")
+
+            ocpus=$(prompt_int_range "  OCPUs (1-$remaining_ocpus)" "$remaining_ocpus" "1" "$remaining_ocpus")
+            arm_flex_ocpus_per_instance+="$ocpus "
+            remaining_ocpus=$((remaining_ocpus - ocpus))
+            
+            local max_memory=$((ocpus * 6))  # 6GB per OCPU max
+            [ $max_memory -gt $remaining_memory ] && max_memory=$remaining_memory
+
+            memory=$(prompt_int_range "  Memory GB (1-$max_memory)" "$max_memory" "1" "$max_memory")
+            arm_flex_memory_per_instance+="$memory "
+            remaining_memory=$((remaining_memory - memory))
+
+            boot=$(prompt_int_range "  Boot volume GB (50-200)" "50" "50" "200")
+            arm_flex_boot_volume_size_gb+="$boot "
+            remaining_storage=$((remaining_storage - boot))
+
+            block=$(prompt_block_volumes "  Block volumes" "$remaining_storage")
+            arm_flex_block_volumes+=("$block")
+            remaining_storage=$((remaining_storage - $(block_volume_total_gb "$block")))
+        done
+        
+        arm_flex_ocpus_per_instance=$(echo "$arm_flex_ocpus_per_instance" | xargs)
+        arm_flex_memory_per_instance=$(echo "$arm_flex_memory_per_instance" | xargs)
+        arm_flex_boot_volume_size_gb=$(echo "$arm_flex_boot_volume_size_gb" | xargs)
+    else
+        arm_flex_instance_count=0
+        arm_flex_ocpus_per_instance=""
+        arm_flex_memory_per_instance=""
+        arm_flex_boot_volume_size_gb=""
+        arm_flex_block_volumes=()
+        arm_flex_hostnames=()
+    fi
+}
+
+configure_maximum_free_tier() {
+    print_status "Configuring maximum Free Tier utilization..."
+    
+    # Use all available AMD instances
+    amd_micro_instance_count=$AVAILABLE_AMD_INSTANCES
+    amd_micro_boot_volume_size_gb=50
+    amd_micro_hostnames=()
+    amd_block_volumes=()
+    for ((i=1; i<=amd_micro_instance_count; i++)); do
+        amd_micro_hostnames+=("amd-instance-$i")
+        amd_block_volumes+=(0)
+    done
+    
+    # Use all available ARM resources
+    if [ -n "$ubuntu_arm_flex_image_ocid" ] && [ "$AVAILABLE_ARM_OCPUS" -gt 0 ]; then
+        arm_flex_instance_count=1
+        arm_flex_ocpus_per_instance="$AVAILABLE_ARM_OCPUS"
+        arm_flex_memory_per_instance="$AVAILABLE_ARM_MEMORY"
+        
+        # Calculate boot volume size to use remaining storage
+        local used_by_amd=$((amd_micro_instance_count * amd_micro_boot_volume_size_gb))
+        local remaining_storage=$((AVAILABLE_STORAGE - used_by_amd))
+        [ $remaining_storage -lt $FREE_TIER_MIN_BOOT_VOLUME_GB ] && remaining_storage=$FREE_TIER_MIN_BOOT_VOLUME_GB
+        
+        arm_flex_boot_volume_size_gb="$remaining_storage"
+        arm_flex_hostnames=("arm-instance-1")
+        arm_flex_block_volumes=(0)
+    else
+        arm_flex_instance_count=0
+        arm_flex_ocpus_per_instance=""
+        arm_flex_memory_per_instance=""
+        arm_flex_boot_volume_size_gb=""
+        arm_flex_hostnames=()
+        arm_flex_block_volumes=()
+    fi
+    
+    print_success "Maximum config: ${amd_micro_instance_count}x AMD, ${arm_flex_instance_count}x ARM ($AVAILABLE_ARM_OCPUS OCPUs, ${AVAILABLE_ARM_MEMORY}GB)"
+}
+
+# ============================================================================
+# BLOCK VOLUMES
+# ============================================================================
+
+# Check a per-instance block volume spec ("0" or sizes joined by "+"); prints the problem
+block_volume_spec_error() {
+    local spec="$1" size
+    if [[ ! "$spec" =~ ^(0|[1-9][0-9]*(\+[1-9][0-9]*)*)$ ]]; then
+        echo "'$spec' is not 0 or sizes in GB joined by + (e.g. 100 or 50+50)"
+        return 0
+    fi
+    [ "$spec" = "0" ] && return 1
+    for size in ${spec//+/ }; do
+        if [ "$size" -lt "$FREE_TIER_MIN_BLOCK_VOLUME_GB" ]; then
+            echo "block volumes must be at least ${FREE_TIER_MIN_BLOCK_VOLUME_GB}GB (got ${size}GB)"
+            return 0
+        fi
+    done
+    return 1
+}
+
+# Total GB of the given specs
+block_volume_total_gb() {
+    local spec size total=0
+    for spec in "$@"; do
+        [ "${spec:-0}" = "0" ] && continue
+        for size in ${spec//+/ }; do
+            total=$((total + size))
+        done
+    done
+    echo "$total"
+}
+
+# Number of volumes in the given specs
+block_volume_count() {
+    local spec count=0
+    for spec in "$@"; do
+        [ "${spec:-0}" = "0" ] && continue
+        count=$((count + $(tr '+' '\n' <<< "$spec" | wc -l)))
+    done
+    echo "$count"
+}
+
+# "<hostname>-block[-N]" sizes of existing managed volumes as a spec ("0" when none)
+existing_block_volume_spec() {
+    local hostname="$1" spec="" n=1 name data found
+    while true; do
+        name="$hostname-block"
+        [ "$n" -gt 1 ] && name="$hostname-block-$n"
+        found=""
+        for data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
+            [ "${data%%|*}" = "$name" ] && found="${data##*|}" && break
+        done
+        [ -n "$found" ] || break
+        spec+="${spec:++}$found"
+        n=$((n + 1))
+    done
+    echo "${spec:-0}"
+}
+
+# Prompt until the answer is a valid spec that fits in the remaining storage
+prompt_block_volumes() {
+    local prompt="$1" remaining="$2" spec problem
+    while true; do
+        spec=$(prompt_with_default "$prompt, GB (0 = none, 100+50 = two volumes; ${remaining}GB left)" "0")
+        if problem=$(block_volume_spec_error "$spec"); then
+            print_error "$problem" >&2
+        elif [ "$(block_volume_total_gb "$spec")" -gt "$remaining" ]; then
+            print_error "Only ${remaining}GB of Free Tier storage left" >&2
+        else
+            echo "$spec"
+            return 0
+        fi
+    done
+}
+
+# Apply AMD_BLOCK_VOLUMES / ARM_BLOCK_VOLUMES (or the matching flags) to the configuration
+apply_block_volume_overrides() {
+    local errors=0 kind list count spec problem i
+    local -a specs
+    for kind in amd arm; do
+        if [ "$kind" = "amd" ]; then
+            list="$AMD_BLOCK_VOLUMES" count=$amd_micro_instance_count
+        else
+            list="$ARM_BLOCK_VOLUMES" count=$arm_flex_instance_count
+        fi
+        [ -n "$list" ] || continue
+
+        IFS=',' read -r -a specs <<< "${list// /}"
+        if [ ${#specs[@]} -gt "$count" ]; then
+            print_error "${kind^^}_BLOCK_VOLUMES lists ${#specs[@]} instances but only $count ${kind^^} instance(s) are configured"
+            errors=$((errors + 1))
+            continue
+        fi
+        for spec in "${specs[@]}"; do
+            if problem=$(block_volume_spec_error "$spec"); then
+                print_error "${kind^^}_BLOCK_VOLUMES: $problem"
+                errors=$((errors + 1))
+            fi
+        done
+        [ "$errors" -eq 0 ] || continue
+
+        for ((i=${#specs[@]}; i<count; i++)); do
+            specs+=(0)
+        done
+        if [ "$kind" = "amd" ]; then
+            amd_block_volumes=("${specs[@]}")
+        else
+            arm_flex_block_volumes=("${specs[@]}")
+        fi
+        print_status "${kind^^} block volumes: ${specs[*]}"
+    done
+    [ "$errors" -eq 0 ]
+}
+
+# GB of existing managed block volumes that no configured instance claims
+orphaned_block_volume_gb() {
+    local total=0 data planned
+    planned=$(block_volumes_tf | jq -r 'keys[]')
+    for data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
+        grep -qxF "${data%%|*}" <<< "$planned" || total=$((total + ${data##*|}))
+    done
+    echo "$total"
+}
+
+# GB of boot volumes by whose instance they belong to: "eligible" (an AMD Micro or A1
+# instance), "other" (an instance of another shape), "detached" (no live instance, e.g.
+# left by a terminated one) or "outside" (anything but an instance this configuration manages)
+boot_volume_gb() {
+    local data _name size instance shape total=0
+    for data in "${EXISTING_BOOT_VOLUMES[@]}"; do
+        IFS='|' read -r _name size instance <<< "$data"
+        shape="${INSTANCE_SHAPES[${instance:-none}]:-}"
+        case "$1" in
+            eligible) [ "$shape" = "$FREE_TIER_AMD_SHAPE" ] || [ "$shape" = "$FREE_TIER_ARM_SHAPE" ] || continue ;;
+            other) [ "${instance:-none}" = "none" ] || [ "$shape" = "$FREE_TIER_AMD_SHAPE" ] || [ "$shape" = "$FREE_TIER_ARM_SHAPE" ] && continue ;;
+            detached) [ "${instance:-none}" = "none" ] || continue ;;
+            outside) [ -n "${EXISTING_AMD_INSTANCES[${instance:-none}]:-}${EXISTING_ARM_INSTANCES[${instance:-none}]:-}" ] && continue ;;
+        esac
+        total=$((total + size))
+    done
+    echo "$total"
+}
+
+# Storage the configuration may use: the Free Tier limit minus volumes it won't manage
+storage_budget_gb() {
+    echo $((FREE_TIER_MAX_STORAGE_GB - UNMANAGED_STORAGE_GB - $(orphaned_block_volume_gb) - $(boot_volume_gb outside)))
+}
+
+# Render the block volumes as a single-line HCL map keyed by display name:
+# {"arm-1-block":{"kind":"arm","index":0,"host":"arm-1","size_gb":100},"arm-1-block-2":{...}}
+block_volumes_tf() {
+    local i spec size n
+    {
+        for ((i=0; i<amd_micro_instance_count; i++)); do
+            spec="${amd_block_volumes[$i]:-0}"
+            [ "$spec" = "0" ] && continue
+            n=1
+            for size in ${spec//+/ }; do
+                printf '%s\tamd\t%s\t%s\t%s\n' "${amd_micro_hostnames[$i]}-block$([ "$n" -gt 1 ] && echo "-$n")" "$i" "$size" "${amd_micro_hostnames[$i]}"
+                n=$((n + 1))
+            done
+        done
+        for ((i=0; i<arm_flex_instance_count; i++)); do
+            spec="${arm_flex_block_volumes[$i]:-0}"
+            [ "$spec" = "0" ] && continue
+            n=1
+            for size in ${spec//+/ }; do
+                printf '%s\tarm\t%s\t%s\t%s\n' "${arm_flex_hostnames[$i]}-block$([ "$n" -gt 1 ] && echo "-$n")" "$i" "$size" "${arm_flex_hostnames[$i]}"
+                n=$((n + 1))
+            done
+        done
+    } | jq -Rn -c '[inputs | split("\t") | {(.[0]): {kind: .[1], index: (.[2] | tonumber), host: .[4], size_gb: (.[3] | tonumber)}}] | add // {}'
+}
+
+# Rebuild amd_block_volumes / arm_flex_block_volumes from the block_volumes map in variables.tf
+load_block_volume_specs() {
+    local map i
+    map=$(grep -oP '^\s*block_volumes\s*=\s*\K\{.*\}' variables.tf 2>/dev/null | head -1) || map=""
+    [ -n "$map" ] || map="{}"
+    amd_block_volumes=()
+    arm_flex_block_volumes=()
+    for ((i=0; i<amd_micro_instance_count; i++)); do
+        amd_block_volumes+=("$(jq -r --argjson i "$i" '[.[] | select(.kind == "amd" and .index == $i) | .size_gb | tostring] | if length == 0 then "0" else join("+") end' <<< "$map" 2>/dev/null || echo 0)")
+    done
+    for ((i=0; i<arm_flex_instance_count; i++)); do
+        arm_flex_block_volumes+=("$(jq -r --argjson i "$i" '[.[] | select(.kind == "arm" and .index == $i) | .size_gb | tostring] | if length == 0 then "0" else join("+") end' <<< "$map" 2>/dev/null || echo 0)")
+    done
+}
+
+# Adopt existing managed block volumes (and their attachments) whose names match the plan
+import_block_volumes() {
+    local planned id name address attachment_id managed
+    planned=$(block_volumes_tf)
+    # Volumes Terraform already manages, at any address: one still at its position-indexed
+    # address (amd_block[i]) is moved by moves.tf, and importing it again would leave two
+    # addresses for one volume, one of them planned for destruction
+    if ! managed=$(workspace_state | jq -r '.resources[]? | select(.type == "oci_core_volume") | .instances[]?.attributes.id // empty'); then
+        print_warning "Terraform state not readable: not adopting block volumes"
+        return 0
+    fi
+    for id in "${!EXISTING_BLOCK_VOLUMES[@]}"; do
+        name="${EXISTING_BLOCK_VOLUMES[$id]%%|*}"
+        jq -e --arg n "$name" 'has($n)' <<< "$planned" >/dev/null || continue
+        if grep -qxF "$id" <<< "$managed"; then
+            print_status "Already in state: block volume $name"
+            continue
+        fi
+        address="oci_core_volume.block[\"$name\"]"
+        queue_import "$address" "$id" "block volume $name"
+
+        attachment_id=$(oci_cmd "compute volume-attachment list \
+            --compartment-id $tenancy_ocid \
+            --volume-id $id \
+            --query 'data[?\"lifecycle-state\"==\`ATTACHED\`] | [0].id' \
+            --raw-output" 2>/dev/null) || attachment_id=""
+        if [ -n "$attachment_id" ] && [ "$attachment_id" != "null" ]; then
+            queue_import "oci_core_volume_attachment.block[\"$name\"]" "$attachment_id" "attachment of $name"
+        fi
+    done
+}
+
+# Adopt existing "<hostname>-volumes" groups for VOLUME_GROUPS instances (a volume can only
+# belong to one group, so creating a second one would fail)
+import_volume_groups() {
+    local host groups id
+    [ -n "$(volume_group_hosts)" ] || return 0
+    groups=$(oci_cmd "bv volume-group list \
+        --compartment-id $tenancy_ocid \
+        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\"}' \
+        --all" 2>/dev/null) || groups="[]"
+    while IFS= read -r host; do
+        id=$(jq -r --arg n "$host-volumes" '[.[]? | select(.name == $n)][0].id // empty' <<< "$groups")
+        [ -n "$id" ] || continue
+        queue_import "oci_core_volume_group.instance[\"$host\"]" "$id" "volume group $host-volumes"
+    done <<< "$(volume_group_hosts)"
+}
+
+# ============================================================================
+# TERRAFORM FILE GENERATION
+# ============================================================================
+
+create_terraform_files() {
+    print_header "GENERATING TERRAFORM FILES"
+    
+    resolve_provision || return 1
+    GENERATION_SPEC_HASH=$(generation_spec_hash)
+    [ "$LAYOUT" = "modules" ] && LAYOUT_STAGE_DIR=$(mktemp -d)
+    record_adopted_blocks
+    create_terraform_provider
+    create_terraform_encryption
+    create_terraform_variables
+    create_terraform_datasources
+    create_terraform_main
+    create_terraform_outputs
+    create_terraform_marketplace_images
+    create_terraform_capacity_reservation
+    create_terraform_block_volumes
+    create_terraform_volume_backups
+    create_terraform_backups
+    create_terraform_autonomous_databases
+    create_terraform_budget
+    create_terraform_secrets
+    release_instance_access_iam
+    create_terraform_renames
+    create_terraform_moves
+    create_terraform_layout || return 1
+    create_cloud_init
+    sync_extra_terraform
+    ensure_gitignore
+    
+    print_success "All Terraform files generated successfully"
+}
+
+# True when a workspace file is a copy of one of the EXTRA_TF_DIR files
+is_extra_tf_file() {
+    [ -f "$EXTRA_TF_MANIFEST" ] && grep -qxF "$1" "$EXTRA_TF_MANIFEST"
+}
+
+# Copy EXTRA_TF_DIR/*.tf into the workspace untouched and drop copies whose source was
+# removed. Names that clash with generated files are skipped.
+sync_extra_terraform() {
+    local -a generated=(provider.tf backend.tf variables.tf data_sources.tf main.tf block_volumes.tf
+        volume_backups.tf backups.tf autonomous_databases.tf secrets.tf marketplace_images.tf renames.tf
+        capacity_reservation.tf budget.tf outputs.tf layout.tf moves.tf encryption.tf)
+    local -a copied=()
+    local src name
+
+    if [ -f "$EXTRA_TF_MANIFEST" ]; then
+        while IFS= read -r name; do
+            [ -n "$name" ] && [ ! -f "$EXTRA_TF_DIR/$name" ] || continue
+            if [ "$DRY_RUN" = "true" ]; then
+                : > "$DRY_RUN_DIR/$name"   # keep the stale copy out of the scratch plan
+                print_status "[dry-run] Would remove $name (no longer in $EXTRA_TF_DIR/)"
+            else
+                rm -f "$name"
+                print_status "Removed $name (no longer in $EXTRA_TF_DIR/)"
+            fi
+        done < "$EXTRA_TF_MANIFEST"
+    fi
+
+    if [ -d "$EXTRA_TF_DIR" ]; then
+        for src in "$EXTRA_TF_DIR"/*.tf; do
+            [ -f "$src" ] || continue
+            name=$(basename "$src")
+            if printf '%s\n' "${generated[@]}" | grep -qxF "$name"; then
+                print_warning "Skipping $src: $name is a generated file (rename it)"
+                continue
+            fi
+            copied+=("$name")
+            [ "$DRY_RUN" = "true" ] && cp "$src" "$DRY_RUN_DIR/$name"
+            cmp -s "$src" "$name" && continue
+            if [ "$DRY_RUN" = "true" ]; then
+                print_status "[dry-run] Would copy $src"
+            else
+                cp "$src" "$name"
+                print_status "Copied $src"
+            fi
+        done
+    fi
+
+    [ "$DRY_RUN" = "true" ] && return 0
+    if [ ${#copied[@]} -gt 0 ]; then
+        printf '%s\n' "${copied[@]}" > "$EXTRA_TF_MANIFEST"
+    else
+        rm -f "$EXTRA_TF_MANIFEST"
+    fi
+}
+
+# ============================================================================
+# MODULES LAYOUT
+# ============================================================================
+#
+# LAYOUT=modules splits the generated main.tf, block_volumes.tf and volume_backups.tf into
+# modules/{network,compute-amd,compute-arm,storage}; the root keeps the settings, the other
+# generated files and a main.tf that wires the modules together. Blocks move unchanged
+# except for references to what now lives elsewhere:
+#   resource or data source T.N  ->  var.<sym> in a module, module.<call>.<sym> in the root
+#   local.x / var.x              ->  module input x (a locals block keeps the local.x name)
+# where <sym> is T.N without its oci_/core_ prefix (oci_core_vcn.main -> vcn_main).
+
+readonly TERRAFORM_MODULES="network compute-amd compute-arm storage"
+
+# "start|end|kind|id|defs|refs" for each top-level block of FILE. id is T.N for resources,
+# data.T.N for data sources and the label otherwise; defs are the names a locals block
+# defines; refs are the resources, data sources, locals and variables the block uses.
+# Comment lines before a block belong to it.
+terraform_blocks() {
+    awk '
+        function refs(line,    ref, pre) {
+            sub(/#.*/, "", line)
+            while (match(line, /(data\.)?oci_[a-z0-9_]+\.[a-z0-9_]+|(local|var)\.[a-z0-9_]+/)) {
+                ref = substr(line, RSTART, RLENGTH)
+                pre = substr(line, 1, RSTART - 1)
+                line = substr(line, RSTART + RLENGTH)
+                if (pre ~ /[.A-Za-z0-9_]$/ || index(" " found " ", " " ref " ")) continue
+                found = found (found == "" ? "" : " ") ref
+            }
+        }
+        function emit() { print start "|" FNR "|" kind "|" id "|" defs "|" found; in_block = 0; start = 0 }
+        FNR == 1 { start = 0; in_block = 0 }
+        !start { start = FNR }
+        !in_block && /^[a-z]+( "[^"]*")* \{/ {
+            in_block = 1; kind = $1; id = ""; defs = ""; found = ""
+            n = split($0, f, "\"")
+            if (kind == "resource") id = f[2] "." f[4]
+            else if (kind == "data") id = "data." f[2] "." f[4]
+            else if (n > 1) id = f[2]
+            if (/\{\}$/) emit()
+            next
+        }
+        !in_block { next }
+        /^\}/ { emit(); next }
+        kind == "locals" && match($0, /^  [A-Za-z0-9_]+[[:space:]]*=/) {
+            name = substr($0, 3, RLENGTH - 3); sub(/[[:space:]]+$/, "", name)
+            defs = defs (defs == "" ? "" : " ") name
+        }
+        { refs($0) }
+    ' "$1"
+}
+
+# FILE with the references listed in MAP ("ref<TAB>expression<TAB>address in moved blocks")
+# replaced; comments are left alone
+terraform_rewrite_refs() {
+    awk -v map="$1" '
+        BEGIN {
+            while ((getline entry < map) > 0) {
+                split(entry, f, "\t")
+                expr[f[1]] = f[2]; moved_to[f[1]] = f[3]
+            }
+        }
+        {
+            line = $0; out = ""; comment = ""
+            if (match(line, /#/)) { comment = substr(line, RSTART); line = substr(line, 1, RSTART - 1) }
+            in_moved = line ~ /^  (from|to)[[:space:]]*=/
+            while (match(line, /(data\.)?oci_[a-z0-9_]+\.[a-z0-9_]+|local\.[a-z0-9_]+/)) {
+                ref = substr(line, RSTART, RLENGTH)
+                pre = substr(line, 1, RSTART - 1)
+                line = substr(line, RSTART + RLENGTH)
+                if (pre ~ /[.A-Za-z0-9_]$/ || !(ref in expr)) out = out pre ref
+                else out = out pre (in_moved ? moved_to[ref] : expr[ref])
+            }
+            print out line comment
+        }
+    ' "$2"
+}
+
+# "name<TAB>value" lines as HCL attributes, aligned the way terraform fmt does
+hcl_attributes() {
+    awk -F'\t' '{ name[NR] = $1; value[NR] = $2; if (length($1) > w) w = length($1) }
+        END { for (i = 1; i <= NR; i++) printf "  %-" w "s = %s\n", name[i], value[i] }'
+}
+
+# Lines START,END of FILE without the blank lines in front
+terraform_block_text() {
+    sed -n "$1p" "$2" | sed '/./,$!d'
+}
+
+# "<module call><TAB>T.N" for each resource of the generated modules in DIR/modules
+module_resources() {
+    local dir="${1:-.}" m
+    for m in $TERRAFORM_MODULES; do
+        [ -f "$dir/modules/$m/main.tf" ] || continue
+        awk -F'"' -v call="${m//-/_}" '/^resource "/ { print call "\t" $2 "." $4 }' "$dir/modules/$m/main.tf"
+    done
+}
+
+# ADDRESS (oci_core_instance.arm["arm-1"]) as Terraform sees it in the current layout
+# (module.compute_arm.oci_core_instance.arm["arm-1"] with LAYOUT=modules)
+tf_address() {
+    local address="$1" dir=. call
+    if [ "$LAYOUT" != "modules" ]; then
+        echo "$address"
+        return 0
+    fi
+    [ "$DRY_RUN" = "true" ] && dir="$DRY_RUN_DIR"
+    call=$(module_resources "$dir" | awk -F'\t' -v n="${address%%[*}" '$2 == n { print $1; exit }')
+    echo "${call:+module.$call.}$address"
+}
+
+# Which module of the modules layout a block of the flat FILE belongs in
+terraform_block_module() {
+    local file="$1" kind="$2" id="$3"
+    case "$file:$kind" in
+        main.tf:resource|main.tf:data)
+            case "${id##*.}" in
+                amd*) echo compute-amd ;;
+                arm*) echo compute-arm ;;
+                *) echo network ;;
+            esac
+            ;;
+        main.tf:*) echo root ;;
+        *) echo storage ;;
+    esac
+}
+
+# layout.tf: moved blocks between the flat and the modules layout, so switching LAYOUT
+# moves the resources in state instead of replacing them
+create_terraform_layout() {
+    if [ "$LAYOUT" = "modules" ]; then
+        local stage="$LAYOUT_STAGE_DIR"
+        LAYOUT_STAGE_DIR=""
+        modularize_terraform "$stage" || { rm -rf "$stage"; return 1; }
+        rm -rf "$stage"
+        return 0
+    fi
+
+    print_status "Creating layout.tf..."
+    {
+        cat << 'EOF'
+# Moves between the flat and the modules layout (LAYOUT)
+# Flat layout: resources of the modules in modules/ (from an earlier modules layout) move back
+# to the root module. Delete modules/ once this has been applied.
+EOF
+        module_resources . | while IFS=$'\t' read -r call node; do
+            printf '\nmoved {\n  from = module.%s.%s\n  to   = %s\n}\n' "$call" "$node" "$node"
+        done
+    } | write_generated_file layout.tf
+    print_success "layout.tf created"
+}
+
+# Split the files collected in STAGE into the modules and the root module (see above)
+modularize_terraform() {
+    local stage="$1" dir=. file m call ref name sym o src i start end kind id defs refs mods
+    local -a split_files=(main.tf block_volumes.tf volume_backups.tf)
+    local -a b_file=() b_range=() b_kind=() b_id=() b_defs=() b_refs=() b_module=() root_files=()
+    local -A owner=() inputs=() aliases=() outputs=() exports=() rewrites=() passthrough=()
+    [ "$DRY_RUN" = "true" ] && dir="$DRY_RUN_DIR"
+
+    print_status "Splitting the configuration into modules/ (LAYOUT=modules)..."
+
+    # Blocks of the files being split, and which module each goes to. A locals block goes
+    # with the module whose resources it uses; when it uses several, to its file's default.
+    for file in "${split_files[@]}"; do
+        [ -f "$stage/$file" ] || continue
+        while IFS='|' read -r start end kind id defs refs; do
+            b_file+=("$file"); b_range+=("$start,$end"); b_kind+=("$kind"); b_id+=("$id")
+            b_defs+=("$defs"); b_refs+=("$refs")
+            b_module+=("$(terraform_block_module "$file" "$kind" "$id")")
+            case "$kind" in
+                resource|data) owner[$id]="${b_module[-1]}" ;;
+            esac
+        done < <(terraform_blocks "$stage/$file")
+    done
+    for i in "${!b_kind[@]}"; do
+        [ "${b_kind[$i]}" = "locals" ] || continue
+        mods=$(for ref in ${b_refs[$i]}; do echo "${owner[$ref]:-}"; done | grep -v '^$\|^root$' | sort -u)
+        [ -n "$mods" ] && [ "$(wc -l <<< "$mods")" -eq 1 ] && b_module[$i]="$mods"
+        [ "${b_module[$i]}" = "root" ] && continue
+        for name in ${b_defs[$i]}; do
+            owner[local.$name]="${b_module[$i]}"
+        done
+    done
+
+    # Wire every reference that crosses a module boundary
+    _wire_ref() {
+        local context="$1" ref="$2" kind="${3:-}"
+        o="${owner[$ref]:-root}"
+        [ "$o" = "$context" ] && return 0
+        case "$ref" in
+            var.*)
+                [ "$context" = "root" ] || inputs[$context|${ref#var.}]="$ref"
+                ;;
+            local.*)
+                name="${ref#local.}" src="$ref"
+                if [ "$o" != "root" ]; then
+                    outputs[$o|$name]="$ref"
+                    src="module.${o//-/_}.$name"
+                fi
+                if [ "$context" = "root" ]; then
+                    exports[$name]="$src"
+                else
+                    inputs[$context|$name]="$src"
+                    aliases[$context|$name]=1
+                fi
+                ;;
+            *)
+                sym="${ref#data.}"; sym="${sym#oci_}"; sym="${sym#core_}"; sym="${sym/./_}"
+                src="$ref"
+                if [ "$o" != "root" ]; then
+                    # moved blocks take the address, not the value
+                    [ "$kind" = "moved" ] || outputs[$o|$sym]="$ref"
+                    src="module.${o//-/_}.$sym"
+                fi
+                if [ "$context" = "root" ]; then
+                    rewrites[root|$ref]="$src"$'\t'"module.${o//-/_}.$ref"
+                else
+                    inputs[$context|$sym]="$src"
+                    rewrites[$context|$ref]="var.$sym"$'\t'
+                fi
+                ;;
+        esac
+    }
+    for i in "${!b_kind[@]}"; do
+        for ref in ${b_refs[$i]}; do
+            _wire_ref "${b_module[$i]}" "$ref"
+        done
+        [ "${b_kind[$i]}" = "output" ] && [ "${b_module[$i]}" != "root" ] && passthrough[${b_id[$i]}]="${b_module[$i]}"
+    done
+    for file in "$stage"/*.tf; do
+        name=$(basename "$file")
+        printf '%s\n' "${split_files[@]}" | grep -qxF "$name" && continue
+        root_files+=("$name")
+        while IFS='|' read -r start end kind id defs refs; do
+            for ref in $refs; do
+                _wire_ref root "$ref" "$kind"
+            done
+        done < <(terraform_blocks "$file")
+    done
+    unset -f _wire_ref
+
+    # The modules
+    local map description
+    map=$(mktemp)
+    for m in $TERRAFORM_MODULES; do
+        case "$m" in
+            network) description="VCN, gateways, route tables, security lists and subnets" ;;
+            compute-amd) description="AMD VM.Standard.E2.1.Micro instances, their IPv6 addresses and reserved public IPs" ;;
+            compute-arm) description="ARM VM.Standard.A1.Flex instances, their IPv6 addresses and reserved public IPs" ;;
+            storage) description="Block volumes, volume groups and scheduled volume backups" ;;
+        esac
+        mkdir -p "$dir/modules/$m"
+        for ref in "${!rewrites[@]}"; do
+            [ "${ref%%|*}" = "$m" ] && printf '%s\t%s\n' "${ref#*|}" "${rewrites[$ref]}"
+        done > "$map"
+        {
+            echo "# $description"
+            echo "# Module of the modules layout (LAYOUT=modules), generated from the flat configuration."
+            echo "# The setup rewrites main.tf, variables.tf and outputs.tf; add your own .tf files here."
+            echo ""
+            echo 'terraform {'
+            echo '  required_providers {'
+            echo '    oci = {'
+            echo '      source = "oracle/oci"'
+            echo '    }'
+            echo '  }'
+            echo '}'
+            for i in "${!b_kind[@]}"; do
+                [ "${b_module[$i]}" = "$m" ] || continue
+                echo ""
+                terraform_block_text "${b_range[$i]}" "$stage/${b_file[$i]}"
+            done | terraform_rewrite_refs "$map" /dev/stdin | sed 's/[$][{]path[.]module[}]/${path.root}/g'
+        } | write_generated_file "modules/$m/main.tf"
+        {
+            echo "# Inputs of the ${m} module, set by module \"${m//-/_}\" in the root main.tf"
+            for ref in $(printf '%s\n' "${!inputs[@]}" | grep "^$m|" | sort); do
+                echo ""
+                echo "variable \"${ref#*|}\" {}"
+            done
+            if printf '%s\n' "${!aliases[@]}" | grep -q "^$m|"; then
+                echo ""
+                echo "# Inputs under the local.<name> they have in the flat configuration"
+                echo "locals {"
+                for ref in $(printf '%s\n' "${!aliases[@]}" | grep "^$m|" | sort); do
+                    printf '%s\tvar.%s\n' "${ref#*|}" "${ref#*|}"
+                done | hcl_attributes
+                echo "}"
+            fi
+        } | write_generated_file "modules/$m/variables.tf"
+        {
+            echo "# Outputs of the ${m} module, used by the root module and the other modules"
+            for ref in $(printf '%s\n' "${!outputs[@]}" | grep "^$m|" | sort); do
+                printf '\noutput "%s" {\n  value = %s\n}\n' "${ref#*|}" "${outputs[$ref]}"
+            done
+        } | write_generated_file "modules/$m/outputs.tf"
+    done
+
+    # The root module: module calls, locals the root files use from the modules, and the
+    # blocks that stay in the root
+    for ref in "${!rewrites[@]}"; do
+        [ "${ref%%|*}" = "root" ] && printf '%s\t%s\n' "${ref#*|}" "${rewrites[$ref]}"
+    done > "$map"
+    {
+        echo "# Oracle Cloud Infrastructure - Root module (LAYOUT=modules)"
+        echo "# The resources are in modules/; this file wires them together. The settings are the"
+        echo "# locals in variables.tf."
+        for m in $TERRAFORM_MODULES; do
+            echo ""
+            echo "module \"${m//-/_}\" {"
+            echo "  source = \"./modules/$m\""
+            printf '%s\n' "${!inputs[@]}" | grep -q "^$m|" && echo ""
+            for ref in $(printf '%s\n' "${!inputs[@]}" | grep "^$m|" | sort); do
+                printf '%s\t%s\n' "${ref#*|}" "${inputs[$ref]}"
+            done | hcl_attributes
+            echo "}"
+        done
+        if [ ${#exports[@]} -gt 0 ]; then
+            echo ""
+            echo "# Locals of the modules that the root files use"
+            echo "locals {"
+            for name in $(printf '%s\n' "${!exports[@]}" | sort); do
+                printf '%s\t%s\n' "$name" "${exports[$name]}"
+            done | hcl_attributes
+            echo "}"
+        fi
+        for i in "${!b_kind[@]}"; do
+            [ "${b_module[$i]}" = "root" ] || continue
+            echo ""
+            terraform_block_text "${b_range[$i]}" "$stage/${b_file[$i]}"
+        done | terraform_rewrite_refs "$map" /dev/stdin
+        for name in $(printf '%s\n' "${!passthrough[@]}" | sort); do
+            printf '\noutput "%s" {\n  value = module.%s.%s\n}\n' "$name" "${passthrough[$name]//-/_}" "$name"
+        done
+    } | write_generated_file main.tf
+    for file in "${root_files[@]}"; do
+        terraform_rewrite_refs "$map" "$stage/$file" | write_generated_file "$file"
+    done
+    rm -f "$map"
+
+    {
+        cat << 'EOF'
+# Moves between the flat and the modules layout (LAYOUT)
+# Resources in state from the flat layout move into their module instead of being replaced.
+EOF
+        module_resources "$dir" | while IFS=$'\t' read -r call ref; do
+            printf '\nmoved {\n  from = %s\n  to   = module.%s.%s\n}\n' "$ref" "$call" "$ref"
+        done
+    } | write_generated_file layout.tf
+
+    # The flat files now in modules/storage
+    for file in block_volumes.tf volume_backups.tf; do
+        [ -f "$file" ] || continue
+        if [ "$DRY_RUN" = "true" ]; then
+            : > "$DRY_RUN_DIR/$file"
+            print_status "[dry-run] Would remove $file (now in modules/storage)"
+        else
+            mv "$file" "$file.bak.$(date +%Y%m%d_%H%M%S)"
+            print_status "Removed $file (now in modules/storage)"
+        fi
+    done
+
+    print_success "Modules written to modules/: ${TERRAFORM_MODULES// /, }"
+}
+
+# Provider auth attributes for the detected OCI CLI auth method
+terraform_provider_auth_hcl() {
+    case "$auth_method" in
+        api_key)
+            echo "  auth                = \"APIKey\""
+            echo "  config_file_profile = \"$OCI_PROFILE\""
+            ;;
+        instance_principal)
+            echo "  auth                = \"InstancePrincipal\""
+            ;;
+        resource_principal)
+            echo "  auth                = \"ResourcePrincipal\""
+            ;;
+        oke_workload_identity)
+            echo "  auth                = \"OKEWorkloadIdentity\""
+            ;;
+        *)
+            echo "  auth                = \"SecurityToken\""
+            echo "  config_file_profile = \"$OCI_PROFILE\""
+            ;;
+    esac
+}
+
+create_terraform_provider() {
+    print_status "Creating provider.tf..."
+
+    # Configure terraform backend if requested (may create backend.tf)
+    configure_terraform_backend || true
+    
+    write_generated_file provider.tf << EOF
+# Terraform Provider Configuration for Oracle Cloud Infrastructure
+# Generated: $(date)
+# Region: $region
+
+terraform {
+  required_version = "$(terraform_required_version)"
+  required_providers {
+    oci = {
+      source  = "oracle/oci"
+      version = "$(oci_provider_version)"
+    }
+  }
+}
+
+# OCI Provider ($auth_method authentication, matching the OCI CLI session)
+provider "oci" {
+$(terraform_provider_auth_hcl)
+  region              = "$region"
+}
+EOF
+    
+    print_success "provider.tf created"
+}
+
+# Declared power state of an instance (RUNNING unless recorded in POWER_STATE_FILE)
+power_state_of() {
+    local name="$1" state=""
+    [ -f "$POWER_STATE_FILE" ] && state=$(awk -v h="$name" '$1 == h { print toupper($2) }' "$POWER_STATE_FILE" | tail -1)
+    echo "${state:-RUNNING}"
+}
+
+# Record the declared power state; RUNNING is the default and is simply removed
+record_power_state() {
+    local name="$1" state="$2" tmp
+    tmp=$(mktemp)
+    [ -f "$POWER_STATE_FILE" ] && awk -v h="$name" '$1 != h' "$POWER_STATE_FILE" > "$tmp"
+    [ "$state" = "RUNNING" ] || echo "$name $state" >> "$tmp"
+    if [ -s "$tmp" ] || [ -f "$POWER_STATE_FILE" ]; then
+        mv "$tmp" "$POWER_STATE_FILE"
+    else
+        rm -f "$tmp"
+    fi
+}
+
+# Render POWER_STATE_FILE as a single-line HCL map: {"host":"STOPPED"}
+power_states_tf() {
+    if [ ! -f "$POWER_STATE_FILE" ]; then
+        echo "{}"
+        return 0
+    fi
+    sed 's/#.*//' "$POWER_STATE_FILE" | awk 'NF >= 2 { print $1, toupper($2) }' \
+        | jq -Rn '[inputs | split(" ") | {(.[0]): .[1]}] | add // {}' -c
+}
+
+# Rewrite the instance_power_states local in an existing variables.tf so a plan run
+# right after stop/start already sees the new declared state
+refresh_power_states_tf() {
+    [ -f variables.tf ] || return 0
+    [ "$DRY_RUN" = "true" ] && return 0
+    local tmp
+    tmp=$(mktemp)
+    awk -v states="$(power_states_tf)" \
+        '/^  instance_power_states = / { print "  instance_power_states = " states; next } { print }' \
+        variables.tf > "$tmp" && mv "$tmp" variables.tf
+}
+
+# Render INSTANCE_LABELS_FILE as an HCL map of maps: { "host" = { "role" = "web" } }
+instance_labels_tf() {
+    if [ ! -f "$INSTANCE_LABELS_FILE" ]; then
+        echo "{}"
+        return 0
+    fi
+
+    local out="{" line hostname pair key value
+    while IFS= read -r line; do
+        line=$(echo "$line" | sed 's/#.*//')
+        read -r hostname line <<< "$line"
+        [ -n "$hostname" ] || continue
+
+        out+=$'\n'"    \"$hostname\" = {"
+        for pair in $line; do
+            key="${pair%%=*}"
+            value="${pair#*=}"
+            if [[ ! "$pair" == *=* ]] || [[ ! "$key" =~ ^[A-Za-z][A-Za-z0-9_.-]*$ ]]; then
+                print_warning "Ignoring invalid label '$pair' for $hostname in $INSTANCE_LABELS_FILE" >&2
+                continue
+            fi
+            out+=" \"$key\" = \"$value\","
+        done
+        out="${out%,} }"
+    done < "$INSTANCE_LABELS_FILE"
+    out+=$'\n'"  }"
+
+    echo "$out"
+}
+
+# FIREWALL_RULES plus the rules other settings depend on, one per line: ports 80/443 for a
+# reverse proxy and SSH_PORT from the sources allowed to reach port 22
+effective_firewall_rules() {
+    [ ${#FIREWALL_RULES[@]} -gt 0 ] || load_firewall_rules
+
+    local rule port ssh_port cidrs=""
+    printf '%s\n' "${FIREWALL_RULES[@]}"
+    # A reverse proxy needs 80 (ACME challenges, redirects) and 443 open to the world
+    if reverse_proxy_in_use; then
+        for port in 80 443; do
+            firewall_allows_port "$port" || echo "ingress tcp $port 0.0.0.0/0,::/0 Reverse proxy ($REVERSE_PROXY)"
+        done
+    fi
+    ssh_port=$(ssh_port)
+    if [ "$ssh_port" != "22" ]; then
+        for rule in "${FIREWALL_RULES[@]}"; do
+            firewall_rule_admits_port "$rule" "$ssh_port" && return 0
+            firewall_rule_admits_port "$rule" 22 || continue
+            read -r _ _ _ port _ <<< "$rule"
+            cidrs+="${cidrs:+,}$port"
+        done
+        [ -z "$cidrs" ] || echo "ingress tcp $ssh_port $cidrs SSH ($ssh_port)"
+    fi
+}
+
+# Render FIREWALL_RULES for one direction as an HCL list of rule objects. Each port spec
+# and CIDR becomes its own security list rule; ICMP uses protocol 58 for IPv6 sources.
+firewall_rules_tf() {
+    local direction="$1"
+
+    local out="[" rule dir proto ports cidrs description cidr port_spec protocol min max icmp_type label
+    while IFS= read -r rule; do
+        read -r dir proto ports cidrs description <<< "$rule"
+        [ "$dir" = "$direction" ] || continue
+        for cidr in ${cidrs//,/ }; do
+            for port_spec in ${ports//,/ }; do
+                min="null"; max="null"; icmp_type="null"
+                case "$proto" in
+                    tcp) protocol="6" ;;
+                    udp) protocol="17" ;;
+                    icmp) if [[ "$cidr" == *:* ]]; then protocol="58"; else protocol="1"; fi ;;
+                    all) protocol="all" ;;
+                    *)
+                        print_warning "Ignoring firewall rule with unknown protocol '$proto': $rule" >&2
+                        continue 2
+                        ;;
+                esac
+                if [ "$proto" = "icmp" ] && [[ "$port_spec" =~ ^[0-9]+$ ]]; then
+                    icmp_type="$port_spec"
+                elif [[ "$port_spec" =~ ^([0-9]+)(-([0-9]+))?$ ]] && { [ "$proto" = "tcp" ] || [ "$proto" = "udp" ]; }; then
+                    min="${BASH_REMATCH[1]}"
+                    max="${BASH_REMATCH[3]:-$min}"
+                fi
+                label="${description:-$proto $port_spec}"
+                out+=$'\n'"    { protocol = \"$protocol\", cidr = \"$cidr\", min = $min, max = $max, icmp_type = $icmp_type, description = \"${label//\"/}\" },"
+            done
+        done
+    done < <(effective_firewall_rules)
+    out+=$'\n'"  ]"
+
+    echo "$out"
+}
+
+# Render RESERVED_PUBLIC_IPS as an HCL list of hostnames ("all" = every instance).
+# Private (two-tier) instances never get a public IP and are left out.
+reserved_ip_hostnames_tf() {
+    local -a hosts=()
+    if [ "$RESERVED_PUBLIC_IPS" = "all" ]; then
+        hosts=("${amd_micro_hostnames[@]}" "${arm_flex_hostnames[@]}")
+    elif [ -n "$RESERVED_PUBLIC_IPS" ]; then
+        IFS=',' read -r -a hosts <<< "${RESERVED_PUBLIC_IPS// /}"
+    fi
+    if [ ${#hosts[@]} -eq 0 ]; then
+        echo "[]"
+        return 0
+    fi
+    printf '%s\n' "${hosts[@]}" | jq -R . | jq -sc --argjson private "$(private_hostnames_tf)" \
+        '[.[] | select(. as $h | $private | index($h) | not)]'
+}
+
+# Render the dynamic DNS name of every public instance as an HCL map (empty when disabled)
+ddns_domains_tf() {
+    if [ -z "$DDNS_PROVIDER" ]; then
+        echo "{}"
+        return 0
+    fi
+    local host
+    for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do
+        [ -n "$host" ] && echo "$host ${DDNS_DOMAIN_TEMPLATE//\{hostname\}/$host}"
+    done | jq -Rn --argjson private "$(private_hostnames_tf)" '
+        [inputs | split(" ") | select(.[0] as $h | $private | index($h) | not) | {(.[0]): .[1]}] | add // {}' -c
+}
+
+# Bastion hostname for the two-tier topology (BASTION_HOST or the first instance)
+bastion_hostname() {
+    [ "$NETWORK_TOPOLOGY" = "two-tier" ] || return 0
+    if [ -n "$BASTION_HOST" ]; then
+        echo "$BASTION_HOST"
+    elif [ "$amd_micro_instance_count" -gt 0 ]; then
+        echo "${amd_micro_hostnames[0]}"
+    elif [ "$arm_flex_instance_count" -gt 0 ]; then
+        echo "${arm_flex_hostnames[0]}"
+    fi
+}
+
+# Render the hostnames without a public IP as an HCL list (empty for the flat topology).
+# SUBNETS_FILE assignments win: hosts in its public subnets are public, in private ones private.
+private_hostnames_tf() {
+    local -a hosts=() public=() members=()
+    local spec kind assigned
+    if [ "$NETWORK_TOPOLOGY" = "two-tier" ]; then
+        if [ -n "$PRIVATE_INSTANCES" ]; then
+            IFS=',' read -r -a hosts <<< "${PRIVATE_INSTANCES// /}"
+        else
+            hosts=("${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}")
+        fi
+        load_subnet_specs
+        for spec in "${SUBNET_SPECS[@]}"; do
+            read -r _ _ kind assigned <<< "$spec"
+            IFS=',' read -r -a members <<< "$assigned"
+            if [ "$kind" = "private" ]; then
+                hosts+=("${members[@]}")
+            else
+                public+=("${members[@]}")
+            fi
+        done
+    fi
+    if [ ${#hosts[@]} -eq 0 ]; then
+        echo "[]"
+        return 0
+    fi
+    printf '%s\n' "${hosts[@]}" | jq -R . | jq -sc --arg bastion "$(bastion_hostname)" \
+        --argjson public "$(printf '%s\n' "${public[@]}" | jq -R . | jq -sc .)" \
+        'reduce (.[] | select(length > 0 and . != $bastion and (. as $h | $public | index($h) | not))) as $h
+            ([]; if index([$h]) then . else . + [$h] end)'
+}
+
+# Render SUBNETS_FILE as an HCL map: {"db": {"cidr": ..., "public": false, "dns_label": ..., "ipv6_index": 2}}
+# An adopted subnet keeps its DNS label (changing it would replace the subnet). IPv6 /64s 0
+# and 1 belong to the public and private subnets, so add new subnets at the end of the file.
+# Existing VCNs other than the import target as {name: {cidr}} (adopted_vcns in variables.tf)
+adopted_vcns_tf() {
+    local target id
+    target=$(import_target_vcn_id)
+    for id in "${!EXISTING_VCNS[@]}"; do
+        [ "$id" != "$target" ] || continue
+        printf '%s\n' "${EXISTING_VCNS[$id]}"
+    done | jq -Rn -c '[inputs | split("|") | select(.[1] != "" and .[1] != "null") | {(.[0]): {cidr: .[1]}}] | add // {}'
+}
+
+subnets_tf() {
+    local spec name cidr kind vcn_id subnet_id dns index=2
+    load_subnet_specs
+    vcn_id=$(import_target_vcn_id)
+    for spec in "${SUBNET_SPECS[@]}"; do
+        read -r name cidr kind _ <<< "$spec"
+        dns="$name"
+        subnet_id=""
+        [ -n "$vcn_id" ] && subnet_id=$(existing_extra_subnet_id "$name" "$cidr" "$vcn_id")
+        [ -n "$subnet_id" ] && dns=$(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f4)
+        printf '%s\t%s\t%s\t%s\t%s\n' "$name" "$cidr" "$kind" "$dns" "$index"
+        index=$((index + 1))
+    done | jq -Rn -c '[inputs | split("\t")
+        | {(.[0]): {cidr: .[1], public: (.[2] == "public"), dns_label: (if .[3] == "" then null else .[3] end), ipv6_index: (.[4] | tonumber)}}] | add // {}'
+}
+
+# Render the SUBNETS_FILE instance assignments as an HCL map: {"hostname": "subnet name"}
+instance_subnets_tf() {
+    local spec name hosts host
+    load_subnet_specs
+    for spec in "${SUBNET_SPECS[@]}"; do
+        read -r name _ _ hosts <<< "$spec"
+        for host in ${hosts//,/ }; do
+            printf '%s\t%s\n' "$host" "$name"
+        done
+    done | jq -Rn -c '[inputs | split("\t") | {(.[0]): .[1]}] | add // {}'
+}
+
+# Render MANAGED_TAG as an HCL map ({} when tag scoping is off)
+managed_tags_tf() {
+    if [ -z "$MANAGED_TAG" ]; then
+        echo "{}"
+        return 0
+    fi
+    echo "{ \"${MANAGED_TAG%%=*}\" = \"${MANAGED_TAG#*=}\" }"
+}
+
+create_terraform_variables() {
+    print_status "Creating variables.tf..."
+    
+    # Rendered into backup_rclone below
+    if [ "$(backup_plans_tf)" != "{}" ]; then
+        ensure_rclone_checksums || true
+    fi
+    
+    # Build array strings for Terraform
+    local amd_hostnames_tf="["
+    for ((i=0; i<${#amd_micro_hostnames[@]}; i++)); do
+        [ $i -gt 0 ] && amd_hostnames_tf+=", "
+        amd_hostnames_tf+="\"${amd_micro_hostnames[$i]}\""
+    done
+    amd_hostnames_tf+="]"
+    
+    local arm_hostnames_tf="["
+    for ((i=0; i<${#arm_flex_hostnames[@]}; i++)); do
+        [ $i -gt 0 ] && arm_hostnames_tf+=", "
+        arm_hostnames_tf+="\"${arm_flex_hostnames[$i]}\""
+    done
+    arm_hostnames_tf+="]"
+    
+    local arm_ocpus_tf="["
+    local arm_memory_tf="["
+    local arm_boot_tf="["
+    
+    if [ "$arm_flex_instance_count" -gt 0 ]; then
+        # Split space-separated strings safely into arrays
+        IFS=' ' read -r -a ocpu_arr <<< "$arm_flex_ocpus_per_instance"
+        IFS=' ' read -r -a memory_arr <<< "$arm_flex_memory_per_instance"
+        IFS=' ' read -r -a boot_arr <<< "$arm_flex_boot_volume_size_gb"
+        
+        for ((i=0; i<${#ocpu_arr[@]}; i++)); do
+            [ $i -gt 0 ] && arm_ocpus_tf+=", " && arm_memory_tf+=", " && arm_boot_tf+=", "
+            arm_ocpus_tf+="${ocpu_arr[$i]}"
+            arm_memory_tf+="${memory_arr[$i]}"
+            arm_boot_tf+="${boot_arr[$i]}"
+        done
+    fi
+    
+    arm_ocpus_tf+="]"
+    arm_memory_tf+="]"
+    arm_boot_tf+="]"
+    
+    write_generated_file variables.tf << EOF
+# Oracle Cloud Infrastructure Terraform Variables
+# Generated: $(date)
+# Configuration: ${amd_micro_instance_count}x AMD + ${arm_flex_instance_count}x ARM instances
+
+locals {
+  # Core identifiers
+  tenancy_ocid    = "$tenancy_ocid"
+  compartment_id  = "$tenancy_ocid"
+  user_ocid       = "$user_ocid"
+  region          = "$region"
+  
+  # Instance images (region-specific; INSTANCE_OS or AMD_IMAGE_OCID/ARM_IMAGE_OCID)
+  ubuntu_x86_image_ocid = "$ubuntu_image_ocid"
+  ubuntu_arm_image_ocid = "$ubuntu_arm_flex_image_ocid"
+  marketplace_images    = $(marketplace_images_tf)
+
+  # Operating system, its login user and cloud-init package differences
+  instance_os = "$INSTANCE_OS"
+  ssh_user    = "${SSH_USER:-$(os_default_user "$INSTANCE_OS")}"
+  os_settings = $(os_settings_tf)
+
+  # Template variables for CLOUD_INIT_FILE commands and files (\${vars.<name>})
+  cloud_init_vars = $(cloud_init_vars_tf)
+  
+  # SSH Configuration
+  ssh_pubkey_path      = pathexpand("./ssh_keys/id_rsa.pub")
+  ssh_pubkey_data      = file(pathexpand("./ssh_keys/id_rsa.pub"))
+  ssh_private_key_path = pathexpand("./ssh_keys/id_rsa")
+  
+  # AMD x86 Micro Instances Configuration
+  amd_micro_instance_count      = $amd_micro_instance_count
+  amd_micro_boot_volume_size_gb = $amd_micro_boot_volume_size_gb
+  amd_micro_hostnames           = $amd_hostnames_tf
+  
+  # ARM A1 Flex Instances Configuration
+  arm_flex_instance_count       = $arm_flex_instance_count
+  arm_flex_ocpus_per_instance   = $arm_ocpus_tf
+  arm_flex_memory_per_instance  = $arm_memory_tf
+  arm_flex_boot_volume_size_gb  = $arm_boot_tf
+  arm_flex_hostnames            = $arm_hostnames_tf
+
+  # Block volumes keyed by display name ("<hostname>-block", "<hostname>-block-2", ...)
+  block_volumes = $(block_volumes_tf)
+
+  # Compute capacity reservation for the ARM instances (CAPACITY_RESERVATION: none, create or an OCID)
+  capacity_reservation = "$(capacity_reservation)"
+  
+  # Security list rules (from $FIREWALL_RULES_FILE or built-in defaults)
+  ingress_rules = $(firewall_rules_tf ingress)
+  egress_rules  = $(firewall_rules_tf egress)
+
+  # Host hardening (HARDENING_PROFILE; per instance from $HARDENING_FILE) and the sshd port.
+  # The strict profile's host firewall mirrors the ingress rules above.
+  hardening_profile   = "$(hardening_profile)"
+  hardening_profiles  = $(hardening_profiles_tf)
+  host_firewall_rules = $(host_firewall_rules_tf)
+  ssh_port            = $(ssh_port)
+  ssh_port_flag       = "$([ "$(ssh_port)" = "22" ] || echo "-p $(ssh_port) ")"
+  
+  # Per-instance labels (from $INSTANCE_LABELS_FILE), merged into freeform tags
+  instance_labels = $(instance_labels_tf)
+
+  # Declared power state (from $POWER_STATE_FILE, updated by stop/start)
+  instance_power_states = $(power_states_tf)
+
+  # user_data of renamed instances as launched (from $PINNED_USER_DATA_FILE, written by rename)
+  pinned_user_data = fileexists("\${path.module}/$PINNED_USER_DATA_FILE") ? jsondecode(file("\${path.module}/$PINNED_USER_DATA_FILE")) : {}
+
+  # Extra login accounts and their keys (SSH_AUTHORIZED_USERS and $USERS_FILE; published keys cached in $SSH_AUTHORIZED_USERS_CACHE)
+  ssh_authorized_users = $(ssh_authorized_users_tf)
+
+  # Instances using a reserved public IP (RESERVED_PUBLIC_IPS)
+  reserved_ip_hostnames = $(reserved_ip_hostnames_tf)
+
+  # Dynamic DNS (DDNS_PROVIDER, DDNS_DOMAIN_TEMPLATE); the token comes from var.ddns_token
+  ddns_provider = "$DDNS_PROVIDER"
+  ddns_domains  = $(ddns_domains_tf)
+
+  # Application data backups (from $BACKUP_SPEC_FILE), see backups.tf
+  backup_plans     = $(backup_plans_tf)
+
+  # Provisioner modules: for every instance (PROVISION) and per instance (from $PROVISIONERS_FILE)
+  provision    = "$PROVISION"
+  provisioners = $(provisioners_tf)
+
+  # Reverse proxy sites (from $SITES_FILE)
+  sites = $(sites_tf)
+
+  # Secrets fetched from the vault at boot (from $SECRETS_FILE), see secrets.tf
+  secrets            = $(secrets_tf)
+  secrets_vault_name = "$SECRETS_VAULT_NAME"
+
+  # Defined tags admitting instances to the backup and secrets dynamic groups (bootstrap-iam)
+  instance_access_tags = $(instance_access_tags_tf)
+
+  backup_bucket    = "$BACKUP_BUCKET"
+  backup_retention = "$BACKUP_RETENTION"
+  backup_rclone    = $(rclone_release_tf)
+
+  # Scheduled volume backups (VOLUME_BACKUP_POLICY), see volume_backups.tf
+  volume_backup_policy    = "$VOLUME_BACKUP_POLICY"
+  volume_backup_volumes   = "$VOLUME_BACKUP_VOLUMES"
+  volume_backup_schedules = $(volume_backup_schedules_tf)
+  volume_group_hosts      = $(volume_group_hosts | jq -Rn -c '[inputs | select(length > 0)]')
+
+  # Cost alerts (BUDGET_ALERT_EMAIL, BUDGET_AMOUNT, BUDGET_ALERT_THRESHOLD), see budget.tf
+  budget_alert_email     = "$(budget_alert_email)"
+  budget_amount          = $BUDGET_AMOUNT
+  budget_alert_threshold = $BUDGET_ALERT_THRESHOLD
+
+  # Always Free Autonomous Databases (AUTONOMOUS_DATABASES), see autonomous_databases.tf
+  autonomous_databases = $(autonomous_databases_tf)
+
+  # Network CIDRs (VCN_CIDRS, PUBLIC_SUBNET_CIDR, PRIVATE_SUBNET_CIDR)
+  vcn_cidrs           = $(echo "${VCN_CIDRS:-10.0.0.0/16}" | tr ',' '\n' | jq -R 'select(length > 0)' | jq -sc .)
+  public_subnet_cidr  = "${PUBLIC_SUBNET_CIDR:-10.0.1.0/24}"
+  private_subnet_cidr = "${PRIVATE_SUBNET_CIDR:-10.0.2.0/24}"
+
+  # Other existing VCNs, adopted as they are (their subnets and gateways stay unmanaged)
+  adopted_vcns = $(adopted_vcns_tf)
+
+  # Additional subnets and the instances placed in them (SUBNETS_FILE)
+  subnets          = $(subnets_tf)
+  instance_subnets = $(instance_subnets_tf)
+
+  # Network topology (NETWORK_TOPOLOGY): private instances sit behind a NAT gateway
+  # and are reached through the bastion
+  network_topology  = "$NETWORK_TOPOLOGY"
+  bastion_hostname  = "$(bastion_hostname)"
+  private_hostnames = $(private_hostnames_tf)
+  service_gateway   = $([ "$SERVICE_GATEWAY" = "true" ] && [ "$NETWORK_TOPOLOGY" = "two-tier" ] && echo true || echo false)
+
+  # Tag-scoped management (MANAGED_TAG), applied to every resource
+  managed_tags = $(managed_tags_tf)
+  
+  # Storage calculations
+  total_amd_storage = local.amd_micro_instance_count * local.amd_micro_boot_volume_size_gb
+  total_arm_storage = local.arm_flex_instance_count > 0 ? sum(local.arm_flex_boot_volume_size_gb) : 0
+  total_block_storage = sum(concat([0], [for v in values(local.block_volumes) : v.size_gb]))
+  total_storage = local.total_amd_storage + local.total_arm_storage + local.total_block_storage
+}
+
+# Dynamic DNS token (set DDNS_TOKEN or TF_VAR_ddns_token; never stored in these files)
+variable "ddns_token" {
+  description = "Token/password for the dynamic DNS provider"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+# Tailscale auth key for the tailscale module (set TAILSCALE_AUTH_KEY or TF_VAR_tailscale_auth_key)
+variable "tailscale_auth_key" {
+  description = "Auth key instances with the tailscale provisioner module join the tailnet with"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+# ADMIN password of the Autonomous Databases (generated into $ADB_ADMIN_PASSWORD_FILE)
+variable "adb_admin_password" {
+  description = "ADMIN password for the Always Free Autonomous Databases"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+# Free Tier Limits
+variable "free_tier_max_storage_gb" {
+  description = "Maximum storage for Oracle Free Tier"
+  type        = number
+  default     = $FREE_TIER_MAX_STORAGE_GB
+}
+
+variable "free_tier_max_arm_ocpus" {
+  description = "Maximum ARM OCPUs for Oracle Free Tier"
+  type        = number
+  default     = $FREE_TIER_MAX_ARM_OCPUS
+}
+
+variable "free_tier_max_arm_memory_gb" {
+  description = "Maximum ARM memory for Oracle Free Tier"
+  type        = number
+  default     = $FREE_TIER_MAX_ARM_MEMORY_GB
+}
+
+# Validation checks
+check "storage_limit" {
+  assert {
+    condition     = local.total_storage <= var.free_tier_max_storage_gb
+    error_message = "Total storage (\${local.total_storage}GB) exceeds Free Tier limit (\${var.free_tier_max_storage_gb}GB)"
+  }
+}
+
+check "arm_ocpu_limit" {
+  assert {
+    condition     = local.arm_flex_instance_count == 0 || sum(local.arm_flex_ocpus_per_instance) <= var.free_tier_max_arm_ocpus
+    error_message = "Total ARM OCPUs exceed Free Tier limit (\${var.free_tier_max_arm_ocpus})"
+  }
+}
+
+check "arm_memory_limit" {
+  assert {
+    condition     = local.arm_flex_instance_count == 0 || sum(local.arm_flex_memory_per_instance) <= var.free_tier_max_arm_memory_gb
+    error_message = "Total ARM memory exceeds Free Tier limit (\${var.free_tier_max_arm_memory_gb}GB)"
+  }
+}
+EOF
+    
+    print_success "variables.tf created"
+}
+
+create_terraform_datasources() {
+    print_status "Creating data_sources.tf..."
+    
+    write_generated_file data_sources.tf << 'EOF'
+# OCI Data Sources
+# Fetches dynamic information from Oracle Cloud
+
+# Availability Domains
+data "oci_identity_availability_domains" "ads" {
+  compartment_id = local.tenancy_ocid
+}
+
+# Tenancy Information
+data "oci_identity_tenancy" "tenancy" {
+  tenancy_id = local.tenancy_ocid
+}
+
+# Available Regions
+data "oci_identity_regions" "regions" {}
+
+# Region Subscriptions
+data "oci_identity_region_subscriptions" "subscriptions" {
+  tenancy_id = local.tenancy_ocid
+}
+EOF
+    
+    print_success "data_sources.tf created"
+}
+
+# Resource types PREVENT_DESTROY protects (a boot volume is part of its instance)
+readonly PREVENT_DESTROY_TYPES="oci_core_instance oci_core_volume"
+
+# Attributes adopted resources ignore, per resource type ("*": any other type). Imported
+# instances were launched with other user_data, SSH keys, images, names and VNIC settings;
+# everything else adopted usually differs only in names, DNS labels and tags.
+readonly ADOPT_IGNORE_DEFAULTS="oci_core_instance=metadata,extended_metadata,source_details,create_vnic_details,display_name,freeform_tags,defined_tags;\
+oci_core_vcn=display_name,dns_label,freeform_tags,defined_tags;\
+oci_core_subnet=display_name,dns_label,freeform_tags,defined_tags;\
+*=display_name,freeform_tags,defined_tags"
+
+# Attributes the adopted resource block BLOCK ignores, comma-separated: the most specific
+# ADOPT_IGNORE_CHANGES entry (address, then type), else the default for its type
+adopt_ignore_list() {
+    local block="$1" key
+    for key in "$block" "${block%%.*}" "*"; do
+        if [[ ";$ADOPT_IGNORE_CHANGES;$ADOPT_IGNORE_DEFAULTS;" =~ \;[[:space:]]*"$key"=([^\;]*)\; ]]; then
+            echo "${BASH_REMATCH[1]// /}"
+            return 0
+        fi
+    done
+}
+
+# "block=attr,attr;..." for the adopted resource blocks with something to ignore
+adopted_ignore_spec() {
+    local block list
+    [ "$ADOPT_IGNORE_CHANGES" != "off" ] || return 0
+    for block in $ADOPTED_BLOCKS; do
+        list=$(adopt_ignore_list "$block")
+        [ -z "$list" ] || printf '%s=%s;' "$block" "$list"
+    done
+}
+
+# Generated Terraform on stdin with its lifecycle settings: prevent_destroy in the protected
+# resources when PREVENT_DESTROY is on, and the ignored attributes of adopted resources
+# merged into their ignore_changes
+resource_lifecycle() {
+    local spec
+    spec=$(adopted_ignore_spec)
+    if [ "$PREVENT_DESTROY" != "true" ] && [ -z "$spec" ]; then
+        cat
+        return 0
+    fi
+    awk -v protect_on="$PREVENT_DESTROY" -v types=" $PREVENT_DESTROY_TYPES " -v spec="$spec" -v file="$ADOPTED_FILE" '
+        BEGIN {
+            n = split(spec, entries, ";")
+            for (i = 1; i <= n; i++) if (split(entries[i], kv, "=") == 2) adopted[kv[1]] = kv[2]
+        }
+        # The adopted attributes not listed yet, after a comment saying where they come from
+        function ignore_items(    items, m, i, note) {
+            m = split(extra, items, ",")
+            for (i = 1; i <= m; i++) {
+                if (items[i] in seen) continue
+                if (!note++) print "      # Imported resource, kept as it is (" file ", ADOPT_IGNORE_CHANGES)"
+                print "      " items[i] ","
+            }
+        }
+        /^resource "/ {
+            split($0, f, "\"")
+            protect = protect_on == "true" && index(types, " " f[2] " ") > 0
+            extra = (f[2] "." f[4]) in adopted ? adopted[f[2] "." f[4]] : ""
+            in_block = 1; has_lifecycle = 0; has_ignore = 0; split("", seen)
+        }
+        in_block && /^  lifecycle \{/ {
+            print
+            if (protect) { print "    prevent_destroy = true"; print "" }
+            in_lifecycle = 1; has_lifecycle = 1
+            next
+        }
+        in_lifecycle && extra != "" && /^    ignore_changes = \[.*\]/ {
+            items = $0
+            sub(/^[^[]*\[/, "", items); sub(/\].*/, "", items)
+            print "    ignore_changes = ["
+            m = split(items, list, ",")
+            for (i = 1; i <= m; i++) {
+                gsub(/ /, "", list[i])
+                if (list[i] != "") { print "      " list[i] ","; seen[list[i]] = 1 }
+            }
+            ignore_items()
+            print "    ]"
+            has_ignore = 1
+            next
+        }
+        in_lifecycle && extra != "" && /^    ignore_changes = \[$/ { in_ignore = 1; print; next }
+        in_ignore && /^    \]/ { ignore_items(); in_ignore = 0; has_ignore = 1; print; next }
+        in_ignore {
+            item = $0
+            sub(/#.*/, "", item); gsub(/[ ,]/, "", item)
+            if (item != "") seen[item] = 1
+            print
+            next
+        }
+        in_lifecycle && /^  \}/ {
+            if (extra != "" && !has_ignore) { print "    ignore_changes = ["; ignore_items(); print "    ]" }
+            in_lifecycle = 0
+            print
+            next
+        }
+        in_block && /^\}/ {
+            if (!has_lifecycle && (protect || extra != "")) {
+                print ""
+                print "  lifecycle {"
+                if (protect) print "    prevent_destroy = true"
+                if (protect && extra != "") print ""
+                if (extra != "") { print "    ignore_changes = ["; ignore_items(); print "    ]" }
+                print "  }"
+            }
+            in_block = 0
+        }
+        { print }'
+}
+
+# After a failed plan (LOG: its output): explain a refusal caused by PREVENT_DESTROY
+prevent_destroy_hint() {
+    grep -q 'lifecycle.prevent_destroy' "$1" 2>/dev/null || return 0
+    print_status "Instances and block volumes are protected from destruction (PREVENT_DESTROY)."
+    print_status "To replace them on purpose, regenerate without it first: $0 --no-prevent-destroy --emit-only"
+}
+
+create_terraform_main() {
+    print_status "Creating main.tf..."
+    
+    resource_lifecycle << 'EOFMAIN' | write_generated_file main.tf
+# Oracle Cloud Infrastructure - Main Configuration
+# Always Free Tier Optimized
+
+# ============================================================================
+# NETWORKING
+# ============================================================================
+
+resource "oci_core_vcn" "main" {
+  compartment_id = local.compartment_id
+  cidr_blocks    = local.vcn_cidrs
+  display_name   = "main-vcn"
+  dns_label      = "mainvcn"
+  is_ipv6enabled = true
+  
+  freeform_tags = merge({
+    "Purpose" = "AlwaysFreeTier"
+    "Managed" = "Terraform"
+  }, local.managed_tags)
+}
+
+# Other VCNs that already existed (Always Free allows two), adopted as they are so they
+# are tracked in state; their subnets and gateways are not managed
+resource "oci_core_vcn" "adopted" {
+  for_each = local.adopted_vcns
+
+  compartment_id = local.compartment_id
+  cidr_blocks    = [each.value.cidr]
+  display_name   = each.key
+  freeform_tags  = local.managed_tags
+}
+
+resource "oci_core_internet_gateway" "main" {
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  display_name   = "main-igw"
+  enabled        = true
+  freeform_tags  = local.managed_tags
+}
+
+resource "oci_core_default_route_table" "main" {
+  manage_default_resource_id = oci_core_vcn.main.default_route_table_id
+  display_name               = "main-rt"
+  freeform_tags              = local.managed_tags
+  
+  route_rules {
+    destination       = "0.0.0.0/0"
+    destination_type  = "CIDR_BLOCK"
+    network_entity_id = oci_core_internet_gateway.main.id
+  }
+  
+  route_rules {
+    destination       = "::/0"
+    destination_type  = "CIDR_BLOCK"
+    network_entity_id = oci_core_internet_gateway.main.id
+  }
+}
+
+resource "oci_core_default_security_list" "main" {
+  manage_default_resource_id = oci_core_vcn.main.default_security_list_id
+  display_name               = "main-sl"
+  freeform_tags              = local.managed_tags
+  
+  # Rules come from local.ingress_rules / local.egress_rules (see FIREWALL_RULES_FILE)
+  dynamic "egress_security_rules" {
+    for_each = local.egress_rules
+    content {
+      protocol    = egress_security_rules.value.protocol
+      destination = egress_security_rules.value.cidr
+      description = egress_security_rules.value.description
+
+      dynamic "tcp_options" {
+        for_each = egress_security_rules.value.protocol == "6" && egress_security_rules.value.min != null ? [1] : []
+        content {
+          min = egress_security_rules.value.min
+          max = egress_security_rules.value.max
+        }
+      }
+      dynamic "udp_options" {
+        for_each = egress_security_rules.value.protocol == "17" && egress_security_rules.value.min != null ? [1] : []
+        content {
+          min = egress_security_rules.value.min
+          max = egress_security_rules.value.max
+        }
+      }
+      dynamic "icmp_options" {
+        for_each = egress_security_rules.value.icmp_type != null ? [1] : []
+        content {
+          type = egress_security_rules.value.icmp_type
+        }
+      }
+    }
+  }
+  
+  dynamic "ingress_security_rules" {
+    for_each = local.ingress_rules
+    content {
+      protocol    = ingress_security_rules.value.protocol
+      source      = ingress_security_rules.value.cidr
+      description = ingress_security_rules.value.description
+
+      dynamic "tcp_options" {
+        for_each = ingress_security_rules.value.protocol == "6" && ingress_security_rules.value.min != null ? [1] : []
+        content {
+          min = ingress_security_rules.value.min
+          max = ingress_security_rules.value.max
+        }
+      }
+      dynamic "udp_options" {
+        for_each = ingress_security_rules.value.protocol == "17" && ingress_security_rules.value.min != null ? [1] : []
+        content {
+          min = ingress_security_rules.value.min
+          max = ingress_security_rules.value.max
+        }
+      }
+      dynamic "icmp_options" {
+        for_each = ingress_security_rules.value.icmp_type != null ? [1] : []
+        content {
+          type = ingress_security_rules.value.icmp_type
+        }
+      }
+    }
+  }
+}
+
+resource "oci_core_subnet" "main" {
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  cidr_block     = local.public_subnet_cidr
+  display_name   = "main-subnet"
+  dns_label      = "mainsubnet"
+  
+  route_table_id    = oci_core_default_route_table.main.id
+  security_list_ids = [oci_core_default_security_list.main.id]
+  
+  # IPv6 - use first /64 block from VCN's /56
+  ipv6cidr_blocks = [cidrsubnet(oci_core_vcn.main.ipv6cidr_blocks[0], 8, 0)]
+
+  freeform_tags = local.managed_tags
+}
+
+# ============================================================================
+# PRIVATE SUBNET (NETWORK_TOPOLOGY = two-tier): outbound-only via NAT gateway
+# ============================================================================
+
+resource "oci_core_nat_gateway" "main" {
+  count          = local.network_topology == "two-tier" ? 1 : 0
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  display_name   = "main-natgw"
+  freeform_tags  = local.managed_tags
+}
+
+# Service gateway (SERVICE_GATEWAY): Object Storage and other OCI services over the
+# Oracle Services Network instead of the NAT gateway
+data "oci_core_services" "all" {
+  filter {
+    name   = "name"
+    values = ["All .* Services In Oracle Services Network"]
+    regex  = true
+  }
+}
+
+resource "oci_core_service_gateway" "main" {
+  count          = local.service_gateway ? 1 : 0
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  display_name   = "main-sgw"
+  freeform_tags  = local.managed_tags
+
+  services {
+    service_id = data.oci_core_services.all.services[0].id
+  }
+}
+
+resource "oci_core_route_table" "private" {
+  count          = local.network_topology == "two-tier" ? 1 : 0
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  display_name   = "private-rt"
+  freeform_tags  = local.managed_tags
+
+  route_rules {
+    destination       = "0.0.0.0/0"
+    destination_type  = "CIDR_BLOCK"
+    network_entity_id = oci_core_nat_gateway.main[0].id
+  }
+
+  dynamic "route_rules" {
+    for_each = oci_core_service_gateway.main
+    content {
+      destination       = data.oci_core_services.all.services[0].cidr_block
+      destination_type  = "SERVICE_CIDR_BLOCK"
+      network_entity_id = route_rules.value.id
+    }
+  }
+}
+
+resource "oci_core_security_list" "private" {
+  count          = local.network_topology == "two-tier" ? 1 : 0
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  display_name   = "private-sl"
+  freeform_tags  = local.managed_tags
+
+  # Only traffic from inside the VCN (the bastion and other instances)
+  dynamic "ingress_security_rules" {
+    for_each = oci_core_vcn.main.cidr_blocks
+    content {
+      protocol    = "all"
+      source      = ingress_security_rules.value
+      description = "Intra-VCN"
+    }
+  }
+
+  egress_security_rules {
+    protocol    = "all"
+    destination = "0.0.0.0/0"
+    description = "Outbound via NAT gateway"
+  }
+}
+
+resource "oci_core_subnet" "private" {
+  count          = local.network_topology == "two-tier" ? 1 : 0
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  cidr_block     = local.private_subnet_cidr
+  display_name   = "private-subnet"
+  dns_label      = "privsubnet"
+
+  prohibit_public_ip_on_vnic = true
+  route_table_id             = oci_core_route_table.private[0].id
+  security_list_ids          = [oci_core_security_list.private[0].id]
+
+  ipv6cidr_blocks = [cidrsubnet(oci_core_vcn.main.ipv6cidr_blocks[0], 8, 1)]
+
+  freeform_tags = local.managed_tags
+}
+
+locals {
+  private_subnet_id        = try(oci_core_subnet.private[0].id, null)
+  private_route_table_id   = try(oci_core_route_table.private[0].id, null)
+  private_security_list_id = try(oci_core_security_list.private[0].id, null)
+}
+
+# ============================================================================
+# ADDITIONAL SUBNETS (SUBNETS_FILE)
+# ============================================================================
+
+# Public subnets share the main subnet's route table and security list; private ones
+# those of the private subnet (NAT gateway, intra-VCN ingress only)
+resource "oci_core_subnet" "extra" {
+  for_each       = local.subnets
+  compartment_id = local.compartment_id
+  vcn_id         = oci_core_vcn.main.id
+  cidr_block     = each.value.cidr
+  display_name   = each.key
+  dns_label      = each.value.dns_label
+
+  prohibit_public_ip_on_vnic = !each.value.public
+  route_table_id             = each.value.public ? oci_core_default_route_table.main.id : local.private_route_table_id
+  security_list_ids          = [each.value.public ? oci_core_default_security_list.main.id : local.private_security_list_id]
+
+  ipv6cidr_blocks = [cidrsubnet(oci_core_vcn.main.ipv6cidr_blocks[0], 8, each.value.ipv6_index)]
+
+  freeform_tags = local.managed_tags
+}
+
+locals {
+  # Subnet of every instance: its SUBNETS_FILE subnet, else the private or main subnet
+  instance_subnet_ids = { for h in concat(local.amd_micro_hostnames, local.arm_flex_hostnames) :
+    h => try(oci_core_subnet.extra[local.instance_subnets[h]].id,
+    contains(local.private_hostnames, h) ? local.private_subnet_id : oci_core_subnet.main.id)
+  }
+}
+
+# ============================================================================
+# COMPUTE INSTANCES
+# ============================================================================
+
+# AMD x86 Micro Instances
+resource "oci_core_instance" "amd" {
+  # Keyed by hostname, so removing an instance leaves the others where they are
+  for_each = { for i, h in local.amd_micro_hostnames : h => i if i < local.amd_micro_instance_count }
+  
+  availability_domain = data.oci_identity_availability_domains.ads.availability_domains[0].name
+  compartment_id      = local.compartment_id
+  display_name        = each.key
+  state               = lookup(local.instance_power_states, each.key, "RUNNING")
+  shape               = "VM.Standard.E2.1.Micro"
+  
+  create_vnic_details {
+    subnet_id        = local.instance_subnet_ids[each.key]
+    display_name     = "${each.key}-vnic"
+    assign_public_ip = !contains(local.reserved_ip_hostnames, each.key) && !contains(local.private_hostnames, each.key)
+    assign_ipv6ip    = true
+    hostname_label   = each.key
+  }
+  
+  source_details {
+    source_type             = "image"
+    source_id               = local.ubuntu_x86_image_ocid
+    boot_volume_size_in_gbs = local.amd_micro_boot_volume_size_gb
+  }
+  
+  metadata = {
+    ssh_authorized_keys = local.ssh_pubkey_data
+    # Renamed instances keep their launch user_data (a change would replace them)
+    user_data = lookup(local.pinned_user_data, each.key, base64encode(templatefile("${path.module}/cloud-init.yaml", {
+      hostname      = each.key
+      os            = local.os_settings
+      users         = local.ssh_authorized_users
+      ddns_provider = local.ddns_provider
+      ddns_domain   = lookup(local.ddns_domains, each.key, "")
+      ddns_token    = var.ddns_token
+      backup        = merge(local.backup_settings, try(local.backup_plans[each.key], { schedule = "", paths = "" }))
+      vars          = local.cloud_init_vars
+      modules       = try(local.provisioners[each.key], [])
+      sites         = try(local.sites[each.key], [])
+      secrets       = { vault = local.secrets_vault_id, region = local.region, items = try(local.secrets[each.key], []) }
+      hardening     = { profile = lookup(local.hardening_profiles, each.key, local.hardening_profile), ssh_port = local.ssh_port, firewall = local.host_firewall_rules }
+      tailscale_key = var.tailscale_auth_key
+    })))
+  }
+  
+  # Marketplace images can only be launched once subscribed
+  depends_on = [oci_core_app_catalog_subscription.image]
+
+  freeform_tags = merge({
+    "Purpose"      = "AlwaysFreeTier"
+    "InstanceType" = "AMD-Micro"
+    "Managed"      = "Terraform"
+  }, lookup(local.instance_labels, each.key, {}), local.managed_tags)
+
+  # Backup and secrets access through the dynamic groups of bootstrap-iam
+  defined_tags = lookup(local.instance_access_tags, each.key, {})
+  
+  lifecycle {
+    ignore_changes = [
+      source_details[0].source_id,  # Ignore image updates
+      # Tags OCI adds itself
+      defined_tags["Oracle-Tags.CreatedBy"],
+      defined_tags["Oracle-Tags.CreatedOn"],
+    ]
+  }
+}
+
+# ARM A1 Flex Instances
+resource "oci_core_instance" "arm" {
+  for_each = { for i, h in local.arm_flex_hostnames : h => i if i < local.arm_flex_instance_count }
+  
+  availability_domain = data.oci_identity_availability_domains.ads.availability_domains[0].name
+  compartment_id      = local.compartment_id
+  display_name        = each.key
+  state               = lookup(local.instance_power_states, each.key, "RUNNING")
+  shape               = "VM.Standard.A1.Flex"
+
+  # Launch into reserved capacity (CAPACITY_RESERVATION), see capacity_reservation.tf
+  capacity_reservation_id = local.arm_capacity_reservation_id
+  
+  shape_config {
+    ocpus         = local.arm_flex_ocpus_per_instance[each.value]
+    memory_in_gbs = local.arm_flex_memory_per_instance[each.value]
+  }
+  
+  create_vnic_details {
+    subnet_id        = local.instance_subnet_ids[each.key]
+    display_name     = "${each.key}-vnic"
+    assign_public_ip = !contains(local.reserved_ip_hostnames, each.key) && !contains(local.private_hostnames, each.key)
+    assign_ipv6ip    = true
+    hostname_label   = each.key
+  }
+  
+  source_details {
+    source_type             = "image"
+    source_id               = local.ubuntu_arm_image_ocid
+    boot_volume_size_in_gbs = local.arm_flex_boot_volume_size_gb[each.value]
+  }
+  
+  metadata = {
+    ssh_authorized_keys = local.ssh_pubkey_data
+    # Renamed instances keep their launch user_data (a change would replace them)
+    user_data = lookup(local.pinned_user_data, each.key, base64encode(templatefile("${path.module}/cloud-init.yaml", {
+      hostname      = each.key
+      os            = local.os_settings
+      users         = local.ssh_authorized_users
+      ddns_provider = local.ddns_provider
+      ddns_domain   = lookup(local.ddns_domains, each.key, "")
+      ddns_token    = var.ddns_token
+      backup        = merge(local.backup_settings, try(local.backup_plans[each.key], { schedule = "", paths = "" }))
+      vars          = local.cloud_init_vars
+      modules       = try(local.provisioners[each.key], [])
+      sites         = try(local.sites[each.key], [])
+      secrets       = { vault = local.secrets_vault_id, region = local.region, items = try(local.secrets[each.key], []) }
+      hardening     = { profile = lookup(local.hardening_profiles, each.key, local.hardening_profile), ssh_port = local.ssh_port, firewall = local.host_firewall_rules }
+      tailscale_key = var.tailscale_auth_key
+    })))
+  }
+  
+  # Marketplace images can only be launched once subscribed
+  depends_on = [oci_core_app_catalog_subscription.image]
+
+  freeform_tags = merge({
+    "Purpose"      = "AlwaysFreeTier"
+    "InstanceType" = "ARM-A1-Flex"
+    "Managed"      = "Terraform"
+  }, lookup(local.instance_labels, each.key, {}), local.managed_tags)
+
+  # Backup and secrets access through the dynamic groups of bootstrap-iam
+  defined_tags = lookup(local.instance_access_tags, each.key, {})
+  
+  lifecycle {
+    ignore_changes = [
+      source_details[0].source_id,
+      defined_tags["Oracle-Tags.CreatedBy"],
+      defined_tags["Oracle-Tags.CreatedOn"],
+    ]
+  }
+}
+
+# ============================================================================
+# PER-INSTANCE IPv6: Reserve an IPv6 for each instance VNIC
+# Docs: "Creates an IPv6 for the specified VNIC." and "lifetime: Ephemeral | Reserved" (OCI Terraform provider)
+# ============================================================================
+
+data "oci_core_vnic_attachments" "amd_vnics" {
+  for_each       = oci_core_instance.amd
+  compartment_id = local.compartment_id
+  instance_id    = each.value.id
+}
+
+resource "oci_core_ipv6" "amd_ipv6" {
+  for_each = oci_core_instance.amd
+  vnic_id = data.oci_core_vnic_attachments.amd_vnics[each.key].vnic_attachments[0].vnic_id
+  lifetime = "RESERVED"
+  subnet_id = local.instance_subnet_ids[each.key]
+  route_table_id = contains(local.private_hostnames, each.key) ? local.private_route_table_id : oci_core_default_route_table.main.id
+  display_name = "amd-${each.key}-ipv6"
+  freeform_tags = merge({
+    "Purpose" = "AlwaysFreeTier"
+    "Managed" = "Terraform"
+  }, local.managed_tags)
+}
+
+data "oci_core_vnic_attachments" "arm_vnics" {
+  for_each       = oci_core_instance.arm
+  compartment_id = local.compartment_id
+  instance_id    = each.value.id
+}
+
+resource "oci_core_ipv6" "arm_ipv6" {
+  for_each = oci_core_instance.arm
+  vnic_id = data.oci_core_vnic_attachments.arm_vnics[each.key].vnic_attachments[0].vnic_id
+  lifetime = "RESERVED"
+  subnet_id = local.instance_subnet_ids[each.key]
+  route_table_id = contains(local.private_hostnames, each.key) ? local.private_route_table_id : oci_core_default_route_table.main.id
+  display_name = "arm-${each.key}-ipv6"
+  freeform_tags = merge({
+    "Purpose" = "AlwaysFreeTier"
+    "Managed" = "Terraform"
+  }, local.managed_tags)
+}
+
+# ============================================================================
+# RESERVED PUBLIC IPs: static addresses that survive instance rebuilds
+# ============================================================================
+
+data "oci_core_private_ips" "amd_primary" {
+  for_each = { for i, h in local.amd_micro_hostnames : h => i if i < local.amd_micro_instance_count && contains(local.reserved_ip_hostnames, h) }
+  vnic_id  = data.oci_core_vnic_attachments.amd_vnics[each.key].vnic_attachments[0].vnic_id
+}
+
+resource "oci_core_public_ip" "amd_reserved" {
+  for_each       = data.oci_core_private_ips.amd_primary
+  compartment_id = local.compartment_id
+  lifetime       = "RESERVED"
+  display_name   = "${each.key}-public-ip"
+  private_ip_id  = [for ip in each.value.private_ips : ip.id if ip.is_primary][0]
+  freeform_tags = merge({
+    "Purpose" = "AlwaysFreeTier"
+    "Managed" = "Terraform"
+  }, local.managed_tags)
+}
+
+data "oci_core_private_ips" "arm_primary" {
+  for_each = { for i, h in local.arm_flex_hostnames : h => i if i < local.arm_flex_instance_count && contains(local.reserved_ip_hostnames, h) }
+  vnic_id  = data.oci_core_vnic_attachments.arm_vnics[each.key].vnic_attachments[0].vnic_id
+}
+
+resource "oci_core_public_ip" "arm_reserved" {
+  for_each       = data.oci_core_private_ips.arm_primary
+  compartment_id = local.compartment_id
+  lifetime       = "RESERVED"
+  display_name   = "${each.key}-public-ip"
+  private_ip_id  = [for ip in each.value.private_ips : ip.id if ip.is_primary][0]
+  freeform_tags = merge({
+    "Purpose" = "AlwaysFreeTier"
+    "Managed" = "Terraform"
+  }, local.managed_tags)
+}
+
+locals {
+  amd_public_ips = [for i in range(local.amd_micro_instance_count) :
+    try(oci_core_public_ip.amd_reserved[local.amd_micro_hostnames[i]].ip_address, oci_core_instance.amd[local.amd_micro_hostnames[i]].public_ip)]
+  arm_public_ips = [for i in range(local.arm_flex_instance_count) :
+    try(oci_core_public_ip.arm_reserved[local.arm_flex_hostnames[i]].ip_address, oci_core_instance.arm[local.arm_flex_hostnames[i]].public_ip)]
+
+  # Dynamic DNS names as resolvable FQDNs (DuckDNS takes the bare subdomain)
+  ddns_fqdns = { for h, d in local.ddns_domains : h => local.ddns_provider == "duckdns" ? "${d}.duckdns.org" : d }
+
+  # Public address of the two-tier jump host (null for the flat topology)
+  bastion_public_ip = lookup(merge(
+    zipmap(slice(local.amd_micro_hostnames, 0, local.amd_micro_instance_count), local.amd_public_ips),
+    zipmap(slice(local.arm_flex_hostnames, 0, local.arm_flex_instance_count), local.arm_public_ips)
+  ), local.bastion_hostname, null)
+}
+EOFMAIN
+    
+    print_success "main.tf created"
+}
+
+create_terraform_block_volumes() {
+    print_status "Creating block_volumes.tf..."
+    
+    resource_lifecycle << 'EOF' | write_generated_file block_volumes.tf
+# Block Volume Resources (Optional)
+# Block volumes provide additional storage beyond boot volumes. Each instance can have
+# several (local.block_volumes, from AMD_BLOCK_VOLUMES/ARM_BLOCK_VOLUMES or the prompts).
+
+resource "oci_core_volume" "block" {
+  for_each = local.block_volumes
+
+  compartment_id      = local.compartment_id
+  availability_domain = each.value.kind == "amd" ? oci_core_instance.amd[each.value.host].availability_domain : oci_core_instance.arm[each.value.host].availability_domain
+  display_name        = each.key
+  size_in_gbs         = each.value.size_gb
+
+  freeform_tags = merge({
+    "Purpose" = "AlwaysFreeTier"
+    "Type"    = "BlockVolume"
+    "Managed" = "Terraform"
+  }, local.managed_tags)
+}
+
+resource "oci_core_volume_attachment" "block" {
+  for_each = local.block_volumes
+
+  attachment_type = "paravirtualized"
+  instance_id     = each.value.kind == "amd" ? oci_core_instance.amd[each.value.host].id : oci_core_instance.arm[each.value.host].id
+  volume_id       = oci_core_volume.block[each.key].id
+}
+EOF
+
+    print_success "block_volumes.tf created"
+}
+
+create_terraform_renames() {
+    print_status "Creating renames.tf..."
+
+    {
+        cat << 'EOF'
+# Hostname renames (from RENAMES_FILE, maintained by the rename command)
+# Resources keyed by hostname move to the new name instead of being replaced; instances
+# then only get a new display name and hostname label.
+EOF
+        if [ -f "$RENAMES_FILE" ]; then
+            sed 's/#.*//' "$RENAMES_FILE" | while read -r old new _; do
+                [ -n "$new" ] && renamed_moved_blocks "$old" "$new"
+            done
+        fi
+    } | write_generated_file renames.tf
+
+    print_success "renames.tf created"
+}
+
+# moved blocks for the resources keyed by hostname (instances, their IPv6 addresses, reserved
+# IPs, volume groups) or by volume name ("<hostname>-boot", "<hostname>-block", ...)
+renamed_moved_blocks() {
+    local old="$1" new="$2" address n blocks suffix
+    blocks=$(block_volumes_tf | jq -r --arg h "$new" '[.[] | select(.host == $h)] | length')
+    for address in oci_core_instance.amd oci_core_instance.arm oci_core_ipv6.amd_ipv6 oci_core_ipv6.arm_ipv6 \
+        oci_core_public_ip.amd_reserved oci_core_public_ip.arm_reserved \
+        oci_core_volume_group.instance oci_core_volume_backup_policy_assignment.groups; do
+        address=$(tf_address "$address")
+        printf '\nmoved {\n  from = %s["%s"]\n  to   = %s["%s"]\n}\n' "$address" "$old" "$address" "$new"
+    done
+    address=$(tf_address oci_core_volume_backup_policy_assignment.volumes)
+    printf '\nmoved {\n  from = %s["%s"]\n  to   = %s["%s"]\n}\n' "$address" "$old-boot" "$address" "$new-boot"
+    for ((n = 1; n <= blocks; n++)); do
+        suffix="-block"
+        [ "$n" -eq 1 ] || suffix="-block-$n"
+        for address in oci_core_volume.block oci_core_volume_attachment.block oci_core_volume_backup_policy_assignment.volumes; do
+            address=$(tf_address "$address")
+            printf '\nmoved {\n  from = %s["%s"]\n  to   = %s["%s"]\n}\n' "$address" "$old$suffix" "$address" "$new$suffix"
+        done
+    done
+}
+
+# The workspace's Terraform state as JSON (empty without one); fails when there is a state
+# that cannot be read (backend not initialised, encrypted)
+workspace_state() {
+    if [ -d .terraform ] && terraform_available; then
+        terraform state pull 2>/dev/null || return 1
+    elif [ -f terraform.tfstate ]; then
+        cat terraform.tfstate
+    fi
+}
+
+# Resources of STATE indexed by position, as
+# "<module prefix>|<type.name>|<index>|<display name>|<id>" lines
+state_indexed_resources() {
+    [ -n "$1" ] || return 0
+    jq -r '.resources[]? | select(.mode == "managed")
+        | (if .module then .module + "." else "" end) as $m | (.type + "." + .name) as $a
+        | .instances[]? | select(.index_key | type == "number")
+        | [$m, $a, .index_key, (.attributes.display_name // ""), (.attributes.id // "")] | map(tostring) | join("|")' <<< "$1" 2>/dev/null
+}
+
+# What the configuration used to index by position, when the state cannot be read: the
+# instances, and one "<hostname>-block" volume (and attachment) per position
+positional_resources() {
+    local kind i host
+    for kind in amd arm; do
+        i=0
+        while IFS= read -r host; do
+            [ -n "$host" ] || continue
+            printf '|oci_core_instance.%s|%s|%s|\n' "$kind" "$i" "$host"
+            printf '|oci_core_volume.%s_block|%s|%s-block|\n' "$kind" "$i" "$host"
+            printf '|oci_core_volume_attachment.%s_block|%s||\n' "$kind" "$i"
+            i=$((i + 1))
+        done < <(configured_hostnames "$kind")
+    done
+}
+
+# Hostnames of the configured instances of KIND, one per line
+configured_hostnames() {
+    if [ "$1" = "amd" ]; then
+        printf '%s\n' "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"
+    else
+        printf '%s\n' "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"
+    fi
+}
+
+moved_block() {
+    printf '\nmoved {\n  from = %s\n  to   = %s\n}\n' "$1" "$2"
+}
+
+# moves.tf: moved blocks for addressing changes of the generator itself, read from the
+# position-indexed resources in state:
+#   - instances and their IPv6 addresses (and any reserved IP) used to be indexed by
+#     position, so removing one shifted the others and replaced them. An instance moves to
+#     the key of its display name, or else to the hostname at its old position, as the
+#     previous configuration had it.
+#   - block volumes and attachments were oci_core_volume.amd_block[i] / arm_block[i]; they
+#     move to oci_core_volume.block["<hostname>-block"] (by display name, else position),
+#     and a backup policy assignment keyed by the old display name follows its volume.
+# Without a readable state every position moves to its hostname.
+create_terraform_moves() {
+    print_status "Creating moves.tf..."
+
+    local state indexed prefix address index name id kind host key planned
+    local -A claimed=() host_at=() block_key=() volume_key=() taken=()
+    if ! state=$(workspace_state); then
+        print_warning "Terraform state not readable: moving instances and block volumes by position (check moves.tf after a removal)"
+        state=""
+        indexed=$(positional_resources)
+    else
+        indexed=$(state_indexed_resources "$state")
+    fi
+    indexed=$(sort -t'|' -k2,2 -k3,3n <<< "$indexed")
+    planned=$(block_volumes_tf)
+
+    # Instances: display names first, so no position takes the hostname an instance is named after
+    while IFS='|' read -r prefix address index name id; do
+        [[ "$address" =~ ^oci_core_instance\.(amd|arm)$ ]] || continue
+        kind="${BASH_REMATCH[1]}"
+        configured_hostnames "$kind" | grep -qxF "$name" && claimed[$kind|$name]=$index
+    done <<< "$indexed"
+    while IFS='|' read -r prefix address index name id; do
+        [[ "$address" =~ ^oci_core_instance\.(amd|arm)$ ]] || continue
+        kind="${BASH_REMATCH[1]}"
+        if [ "${claimed[$kind|$name]:-}" = "$index" ]; then
+            host="$name"
+        else
+            host=$(configured_hostnames "$kind" | sed -n "$((index + 1))p")
+            [ -n "$host" ] && [ -z "${claimed[$kind|$host]:-}" ] || continue
+            claimed[$kind|$host]=$index
+        fi
+        host_at[$kind|$index]="$host"
+    done <<< "$indexed"
+
+    # Block volumes: the key of their display name, else that of the instance they were
+    # attached to (amd_block[i] and arm_block[i] belonged to instance i)
+    while IFS='|' read -r prefix address index name id; do
+        [[ "$address" =~ ^oci_core_volume\.(amd|arm)_block$ ]] || continue
+        kind="${BASH_REMATCH[1]}"
+        key=""
+        for key in "$name" "${host_at[$kind|$index]:-$(configured_hostnames "$kind" | sed -n "$((index + 1))p")}-block"; do
+            [ -n "$key" ] && [ -z "${taken[$key]:-}" ] && jq -e --arg k "$key" 'has($k)' <<< "$planned" >/dev/null && break
+            key=""
+        done
+        [ -n "$key" ] || continue
+        taken[$key]=1
+        block_key[$kind|$index]="$key"
+        [ -z "$id" ] || volume_key[$id]="$key"
+    done <<< "$indexed"
+
+    {
+        cat << 'EOF'
+# Moves for addressing changes of the generator (renames are in renames.tf, LAYOUT changes
+# in layout.tf). Instances, their IPv6 addresses and block volumes are keyed by hostname
+# instead of by position, so removing one instance no longer shifts and replaces the ones
+# after it, and an upgraded configuration keeps the existing volumes and their data.
+EOF
+        while IFS='|' read -r prefix address index name id; do
+            [ -n "$address" ] || continue
+            case "$address" in
+                oci_core_instance.amd|oci_core_instance.arm)
+                    kind="${address##*.}"
+                    host="${host_at[$kind|$index]:-}"
+                    [ -n "$host" ] || continue
+                    moved_block "$prefix$address[$index]" "$prefix$address[\"$host\"]"
+                    # Without a state the IPv6 address is moved too; a move of an address
+                    # that is not there does nothing
+                    if [ -z "$state" ] || grep -qxF "$prefix|oci_core_ipv6.${kind}_ipv6|$index" <<< "$(cut -d'|' -f1-3 <<< "$indexed")"; then
+                        moved_block "${prefix}oci_core_ipv6.${kind}_ipv6[$index]" "${prefix}oci_core_ipv6.${kind}_ipv6[\"$host\"]"
+                    fi
+                    ;;
+                oci_core_public_ip.amd_reserved|oci_core_public_ip.arm_reserved)
+                    kind="${address#*.}" kind="${kind%_reserved}"
+                    host="${host_at[$kind|$index]:-}"
+                    [ -z "$host" ] || moved_block "$prefix$address[$index]" "$prefix$address[\"$host\"]"
+                    ;;
+                oci_core_volume.amd_block|oci_core_volume.arm_block)
+                    kind="${address#*.}" kind="${kind%_block}"
+                    key="${block_key[$kind|$index]:-}"
+                    [ -z "$key" ] || moved_block "$prefix$address[$index]" "${prefix}oci_core_volume.block[\"$key\"]"
+                    ;;
+                oci_core_volume_attachment.amd_block|oci_core_volume_attachment.arm_block)
+                    kind="${address#*.}" kind="${kind%_block}"
+                    key="${block_key[$kind|$index]:-}"
+                    [ -z "$key" ] || moved_block "$prefix$address[$index]" "${prefix}oci_core_volume_attachment.block[\"$key\"]"
+                    ;;
+            esac
+        done <<< "$indexed"
+
+        # Backup policy assignments are keyed by volume name; follow a volume whose key changed
+        [ -z "$state" ] || jq -r '.resources[]? | select(.mode == "managed" and .type == "oci_core_volume_backup_policy_assignment" and .name == "volumes")
+            | (if .module then .module + "." else "" end) as $m
+            | .instances[]? | select(.index_key | type == "string") | [$m, .index_key, (.attributes.asset_id // "")] | join("|")' <<< "$state" 2>/dev/null \
+            | while IFS='|' read -r prefix name id; do
+                [ -n "$id" ] || continue
+                key="${volume_key[$id]:-}"
+                [ -n "$key" ] && [ "$key" != "$name" ] || continue
+                moved_block "${prefix}oci_core_volume_backup_policy_assignment.volumes[\"$name\"]" \
+                    "${prefix}oci_core_volume_backup_policy_assignment.volumes[\"$key\"]"
+            done
+    } | write_generated_file moves.tf
+
+    print_success "moves.tf created"
+}
+
+create_terraform_capacity_reservation() {
+    print_status "Creating capacity_reservation.tf..."
+
+    write_generated_file capacity_reservation.tf << 'EOF'
+# Compute capacity reservation for the ARM instances (CAPACITY_RESERVATION)
+# "create" reserves A1.Flex capacity for every ARM instance size in the first availability
+# domain. A terminated instance hands its capacity back to the reservation, so rebuilds and
+# replacements launch into it instead of hitting "Out of host capacity". Capacity reserved
+# but not used by an instance is billed.
+
+locals {
+  # "<ocpus>/<memory>" => indexes of the ARM instances with that size
+  arm_reservation_sizes = { for i in range(local.arm_flex_instance_count) :
+    "${local.arm_flex_ocpus_per_instance[i]}/${local.arm_flex_memory_per_instance[i]}" => i...
+  }
+
+  arm_capacity_reservation_id = (
+    local.capacity_reservation == "none" ? null :
+    local.capacity_reservation == "create" ? one(oci_core_compute_capacity_reservation.arm[*].id) :
+    local.capacity_reservation
+  )
+}
+
+resource "oci_core_compute_capacity_reservation" "arm" {
+  count = local.capacity_reservation == "create" && local.arm_flex_instance_count > 0 ? 1 : 0
+
+  compartment_id         = local.compartment_id
+  availability_domain    = data.oci_identity_availability_domains.ads.availability_domains[0].name
+  display_name           = "cloudcradle-arm-capacity"
+  is_default_reservation = false
+  freeform_tags          = local.managed_tags
+
+  dynamic "instance_reservation_configs" {
+    for_each = local.arm_reservation_sizes
+    content {
+      instance_shape = "VM.Standard.A1.Flex"
+      reserved_count = length(instance_reservation_configs.value)
+      instance_shape_config {
+        ocpus         = local.arm_flex_ocpus_per_instance[instance_reservation_configs.value[0]]
+        memory_in_gbs = local.arm_flex_memory_per_instance[instance_reservation_configs.value[0]]
+      }
+    }
+  }
+}
+
+output "capacity_reservation" {
+  description = "Compute capacity reservation the ARM instances launch into"
+  value = local.arm_capacity_reservation_id == null ? null : {
+    id       = local.arm_capacity_reservation_id
+    reserved = local.capacity_reservation == "create" ? { for size, hosts in local.arm_reservation_sizes : size => length(hosts) } : null
+  }
+}
+EOF
+
+    print_success "capacity_reservation.tf created"
+}
+
+create_terraform_outputs() {
+    print_status "Creating outputs.tf..."
+
+    write_generated_file outputs.tf << 'EOF'
+# Outputs: per-instance addresses, OCIDs and SSH commands, and the network IDs.
+# `terraform output ssh_commands` prints one ready-to-paste command per instance; the
+# setup renders all of it as a table after apply (and for the `outputs` command).
+
+locals {
+  # Instances in the private subnet are reached through the bastion
+  amd_ssh_commands = { for i in range(local.amd_micro_instance_count) : local.amd_micro_hostnames[i] => (
+    contains(local.private_hostnames, local.amd_micro_hostnames[i])
+    ? "ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}-o ProxyCommand=\"ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}-W %h:%p ${local.ssh_user}@${local.bastion_public_ip}\" ${local.ssh_user}@${oci_core_instance.amd[local.amd_micro_hostnames[i]].private_ip}"
+    : "ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}${local.ssh_user}@${local.amd_public_ips[i]}"
+  ) }
+  arm_ssh_commands = { for i in range(local.arm_flex_instance_count) : local.arm_flex_hostnames[i] => (
+    contains(local.private_hostnames, local.arm_flex_hostnames[i])
+    ? "ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}-o ProxyCommand=\"ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}-W %h:%p ${local.ssh_user}@${local.bastion_public_ip}\" ${local.ssh_user}@${oci_core_instance.arm[local.arm_flex_hostnames[i]].private_ip}"
+    : "ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}${local.ssh_user}@${local.arm_public_ips[i]}"
+  ) }
+}
+
+output "amd_instances" {
+  description = "AMD instance information"
+  value = local.amd_micro_instance_count > 0 ? {
+    for i in range(local.amd_micro_instance_count) : local.amd_micro_hostnames[i] => {
+      id         = oci_core_instance.amd[local.amd_micro_hostnames[i]].id
+      public_ip  = local.amd_public_ips[i]
+      reserved   = contains(local.reserved_ip_hostnames, local.amd_micro_hostnames[i])
+      private_ip = oci_core_instance.amd[local.amd_micro_hostnames[i]].private_ip
+      ipv6       = oci_core_ipv6.amd_ipv6[local.amd_micro_hostnames[i]].ip_address
+      state      = oci_core_instance.amd[local.amd_micro_hostnames[i]].state
+      labels     = lookup(local.instance_labels, local.amd_micro_hostnames[i], {})
+      jump       = contains(local.private_hostnames, local.amd_micro_hostnames[i]) ? local.bastion_public_ip : null
+      dns_name   = lookup(local.ddns_fqdns, local.amd_micro_hostnames[i], null)
+      ssh        = local.amd_ssh_commands[local.amd_micro_hostnames[i]]
+      ssh_ipv6   = "ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}${local.ssh_user}@${oci_core_ipv6.amd_ipv6[local.amd_micro_hostnames[i]].ip_address}"
+    }
+  } : {}
+}
+
+output "arm_instances" {
+  description = "ARM instance information"
+  value = local.arm_flex_instance_count > 0 ? {
+    for i in range(local.arm_flex_instance_count) : local.arm_flex_hostnames[i] => {
+      id         = oci_core_instance.arm[local.arm_flex_hostnames[i]].id
+      public_ip  = local.arm_public_ips[i]
+      reserved   = contains(local.reserved_ip_hostnames, local.arm_flex_hostnames[i])
+      private_ip = oci_core_instance.arm[local.arm_flex_hostnames[i]].private_ip
+      ipv6       = oci_core_ipv6.arm_ipv6[local.arm_flex_hostnames[i]].ip_address
+      state      = oci_core_instance.arm[local.arm_flex_hostnames[i]].state
+      ocpus      = local.arm_flex_ocpus_per_instance[i]
+      memory_gb  = local.arm_flex_memory_per_instance[i]
+      labels     = lookup(local.instance_labels, local.arm_flex_hostnames[i], {})
+      jump       = contains(local.private_hostnames, local.arm_flex_hostnames[i]) ? local.bastion_public_ip : null
+      dns_name   = lookup(local.ddns_fqdns, local.arm_flex_hostnames[i], null)
+      ssh        = local.arm_ssh_commands[local.arm_flex_hostnames[i]]
+      ssh_ipv6   = "ssh -i ./ssh_keys/id_rsa ${local.ssh_port_flag}${local.ssh_user}@${oci_core_ipv6.arm_ipv6[local.arm_flex_hostnames[i]].ip_address}"
+    }
+  } : {}
+}
+
+output "network" {
+  description = "Network information"
+  value = {
+    vcn_id     = oci_core_vcn.main.id
+    vcn_cidr   = oci_core_vcn.main.cidr_blocks[0]
+    subnet_id  = oci_core_subnet.main.id
+    subnet_cidr = oci_core_subnet.main.cidr_block
+    vcn_ipv6_cidr    = oci_core_vcn.main.ipv6cidr_blocks[0]
+    subnet_ipv6_cidr = oci_core_subnet.main.ipv6cidr_blocks[0]
+    topology          = local.network_topology
+    private_subnet_id = local.private_subnet_id
+    subnets = { for name, subnet in oci_core_subnet.extra : name => {
+      id     = subnet.id
+      cidr   = subnet.cidr_block
+      public = !subnet.prohibit_public_ip_on_vnic
+    } }
+    nat_gateway_id    = try(oci_core_nat_gateway.main[0].id, null)
+    service_gateway_id = try(oci_core_service_gateway.main[0].id, null)
+    bastion           = local.bastion_public_ip
+  }
+}
+
+output "summary" {
+  description = "Infrastructure summary"
+  value = {
+    region          = local.region
+    total_amd       = local.amd_micro_instance_count
+    total_arm       = local.arm_flex_instance_count
+    total_storage   = local.total_storage
+    free_tier_limit = var.free_tier_max_storage_gb
+  }
+}
+
+output "ssh_commands" {
+  description = "Ready-to-paste SSH command per instance"
+  value       = merge(local.amd_ssh_commands, local.arm_ssh_commands)
+}
+EOF
+
+    print_success "outputs.tf created"
+}
+
+create_terraform_budget() {
+    print_status "Creating budget.tf..."
+
+    write_generated_file budget.tf << 'EOF'
+# Cost alerts (BUDGET_ALERT_EMAIL)
+# A monthly budget on the whole tenancy with alert rules on the actual and the forecast
+# spend. Always Free usage costs nothing, so any spend above the threshold means something
+# billable is running. The Budgets service mails the recipients itself; there is no
+# subscription to confirm.
+
+resource "oci_budget_budget" "cost_guard" {
+  count = local.budget_alert_email == "none" ? 0 : 1
+
+  compartment_id = local.tenancy_ocid
+  amount         = local.budget_amount
+  reset_period   = "MONTHLY"
+  target_type    = "COMPARTMENT"
+  targets        = [local.tenancy_ocid]
+  display_name   = "cloudcradle-cost-guard"
+  description    = "Alerts on any spend beyond the Always Free tier"
+  freeform_tags  = local.managed_tags
+}
+
+resource "oci_budget_alert_rule" "cost_guard" {
+  for_each = local.budget_alert_email == "none" ? {} : { actual = "ACTUAL", forecast = "FORECAST" }
+
+  budget_id      = oci_budget_budget.cost_guard[0].id
+  display_name   = "cloudcradle-${each.key}-spend"
+  type           = each.value
+  threshold      = local.budget_alert_threshold
+  threshold_type = "ABSOLUTE"
+  recipients     = local.budget_alert_email
+  message        = "The ${each.key} spend of this month is above ${local.budget_alert_threshold}: something outside the Always Free tier is billed. Check Cost Analysis in the OCI console."
+  freeform_tags  = local.managed_tags
+}
+
+output "budget" {
+  description = "Cost alert budget and its recipients"
+  value = local.budget_alert_email == "none" ? null : {
+    id         = oci_budget_budget.cost_guard[0].id
+    recipients = local.budget_alert_email
+    threshold  = local.budget_alert_threshold
+  }
+}
+EOF
+
+    print_success "budget.tf created"
+}
+
+create_terraform_marketplace_images() {
+    print_status "Creating marketplace_images.tf..."
+
+    write_generated_file marketplace_images.tf << 'EOF'
+# Marketplace images (INSTANCE_OS = almalinux | rocky | debian)
+# Partner images can only be launched after subscribing to their listing version, which
+# accepts the publisher's terms of use. Empty (no resources) for platform and custom images.
+
+resource "oci_core_app_catalog_listing_resource_version_agreement" "image" {
+  for_each = local.marketplace_images
+
+  listing_id               = each.value.listing_id
+  listing_resource_version = each.value.version
+}
+
+resource "oci_core_app_catalog_subscription" "image" {
+  for_each = local.marketplace_images
+
+  compartment_id           = local.compartment_id
+  listing_id               = oci_core_app_catalog_listing_resource_version_agreement.image[each.key].listing_id
+  listing_resource_version = oci_core_app_catalog_listing_resource_version_agreement.image[each.key].listing_resource_version
+  eula_link                = oci_core_app_catalog_listing_resource_version_agreement.image[each.key].eula_link
+  oracle_terms_of_use_link = oci_core_app_catalog_listing_resource_version_agreement.image[each.key].oracle_terms_of_use_link
+  signature                = oci_core_app_catalog_listing_resource_version_agreement.image[each.key].signature
+  time_retrieved           = oci_core_app_catalog_listing_resource_version_agreement.image[each.key].time_retrieved
+}
+EOF
+
+    print_success "marketplace_images.tf created"
+}
+
+create_terraform_volume_backups() {
+    print_status "Creating volume_backups.tf..."
+
+    resource_lifecycle << 'EOF' | write_generated_file volume_backups.tf
+# Scheduled Volume Backups (VOLUME_BACKUP_POLICY) and volume groups (VOLUME_GROUPS)
+# Oracle-defined bronze/silver/gold policies or a custom schedule, assigned to the boot
+# and/or block volumes - or to an instance's volume group, which snapshots all of its
+# volumes at the same point in time. Always Free includes 5 volume backups in total.
+
+locals {
+  volume_backup_enabled = local.volume_backup_policy != ""
+
+  volume_backup_policy_id = !local.volume_backup_enabled ? null : (
+    local.volume_backup_policy == "custom"
+    ? oci_core_volume_backup_policy.custom[0].id
+    : one([for p in data.oci_core_volume_backup_policies.oracle.volume_backup_policies : p.id if p.display_name == local.volume_backup_policy])
+  )
+
+  # "<hostname>-boot" / "<hostname>-block" => volume OCID (volumes in a group are backed up with it)
+  volume_backup_targets = !local.volume_backup_enabled ? {} : merge(
+    contains(["boot", "all"], local.volume_backup_volumes) ? { for h, inst in oci_core_instance.amd : "${h}-boot" => inst.boot_volume_id if !contains(local.volume_group_hosts, h) } : {},
+    contains(["boot", "all"], local.volume_backup_volumes) ? { for h, inst in oci_core_instance.arm : "${h}-boot" => inst.boot_volume_id if !contains(local.volume_group_hosts, h) } : {},
+    contains(["block", "all"], local.volume_backup_volumes) ? { for name, vol in oci_core_volume.block : name => vol.id if !contains(local.volume_group_hosts, local.block_volumes[name].host) } : {},
+  )
+
+  # hostname => {kind, index} for instances whose volumes form a group
+  volume_group_instances = merge(
+    { for i, name in local.amd_micro_hostnames : name => { kind = "amd", index = i } if i < local.amd_micro_instance_count && contains(local.volume_group_hosts, name) },
+    { for i, name in local.arm_flex_hostnames : name => { kind = "arm", index = i } if i < local.arm_flex_instance_count && contains(local.volume_group_hosts, name) },
+  )
+}
+
+resource "oci_core_volume_group" "instance" {
+  for_each = local.volume_group_instances
+
+  compartment_id      = local.compartment_id
+  availability_domain = each.value.kind == "amd" ? oci_core_instance.amd[each.key].availability_domain : oci_core_instance.arm[each.key].availability_domain
+  display_name        = "${each.key}-volumes"
+  freeform_tags       = local.managed_tags
+
+  source_details {
+    type = "volumeIds"
+    volume_ids = concat(
+      [each.value.kind == "amd" ? oci_core_instance.amd[each.key].boot_volume_id : oci_core_instance.arm[each.key].boot_volume_id],
+      [for name, vol in local.block_volumes : oci_core_volume.block[name].id if vol.host == each.key],
+    )
+  }
+}
+
+# Oracle-defined policies (bronze, silver, gold)
+data "oci_core_volume_backup_policies" "oracle" {}
+
+resource "oci_core_volume_backup_policy" "custom" {
+  count = local.volume_backup_policy == "custom" ? 1 : 0
+
+  compartment_id = local.compartment_id
+  display_name   = "cloudcradle-volume-backups"
+  freeform_tags  = local.managed_tags
+
+  dynamic "schedules" {
+    for_each = local.volume_backup_schedules
+    content {
+      backup_type       = "INCREMENTAL"
+      period            = schedules.value.period
+      retention_seconds = schedules.value.retention_seconds
+      hour_of_day       = schedules.value.hour_of_day
+      day_of_week       = schedules.value.period == "ONE_WEEK" ? "SUNDAY" : null
+      day_of_month      = schedules.value.period == "ONE_MONTH" ? 1 : null
+      offset_type       = "STRUCTURED"
+      time_zone         = "UTC"
+    }
+  }
+}
+
+resource "oci_core_volume_backup_policy_assignment" "volumes" {
+  for_each = local.volume_backup_targets
+
+  asset_id  = each.value
+  policy_id = local.volume_backup_policy_id
+}
+
+resource "oci_core_volume_backup_policy_assignment" "groups" {
+  for_each = local.volume_backup_enabled ? oci_core_volume_group.instance : {}
+
+  asset_id  = each.value.id
+  policy_id = local.volume_backup_policy_id
+}
+
+output "volume_backups" {
+  description = "Volumes and volume groups with a scheduled backup policy"
+  value = local.volume_backup_enabled ? {
+    policy  = local.volume_backup_policy
+    volumes = keys(local.volume_backup_targets)
+    groups  = [for host in keys(local.volume_group_instances) : "${host}-volumes"]
+  } : null
+}
+EOF
+
+    print_success "volume_backups.tf created"
+}
+
+create_terraform_backups() {
+    print_status "Creating backups.tf..."
+
+    [ "$(backup_plans_tf)" != "{}" ] && ensure_backup_passwords
+
+    write_generated_file backups.tf << 'EOF'
+# Application data backups (BACKUP_SPEC_FILE)
+# Instances push restic snapshots to a private bucket through instance principals, so no
+# Object Storage credentials are stored on them. Always Free includes 20 GB of Object Storage.
+# The instances reach the bucket through the dynamic group created by bootstrap-iam, which
+# matches the <namespace>.backup defined tag set in main.tf.
+
+locals {
+  backup_enabled = length(local.backup_plans) > 0
+
+  # Shared by every instance's cloud-init; per-instance paths/schedule come from backup_plans
+  backup_settings = {
+    bucket      = local.backup_bucket
+    namespace   = local.backup_enabled ? data.oci_objectstorage_namespace.backups[0].namespace : ""
+    region      = local.region
+    compartment = local.compartment_id
+    retention   = local.backup_retention
+    rclone      = local.backup_rclone
+  }
+}
+
+data "oci_objectstorage_namespace" "backups" {
+  count          = local.backup_enabled ? 1 : 0
+  compartment_id = local.tenancy_ocid
+}
+
+resource "oci_objectstorage_bucket" "backups" {
+  count = local.backup_enabled ? 1 : 0
+
+  compartment_id = local.compartment_id
+  namespace      = data.oci_objectstorage_namespace.backups[0].namespace
+  name           = local.backup_bucket
+  access_type    = "NoPublicAccess"
+  freeform_tags  = local.managed_tags
+}
+
+output "backups" {
+  description = "Backup bucket and per-instance plans"
+  value = local.backup_enabled ? {
+    bucket    = oci_objectstorage_bucket.backups[0].name
+    namespace = oci_objectstorage_bucket.backups[0].namespace
+    plans     = local.backup_plans
+  } : null
+}
+EOF
+
+    print_success "backups.tf created"
+}
+
+create_terraform_autonomous_databases() {
+    print_status "Creating autonomous_databases.tf..."
+
+    [ -n "$AUTONOMOUS_DATABASES" ] && ensure_adb_admin_password
+
+    resource_lifecycle << 'EOF' | write_generated_file autonomous_databases.tf
+# Always Free Autonomous Databases (AUTONOMOUS_DATABASES)
+# Up to two per tenancy, each with 1 OCPU and 20 GB of storage. They are stopped by Oracle
+# after 7 days without connections and reclaimed after 90 days stopped.
+
+resource "oci_database_autonomous_database" "free" {
+  for_each = local.autonomous_databases
+
+  compartment_id           = local.compartment_id
+  db_name                  = each.key
+  display_name             = each.key
+  db_workload              = each.value.workload
+  is_free_tier             = true
+  cpu_core_count           = 1
+  data_storage_size_in_tbs = 1
+  admin_password           = var.adb_admin_password
+  freeform_tags            = local.managed_tags
+
+  lifecycle {
+    # Rotating the password in the console must not force a change here
+    ignore_changes = [admin_password]
+  }
+}
+
+output "autonomous_databases" {
+  description = "Always Free Autonomous Databases (download wallets with: setup_oci_terraform.sh adb wallet NAME)"
+  value = {
+    for name, db in oci_database_autonomous_database.free : name => {
+      id             = db.id
+      workload       = db.db_workload
+      state          = db.state
+      service_url    = try(db.connection_urls[0].sql_dev_web_url, null)
+      apex_url       = try(db.connection_urls[0].apex_url, null)
+      connection_tns = try(db.connection_strings[0].high, null)
+    }
+  }
+}
+EOF
+
+    print_success "autonomous_databases.tf created"
+}
+
+create_terraform_secrets() {
+    print_status "Creating secrets.tf..."
+
+    write_generated_file secrets.tf << 'EOF'
+# Application secrets (SECRETS_FILE)
+# Only the vault and its key are managed here. Secret values are stored with
+# 'setup_oci_terraform.sh secrets set NAME' and fetched by the instances at boot, so they
+# never reach user-data or Terraform state. Read access comes from the dynamic group created
+# by 'bootstrap-iam --instance-access', which matches the <namespace>.secrets defined tag set
+# in main.tf. Always Free includes software-protected keys and 150 secrets.
+
+locals {
+  secrets_enabled  = length(local.secrets) > 0
+  secrets_vault_id = local.secrets_enabled ? oci_kms_vault.secrets[0].id : ""
+}
+
+resource "oci_kms_vault" "secrets" {
+  count = local.secrets_enabled ? 1 : 0
+
+  compartment_id = local.compartment_id
+  display_name   = local.secrets_vault_name
+  vault_type     = "DEFAULT"
+  freeform_tags  = local.managed_tags
+}
+
+resource "oci_kms_key" "secrets" {
+  count = local.secrets_enabled ? 1 : 0
+
+  compartment_id      = local.compartment_id
+  display_name        = "${local.secrets_vault_name}-key"
+  management_endpoint = oci_kms_vault.secrets[0].management_endpoint
+  protection_mode     = "SOFTWARE"
+  freeform_tags       = local.managed_tags
+
+  key_shape {
+    algorithm = "AES"
+    length    = 32
+  }
+}
+
+output "secrets_vault" {
+  description = "Vault holding the application secrets (store values with: setup_oci_terraform.sh secrets set NAME)"
+  value = local.secrets_enabled ? {
+    id             = oci_kms_vault.secrets[0].id
+    key_id         = oci_kms_key.secrets[0].id
+    compartment_id = local.compartment_id
+    secrets        = local.secrets
+  } : null
+}
+EOF
+
+    print_success "secrets.tf created"
+}
+
+# backups.tf and secrets.tf used to create the dynamic groups and policies of the instances.
+# bootstrap-iam owns them now (same names), so forget them in state instead of letting the
+# next apply destroy them. Also warn while the tag namespace they match on is missing: the
+# apply cannot tag the instances until a tenancy admin has created it.
+release_instance_access_iam() {
+    local state address
+    if state=$(workspace_state) && [ -n "$state" ]; then
+        jq -r '.resources[]? | select(.mode == "managed")
+            | select(.type == "oci_identity_dynamic_group" or .type == "oci_identity_policy")
+            | select(.name == "backups" or .name == "secrets")
+            | (if .module then .module + "." else "" end) + .type + "." + .name' <<< "$state" 2>/dev/null \
+            | while IFS= read -r address; do
+                if [ "$DRY_RUN" = "true" ] || [ "$EMIT_ONLY" = "true" ] || ! terraform_available; then
+                    print_status "Run: terraform state rm '$address'   # now managed by bootstrap-iam"
+                elif terraform state rm "$address" >/dev/null < /dev/null; then
+                    print_status "Forgot $address in state (now managed by bootstrap-iam)"
+                else
+                    print_warning "Could not forget $address - the next apply would delete it"
+                fi
+            done
+    fi
+
+    [ -n "$(instance_access_kinds)" ] || return 0
+    local namespaces
+    namespaces=$(oci_cmd "iam tag-namespace list --compartment-id $tenancy_ocid --all --query 'data[].name'" 2>/dev/null) || return 0
+    if ! jq -e --arg n "$INSTANCE_TAG_NAMESPACE" 'index($n) != null' <<< "$namespaces" >/dev/null 2>&1; then
+        print_warning "Tag namespace $INSTANCE_TAG_NAMESPACE does not exist - applying will fail until a tenancy admin runs:"
+        print_warning "  $0 bootstrap-iam --instance-access"
+    fi
+}
+
+# ============================================================================
+# PROVISIONER MODULES
+# ============================================================================
+#
+# Ready-made cloud-init snippets enabled per instance in PROVISIONERS_FILE. Each module
+# contributes packages, runcmd entries and write_files; create_cloud_init splices the
+# modules in use into cloud-init.yaml, each guarded by contains(modules, "<name>"), so
+# every instance's rendered cloud-config only carries its own modules.
+
+readonly PROVISIONER_MODULES="docker k3s tailscale wireguard caddy traefik node_exporter"
+
+# Template fragment of a module for one cloud-config section (packages, runcmd or files)
+provisioner_snippet() {
+    case "$1:$2" in
+        docker:files)
+            cat <<'EOF'
+  # Rotate container logs so they cannot fill the boot volume
+  - path: /etc/docker/daemon.json
+    permissions: '0644'
+    content: |
+      {
+        "log-driver": "json-file",
+        "log-opts": {"max-size": "10m", "max-file": "3"}
+      }
+EOF
+            ;;
+        docker:runcmd)
+            cat <<'EOF'
+%{ if os.epel_release != "" ~}
+  - dnf config-manager --add-repo https://download.docker.com/linux/centos/docker-ce.repo && dnf install -y docker-ce docker-ce-cli containerd.io docker-compose-plugin
+%{ else ~}
+  - curl -fsSL https://get.docker.com | sh
+%{ endif ~}
+  - systemctl enable --now docker
+  - usermod -aG docker "$(id -nu 1000)"
+%{ for name, user in users ~}
+%{ if user.sudo ~}
+  - usermod -aG docker ${name}
+%{ endif ~}
+%{ endfor ~}
+EOF
+            ;;
+        k3s:runcmd)
+            cat <<'EOF'
+  - curl -sfL https://get.k3s.io | INSTALL_K3S_EXEC="--node-name ${hostname} --write-kubeconfig-mode 0640" sh -
+EOF
+            ;;
+        tailscale:runcmd)
+            cat <<'EOF'
+  - curl -fsSL https://tailscale.com/install.sh | sh
+%{ if tailscale_key != "" ~}
+  - tailscale up --auth-key=file:/etc/cloudcradle/tailscale.key --hostname=${hostname}
+%{ endif ~}
+EOF
+            ;;
+        tailscale:files)
+            cat <<'EOF'
+%{ if tailscale_key != "" ~}
+  - path: /etc/cloudcradle/tailscale.key
+    permissions: '0600'
+    content: ${jsonencode(tailscale_key)}
+%{ endif ~}
+EOF
+            ;;
+        wireguard:packages)
+            echo "  - wireguard-tools"
+            ;;
+        wireguard:runcmd)
+            cat <<'EOF'
+  - sysctl --system
+  - "umask 077; mkdir -p /etc/wireguard; [ -f /etc/wireguard/private.key ] || wg genkey | tee /etc/wireguard/private.key | wg pubkey > /etc/wireguard/public.key"
+  - "if [ -f /etc/wireguard/wg0.conf ]; then systemctl enable --now wg-quick@wg0; fi"
+EOF
+            ;;
+        wireguard:files)
+            cat <<'EOF'
+  # Key pair in /etc/wireguard; supply wg0.conf through CLOUD_INIT_FILE to bring the tunnel up
+  - path: /etc/sysctl.d/99-cloudcradle-wireguard.conf
+    permissions: '0644'
+    content: |
+      net.ipv4.ip_forward = 1
+      net.ipv6.conf.all.forwarding = 1
+EOF
+            ;;
+        caddy:runcmd)
+            echo "  - /usr/local/sbin/cloudcradle-open-web-ports"
+            echo "  - /usr/local/sbin/cloudcradle-install-caddy"
+            ;;
+        caddy:files)
+            provisioner_web_ports_file
+            cat <<'EOF'
+  - path: /usr/local/sbin/cloudcradle-install-caddy
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      set -e
+      case "$(uname -m)" in aarch64) arch=arm64 ;; *) arch=amd64 ;; esac
+      curl -fsSL -o /usr/local/bin/caddy "https://caddyserver.com/api/download?os=linux&arch=$arch"
+      chmod 0755 /usr/local/bin/caddy
+      id caddy >/dev/null 2>&1 || useradd --system --home-dir /var/lib/caddy --create-home --shell /usr/sbin/nologin caddy
+      systemctl daemon-reload
+      systemctl enable --now caddy
+  # Sites from SITES_FILE; without any, a placeholder on :80
+  - path: /etc/caddy/Caddyfile
+    permissions: '0644'
+    content: |
+EOF
+            [ -z "$ACME_EMAIL" ] || printf '      {\n        email %s\n      }\n' "$ACME_EMAIL"
+            cat <<'EOF'
+%{ for site in sites ~}
+      ${site.domain} {
+        reverse_proxy ${site.upstream}
+      }
+%{ endfor ~}
+%{ if length(sites) == 0 ~}
+      :80 {
+        respond "${hostname}"
+      }
+%{ endif ~}
+  - path: /etc/systemd/system/caddy.service
+    content: |
+      [Unit]
+      Description=Caddy web server
+      Wants=network-online.target
+      After=network-online.target
+
+      [Service]
+      User=caddy
+      Group=caddy
+      ExecStart=/usr/local/bin/caddy run --environ --config /etc/caddy/Caddyfile
+      ExecReload=/usr/local/bin/caddy reload --config /etc/caddy/Caddyfile --force
+      AmbientCapabilities=CAP_NET_BIND_SERVICE
+      Restart=on-failure
+
+      [Install]
+      WantedBy=multi-user.target
+EOF
+            ;;
+        traefik:runcmd)
+            echo "  - /usr/local/sbin/cloudcradle-open-web-ports"
+            echo "  - /usr/local/sbin/cloudcradle-install-traefik"
+            ;;
+        traefik:files)
+            provisioner_web_ports_file
+            cat <<'EOF'
+  - path: /usr/local/sbin/cloudcradle-install-traefik
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      set -e
+      version=@TRAEFIK_VERSION@
+      case "$(uname -m)" in aarch64) arch=arm64 ;; *) arch=amd64 ;; esac
+      curl -fsSL "https://github.com/traefik/traefik/releases/download/v$version/traefik_v$${version}_linux_$arch.tar.gz" \
+        | tar -xz -C /usr/local/bin traefik
+      id traefik >/dev/null 2>&1 || useradd --system --home-dir /var/lib/traefik --create-home --shell /usr/sbin/nologin traefik
+      systemctl daemon-reload
+      systemctl enable --now traefik
+  - path: /etc/traefik/traefik.yml
+    permissions: '0644'
+    content: |
+      entryPoints:
+        web:
+          address: ":80"
+          http:
+            redirections:
+              entryPoint:
+                to: websecure
+                scheme: https
+        websecure:
+          address: ":443"
+      certificatesResolvers:
+        letsencrypt:
+          acme:
+            email: "@ACME_EMAIL@"
+            storage: /var/lib/traefik/acme.json
+            httpChallenge:
+              entryPoint: web
+      providers:
+        file:
+          filename: /etc/traefik/sites.yml
+          watch: true
+  # Sites from SITES_FILE, one router and service each
+  - path: /etc/traefik/sites.yml
+    permissions: '0644'
+    content: |
+%{ if length(sites) > 0 ~}
+      http:
+        routers:
+%{ for i, site in sites ~}
+          site${i}:
+            rule: "Host(`${site.domain}`)"
+            entryPoints: [websecure]
+            service: site${i}
+            tls:
+              certResolver: letsencrypt
+%{ endfor ~}
+        services:
+%{ for i, site in sites ~}
+          site${i}:
+            loadBalancer:
+              servers:
+                - url: "${site.url}"
+%{ endfor ~}
+%{ else ~}
+      # No sites configured
+%{ endif ~}
+  - path: /etc/systemd/system/traefik.service
+    content: |
+      [Unit]
+      Description=Traefik reverse proxy
+      Wants=network-online.target
+      After=network-online.target
+
+      [Service]
+      User=traefik
+      Group=traefik
+      ExecStart=/usr/local/bin/traefik --configFile=/etc/traefik/traefik.yml
+      AmbientCapabilities=CAP_NET_BIND_SERVICE
+      Restart=on-failure
+
+      [Install]
+      WantedBy=multi-user.target
+EOF
+            ;;
+        node_exporter:runcmd)
+            echo "  - /usr/local/sbin/cloudcradle-install-node-exporter"
+            ;;
+        node_exporter:files)
+            cat <<'EOF'
+  - path: /usr/local/sbin/cloudcradle-install-node-exporter
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      set -e
+      version=@NODE_EXPORTER_VERSION@
+      case "$(uname -m)" in aarch64) arch=arm64 ;; *) arch=amd64 ;; esac
+      curl -fsSL "https://github.com/prometheus/node_exporter/releases/download/v$version/node_exporter-$version.linux-$arch.tar.gz" \
+        | tar -xz -C /usr/local/bin --strip-components=1 "node_exporter-$version.linux-$arch/node_exporter"
+      id node_exporter >/dev/null 2>&1 || useradd --system --no-create-home --shell /usr/sbin/nologin node_exporter
+      systemctl daemon-reload
+      systemctl enable --now node_exporter
+  - path: /etc/systemd/system/node_exporter.service
+    content: |
+      [Unit]
+      Description=Prometheus node exporter
+      Wants=network-online.target
+      After=network-online.target
+
+      [Service]
+      User=node_exporter
+      ExecStart=/usr/local/bin/node_exporter
+      Restart=on-failure
+
+      [Install]
+      WantedBy=multi-user.target
+EOF
+            ;;
+    esac
+}
+
+# Host firewall opener shared by the reverse proxies: Oracle's Ubuntu images reject all but
+# SSH in iptables, and Oracle Linux runs firewalld, so the security list alone is not enough
+provisioner_web_ports_file() {
+    cat <<'EOF'
+  - path: /usr/local/sbin/cloudcradle-open-web-ports
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      if systemctl is-active --quiet firewalld; then
+        firewall-cmd --permanent --add-service=http --add-service=https && firewall-cmd --reload
+      elif command -v iptables >/dev/null; then
+        for port in 443 80; do
+          iptables -C INPUT -p tcp --dport $port -j ACCEPT 2>/dev/null || iptables -I INPUT 1 -p tcp --dport $port -j ACCEPT
+        done
+        if command -v netfilter-persistent >/dev/null; then netfilter-persistent save; fi
+      fi
+EOF
+}
+
+# Settle PROVISION: the flag/variable ("none" = no modules), else the modules saved in variables.tf
+resolve_provision() {
+    local module
+    if [ -z "$PROVISION" ]; then
+        PROVISION=$(grep -oP '^\s*provision\s*=\s*"\K[^"]*' variables.tf 2>/dev/null | head -1) || PROVISION=""
+    elif [ "$PROVISION" = "none" ]; then
+        PROVISION=""
+    fi
+    for module in ${PROVISION//,/ }; do
+        if [[ " $PROVISIONER_MODULES " != *" $module "* ]]; then
+            print_error "PROVISION: unknown module '$module' (available: $PROVISIONER_MODULES)"
+            return 1
+        fi
+    done
+}
+
+# Render PROVISION and PROVISIONERS_FILE as a single-line HCL map of module lists:
+# {"arm-1":["docker","k3s"]}. Modules of every matching line are combined, in library order;
+# instances with SITES_FILE entries also get REVERSE_PROXY.
+provisioners_tf() {
+    if [ ! -f "$PROVISIONERS_FILE" ] && [ ! -f "$SITES_FILE" ] && [ -z "$PROVISION" ]; then
+        echo "{}"
+        return 0
+    fi
+    local host kind target modules module
+    {
+        for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"; do echo "$host amd"; done
+        for host in "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do echo "$host arm"; done
+    } | while read -r host kind; do
+        [ -n "$host" ] || continue
+        while read -r target modules; do
+            [ -n "$modules" ] || continue
+            backup_target_matches "$target" "$host" "$kind" || continue
+            for module in $modules; do
+                printf '%s\t%s\n' "$host" "$module"
+            done
+        done < <(echo "* ${PROVISION//,/ }"; [ ! -f "$PROVISIONERS_FILE" ] || sed 's/#.*//' "$PROVISIONERS_FILE"
+                 [ ! -f "$SITES_FILE" ] || sed 's/#.*//' "$SITES_FILE" | awk -v proxy="$REVERSE_PROXY" 'NF { print $1, proxy }')
+    done | jq -Rn -c --arg library "$PROVISIONER_MODULES" '
+        ($library | split(" ")) as $order
+        | reduce (inputs | split("\t")) as $l ({}; .[$l[0]] += [$l[1]])
+        | map_values(unique | sort_by($order | index(.)))'
+}
+
+# Render SITES_FILE as a single-line HCL map of site lists per instance:
+# {"arm-1":[{"domain":"app.example.com","upstream":"localhost:8080","url":"http://localhost:8080"}]}
+sites_tf() {
+    if [ ! -f "$SITES_FILE" ]; then
+        echo "{}"
+        return 0
+    fi
+    local host kind target domain upstream
+    {
+        for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"; do echo "$host amd"; done
+        for host in "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do echo "$host arm"; done
+    } | while read -r host kind; do
+        [ -n "$host" ] || continue
+        while read -r target domain upstream; do
+            [ -n "$upstream" ] || continue
+            backup_target_matches "$target" "$host" "$kind" || continue
+            printf '%s\t%s\t%s\n' "$host" "$domain" "$upstream"
+        done < <(sed 's/#.*//' "$SITES_FILE")
+    done | jq -Rn -c '
+        reduce (inputs | split("\t")) as $l ({};
+            .[$l[0]] += [{domain: $l[1], upstream: $l[2],
+                          url: (if ($l[2] | test("://")) then $l[2] else "http://" + $l[2] end)}])' | hcl_literal_json
+}
+
+# Render SECRETS_FILE as a single-line HCL map of secret lists per instance:
+# {"arm-1":[{"name":"stripe-key","path":"/etc/myapp/stripe.key","mode":"0600"}]}
+# Instances with a backup plan also receive their restic repository password.
+secrets_tf() {
+    local host kind target name path mode
+    {
+        if [ -f "$SECRETS_FILE" ]; then
+            {
+                for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"; do echo "$host amd"; done
+                for host in "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do echo "$host arm"; done
+            } | while read -r host kind; do
+                [ -n "$host" ] || continue
+                while read -r target name path mode; do
+                    [ -n "$path" ] || continue
+                    backup_target_matches "$target" "$host" "$kind" || continue
+                    printf '%s\t%s\t%s\t%s\n' "$host" "$name" "$path" "${mode:-0600}"
+                done < <(sed 's/#.*//' "$SECRETS_FILE")
+            done
+        fi
+        for host in $(backup_plans_tf | jq -r 'keys[]'); do
+            printf '%s\t%s\t%s\t%s\n' "$host" "$(backup_password_secret "$host")" "$BACKUP_REMOTE_PASSWORD_FILE" 0600
+            [ ! -f "$BACKUP_PASSWORD_FILE" ] || \
+                printf '%s\t%s\t%s\t%s\n' "$host" "$BACKUP_SHARED_PASSWORD_SECRET" "$BACKUP_REMOTE_SHARED_PASSWORD_FILE" 0600
+        done
+    } | jq -Rn -c 'reduce (inputs | split("\t")) as $l ({}; .[$l[0]] += [{name: $l[1], path: $l[2], mode: $l[3]}])' | hcl_literal_json
+}
+
+# Render the instance access defined tags as a single-line HCL map:
+# {"arm-1":{"cloudcradle.backup":"true","cloudcradle.secrets":"true"}}
+instance_access_tags_tf() {
+    jq -n -c --arg ns "$INSTANCE_TAG_NAMESPACE" --argjson backup "$(backup_plans_tf)" --argjson secrets "$(secrets_tf)" '
+        reduce ($backup | keys[]) as $h ({}; .[$h][$ns + ".backup"] = "true")
+        | reduce ($secrets | keys[]) as $h (.; .[$h][$ns + ".secrets"] = "true")'
+}
+
+# Whether any instance runs a reverse proxy module (ports 80/443 must be reachable)
+reverse_proxy_in_use() {
+    provisioners_tf | jq -e '[.[][]] | any(. == "caddy" or . == "traefik")' >/dev/null
+}
+
+# Whether FIREWALL_RULES admit TCP PORT from anywhere over IPv4
+firewall_allows_port() {
+    local port="$1" rule cidrs
+    for rule in "${FIREWALL_RULES[@]}"; do
+        read -r _ _ _ cidrs _ <<< "$rule"
+        [[ ",$cidrs," == *",0.0.0.0/0,"* ]] || continue
+        firewall_rule_admits_port "$rule" "$port" && return 0
+    done
+    return 1
+}
+
+# Whether one firewall rule line admits ingress TCP PORT (from any of its sources)
+firewall_rule_admits_port() {
+    local port="$2" dir proto ports port_spec
+    read -r dir proto ports _ <<< "$1"
+    [ "$dir" = "ingress" ] || return 1
+    [ "$proto" = "all" ] && return 0
+    [ "$proto" = "tcp" ] || return 1
+    for port_spec in ${ports//,/ }; do
+        [ "$port_spec" = "-" ] && return 0
+        if [[ "$port_spec" =~ ^([0-9]+)(-([0-9]+))?$ ]] \
+            && [ "$port" -ge "${BASH_REMATCH[1]}" ] && [ "$port" -le "${BASH_REMATCH[3]:-${BASH_REMATCH[1]}}" ]; then
+            return 0
+        fi
+    done
+    return 1
+}
+
+# Capacity reservation setting: CAPACITY_RESERVATION, else the one saved in variables.tf
+capacity_reservation() {
+    local value="$CAPACITY_RESERVATION"
+    [ -n "$value" ] || value=$(grep -oP '^\s*capacity_reservation\s*=\s*"\K[^"]+' variables.tf 2>/dev/null | head -1) || value=""
+    echo "${value:-none}"
+}
+
+# Cost alert recipients: BUDGET_ALERT_EMAIL, else the ones saved in variables.tf
+budget_alert_email() {
+    local email="$BUDGET_ALERT_EMAIL"
+    [ -n "$email" ] || email=$(grep -oP '^\s*budget_alert_email\s*=\s*"\K[^"]+' variables.tf 2>/dev/null | head -1) || email=""
+    echo "${email:-none}"
+}
+
+# Hardening profile for every instance: HARDENING_PROFILE, else the profile saved in
+# variables.tf, else standard
+hardening_profile() {
+    local profile="$HARDENING_PROFILE"
+    [ -n "$profile" ] || profile=$(grep -oP '^\s*hardening_profile\s*=\s*"\K[^"]+' variables.tf 2>/dev/null | head -1) || profile=""
+    echo "${profile:-standard}"
+}
+
+# Render HARDENING_FILE as an HCL map of hostname => profile (the last matching line wins)
+hardening_profiles_tf() {
+    if [ ! -f "$HARDENING_FILE" ]; then
+        echo "{}"
+        return 0
+    fi
+    local host kind target profile
+    {
+        for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"; do echo "$host amd"; done
+        for host in "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do echo "$host arm"; done
+    } | while read -r host kind; do
+        [ -n "$host" ] || continue
+        while read -r target profile _; do
+            [ -n "$profile" ] || continue
+            backup_target_matches "$target" "$host" "$kind" || continue
+            printf '%s\t%s\n' "$host" "$profile"
+        done < <(sed 's/#.*//' "$HARDENING_FILE")
+    done | jq -Rn -c 'reduce (inputs | split("\t")) as $l ({}; .[$l[0]] = $l[1])'
+}
+
+# Render the ingress security list rules as "<tcp|udp|all> <ports|-> <cidr>" lines for the
+# strict profile's host firewall (ICMP is left to the distro defaults). Traffic from inside
+# the VCN is allowed as in the private subnet's security list.
+host_firewall_rules_tf() {
+    local rule dir proto ports cidrs cidr port_spec vcn_cidrs="${VCN_CIDRS:-10.0.0.0/16}"
+    {
+        while IFS= read -r rule; do
+            read -r dir proto ports cidrs _ <<< "$rule"
+            [ "$dir" = "ingress" ] || continue
+            for cidr in ${cidrs//,/ }; do
+                case "$proto" in
+                    tcp|udp) for port_spec in ${ports//,/ }; do echo "$proto $port_spec $cidr"; done ;;
+                    all) echo "all - $cidr" ;;
+                esac
+            done
+        done < <(effective_firewall_rules)
+        for cidr in ${vcn_cidrs//,/ }; do
+            echo "all - $cidr"
+        done
+    } | jq -Rn -c '[inputs | select(length > 0)] | unique'
+}
+
+
+# Guarded fragments of every module in use for one section, spliced into cloud-init.yaml
+provisioner_sections() {
+    local section="$1" modules="$2" module snippet
+    for module in $modules; do
+        snippet=$(provisioner_snippet "$module" "$section")
+        [ -n "$snippet" ] || continue
+        echo "%{ if contains(modules, \"$module\") ~}"
+        echo "$snippet"
+        echo "%{ endif ~}"
+    done
+}
+
+# Entries of one CLOUD_INIT_FILE directive, one per line without the keyword
+cloud_init_entries() {
+    [ -f "$CLOUD_INIT_FILE" ] || return 0
+    sed 's/^[[:space:]]*//' "$CLOUD_INIT_FILE" | grep -v '^#' | awk -v want="$1" '$1 == want { sub(/^[^[:space:]]+[[:space:]]*/, ""); print }'
+}
+
+# Escape template sequences so a value reaches the instance literally
+hcl_literal_json() {
+    jq -c 'walk(if type == "string" then gsub("\\$\\{"; "$${") | gsub("%\\{"; "%%{") else . end)'
+}
+
+# Render the CLOUD_INIT_FILE variables as an HCL map (templates read them as ${vars.<name>})
+cloud_init_vars_tf() {
+    cloud_init_entries var | jq -Rn '[inputs | capture("^(?<k>[A-Za-z_][A-Za-z0-9_]*)\\s*(?<v>.*)$") | {(.k): .v}] | add // {}' | hcl_literal_json
+}
+
+# YAML for the CLOUD_INIT_FILE packages, runcmd entries and files, spliced into the template
+cloud_init_user_packages() {
+    local line package
+    while IFS= read -r line; do
+        for package in $line; do
+            echo "  - $package"
+        done
+    done < <(cloud_init_entries package)
+}
+
+cloud_init_user_runcmd() {
+    cloud_init_entries runcmd | jq -R -r 'select(length > 0) | "  - \(tojson)"'
+}
+
+cloud_init_user_files() {
+    local path mode source
+    while read -r path mode source _; do
+        [ -n "$source" ] || continue
+        if [ ! -f "$source" ]; then
+            print_error "$CLOUD_INIT_FILE: template $source for $path not found" >&2
+            return 1
+        fi
+        echo "  - path: $path"
+        echo "    permissions: '$mode'"
+        echo "    content: |"
+        sed 's/^/      /;s/^[[:space:]]*$//' "$source"
+    done < <(cloud_init_entries file)
+}
+
+# Render a cloud-init template for every instance (as Terraform's templatefile would) and
+# check that each result is valid YAML. Needs terraform; sample values stand in for the
+# secrets and the Object Storage namespace.
+validate_cloud_init() {
+    local template="$1" dir host vars expr out errors=0 ddns plans provisioners sites secrets hardening firewall users="{}"
+    if ! terraform_available; then
+        print_warning "terraform not found - skipping the per-instance cloud-init check" >&2
+        return 0
+    fi
+    if [ -n "$SSH_AUTHORIZED_USERS" ] || [ -f "$USERS_FILE" ]; then
+        users='{"validate": {"sudo": true, "shell": "/bin/zsh", "keys": ["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA validate"]},
+                "validate2": {"sudo": false, "shell": "/bin/bash", "keys": ["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA validate"]}}'
+    fi
+    ddns=$(ddns_domains_tf)
+    plans=$(backup_plans_tf)
+    provisioners=$(provisioners_tf)
+    sites=$(sites_tf)
+    secrets=$(secrets_tf)
+    hardening=$(hardening_profiles_tf)
+    firewall=$(host_firewall_rules_tf)
+    dir=$(mktemp -d)
+    for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do
+        [ -n "$host" ] || continue
+        vars=$(jq -n -c --arg host "$host" --argjson os "$(os_settings_tf)" --argjson users "$users" \
+            --arg ddns_provider "$DDNS_PROVIDER" --arg ddns_domain "$(jq -r --arg h "$host" '.[$h] // ""' <<< "$ddns")" \
+            --argjson plan "$(jq -c --arg h "$host" '.[$h] // {schedule: "", paths: ""}' <<< "$plans")" \
+            '{hostname: $host, os: $os, users: $users, ddns_provider: $ddns_provider, ddns_domain: $ddns_domain, ddns_token: "token",
+              backup: ({bucket: "bucket", namespace: "namespace", region: "region", compartment: "compartment",
+                        retention: "--keep-daily 7", password: "password"} + $plan)}' | hcl_literal_json)
+        vars=$(jq -c --argjson v "$(cloud_init_vars_tf)" --arg h "$host" --argjson p "$provisioners" --argjson s "$sites" \
+            --argjson k "$secrets" --argjson f "$hardening" --arg profile "$(hardening_profile)" --argjson port "$(ssh_port)" \
+            --argjson fw "$firewall" '. + {vars: $v, modules: ($p[$h] // []), sites: ($s[$h] // []), tailscale_key: "tskey",
+              secrets: {vault: "ocid1.vault.oc1..validate", region: "region", items: ($k[$h] // [])},
+              hardening: {profile: ($f[$h] // $profile), ssh_port: $port, firewall: $fw}}' <<< "$vars")
+        expr="length(yamldecode(templatefile($(jq -Rn --arg p "$template" '$p'), $vars)))"
+        out=$(echo "$expr" | terraform -chdir="$dir" console 2>&1) || true
+        if echo "$out" | grep -q 'Error:'; then
+            print_error "cloud-init for $host does not render to valid YAML:" >&2
+            echo "$out" | sed 's/\x1b\[[0-9;]*m//g;s/^[│╷╵ ]*//' | grep -v '^$' | sed 's/^/    /' >&2
+            errors=$((errors + 1))
+        fi
+    done
+    rm -rf "$dir"
+    [ "$errors" -eq 0 ]
+}
+
+create_cloud_init() {
+    print_status "Creating cloud-init.yaml..."
+    
+    local template packages runcmd files timezone modules
+    packages=$(cloud_init_user_packages)
+    runcmd=$(cloud_init_user_runcmd)
+    files=$(cloud_init_user_files) || return 1
+    timezone=$(cloud_init_entries timezone | tail -1 | awk '{ print $1 }')
+    modules=$(provisioners_tf | jq -r --arg library "$PROVISIONER_MODULES" \
+        '[.[][]] as $used | $library | split(" ") | map(select(IN($used[]))) | join(" ")')
+    template=$(mktemp)
+    
+    sed "s/@SSH_REVERT_TIMEOUT@/$SSH_HARDENING_REVERT_TIMEOUT/g;s|@TIMEZONE@|${timezone:-UTC}|" << 'EOF' \
+        | USER_PACKAGES="$packages" USER_RUNCMD="$runcmd" USER_FILES="$files" \
+          MODULE_PACKAGES="$(provisioner_sections packages "$modules")" \
+          MODULE_RUNCMD="$(provisioner_sections runcmd "$modules")" \
+          MODULE_FILES="$(provisioner_sections files "$modules")" awk '
+            /^@(USER|MODULE)_(PACKAGES|RUNCMD|FILES)@$/ {
+                value = ENVIRON[substr($0, 2, length($0) - 2)]
+                if (value != "") print value
+                next
+            }
+            { print }' | sed "s/@NODE_EXPORTER_VERSION@/$NODE_EXPORTER_VERSION/g;s/@TRAEFIK_VERSION@/$TRAEFIK_VERSION/g;s|@ACME_EMAIL@|$ACME_EMAIL|g" > "$template"
+#cloud-config
+hostname: ${hostname}
+fqdn: ${hostname}.local
+manage_etc_hosts: true
+
+# Default user (the image's, e.g. ubuntu or opc; key from ssh_keys/) plus SSH_AUTHORIZED_USERS
+# and USERS_FILE accounts
+users:
+  - default
+%{ for name, user in users ~}
+  - name: ${name}
+    gecos: CloudCradle user ${name}
+    shell: ${user.shell}
+%{ if user.sudo ~}
+    groups: [adm, ${os.sudo_group}]
+    sudo: ALL=(ALL) NOPASSWD:ALL
+%{ endif ~}
+    lock_passwd: true
+    ssh_authorized_keys: ${jsonencode(user.keys)}
+%{ endfor ~}
+
+package_update: true
+package_upgrade: true
+
+# Package names differ per distro (os_settings in variables.tf); on the RHEL family some
+# come from EPEL, which runcmd enables first
+packages:
+%{ for package in os.packages ~}
+  - ${package}
+%{ endfor ~}
+# Login shells of the accounts other than bash (zsh, fish, ...)
+%{ for shell in setsubtract([for user in values(users) : basename(user.shell)], ["bash", "sh"]) ~}
+  - ${shell}
+%{ endfor ~}
+%{ if backup.paths != "" && os.epel_release == "" ~}
+  - restic
+  - unzip
+%{ endif ~}
+%{ if hardening.profile == "strict" && os.epel_release == "" ~}
+  - ufw
+%{ endif ~}
+# PROVISIONERS_FILE modules
+@MODULE_PACKAGES@
+# CLOUD_INIT_FILE packages
+@USER_PACKAGES@
+
+runcmd:
+  - echo "Instance ${hostname} initialized at $(date)" >> /var/log/cloud-init-complete.log
+%{ if os.epel_release != "" ~}
+  - dnf install -y ${os.epel_release} && dnf install -y ${join(" ", concat(os.epel_packages, backup.paths != "" ? ["restic", "unzip"] : []))}
+%{ endif ~}
+%{ if hardening.profile == "strict" ~}
+  - /usr/local/sbin/cloudcradle-host-firewall
+%{ endif ~}
+%{ if hardening.profile == "minimal" ~}
+  - systemctl disable --now fail2ban || true
+%{ else ~}
+  - systemctl enable --now fail2ban || true
+%{ endif ~}
+  - /usr/local/sbin/cloudcradle-ssh-harden
+%{ if ddns_domain != "" ~}
+  - systemctl daemon-reload
+  - systemctl enable --now cloudcradle-ddns.timer
+%{ endif ~}
+%{ if backup.paths != "" ~}
+  - /usr/local/sbin/cloudcradle-install-rclone
+  - systemctl daemon-reload
+  - systemctl enable --now cloudcradle-backup.timer
+%{ endif ~}
+%{ if length(secrets.items) > 0 ~}
+  - systemctl daemon-reload
+  - systemctl enable --now --no-block cloudcradle-secrets.service
+%{ endif ~}
+# PROVISIONERS_FILE modules
+@MODULE_RUNCMD@
+# CLOUD_INIT_FILE commands
+@USER_RUNCMD@
+
+# Basic security hardening (profile ${hardening.profile}), applied safely: the config is
+# staged, validated with sshd -t, and reverted automatically unless a login is confirmed
+# after the reload.
+write_files:
+  - path: /etc/cloudcradle/sshd-hardening.conf
+    permissions: '0644'
+    content: |
+%{ if hardening.ssh_port != 22 ~}
+      Port ${hardening.ssh_port}
+%{ endif ~}
+      PermitRootLogin no
+      PasswordAuthentication no
+%{ if hardening.profile == "strict" ~}
+      MaxAuthTries 2
+      LoginGraceTime 30
+      X11Forwarding no
+      AllowAgentForwarding no
+%{ else ~}
+      MaxAuthTries 3
+%{ endif ~}
+      ClientAliveInterval 300
+      ClientAliveCountMax 2
+  - path: /usr/local/sbin/cloudcradle-ssh-harden
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      conf=/etc/ssh/sshd_config.d/hardening.conf
+      log() { echo "$(date -Is) cloudcradle-ssh-harden: $*" >> /var/log/cloudcradle-ssh.log; }
+      # Ubuntu 22.10+ listens through ssh.socket, which only picks up a new Port on restart
+      reload_sshd() {
+        if systemctl is-active --quiet ssh.socket; then
+          systemctl daemon-reload && systemctl restart ssh.socket || return 1
+        fi
+        systemctl try-reload-or-restart ssh 2>/dev/null || systemctl reload sshd
+      }
+      mkdir -p /run/sshd /var/lib/cloudcradle
+%{ if hardening.ssh_port != 22 ~}
+      # Let the new port through SELinux and the image's own firewall before sshd moves
+      if command -v semanage >/dev/null; then
+        semanage port -a -t ssh_port_t -p tcp ${hardening.ssh_port} 2>/dev/null || semanage port -m -t ssh_port_t -p tcp ${hardening.ssh_port}
+      fi
+      if systemctl is-active --quiet firewalld; then
+        firewall-cmd --permanent --add-port=${hardening.ssh_port}/tcp && firewall-cmd --reload
+      elif command -v iptables >/dev/null && ! ufw status 2>/dev/null | grep -q 'Status: active'; then
+        iptables -C INPUT -p tcp --dport ${hardening.ssh_port} -j ACCEPT 2>/dev/null || iptables -I INPUT 1 -p tcp --dport ${hardening.ssh_port} -j ACCEPT
+        if command -v netfilter-persistent >/dev/null; then netfilter-persistent save; fi
+      fi
+%{ endif ~}
+      cp /etc/cloudcradle/sshd-hardening.conf "$conf"
+      if ! sshd -t 2>> /var/log/cloudcradle-ssh.log; then
+        log "sshd -t rejected the hardening config; sshd left unchanged"
+        rm -f "$conf"
+        exit 1
+      fi
+      if ! reload_sshd; then
+        log "sshd reload failed; removing the hardening config"
+        rm -f "$conf"
+        reload_sshd
+        exit 1
+      fi
+      systemd-run --unit=cloudcradle-ssh-revert --on-active=@SSH_REVERT_TIMEOUT@ /usr/local/sbin/cloudcradle-ssh-revert
+      log "hardening applied; reverting in @SSH_REVERT_TIMEOUT@s unless a login is confirmed"
+  - path: /usr/local/sbin/cloudcradle-ssh-revert
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      [ -f /var/lib/cloudcradle/ssh-confirmed ] && exit 0
+      rm -f /etc/ssh/sshd_config.d/hardening.conf
+      if systemctl is-active --quiet ssh.socket; then
+        systemctl daemon-reload && systemctl restart ssh.socket
+      fi
+      systemctl try-reload-or-restart ssh 2>/dev/null || systemctl reload sshd
+      echo "$(date -Is) cloudcradle-ssh-revert: no confirmed login, hardening reverted" >> /var/log/cloudcradle-ssh.log
+  - path: /usr/local/sbin/cloudcradle-ssh-confirm
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      # Run over SSH after apply: a successful login proves the hardened sshd accepts keys
+      mkdir -p /var/lib/cloudcradle
+      touch /var/lib/cloudcradle/ssh-confirmed
+      systemctl stop cloudcradle-ssh-revert.timer 2>/dev/null || true
+      sshd -T 2>/dev/null | grep -E '^(port|permitrootlogin|passwordauthentication|maxauthtries) '
+%{ if hardening.profile != "minimal" ~}
+  # fail2ban jails (standard: sshd; strict: aggressive sshd matching plus repeat offenders)
+  - path: /etc/fail2ban/jail.d/cloudcradle.local
+    permissions: '0644'
+    content: |
+      [DEFAULT]
+%{ if hardening.profile == "strict" ~}
+      bantime = 1d
+      findtime = 1h
+      maxretry = 3
+
+      [sshd]
+      enabled = true
+      port = ${hardening.ssh_port}
+      mode = aggressive
+
+      [recidive]
+      enabled = true
+      bantime = 1w
+      findtime = 1d
+%{ else ~}
+      bantime = 1h
+      findtime = 10m
+      maxretry = 5
+
+      [sshd]
+      enabled = true
+      port = ${hardening.ssh_port}
+%{ endif ~}
+%{ endif ~}
+%{ if hardening.profile == "strict" ~}
+  # Host firewall mirroring the security list ("<tcp|udp|all> <ports|-> <cidr>" per line):
+  # ufw on Debian/Ubuntu, firewalld rich rules on the RHEL family
+  - path: /etc/cloudcradle/host-firewall.rules
+    permissions: '0644'
+    content: |
+%{ for rule in hardening.firewall ~}
+      ${rule}
+%{ endfor ~}
+  - path: /usr/local/sbin/cloudcradle-host-firewall
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      rules=/etc/cloudcradle/host-firewall.rules
+      if command -v firewall-cmd >/dev/null; then
+        systemctl enable --now firewalld
+        firewall-cmd --permanent --remove-service=ssh || true
+        while read -r proto ports cidr; do
+          family=ipv4
+          case "$cidr" in *:*) family=ipv6 ;; esac
+          case "$proto" in
+            tcp|udp) [ "$ports" = "-" ] && ports=1-65535
+                     firewall-cmd --permanent --add-rich-rule="rule family=$family source address=$cidr port port=$ports protocol=$proto accept" ;;
+            all) firewall-cmd --permanent --add-rich-rule="rule family=$family source address=$cidr accept" ;;
+          esac
+        done < "$rules"
+        firewall-cmd --reload
+      else
+        # Oracle's Ubuntu images reject everything but SSH in the INPUT chain; ufw takes over
+        if command -v netfilter-persistent >/dev/null; then
+          iptables -F INPUT && ip6tables -F INPUT
+          netfilter-persistent save
+        fi
+        ufw --force reset >/dev/null
+        ufw default deny incoming
+        ufw default allow outgoing
+        while read -r proto ports cidr; do
+          case "$proto" in
+            tcp|udp) if [ "$ports" = "-" ]; then
+                       ufw allow proto "$proto" from "$cidr"
+                     else
+                       ufw allow proto "$proto" from "$cidr" to any port "$(echo "$ports" | tr - :)"
+                     fi ;;
+            all) ufw allow from "$cidr" ;;
+          esac
+        done < "$rules"
+        ufw --force enable
+      fi
+      echo "$(date -Is) cloudcradle-host-firewall: $(wc -l < "$rules") rules applied" >> /var/log/cloudcradle-ssh.log
+%{ endif ~}
+%{ if ddns_domain != "" ~}
+  # Dynamic DNS client (DDNS_PROVIDER): the provider detects the IPv4 address from the
+  # request; the global IPv6 address is sent explicitly
+  - path: /etc/cloudcradle/ddns.env
+    permissions: '0600'
+    content: |
+      DDNS_PROVIDER=${ddns_provider}
+      DDNS_DOMAIN=${ddns_domain}
+      DDNS_TOKEN=${ddns_token}
+  - path: /usr/local/sbin/cloudcradle-ddns
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      . /etc/cloudcradle/ddns.env
+      ip6=$(ip -6 addr show scope global | awk '/inet6/ { sub("/.*", "", $2); print $2; exit }')
+      case "$DDNS_PROVIDER" in
+        duckdns) url="https://www.duckdns.org/update?domains=$DDNS_DOMAIN&token=$DDNS_TOKEN&ipv6=$ip6" ;;
+        dynu) url="https://api.dynu.com/nic/update?hostname=$DDNS_DOMAIN&password=$DDNS_TOKEN&myipv6=$ip6" ;;
+        *) echo "cloudcradle-ddns: unknown provider '$DDNS_PROVIDER'" >&2; exit 1 ;;
+      esac
+      result=$(curl -4 -fsS --max-time 20 "$url" 2>&1) || result="request failed: $result"
+      echo "$(date -Is) $DDNS_PROVIDER $DDNS_DOMAIN ipv6=$ip6: $result" >> /var/log/cloudcradle-ddns.log
+  - path: /etc/systemd/system/cloudcradle-ddns.service
+    content: |
+      [Unit]
+      Description=Update dynamic DNS record
+      Wants=network-online.target
+      After=network-online.target
+
+      [Service]
+      Type=oneshot
+      ExecStart=/usr/local/sbin/cloudcradle-ddns
+  - path: /etc/systemd/system/cloudcradle-ddns.timer
+    content: |
+      [Unit]
+      Description=Update dynamic DNS record on boot and every 5 minutes
+
+      [Timer]
+      OnBootSec=30s
+      OnUnitActiveSec=5min
+
+      [Install]
+      WantedBy=timers.target
+%{ endif ~}
+%{ if backup.paths != "" ~}
+  # Application data backups (BACKUP_SPEC_FILE): restic through rclone's Object Storage
+  # backend, authenticated as the instance (instance principals)
+  - path: /usr/local/sbin/cloudcradle-install-rclone
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      # Install the pinned rclone release, refusing an archive that does not match its checksum
+      set -euo pipefail
+      case "$(uname -m)" in
+        x86_64) arch=amd64 sum="${backup.rclone.sha256.amd64}" ;;
+        aarch64) arch=arm64 sum="${backup.rclone.sha256.arm64}" ;;
+        *) echo "No rclone release for $(uname -m)" >&2; exit 1 ;;
+      esac
+      [ -n "$sum" ] || { echo "No pinned checksum for rclone ${backup.rclone.version} ($arch)" >&2; exit 1; }
+      zip=rclone-v${backup.rclone.version}-linux-$arch.zip
+      tmp=$(mktemp -d)
+      trap 'rm -rf "$tmp"' EXIT
+      curl -fsSL -o "$tmp/$zip" "https://downloads.rclone.org/v${backup.rclone.version}/$zip"
+      echo "$sum  $tmp/$zip" | sha256sum -c --quiet
+      unzip -q -j "$tmp/$zip" '*/rclone' -d "$tmp"
+      install -m 0755 "$tmp/rclone" /usr/local/bin/rclone
+  - path: /etc/cloudcradle/backup.env
+    permissions: '0600'
+    content: |
+      RESTIC_REPOSITORY=rclone:cloudcradle:${backup.bucket}/${hostname}
+      RESTIC_PASSWORD_FILE=/etc/cloudcradle/restic.password
+      RCLONE_CONFIG=/etc/cloudcradle/rclone.conf
+      BACKUP_PATHS="${backup.paths}"
+      BACKUP_RETENTION="${backup.retention}"
+  - path: /etc/cloudcradle/rclone.conf
+    permissions: '0600'
+    content: |
+      [cloudcradle]
+      type = oracleobjectstorage
+      provider = instance_principal_auth
+      namespace = ${backup.namespace}
+      compartment = ${backup.compartment}
+      region = ${backup.region}
+  - path: /usr/local/sbin/cloudcradle-backup
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      # cloudcradle-backup [run | status | restore SNAPSHOT TARGET_DIR [PATH...]]
+      set -a; . /etc/cloudcradle/backup.env; set +a
+      state=/var/lib/cloudcradle/backup-last.json
+      shared=/etc/cloudcradle/restic.shared-password
+      mkdir -p /var/lib/cloudcradle
+      # The password is this instance's own, fetched from the vault by cloudcradle-secrets
+      if [ "$1" != status ] && [ ! -s "$RESTIC_PASSWORD_FILE" ]; then
+        echo "No repository password in $RESTIC_PASSWORD_FILE yet (see systemctl status cloudcradle-secrets)" >&2
+        exit 1
+      fi
+      # A repository created with the password all instances shared in earlier versions gets
+      # this instance's key, and the shared key is removed from it
+      adopt_shared_key() {
+        [ -s "$shared" ] && ! restic cat config >/dev/null 2>&1 || return 0
+        old=$(RESTIC_PASSWORD_FILE=$shared restic key list --json 2>/dev/null | jq -r '.[] | select(.current) | .id') || return 0
+        [ -n "$old" ] || return 0
+        RESTIC_PASSWORD_FILE=$shared restic key add --new-password-file "$RESTIC_PASSWORD_FILE" && restic key remove "$old"
+      }
+      case "$1" in
+        run|"")
+          adopt_shared_key || exit 1
+          restic cat config >/dev/null 2>&1 || restic init || exit 1
+          started=$(date -Is)
+          # shellcheck disable=SC2086  # space-separated lists
+          if restic backup --tag cloudcradle $BACKUP_PATHS && restic forget --prune --tag cloudcradle $BACKUP_RETENTION; then
+            result=ok
+          else
+            result=failed
+          fi
+          jq -n --arg t "$started" --arg r "$result" '{time: $t, result: $r}' > "$state"
+          [ "$result" = ok ]
+          ;;
+        status)
+          snaps=$(restic snapshots --json --tag cloudcradle 2>/dev/null) || snaps=null
+          jq -n --arg paths "$BACKUP_PATHS" --arg repo "$RESTIC_REPOSITORY" --argjson snaps "$snaps" \
+            --argjson last "$(cat "$state" 2>/dev/null || echo null)" \
+            --arg next "$(systemctl show cloudcradle-backup.timer -p NextElapseUSecRealtime --value 2>/dev/null)" \
+            '{paths: ($paths | split(" ")), repository: $repo, reachable: ($snaps != null),
+              snapshots: (($snaps // []) | length),
+              latest: (($snaps // []) | last | if . then {id: .short_id, time: .time} else null end),
+              last_run: $last, next_run: $next}'
+          ;;
+        restore)
+          snapshot="$2" target="$3"
+          [ -n "$snapshot" ] && [ -n "$target" ] || { echo "usage: cloudcradle-backup restore SNAPSHOT TARGET_DIR [PATH...]" >&2; exit 2; }
+          adopt_shared_key || exit 1
+          shift 3
+          for path in "$@"; do set -- "$@" --include "$path"; shift; done
+          restic restore "$snapshot" --tag cloudcradle --target "$target" "$@"
+          ;;
+        *)
+          echo "usage: cloudcradle-backup [run | status | restore SNAPSHOT TARGET_DIR [PATH...]]" >&2
+          exit 2
+          ;;
+      esac
+  - path: /etc/systemd/system/cloudcradle-backup.service
+    content: |
+      [Unit]
+      Description=Back up application data to Object Storage
+      Wants=network-online.target
+      After=network-online.target cloudcradle-secrets.service
+
+      [Service]
+      Type=oneshot
+      Nice=10
+      IOSchedulingClass=idle
+      ExecStart=/usr/local/sbin/cloudcradle-backup run
+  - path: /etc/systemd/system/cloudcradle-backup.timer
+    content: |
+      [Unit]
+      Description=Scheduled application data backup
+
+      [Timer]
+      OnCalendar=${backup.schedule}
+      RandomizedDelaySec=10min
+      Persistent=true
+
+      [Install]
+      WantedBy=timers.target
+%{ endif ~}
+%{ if length(secrets.items) > 0 ~}
+  # Application secrets (SECRETS_FILE): fetched from the vault at every boot as the instance
+  # (instance principals); only the vault OCID and secret names are in this file
+  - path: /etc/cloudcradle/secrets.list
+    permissions: '0644'
+    content: |
+%{ for secret in secrets.items ~}
+      ${secret.name} ${secret.path} ${secret.mode}
+%{ endfor ~}
+  - path: /usr/local/sbin/cloudcradle-fetch-secrets
+    permissions: '0755'
+    content: |
+      #!/bin/bash
+      # Exits non-zero while a secret is missing (not stored yet); systemd retries
+      export OCI_CLI_AUTH=instance_principal
+      if ! command -v oci >/dev/null; then
+        curl -fsSL -o /tmp/oci-cli-install.sh https://raw.githubusercontent.com/oracle/oci-cli/master/scripts/install/install.sh
+        bash /tmp/oci-cli-install.sh --accept-all-defaults --install-dir /opt/oci-cli --exec-dir /usr/local/bin >/dev/null || exit 1
+      fi
+      missing=0
+      while read -r name path mode; do
+        [ -n "$name" ] || continue
+        if content=$(oci secrets secret-bundle get-secret-bundle-by-name --region ${secrets.region} \
+            --vault-id ${secrets.vault} --secret-name "$name" \
+            --query 'data."secret-bundle-content".content' --raw-output 2>/dev/null) && [ -n "$content" ]; then
+          mkdir -p "$(dirname "$path")"
+          (umask 077 && echo "$content" | base64 -d > "$path.new") && chmod "$mode" "$path.new" && mv -f "$path.new" "$path"
+        else
+          echo "Secret $name is not available yet (store it with: setup_oci_terraform.sh secrets set $name)" >&2
+          missing=1
+        fi
+      done < /etc/cloudcradle/secrets.list
+      exit $missing
+  - path: /etc/systemd/system/cloudcradle-secrets.service
+    content: |
+      [Unit]
+      Description=Fetch application secrets from OCI Vault
+      Wants=network-online.target
+      After=network-online.target
+      StartLimitIntervalSec=0
+
+      [Service]
+      Type=oneshot
+      ExecStart=/usr/local/sbin/cloudcradle-fetch-secrets
+      Restart=on-failure
+      RestartSec=60
+
+      [Install]
+      WantedBy=multi-user.target
+%{ endif ~}
+  # PROVISIONERS_FILE modules
+@MODULE_FILES@
+  # CLOUD_INIT_FILE files
+@USER_FILES@
+
+timezone: @TIMEZONE@
+ssh_pwauth: false
+
+final_message: "Instance ${hostname} ready after $UPTIME seconds"
+EOF
+    
+    if ! validate_cloud_init "$template"; then
+        rm -f "$template"
+        print_error "cloud-init.yaml not written - fix $CLOUD_INIT_FILE (write \$\${ for a literal \${ in commands and templates)"
+        return 1
+    fi
+    write_generated_file cloud-init.yaml < "$template"
+    rm -f "$template"
+    print_success "cloud-init.yaml created"
+}
+
+# ============================================================================
+# TERRAFORM IMPORT AND STATE MANAGEMENT
+# ============================================================================
+
+import_existing_resources() {
+    print_header "IMPORTING EXISTING RESOURCES"
+    
+    if ! has_existing_resources; then
+        print_status "No existing resources to import"
+        return 0
+    fi
+    
+    # Initialize Terraform first
+    if [ "$DRY_RUN" != "true" ] && [ "$EMIT_ONLY" != "true" ]; then
+        print_status "Initializing Terraform..."
+        check_terraform_version || true
+        if ! retry_with_backoff "terraform init -input=false" >/dev/null 2>&1; then
+            print_error "Terraform init failed after retries"
+            return 1
+        fi
+    fi
+    
+    # Collect everything first; import_queued_resources then imports parents before children
+    IMPORT_QUEUE=()
+    
+    # VCN and its networking components; any other VCN is adopted as it is
+    if [ ${#EXISTING_VCNS[@]} -gt 0 ]; then
+        local first_vcn_id vcn_id vcn_name
+        first_vcn_id=$(import_target_vcn_id)
+        
+        if [ -n "$first_vcn_id" ]; then
+            vcn_name=$(echo "${EXISTING_VCNS[$first_vcn_id]}" | cut -d'|' -f1)
+            queue_import oci_core_vcn.main "$first_vcn_id" "VCN $vcn_name"
+            import_vcn_components "$first_vcn_id"
+        fi
+        for vcn_id in "${!EXISTING_VCNS[@]}"; do
+            [ "$vcn_id" != "$first_vcn_id" ] || continue
+            vcn_name=$(echo "${EXISTING_VCNS[$vcn_id]}" | cut -d'|' -f1)
+            queue_import "oci_core_vcn.adopted[\"$vcn_name\"]" "$vcn_id" "VCN $vcn_name (adopted as it is)"
+        done
+    fi
+    
+    # Instances
+    for instance_id in "${!EXISTING_AMD_INSTANCES[@]}"; do
+        echo "$instance_id|${EXISTING_AMD_INSTANCES[$instance_id]%%|*}"
+    done | queue_instance_imports amd "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"
+    for instance_id in "${!EXISTING_ARM_INSTANCES[@]}"; do
+        echo "$instance_id|${EXISTING_ARM_INSTANCES[$instance_id]%%|*}"
+    done | queue_instance_imports arm "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"
+    
+    import_block_volumes
+    import_volume_groups
+    import_reserved_public_ips
+    import_autonomous_databases
+    
+    # Emit-only runs print the queue as commands instead (emit_only_next_steps)
+    if [ "$EMIT_ONLY" != "true" ]; then
+        import_queued_resources
+    fi
+    import_coverage_report
+}
+
+# Queue imports of existing instances ("<ocid>|<display name>" lines on stdin) of KIND for
+# the given hostnames. Instances are keyed by hostname: an instance named like one keeps it,
+# the others take the hostnames left over in order (and are renamed by the next apply).
+queue_instance_imports() {
+    local kind="$1" host id name
+    shift
+    local -a instances=() free=()
+    mapfile -t instances
+    local -A taken=()
+    for host in "$@"; do
+        for id in "${instances[@]}"; do
+            [ "${id#*|}" = "$host" ] || continue
+            queue_import "oci_core_instance.$kind[\"$host\"]" "${id%%|*}" "${kind^^} instance $host"
+            taken[${id%%|*}]=1
+            continue 2
+        done
+        free+=("$host")
+    done
+    for id in "${instances[@]}"; do
+        [ ${#free[@]} -gt 0 ] || break
+        [ -z "${taken[${id%%|*}]:-}" ] || continue
+        name="${id#*|}"
+        queue_import "oci_core_instance.$kind[\"${free[0]}\"]" "${id%%|*}" "${kind^^} instance $name (as ${free[0]})"
+        free=("${free[@]:1}")
+    done
+}
+
+# True when the inventory found anything the import step could adopt
+has_existing_resources() {
+    [ ${#EXISTING_VCNS[@]} -gt 0 ] || [ ${#EXISTING_AMD_INSTANCES[@]} -gt 0 ] || [ ${#EXISTING_ARM_INSTANCES[@]} -gt 0 ] \
+        || [ ${#EXISTING_BLOCK_VOLUMES[@]} -gt 0 ] || [ ${#EXISTING_AUTONOMOUS_DBS[@]} -gt 0 ] \
+        || [ ${#EXISTING_RESERVED_IPS[@]} -gt 0 ]
+}
+
+# Discovered resources the template cannot represent: neither in state nor queued for import.
+# One "<kind>|<name>|<id>" line each, kinds in report order.
+unrepresented_resources() {
+    local state_ids covered id entry instance boot attachments ads ad page
+    state_ids=$(terraform_state_ids) || return 1
+    covered=$({
+        [ -z "$state_ids" ] || echo "$state_ids"
+        for entry in "${IMPORT_QUEUE[@]}"; do
+            entry="${entry#*|}"
+            echo "${entry%%|*}"
+        done
+    } | sort -u)
+    _covered() { grep -qxF "$1" <<< "$covered"; }
+
+    for id in "${!EXISTING_VCNS[@]}"; do
+        _covered "$id" || echo "vcn|${EXISTING_VCNS[$id]%%|*}|$id"
+    done
+    for id in "${!EXISTING_SUBNETS[@]}"; do
+        _covered "$id" || echo "subnet|$(cut -d'|' -f1,2 <<< "${EXISTING_SUBNETS[$id]}" | tr '|' ' ')|$id"
+    done
+    for id in "${!EXISTING_INTERNET_GATEWAYS[@]}"; do
+        _covered "$id" || echo "internet-gateway|${EXISTING_INTERNET_GATEWAYS[$id]%%|*}|$id"
+    done
+    for id in "${!EXISTING_ROUTE_TABLES[@]}"; do
+        _covered "$id" || echo "route-table|${EXISTING_ROUTE_TABLES[$id]%%|*}|$id"
+    done
+    for id in "${!EXISTING_SECURITY_LISTS[@]}"; do
+        _covered "$id" || echo "security-list|${EXISTING_SECURITY_LISTS[$id]%%|*}|$id"
+    done
+    for id in "${!EXISTING_NSGS[@]}"; do
+        _covered "$id" || echo "nsg|${EXISTING_NSGS[$id]%%|*}|$id"
+    done
+    for id in "${!EXISTING_AMD_INSTANCES[@]}" "${!EXISTING_ARM_INSTANCES[@]}"; do
+        _covered "$id" || echo "instance|$(cut -d'|' -f1 <<< "${EXISTING_AMD_INSTANCES[$id]:-${EXISTING_ARM_INSTANCES[$id]}}")|$id"
+    done
+
+    # Boot volumes are managed through their instance
+    if [ ${#EXISTING_BOOT_VOLUMES[@]} -gt 0 ]; then
+        attachments="[]"
+        ads=$(availability_domain_names) || return 1
+        while read -r ad; do
+            page=$(oci_list_json "compute boot-volume-attachment list \
+                --compartment-id $tenancy_ocid \
+                --availability-domain $ad \
+                --query 'data[?\"lifecycle-state\"==\`ATTACHED\`].{boot:\"boot-volume-id\",instance:\"instance-id\"}'") || return 1
+            attachments=$(jq -c --argjson page "$page" '. + $page' <<< "$attachments")
+        done <<< "$ads"
+        for id in "${!EXISTING_BOOT_VOLUMES[@]}"; do
+            instance=$(jq -r --arg b "$id" '[.[] | select(.boot == $b)][0].instance // empty' <<< "$attachments")
+            if [ -n "$instance" ] && _covered "$instance"; then
+                continue
+            fi
+            boot="${EXISTING_BOOT_VOLUMES[$id]%%|*}"
+            _covered "$id" || echo "boot-volume|$boot${instance:+ (attached)}|$id"
+        done
+    fi
+
+    for id in "${!EXISTING_BLOCK_VOLUMES[@]}"; do
+        _covered "$id" || echo "block-volume|${EXISTING_BLOCK_VOLUMES[$id]%%|*}|$id"
+    done
+    for id in "${!EXISTING_RESERVED_IPS[@]}"; do
+        _covered "$id" || echo "reserved-ip|$(cut -d'|' -f1,2 <<< "${EXISTING_RESERVED_IPS[$id]}" | tr '|' ' ')|$id"
+    done
+    for id in "${!EXISTING_AUTONOMOUS_DBS[@]}"; do
+        _covered "$id" || echo "autonomous-db|${EXISTING_AUTONOMOUS_DBS[$id]%%|*}|$id"
+    done
+}
+
+# After the import: what was discovered but stays outside Terraform, and how to bring it in
+import_coverage_report() {
+    local records kind name id last=""
+    if ! records=$(unrepresented_resources); then
+        print_warning "Cannot read the Terraform state or the boot volume attachments; skipping the coverage report"
+        return 0
+    fi
+    if [ -z "$records" ]; then
+        print_success "Every discovered resource is managed by the generated configuration"
+        return 0
+    fi
+
+    print_subheader "Discovered but not managed"
+    while IFS='|' read -r kind name id; do
+        if [ "$kind" != "$last" ]; then
+            last="$kind"
+            case "$kind" in
+                vcn)              echo "  VCNs:" ;;
+                subnet)           echo "  Subnets (declare them in $SUBNETS_FILE to manage them):" ;;
+                internet-gateway) echo "  Internet gateways (only the one of the main VCN is represented):" ;;
+                route-table)      echo "  Route tables (only the default and the private one are represented):" ;;
+                security-list)    echo "  Security lists (only the default and the private one are represented):" ;;
+                nsg)              echo "  Network security groups (not part of the template; firewall rules use security lists):" ;;
+                instance)         echo "  Instances beyond the configured AMD/ARM counts:" ;;
+                boot-volume)      echo "  Boot volumes without a managed instance (reclaim detached ones with: $0 cleanup):" ;;
+                block-volume)     echo "  Block volumes not declared in AMD_BLOCK_VOLUMES/ARM_BLOCK_VOLUMES (matched by name):" ;;
+                reserved-ip)      echo "  Reserved public IPs (adopted when named <hostname>-public-ip with RESERVED_PUBLIC_IPS):" ;;
+                autonomous-db)    echo "  Autonomous Databases not listed in AUTONOMOUS_DATABASES:" ;;
+            esac
+        fi
+        printf '    %-32s %s\n' "$name" "$id"
+    done <<< "$records"
+    echo ""
+    print_warning "$(wc -l <<< "$records" | tr -d ' ') discovered resource(s) stay outside Terraform: they keep running and count against the Always Free limits"
+}
+
+# Resource blocks (type.name) holding imported resources: the ones in ADOPTED_FILE plus
+# those the import step is about to adopt (discovered resources not in state yet)
+adopted_resource_blocks() {
+    local entry
+    {
+        [ ! -f "$ADOPTED_FILE" ] || sed 's/#.*//' "$ADOPTED_FILE"
+        IMPORT_QUEUE=()
+        EMIT_ONLY=true import_existing_resources >/dev/null 2>&1 || true
+        for entry in "${IMPORT_QUEUE[@]}"; do
+            entry="${entry%%|*}"
+            echo "${entry%%\[*}"
+        done
+    } | awk 'NF { print $1 }' | sort -u
+}
+
+# Collect ADOPTED_BLOCKS before the files are generated and record new ones in ADOPTED_FILE,
+# so the adopted lifecycle settings outlive the import
+record_adopted_blocks() {
+    local new
+    [ "$ADOPT_IGNORE_CHANGES" != "off" ] || return 0
+    ADOPTED_BLOCKS=$(adopted_resource_blocks)
+    [ -n "$ADOPTED_BLOCKS" ] && [ "$DRY_RUN" != "true" ] || return 0
+
+    new=$(comm -13 <(sed 's/#.*//' "$ADOPTED_FILE" 2>/dev/null | awk 'NF { print $1 }' | sort -u) <(echo "$ADOPTED_BLOCKS"))
+    [ -n "$new" ] || return 0
+    [ -f "$ADOPTED_FILE" ] || echo "# Resource blocks holding imported resources (lifecycle ignore_changes, see ADOPT_IGNORE_CHANGES)" > "$ADOPTED_FILE"
+    echo "$new" >> "$ADOPTED_FILE"
+    print_status "Adopting existing resources - their differences from the template are kept ($ADOPTED_FILE):"
+    print_status "  $(paste -sd' ' <<< "$new")"
+}
+
+# Queue a resource for import_queued_resources unless it is already in state
+queue_import() {
+    local address="$1" resource_id="$2" label="${3:-$1}"
+    if terraform state show "$(tf_address "$address")" >/dev/null 2>&1; then
+        print_status "Already in state: $label"
+        return 0
+    fi
+    IMPORT_QUEUE+=("$address|$resource_id|$label")
+}
+
+# Dependency edges "<parent> <child>" of the generated config: every resource, data source
+# and local depends on the resources, data sources and locals its block references
+# (each node is also paired with itself so tsort lists nodes without edges)
+terraform_dependency_edges() {
+    local dir="${1:-.}" file
+    local -a files=()
+    # The flat layout has no modules/; awk fails on a pattern that matched nothing
+    for file in "$dir"/*.tf "$dir"/modules/*/*.tf; do
+        [ -f "$file" ] && files+=("$file")
+    done
+    [ ${#files[@]} -gt 0 ] || return 0
+    awk '
+        function refs(line,    ref) {
+            while (match(line, /(data\.)?oci_[a-z0-9_]+\.[a-z0-9_]+|local\.[a-z0-9_]+/)) {
+                ref = substr(line, RSTART, RLENGTH)
+                if (ref != node) print ref, node
+                line = substr(line, RSTART + RLENGTH)
+            }
+        }
+        /^(resource|data) "/ {
+            split($0, f, "\"")
+            node = ($1 == "data" ? "data." : "") f[2] "." f[4]
+            print node, node
+            next
+        }
+        /^locals \{/ { in_locals = 1; node = ""; next }
+        /^\}/ { in_locals = 0; node = ""; next }
+        in_locals && /^  [a-z0-9_]+ *=/ { node = "local." $1; print node, node }
+        node != "" { sub(/#.*/, ""); refs($0) }
+    ' "${files[@]}"
+}
+
+# Indices of IMPORT_QUEUE, one per line, in the order of the dependency EDGES: a stable
+# sort by graph rank, with addresses missing from the config last
+import_queue_order() {
+    local edges="$1" node address i=0
+    local -A rank=()
+    while read -r node; do
+        [ -n "$node" ] && rank[$node]=$i
+        i=$((i + 1))
+    done < <(tsort <<< "$edges" 2>/dev/null)
+    for i in "${!IMPORT_QUEUE[@]}"; do
+        address="${IMPORT_QUEUE[$i]%%|*}"
+        printf '%s\t%s\n' "${rank[${address%%[*}]:-999999}" "$i"
+    done | sort -n -k1,1 -k2,2 | cut -f2
+}
+
+# Run IMPORT_QUEUE in the order of the config's dependency graph (VCN before subnets
+# before instances before attachments). A resource whose ancestor failed to import is
+# skipped, since its import would fail or bind it to the wrong parent; re-run to retry.
+import_queued_resources() {
+    if [ ${#IMPORT_QUEUE[@]} -eq 0 ]; then
+        print_status "Nothing left to import"
+        return 0
+    fi
+
+    local dir=. edges parent child node entry address resource_id label blocked i
+    local imported=0 failed=0 skipped=0
+    local -A parents=() failed_nodes=() seen=()
+    local -a pending=() more=() ordered=()
+    [ "$DRY_RUN" = "true" ] && dir="$DRY_RUN_DIR"
+
+    edges=$(terraform_dependency_edges "$dir")
+    while read -r parent child; do
+        [ -n "$child" ] && [ "$parent" != "$child" ] && parents[$child]+=" $parent"
+    done <<< "$edges"
+    mapfile -t ordered < <(import_queue_order "$edges")
+
+    for i in "${ordered[@]}"; do
+        entry="${IMPORT_QUEUE[$i]}"
+        address="${entry%%|*}"
+        resource_id=$(echo "$entry" | cut -d'|' -f2)
+        label="${entry#*|*|}"
+        node="${address%%[*}"
+
+        # Walk up the graph looking for a resource that failed to import
+        blocked=""
+        seen=()
+        read -r -a pending <<< "${parents[$node]:-}"
+        while [ ${#pending[@]} -gt 0 ] && [ -z "$blocked" ]; do
+            parent="${pending[0]}"
+            pending=("${pending[@]:1}")
+            [ -z "${seen[$parent]:-}" ] || continue
+            seen[$parent]=1
+            if [ -n "${failed_nodes[$parent]:-}" ]; then
+                blocked="$parent"
+            else
+                read -r -a more <<< "${parents[$parent]:-}"
+                pending+=("${more[@]}")
+            fi
+        done
+
+        if [ -n "$blocked" ]; then
+            print_warning "Skipping $label: it depends on $blocked, which failed to import"
+            failed_nodes[$node]=1
+            skipped=$((skipped + 1))
+            continue
+        fi
+
+        print_status "Importing $label"
+        if terraform_import_with_retries "$address" "$resource_id"; then
+            [ "$DRY_RUN" = "true" ] || print_success "  Imported $address"
+            imported=$((imported + 1))
+        else
+            print_warning "  Failed to import $address (see logs above)"
+            failed_nodes[$node]=1
+            failed=$((failed + 1))
+        fi
+    done
+
+    print_status ""
+    if [ "$DRY_RUN" = "true" ]; then
+        print_success "[dry-run] $imported resources would be imported"
+    else
+        print_success "Import complete: $imported imported, $failed failed, $skipped skipped"
+    fi
+}
+
+# Import one resource into state. In dry-run mode it is only recorded (and later
+# previewed via import blocks) so the real state is never touched.
+terraform_import_with_retries() {
+    local address resource_id="$2"
+    address=$(tf_address "$1")
+    if [ "$DRY_RUN" = "true" ]; then
+        DRY_RUN_IMPORTS+=("$address|$resource_id")
+        print_status "  [dry-run] Would import $address <- $resource_id"
+        return 0
+    fi
+    run_cmd_with_retries_and_check "terraform import \"$address\" \"$resource_id\"" >/dev/null 2>&1
+}
+
+# Adopt existing reserved IPs named "<hostname>-public-ip" for RESERVED_PUBLIC_IPS hosts
+import_reserved_public_ips() {
+    [ -n "$RESERVED_PUBLIC_IPS" ] || return 0
+
+    local hostname kind address id ip_id ip_address
+    for hostname in $(reserved_ip_hostnames_tf | jq -r '.[]'); do
+        kind="amd"
+        printf '%s\n' "${arm_flex_hostnames[@]}" | grep -qxF "$hostname" && kind="arm"
+        address="oci_core_public_ip.${kind}_reserved[\"$hostname\"]"
+
+        ip_id=""
+        for id in "${!EXISTING_RESERVED_IPS[@]}"; do
+            [ "${EXISTING_RESERVED_IPS[$id]%%|*}" = "$hostname-public-ip" ] && ip_id="$id" && break
+        done
+        [ -n "$ip_id" ] || continue
+        ip_address=$(cut -d'|' -f2 <<< "${EXISTING_RESERVED_IPS[$ip_id]}")
+
+        queue_import "$address" "$ip_id" "reserved public IP of $hostname ($ip_address)"
+    done
+}
+
+# Queue the NAT/service gateways, route table, security list and subnet of an existing
+# two-tier layout
+import_private_subnet_components() {
+    local vcn_id="$1" id
+
+    id=$(oci_cmd "network nat-gateway list --compartment-id $tenancy_ocid --vcn-id $vcn_id \
+        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`] | [0].id' --raw-output" 2>/dev/null) || id=""
+    if [ -n "$id" ] && [ "$id" != "null" ]; then
+        queue_import 'oci_core_nat_gateway.main[0]' "$id" "NAT gateway"
+    fi
+
+    if [ "$SERVICE_GATEWAY" = "true" ]; then
+        id=$(oci_cmd "network service-gateway list --compartment-id $tenancy_ocid --vcn-id $vcn_id \
+            --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`] | [0].id' --raw-output" 2>/dev/null) || id=""
+        if [ -n "$id" ] && [ "$id" != "null" ]; then
+            queue_import 'oci_core_service_gateway.main[0]' "$id" "service gateway"
+        fi
+    fi
+
+    for id in "${!EXISTING_ROUTE_TABLES[@]}"; do
+        if [ "${EXISTING_ROUTE_TABLES[$id]}" = "private-rt|$vcn_id" ]; then
+            queue_import 'oci_core_route_table.private[0]' "$id" "private route table"
+        fi
+    done
+
+    for id in "${!EXISTING_SECURITY_LISTS[@]}"; do
+        if [ "${EXISTING_SECURITY_LISTS[$id]}" = "private-sl|$vcn_id" ]; then
+            queue_import 'oci_core_security_list.private[0]' "$id" "private security list"
+        fi
+    done
+
+    for id in "${!EXISTING_SUBNETS[@]}"; do
+        if [[ "${EXISTING_SUBNETS[$id]}" == "private-subnet|"*"|$vcn_id|"* ]]; then
+            queue_import 'oci_core_subnet.private[0]' "$id" "private subnet"
+        fi
+    done
+}
+
+import_vcn_components() {
+    local vcn_id="$1"
+    
+    # Import Internet Gateway
+    for ig_id in "${!EXISTING_INTERNET_GATEWAYS[@]}"; do
+        local ig_vcn
+        ig_vcn=$(echo "${EXISTING_INTERNET_GATEWAYS[$ig_id]}" | cut -d'|' -f2)
+        if [ "$ig_vcn" = "$vcn_id" ]; then
+            queue_import oci_core_internet_gateway.main "$ig_id" "internet gateway"
+            break
+        fi
+    done
+    
+    # Import Subnet (the private subnet of a two-tier layout and SUBNETS_FILE subnets are
+    # handled below)
+    for subnet_id in "${!EXISTING_SUBNETS[@]}"; do
+        local subnet_vcn subnet_name
+        subnet_vcn=$(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f3)
+        subnet_name=$(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f1)
+        if [ "$subnet_vcn" = "$vcn_id" ] && [ "$subnet_name" != "private-subnet" ] && ! is_extra_subnet "$subnet_id"; then
+            queue_import oci_core_subnet.main "$subnet_id" "subnet"
+            break
+        fi
+    done
+
+    # Adopt SUBNETS_FILE subnets by display name, else by CIDR
+    local spec extra_name extra_cidr
+    load_subnet_specs
+    for spec in "${SUBNET_SPECS[@]}"; do
+        read -r extra_name extra_cidr _ <<< "$spec"
+        subnet_id=$(existing_extra_subnet_id "$extra_name" "$extra_cidr" "$vcn_id")
+        [ -n "$subnet_id" ] || continue
+        queue_import "oci_core_subnet.extra[\"$extra_name\"]" "$subnet_id" \
+            "subnet $extra_name ($(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f1), $(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f2))"
+    done
+
+    if [ "$NETWORK_TOPOLOGY" = "two-tier" ]; then
+        import_private_subnet_components "$vcn_id"
+    fi
+    
+    # Import Route Table (default)
+    for rt_id in "${!EXISTING_ROUTE_TABLES[@]}"; do
+        local rt_vcn rt_name
+        rt_vcn=$(echo "${EXISTING_ROUTE_TABLES[$rt_id]}" | cut -d'|' -f2)
+        rt_name=$(echo "${EXISTING_ROUTE_TABLES[$rt_id]}" | cut -d'|' -f1)
+        if [ "$rt_vcn" = "$vcn_id" ] && [[ "${EXISTING_ROUTE_TABLES[$rt_id]}" == *"|default" || "$rt_name" == *"Default"* || "$rt_name" == *"default"* ]]; then
+            queue_import oci_core_default_route_table.main "$rt_id" "default route table"
+            break
+        fi
+    done
+    
+    # Import Security List (default)
+    for sl_id in "${!EXISTING_SECURITY_LISTS[@]}"; do
+        local sl_vcn sl_name
+        sl_vcn=$(echo "${EXISTING_SECURITY_LISTS[$sl_id]}" | cut -d'|' -f2)
+        sl_name=$(echo "${EXISTING_SECURITY_LISTS[$sl_id]}" | cut -d'|' -f1)
+        if [ "$sl_vcn" = "$vcn_id" ] && [[ "${EXISTING_SECURITY_LISTS[$sl_id]}" == *"|default" || "$sl_name" == *"Default"* || "$sl_name" == *"default"* ]]; then
+            queue_import oci_core_default_security_list.main "$sl_id" "default security list"
+            break
+        fi
+    done
+}
+
+# ============================================================================
+# CAPACITY HISTORY
+# ============================================================================
+
+# Instance shapes the saved plan creates (the ones subject to capacity errors)
+capacity_planned_shapes() {
+    [ -f tfplan ] || return 0
+    terraform show -json tfplan 2>/dev/null | jq -r '
+        [.resource_changes[]? | select(.type == "oci_core_instance" and (.change.actions | index("create")))
+         | .change.after.shape] | unique[]' 2>/dev/null
+}
+
+# Shapes named in an apply error (via the failing resource address), else the planned ones
+capacity_failed_shapes() {
+    local out="$1"
+    shift
+    local found=""
+    echo "$out" | grep -q 'oci_core_instance\.amd' && found="$FREE_TIER_AMD_SHAPE"
+    echo "$out" | grep -q 'oci_core_instance\.arm' && found="$found $FREE_TIER_ARM_SHAPE"
+    echo "${found:-$*}"
+}
+
+# record_capacity_event success|out_of_capacity SHAPE...
+record_capacity_event() {
+    local result="$1" shape now
+    shift
+    [ $# -gt 0 ] || return 0
+    now=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+    for shape in "$@"; do
+        jq -nc --arg ts "$now" --arg result "$result" --arg shape "$shape" \
+            --arg region "$region" --arg ad "${availability_domain:-unknown}" --argjson hour "$((10#$(date -u +%H)))" \
+            '{ts: $ts, hour: $hour, result: $result, region: $region, ad: $ad, shape: $shape}' \
+            >> "$CAPACITY_HISTORY_FILE" 2>/dev/null || true
+    done
+}
+
+# Per shape: attempts, successes, and the 3-hour UTC window / AD with the most successes
+capacity_stats_json() {
+    [ -s "$CAPACITY_HISTORY_FILE" ] || { echo "[]"; return 0; }
+    jq -sc '
+        group_by(.shape) | map(
+            . as $events
+            | ([$events[] | select(.result == "success")]) as $ok
+            | {
+                shape: $events[0].shape,
+                attempts: ($events | length),
+                successes: ($ok | length),
+                failures: ([$events[] | select(.result != "success")] | length),
+                last_success: ($ok | map(.ts) | max),
+                best_window: (if ($ok | length) == 0 then null else
+                    ([range(0; 24) as $start
+                      | {start: $start,
+                         events: [$ok[] | select(((.hour - $start + 24) % 24) < 3)]}]
+                     | max_by(.events | length)
+                     | {start, end: ((.start + 3) % 24), successes: (.events | length),
+                        ad: (.events | group_by(.ad) | max_by(length) | .[0].ad)})
+                  end)
+              })
+    ' "$CAPACITY_HISTORY_FILE" 2>/dev/null || echo "[]"
+}
+
+# "AD-2" from "Uocm:PHX-AD-2"
+short_ad_name() {
+    echo "$1" | sed -E 's/.*-(AD-[0-9]+)$/\1/'
+}
+
+# capacity-stats [--json]
+show_capacity_stats() {
+    local stats
+    stats=$(capacity_stats_json)
+    if [ "${1:-}" = "--json" ]; then
+        echo "$stats" | jq .
+        return 0
+    fi
+    if [ "$stats" = "[]" ]; then
+        print_status "No capacity history yet ($CAPACITY_HISTORY_FILE)"
+        return 0
+    fi
+
+    print_subheader "Capacity history ($CAPACITY_HISTORY_FILE)"
+    local shape attempts successes last start end ad window_ok
+    while IFS=$'\t' read -r shape attempts successes last start end ad window_ok; do
+        printf '  %-22s %3s attempts, %3s succeeded (last: %s)\n' "$shape" "$attempts" "$successes" "${last:-never}"
+        if [ -n "$start" ]; then
+            printf '  %-22s capacity succeeded most often between %02d:00-%02d:00 UTC in %s (%s of %s)\n' \
+                "" "$start" "$end" "$(short_ad_name "$ad")" "$window_ok" "$successes"
+        fi
+    done < <(echo "$stats" | jq -r '.[] | [.shape, .attempts, .successes, (.last_success // ""),
+        (.best_window.start // ""), (.best_window.end // ""), (.best_window.ad // ""),
+        (.best_window.successes // "")] | @tsv')
+}
+
+# Hours until the best historical window for SHAPE opens (0 = inside it now); empty without history
+capacity_hours_until_window() {
+    local shape="$1" start hour
+    start=$(capacity_stats_json | jq -r --arg s "$shape" '.[] | select(.shape == $s) | .best_window.start // empty')
+    [ -n "$start" ] || return 0
+    hour=$((10#$(date -u +%H)))
+    if [ $(( (hour - start + 24) % 24 )) -lt 3 ]; then
+        echo 0
+    else
+        echo $(( (start - hour + 24) % 24 ))
+    fi
+}
+
+# Seconds until the best historical window for SHAPE opens (0 = inside it); empty without history
+capacity_seconds_until_window() {
+    local hours
+    hours=$(capacity_hours_until_window "$1")
+    [ -n "$hours" ] || return 0
+    if [ "$hours" -eq 0 ]; then
+        echo 0
+    else
+        echo $(( hours * 3600 - 10#$(date -u +%M) * 60 - 10#$(date -u +%S) ))
+    fi
+}
+
+# Seconds left in HUNT_QUIET_HOURS ("start-end", local time, may wrap midnight); 0 outside
+hunt_quiet_remaining() {
+    if [[ ! "$HUNT_QUIET_HOURS" =~ ^([0-9]{1,2})-([0-9]{1,2})$ ]]; then
+        echo 0
+        return 0
+    fi
+    local start=$((10#${BASH_REMATCH[1]})) end=$((10#${BASH_REMATCH[2]})) hour quiet=false
+    hour=$((10#$(date +%H)))
+    if [ "$start" -lt "$end" ]; then
+        [ "$hour" -ge "$start" ] && [ "$hour" -lt "$end" ] && quiet=true
+    elif [ "$start" -gt "$end" ]; then
+        { [ "$hour" -ge "$start" ] || [ "$hour" -lt "$end" ]; } && quiet=true
+    fi
+    if [ "$quiet" != "true" ]; then
+        echo 0
+        return 0
+    fi
+    echo $(( ((end - hour + 24) % 24) * 3600 - 10#$(date +%M) * 60 - 10#$(date +%S) ))
+}
+
+# hunt_next_delay ATTEMPT [SHAPE...]: seconds to wait before the next apply attempt
+hunt_next_delay() {
+    local attempt="$1"
+    shift
+    local delay scheduler="$HUNT_SCHEDULER"
+
+    if [ "$scheduler" = "adaptive" ]; then
+        local shape wait best=""
+        for shape in "$@"; do
+            wait=$(capacity_seconds_until_window "$shape")
+            [ -n "$wait" ] || continue
+            if [ -z "$best" ] || [ "$wait" -lt "$best" ]; then
+                best="$wait"
+            fi
+        done
+        if [ -z "$best" ]; then
+            scheduler="jittered"
+        elif [ "$best" -eq 0 ]; then
+            scheduler="fixed"
+        else
+            delay=$(HUNT_SCHEDULER=jittered hunt_next_delay "$attempt")
+            [ "$best" -lt "$delay" ] && delay="$best"
+        fi
+    fi
+
+    case "$scheduler" in
+        adaptive)
+            ;;
+        fixed)
+            delay="$RETRY_BASE_DELAY"
+            ;;
+        jittered)
+            # Double once per earlier attempt, stopping at the cap so a long hunt cannot
+            # overflow the shell's 64-bit arithmetic
+            local i
+            delay="$RETRY_BASE_DELAY"
+            for ((i = 1; i < attempt && delay > 0 && delay < HUNT_MAX_DELAY; i++)); do
+                delay=$((delay * 2))
+            done
+            [ "$delay" -gt "$HUNT_MAX_DELAY" ] && delay="$HUNT_MAX_DELAY"
+            if [ "$HUNT_JITTER_PCT" -gt 0 ]; then
+                local spread=$(( delay * HUNT_JITTER_PCT / 100 ))
+                delay=$(( delay - spread + RANDOM % (2 * spread + 1) ))
+            fi
+            ;;
+        *)
+            print_warning "Unknown HUNT_SCHEDULER '$HUNT_SCHEDULER' - using jittered" >&2
+            delay=$(HUNT_SCHEDULER=jittered hunt_next_delay "$attempt")
+            ;;
+    esac
+
+    [ "$delay" -gt "$HUNT_MAX_DELAY" ] && delay="$HUNT_MAX_DELAY"
+    [ "$delay" -lt 1 ] && delay=1
+    echo "$delay"
+}
+
+# After giving up on capacity, point at the historically best time to try again
+capacity_retry_hint() {
+    local stats line shape start end ad
+    stats=$(capacity_stats_json)
+    while IFS=$'\t' read -r shape start end ad; do
+        [ -n "$start" ] || continue
+        line=$(printf '%s capacity succeeded most often between %02d:00-%02d:00 UTC in %s' \
+            "$shape" "$start" "$end" "$(short_ad_name "$ad")")
+        local hours
+        hours=$(capacity_hours_until_window "$shape")
+        if [ "$hours" = "0" ]; then
+            print_status "Hint: $line - that window is open now, retrying soon may pay off"
+        else
+            print_status "Hint: $line - next window opens in ${hours}h"
+        fi
+    done < <(echo "$stats" | jq -r '.[] | select(.best_window) | [.shape, .best_window.start, .best_window.end, .best_window.ad] | @tsv')
+}
+
+# ============================================================================
+# TERRAFORM WORKFLOW
+# ============================================================================
+
+# Preview imports and the plan in a scratch copy of the workspace. Imports are expressed
+# as import blocks (Terraform >= 1.5) so the plan shows them without touching state.
+dry_run_terraform_preview() {
+    print_header "DRY RUN: TERRAFORM PREVIEW"
+
+    local f
+    for f in *.tf cloud-init.yaml terraform.tfstate .terraform.lock.hcl; do
+        if [ -f "$f" ] && [ ! -f "$DRY_RUN_DIR/$f" ]; then
+            cp "$f" "$DRY_RUN_DIR/"
+        fi
+    done
+    if [ -d ssh_keys ] && [ ! -d "$DRY_RUN_DIR/ssh_keys" ]; then
+        cp -r ssh_keys "$DRY_RUN_DIR/"
+    fi
+    # Your own files in the modules next to the generated ones
+    [ "$LAYOUT" = "modules" ] && [ -d modules ] && cp -rn modules "$DRY_RUN_DIR/"
+
+    if has_existing_resources; then
+        import_existing_resources
+    fi
+
+    local entry
+    for entry in "${DRY_RUN_IMPORTS[@]}"; do
+        printf 'import {\n  to = %s\n  id = "%s"\n}\n\n' "${entry%%|*}" "${entry#*|}"
+    done > "$DRY_RUN_DIR/dry_run_imports.tf"
+
+    print_status "Running terraform plan against a scratch copy of the workspace..."
+    check_terraform_version || true
+    if ! terraform -chdir="$DRY_RUN_DIR" init -input=false >/dev/null 2>&1; then
+        print_error "terraform init failed in scratch workspace"
+        return 1
+    fi
+    prepare_terraform_selection "$DRY_RUN_DIR" || return 1
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform -chdir="$DRY_RUN_DIR" plan -input=false -lock=false $(terraform_plan_args) "${TF_SELECTION_ARGS[@]}"; then
+        print_error "terraform plan failed"
+        return 1
+    fi
+
+    print_success "Dry run complete - no files written, nothing imported or applied"
+}
+
+# Emit-only mode: the files are written; collect the imports the workflow would run and
+# print the remaining steps as copy-pasteable commands, in the order the workflow runs them
+emit_only_next_steps() {
+    local i entry address resource_id edges
+    local -a ordered=()
+
+    IMPORT_QUEUE=()
+    import_existing_resources || true
+
+    print_header "NEXT STEPS (EMIT-ONLY)"
+    print_warning "Terraform was not run. Install Terraform or OpenTofu, then run the commands below"
+    print_status "  Terraform: https://developer.hashicorp.com/terraform/install"
+    print_status "  OpenTofu:  https://opentofu.org/docs/intro/install/ (use 'tofu' in place of 'terraform')"
+    echo ""
+    echo "  cd '$PWD'"
+    [ -f "$ADB_ADMIN_PASSWORD_FILE" ] && echo "  export TF_VAR_adb_admin_password=\"\$(cat '$ADB_ADMIN_PASSWORD_FILE')\""
+    [ -n "${TF_VAR_ddns_token:-}" ] && echo "  export TF_VAR_ddns_token=...         # your DDNS_TOKEN"
+    [ -n "${TF_VAR_tailscale_auth_key:-}" ] && echo "  export TF_VAR_tailscale_auth_key=... # your TAILSCALE_AUTH_KEY"
+    state_encryption_enabled && echo "  export TF_VAR_state_passphrase=...   # state encryption key (TOFU_STATE_ENCRYPTION)"
+    echo "  terraform init -input=false"
+    [ -n "$(lock_file_missing_platforms)" ] && echo "  terraform providers lock -platform=${TF_LOCK_PLATFORMS// / -platform=}"
+    if [ ${#IMPORT_QUEUE[@]} -gt 0 ]; then
+        edges=$(terraform_dependency_edges .)
+        mapfile -t ordered < <(import_queue_order "$edges")
+        for i in "${ordered[@]}"; do
+            entry="${IMPORT_QUEUE[$i]}"
+            address="${entry%%|*}"
+            resource_id=$(echo "$entry" | cut -d'|' -f2)
+            echo "  terraform import -input=false '$(tf_address "$address")' '$resource_id'"
+        done
+    fi
+    # Without Terraform there is no state to check --target/--replace addresses against
+    local selection="" arg
+    prepare_terraform_selection || true
+    for arg in "${TF_SELECTION_ARGS[@]}"; do
+        selection="$selection '$arg'"
+    done
+    echo "  terraform plan -input=false -out=tfplan $(terraform_plan_args)$selection"
+    echo "  terraform apply $(terraform_apply_args) tfplan"
+    [ ! -f "$BACKUP_SPEC_FILE" ] || echo "  $0 backup passwords"
+    echo ""
+    print_status "Or re-run this script once Terraform is installed - it picks up from the generated files"
+}
+
+# ============================================================================
+# PLAN SUMMARY
+# ============================================================================
+
+# Resource types whose destruction loses a running instance or data (flagged in red)
+readonly PLAN_RISKY_TYPES="oci_core_instance oci_core_volume oci_core_boot_volume oci_core_volume_attachment
+oci_core_volume_group oci_core_volume_backup oci_core_volume_group_backup oci_database_autonomous_database
+oci_objectstorage_bucket oci_core_public_ip"
+
+# Changes of a saved plan, one JSON object per line: {action, address, type, attrs, risky}.
+# action is create, update, replace, delete, read, import or move; attrs are the changed
+# top-level attributes (for replace, the ones forcing it). Resources without changes are skipped.
+plan_changes() {
+    local plan="${1:-tfplan}"
+    terraform show -json "$plan" 2>/dev/null | jq -c --arg risky "$PLAN_RISKY_TYPES" '
+        ($risky | split("\\s+"; null)) as $risky_types
+        | .resource_changes[]? | .change as $c | $c.actions as $a
+        | (if ($a | index("delete")) and ($a | index("create")) then "replace"
+           elif $a == ["delete"] then "delete"
+           elif $a == ["create"] then "create"
+           elif $a == ["update"] then "update"
+           elif $a == ["read"] then "read"
+           elif $c.importing then "import"
+           elif .previous_address then "move"
+           else empty end) as $action
+        | {action: $action, address: .address, type: .type,
+           from: (.previous_address // null),
+           attrs: (if $action == "replace" then [($c.replace_paths // [])[] | .[0] | tostring] | unique
+                   elif $action == "update" then
+                       ($c.before // {}) as $before | ($c.after_unknown // {}) as $unknown
+                       | [($c.after // {}) | to_entries[]
+                          | select(.value != $before[.key] or ($unknown[.key] // false) == true) | .key]
+                   else [] end),
+           risky: (($action == "replace" or $action == "delete") and (.type as $t | $risky_types | index($t)) != null)}'
+}
+
+# Print the changes grouped by action, destructive ones on instances and volumes in red
+plan_summary() {
+    local changes="$1"
+    if [ -z "$changes" ]; then
+        print_status "No changes. Infrastructure matches the configuration."
+        return 0
+    fi
+
+    local counts
+    counts=$(jq -rs 'def n(a): [.[] | select(.action == a)] | length;
+        "Plan: \(n("create")) to add, \(n("update")) to change, \(n("replace")) to replace, \(n("delete")) to destroy"
+        + (if n("import") > 0 then ", \(n("import")) to import" else "" end)
+        + (if n("move") > 0 then ", \(n("move")) to move" else "" end)' <<< "$changes")
+    echo -e "  ${BOLD}$counts${NC}"
+
+    local action symbol color label address attrs risky
+    for action in create update replace delete import move read; do
+        case "$action" in
+            create)  symbol="+";   color="$GREEN";  label="create" ;;
+            update)  symbol="~";   color="$YELLOW"; label="update in place" ;;
+            replace) symbol="-/+"; color="$YELLOW"; label="destroy and re-create" ;;
+            delete)  symbol="-";   color="$YELLOW"; label="destroy" ;;
+            import)  symbol="<=";  color="$CYAN";   label="import" ;;
+            move)    symbol="->";  color="$CYAN";   label="move in state" ;;
+            read)    symbol="<=";  color="$CYAN";   label="read (data source)" ;;
+        esac
+        jq -se --arg a "$action" 'any(.[]; .action == $a)' <<< "$changes" >/dev/null || continue
+        echo ""
+        echo -e "  ${color}${symbol} ${label}${NC}"
+        while IFS=$'\t' read -r risky address attrs; do
+            [ -z "$attrs" ] || attrs="  ($attrs)"
+            if [ "$risky" = "true" ]; then
+                echo -e "    ${RED}${BOLD}${address}${attrs}${NC}"
+            else
+                echo -e "    ${address}${attrs}"
+            fi
+        done < <(jq -r --arg a "$action" 'select(.action == $a)
+            | [.risky, (if .from then "\(.from) -> \(.address)" else .address end),
+               ((.attrs[:4] | join(", ")) + (if (.attrs | length) > 4 then ", ..." else "" end))] | @tsv' <<< "$changes")
+    done
+
+    if jq -se 'any(.[]; .risky)' <<< "$changes" >/dev/null; then
+        echo ""
+        print_warning "Resources in red are instances, volumes or backups that would be destroyed:"
+        print_warning "their disks and data are lost unless backed up."
+    fi
+}
+
+# Second confirmation for a plan that destroys or replaces resources: type "destroy".
+# Unattended runs refuse such a plan unless ALLOW_DESTROY=true.
+confirm_plan_destroy() {
+    local changes="$1" count answer
+    count=$(jq -s '[.[] | select(.action == "delete" or .action == "replace")] | length' <<< "$changes")
+    [ "$count" -gt 0 ] || return 0
+
+    if [ "$AUTO_DEPLOY" = "true" ] || [ "$NON_INTERACTIVE" = "true" ]; then
+        if [ "$ALLOW_DESTROY" = "true" ]; then
+            print_warning "The plan destroys $count resource(s) - applying anyway (ALLOW_DESTROY=true)"
+            return 0
+        fi
+        print_error "The plan destroys $count resource(s); not applying it unattended"
+        print_status "Review it with: terraform show tfplan - then apply by hand or set ALLOW_DESTROY=true"
+        return 1
+    fi
+
+    echo -n -e "${RED}${BOLD}The plan destroys $count resource(s). Type 'destroy' to apply it: ${NC}"
+    read -r answer
+    if [ "$answer" != "destroy" ]; then
+        print_status "Not confirmed"
+        return 1
+    fi
+}
+
+# What --target, --replace or --refresh-only restricted a saved plan to
+plan_selection_summary() {
+    local plan="${1:-tfplan}" arg drift
+    [ ${#TF_SELECTION_ARGS[@]} -gt 0 ] || return 0
+    echo ""
+    for arg in "${TF_SELECTION_ARGS[@]}"; do
+        case "$arg" in
+            -target=*)  print_status "  Limited to ${arg#-target=} (and what it depends on)" ;;
+            -replace=*) print_warning "  Replaces ${arg#-replace=} even though its configuration is unchanged" ;;
+            -refresh-only)
+                drift=$(terraform show -json "$plan" 2>/dev/null | jq '.resource_drift // [] | length')
+                print_status "  Refresh only: ${drift:-0} resource(s) changed outside Terraform are written to state, nothing else changes"
+                ;;
+        esac
+    done
+    [[ " ${TF_SELECTION_ARGS[*]}" == *" -target="* ]] \
+        && print_warning "  A targeted plan leaves other pending changes out - run a full plan afterwards"
+    return 0
+}
+
+# plan|apply [--yes]: plan the Terraform files as they are, without inventory or
+# regeneration, honouring --target, --replace and --refresh-only; apply then applies
+# the plan after the usual confirmations (--yes skips the first one)
+plan_apply_command() {
+    local mode="$1" yes=false changes
+    shift
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --yes|-y)
+                yes=true
+                shift
+                ;;
+            *)
+                print_error "Usage: $mode [--target ADDR]... [--replace ADDR]... [--refresh-only]$([ "$mode" = "apply" ] && echo " [--yes]")"
+                return 2
+                ;;
+        esac
+    done
+    if [ ! -f main.tf ]; then
+        print_error "No main.tf here - run $0 first to generate the Terraform files"
+        return 1
+    fi
+    if ! terraform_available; then
+        print_error "$(terraform_engine) is not installed - run $0 first, or use --emit-only"
+        return 1
+    fi
+    if [ ! -d .terraform ]; then
+        check_terraform_version || true
+        if ! retry_with_backoff "terraform init -input=false" >/dev/null 2>&1; then
+            print_error "Terraform init failed after retries"
+            return 1
+        fi
+    fi
+    prepare_terraform_selection || return 1
+
+    rm -f "$TF_PLAN_CACHE_FILE"
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! trace_run "terraform plan" terraform plan -out=tfplan -input=false $(terraform_plan_args) "${TF_SELECTION_ARGS[@]}"; then
+        print_error "Terraform plan failed"
+        if [ -n "$TF_REPLACE" ] && grep -qs 'prevent_destroy = true' main.tf block_volumes.tf modules/*/main.tf; then
+            print_status "Instances and block volumes are protected from destruction (PREVENT_DESTROY)."
+            print_status "To replace them on purpose, regenerate without it first: $0 --no-prevent-destroy --emit-only"
+        fi
+        return 1
+    fi
+    changes=$(plan_changes tfplan)
+    echo ""
+    print_status "Plan summary:"
+    plan_summary "$changes"
+    plan_selection_summary tfplan
+    echo ""
+
+    if [ "$mode" = "plan" ]; then
+        print_status "Plan saved as 'tfplan' - apply it with: terraform apply tfplan"
+        return 0
+    fi
+    if [ -z "$changes" ] && [ "$TF_REFRESH_ONLY" != "true" ]; then
+        rm -f tfplan
+        return 0
+    fi
+    if [ "$yes" != "true" ] && [ "$AUTO_DEPLOY" != "true" ] && [ "$NON_INTERACTIVE" != "true" ] \
+        && ! confirm_action "Apply this plan?" "N"; then
+        print_status "Plan saved as 'tfplan' - apply later with: terraform apply tfplan"
+        return 1
+    fi
+    confirm_plan_destroy "$changes" || return 1
+    if ! trace_run "terraform apply" out_of_capacity_auto_apply; then
+        print_error "Terraform apply failed"
+        return 1
+    fi
+    rm -f tfplan
+    audit_log "$mode" "${TF_SELECTION_ARGS[*]:-full}"
+    print_success "Applied"
+    FLEET_JSON=""
+}
+
+run_terraform_workflow() {
+    print_header "TERRAFORM WORKFLOW"
+    
+    # Step 1: Initialize
+    print_status "Step 1: Initializing Terraform..."
+    check_terraform_version || true
+    if ! trace_run "terraform init" retry_with_backoff "terraform init -input=false -upgrade" >/dev/null 2>&1; then
+        print_error "Terraform init failed after retries"
+        return 1
+    fi
+    print_success "Terraform initialized"
+    if [ -n "$(lock_file_missing_platforms)" ]; then
+        terraform_lock_platforms || print_warning "The lock file only has checksums for this platform; run '$0 lock' later"
+    fi
+    prepare_terraform_selection || return 1
+    
+    # Step 2: Import existing resources
+    if has_existing_resources; then
+        print_status "Step 2: Importing existing resources..."
+        trace_run "terraform import" import_existing_resources
+    else
+        print_status "Step 2: No existing resources to import"
+    fi
+    
+    # Step 3: Validate
+    print_status "Step 3: Validating configuration..."
+    if ! trace_run "terraform validate" terraform validate; then
+        print_error "Terraform validation failed"
+        return 1
+    fi
+    print_success "Configuration valid"
+    
+    # Step 4: Plan
+    print_status "Step 4: Creating execution plan..."
+    local plan_cache_key
+    plan_cache_key=$(compute_plan_cache_key)
+    # A targeted or refresh-only plan is never cached: the next full run must not reuse it
+    if [ ${#TF_SELECTION_ARGS[@]} -eq 0 ] && plan_cache_is_valid "$plan_cache_key"; then
+        print_success "Config, inventory and state unchanged - reusing cached plan (set TF_PLAN_CACHE=false to force re-plan)"
+    else
+        rm -f "$TF_PLAN_CACHE_FILE"
+        # shellcheck disable=SC2046  # intentional word splitting of option list
+        if ! trace_run "terraform plan" terraform plan -out=tfplan -input=false $(terraform_plan_args) "${TF_SELECTION_ARGS[@]}"; then
+            print_error "Terraform plan failed"
+            return 1
+        fi
+        [ ${#TF_SELECTION_ARGS[@]} -eq 0 ] && save_plan_cache "$plan_cache_key"
+        print_success "Plan created successfully"
+    fi
+    
+    # Show plan summary
+    local changes
+    changes=$(plan_changes tfplan)
+    echo ""
+    print_status "Plan summary:"
+    plan_summary "$changes"
+    plan_selection_summary tfplan
+    echo ""
+    check_git_hygiene
+    
+    # Step 5: Apply (with confirmation)
+    if [ "$AUTO_DEPLOY" = "true" ] || [ "$NON_INTERACTIVE" = "true" ]; then
+        if ! confirm_plan_destroy "$changes"; then
+            return 1
+        fi
+        print_status "Step 5: Auto-applying plan..."
+        apply_choice="Y"
+    else
+        echo -n -e "${BLUE}Apply this plan? [y/N]: ${NC}"
+        read -r apply_choice
+        apply_choice=${apply_choice:-N}
+        if [[ "$apply_choice" =~ ^[Yy]$ ]] && ! confirm_plan_destroy "$changes"; then
+            apply_choice="N"
+        fi
+    fi
+    
+    if [[ "$apply_choice" =~ ^[Yy]$ ]]; then
+        print_status "Applying Terraform plan..."
+        if trace_run "terraform apply" out_of_capacity_auto_apply; then
+            print_success "Infrastructure deployed successfully!"
+            rm -f tfplan "$TF_PLAN_CACHE_FILE"
             
-            if is_wsl; then
-                if auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1); then
-                    echo "$auth_out"
-                    local url
-                    url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
-                    if [ -n "$url" ]; then
-                        print_status "Opening browser for login URL (WSL)..."
-                        open_url_best_effort "$url" || true
-                        print_status ""
-                        print_status "After completing browser authentication, press Enter to continue..."
-                        read -r
-                    fi
-                    OCI_PROFILE="$new_profile"
-                    auth_method="security_token"
-                    if test_oci_connectivity; then
-                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
-                        return 0
-                    else
-                        print_warning "Session auth completed but connectivity test failed"
+            # Show outputs
+            echo ""
+            print_header "DEPLOYMENT COMPLETE"
+            show_deployment_outputs || true
+            if [ "$ARTIFACTS" = "true" ]; then
+                write_apply_artifacts || true
+            fi
+
+            if [ "$READINESS_CHECKS" = "true" ]; then
+                trace_run "readiness" run_readiness_checks || \
+                    print_warning "Some readiness checks failed - see $READINESS_REPORT_FILE"
+            fi
+            trace_run "verify-ssh" verify_ssh_hardening || true
+        else
+            print_error "Terraform apply failed"
+            return 1
+        fi
+    else
+        print_status "Plan saved as 'tfplan' - apply later with: terraform apply tfplan"
+    fi
+    
+    return 0
+}
+
+# outputs [--json]: the Terraform outputs (outputs.tf) as tables - instances with their
+# addresses and state, OCIDs, SSH commands and the network IDs
+show_deployment_outputs() {
+    local outputs
+    outputs=$(terraform output -json 2>/dev/null) || outputs=""
+    if [ "${1:-}" = "--json" ]; then
+        jq . <<< "${outputs:-"{}"}"
+        return 0
+    fi
+    if [ -z "$outputs" ] || [ "$outputs" = "{}" ]; then
+        print_warning "No Terraform outputs yet - run the setup and apply first"
+        return 1
+    fi
+
+    local instances name kind size public private ipv6 state dns
+    instances=$(jq -c '
+        [((.amd_instances.value // {}) | to_entries[] | .value + {name: .key, kind: "amd", size: "1/1GB"}),
+         ((.arm_instances.value // {}) | to_entries[]
+            | .value + {name: .key, kind: "arm", size: "\(.value.ocpus // "?")/\(.value.memory_gb // "?")GB"})]' <<< "$outputs")
+
+    print_subheader "Instances"
+    printf '  %-16s %-4s %-9s %-16s %-15s %-26s %s\n' "NAME" "KIND" "OCPU/MEM" "PUBLIC IP" "PRIVATE IP" "IPV6" "STATE"
+    while IFS=$'\t' read -r name kind size public private ipv6 state; do
+        printf '  %-16s %-4s %-9s %-16s %-15s %-26s %s\n' "$name" "$kind" "$size" "$public" "$private" "$ipv6" "$state"
+    done < <(jq -r '.[] | [.name, .kind, .size,
+        ((.public_ip // "" | if . == "" then "-" else . end) + (if .reserved then "*" else "" end)),
+        (.private_ip // "-"), (.ipv6 // "-"), (.state // "-")] | @tsv' <<< "$instances")
+    if jq -e 'any(.[]; .reserved == true)' <<< "$instances" >/dev/null; then
+        echo "  * reserved public IP (kept across instance replacement)"
+    fi
+    dns=$(jq -r '.[] | select(.dns_name != null) | "    \(.name): \(.dns_name)"' <<< "$instances")
+    if [ -n "$dns" ]; then
+        echo "  DNS names:"
+        echo "$dns"
+    fi
+
+    print_subheader "OCIDs"
+    jq -r '.[] | "\(.name)\t\(.id)"' <<< "$instances" | while IFS=$'\t' read -r name ocid; do
+        printf '  %-16s %s\n' "$name" "$ocid"
+    done
+
+    print_subheader "SSH"
+    jq -r '.[] | "\(.name)\t\(.ssh)"' <<< "$instances" | while IFS=$'\t' read -r name ssh; do
+        printf '  %-16s %s\n' "$name" "$ssh"
+    done
+
+    if jq -e '.network.value' <<< "$outputs" >/dev/null 2>&1; then
+        print_subheader "Network"
+        jq -r '.network.value
+            | "  VCN     \(.vcn_id) (\(.vcn_cidr)\(if .vcn_ipv6_cidr then ", \(.vcn_ipv6_cidr)" else "" end))",
+              "  Subnet  \(.subnet_id) (\(.subnet_cidr)\(if .subnet_ipv6_cidr then ", \(.subnet_ipv6_cidr)" else "" end))",
+              (if .private_subnet_id then "  Private \(.private_subnet_id) (\(.topology) topology, bastion \(.bastion // "-"))" else empty end),
+              ((.subnets // {}) | to_entries[] | "  \(.key)\(" " * ([8 - (.key | length), 1] | max))\(.value.id) (\(.value.cidr), \(if .value.public then "public" else "private" end))")' \
+            <<< "$outputs"
+    fi
+    echo ""
+    print_status "Everything as JSON: $0 outputs --json (or terraform output -json)"
+}
+
+# artifacts [--dir DIR]: the Terraform outputs as files for downstream tools - instances.json
+# (everything), instances.env (flat KEY=value, usable with `source` and docker --env-file)
+# and inventory.ini (Ansible, grouped by kind, private instances through the bastion)
+write_apply_artifacts() {
+    local dir="$ARTIFACTS_DIR"
+    if [ "${1:-}" = "--dir" ]; then
+        dir="${2:-}"
+        [ -n "$dir" ] || { print_error "--dir requires a directory"; return 2; }
+    fi
+    local outputs
+    outputs=$(terraform output -json 2>/dev/null) || outputs=""
+    if [ -z "$outputs" ] || [ "$outputs" = "{}" ]; then
+        print_warning "No Terraform outputs yet - nothing to write to $dir/"
+        return 1
+    fi
+
+    local key="$PWD/ssh_keys/id_rsa" user port json
+    user=$(ssh_login_user)
+    port=$(ssh_port)
+    json=$(jq --arg key "$key" --arg user "$user" --argjson port "$port" \
+        --arg now "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '
+        def instances($kind): (.["\($kind)_instances"].value // {}) | to_entries | map(.value + {name: .key, kind: $kind}
+            | {name, kind, id, state, public_ip, private_ip, ipv6, jump, dns_name, labels, ssh,
+               ocpus: (.ocpus // 1), memory_gb: (.memory_gb // 1),
+               host: (if .jump then .private_ip else .public_ip end)});
+        {generated: $now, region: (.summary.value.region // null),
+         ssh: {user: $user, port: $port, key: $key},
+         instances: (instances("amd") + instances("arm")),
+         network: (.network.value // {})}' <<< "$outputs") || return 1
+
+    mkdir -p "$dir"
+    echo "$json" > "$dir/instances.json.tmp" && mv "$dir/instances.json.tmp" "$dir/instances.json"
+
+    jq -r '
+        def var($k; $v): "\($k)=\($v // "")";
+        var("CLOUDCRADLE_REGION"; .region), var("SSH_USER"; .ssh.user), var("SSH_PORT"; .ssh.port),
+        var("SSH_KEY"; .ssh.key), var("VCN_ID"; .network.vcn_id), var("SUBNET_ID"; .network.subnet_id),
+        var("BASTION_IP"; .network.bastion),
+        (["amd", "arm"][] as $kind | [.instances[] | select(.kind == $kind)] as $list
+         | ($kind | ascii_upcase) as $k
+         | var("\($k)_INSTANCE_COUNT"; $list | length),
+           ($list | to_entries[] | "\($k)_INSTANCE_\(.key + 1)" as $p | .value
+            | var("\($p)_NAME"; .name), var("\($p)_IP"; .host), var("\($p)_PUBLIC_IP"; .public_ip),
+              var("\($p)_PRIVATE_IP"; .private_ip), var("\($p)_IPV6"; .ipv6), var("\($p)_ID"; .id)))' \
+        <<< "$json" > "$dir/instances.env.tmp" && mv "$dir/instances.env.tmp" "$dir/instances.env"
+
+    jq -r --arg proxy "$(ssh_proxy_command "BASTION" | sed "s|\./ssh_keys/|$PWD/ssh_keys/|g")" '
+        "# Generated by CloudCradle from the Terraform outputs (\(.generated))",
+        "[all:vars]",
+        "ansible_user=\(.ssh.user)",
+        "ansible_port=\(.ssh.port)",
+        "ansible_ssh_private_key_file=\(.ssh.key)",
+        (["amd", "arm"][] as $kind | "", "[\($kind)]",
+         (.instances[] | select(.kind == $kind)
+          | .jump as $jump | "\(.name) ansible_host=\(.host)"
+            + (if $jump then " ansible_ssh_common_args=\u0027-o ProxyCommand=\"\($proxy | sub("BASTION"; $jump))\"\u0027" else "" end)))' \
+        <<< "$json" > "$dir/inventory.ini.tmp" && mv "$dir/inventory.ini.tmp" "$dir/inventory.ini"
+
+    print_success "Wrote $dir/instances.json, $dir/instances.env and $dir/inventory.ini"
+}
+
+# ============================================================================
+# FLEET OPERATIONS
+# ============================================================================
+
+# Cache instances from Terraform outputs as [{name, kind, id, public_ip, labels}]
+load_fleet() {
+    if [ -n "${FLEET_JSON:-}" ]; then
+        return 0
+    fi
+    FLEET_JSON=$(terraform output -json 2>/dev/null | jq -c '
+        [((.amd_instances.value // {}) | to_entries[] | {name: .key, kind: "amd", id: .value.id,
+            public_ip: (.value.public_ip // ""), private_ip: (.value.private_ip // ""), jump: (.value.jump // ""),
+            ipv6: (.value.ipv6 // ""), labels: (.value.labels // {})}),
+         ((.arm_instances.value // {}) | to_entries[] | {name: .key, kind: "arm", id: .value.id,
+            public_ip: (.value.public_ip // ""), private_ip: (.value.private_ip // ""), jump: (.value.jump // ""),
+            ipv6: (.value.ipv6 // ""), labels: (.value.labels // {})})]
+    ' 2>/dev/null) || FLEET_JSON=""
+    [ -n "$FLEET_JSON" ] && [ "$FLEET_JSON" != "[]" ]
+}
+
+# Print names of instances matching a selector: comma-separated key=value / key!=value
+# terms that must all hold. "name" and "kind" (amd|arm) are implicit labels.
+fleet_select() {
+    local selector="$1"
+    load_fleet || return 0
+    jq -r --arg sel "$selector" '
+        def terms: $sel | split(",") | map(select(length > 0)) | map(
+            if test("!=") then {k: (split("!=")[0]), v: (split("!=")[1:] | join("!=")), neg: true}
+            else {k: (split("=")[0]), v: (split("=")[1:] | join("=")), neg: false} end);
+        .[] | (.labels + {name: .name, kind: .kind}) as $l
+        | select(all(terms[]; (($l[.k] // "") == .v) != .neg)) | .name
+    ' <<< "$FLEET_JSON"
+}
+
+fleet_field() {
+    local name="$1" field="$2"
+    jq -r --arg n "$name" --arg f "$field" '.[] | select(.name == $n) | .[$f] // ""' <<< "$FLEET_JSON"
+}
+
+# Address used to reach an instance over SSH, honouring SSH_ADDRESS_FAMILY
+fleet_ssh_host() {
+    local name="$1" ipv6
+    if [ "$SSH_ADDRESS_FAMILY" = "ipv6" ]; then
+        ipv6=$(fleet_field "$name" ipv6)
+        if [ -n "$ipv6" ]; then
+            echo "$ipv6"
+            return 0
+        fi
+        print_warning "$name has no IPv6 address; using IPv4" >&2
+    fi
+    if [ -n "$(fleet_field "$name" jump)" ]; then
+        fleet_field "$name" private_ip
+        return 0
+    fi
+    fleet_field "$name" public_ip
+}
+
+# Bastion address for a private (two-tier) instance address, empty otherwise
+fleet_jump_host() {
+    local ip="$1"
+    load_fleet || return 0
+    jq -r --arg ip "$ip" '[.[] | select(.private_ip == $ip and .jump != "")][0].jump // empty' <<< "$FLEET_JSON"
+}
+
+ssh_instance() {
+    local ip="$1" jump
+    shift
+    jump=$(fleet_jump_host "$ip")
+    windows_protect_key ./ssh_keys/id_rsa
+    ssh -n -i ./ssh_keys/id_rsa -p "$(ssh_port)" -o BatchMode=yes -o ConnectTimeout=10 \
+        -o StrictHostKeyChecking=accept-new -o UserKnownHostsFile=./ssh_keys/known_hosts \
+        ${jump:+-o "ProxyCommand=$(ssh_proxy_command "$jump")"} \
+        "$(ssh_login_user)@$ip" "$@"
+}
+
+# ProxyCommand reaching a private instance through the bastion
+ssh_proxy_command() {
+    local client
+    client=$(ssh_client) || client=ssh
+    # ssh.exe runs the ProxyCommand itself, without a POSIX shell to resolve /c/... paths
+    case "$client" in *.exe) client=ssh.exe ;; esac
+    echo "$client -i ./ssh_keys/id_rsa -p $(ssh_port) -o BatchMode=yes -o StrictHostKeyChecking=accept-new -o UserKnownHostsFile=./ssh_keys/known_hosts -W %h:%p $(ssh_login_user)@$1"
+}
+
+# Resolve "[--selector EXPR | --all | host...] [-- rest...]" into FLEET_TARGETS and FLEET_REST
+parse_fleet_targets() {
+    FLEET_TARGETS=()
+    FLEET_REST=()
+    local selector="" all=false name
+    local -a hosts=()
+
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --selector|-l)
+                selector="${2:-}"
+                shift 2 || { print_error "--selector requires an expression (e.g. role=web)"; return 2; }
+                ;;
+            --selector=*)
+                selector="${1#*=}"
+                shift
+                ;;
+            --all)
+                all=true
+                shift
+                ;;
+            --)
+                shift
+                FLEET_REST=("$@")
+                break
+                ;;
+            *)
+                hosts+=("$1")
+                shift
+                ;;
+        esac
+    done
+
+    if ! load_fleet; then
+        print_error "No deployed instances found in Terraform outputs (run terraform apply first)"
+        return 1
+    fi
+
+    if [ -n "$selector" ]; then
+        while IFS= read -r name; do
+            [ -n "$name" ] && FLEET_TARGETS+=("$name")
+        done <<< "$(fleet_select "$selector")"
+    elif [ "$all" = "true" ]; then
+        while IFS= read -r name; do
+            FLEET_TARGETS+=("$name")
+        done <<< "$(jq -r '.[].name' <<< "$FLEET_JSON")"
+    fi
+
+    for name in "${hosts[@]}"; do
+        if [ -z "$(fleet_field "$name" name)" ]; then
+            print_error "Unknown instance: $name"
+            return 1
+        fi
+        FLEET_TARGETS+=("$name")
+    done
+
+    if [ ${#FLEET_TARGETS[@]} -eq 0 ]; then
+        print_error "No instances matched (use --selector key=value, --all or hostnames)"
+        return 1
+    fi
+}
+
+# Single-quote a value for safe use in eval'd shell code
+shell_quote() {
+    printf "'%s'" "${1//\'/\'\\\'\'}"
+}
+
+# env <instance> [--prefix P]: print export statements for eval $(... env arm-1)
+fleet_env() {
+    local name="" prefix=""
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --prefix)
+                prefix="${2:-}"
+                shift 2 || { print_error "--prefix requires a value" >&2; return 2; }
+                ;;
+            *)
+                name="$1"
+                shift
+                ;;
+        esac
+    done
+
+    if [ -z "$name" ]; then
+        print_error "Usage: env <instance> [--prefix PREFIX_]" >&2
+        return 2
+    fi
+    if ! load_fleet || [ -z "$(fleet_field "$name" name)" ]; then
+        print_error "Unknown instance: $name" >&2
+        return 1
+    fi
+
+    local ip key
+    ip=$(fleet_ssh_host "$name")
+    key="$PWD/ssh_keys/id_rsa"
+
+    echo "export ${prefix}NAME=$(shell_quote "$name")"
+    echo "export ${prefix}HOST=$(shell_quote "$ip")"
+    echo "export ${prefix}HOST4=$(shell_quote "$(fleet_field "$name" public_ip)")"
+    echo "export ${prefix}HOST6=$(shell_quote "$(fleet_field "$name" ipv6)")"
+    echo "export ${prefix}USER=$(shell_quote "$(ssh_login_user)")"
+    echo "export ${prefix}PORT=$(shell_quote "$(ssh_port)")"
+    echo "export ${prefix}KEY=$(shell_quote "$key")"
+    echo "export ${prefix}ID=$(shell_quote "$(fleet_field "$name" id)")"
+    echo "export ${prefix}SSH=$(shell_quote "ssh -i $key -p $(ssh_port) $(ssh_login_user)@$ip")"
+}
+
+# ssh <instance> [-4|-6] [command...]: interactive SSH session (or one command)
+fleet_ssh() {
+    local name="${1:-}"
+    if [ -z "$name" ]; then
+        print_error "Usage: ssh <instance> [-4|-6] [command...]"
+        return 2
+    fi
+    shift
+    case "${1:-}" in
+        -4) SSH_ADDRESS_FAMILY=ipv4; shift ;;
+        -6) SSH_ADDRESS_FAMILY=ipv6; shift ;;
+    esac
+    if ! load_fleet || [ -z "$(fleet_field "$name" name)" ]; then
+        print_error "Unknown instance: $name"
+        return 1
+    fi
+
+    if ! ssh_client >/dev/null; then
+        print_error "No ssh client found: install OpenSSH (Windows: Settings > Optional features > OpenSSH Client)"
+        return 1
+    fi
+    windows_protect_key ./ssh_keys/id_rsa
+
+    local jump
+    jump=$(fleet_field "$name" jump)
+    ssh -i ./ssh_keys/id_rsa -p "$(ssh_port)" -o StrictHostKeyChecking=accept-new \
+        -o UserKnownHostsFile=./ssh_keys/known_hosts \
+        ${jump:+-o "ProxyCommand=$(ssh_proxy_command "$jump")"} \
+        "$(ssh_login_user)@$(fleet_ssh_host "$name")" "$@"
+}
+
+# Active console connection of an instance (JSON), empty when there is none
+console_connection() {
+    oci_cmd "compute instance-console-connection list --compartment-id $tenancy_ocid --instance-id $1 --all" 2>/dev/null \
+        | jq -c '[.data[]? | select(."lifecycle-state" == "ACTIVE")][0] // empty' 2>/dev/null || true
+}
+
+# console INSTANCE [--print] [--delete]: serial console through an instance console
+# connection, which works when sshd or the firewall on the instance is broken. The
+# connection is reused while it matches ssh_keys/id_rsa; --delete removes it.
+fleet_console() {
+    local name="" print=false delete=false
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --print)
+                print=true
+                shift
+                ;;
+            --delete)
+                delete=true
+                shift
+                ;;
+            *)
+                name="$1"
+                shift
+                ;;
+        esac
+    done
+    if [ -z "$name" ]; then
+        print_error "Usage: console INSTANCE [--print] [--delete]"
+        return 2
+    fi
+    if ! load_fleet || [ -z "$(fleet_field "$name" name)" ]; then
+        print_error "Unknown instance: $name"
+        return 1
+    fi
+
+    local id connection fingerprint key="$PWD/ssh_keys/id_rsa" command
+    id=$(fleet_field "$name" id)
+    connection=$(console_connection "$id")
+    fingerprint=$(ssh-keygen -E md5 -lf "$key.pub" 2>/dev/null | awk '{ sub("^MD5:", "", $2); print $2 }')
+
+    if [ -n "$connection" ] && { [ "$delete" = "true" ] || [ "$(jq -r '.fingerprint // ""' <<< "$connection")" != "$fingerprint" ]; }; then
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would delete the console connection of $name"
+        elif oci_cmd "compute instance-console-connection delete --instance-console-connection-id $(jq -r '.id' <<< "$connection") --force --wait-for-state DELETED" >/dev/null; then
+            print_status "Deleted the console connection of $name$([ "$delete" = "true" ] || echo " (made with another key)")" >&2
+            audit_log console-delete "$name"
+        else
+            print_error "Could not delete the console connection of $name"
+            return 1
+        fi
+        connection=""
+    fi
+    [ "$delete" = "true" ] && return 0
+
+    if [ -z "$connection" ]; then
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would create a console connection for $name ($id)"
+            return 0
+        fi
+        print_status "Creating a console connection for $name..." >&2
+        connection=$(oci_cmd "compute instance-console-connection create --instance-id $id --ssh-public-key-file \"$key.pub\" --wait-for-state ACTIVE" 2>/dev/null \
+            | jq -c '.data // empty' 2>/dev/null) || connection=""
+        if [ -z "$connection" ]; then
+            print_error "Could not create a console connection for $name (one per instance; check the instance-console-connection permissions)"
+            return 1
+        fi
+        audit_log console "$name"
+    fi
+
+    # The console gateway still offers only ssh-rsa host keys and signatures
+    command=$(jq -r '."connection-string"' <<< "$connection" \
+        | sed "s|ssh |ssh -i $key -o HostKeyAlgorithms=+ssh-rsa -o PubkeyAcceptedKeyTypes=+ssh-rsa |g")
+    if [ "$print" = "true" ]; then
+        echo "$command"
+        return 0
+    fi
+    print_status "Serial console of $name: press Enter for a login prompt, ~. to leave"
+    print_status "(the connection stays until '$0 console $name --delete')"
+    eval "$command"
+}
+
+# exec [targets] -- command: run a shell command over SSH on each target
+fleet_exec() {
+    parse_fleet_targets "$@" || return 1
+    if [ ${#FLEET_REST[@]} -eq 0 ]; then
+        print_error "Usage: exec [--selector EXPR | --all | host...] -- command"
+        return 2
+    fi
+
+    local name ip failed=0
+    for name in "${FLEET_TARGETS[@]}"; do
+        ip=$(fleet_ssh_host "$name")
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would run on $name ($ip): ${FLEET_REST[*]}"
+            continue
+        fi
+        print_subheader "$name ($ip)"
+        if ! ssh_instance "$ip" "${FLEET_REST[*]}"; then
+            print_error "$name: command failed"
+            failed=$((failed + 1))
+        fi
+    done
+    [ "$failed" -eq 0 ]
+}
+
+# stop|start|reboot [targets]: OCI instance power actions
+fleet_power_action() {
+    local action="$1"
+    shift
+    parse_fleet_targets "$@" || return 1
+
+    local oci_action
+    case "$action" in
+        stop) oci_action="SOFTSTOP" ;;
+        start) oci_action="START" ;;
+        reboot) oci_action="SOFTRESET" ;;
+    esac
+
+    local name id failed=0
+    for name in "${FLEET_TARGETS[@]}"; do
+        id=$(fleet_field "$name" id)
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would $oci_action $name ($id)"
+            continue
+        fi
+        print_status "$action $name..."
+        if oci_cmd "compute instance action --instance-id $id --action $oci_action" >/dev/null; then
+            print_success "  $name: $oci_action requested"
+            case "$action" in
+                stop) record_power_state "$name" STOPPED ;;
+                start) record_power_state "$name" RUNNING ;;
+            esac
+        else
+            print_error "  $name: $oci_action failed"
+            failed=$((failed + 1))
+        fi
+    done
+    refresh_power_states_tf
+    [ "$failed" -eq 0 ]
+}
+
+# Print "<package>\t<version>" for each argument on the instance ("-" when not installed)
+# shellcheck disable=SC2016  # expanded on the instance
+readonly FLEET_PACKAGES_PROBE='for p in "$@"; do
+    case "$p" in
+        kernel) v=$(uname -r) ;;
+        docker) v=$(docker --version 2>/dev/null | awk "{ sub(\",\", \"\", \$3); print \$3 }") ;;
+        *) v=$(dpkg-query -W -f="\${Version}" "$p" 2>/dev/null || rpm -q --qf "%{VERSION}-%{RELEASE}" "$p" 2>/dev/null) ;;
+    esac
+    printf "%s\t%s\n" "$p" "${v:--}"
+done'
+
+# fleet packages [TARGETS] [--packages "a b"] [--json]: compare package versions across
+# instances and flag stragglers (exit 2 when any instance is behind)
+fleet_packages() {
+    local json=false packages="$FLEET_PACKAGES"
+    local -a args=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --json)
+                json=true
+                shift
+                ;;
+            --packages)
+                packages="${2:-}"
+                shift 2 || { print_error "--packages requires a list (e.g. \"docker openssl\")"; return 2; }
+                ;;
+            *)
+                args+=("$1")
+                shift
+                ;;
+        esac
+    done
+    [ ${#args[@]} -gt 0 ] || args=(--all)
+    parse_fleet_targets "${args[@]}" || return 1
+
+    local -a pkgs
+    read -r -a pkgs <<< "$packages"
+    if [ ${#pkgs[@]} -eq 0 ]; then
+        print_error "No packages to compare (set FLEET_PACKAGES or --packages)"
+        return 2
+    fi
+
+    local name ip out inventory="{}"
+    for name in "${FLEET_TARGETS[@]}"; do
+        if [ "$(power_state_of "$name")" = "STOPPED" ]; then
+            inventory=$(jq -c --arg h "$name" '. + {($h): "stopped"}' <<< "$inventory")
+            continue
+        fi
+        ip=$(fleet_ssh_host "$name")
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would collect ${pkgs[*]} versions from $name ($ip)"
+            continue
+        fi
+        [ "$json" = "true" ] || print_status "Collecting package versions from $name ($ip)..."
+        if out=$(ssh_instance "$ip" "bash -s -- ${pkgs[*]} <<'EOF'
+$FLEET_PACKAGES_PROBE
+EOF" 2>/dev/null); then
+            inventory=$(jq -Rn -c --arg h "$name" --argjson inv "$inventory" '
+                $inv + {($h): ([inputs | split("\t") | select(length == 2) | {(.[0]): .[1]}] | add // {})}' <<< "$out")
+        else
+            inventory=$(jq -c --arg h "$name" '. + {($h): "unreachable"}' <<< "$inventory")
+        fi
+    done
+    [ "$DRY_RUN" = "true" ] && return 0
+
+    # Newest version of each package across the fleet (version sort, not lexical)
+    local pkg latest="{}" newest
+    for pkg in "${pkgs[@]}"; do
+        newest=$(jq -r --arg p "$pkg" '.[] | objects | .[$p] // empty | select(. != "-")' <<< "$inventory" | sort -V | tail -n 1)
+        latest=$(jq -c --arg p "$pkg" --arg v "$newest" '. + {($p): $v}' <<< "$latest")
+    done
+
+    local report
+    report=$(jq -c --argjson latest "$latest" '{
+        hosts: .,
+        latest: $latest,
+        stragglers: [to_entries[] | select(.value | type == "object") | .key as $h | .value | to_entries[]
+            | ($latest[.key] // "") as $newest | select(.value != "-" and $newest != "" and .value != $newest)
+            | {host: $h, package: .key, version: .value, latest: $newest}]
+    }' <<< "$inventory")
+
+    if [ "$json" = "true" ]; then
+        jq . <<< "$report"
+    else
+        local width=12 cell row v
+        for name in "${FLEET_TARGETS[@]}"; do
+            [ ${#name} -ge "$width" ] && width=$(( ${#name} + 2 ))
+        done
+        while IFS= read -r v; do
+            [ ${#v} -ge "$width" ] && width=$(( ${#v} + 2 ))
+        done < <(jq -r '.hosts[] | objects | .[]' <<< "$report")
+
+        print_subheader "Package versions (${YELLOW}yellow${NC} = behind the newest in the fleet)"
+        row=$(printf "  %-${width}s" "INSTANCE")
+        for pkg in "${pkgs[@]}"; do
+            row+=$(printf "%-${width}s" "$pkg")
+        done
+        echo -e "${BOLD}${row}${NC}"
+        for name in "${FLEET_TARGETS[@]}"; do
+            row=$(printf "  %-${width}s" "$name")
+            if jq -e --arg h "$name" '.hosts[$h] | type == "string"' <<< "$report" >/dev/null; then
+                v=$(jq -r --arg h "$name" '.hosts[$h]' <<< "$report")
+                [ "$v" = "unreachable" ] && v="${RED}${v}${NC}"
+                row+="$v"
+                echo -e "$row"
+                continue
+            fi
+            for pkg in "${pkgs[@]}"; do
+                v=$(jq -r --arg h "$name" --arg p "$pkg" '.hosts[$h][$p] // "-"' <<< "$report")
+                cell=$(printf "%-${width}s" "$v")
+                if [ "$v" != "-" ] && [ "$v" != "$(jq -r --arg p "$pkg" '.latest[$p]' <<< "$report")" ]; then
+                    cell="${YELLOW}${cell}${NC}"
+                fi
+                row+="$cell"
+            done
+            echo -e "$row"
+        done
+
+        local count
+        count=$(jq '.stragglers | length' <<< "$report")
+        echo ""
+        if [ "$count" -eq 0 ]; then
+            print_success "All reachable instances run the newest versions found in the fleet"
+        else
+            print_warning "$count package(s) behind the rest of the fleet:"
+            jq -r '.stragglers[] | "  \(.host): \(.package) \(.version) -> \(.latest)"' <<< "$report"
+        fi
+    fi
+
+    [ "$(jq '.stragglers | length' <<< "$report")" -eq 0 ] || return 2
+}
+
+# ============================================================================
+# APPLICATION BACKUPS
+# ============================================================================
+
+# Whether a BACKUP_SPEC_FILE or PROVISIONERS_FILE target (hostname, amd, arm, * or a
+# key=value[,key!=value] selector over INSTANCE_LABELS_FILE) covers an instance; works
+# before the first apply
+backup_target_matches() {
+    local target="$1" host="$2" kind="$3" labels term
+    if [ "$target" = "*" ] || [ "$target" = "$host" ] || [ "$target" = "$kind" ]; then
+        return 0
+    fi
+    [[ "$target" == *=* ]] || return 1
+    labels=" name=$host kind=$kind "
+    if [ -f "$INSTANCE_LABELS_FILE" ]; then
+        labels+="$(sed 's/#.*//' "$INSTANCE_LABELS_FILE" | awk -v h="$host" '$1 == h { $1 = ""; print }') "
+    fi
+    for term in ${target//,/ }; do
+        if [[ "$term" == *!=* ]]; then
+            [[ "$labels" == *" ${term/!=/=} "* ]] && return 1
+        else
+            [[ "$labels" == *" $term "* ]] || return 1
+        fi
+    done
+    return 0
+}
+
+# Render BACKUP_SPEC_FILE as a single-line HCL map: {"host":{"schedule":"daily","paths":"/srv /etc/app"}}
+# Paths of every matching line are combined; the first matching line sets the schedule.
+backup_plans_tf() {
+    if [ ! -f "$BACKUP_SPEC_FILE" ]; then
+        echo "{}"
+        return 0
+    fi
+    local host kind target schedule paths
+    {
+        for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}"; do echo "$host amd"; done
+        for host in "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do echo "$host arm"; done
+    } | while read -r host kind; do
+        [ -n "$host" ] || continue
+        while read -r target schedule paths; do
+            [ -n "$paths" ] || continue
+            backup_target_matches "$target" "$host" "$kind" || continue
+            printf '%s\t%s\t%s\n' "$host" "${schedule//_/ }" "$paths"
+        done < <(sed 's/#.*//' "$BACKUP_SPEC_FILE")
+    done | jq -Rn -c '
+        reduce (inputs | split("\t")) as $l ({};
+            .[$l[0]] = {schedule: (.[$l[0]].schedule // $l[1]),
+                        paths: ([(.[$l[0]].paths // empty), $l[2]] | join(" "))})'
+}
+
+# Fetch the SHA256SUMS of RCLONE_VERSION into RCLONE_CHECKSUMS_FILE unless it has them already
+ensure_rclone_checksums() {
+    local url="https://downloads.rclone.org/v$RCLONE_VERSION/SHA256SUMS" tmp
+    grep -qF "rclone-v$RCLONE_VERSION-linux-amd64.zip" "$RCLONE_CHECKSUMS_FILE" 2>/dev/null && return 0
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would fetch the rclone $RCLONE_VERSION checksums into $RCLONE_CHECKSUMS_FILE"
+        return 0
+    fi
+    tmp=$(mktemp)
+    if curl -fsSL -o "$tmp" "$url" && grep -qF "rclone-v$RCLONE_VERSION-linux-amd64.zip" "$tmp"; then
+        mv "$tmp" "$RCLONE_CHECKSUMS_FILE"
+        print_status "Pinned the rclone $RCLONE_VERSION checksums in $RCLONE_CHECKSUMS_FILE"
+        return 0
+    fi
+    rm -f "$tmp"
+    print_warning "Could not fetch $url - instances refuse to install rclone (and cannot back up)"
+    print_warning "until $RCLONE_CHECKSUMS_FILE has the checksums of rclone $RCLONE_VERSION"
+    return 1
+}
+
+# Pinned rclone release as a single-line HCL object:
+# {"version":"1.68.2","sha256":{"amd64":"<sha256>","arm64":"<sha256>"}}
+rclone_release_tf() {
+    local arch sum sums="{}"
+    for arch in amd64 arm64; do
+        sum=$(awk -v f="rclone-v$RCLONE_VERSION-linux-$arch.zip" '$2 == f { print $1 }' "$RCLONE_CHECKSUMS_FILE" 2>/dev/null) || sum=""
+        sums=$(jq -c --arg a "$arch" --arg s "$sum" '. + {($a): $s}' <<< "$sums")
+    done
+    jq -n -c --arg v "$RCLONE_VERSION" --argjson s "$sums" '{version: $v, sha256: $s}'
+}
+
+# Where the instances keep their repository password, and the shared one of earlier versions
+readonly BACKUP_REMOTE_PASSWORD_FILE="/etc/cloudcradle/restic.password"
+readonly BACKUP_REMOTE_SHARED_PASSWORD_FILE="/etc/cloudcradle/restic.shared-password"
+# Vault secret of the shared password ('_' cannot clash with a hostname)
+readonly BACKUP_SHARED_PASSWORD_SECRET="cloudcradle-backup_shared"
+
+# Vault secret holding the repository password of HOST
+backup_password_secret() {
+    echo "cloudcradle-backup-$1"
+}
+
+# Create the repository password of every instance with a backup plan on first use, in
+# BACKUP_PASSWORDS_DIR/<hostname>. Terraform only ever sees the secret names.
+ensure_backup_passwords() {
+    local host
+    local -a created=()
+    for host in $(backup_plans_tf | jq -r 'keys[]'); do
+        [ ! -s "$BACKUP_PASSWORDS_DIR/$host" ] || continue
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would generate the backup repository password of $host in $BACKUP_PASSWORDS_DIR/$host"
+            continue
+        fi
+        (umask 077 && mkdir -p "$BACKUP_PASSWORDS_DIR" && openssl rand -base64 32 | tr -d '\n' > "$BACKUP_PASSWORDS_DIR/$host")
+        created+=("$host")
+    done
+    [ ${#created[@]} -gt 0 ] || return 0
+    print_warning "Generated backup repository passwords in $BACKUP_PASSWORDS_DIR/ for: ${created[*]}"
+    print_warning "Keep a copy; snapshots cannot be decrypted without them"
+}
+
+# backup passwords: store the repository passwords the secrets vault does not have yet (run
+# after every apply). Stored ones are never replaced: the repository only opens with the
+# password it was created with.
+store_backup_passwords() {
+    local vault name file failed=0
+    vault=$(secrets_vault_output)
+    [ -n "$vault" ] || return 0
+    for name in $(jq -r '[.secrets[][]?.name | select(startswith("cloudcradle-backup"))] | unique[]' <<< "$vault"); do
+        [ -z "$(secret_ocid "$vault" "$name")" ] || continue
+        if [ "$name" = "$BACKUP_SHARED_PASSWORD_SECRET" ]; then
+            file="$BACKUP_PASSWORD_FILE"
+        else
+            file="$BACKUP_PASSWORDS_DIR/${name#cloudcradle-backup-}"
+        fi
+        if [ ! -s "$file" ]; then
+            print_error "$file is missing: cannot store $name (regenerate the files to create it)"
+            failed=$((failed + 1))
+            continue
+        fi
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would store $file in vault $SECRETS_VAULT_NAME as $name"
+            continue
+        fi
+        if vault_store_secret "$vault" "$name" "$(base64 < "$file" | tr -d '\n')"; then
+            print_success "Stored backup password $name"
+        else
+            print_error "Failed to store backup password $name"
+            failed=$((failed + 1))
+        fi
+    done
+    [ "$failed" -eq 0 ]
+}
+
+# Run cloudcradle-backup on an instance (exit 3 when the instance has no backup plan).
+# Arguments are quoted for the remote shell, so paths with spaces or metacharacters stay
+# single words.
+backup_remote() {
+    local ip="$1"
+    shift
+    ssh_instance "$ip" "test -x /usr/local/sbin/cloudcradle-backup || exit 3; sudo /usr/local/sbin/cloudcradle-backup $(printf '%q ' "$@")"
+}
+
+# backup status [TARGETS] [--json]: snapshot count, latest snapshot and last/next run
+backup_status() {
+    local json=false
+    local -a args=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --json) json=true ;;
+            *) args+=("$1") ;;
+        esac
+        shift
+    done
+    [ ${#args[@]} -gt 0 ] || args=(--all)
+    parse_fleet_targets "${args[@]}" || return 1
+
+    local name ip out rc report="{}" failed=0
+    for name in "${FLEET_TARGETS[@]}"; do
+        ip=$(fleet_ssh_host "$name")
+        out=$(backup_remote "$ip" status 2>/dev/null) && rc=0 || rc=$?
+        if [ "$rc" -eq 0 ] && jq -e . <<< "$out" >/dev/null 2>&1; then
+            report=$(jq -c --arg h "$name" --argjson s "$out" '. + {($h): $s}' <<< "$report")
+            [ "$(jq -r '.last_run.result // "ok"' <<< "$out")" = "ok" ] && [ "$(jq -r .reachable <<< "$out")" = "true" ] \
+                || failed=$((failed + 1))
+        elif [ "$rc" -eq 3 ]; then
+            report=$(jq -c --arg h "$name" '. + {($h): "not configured"}' <<< "$report")
+        else
+            report=$(jq -c --arg h "$name" '. + {($h): "unreachable"}' <<< "$report")
+            failed=$((failed + 1))
+        fi
+    done
+
+    if [ "$json" = "true" ]; then
+        jq . <<< "$report"
+    else
+        print_subheader "Backups (bucket: $BACKUP_BUCKET)"
+        printf "  ${BOLD}%-16s %-9s %-27s %-20s %s${NC}\n" "INSTANCE" "SNAPSHOTS" "LATEST" "LAST RUN" "NEXT RUN"
+        for name in "${FLEET_TARGETS[@]}"; do
+            if jq -e --arg h "$name" '.[$h] | type == "string"' <<< "$report" >/dev/null; then
+                printf "  %-16s %s\n" "$name" "$(jq -r --arg h "$name" '.[$h]' <<< "$report")"
+                continue
+            fi
+            jq -r --arg h "$name" '.[$h] | [$h, (if .reachable then (.snapshots | tostring) else "no repo" end),
+                    (if .latest then "\(.latest.id) \(.latest.time[0:16])" else "-" end),
+                    (if .last_run then "\(.last_run.result) \(.last_run.time[0:16])" else "-" end),
+                    (if .next_run != "" then .next_run else "-" end)] | @tsv' <<< "$report" \
+                | while IFS=$'\t' read -r name snapshots latest last next; do
+                    printf "  %-16s %-9s %-27s %-20s %s\n" "$name" "$snapshots" "$latest" "$last" "$next"
+                done
+        done
+    fi
+    [ "$failed" -eq 0 ]
+}
+
+# backup now [TARGETS]: run the backup immediately instead of waiting for the timer
+backup_now() {
+    [ $# -gt 0 ] || set -- --all
+    parse_fleet_targets "$@" || return 1
+    local name ip rc failed=0
+    for name in "${FLEET_TARGETS[@]}"; do
+        ip=$(fleet_ssh_host "$name")
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would back up $name ($ip) now"
+            continue
+        fi
+        print_status "Backing up $name..."
+        backup_remote "$ip" run >/dev/null 2>&1 && rc=0 || rc=$?
+        case "$rc" in
+            0) print_success "  $name: snapshot saved" ;;
+            3) print_status "  $name: no backup plan in $BACKUP_SPEC_FILE" ;;
+            *) print_error "  $name: backup failed (see journalctl -u cloudcradle-backup)"; failed=$((failed + 1)) ;;
+        esac
+    done
+    [ "$failed" -eq 0 ]
+}
+
+# backup restore INSTANCE [--snapshot ID] [--path PATH]... [--in-place]
+# Restores into /var/restore/<timestamp> unless --in-place is given
+backup_restore() {
+    local name="" snapshot="latest" in_place=false
+    local -a paths=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --snapshot)
+                snapshot="${2:-}"
+                shift 2 || { print_error "--snapshot requires an ID"; return 2; }
+                ;;
+            --path)
+                paths+=("${2:-}")
+                shift 2 || { print_error "--path requires a path"; return 2; }
+                ;;
+            --in-place)
+                in_place=true
+                shift
+                ;;
+            *)
+                name="$1"
+                shift
+                ;;
+        esac
+    done
+    if [ -z "$name" ]; then
+        print_error "Usage: backup restore INSTANCE [--snapshot ID] [--path PATH]... [--in-place]"
+        return 2
+    fi
+    if ! load_fleet || [ -z "$(fleet_field "$name" name)" ]; then
+        print_error "Unknown instance: $name"
+        return 1
+    fi
+
+    local target="/var/restore/$(date +%Y%m%d_%H%M%S)" ip
+    [ "$in_place" = "true" ] && target="/"
+    ip=$(fleet_ssh_host "$name")
+    print_status "Restoring snapshot $snapshot on $name into $target${paths[*]:+ (${paths[*]})}"
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would run cloudcradle-backup restore on $name"
+        return 0
+    fi
+    if [ "$in_place" = "true" ] && ! confirm_action "Overwrite files on $name with snapshot $snapshot?" "N"; then
+        return 1
+    fi
+
+    local rc
+    backup_remote "$ip" restore "$snapshot" "$target" "${paths[@]}" && rc=0 || rc=$?
+    case "$rc" in
+        0) print_success "Restored on $name into $target" ;;
+        3) print_error "$name has no backup plan in $BACKUP_SPEC_FILE" ;;
+        *) print_error "Restore on $name failed" ;;
+    esac
+    return "$rc"
+}
+
+# ============================================================================
+# SCHEDULED VOLUME BACKUPS
+# ============================================================================
+
+# Render VOLUME_BACKUP_SCHEDULE as a single-line HCL list of schedule objects ([] unless custom)
+volume_backup_schedules_tf() {
+    if [ "$VOLUME_BACKUP_POLICY" != "custom" ]; then
+        echo "[]"
+        return 0
+    fi
+    echo "${VOLUME_BACKUP_SCHEDULE// /}" | tr ',' '\n' | jq -Rn -c --argjson hour "$VOLUME_BACKUP_HOUR" '
+        {daily: ["ONE_DAY", 86400], weekly: ["ONE_WEEK", 604800], monthly: ["ONE_MONTH", 2678400]} as $p
+        | [inputs | select(length > 0) | split(":") | select($p[.[0]])
+           | {period: $p[.[0]][0], retention_seconds: ($p[.[0]][1] * (.[1] | tonumber)), hour_of_day: $hour}]'
+}
+
+# Backups each volume keeps once the policy has been running for a while
+volume_backups_retained_per_volume() {
+    case "$VOLUME_BACKUP_POLICY" in
+        bronze) echo 17 ;;   # 12 monthly + 5 yearly
+        silver) echo 21 ;;   # 4 weekly + 12 monthly + 5 yearly
+        gold) echo 28 ;;     # 7 daily + 4 weekly + 12 monthly + 5 yearly
+        custom) echo "${VOLUME_BACKUP_SCHEDULE// /}" | tr ',' '\n' | awk -F: '{ n += $2 } END { print n + 0 }' ;;
+        *) echo 0 ;;
+    esac
+}
+
+# Block volume spec of an instance by hostname ("0" when it has none or doesn't exist)
+instance_block_spec() {
+    local host="$1" i
+    for ((i=0; i<amd_micro_instance_count; i++)); do
+        [ "${amd_micro_hostnames[$i]:-}" = "$host" ] && { echo "${amd_block_volumes[$i]:-0}"; return 0; }
+    done
+    for ((i=0; i<arm_flex_instance_count; i++)); do
+        [ "${arm_flex_hostnames[$i]:-}" = "$host" ] && { echo "${arm_flex_block_volumes[$i]:-0}"; return 0; }
+    done
+    echo 0
+}
+
+# Configured hostnames whose volumes form a group (VOLUME_GROUPS), one per line
+volume_group_hosts() {
+    local host
+    for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do
+        if [ "$VOLUME_GROUPS" = "all" ]; then
+            [ "$(instance_block_spec "$host")" != "0" ] && echo "$host"
+        elif [[ ",${VOLUME_GROUPS// /}," == *",$host,"* ]]; then
+            echo "$host"
+        fi
+    done
+}
+
+# Volumes the backup policy covers: whole groups plus VOLUME_BACKUP_VOLUMES of the rest
+volume_backup_volume_count() {
+    local host grouped count=0
+    grouped=$(volume_group_hosts)
+    for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do
+        if grep -qxF "$host" <<< "$grouped"; then
+            count=$((count + 1 + $(block_volume_count "$(instance_block_spec "$host")")))
+            continue
+        fi
+        [[ "$VOLUME_BACKUP_VOLUMES" =~ ^(boot|all)$ ]] && count=$((count + 1))
+        [[ "$VOLUME_BACKUP_VOLUMES" =~ ^(block|all)$ ]] && count=$((count + $(block_volume_count "$(instance_block_spec "$host")")))
+    done
+    echo "$count"
+}
+
+# Check VOLUME_BACKUP_* syntax
+validate_volume_backup_policy() {
+    local errors=0 entry
+    if [[ ! "$VOLUME_BACKUP_POLICY" =~ ^(|bronze|silver|gold|custom)$ ]]; then
+        print_error "VOLUME_BACKUP_POLICY must be bronze, silver, gold or custom (got '$VOLUME_BACKUP_POLICY')"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$VOLUME_BACKUP_VOLUMES" =~ ^(boot|block|all)$ ]]; then
+        print_error "VOLUME_BACKUP_VOLUMES must be boot, block or all (got '$VOLUME_BACKUP_VOLUMES')"
+        errors=$((errors + 1))
+    fi
+    if [ -n "$VOLUME_GROUPS" ] && [ "$VOLUME_GROUPS" != "all" ] && [[ ! "${VOLUME_GROUPS// /}" =~ ^[A-Za-z0-9-]+(,[A-Za-z0-9-]+)*$ ]]; then
+        print_error "VOLUME_GROUPS must be 'all' or comma-separated hostnames (got '$VOLUME_GROUPS')"
+        errors=$((errors + 1))
+    fi
+    if [ "$VOLUME_BACKUP_POLICY" = "custom" ]; then
+        for entry in ${VOLUME_BACKUP_SCHEDULE//,/ }; do
+            if [[ ! "$entry" =~ ^(daily|weekly|monthly):[1-9][0-9]*$ ]]; then
+                print_error "VOLUME_BACKUP_SCHEDULE: '$entry' must look like weekly:2 (daily|weekly|monthly:<count>)"
+                errors=$((errors + 1))
+            fi
+        done
+        if [[ ! "$VOLUME_BACKUP_HOUR" =~ ^([01]?[0-9]|2[0-3])$ ]]; then
+            print_error "VOLUME_BACKUP_HOUR must be 0-23 (got '$VOLUME_BACKUP_HOUR')"
+            errors=$((errors + 1))
+        fi
+    fi
+    [ "$errors" -eq 0 ]
+}
+
+# After configuration: warn when the policy would keep more backups than Always Free includes
+check_volume_backup_allowance() {
+    validate_volume_backup_policy || return 1
+
+    local host
+    if [ -n "$VOLUME_GROUPS" ] && [ "$VOLUME_GROUPS" != "all" ]; then
+        for host in ${VOLUME_GROUPS//,/ }; do
+            if ! printf '%s\n' "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}" | grep -qxF "$host"; then
+                print_error "VOLUME_GROUPS: no configured instance is named '$host'"
+                return 1
+            fi
+            [ "$(instance_block_spec "$host")" = "0" ] && print_warning "VOLUME_GROUPS: $host has no block volumes - its group only holds the boot volume"
+        done
+    fi
+    if [ -n "$(volume_group_hosts)" ]; then
+        print_status "Volume groups: $(volume_group_hosts | paste -sd " " -)"
+        [ -n "$VOLUME_BACKUP_POLICY" ] || print_warning "VOLUME_GROUPS without VOLUME_BACKUP_POLICY creates the groups but schedules no backups"
+    fi
+
+    [ -n "$VOLUME_BACKUP_POLICY" ] || return 0
+
+    local volumes per_volume projected
+    volumes=$(volume_backup_volume_count)
+    per_volume=$(volume_backups_retained_per_volume)
+    projected=$((volumes * per_volume + VOLUME_BACKUPS_MANUAL))
+
+    print_status "Volume backups: $VOLUME_BACKUP_POLICY policy on $volumes volume(s) keeps ~$per_volume each"
+    if [ "$projected" -gt "$FREE_TIER_MAX_VOLUME_BACKUPS" ]; then
+        print_warning "That is ~$projected backups (including $VOLUME_BACKUPS_MANUAL manual ones), above the $FREE_TIER_MAX_VOLUME_BACKUPS included in Always Free - the rest are billed"
+        local fits=$(( (FREE_TIER_MAX_VOLUME_BACKUPS - VOLUME_BACKUPS_MANUAL) / (volumes > 0 ? volumes : 1) ))
+        if [ "$fits" -ge 1 ]; then
+            print_status "  To stay free use e.g. VOLUME_BACKUP_POLICY=custom VOLUME_BACKUP_SCHEDULE=weekly:$fits"
+        fi
+        confirm_action "Continue with this backup policy?" "N" || return 1
+    fi
+    return 0
+}
+
+# ============================================================================
+# AUTONOMOUS DATABASES
+# ============================================================================
+
+# Render AUTONOMOUS_DATABASES as a single-line HCL map: {"appdb":{"workload":"OLTP"}}
+autonomous_databases_tf() {
+    echo "${AUTONOMOUS_DATABASES// /}" | tr ',' '\n' | jq -Rn -c '
+        [inputs | select(length > 0) | split(":") | {(.[0] | ascii_downcase): {workload: ((.[1] // "OLTP") | ascii_upcase)}}] | add // {}'
+}
+
+# Check AUTONOMOUS_DATABASES syntax and, after inventory, the Always Free limit of two
+validate_autonomous_databases() {
+    [ -n "$AUTONOMOUS_DATABASES" ] || return 0
+    local errors=0 name workload planned
+
+    while IFS=: read -r name workload; do
+        [ -n "$name" ] || continue
+        if [[ ! "$name" =~ ^[A-Za-z][A-Za-z0-9]{0,13}$ ]]; then
+            print_error "AUTONOMOUS_DATABASES: '$name' must start with a letter and be up to 14 letters/digits"
+            errors=$((errors + 1))
+        fi
+        if [[ ! "${workload:-OLTP}" =~ ^(OLTP|DW|AJD|APEX|oltp|dw|ajd|apex)$ ]]; then
+            print_error "AUTONOMOUS_DATABASES: workload of '$name' must be OLTP, DW, AJD or APEX (got '$workload')"
+            errors=$((errors + 1))
+        fi
+    done <<< "$(echo "${AUTONOMOUS_DATABASES// /}" | tr ',' '\n')"
+
+    planned=$(autonomous_databases_tf)
+    if [ "$(jq 'length' <<< "$planned")" -gt "$FREE_TIER_MAX_AUTONOMOUS_DBS" ]; then
+        print_error "AUTONOMOUS_DATABASES lists more than $FREE_TIER_MAX_AUTONOMOUS_DBS databases (Always Free limit)"
+        errors=$((errors + 1))
+    fi
+
+    # Free databases outside the plan (unmanaged or simply not listed) use up the limit too
+    local id others=$UNMANAGED_AUTONOMOUS_DBS
+    for id in "${!EXISTING_AUTONOMOUS_DBS[@]}"; do
+        name=$(echo "${EXISTING_AUTONOMOUS_DBS[$id]}" | cut -d'|' -f1 | tr '[:upper:]' '[:lower:]')
+        jq -e --arg n "$name" 'has($n)' <<< "$planned" >/dev/null || others=$((others + 1))
+    done
+    if [ "$others" -gt 0 ] && [ $(( others + $(jq 'length' <<< "$planned") )) -gt "$FREE_TIER_MAX_AUTONOMOUS_DBS" ]; then
+        print_error "Cannot create $(jq -r 'keys | join(", ")' <<< "$planned"): $others other Always Free Autonomous Database(s) already exist"
+        errors=$((errors + 1))
+    fi
+
+    [ "$errors" -eq 0 ]
+}
+
+# Create the ADMIN password on first use: 12-30 characters with upper, lower and digit.
+# An existing file is always reused: the load-time read happens before a tenancy workspace
+# is entered, and a new password here would rotate ADMIN on the next apply.
+ensure_adb_admin_password() {
+    [ -n "${TF_VAR_adb_admin_password:-}" ] && return 0
+    if [ -f "$ADB_ADMIN_PASSWORD_FILE" ]; then
+        export TF_VAR_adb_admin_password="$(cat "$ADB_ADMIN_PASSWORD_FILE")"
+        return 0
+    fi
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would generate the Autonomous Database ADMIN password in $ADB_ADMIN_PASSWORD_FILE"
+        return 0
+    fi
+    (umask 077 && set -o noclobber && printf 'Cc1%s' "$(openssl rand -base64 48 | tr -dc 'A-Za-z0-9' | head -c 20)" > "$ADB_ADMIN_PASSWORD_FILE")
+    export TF_VAR_adb_admin_password="$(cat "$ADB_ADMIN_PASSWORD_FILE")"
+    print_status "Generated the Autonomous Database ADMIN password in $ADB_ADMIN_PASSWORD_FILE"
+}
+
+# Adopt existing Always Free databases whose names are listed in AUTONOMOUS_DATABASES
+import_autonomous_databases() {
+    [ -n "$AUTONOMOUS_DATABASES" ] || return 0
+    local planned id name address
+    planned=$(autonomous_databases_tf)
+    for id in "${!EXISTING_AUTONOMOUS_DBS[@]}"; do
+        name=$(echo "${EXISTING_AUTONOMOUS_DBS[$id]}" | cut -d'|' -f1 | tr '[:upper:]' '[:lower:]')
+        jq -e --arg n "$name" 'has($n)' <<< "$planned" >/dev/null || continue
+        address="oci_database_autonomous_database.free[\"$name\"]"
+        queue_import "$address" "$id" "Autonomous Database $name"
+    done
+}
+
+# Autonomous Databases from Terraform outputs as {name: {id, workload, state, ...}}
+adb_outputs() {
+    terraform output -json autonomous_databases 2>/dev/null || echo "{}"
+}
+
+# adb list: databases with their state and console URLs
+adb_list() {
+    local dbs
+    dbs=$(adb_outputs)
+    if [ "$(jq 'length' <<< "$dbs")" -eq 0 ]; then
+        print_status "No Autonomous Databases in Terraform outputs (set AUTONOMOUS_DATABASES and apply)"
+        return 0
+    fi
+    print_subheader "Always Free Autonomous Databases"
+    jq -r 'to_entries[] | "\(.key)\t\(.value.workload)\t\(.value.state)\t\(.value.service_url // "-")"' <<< "$dbs" \
+        | while IFS=$'\t' read -r name workload state url; do
+            printf "  %-14s %-5s %-12s %s\n" "$name" "$workload" "$state" "$url"
+        done
+    if jq -e 'any(.[]; .state == "STOPPED")' <<< "$dbs" >/dev/null; then
+        echo ""
+        print_status "Stopped databases (auto-stopped after 7 idle days) can be started with:"
+        print_status "  oci db autonomous-database start --autonomous-database-id <id>"
+    fi
+}
+
+# adb wallet NAME [--dir DIR]: download and unpack the connection wallet
+adb_wallet() {
+    local name="" dir=""
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --dir)
+                dir="${2:-}"
+                shift 2 || { print_error "--dir requires a directory"; return 2; }
+                ;;
+            *)
+                name="$1"
+                shift
+                ;;
+        esac
+    done
+    if [ -z "$name" ]; then
+        print_error "Usage: adb wallet NAME [--dir DIR]"
+        return 2
+    fi
+
+    local id
+    id=$(adb_outputs | jq -r --arg n "${name,,}" '.[$n].id // empty')
+    if [ -z "$id" ]; then
+        print_error "Unknown Autonomous Database: $name (see: adb list)"
+        return 1
+    fi
+    dir="${dir:-$ADB_WALLET_DIR/${name,,}}"
+
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would download the wallet of $name into $dir"
+        return 0
+    fi
+
+    # The wallet password protects the Java keystores inside; it is stored next to them
+    local password zip="$dir.zip"
+    password="Cc1$(openssl rand -base64 24 | tr -dc 'A-Za-z0-9' | head -c 13)"
+    mkdir -p "$(dirname "$zip")"
+    if ! oci_cmd "db autonomous-database generate-wallet --autonomous-database-id $id \
+        --password $password --generate-type SINGLE --file $zip" >/dev/null; then
+        print_error "Failed to download the wallet of $name"
+        return 1
+    fi
+    rm -rf "$dir"
+    (umask 077 && mkdir -p "$dir" && unzip -q -o "$zip" -d "$dir" && echo "$password" > "$dir/wallet-password") || {
+        print_error "Failed to unpack $zip"
+        return 1
+    }
+    rm -f "$zip"
+    chmod 700 "$dir"
+
+    print_success "Wallet for $name saved in $dir"
+    print_status "  export TNS_ADMIN=$(cd "$dir" && pwd)"
+    print_status "  Services: $(grep -oE '^[A-Za-z0-9_]+' "$dir/tnsnames.ora" 2>/dev/null | tr '\n' ' ')"
+    print_status "  e.g. sql ADMIN@${name,,}_high   (password in $ADB_ADMIN_PASSWORD_FILE)"
+}
+
+# Vault of the application secrets from Terraform outputs as {id, key_id, compartment_id, secrets}
+secrets_vault_output() {
+    terraform output -json secrets_vault 2>/dev/null | jq -c 'select(type == "object")' 2>/dev/null
+}
+
+# OCID of the active secret NAME in VAULT, if it exists
+secret_ocid() {
+    local vault="$1" name="$2"
+    oci_cmd "vault secret list --compartment-id $(jq -r '.compartment_id' <<< "$vault") --vault-id $(jq -r '.id' <<< "$vault") \
+        --name $name --lifecycle-state ACTIVE --query 'data[0].id' --raw-output" 2>/dev/null | grep '^ocid1\.' || true
+}
+
+# Store base64 VALUE as secret NAME of VAULT, as a new version when SECRET_ID (or a secret
+# of that name) exists. The value goes to the OCI CLI through a private temp file.
+vault_store_secret() {
+    local vault="$1" name="$2" value="$3" id="${4:-}" params rc=0
+    [ -n "$id" ] || id=$(secret_ocid "$vault" "$name")
+    params=$(mktemp)
+    (umask 077 && jq -R '{secretContentContent: .}' <<< "$value" > "$params")
+    if [ -n "$id" ]; then
+        oci_cmd "vault secret update-base64 --secret-id $id --from-json file://$params" >/dev/null || rc=1
+    else
+        oci_cmd "vault secret create-base64 --compartment-id $(jq -r '.compartment_id' <<< "$vault") \
+            --vault-id $(jq -r '.id' <<< "$vault") --key-id $(jq -r '.key_id' <<< "$vault") \
+            --secret-name $name --from-json file://$params" >/dev/null || rc=1
+    fi
+    rm -f "$params"
+    return "$rc"
+}
+
+# secrets list: declared secrets, the instances receiving them and whether a value is stored
+secrets_list() {
+    local vault stored
+    if [ ! -f "$SECRETS_FILE" ]; then
+        print_status "No secrets declared (add lines to $SECRETS_FILE)"
+        return 0
+    fi
+    vault=$(secrets_vault_output)
+    stored="[]"
+    if [ -n "$vault" ]; then
+        stored=$(oci_cmd "vault secret list --compartment-id $(jq -r '.compartment_id' <<< "$vault") \
+            --vault-id $(jq -r '.id' <<< "$vault") --lifecycle-state ACTIVE --all" 2>/dev/null \
+            | jq -c '[.data[]?."secret-name"]' 2>/dev/null) || stored="[]"
+    fi
+    print_subheader "Application secrets"
+    sed 's/#.*//' "$SECRETS_FILE" | while read -r target name path mode; do
+        [ -n "$path" ] || continue
+        printf "  %-24s %-12s %-36s %s\n" "$name" "$target" "$path" \
+            "$(jq -e --arg n "$name" 'index($n) != null' <<< "$stored" >/dev/null && echo stored || echo "not stored")"
+    done
+    [ -n "$vault" ] || print_warning "The vault does not exist yet - apply first, then store the values with: secrets set NAME"
+}
+
+# secrets set NAME [--from-file FILE]: store a value (from FILE, stdin or a prompt) in the vault.
+# The value goes to the OCI CLI through a private temp file, never on a command line.
+secrets_set() {
+    local name="" file="" value vault id params
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --from-file)
+                file="${2:-}"
+                shift 2 || { print_error "--from-file requires a file"; return 2; }
+                ;;
+            *)
+                name="$1"
+                shift
+                ;;
+        esac
+    done
+    if [ -z "$name" ]; then
+        print_error "Usage: secrets set NAME [--from-file FILE]"
+        return 2
+    fi
+    if [ ! -f "$SECRETS_FILE" ] || ! sed 's/#.*//' "$SECRETS_FILE" | awk -v n="$name" '$2 == n { found = 1 } END { exit !found }'; then
+        print_warning "$name is not declared in $SECRETS_FILE - no instance will receive it"
+    fi
+    vault=$(secrets_vault_output)
+    if [ -z "$vault" ]; then
+        print_error "No secrets vault in Terraform outputs (declare secrets in $SECRETS_FILE and apply first)"
+        return 1
+    fi
+
+    if [ -n "$file" ]; then
+        [ -r "$file" ] || { print_error "Cannot read $file"; return 1; }
+        value=$(base64 < "$file" | tr -d '\n')
+    elif [ -t 0 ]; then
+        echo -n -e "${BLUE}Value for $name (input hidden): ${NC}"
+        read -r -s value
+        echo ""
+        value=$(printf '%s' "$value" | base64 | tr -d '\n')
+    else
+        value=$(base64 | tr -d '\n')
+    fi
+    if [ -z "$value" ]; then
+        print_error "Refusing to store an empty value for $name"
+        return 1
+    fi
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would store $name in vault $SECRETS_VAULT_NAME"
+        return 0
+    fi
+
+    id=$(secret_ocid "$vault" "$name")
+    vault_store_secret "$vault" "$name" "$value" "$id" || { print_error "Failed to store $name"; return 1; }
+
+    print_success "Stored $name${id:+ (new version)}"
+    print_status "Instances fetch it at their next boot; to roll it out now:"
+    print_status "  $0 exec --all -- sudo systemctl restart cloudcradle-secrets"
+}
+
+# ============================================================================
+# OS UPGRADES
+# ============================================================================
+
+# Bring an Ubuntu instance fully up to date; prints REBOOT when a reboot is pending
+# shellcheck disable=SC2016  # expanded on the instance
+readonly UPGRADE_OS_UPDATE='set -e
+export DEBIAN_FRONTEND=noninteractive
+sudo -E apt-get update -q
+sudo -E apt-get -y -q -o Dpkg::Options::=--force-confdef -o Dpkg::Options::=--force-confold dist-upgrade
+if [ -f /var/run/reboot-required ]; then echo REBOOT; fi'
+
+# Upgrade to the next LTS release without prompts (the new release boots after a reboot)
+readonly UPGRADE_OS_RELEASE='set -e
+sudo sed -i "s/^Prompt=.*/Prompt=lts/" /etc/update-manager/release-upgrades
+sudo do-release-upgrade -f DistUpgradeViewNonInteractive'
+
+# Terraform address of a deployed instance, when it is one of the hostnames of its kind
+instance_address() {
+    local name="$1" kind="$2" list
+    case "$kind" in
+        amd) list=amd_micro_hostnames ;;
+        *) list=arm_flex_hostnames ;;
+    esac
+    grep -oP "$list\s*=\s*\[\K[^\]]+" variables.tf 2>/dev/null | head -1 | tr -d '" ' | tr ',' '\n' \
+        | grep -qxF "$name" || return 1
+    tf_address "oci_core_instance.$kind[\"$name\"]"
+}
+
+# Release (VERSION_ID) running on an instance, empty when unreachable
+instance_os_release() {
+    ssh_instance "$1" '. /etc/os-release && echo "$VERSION_ID"' 2>/dev/null | tail -1
+}
+
+# Reboot an instance and wait until SSH answers again
+reboot_and_wait() {
+    local name="$1" ip="$2" started
+    print_status "  Rebooting $name..."
+    ssh_instance "$ip" "sudo systemctl reboot" >/dev/null 2>&1 || true
+    sleep 20
+    started=$(date +%s)
+    until ssh_instance "$ip" true >/dev/null 2>&1; do
+        if [ $(( $(date +%s) - started )) -ge "$READINESS_TIMEOUT" ]; then
+            print_error "  $name did not come back within ${READINESS_TIMEOUT}s"
+            return 1
+        fi
+        sleep "$READINESS_INTERVAL"
+    done
+}
+
+# In-place strategy: update, reboot if needed, do-release-upgrade, reboot, check the release
+upgrade_os_in_place() {
+    local name="$1" ip="$2" to="$3" log="$4" output release
+    print_status "  Updating packages (log: $log)..."
+    output=$(ssh_instance "$ip" "$UPGRADE_OS_UPDATE" 2>&1 | tee -a "$log") || {
+        print_error "  Package update failed on $name (see $log)"
+        return 1
+    }
+    if [[ "$output" == *REBOOT* ]]; then
+        reboot_and_wait "$name" "$ip" || return 1
+    fi
+    print_status "  Running do-release-upgrade (this takes a while)..."
+    if ! ssh_instance "$ip" "$UPGRADE_OS_RELEASE" >> "$log" 2>&1; then
+        print_error "  do-release-upgrade failed on $name (see $log)"
+        return 1
+    fi
+    reboot_and_wait "$name" "$ip" || return 1
+    release=$(instance_os_release "$ip")
+    if [ "$release" != "$to" ]; then
+        print_error "  $name runs ${release:-an unknown release} after the upgrade, expected $to (see $log)"
+        return 1
+    fi
+}
+
+# Replace strategy: recreate the instance from the image now pinned in the config. The
+# boot volume is rebuilt (block volumes are kept); the instance comes up through cloud-init.
+upgrade_os_replace() {
+    local name="$1" kind="$2" log="$3" address
+    if ! address=$(instance_address "$name" "$kind"); then
+        print_error "  Cannot find $name in variables.tf"
+        return 1
+    fi
+    print_status "  Replacing $address (log: $log)..."
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform plan -input=false -out=tfplan -replace="$address" $(terraform_plan_args) >> "$log" 2>&1; then
+        print_error "  Plan failed for $name (see $log)"
+        prevent_destroy_hint "$log"
+        return 1
+    fi
+    print_status "  $(terraform show -no-color tfplan | grep -E '^Plan:' || echo 'Plan: see tfplan')"
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform apply -input=false $(terraform_apply_args) tfplan >> "$log" 2>&1; then
+        print_error "  Apply failed for $name (see $log)"
+        return 1
+    fi
+    rm -f tfplan "$TF_PLAN_CACHE_FILE"
+    FLEET_JSON=""
+    load_fleet || true
+    verify_ssh_hardening >> "$log" 2>&1 || true
+}
+
+# upgrade-os [TARGETS] [--to VERSION] [--strategy in-place|replace] [--yes]: move the fleet
+# to a new Ubuntu release one instance at a time, checking each before the next and
+# stopping at the first failure
+upgrade_os() {
+    local to="" strategy="in-place" yes=false
+    local -a args=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --to)
+                to="${2:-}"
+                shift 2 || { print_error "--to requires a release (e.g. 24.04)"; return 2; }
+                ;;
+            --strategy)
+                strategy="${2:-}"
+                shift 2 || { print_error "--strategy requires in-place or replace"; return 2; }
+                ;;
+            --yes|-y)
+                yes=true
+                shift
+                ;;
+            *)
+                args+=("$1")
+                shift
+                ;;
+        esac
+    done
+    [ ${#args[@]} -gt 0 ] || args=(--all)
+    to=${to:-${SUPPORTED_UBUNTU_VERSIONS##* }}
+
+    case "$strategy" in
+        in-place|replace) ;;
+        *)
+            print_error "--strategy must be in-place or replace (got '$strategy')"
+            return 2
+            ;;
+    esac
+    resolve_instance_os >/dev/null 2>&1 || true
+    if [ "$INSTANCE_OS" != "ubuntu" ]; then
+        print_error "upgrade-os supports Ubuntu instances (this fleet runs $INSTANCE_OS)"
+        return 1
+    fi
+    if [[ ! " $SUPPORTED_UBUNTU_VERSIONS " == *" $to "* ]]; then
+        print_error "--to must be one of: $SUPPORTED_UBUNTU_VERSIONS (got '$to')"
+        return 2
+    fi
+    if [ "$strategy" = "replace" ] \
+        && ! jq -e --arg s "ubuntu $to " 'any(.[]; (.selection // "") + " " | startswith($s))' "$IMAGE_LOCK_FILE" >/dev/null 2>&1; then
+        print_error "The config does not pin Ubuntu $to images yet, so a replacement would boot the old release."
+        print_status "Regenerate the files first, then re-run upgrade-os:"
+        print_status "  $0 --ubuntu-version $to --emit-only"
+        return 1
+    fi
+    # Only replacements talk to OCI (through Terraform); in-place upgrades are SSH only
+    if [ "$strategy" = "replace" ]; then
+        prepare_oci_session || return 1
+    fi
+    parse_fleet_targets "${args[@]}" || return 1
+
+    # Plan: the release each target runs now; instances already on $to are skipped
+    local name ip release
+    local -a pending=()
+    print_subheader "OS upgrade to Ubuntu $to ($strategy)"
+    for name in "${FLEET_TARGETS[@]}"; do
+        ip=$(fleet_ssh_host "$name")
+        release=$(instance_os_release "$ip")
+        if [ "$release" = "$to" ]; then
+            print_status "  $name: already on $to"
+        else
+            print_status "  $name: ${release:-unreachable} -> $to"
+            pending+=("$name")
+        fi
+    done
+    if [ ${#pending[@]} -eq 0 ]; then
+        print_success "Every target already runs Ubuntu $to"
+        return 0
+    fi
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would upgrade ${pending[*]}, one at a time"
+        return 0
+    fi
+    if [ "$strategy" = "replace" ]; then
+        print_warning "Replacing an instance rebuilds its boot volume: data outside block volumes is lost"
+    else
+        print_warning "Each instance is unavailable for its upgrade and reboots (typically 15-30 minutes)"
+    fi
+    if [ "$yes" != "true" ] && ! confirm_action "Upgrade ${#pending[@]} instance(s) one at a time?" "N"; then
+        print_status "Cancelled"
+        return 1
+    fi
+
+    local i=0 kind log failed_step
+    for name in "${pending[@]}"; do
+        i=$((i + 1))
+        print_subheader "$name ($i/${#pending[@]})"
+        ip=$(fleet_ssh_host "$name")
+        kind=$(fleet_field "$name" kind)
+        log="upgrade-os-$name.log"
+        failed_step=""
+        audit_log upgrade-os "host=$name to=$to strategy=$strategy"
+
+        if [ "$strategy" = "replace" ]; then
+            upgrade_os_replace "$name" "$kind" "$log" || failed_step="replace"
+        else
+            upgrade_os_in_place "$name" "$ip" "$to" "$log" || failed_step="upgrade"
+        fi
+        if [ -z "$failed_step" ] && ! run_readiness_checks "$name"; then
+            failed_step="readiness checks"
+        fi
+
+        if [ -n "$failed_step" ]; then
+            audit_log upgrade-os-failed "host=$name step=$failed_step"
+            print_error "Stopped: $failed_step failed on $name"
+            [ "$i" -lt ${#pending[@]} ] && print_status "Not upgraded: ${pending[*]:$i}"
+            print_status "Fix $name, then re-run upgrade-os; instances already on $to are skipped"
+            return 1
+        fi
+        print_success "$name now runs Ubuntu $to"
+    done
+    print_success "All ${#pending[@]} instance(s) upgraded to Ubuntu $to"
+}
+
+# ============================================================================
+# ARM RESHAPING
+# ============================================================================
+
+# Replace the value of a one-line "<key> = ..." entry of the variables.tf locals with HCL
+set_variables_tf_local() {
+    local key="$1" value="$2" tmp
+    tmp=$(mktemp)
+    KEY="$key" VALUE="$value" awk '$1 == ENVIRON["KEY"] && $2 == "=" { sub(/=.*/, "= " ENVIRON["VALUE"]) } { print }' \
+        variables.tf > "$tmp" && mv "$tmp" variables.tf
+}
+
+# Write the ARM instances of the loaded configuration (count, sizes, hostnames and block
+# volumes) back to variables.tf, leaving everything else as generated
+# shellcheck disable=SC2046,SC2086  # the per-instance lists are split into arguments
+write_arm_layout() {
+    local count="$arm_flex_instance_count"
+    local -a hosts=("${arm_flex_hostnames[@]:0:$count}")
+    set_variables_tf_local arm_flex_instance_count "$count"
+    set_variables_tf_local arm_flex_ocpus_per_instance "$(hcl_list "$count" $arm_flex_ocpus_per_instance)"
+    set_variables_tf_local arm_flex_memory_per_instance "$(hcl_list "$count" $arm_flex_memory_per_instance)"
+    set_variables_tf_local arm_flex_boot_volume_size_gb "$(hcl_list "$count" $arm_flex_boot_volume_size_gb)"
+    set_variables_tf_local arm_flex_hostnames "$(hcl_list "$count" $(printf '"%s" ' "${hosts[@]}"))"
+    set_variables_tf_local block_volumes "$(block_volumes_tf)"
+}
+
+# "[a, b]" from the first COUNT of the remaining arguments
+hcl_list() {
+    local count="$1"
+    shift
+    local -a values=("${@:1:$count}")
+    local IFS=,
+    echo "[${values[*]}]" | sed 's/,/, /g'
+}
+
+# Run as root on an instance after its boot volume grew: rescan the disk, grow the root
+# partition and its filesystem (oci-growfs handles the LVM layout of Oracle Linux)
+# shellcheck disable=SC2016  # expanded on the instance
+readonly BOOT_VOLUME_EXPAND='set -e
+if [ -x /usr/libexec/oci-growfs ]; then
+    /usr/libexec/oci-growfs -y
+    exit 0
+fi
+root=$(findmnt -no SOURCE /)
+disk=$(lsblk -no PKNAME "$root")
+echo 1 > "/sys/class/block/$disk/device/rescan" || true
+growpart "/dev/$disk" "$(cat "/sys/class/block/$(basename "$root")/partition")" || [ $? -eq 1 ]
+case "$(findmnt -no FSTYPE /)" in
+    xfs) xfs_growfs / ;;
+    *) resize2fs "$root" ;;
+esac
+df -h /'
+
+# resize INSTANCE [--ocpus N] [--memory GB] [--boot GB] [--no-expand] [--yes]: reshape an
+# ARM instance or grow a boot volume in place, within the Always Free OCPUs, memory and
+# storage left by the rest of the fleet and by resources outside this config
+resize_instance() {
+    local name="" ocpus="" memory="" boot="" expand=true yes=false
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --ocpus)
+                ocpus="${2:-}"
+                shift 2 || { print_error "--ocpus requires a number"; return 2; }
+                ;;
+            --memory)
+                memory="${2:-}"
+                shift 2 || { print_error "--memory requires a size in GB"; return 2; }
+                ;;
+            --boot)
+                boot="${2:-}"
+                shift 2 || { print_error "--boot requires a size in GB"; return 2; }
+                ;;
+            --no-expand)
+                expand=false
+                shift
+                ;;
+            --yes|-y)
+                yes=true
+                shift
+                ;;
+            *)
+                name="$1"
+                shift
+                ;;
+        esac
+    done
+    if [ -z "$name" ] || [ -z "$ocpus$memory$boot" ]; then
+        print_error "Usage: resize INSTANCE [--ocpus N] [--memory GB] [--boot GB] [--no-expand] [--yes]"
+        return 2
+    fi
+    if [[ ! "${ocpus:-1}" =~ ^[1-9][0-9]*$ ]] || [[ ! "${memory:-1}" =~ ^[1-9][0-9]*$ ]] || [[ ! "${boot:-1}" =~ ^[1-9][0-9]*$ ]]; then
+        print_error "--ocpus, --memory and --boot must be whole numbers"
+        return 2
+    fi
+    if ! load_existing_config >/dev/null 2>&1; then
+        print_error "No variables.tf in this directory - run the setup first"
+        return 1
+    fi
+
+    local i index="" kind=arm old_ocpus="" old_memory="" old_boot
+    local -a ocpu_list memory_list boot_list hosts addresses=()
+    for ((i = 0; i < arm_flex_instance_count; i++)); do
+        [ "${arm_flex_hostnames[$i]}" = "$name" ] && index=$i
+    done
+    if [ -z "$index" ]; then
+        for ((i = 0; i < amd_micro_instance_count; i++)); do
+            [ "${amd_micro_hostnames[$i]}" = "$name" ] && index=$i && kind=amd
+        done
+    fi
+    if [ -z "$index" ]; then
+        print_error "Unknown instance: $name"
+        return 1
+    fi
+    if [ "$kind" = "amd" ] && [ -n "$ocpus$memory" ]; then
+        print_error "$name is an AMD micro instance; its shape ($FREE_TIER_AMD_SHAPE) is fixed (only --boot applies)"
+        return 1
+    fi
+
+    read -r -a ocpu_list <<< "$arm_flex_ocpus_per_instance"
+    read -r -a memory_list <<< "$arm_flex_memory_per_instance"
+    read -r -a boot_list <<< "$arm_flex_boot_volume_size_gb"
+    if [ "$kind" = "arm" ]; then
+        old_ocpus=${ocpu_list[$index]}
+        old_memory=${memory_list[$index]}
+        old_boot=${boot_list[$index]}
+        ocpus=${ocpus:-$old_ocpus}
+        memory=${memory:-$old_memory}
+        # A1.Flex takes 1 to 64GB of memory per OCPU
+        if [ "$memory" -lt "$ocpus" ] || [ "$memory" -gt $((ocpus * 64)) ]; then
+            print_error "$ocpus OCPU(s) need between ${ocpus}GB and $((ocpus * 64))GB of memory (got ${memory}GB)"
+            return 2
+        fi
+        hosts=("$name")
+        addresses=("oci_core_instance.arm[\"$name\"]")
+    else
+        old_boot=$amd_micro_boot_volume_size_gb
+        # One boot size applies to every AMD instance
+        hosts=("${amd_micro_hostnames[@]:0:$amd_micro_instance_count}")
+        for ((i = 0; i < amd_micro_instance_count; i++)); do
+            addresses+=("oci_core_instance.amd[\"${amd_micro_hostnames[$i]}\"]")
+        done
+    fi
+    boot=${boot:-$old_boot}
+    if [ "$boot" -lt "$old_boot" ]; then
+        print_error "Boot volumes can only grow (${old_boot}GB now); shrinking needs a new instance"
+        return 2
+    fi
+    if [ "$ocpus" = "$old_ocpus" ] && [ "$memory" = "$old_memory" ] && [ "$boot" = "$old_boot" ]; then
+        print_success "$name already has $([ "$kind" = "arm" ] && echo "$ocpus OCPU(s), ${memory}GB and ")a ${boot}GB boot volume"
+        return 0
+    fi
+
+    # Check the Always Free limits against live usage outside this config
+    prepare_oci_session || return 1
+    { NON_INTERACTIVE=true inventory_section compute && NON_INTERACTIVE=true inventory_section storage; } </dev/null >/dev/null 2>&1 \
+        || print_warning "Inventory failed - checking against the bare Free Tier limits"
+    if [ "$kind" = "arm" ]; then
+        ocpu_list[$index]=$ocpus
+        memory_list[$index]=$memory
+        boot_list[$index]=$boot
+        arm_flex_ocpus_per_instance="${ocpu_list[*]}"
+        arm_flex_memory_per_instance="${memory_list[*]}"
+        arm_flex_boot_volume_size_gb="${boot_list[*]}"
+    else
+        amd_micro_boot_volume_size_gb=$boot
+    fi
+    local violations
+    violations=$(free_tier_violations | awk -F'\t' '$2 ~ /^quota-(arm-ocpus|arm-memory|storage)$/ { print $3 }')
+    if [ -n "$violations" ]; then
+        print_error "$name cannot grow to this size within the Always Free limits:"
+        echo "$violations" | sed 's/^/  /'
+        print_status "Free capacity first: shrink another ARM instance, or delete orphaned volumes with 'cleanup'"
+        return 1
+    fi
+
+    print_subheader "Resize $name"
+    [ "$kind" = "arm" ] && [ "$ocpus/$memory" != "$old_ocpus/$old_memory" ] \
+        && print_status "  $old_ocpus OCPU(s) / ${old_memory}GB -> $ocpus OCPU(s) / ${memory}GB"
+    if [ "$boot" != "$old_boot" ]; then
+        print_status "  boot volume ${old_boot}GB -> ${boot}GB"
+        [ ${#hosts[@]} -gt 1 ] && print_warning "AMD instances share one boot volume size: ${hosts[*]} all grow to ${boot}GB"
+    fi
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would update variables.tf and apply $(for address in "${addresses[@]}"; do printf -- '-target=%s ' "$(tf_address "$address")"; done)"
+        return 0
+    fi
+    [ "$ocpus/$memory" != "$old_ocpus/$old_memory" ] && print_warning "OCI may restart $name to apply the new shape"
+    [ "$ocpus/$memory" != "$old_ocpus/$old_memory" ] && [ "$(capacity_reservation)" != "none" ] \
+        && print_warning "$name launches into a capacity reservation: the new size needs reserved or free A1 capacity"
+    if [ "$yes" != "true" ] && ! confirm_action "Resize $name?" "N"; then
+        print_status "Cancelled"
+        return 1
+    fi
+
+    local backup log="resize-$name.log" address
+    local -a targets=()
+    for address in "${addresses[@]}"; do
+        targets+=("-target=$(tf_address "$address")")
+    done
+    backup=$(mktemp)
+    cp variables.tf "$backup"
+    if [ "$kind" = "arm" ]; then
+        write_arm_layout
+    else
+        set_variables_tf_local amd_micro_boot_volume_size_gb "$boot"
+    fi
+
+    print_status "Planning ${addresses[*]} (log: $log)..."
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform plan -input=false -out=tfplan "${targets[@]}" $(terraform_plan_args) > "$log" 2>&1; then
+        print_error "Plan failed (see $log); variables.tf restored"
+        prevent_destroy_hint "$log"
+        mv "$backup" variables.tf
+        return 1
+    fi
+    # Other pending changes (e.g. cloud-init edits) could force a replacement instead
+    if ! terraform show -json tfplan 2>/dev/null \
+        | jq -e '[.resource_changes[]? | select(.change.actions | index("delete"))] | length == 0' >/dev/null; then
+        print_error "The plan would replace $name rather than resize it; variables.tf restored"
+        print_status "Apply the pending changes first (terraform plan shows them), then resize again"
+        mv "$backup" variables.tf
+        rm -f tfplan
+        return 1
+    fi
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform apply -input=false $(terraform_apply_args) tfplan >> "$log" 2>&1; then
+        print_error "Apply failed (see $log); variables.tf restored"
+        mv "$backup" variables.tf
+        rm -f tfplan
+        return 1
+    fi
+    rm -f "$backup" tfplan "$TF_PLAN_CACHE_FILE"
+    audit_log resize "host=$name$([ "$kind" = "arm" ] && echo " ocpus=$ocpus memory=${memory}GB") boot=${boot}GB"
+    print_success "$name resized"
+    FLEET_JSON=""
+
+    # The instance only sees the extra space once its partition and filesystem grow
+    if [ "$boot" != "$old_boot" ]; then
+        local host
+        local -a pending=()
+        if [ "$expand" = "true" ] && load_fleet; then
+            for host in "${hosts[@]}"; do
+                print_status "Growing the root filesystem of $host..."
+                if ssh_instance "$(fleet_ssh_host "$host")" "sudo bash -c $(shell_quote "$BOOT_VOLUME_EXPAND")" >> "$log" 2>&1; then
+                    print_success "  $host: $(tail -1 "$log" | awk '{ print $2 " total, " $4 " free" }')"
+                else
+                    print_warning "  $host: could not grow the filesystem over SSH (see $log)"
+                    pending+=("$host")
+                fi
+            done
+        else
+            pending=("${hosts[@]}")
+        fi
+        if [ ${#pending[@]} -gt 0 ]; then
+            print_status "Grow the root filesystem on ${pending[*]} with (as root):"
+            echo "$BOOT_VOLUME_EXPAND" | sed 's/^/    /'
+        fi
+    fi
+    run_readiness_checks "${hosts[@]}"
+}
+
+# Split OCPUS and MEMORY (GB) evenly over COUNT instances, the remainder going to the first
+# ones: prints the two comma-separated lists, e.g. "2,1,1 8,8,8"
+rebalance_split() {
+    local count="$1" ocpus="$2" memory="$3" i
+    local -a ocpu_list=() memory_list=()
+    for ((i = 0; i < count; i++)); do
+        ocpu_list+=($(( ocpus / count + (i < ocpus % count ? 1 : 0) )))
+        memory_list+=($(( memory / count + (i < memory % count ? 1 : 0) )))
+    done
+    local IFS=,
+    echo "${ocpu_list[*]} ${memory_list[*]}"
+}
+
+# "2/12, 1/6" for comma- or space-separated OCPU and memory lists
+rebalance_layout() {
+    paste -d/ <(tr ', ' '\n\n' <<< "$1" | grep .) <(tr ', ' '\n\n' <<< "$2" | grep . | sed 's/$/GB/') | paste -sd, | sed 's/,/, /g'
+}
+
+# Plan and apply the whole configuration for one rebalance step, refusing plans that would
+# replace one of the first KEEP ARM instances or any AMD instance
+rebalance_apply() {
+    local step="$1" keep="$2" log="$3"
+    print_status "$step: planning (log: $log)..."
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform plan -input=false -out=tfplan $(terraform_plan_args) >> "$log" 2>&1; then
+        print_error "$step: plan failed (see $log)"
+        prevent_destroy_hint "$log"
+        return 1
+    fi
+    local kept
+    kept=$(printf '%s\n' "${arm_flex_hostnames[@]:0:$keep}" | jq -R . | jq -s -c 'map(select(length > 0))')
+    if ! terraform show -json tfplan 2>/dev/null | jq -e --argjson keep "$kept" '
+        [.resource_changes[]? | select(.type == "oci_core_instance" and (.change.actions | index("delete"))
+            and (.name == "amd" or (.index as $i | any($keep[]; . == $i))))] | length == 0' >/dev/null; then
+        print_error "$step: the plan would replace instances that should be kept (see terraform plan)"
+        rm -f tfplan
+        return 1
+    fi
+    print_status "$step: $(terraform show -no-color tfplan | grep -E '^Plan:' || echo 'No changes.')"
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform apply -input=false $(terraform_apply_args) tfplan >> "$log" 2>&1; then
+        print_error "$step: apply failed (see $log)"
+        rm -f tfplan
+        return 1
+    fi
+    rm -f tfplan "$TF_PLAN_CACHE_FILE"
+    store_backup_passwords || true
+}
+
+# rebalance [--instances N | --ocpus LIST --memory LIST] [--yes]: redistribute the Always
+# Free ARM OCPUs and memory over 1-4 instances. Without options, list the even splits.
+# Shrinking and removing instances is applied before growing and adding, so the tenancy
+# never goes over the limits in between.
+rebalance() {
+    local count="" ocpus="" memory="" yes=false
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --instances)
+                count="${2:-}"
+                shift 2 || { print_error "--instances requires a number (1-$FREE_TIER_MAX_ARM_INSTANCES)"; return 2; }
+                ;;
+            --ocpus)
+                ocpus="${2:-}"
+                shift 2 || { print_error "--ocpus requires a list (e.g. 2,1,1)"; return 2; }
+                ;;
+            --memory)
+                memory="${2:-}"
+                shift 2 || { print_error "--memory requires a list in GB (e.g. 12,6,6)"; return 2; }
+                ;;
+            --yes|-y)
+                yes=true
+                shift
+                ;;
+            *)
+                print_error "Unknown rebalance option: $1 (see $0 help)"
+                return 2
+                ;;
+        esac
+    done
+    if [ -n "$count" ] && [[ ! "$count" =~ ^[1-9][0-9]*$ ]]; then
+        print_error "--instances must be a number (got '$count')"
+        return 2
+    fi
+    if [ -n "$ocpus$memory" ] && { [[ ! "$ocpus" =~ ^[1-9][0-9]*(,[1-9][0-9]*)*$ ]] || [[ ! "$memory" =~ ^[1-9][0-9]*(,[1-9][0-9]*)*$ ]] \
+        || [ "$(tr -cd , <<< "$ocpus")" != "$(tr -cd , <<< "$memory")" ]; }; then
+        print_error "--ocpus and --memory need one whole number per instance, e.g. --ocpus 2,1,1 --memory 12,6,6"
+        return 2
+    fi
+    if ! load_existing_config >/dev/null 2>&1; then
+        print_error "No variables.tf in this directory - run the setup first"
+        return 1
+    fi
+
+    prepare_oci_session || return 1
+    NON_INTERACTIVE=true inventory_section compute </dev/null >/dev/null 2>&1 \
+        || print_warning "Inventory failed - planning with the bare Free Tier limits"
+    local free_ocpus=$((FREE_TIER_MAX_ARM_OCPUS - UNMANAGED_ARM_OCPUS))
+    local free_memory=$((FREE_TIER_MAX_ARM_MEMORY_GB - UNMANAGED_ARM_MEMORY_GB))
+    local old_count="$arm_flex_instance_count" n split
+    local -a old_ocpus old_memory old_hosts=("${arm_flex_hostnames[@]:0:$arm_flex_instance_count}")
+    read -r -a old_ocpus <<< "$arm_flex_ocpus_per_instance"
+    read -r -a old_memory <<< "$arm_flex_memory_per_instance"
+
+    if [ -z "$count$ocpus" ]; then
+        print_subheader "ARM layouts for $free_ocpus OCPUs / ${free_memory}GB"
+        print_status "  current         $old_count instance(s): $(rebalance_layout "${old_ocpus[*]:0:$old_count}" "${old_memory[*]:0:$old_count}")"
+        for ((n = 1; n <= FREE_TIER_MAX_ARM_INSTANCES && n <= free_ocpus; n++)); do
+            split=$(rebalance_split "$n" "$free_ocpus" "$free_memory")
+            print_status "  --instances $n   $(rebalance_layout ${split})"
+        done
+        print_status "Apply one with: $0 rebalance --instances N (or --ocpus LIST --memory LIST)"
+        return 0
+    fi
+
+    if [ -z "$ocpus" ]; then
+        read -r ocpus memory <<< "$(rebalance_split "$count" "$free_ocpus" "$free_memory")"
+    elif [ -n "$count" ] && [ "$count" -ne $(( $(tr -cd , <<< "$ocpus" | wc -c) + 1 )) ]; then
+        print_error "--instances $count does not match the $(( $(tr -cd , <<< "$ocpus" | wc -c) + 1 )) sizes given"
+        return 2
+    fi
+    count=$(( $(tr -cd , <<< "$ocpus" | wc -c) + 1 ))
+    if [ "$count" -gt "$FREE_TIER_MAX_ARM_INSTANCES" ]; then
+        print_error "At most $FREE_TIER_MAX_ARM_INSTANCES ARM instances fit in the free OCPUs (got $count)"
+        return 2
+    fi
+    whatif_set arm "$count" && whatif_set arm-ocpus "$ocpus" && whatif_set arm-memory "$memory" || return 2
+
+    local i violations
+    local -a new_ocpus new_memory
+    read -r -a new_ocpus <<< "$arm_flex_ocpus_per_instance"
+    read -r -a new_memory <<< "$arm_flex_memory_per_instance"
+    for ((i = 0; i < count; i++)); do
+        # A1.Flex takes 1 to 64GB of memory per OCPU
+        if [ "${new_memory[$i]}" -lt "${new_ocpus[$i]}" ] || [ "${new_memory[$i]}" -gt $(( new_ocpus[i] * 64 )) ]; then
+            print_error "${arm_flex_hostnames[$i]}: ${new_ocpus[$i]} OCPU(s) need between ${new_ocpus[$i]}GB and $(( new_ocpus[i] * 64 ))GB of memory"
+            return 2
+        fi
+    done
+    violations=$(free_tier_violations | cut -f3)
+    if [ -n "$violations" ]; then
+        print_error "This layout does not fit the Always Free limits:"
+        echo "$violations" | sed 's/^/  /'
+        return 1
+    fi
+
+    # What happens to each instance: kept, reshaped, destroyed or created
+    local changes=0 shrink=false name action
+    print_subheader "ARM rebalance: $old_count -> $count instance(s)"
+    for ((i = 0; i < old_count || i < count; i++)); do
+        if [ "$i" -lt "$old_count" ] && [ "$i" -lt "$count" ]; then
+            name="${old_hosts[$i]}"
+            if [ "${old_ocpus[$i]}" = "${new_ocpus[$i]}" ] && [ "${old_memory[$i]}" = "${new_memory[$i]}" ]; then
+                action="keep      ${new_ocpus[$i]}/${new_memory[$i]}GB"
+            else
+                action="reshape   ${old_ocpus[$i]}/${old_memory[$i]}GB -> ${new_ocpus[$i]}/${new_memory[$i]}GB"
+                changes=$((changes + 1))
+                if [ "${new_ocpus[$i]}" -lt "${old_ocpus[$i]}" ] || [ "${new_memory[$i]}" -lt "${old_memory[$i]}" ]; then
+                    shrink=true
+                fi
+            fi
+        elif [ "$i" -lt "$old_count" ]; then
+            name="${old_hosts[$i]}"
+            action="DESTROY   ${old_ocpus[$i]}/${old_memory[$i]}GB (boot volume$([ "${arm_flex_block_volumes[$i]:-0}" != "0" ] && echo " and block volumes") deleted)"
+            changes=$((changes + 1))
+            shrink=true
+        else
+            name="${arm_flex_hostnames[$i]}"
+            action="create    ${new_ocpus[$i]}/${new_memory[$i]}GB"
+            changes=$((changes + 1))
+        fi
+        printf '  %-24s %s\n' "$name" "$action"
+    done
+    if [ "$changes" -eq 0 ]; then
+        print_success "The ARM instances already have this layout"
+        return 0
+    fi
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would update variables.tf and apply $([ "$shrink" = "true" ] && echo "in two steps (shrink, then grow)" || echo "once")"
+        return 0
+    fi
+    [ "$count" -lt "$old_count" ] && print_warning "Destroyed instances lose all data on their boot and block volumes"
+    print_warning "OCI may restart reshaped instances"
+    if [ "$yes" != "true" ] && ! confirm_action "Rebalance the ARM instances?" "N"; then
+        print_status "Cancelled"
+        return 1
+    fi
+
+    local log="rebalance.log" keep=$(( old_count < count ? old_count : count )) backup
+    local final_ocpus="$arm_flex_ocpus_per_instance" final_memory="$arm_flex_memory_per_instance"
+    audit_log rebalance "from=$(rebalance_layout "${old_ocpus[*]:0:$old_count}" "${old_memory[*]:0:$old_count}" | tr -d ' ') to=$(rebalance_layout "$final_ocpus" "$final_memory" | tr -d ' ')"
+    : > "$log"
+    if [ "$shrink" = "true" ]; then
+        # Step 1: drop the removed instances and shrink the kept ones to the smaller size
+        local -a step_ocpus=() step_memory=()
+        for ((i = 0; i < keep; i++)); do
+            step_ocpus+=($(( old_ocpus[i] < new_ocpus[i] ? old_ocpus[i] : new_ocpus[i] )))
+            step_memory+=($(( old_memory[i] < new_memory[i] ? old_memory[i] : new_memory[i] )))
+        done
+        arm_flex_instance_count="$keep"
+        arm_flex_ocpus_per_instance="${step_ocpus[*]}"
+        arm_flex_memory_per_instance="${step_memory[*]}"
+        backup=$(mktemp)
+        cp variables.tf "$backup"
+        write_arm_layout
+        if ! rebalance_apply "Step 1/2 (shrink)" "$keep" "$log"; then
+            # Re-running from the original layout repeats whatever step 1 did not finish
+            mv "$backup" variables.tf
+            audit_log rebalance-failed "step=shrink"
+            print_status "variables.tf restored; fix the problem and re-run rebalance"
+            return 1
+        fi
+        rm -f "$backup"
+    fi
+    arm_flex_instance_count="$count"
+    arm_flex_ocpus_per_instance="$final_ocpus"
+    arm_flex_memory_per_instance="$final_memory"
+    write_arm_layout
+    if ! rebalance_apply "$([ "$shrink" = "true" ] && echo "Step 2/2 (grow)" || echo "Apply")" "$keep" "$log"; then
+        audit_log rebalance-failed "step=grow"
+        print_status "variables.tf holds the new layout; fix the problem and re-run terraform apply"
+        return 1
+    fi
+    print_success "ARM instances rebalanced: $(rebalance_layout "$final_ocpus" "$final_memory")"
+    FLEET_JSON=""
+    run_readiness_checks
+}
+
+# ============================================================================
+# HOSTNAME RENAMES
+# ============================================================================
+
+# Run as root on a renamed instance with the new hostname and dynamic DNS name: set the
+# hostname, keep cloud-init from restoring the launch name on boot and repoint DDNS
+# shellcheck disable=SC2016  # expanded on the instance
+readonly HOSTNAME_RENAME='set -e
+hostnamectl set-hostname "$1"
+printf "preserve_hostname: true\n" > /etc/cloud/cloud.cfg.d/99-cloudcradle-hostname.cfg
+for f in /etc/hosts /etc/cloud/templates/hosts.*.tmpl; do
+    if [ -f "$f" ] && ! grep -q "[[:space:]]$1\([[:space:]]\|$\)" "$f"; then
+        echo "127.0.1.1 $1 $1.local" >> "$f"
+    fi
+done
+if [ -n "$2" ] && [ -f /etc/cloudcradle/ddns.env ]; then
+    sed -i "s|^DDNS_DOMAIN=.*|DDNS_DOMAIN=$2|" /etc/cloudcradle/ddns.env
+    systemctl start cloudcradle-ddns.service
+fi
+hostname'
+
+# Rename OLD to NEW in variables.tf: hostname lists, map keys (per-instance settings and
+# labels) and block volume names and owners
+rename_in_variables_tf() {
+    local tmp
+    tmp=$(mktemp)
+    OLD="$1" NEW="$2" awk '
+        BEGIN { o = ENVIRON["OLD"]; n = ENVIRON["NEW"] }
+        $2 == "=" && $1 ~ /(hostnames|hostname|hosts)$/ { gsub("\"" o "\"", "\"" n "\"") }
+        $1 == "\"" o "\"" && $2 == "=" { sub("\"" o "\"", "\"" n "\"") }
+        {
+            gsub("\"" o "\":", "\"" n "\":")
+            gsub("\"" o "-block", "\"" n "-block")
+            gsub("\"host\":\"" o "\"", "\"host\":\"" n "\"")
+            print
+        }' variables.tf > "$tmp" && cat "$tmp" > variables.tf
+    rm -f "$tmp"
+}
+
+# Rename OLD to NEW in the per-instance config files (a target that is the hostname or
+# selects name=OLD, and the instance lists of SUBNETS_FILE); prints the files changed
+rename_in_config_files() {
+    local old="$1" new="$2" file tmp
+    for file in "$INSTANCE_LABELS_FILE" "$POWER_STATE_FILE" "$BACKUP_SPEC_FILE" "$PROVISIONERS_FILE" \
+        "$SITES_FILE" "$SECRETS_FILE" "$READINESS_CHECKS_FILE" "$HARDENING_FILE" "$SUBNETS_FILE"; do
+        [ -f "$file" ] || continue
+        tmp=$(mktemp)
+        if [ "$file" = "$SUBNETS_FILE" ]; then
+            sed -E "/^[[:space:]]*#/! s/([[:space:],])$old(,|[[:space:]]|\$)/\\1$new\\2/g" "$file" > "$tmp"
+        else
+            OLD="$old" NEW="$new" awk '
+                BEGIN { o = ENVIRON["OLD"]; n = ENVIRON["NEW"] }
+                match($0, /^[ \t]*[^ \t#]+/) {
+                    rest = substr($0, RLENGTH + 1)
+                    lead = substr($0, 1, RLENGTH)
+                    target = lead
+                    sub(/^[ \t]*/, "", target)
+                    lead = substr(lead, 1, length(lead) - length(target))
+                    count = split(target, terms, ",")
+                    target = ""
+                    for (i = 1; i <= count; i++) {
+                        if (terms[i] == o && count == 1) terms[i] = n
+                        else if (terms[i] == "name=" o) terms[i] = "name=" n
+                        else if (terms[i] == "name!=" o) terms[i] = "name!=" n
+                        target = target (i > 1 ? "," : "") terms[i]
+                    }
+                    $0 = lead target rest
+                }
+                { print }' "$file" > "$tmp"
+        fi
+        if cmp -s "$file" "$tmp"; then
+            rm -f "$tmp"
+        else
+            cat "$tmp" > "$file"
+            rm -f "$tmp"
+            echo "$file"
+        fi
+    done
+}
+
+# rename OLD NEW [--yes]: give an instance a new hostname without replacing it. Its display
+# name and hostname label change in place, resources keyed by the hostname move (renames.tf)
+# and its launch user_data is pinned, so the cloud-init change does not force a new instance.
+rename_instance() {
+    local old="" new="" yes=false
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --yes|-y)
+                yes=true
+                shift
+                ;;
+            *)
+                if [ -z "$old" ]; then
+                    old="$1"
+                elif [ -z "$new" ]; then
+                    new="$1"
+                else
+                    print_error "Unexpected argument: $1"
+                    return 2
+                fi
+                shift
+                ;;
+        esac
+    done
+    if [ -z "$new" ]; then
+        print_error "Usage: rename OLD NEW [--yes]"
+        return 2
+    fi
+    # OCI hostname labels (RFC 1123): letters, digits and hyphens, starting with a letter
+    if [[ ! "$new" =~ ^[a-z][a-z0-9-]{0,62}$ ]] || [[ "$new" == *- ]]; then
+        print_error "Invalid hostname '$new': up to 63 lowercase letters, digits and hyphens, starting with a letter"
+        return 2
+    fi
+    if ! load_existing_config >/dev/null 2>&1; then
+        print_error "No variables.tf in this directory - run the setup first"
+        return 1
+    fi
+
+    local i index="" kind="" host
+    for ((i = 0; i < amd_micro_instance_count; i++)); do
+        [ "${amd_micro_hostnames[$i]}" = "$old" ] && index=$i && kind=amd
+    done
+    for ((i = 0; i < arm_flex_instance_count; i++)); do
+        [ "${arm_flex_hostnames[$i]}" = "$old" ] && index=$i && kind=arm
+    done
+    if [ -z "$index" ]; then
+        print_error "Unknown instance: $old"
+        return 1
+    fi
+    for host in "${amd_micro_hostnames[@]}" "${arm_flex_hostnames[@]}"; do
+        if [ "$host" = "$new" ]; then
+            print_error "$new is already a hostname in this configuration"
+            return 1
+        fi
+    done
+
+    # The user_data the instance was launched with: pinned by an earlier rename, or from state
+    local pins="{}" user_data
+    [ -f "$PINNED_USER_DATA_FILE" ] && pins=$(cat "$PINNED_USER_DATA_FILE")
+    user_data=$(jq -r --arg h "$old" '.[$h] // empty' <<< "$pins")
+    if [ -z "$user_data" ]; then
+        user_data=$(terraform show -json 2>/dev/null | jq -r --arg k "$kind" --arg h "$old" \
+            'first(.values.root_module | .. | objects | select(.type? == "oci_core_instance" and .name == $k and .values.display_name == $h))
+             | .values.metadata.user_data // empty') || user_data=""
+    fi
+
+    print_subheader "Rename $old -> $new"
+    if [ -n "$user_data" ]; then
+        print_status "  display name, hostname label and VNIC name change in place"
+        print_status "  its reserved IP, volumes and volume group move to the new name in state"
+        print_status "  the instance keeps its launch cloud-init (pinned in $PINNED_USER_DATA_FILE)"
+        print_status "  the OS hostname and dynamic DNS name are updated over SSH"
+    else
+        print_status "  $old is not in the Terraform state: only the configuration is renamed"
+    fi
+    local var
+    for var in RESERVED_PUBLIC_IPS BASTION_HOST PRIVATE_INSTANCES VOLUME_GROUPS; do
+        [[ ",${!var// /}," == *",$old,"* ]] && print_warning "$var names $old: change it to $new before the next setup run"
+    done
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would rename $old to $new in variables.tf and the config files, then apply"
+        return 0
+    fi
+    if [ "$yes" != "true" ] && ! confirm_action "Rename $old to $new?" "N"; then
+        print_status "Cancelled"
+        return 1
+    fi
+
+    local backup log="rename-$new.log" file changed domains domain=""
+    local -a saved=()
+    for file in variables.tf renames.tf "$RENAMES_FILE" "$PINNED_USER_DATA_FILE" "$INSTANCE_LABELS_FILE" \
+        "$POWER_STATE_FILE" "$BACKUP_SPEC_FILE" "$PROVISIONERS_FILE" "$SITES_FILE" "$SECRETS_FILE" \
+        "$READINESS_CHECKS_FILE" "$HARDENING_FILE" "$SUBNETS_FILE"; do
+        [ -f "$file" ] && saved+=("$file")
+    done
+    backup=$(mktemp)
+    tar -cPf "$backup" "${saved[@]}"
+
+    rename_in_variables_tf "$old" "$new"
+    changed=$(rename_in_config_files "$old" "$new")
+    [ -n "$changed" ] && print_status "Updated $(echo "$changed" | paste -sd, | sed 's/,/, /g')"
+    # A dynamic DNS name derived from the hostname follows it
+    domains=$(grep -oP '^\s*ddns_domains\s*=\s*\K\{.*\}' variables.tf | head -1) || domains=""
+    if [ -n "$domains" ] && [ "$domains" != "{}" ]; then
+        domains=$(jq -c --arg o "$old" --arg n "$new" 'if has($n) then .[$n] |= gsub("\\b" + $o + "\\b"; $n) else . end' <<< "$domains")
+        set_variables_tf_local ddns_domains "$domains"
+        domain=$(jq -r --arg n "$new" '.[$n] // empty' <<< "$domains")
+    fi
+
+    # Earlier renames to OLD now lead to NEW; renames from OLD or NEW are already in state
+    {
+        echo "# Hostname renames (\"<old> <new>\"), maintained by the rename command"
+        {
+            [ -f "$RENAMES_FILE" ] && sed 's/#.*//' "$RENAMES_FILE"
+            echo "$old $new"
+        } | awk -v o="$old" -v n="$new" 'NF >= 2 && (($1 != o && $1 != n) || $2 == n) {
+            if ($2 == o) $2 = n
+            if ($1 != $2) print $1, $2
+        }'
+    } > "$RENAMES_FILE.tmp"
+    mv "$RENAMES_FILE.tmp" "$RENAMES_FILE"
+    if [ -n "$user_data" ]; then
+        (umask 077 && jq --arg o "$old" --arg n "$new" --arg u "$user_data" 'del(.[$o]) | .[$n] = $u' <<< "$pins" > "$PINNED_USER_DATA_FILE")
+    fi
+    if [ "$kind" = "amd" ]; then
+        amd_micro_hostnames[$index]=$new
+    else
+        arm_flex_hostnames[$index]=$new
+    fi
+    create_terraform_renames >/dev/null
+
+    if [ -z "$user_data" ]; then
+        rm -f "$backup"
+        audit_log rename "from=$old to=$new"
+        print_success "$old renamed to $new in the configuration"
+        return 0
+    fi
+
+    print_status "Planning the rename (log: $log)..."
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform plan -input=false -out=tfplan $(terraform_plan_args) > "$log" 2>&1; then
+        print_error "Plan failed (see $log); configuration restored"
+        prevent_destroy_hint "$log"
+        rename_restore "$backup"
+        return 1
+    fi
+    # Other pending changes (e.g. cloud-init edits for the rest of the fleet) could replace instances
+    if ! terraform show -json tfplan 2>/dev/null \
+        | jq -e '[.resource_changes[]? | select(.change.actions | index("delete"))] | length == 0' >/dev/null; then
+        print_error "The plan would destroy or replace resources; configuration restored"
+        print_status "Apply the pending changes first (terraform plan shows them), then rename again"
+        rename_restore "$backup"
+        rm -f tfplan
+        return 1
+    fi
+    # shellcheck disable=SC2046  # intentional word splitting of option list
+    if ! terraform apply -input=false $(terraform_apply_args) tfplan >> "$log" 2>&1; then
+        # Part of the state may already have moved, so the old configuration no longer fits
+        rm -f "$backup" tfplan
+        audit_log rename-failed "from=$old to=$new"
+        print_error "Apply failed (see $log); the configuration already uses $new"
+        print_status "Fix the problem and re-run terraform apply"
+        return 1
+    fi
+    rm -f "$backup" tfplan "$TF_PLAN_CACHE_FILE"
+    store_backup_passwords || true
+    audit_log rename "from=$old to=$new"
+    print_success "$old renamed to $new"
+    FLEET_JSON=""
+
+    # cloud-init only sets the hostname and DDNS name at launch
+    if load_fleet && ssh_instance "$(fleet_ssh_host "$new")" \
+        "sudo bash -c $(shell_quote "$HOSTNAME_RENAME") _ $(shell_quote "$new") $(shell_quote "$domain")" >> "$log" 2>&1; then
+        print_success "  hostname set to $(tail -1 "$log") on the instance"
+    else
+        print_warning "Could not update the instance over SSH (see $log); run as root on it:"
+        { echo "set -- $(shell_quote "$new") $(shell_quote "$domain")"; echo "$HOSTNAME_RENAME"; } | sed 's/^/    /'
+    fi
+    run_readiness_checks "$new"
+}
+
+# Put back the files saved before a rename (those that did not exist are removed)
+rename_restore() {
+    rm -f renames.tf "$RENAMES_FILE" "$PINNED_USER_DATA_FILE"
+    tar -xPf "$1"
+    rm -f "$1"
+}
+
+# ============================================================================
+# TEMPORARY ACCESS GRANTS
+# ============================================================================
+
+# Append "<time>\t<operator>\t<event>\t<details>" to AUDIT_LOG
+audit_log() {
+    local event="$1"
+    shift
+    [ "$DRY_RUN" = "true" ] && return 0
+    printf '%s\t%s\t%s\t%s\n' "$(date -u +%Y-%m-%dT%H:%M:%SZ)" "${USER:-$(id -un)}" "$event" "$*" >> "$AUDIT_LOG"
+}
+
+# Seconds in a "<n><m|h|d|w>" duration (e.g. 90m, 48h, 7d); fails on anything else
+ttl_seconds() {
+    local ttl="$1"
+    [[ "$ttl" =~ ^([1-9][0-9]*)([mhdw])$ ]] || return 1
+    case "${BASH_REMATCH[2]}" in
+        m) echo $(( BASH_REMATCH[1] * 60 )) ;;
+        h) echo $(( BASH_REMATCH[1] * 3600 )) ;;
+        d) echo $(( BASH_REMATCH[1] * 86400 )) ;;
+        w) echo $(( BASH_REMATCH[1] * 604800 )) ;;
+    esac
+}
+
+# Run as root on the instance: grant <user> <expires epoch> <sudo true|false> <base64 keys>
+# or revoke <user>. Grants live in /etc/cloudcradle/grants and a systemd timer removes them
+# once expired (survives reboots; users created for the grant are deleted, keys of existing
+# users are stripped from authorized_keys).
+# shellcheck disable=SC2016  # expanded on the instance
+readonly ACCESS_GRANT_SCRIPT='set -e
+dir=/etc/cloudcradle/grants
+mkdir -p "$dir"
+chmod 700 "$dir"
+
+if [ ! -x /usr/local/sbin/cloudcradle-grants-expire ]; then
+    cat > /usr/local/sbin/cloudcradle-grants-expire <<'"'SCRIPT'"'
+#!/bin/bash
+now=$(date +%s)
+for f in /etc/cloudcradle/grants/*; do
+    [ -f "$f" ] || continue
+    user="" expires=0 created=false
+    . "$f"
+    [ "$now" -ge "$expires" ] || continue
+    rm -f "/etc/sudoers.d/cloudcradle-grant-$user"
+    if [ "$created" = "true" ]; then
+        pkill -KILL -u "$user" 2>/dev/null || true
+        userdel -r "$user" 2>/dev/null || true
+    else
+        home=$(getent passwd "$user" | cut -d: -f6)
+        [ -f "$home/.ssh/authorized_keys" ] && sed -i "/ cloudcradle-grant$/d" "$home/.ssh/authorized_keys"
+    fi
+    rm -f "$f"
+    logger -t cloudcradle-grants "temporary access for $user removed"
+done
+SCRIPT
+    chmod 755 /usr/local/sbin/cloudcradle-grants-expire
+    cat > /etc/systemd/system/cloudcradle-grants.service <<'"'UNIT'"'
+[Unit]
+Description=Remove expired CloudCradle access grants
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/cloudcradle-grants-expire
+UNIT
+    cat > /etc/systemd/system/cloudcradle-grants.timer <<'"'UNIT'"'
+[Unit]
+Description=Remove expired CloudCradle access grants every minute
+
+[Timer]
+OnBootSec=30s
+OnCalendar=*:*:00
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+UNIT
+    systemctl daemon-reload
+    systemctl enable --now cloudcradle-grants.timer >/dev/null 2>&1
+fi
+
+action="$1" user="$2"
+if [ "$action" = "revoke" ]; then
+    [ -f "$dir/$user" ] || { echo "no grant for $user"; exit 0; }
+    sed -i "s/^expires=.*/expires=0/" "$dir/$user"
+    /usr/local/sbin/cloudcradle-grants-expire
+    echo "revoked"
+    exit 0
+fi
+
+expires="$3" admin="$4"
+created=false
+if [ -f "$dir/$user" ]; then
+    created=$(sed -n "s/^created=//p" "$dir/$user")
+elif ! id "$user" >/dev/null 2>&1; then
+    useradd -m -s /bin/bash -c "CloudCradle temporary access" "$user"
+    created=true
+fi
+if [ "$admin" = "true" ]; then
+    echo "$user ALL=(ALL) NOPASSWD:ALL" > "/etc/sudoers.d/cloudcradle-grant-$user"
+    chmod 440 "/etc/sudoers.d/cloudcradle-grant-$user"
+else
+    rm -f "/etc/sudoers.d/cloudcradle-grant-$user"
+fi
+
+home=$(getent passwd "$user" | cut -d: -f6)
+install -d -m 700 -o "$user" -g "$(id -gn "$user")" "$home/.ssh"
+keys="$home/.ssh/authorized_keys"
+touch "$keys"
+sed -i "/ cloudcradle-grant$/d" "$keys"
+echo "$5" | base64 -d | sed "s/\$/ cloudcradle-grant/" >> "$keys"
+chown "$user:" "$keys"
+chmod 600 "$keys"
+
+printf "user=%s\nexpires=%s\ncreated=%s\n" "$user" "$expires" "$created" > "$dir/$user"
+echo "granted until $(date -u -d "@$expires" +%Y-%m-%dT%H:%M:%SZ)"'
+
+# Run ACCESS_GRANT_SCRIPT with arguments on one instance
+access_grant_remote() {
+    local ip="$1" args="" arg
+    shift
+    for arg in "$@"; do
+        args+=" $(shell_quote "$arg")"
+    done
+    ssh_instance "$ip" "sudo bash -s --$args <<'EOF'
+$ACCESS_GRANT_SCRIPT
+EOF"
+}
+
+# grant-access --user <github|gitlab>:<handle> [--ttl 48h] [--sudo] [TARGETS]: add the
+# published keys fleet-wide and have each instance remove them when the TTL runs out
+grant_access() {
+    local entry="" ttl="$GRANT_ACCESS_DEFAULT_TTL" admin=false
+    local -a args=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --user)
+                entry="${2:-}"
+                shift 2 || { print_error "--user requires github:<handle> or gitlab:<handle>"; return 2; }
+                ;;
+            --ttl)
+                ttl="${2:-}"
+                shift 2 || { print_error "--ttl requires a duration (e.g. 48h)"; return 2; }
+                ;;
+            --sudo)
+                admin=true
+                shift
+                ;;
+            *)
+                args+=("$1")
+                shift
+                ;;
+        esac
+    done
+
+    if [[ ! "$entry" =~ ^(github|gitlab):[A-Za-z0-9][A-Za-z0-9_.-]*$ ]]; then
+        print_error "Usage: grant-access --user github:<handle>|gitlab:<handle> [--ttl 48h] [--sudo] [TARGETS]"
+        return 2
+    fi
+    local seconds max user
+    if ! seconds=$(ttl_seconds "$ttl"); then
+        print_error "Invalid --ttl '$ttl' (use minutes, hours, days or weeks: 90m, 48h, 7d, 2w)"
+        return 2
+    fi
+    max=$(ttl_seconds "$GRANT_ACCESS_MAX_TTL") || max=0
+    if [ "$max" -gt 0 ] && [ "$seconds" -gt "$max" ]; then
+        print_error "--ttl $ttl exceeds GRANT_ACCESS_MAX_TTL ($GRANT_ACCESS_MAX_TTL)"
+        return 2
+    fi
+    user=$(ssh_authorized_user_name "$entry")
+    if [[ ! "$user" =~ ^[a-z][a-z0-9_-]{0,31}$ ]] || [[ "$user" =~ ^(root|ubuntu|opc|almalinux|rocky|debian|admin|daemon|bin|sys|nobody)$ ]]; then
+        print_error "'$entry' cannot be used as a login name ('$user')"
+        return 2
+    fi
+
+    [ ${#args[@]} -gt 0 ] || args=(--all)
+    parse_fleet_targets "${args[@]}" || return 1
+
+    local keys
+    keys=$(fetch_ssh_user_keys "$entry")
+    if [ -z "$keys" ]; then
+        print_error "No SSH keys published for $entry"
+        return 1
+    fi
+
+    local expires expires_at name ip out failed=0
+    local -a granted=()
+    expires=$(( $(date +%s) + seconds ))
+    expires_at=$(jq -nr --argjson t "$expires" '$t | todate')
+    print_status "Granting $user ($entry, $(echo "$keys" | wc -l) key(s)$([ "$admin" = "true" ] && echo ", sudo")) access until $expires_at"
+
+    for name in "${FLEET_TARGETS[@]}"; do
+        if [ "$(power_state_of "$name")" = "STOPPED" ]; then
+            print_warning "  $name: stopped - skipped"
+            continue
+        fi
+        ip=$(fleet_ssh_host "$name")
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would grant $user access on $name ($ip)"
+            continue
+        fi
+        if out=$(access_grant_remote "$ip" grant "$user" "$expires" "$admin" "$(printf '%s\n' "$keys" | base64 | tr -d '\n')" 2>&1); then
+            print_success "  $name: $(tail -n 1 <<< "$out")"
+            granted+=("$name")
+        else
+            print_error "  $name: grant failed: $(tail -n 1 <<< "$out")"
+            failed=$((failed + 1))
+        fi
+    done
+
+    if [ ${#granted[@]} -gt 0 ]; then
+        audit_log grant-access "user=$user source=$entry ttl=$ttl expires=$expires_at sudo=$admin hosts=$(IFS=,; echo "${granted[*]}")"
+        print_status "  Connect with: ssh $user@<instance address>"
+    fi
+    [ "$failed" -eq 0 ]
+}
+
+# revoke-access <user|github:handle|gitlab:handle> [TARGETS]: end a grant before it expires
+revoke_access() {
+    local entry="${1:-}"
+    if [ -z "$entry" ] || [[ "$entry" == -* ]]; then
+        print_error "Usage: revoke-access USER|github:<handle>|gitlab:<handle> [TARGETS]"
+        return 2
+    fi
+    shift
+    local user="$entry"
+    [[ "$entry" == *:* ]] && user=$(ssh_authorized_user_name "$entry")
+
+    local -a args=("$@")
+    [ ${#args[@]} -gt 0 ] || args=(--all)
+    parse_fleet_targets "${args[@]}" || return 1
+
+    local name ip out failed=0
+    local -a revoked=()
+    for name in "${FLEET_TARGETS[@]}"; do
+        if [ "$(power_state_of "$name")" = "STOPPED" ]; then
+            print_warning "  $name: stopped - the grant expires on its own after the next start"
+            continue
+        fi
+        ip=$(fleet_ssh_host "$name")
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would revoke $user's access on $name ($ip)"
+            continue
+        fi
+        if out=$(access_grant_remote "$ip" revoke "$user" 2>&1); then
+            print_success "  $name: $(tail -n 1 <<< "$out")"
+            [ "$(tail -n 1 <<< "$out")" = "revoked" ] && revoked+=("$name")
+        else
+            print_error "  $name: revoke failed: $(tail -n 1 <<< "$out")"
+            failed=$((failed + 1))
+        fi
+    done
+
+    if [ ${#revoked[@]} -gt 0 ]; then
+        audit_log revoke-access "user=$user hosts=$(IFS=,; echo "${revoked[*]}")"
+    fi
+    [ "$failed" -eq 0 ]
+}
+
+# ============================================================================
+# READINESS CHECKS
+# ============================================================================
+#
+# Checks are declared one per line in READINESS_CHECKS_FILE:
+#   <target> <type> <argument...>
+# target: instance hostname, "amd", "arm", "*" (all instances) or a label
+#         selector such as role=web (see INSTANCE_LABELS_FILE)
+# type:   tcp <port> | http <url> | ssh <command>
+# In http URLs "{ip}" is replaced with the instance public IP.
+#
+#   *        tcp  22
+#   web-1    http http://{ip}/healthz
+#   arm      ssh  cloud-init status --wait
+
+# Print "<hostname> <amd|arm> <public_ip>" for every instance in Terraform outputs
+list_deployed_instances() {
+    load_fleet || return 0
+    local name kind ip
+    jq -r '.[] | "\(.name) \(.kind) \(if .jump != "" then .private_ip else .public_ip end)"' <<< "$FLEET_JSON" \
+        | while read -r name kind ip; do
+            # Instances stopped on purpose are not expected to answer
+            [ "$(power_state_of "$name")" = "STOPPED" ] && continue
+            echo "$name $kind $ip"
+        done
+}
+
+readiness_check_once() {
+    local type="$1" ip="$2" arg="$3" jump
+
+    # Private (two-tier) instances are only reachable from the bastion
+    jump=$(fleet_jump_host "$ip")
+    if [ -n "$jump" ] && [ "$type" != "ssh" ]; then
+        case "$type" in
+            tcp) ssh_instance "$jump" "timeout 5 bash -c 'exec 3<>/dev/tcp/$ip/$arg'" >/dev/null 2>&1 ;;
+            http) [ "$(ssh_instance "$jump" "curl -s -o /dev/null -w '%{http_code}' --max-time 10 '${arg//\{ip\}/$ip}'" 2>/dev/null)" = "200" ] ;;
+            *) return 2 ;;
+        esac
+        return
+    fi
+
+    case "$type" in
+        tcp)
+            timeout 5 bash -c "exec 3<>/dev/tcp/$ip/$arg" >/dev/null 2>&1
+            ;;
+        http)
+            local code
+            code=$(curl -s -o /dev/null -w '%{http_code}' --max-time 10 "${arg//\{ip\}/$ip}" 2>/dev/null) || code=""
+            [ "$code" = "200" ]
+            ;;
+        ssh)
+            ssh_instance "$ip" "$arg" >/dev/null 2>&1
+            ;;
+        *)
+            return 2
+            ;;
+    esac
+}
+
+readiness_target_matches() {
+    local target="$1" hostname="$2" kind="$3"
+    if [[ "$target" == *=* ]]; then
+        fleet_select "$target" | grep -qxF "$hostname"
+        return
+    fi
+    [ "$target" = "*" ] || [ "$target" = "$hostname" ] || [ "$target" = "$kind" ]
+}
+
+# Run the readiness checks for every deployed instance, or only the named ones
+run_readiness_checks() {
+    print_subheader "Readiness Checks"
+
+    local checks
+    if [ -f "$READINESS_CHECKS_FILE" ]; then
+        checks=$(grep -v -E '^[[:space:]]*(#|$)' "$READINESS_CHECKS_FILE")
+    else
+        checks="* tcp $(ssh_port)"
+    fi
+
+    local instances
+    instances=$(list_deployed_instances)
+    if [ $# -gt 0 ]; then
+        instances=$(awk -v only=" $* " 'index(only, " " $1 " ")' <<< "$instances")
+    fi
+    if [ -z "$instances" ]; then
+        print_status "No instances in Terraform outputs - nothing to check"
+        return 0
+    fi
+
+    local results="[]" failed=0
+    local hostname kind ip target type arg
+    while read -r hostname kind ip; do
+        [ -n "$hostname" ] || continue
+        while read -r target type arg; do
+            [ -n "$target" ] || continue
+            readiness_target_matches "$target" "$hostname" "$kind" || continue
+
+            local status="fail" started elapsed rc
+            started=$(date +%s)
+            if [ -z "$ip" ] || [ "$ip" = "null" ]; then
+                status="no-public-ip"
+            else
+                while true; do
+                    readiness_check_once "$type" "$ip" "$arg" && rc=0 || rc=$?
+                    if [ "$rc" -eq 0 ]; then
+                        status="pass"
+                        break
+                    elif [ "$rc" -eq 2 ]; then
+                        status="invalid-check"
+                        break
                     fi
-                else
-                    echo "$auth_out" >&2
-                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
-                    return 1
-                fi
+                    [ $(( $(date +%s) - started )) -ge "$READINESS_TIMEOUT" ] && break
+                    sleep "$READINESS_INTERVAL"
+                done
+            fi
+            elapsed=$(( $(date +%s) - started ))
+
+            if [ "$status" = "pass" ]; then
+                print_success "  $hostname: $type $arg (${elapsed}s)"
             else
-                if oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
-                    OCI_PROFILE="$new_profile"
-                    auth_method="security_token"
-                    if test_oci_connectivity; then
-                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
-                        return 0
-                    else
-                        print_warning "Session auth completed but connectivity test failed"
+                print_error "  $hostname: $type $arg -> $status (${elapsed}s)"
+                failed=$((failed + 1))
+            fi
+
+            results=$(jq -c --arg host "$hostname" --arg ip "$ip" --arg type "$type" --arg arg "$arg" \
+                --arg status "$status" --argjson elapsed "$elapsed" \
+                '. + [{instance: $host, ip: $ip, type: $type, target: $arg, status: $status, elapsed_seconds: $elapsed}]' <<< "$results")
+        done <<< "$checks"
+    done <<< "$instances"
+
+    jq -n --argjson checks "$results" --arg time "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+        '{checked_at: $time, passed: ($checks | map(select(.status == "pass")) | length),
+          failed: ($checks | map(select(.status != "pass")) | length), checks: $checks}' > "$READINESS_REPORT_FILE"
+    print_status "Readiness report written to $READINESS_REPORT_FILE"
+
+    [ "$failed" -eq 0 ]
+}
+
+# Confirm the cloud-init sshd hardening on every instance by logging in as the
+# unprivileged user; without this the instance reverts the hardening on its own
+verify_ssh_hardening() {
+    print_subheader "SSH Hardening Verification"
+
+    local instances
+    instances=$(list_deployed_instances)
+    if [ -z "$instances" ]; then
+        print_status "No instances in Terraform outputs - nothing to verify"
+        return 0
+    fi
+
+    local hostname kind ip output rc started failed=0
+    while read -r hostname kind ip; do
+        [ -n "$hostname" ] || continue
+        if [ -z "$ip" ] || [ "$ip" = "null" ]; then
+            print_warning "  $hostname: no public IP, cannot confirm (hardening reverts in ${SSH_HARDENING_REVERT_TIMEOUT}s)"
+            failed=$((failed + 1))
+            continue
+        fi
+
+        # Wait for cloud-init, which reloads sshd with the hardened config, in one connection
+        started=$(date +%s)
+        while true; do
+            output=$(ssh_instance "$ip" "cloud-init status --wait >/dev/null 2>&1; \
+                [ -x /usr/local/sbin/cloudcradle-ssh-confirm ] || exit 3" 2>&1) \
+                && rc=0 || rc=$?
+            [ "$rc" -eq 0 ] || [ "$rc" -eq 3 ] && break
+            [ $(( $(date +%s) - started )) -ge "$READINESS_TIMEOUT" ] && break
+            sleep "$READINESS_INTERVAL"
+        done
+        # Then confirm over a new connection: only a login made after the reload shows
+        # that the hardened config still lets us in
+        if [ "$rc" -eq 0 ]; then
+            output=$(ssh_instance "$ip" "sudo /usr/local/sbin/cloudcradle-ssh-confirm" 2>&1) && rc=0 || rc=1
+        fi
+
+        case "$rc" in
+            0)
+                print_success "  $hostname: login confirmed, hardening kept ($(echo "$output" | tr '\n' ' '))"
+                ;;
+            3)
+                print_status "  $hostname: instance predates safe hardening - nothing to confirm"
+                ;;
+            *)
+                print_error "  $hostname: login failed - sshd hardening will revert automatically within ${SSH_HARDENING_REVERT_TIMEOUT}s"
+                failed=$((failed + 1))
+                ;;
+        esac
+    done <<< "$instances"
+
+    [ "$failed" -eq 0 ]
+}
+
+# ============================================================================
+# DRIFT DETECTION
+# ============================================================================
+
+# Summarise a plan JSON into one record per resource that drifted outside Terraform
+# (live vs state) and/or that apply would change (generated HCL vs live)
+drift_records_from_plan_json() {
+    jq -c '
+        def changed_keys(b; a): (b // {}) as $b | (a // {}) as $a
+            | [($b + $a) | keys[]] | unique | map(select($b[.] != $a[.]));
+        ([.resource_drift[]? | {key: .address, value: {
+            drift: (if .change.after == null then ["<deleted outside Terraform>"]
+                    else changed_keys(.change.before; .change.after) end)}}] | from_entries) as $drift
+        | ([.resource_changes[]? | select(.change.actions != ["no-op"] and .change.actions != ["read"])
+            | {key: .address, value: {actions: .change.actions,
+                config: changed_keys(.change.before; .change.after)}}] | from_entries) as $changes
+        | ($drift + $changes | keys) as $addresses
+        | [$addresses[] | {address: .,
+            drift: ($drift[.].drift // []),
+            actions: ($changes[.].actions // ["no-op"]),
+            config_diff: ($changes[.].config // [])}]
+        | map(. + {suggestion: (
+            if (.drift | index("<deleted outside Terraform>")) then "deleted outside Terraform; apply will recreate it"
+            elif (.drift | length) > 0 and .actions == ["no-op"] then "console change is ignored by config; accept it with: terraform apply -refresh-only"
+            elif (.drift | length) > 0 and (.actions | index("delete")) then "apply will REPLACE this resource to undo the console change; update the generated config to keep it"
+            elif (.drift | length) > 0 then "apply will revert the console change; update the generated config (e.g. variables.tf) to keep it"
+            elif (.actions | index("create")) and (.actions | length) == 1 then "declared in config but missing; apply will create it"
+            else "config changed since last apply; run apply to converge" end)})
+    '
+}
+
+# drift [--json]: refresh against live OCI and report per-resource drift
+detect_drift() {
+    local output_json=false
+    [ "${1:-}" = "--json" ] && output_json=true
+
+    print_subheader "Drift Detection" >&2
+
+    local plan_file records
+    plan_file=$(mktemp)
+    if ! terraform plan -input=false -lock=false -refresh=true -out="$plan_file" \
+        -parallelism="$TF_PARALLELISM" >/dev/null 2>&1; then
+        rm -f "$plan_file"
+        print_error "terraform plan failed - run 'terraform plan' to see the error" >&2
+        return 1
+    fi
+    # A plan that cannot be read is an error, not an empty drift report
+    if ! records=$(terraform show -json "$plan_file" 2>/dev/null | drift_records_from_plan_json) \
+        || ! jq -e 'type == "array"' <<< "$records" >/dev/null 2>&1; then
+        rm -f "$plan_file"
+        print_error "Could not read the plan - run 'terraform show -json' on a saved plan to see the error" >&2
+        return 1
+    fi
+    rm -f "$plan_file"
+
+    if [ "$output_json" = "true" ]; then
+        echo "$records"
+    else
+        local count
+        count=$(jq 'length' <<< "$records")
+        if [ "$count" -eq 0 ]; then
+            print_success "No drift: live resources match state and generated config"
+            return 0
+        fi
+        jq -r '.[] | "\(.address)\n    drifted attrs: \(if (.drift | length) > 0 then (.drift | join(", ")) else "-" end)\n    planned:       \(.actions | join("/"))\(if (.config_diff | length) > 0 then " (" + (.config_diff | join(", ")) + ")" else "" end)\n    suggestion:    \(.suggestion)"' <<< "$records"
+        echo ""
+        print_warning "$count resource(s) differ from state or config"
+    fi
+
+    [ "$(jq 'length' <<< "$records")" -eq 0 ] || return 2
+}
+
+# ============================================================================
+# INVENTORY VS STATE RECONCILIATION
+# ============================================================================
+
+# Resource types the inventory lists completely: a state entry of one of these whose OCID
+# the inventory did not find no longer exists in OCI (or lost its MANAGED_TAG)
+readonly RECONCILE_TYPES="oci_core_vcn oci_core_subnet oci_core_internet_gateway oci_core_route_table
+oci_core_default_route_table oci_core_security_list oci_core_default_security_list
+oci_core_network_security_group oci_core_public_ip oci_core_instance oci_core_volume
+oci_database_autonomous_database"
+
+# "<kind>|<name>|<id>" for every resource the inventory found (boot volumes belong to
+# their instance and are left to cleanup)
+discovered_resources() {
+    local id
+    for id in "${!EXISTING_VCNS[@]}"; do echo "vcn|${EXISTING_VCNS[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_SUBNETS[@]}"; do echo "subnet|${EXISTING_SUBNETS[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_INTERNET_GATEWAYS[@]}"; do echo "internet-gateway|${EXISTING_INTERNET_GATEWAYS[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_ROUTE_TABLES[@]}"; do echo "route-table|${EXISTING_ROUTE_TABLES[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_SECURITY_LISTS[@]}"; do echo "security-list|${EXISTING_SECURITY_LISTS[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_NSGS[@]}"; do echo "nsg|${EXISTING_NSGS[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_RESERVED_IPS[@]}"; do echo "reserved-ip|${EXISTING_RESERVED_IPS[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_AMD_INSTANCES[@]}"; do echo "instance|${EXISTING_AMD_INSTANCES[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_ARM_INSTANCES[@]}"; do echo "instance|${EXISTING_ARM_INSTANCES[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_BLOCK_VOLUMES[@]}"; do echo "block-volume|${EXISTING_BLOCK_VOLUMES[$id]%%|*}|$id"; done
+    for id in "${!EXISTING_AUTONOMOUS_DBS[@]}"; do echo "autonomous-db|${EXISTING_AUTONOMOUS_DBS[$id]%%|*}|$id"; done
+}
+
+# "<address>\t<type>\t<id>" for every managed resource instance in Terraform state
+terraform_state_records() {
+    terraform state pull 2>/dev/null | jq -r '
+        .resources[]? | select(.mode == "managed") | . as $r | .instances[]?
+        | [(if $r.module then $r.module + "." else "" end) + $r.type + "." + $r.name
+           + (if has("index_key") then
+                (if (.index_key | type) == "number" then "[\(.index_key)]" else "[\"\(.index_key)\"]" end)
+              else "" end),
+           $r.type, (.attributes.id // "")] | @tsv' 2>/dev/null || true
+}
+
+# reconcile [--json]: cross-reference the inventory with Terraform state. Resources in OCI
+# but not in state get the import the setup would run (or are outside the configuration),
+# resources in state but gone from OCI a state rm; exit 2 when the two disagree.
+reconcile_inventory() {
+    local output_json=false
+    case "${1:-}" in
+        --json) output_json=true ;;
+        "") ;;
+        *) print_error "Usage: $0 reconcile [--json]"; return 2 ;;
+    esac
+
+    print_subheader "Inventory vs Terraform State" >&2
+    load_existing_config >/dev/null 2>&1 \
+        || print_warning "No variables.tf - resources outside state are listed without their import address" >&2
+    local section
+    for section in compute network storage adb; do
+        NON_INTERACTIVE=true inventory_section "$section" </dev/null >/dev/null 2>&1 \
+            || print_warning "The $section inventory failed - its resources may show up as missing" >&2
+    done
+
+    # The imports the setup would queue, without running them
+    local entry queue="" report
+    IMPORT_QUEUE=()
+    EMIT_ONLY=true import_existing_resources >/dev/null 2>&1 || true
+    for entry in "${IMPORT_QUEUE[@]}"; do
+        queue+="$(tf_address "${entry%%|*}")|$(cut -d'|' -f2 <<< "$entry")"$'\n'
+    done
+
+    report=$(jq -n --arg discovered "$(discovered_resources)" --arg state "$(terraform_state_records)" \
+        --arg queue "$queue" --arg types "$RECONCILE_TYPES" --arg tag "$MANAGED_TAG" '
+        def lines($s): $s | split("\n") | map(select(length > 0));
+        ([lines($discovered)[] | split("|") | {kind: .[0], name: .[1], id: .[2]}]) as $oci
+        | ([lines($state)[] | split("\t") | {address: .[0], type: .[1], id: .[2]}]) as $tf
+        | ([lines($queue)[] | split("|") | {key: .[1], value: .[0]}] | from_entries) as $imports
+        | ($types | split("\\s+"; null)) as $covered
+        | ($tf | map({key: .id, value: .address}) | from_entries) as $by_id
+        | ($oci | map({key: .id, value: true}) | from_entries) as $found
+        | {oci_only: [$oci[] | select($by_id[.id] == null)
+             | . + (if $imports[.id] then {address: $imports[.id],
+                      suggestion: "terraform import \u0027\($imports[.id])\u0027 \u0027\(.id)\u0027 (the setup run imports it too)"}
+                    else {address: null,
+                      suggestion: "outside the generated configuration: it stays unmanaged and counts against the Always Free limits"} end)],
+           state_only: [$tf[] | select(.id != "" and (.type | IN($covered[])) and ($found[.id] | not))
+             | . + {suggestion: ("terraform state rm \u0027\(.address)\u0027 to forget it, or apply to create it again"
+                    + (if $tag != "" then " (or it lost the \($tag) tag)" else "" end))}],
+           both: [$oci[] | select($by_id[.id] != null) | . + {address: $by_id[.id]}]}
+        | .oci_only |= sort_by(.kind, .name) | .state_only |= sort_by(.address) | .both |= sort_by(.address)')
+
+    if [ "$output_json" = "true" ]; then
+        echo "$report"
+    else
+        local count
+        count=$(jq '.oci_only | length' <<< "$report")
+        echo -e "  ${BOLD}In OCI, not in state ($count)${NC}"
+        jq -r '.oci_only[] | "    \(.kind) \(.name)  \(.id)\n      -> \(.suggestion)"' <<< "$report"
+        count=$(jq '.state_only | length' <<< "$report")
+        echo -e "  ${BOLD}In state, missing in OCI ($count)${NC}"
+        jq -r '.state_only[] | "    \(.address)  \(.id)\n      -> \(.suggestion)"' <<< "$report"
+        count=$(jq '.both | length' <<< "$report")
+        echo -e "  ${BOLD}In both ($count)${NC}"
+        jq -r '.both[] | "    \(.address)  (\(.kind) \(.name))"' <<< "$report"
+        echo ""
+        count=$(jq '(.oci_only | length) + (.state_only | length)' <<< "$report")
+        if [ "$count" -eq 0 ]; then
+            print_success "Inventory and state agree"
+        else
+            print_warning "$count resource(s) are only in OCI or only in state"
+        fi
+    fi
+
+    [ "$(jq '(.oci_only | length) + (.state_only | length)' <<< "$report")" -eq 0 ] || return 2
+}
+
+# ============================================================================
+# ORPHANED RESOURCE CLEANUP
+# ============================================================================
+
+# OCIDs of every resource tracked in Terraform state, one per line; fails when there is
+# a state that cannot be read, rather than reporting nothing as managed
+terraform_state_ids() {
+    local state
+    state=$(workspace_state) || { print_error "Cannot read the Terraform state" >&2; return 1; }
+    [ -z "$state" ] || jq -r '.resources[]?.instances[]?.attributes.id // empty' <<< "$state"
+}
+
+# Names of every availability domain in the region, one per line; fails when none can be listed
+availability_domain_names() {
+    local ads
+    ads=$(oci_cmd "iam availability-domain list --compartment-id $tenancy_ocid --query 'data[].name'" 2>/dev/null) \
+        && jq -er '.[]' <<< "$ads" 2>/dev/null
+}
+
+# Run an OCI list command (--all, with a --query producing an array) and print the array,
+# "[]" when OCI returns nothing; fails when the call fails
+oci_list_json() {
+    local out
+    out=$(oci_cmd "$1 --all" 2>/dev/null) || return 1
+    jq -c '. // []' <<< "${out:-[]}" 2>/dev/null
+}
+
+# Print "<kind>|<id>|<name>|<size_gb>" for resources that consume free-tier quota
+# but are neither attached to anything nor tracked in Terraform state, across every
+# availability domain. Fails when the state, an attachment list or a resource list cannot
+# be read, since an orphan would otherwise be offered for deletion while still in use.
+# With MANAGED_TAG set, only resources carrying it are candidates: boot volumes are not
+# tagged at launch, so they are never offered then.
+find_orphaned_resources() {
+    local state_ids ads ad attached list
+    local key="${MANAGED_TAG%%=*}" value="${MANAGED_TAG#*=}"
+    state_ids=$(terraform_state_ids) || return 1
+    ads=$(availability_domain_names) || { print_error "Cannot list availability domains" >&2; return 1; }
+
+    # Filter a listed array down to orphans: MANAGED_TAG, not attached, not in state
+    _orphans() {
+        jq -r --argjson attached "$2" --arg state "$state_ids" --arg k "$key" --arg v "$value" "$MANAGED_TAG_JQ"'
+            ($state | split("\n")) as $tracked
+            | .[] | select(managed($k; $v))
+            | select((.id | IN($attached[])) | not) | select((.id | IN($tracked[])) | not)
+            | "'"$1"'|\(.id)|\(.name)|\(.size // 0)"' <<< "$3"
+    }
+
+    # Boot volumes left behind by instances terminated without preserve=false (the
+    # inventory lists them as detached and counts them against the storage allowance)
+    while read -r ad; do
+        attached=$(oci_list_json "compute boot-volume-attachment list \
+            --compartment-id $tenancy_ocid \
+            --availability-domain $ad \
+            --query 'data[?\"lifecycle-state\"==\`ATTACHED\`].\"boot-volume-id\"'") \
+            || { print_error "Cannot list boot volume attachments in $ad" >&2; return 1; }
+        list=$(oci_list_json "bv boot-volume list \
+            --compartment-id $tenancy_ocid \
+            --availability-domain $ad \
+            --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",size:\"size-in-gbs\",tags:\"freeform-tags\"}'") \
+            || { print_error "Cannot list boot volumes in $ad" >&2; return 1; }
+        _orphans boot-volume "$attached" "$list"
+    done <<< "$ads"
+
+    # Block volumes with no attachment (attachments are listed for the whole compartment)
+    attached=$(oci_list_json "compute volume-attachment list \
+        --compartment-id $tenancy_ocid \
+        --query 'data[?\"lifecycle-state\"==\`ATTACHED\`].\"volume-id\"'") \
+        || { print_error "Cannot list volume attachments" >&2; return 1; }
+    while read -r ad; do
+        list=$(oci_list_json "bv volume list \
+            --compartment-id $tenancy_ocid \
+            --availability-domain $ad \
+            --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",size:\"size-in-gbs\",tags:\"freeform-tags\"}'") \
+            || { print_error "Cannot list block volumes in $ad" >&2; return 1; }
+        _orphans volume "$attached" "$list"
+    done <<< "$ads"
+
+    # Reserved public IPs not assigned to any private IP
+    list=$(oci_list_json "network public-ip list \
+        --compartment-id $tenancy_ocid \
+        --scope REGION --lifetime RESERVED \
+        --query 'data[?\"assigned-entity-id\"==null].{id:id,name:\"display-name\",ip:\"ip-address\",tags:\"freeform-tags\"}'") \
+        || { print_error "Cannot list reserved public IPs" >&2; return 1; }
+    jq -r --arg state "$state_ids" --arg k "$key" --arg v "$value" "$MANAGED_TAG_JQ"'
+        ($state | split("\n")) as $tracked
+        | .[] | select(managed($k; $v)) | select((.id | IN($tracked[])) | not)
+        | "public-ip|\(.id)|\(.name) (\(.ip))|0"' <<< "$list"
+}
+
+delete_orphaned_resource() {
+    local kind="$1" id="$2"
+    case "$kind" in
+        boot-volume) oci_cmd "bv boot-volume delete --boot-volume-id $id --force" >/dev/null ;;
+        volume) oci_cmd "bv volume delete --volume-id $id --force" >/dev/null ;;
+        public-ip) oci_cmd "network public-ip delete --public-ip-id $id --force" >/dev/null ;;
+    esac
+}
+
+# cleanup [--force]: list orphans and delete them after confirmation (or all with --force)
+cleanup_orphaned_resources() {
+    local force=false
+    case "${1:-}" in
+        --force) force=true ;;
+        "") ;;
+        *) print_error "Usage: $0 cleanup [--force]"; return 2 ;;
+    esac
+
+    print_subheader "Orphaned Resources"
+    [ -z "$MANAGED_TAG" ] || print_status "Only resources tagged $MANAGED_TAG are candidates"
+
+    local orphans
+    if ! orphans=$(find_orphaned_resources); then
+        print_error "Could not determine which resources are orphaned; nothing deleted"
+        return 1
+    fi
+    if [ -z "$orphans" ]; then
+        print_success "No orphaned volumes or reserved IPs found"
+        return 0
+    fi
+
+    local kind id name size reclaimed=0 failed=0
+    while IFS='|' read -r kind id name size; do
+        printf "  %-12s %-30s %6sGB  %s\n" "$kind" "$name" "$size" "$id"
+    done <<< "$orphans"
+    echo ""
+    if grep -q '^boot-volume|' <<< "$orphans"; then
+        print_status "Boot volumes hold the disk of a terminated instance; back one up first if you need it (oci bv boot-volume-backup create)"
+    fi
+
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would offer to delete $(wc -l <<< "$orphans") resource(s)"
+        return 0
+    fi
+    if [ "$force" != "true" ] && [ "$NON_INTERACTIVE" = "true" ]; then
+        print_warning "Non-interactive mode: nothing deleted (use 'cleanup --force')"
+        return 0
+    fi
+
+    # Orphans are read from fd 3 so confirm_action can still prompt on stdin
+    while IFS='|' read -r kind id name size <&3; do
+        if [ "$force" != "true" ] && ! confirm_action "Delete $kind '$name' (${size}GB)?" "N"; then
+            continue
+        fi
+        if delete_orphaned_resource "$kind" "$id"; then
+            print_success "Deleted $kind '$name'"
+            reclaimed=$((reclaimed + size))
+        else
+            print_error "Failed to delete $kind '$name'"
+            failed=$((failed + 1))
+        fi
+    done 3<<< "$orphans"
+
+    [ "$reclaimed" -gt 0 ] && print_status "Reclaimed ${reclaimed}GB of free-tier storage" && rm -f "$INVENTORY_CACHE_FILE"
+    [ "$failed" -eq 0 ]
+}
+
+# ============================================================================
+# WORKSPACE SCAFFOLDING AND VALIDATION
+# ============================================================================
+
+# validate: lint the workspace's config files (and Terraform, once initialised)
+validate_workspace() {
+    local errors=0 line lineno
+
+    if [ -f "$FIREWALL_RULES_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            [ -n "${line// /}" ] || continue
+            local dir proto ports cidrs cidr
+            read -r dir proto ports cidrs _ <<< "$line"
+            if [[ ! "$dir" =~ ^(ingress|egress)$ ]] || [[ ! "$proto" =~ ^(tcp|udp|icmp|all)$ ]] \
+                || [[ ! "$ports" =~ ^(-|[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*)$ ]] || [ -z "$cidrs" ]; then
+                print_error "$FIREWALL_RULES_FILE:$lineno: expected '<ingress|egress> <tcp|udp|icmp|all> <ports|-> <cidrs>'"
+                errors=$((errors + 1))
+                continue
+            fi
+            for cidr in ${cidrs//,/ }; do
+                if [[ ! "$cidr" =~ ^[0-9A-Fa-f.:]+/[0-9]+$ ]]; then
+                    print_error "$FIREWALL_RULES_FILE:$lineno: invalid CIDR '$cidr'"
+                    errors=$((errors + 1))
+                fi
+            done
+        done < "$FIREWALL_RULES_FILE"
+    fi
+
+    if [ -f "$SUBNETS_FILE" ]; then
+        lineno=0
+        local -A subnet_names=() subnet_hosts=()
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local name cidr kind hosts host
+            read -r name cidr kind hosts _ <<< "$line"
+            [ -n "$name" ] || continue
+            if [[ ! "$name" =~ ^[a-z][a-z0-9]{0,14}$ ]] || ! ipv4_cidr_valid "$cidr" || [[ ! "$kind" =~ ^(public|private)$ ]]; then
+                print_error "$SUBNETS_FILE:$lineno: expected '<name> <ipv4 cidr> <public|private> [hostname,...]' (name: lowercase letters and digits, max 15)"
+                errors=$((errors + 1))
+                continue
+            fi
+            if [ -n "${subnet_names[$name]:-}" ]; then
+                print_error "$SUBNETS_FILE:$lineno: subnet $name is already declared on line ${subnet_names[$name]}"
+                errors=$((errors + 1))
+            fi
+            subnet_names[$name]=$lineno
+            if [ "$kind" = "private" ] && [ "$NETWORK_TOPOLOGY" != "two-tier" ]; then
+                print_error "$SUBNETS_FILE:$lineno: private subnets need NETWORK_TOPOLOGY=two-tier (its NAT gateway and bastion)"
+                errors=$((errors + 1))
+            fi
+            for host in ${hosts//,/ }; do
+                if [ -n "${subnet_hosts[$host]:-}" ]; then
+                    print_error "$SUBNETS_FILE:$lineno: $host is already placed in subnet ${subnet_hosts[$host]}"
+                    errors=$((errors + 1))
+                fi
+                subnet_hosts[$host]=$name
+            done
+        done < "$SUBNETS_FILE"
+    fi
+
+    if [ -f "$CLOUD_INIT_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            [[ "$line" =~ ^[[:space:]]*(#|$) ]] && continue
+            local directive first second third
+            read -r directive first second third _ <<< "$line"
+            case "$directive" in
+                timezone)
+                    if [[ ! "$first" =~ ^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$ ]]; then
+                        print_error "$CLOUD_INIT_FILE:$lineno: expected 'timezone <Area/City>'"
+                        errors=$((errors + 1))
                     fi
-                else
-                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
-                    return 1
+                    ;;
+                package|runcmd)
+                    if [ -z "$first" ]; then
+                        print_error "$CLOUD_INIT_FILE:$lineno: $directive needs a value"
+                        errors=$((errors + 1))
+                    fi
+                    ;;
+                var)
+                    if [[ ! "$first" =~ ^[A-Za-z_][A-Za-z0-9_]*$ ]]; then
+                        print_error "$CLOUD_INIT_FILE:$lineno: expected 'var <name> <value>' (name: letters, digits, _)"
+                        errors=$((errors + 1))
+                    fi
+                    ;;
+                file)
+                    if [[ ! "$first" == /* ]] || [[ ! "$second" =~ ^0?[0-7]{3}$ ]] || [ -z "$third" ]; then
+                        print_error "$CLOUD_INIT_FILE:$lineno: expected 'file <absolute path> <mode> <local template>'"
+                        errors=$((errors + 1))
+                    elif [ ! -f "$third" ]; then
+                        print_error "$CLOUD_INIT_FILE:$lineno: template $third not found"
+                        errors=$((errors + 1))
+                    fi
+                    ;;
+                *)
+                    print_error "$CLOUD_INIT_FILE:$lineno: unknown directive '$directive' (timezone, package, var, runcmd or file)"
+                    errors=$((errors + 1))
+                    ;;
+            esac
+        done < "$CLOUD_INIT_FILE"
+    fi
+
+    if [ -f "$INSTANCE_LABELS_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local hostname pair
+            read -r hostname line <<< "$line"
+            [ -n "$hostname" ] || continue
+            for pair in $line; do
+                if [[ ! "$pair" =~ ^[A-Za-z][A-Za-z0-9_.-]*=.+$ ]]; then
+                    print_error "$INSTANCE_LABELS_FILE:$lineno: invalid label '$pair' (expected key=value)"
+                    errors=$((errors + 1))
+                fi
+            done
+        done < "$INSTANCE_LABELS_FILE"
+    fi
+
+    if [ -f "$READINESS_CHECKS_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local target type arg
+            read -r target type arg <<< "$line"
+            [ -n "$target" ] || continue
+            if [[ ! "$type" =~ ^(tcp|http|ssh)$ ]] || [ -z "$arg" ]; then
+                print_error "$READINESS_CHECKS_FILE:$lineno: expected '<target> <tcp|http|ssh> <argument>'"
+                errors=$((errors + 1))
+            fi
+        done < "$READINESS_CHECKS_FILE"
+    fi
+
+    local module tailscale_used=false
+    for module in ${PROVISION//,/ }; do
+        [ "$module" = "none" ] && continue
+        [ "$module" = "tailscale" ] && tailscale_used=true
+        if [[ " $PROVISIONER_MODULES " != *" $module "* ]]; then
+            print_error "PROVISION: unknown module '$module' (available: $PROVISIONER_MODULES)"
+            errors=$((errors + 1))
+        fi
+    done
+    if [ -f "$PROVISIONERS_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local target modules
+            read -r target modules <<< "$line"
+            [ -n "$target" ] || continue
+            if [ -z "$modules" ]; then
+                print_error "$PROVISIONERS_FILE:$lineno: expected '<target> <module...>'"
+                errors=$((errors + 1))
+                continue
+            fi
+            for module in $modules; do
+                [ "$module" = "tailscale" ] && tailscale_used=true
+                if [[ " $PROVISIONER_MODULES " != *" $module "* ]]; then
+                    print_error "$PROVISIONERS_FILE:$lineno: unknown module '$module' (available: $PROVISIONER_MODULES)"
+                    errors=$((errors + 1))
+                fi
+            done
+        done < "$PROVISIONERS_FILE"
+    fi
+    case "$REVERSE_PROXY" in
+        caddy|traefik) ;;
+        *)
+            print_error "REVERSE_PROXY must be caddy or traefik (got '$REVERSE_PROXY')"
+            errors=$((errors + 1))
+            ;;
+    esac
+    if [ -f "$SITES_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local target domain upstream extra
+            read -r target domain upstream extra <<< "$line"
+            [ -n "$target" ] || continue
+            if [ -z "$upstream" ] || [ -n "$extra" ]; then
+                print_error "$SITES_FILE:$lineno: expected '<target> <domain> <upstream>'"
+                errors=$((errors + 1))
+            elif ! [[ "$domain" =~ ^([A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?\.)+[A-Za-z]{2,}$ ]]; then
+                print_error "$SITES_FILE:$lineno: '$domain' is not a domain name (automatic HTTPS needs a public DNS name)"
+                errors=$((errors + 1))
+            elif ! [[ "$upstream" =~ ^(https?://)?[A-Za-z0-9.-]+:[0-9]+(/.*)?$ ]]; then
+                print_error "$SITES_FILE:$lineno: upstream '$upstream' must be host:port or a http(s):// URL with a port"
+                errors=$((errors + 1))
+            fi
+        done < "$SITES_FILE"
+    fi
+    if [ -f "$SECRETS_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local name path mode
+            read -r target name path mode extra <<< "$line"
+            [ -n "$target" ] || continue
+            if [ -z "$path" ] || [ -n "$extra" ]; then
+                print_error "$SECRETS_FILE:$lineno: expected '<target> <name> <path> [mode]'"
+                errors=$((errors + 1))
+            elif ! [[ "$name" =~ ^[A-Za-z0-9_.-]{1,255}$ ]]; then
+                print_error "$SECRETS_FILE:$lineno: invalid secret name '$name' (letters, digits, '_', '-' and '.')"
+                errors=$((errors + 1))
+            elif [[ "$path" != /* ]]; then
+                print_error "$SECRETS_FILE:$lineno: path '$path' must be absolute"
+                errors=$((errors + 1))
+            elif [ -n "$mode" ] && ! [[ "$mode" =~ ^0?[0-7]{3}$ ]]; then
+                print_error "$SECRETS_FILE:$lineno: invalid mode '$mode' (octal, e.g. 0600)"
+                errors=$((errors + 1))
+            fi
+        done < "$SECRETS_FILE"
+    fi
+    if [ "$tailscale_used" = "true" ] && [ -z "${TF_VAR_tailscale_auth_key:-}" ]; then
+        print_warning "The tailscale module is enabled but TAILSCALE_AUTH_KEY/TF_VAR_tailscale_auth_key is not - run 'sudo tailscale up' on the instances yourself"
+    fi
+
+    if [ -f "$BACKUP_SPEC_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local target schedule paths path
+            read -r target schedule paths <<< "$line"
+            [ -n "$target" ] || continue
+            if [ -z "$paths" ]; then
+                print_error "$BACKUP_SPEC_FILE:$lineno: expected '<target> <schedule> <path...>'"
+                errors=$((errors + 1))
+                continue
+            fi
+            for path in $paths; do
+                if [[ ! "$path" == /* ]]; then
+                    print_error "$BACKUP_SPEC_FILE:$lineno: backup paths must be absolute (got '$path')"
+                    errors=$((errors + 1))
                 fi
+            done
+        done < "$BACKUP_SPEC_FILE"
+        if [[ ! "$BACKUP_BUCKET" =~ ^[A-Za-z0-9_.-]{1,63}$ ]]; then
+            print_error "BACKUP_BUCKET may only contain letters, digits, '.', '_' and '-' (got '$BACKUP_BUCKET')"
+            errors=$((errors + 1))
+        fi
+        if [[ ! "$RCLONE_VERSION" =~ ^[0-9]+\.[0-9]+\.[0-9]+$ ]]; then
+            print_error "RCLONE_VERSION must be a release version like 1.68.2 (got '$RCLONE_VERSION')"
+            errors=$((errors + 1))
+        elif [ -f "$RCLONE_CHECKSUMS_FILE" ] && ! grep -qF "rclone-v$RCLONE_VERSION-linux-amd64.zip" "$RCLONE_CHECKSUMS_FILE"; then
+            print_warning "$RCLONE_CHECKSUMS_FILE has no checksums for rclone $RCLONE_VERSION (fetched again on the next run)"
+        fi
+    fi
+
+    if [ -f "$POWER_STATE_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local host state
+            read -r host state _ <<< "$line"
+            [ -n "$host" ] || continue
+            if [[ ! "${state^^}" =~ ^(RUNNING|STOPPED)$ ]]; then
+                print_error "$POWER_STATE_FILE:$lineno: expected '<hostname> <RUNNING|STOPPED>'"
+                errors=$((errors + 1))
+            fi
+        done < "$POWER_STATE_FILE"
+    fi
+
+    validate_autonomous_databases || errors=$((errors + 1))
+    validate_volume_backup_policy || errors=$((errors + 1))
+
+    local entry user
+    for entry in ${SSH_AUTHORIZED_USERS//,/ }; do
+        user=$(ssh_authorized_user_name "$entry")
+        if [[ ! "$entry" =~ ^(github|gitlab):[A-Za-z0-9][A-Za-z0-9_.-]*$ ]]; then
+            print_error "SSH_AUTHORIZED_USERS: '$entry' must look like github:<handle> or gitlab:<handle>"
+            errors=$((errors + 1))
+        elif [[ ! "$user" =~ ^[a-z][a-z0-9_-]{0,31}$ ]] || [[ "$user" =~ ^(root|ubuntu|opc|almalinux|rocky|debian|admin|daemon|bin|sys|nobody)$ ]]; then
+            print_error "SSH_AUTHORIZED_USERS: '$entry' cannot be used as a login name ('$user')"
+            errors=$((errors + 1))
+        fi
+    done
+
+    if [[ ! "$TF_ENGINE" =~ ^(auto|terraform|tofu)$ ]]; then
+        print_error "TF_ENGINE must be auto, terraform or tofu (got '$TF_ENGINE')"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$TOFU_STATE_ENCRYPTION" =~ ^(off|passphrase|kms)$ ]]; then
+        print_error "TOFU_STATE_ENCRYPTION must be off, passphrase or kms (got '$TOFU_STATE_ENCRYPTION')"
+        errors=$((errors + 1))
+    elif [ "$TOFU_STATE_ENCRYPTION" != "off" ] && [ "$(terraform_engine)" != "tofu" ]; then
+        print_error "TOFU_STATE_ENCRYPTION needs the OpenTofu engine (TF_ENGINE=tofu)"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$LAYOUT" =~ ^(flat|modules|terragrunt)$ ]]; then
+        print_error "LAYOUT must be flat, modules or terragrunt (got '$LAYOUT')"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$SERVICE_LIMITS" =~ ^(free|tenancy|off)$ ]]; then
+        print_error "SERVICE_LIMITS must be free, tenancy or off (got '$SERVICE_LIMITS')"
+        errors=$((errors + 1))
+    fi
+
+    local email
+    email=$(budget_alert_email)
+    if [ "$email" != "none" ] && [[ ! ",$email" =~ ^(,[^@,[:space:]]+@[^@,[:space:]]+\.[^@,[:space:]]+)+$ ]]; then
+        print_error "BUDGET_ALERT_EMAIL must be none or comma-separated email addresses (got '$email')"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$BUDGET_AMOUNT" =~ ^[0-9]+(\.[0-9]+)?$ ]] || [[ "$BUDGET_AMOUNT" =~ ^0+(\.0+)?$ ]]; then
+        print_error "BUDGET_AMOUNT must be a positive number (got '$BUDGET_AMOUNT')"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$BUDGET_ALERT_THRESHOLD" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+        print_error "BUDGET_ALERT_THRESHOLD must be a number (got '$BUDGET_ALERT_THRESHOLD')"
+        errors=$((errors + 1))
+    fi
+
+    local reservation
+    reservation=$(capacity_reservation)
+    if [[ ! "$reservation" =~ ^(none|create|ocid1\.capacityreservation\..+)$ ]]; then
+        print_error "CAPACITY_RESERVATION must be none, create or a capacity reservation OCID (got '$reservation')"
+        errors=$((errors + 1))
+    fi
+
+    local profile
+    profile=$(hardening_profile)
+    if [[ ! "$profile" =~ ^(minimal|standard|strict)$ ]]; then
+        print_error "HARDENING_PROFILE must be minimal, standard or strict (got '$profile')"
+        errors=$((errors + 1))
+    fi
+    if [ -f "$HARDENING_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local target extra
+            read -r target profile extra <<< "$line"
+            [ -n "$target" ] || continue
+            if [ -z "$profile" ] || [ -n "$extra" ]; then
+                print_error "$HARDENING_FILE:$lineno: expected '<target> <minimal|standard|strict>'"
+                errors=$((errors + 1))
+            elif [[ ! "$profile" =~ ^(minimal|standard|strict)$ ]]; then
+                print_error "$HARDENING_FILE:$lineno: unknown profile '$profile' (minimal, standard or strict)"
+                errors=$((errors + 1))
+            fi
+        done < "$HARDENING_FILE"
+    fi
+    if [ -n "$SSH_PORT" ] && { [[ ! "$SSH_PORT" =~ ^[1-9][0-9]{0,4}$ ]] || [ "$SSH_PORT" -gt 65535 ]; }; then
+        print_error "SSH_PORT must be a port number (got '$SSH_PORT')"
+        errors=$((errors + 1))
+    elif [ -n "$SSH_PORT" ] && [[ "$SSH_PORT" =~ ^(80|443)$ ]] && reverse_proxy_in_use; then
+        print_error "SSH_PORT $SSH_PORT is taken by the reverse proxy"
+        errors=$((errors + 1))
+    fi
+
+    if [ -f "$USERS_FILE" ]; then
+        lineno=0
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//')
+            local sudo shell sources source
+            read -r user sudo shell sources <<< "$line"
+            [ -n "$user" ] || continue
+            if [ -z "$sources" ]; then
+                print_error "$USERS_FILE:$lineno: expected '<name> <sudo|nosudo> <shell|-> <key-source...>'"
+                errors=$((errors + 1))
+                continue
+            fi
+            if [[ ! "$user" =~ ^[a-z][a-z0-9_-]{0,31}$ ]] || [[ "$user" =~ ^(root|ubuntu|opc|almalinux|rocky|debian|admin|daemon|bin|sys|nobody)$ ]]; then
+                print_error "$USERS_FILE:$lineno: '$user' cannot be used as a login name"
+                errors=$((errors + 1))
+            fi
+            if [[ ! "$sudo" =~ ^(sudo|nosudo)$ ]]; then
+                print_error "$USERS_FILE:$lineno: expected sudo or nosudo (got '$sudo')"
+                errors=$((errors + 1))
             fi
+            if [ "$shell" != "-" ] && [[ ! "$shell" =~ ^/[A-Za-z0-9/_.-]+$ ]]; then
+                print_error "$USERS_FILE:$lineno: shell must be an absolute path or '-' (got '$shell')"
+                errors=$((errors + 1))
+            fi
+            for source in $sources; do
+                if [[ "$source" =~ ^(github|gitlab): ]]; then
+                    [[ "$source" =~ ^(github|gitlab):[A-Za-z0-9][A-Za-z0-9_.-]*$ ]] && continue
+                    print_error "$USERS_FILE:$lineno: '$source' must look like github:<handle> or gitlab:<handle>"
+                elif [ ! -f "$source" ]; then
+                    print_error "$USERS_FILE:$lineno: key file '$source' not found"
+                elif ! grep -qE '^(ssh-|ecdsa-|sk-)' "$source"; then
+                    print_error "$USERS_FILE:$lineno: '$source' contains no SSH public key"
+                else
+                    continue
+                fi
+                errors=$((errors + 1))
+            done
+        done < "$USERS_FILE"
+    fi
+
+    if [ -n "$MANAGED_TAG" ] && [[ ! "$MANAGED_TAG" =~ ^[^=]+=.+$ ]]; then
+        print_error "MANAGED_TAG must look like Key=Value (got '$MANAGED_TAG')"
+        errors=$((errors + 1))
+    fi
+
+    if [[ ! "$NETWORK_TOPOLOGY" =~ ^(flat|two-tier)$ ]]; then
+        print_error "NETWORK_TOPOLOGY must be 'flat' or 'two-tier' (got '$NETWORK_TOPOLOGY')"
+        errors=$((errors + 1))
+    fi
+    if [ -n "$INSTANCE_OS" ] && [[ ! " $SUPPORTED_OSES " == *" $INSTANCE_OS "* ]]; then
+        print_error "INSTANCE_OS must be one of: $SUPPORTED_OSES (got '$INSTANCE_OS')"
+        errors=$((errors + 1))
+    fi
+    if [ -n "$UBUNTU_VERSION" ] && [[ ! " $SUPPORTED_UBUNTU_VERSIONS " == *" $UBUNTU_VERSION "* ]]; then
+        print_error "UBUNTU_VERSION must be one of: $SUPPORTED_UBUNTU_VERSIONS (got '$UBUNTU_VERSION')"
+        errors=$((errors + 1))
+    fi
+    if [ -n "$UBUNTU_VARIANT" ] && [[ ! "$UBUNTU_VARIANT" =~ ^(standard|minimal)$ ]]; then
+        print_error "UBUNTU_VARIANT must be 'standard' or 'minimal' (got '$UBUNTU_VARIANT')"
+        errors=$((errors + 1))
+    fi
+    if [ -f "$IMAGE_LOCK_FILE" ] && ! jq -e 'type == "object" and all(.[]; (.selection | type) == "string")' "$IMAGE_LOCK_FILE" >/dev/null 2>&1; then
+        print_error "$IMAGE_LOCK_FILE is not a valid image lock (delete it to resolve the images again)"
+        errors=$((errors + 1))
+    fi
+    if [[ ! "$HUNT_SCHEDULER" =~ ^(fixed|jittered|adaptive)$ ]]; then
+        print_error "HUNT_SCHEDULER must be fixed, jittered or adaptive (got '$HUNT_SCHEDULER')"
+        errors=$((errors + 1))
+    fi
+    if [ -n "$HUNT_QUIET_HOURS" ] && [[ ! "$HUNT_QUIET_HOURS" =~ ^([01]?[0-9]|2[0-3])-([01]?[0-9]|2[0-3])$ ]]; then
+        print_error "HUNT_QUIET_HOURS must look like 23-07 (got '$HUNT_QUIET_HOURS')"
+        errors=$((errors + 1))
+    fi
+    if [ -n "$DDNS_PROVIDER" ]; then
+        if [[ ! "$DDNS_PROVIDER" =~ ^(duckdns|dynu)$ ]]; then
+            print_error "DDNS_PROVIDER must be duckdns or dynu (got '$DDNS_PROVIDER')"
+            errors=$((errors + 1))
+        elif [ -z "${TF_VAR_ddns_token:-}" ]; then
+            print_warning "DDNS_PROVIDER is set but DDNS_TOKEN/TF_VAR_ddns_token is not - instances will fail to register"
         fi
+    fi
+    if [ "$SERVICE_GATEWAY" = "true" ] && [ "$NETWORK_TOPOLOGY" != "two-tier" ]; then
+        print_warning "SERVICE_GATEWAY only applies to NETWORK_TOPOLOGY=two-tier and is ignored"
+    fi
+    validate_network_cidrs || errors=$((errors + 1))
 
-        if test_oci_connectivity; then
-            print_success "OCI authentication configured successfully for profile '$new_profile'"
-            return 0
-        else
-            print_warning "Authentication succeeded but connectivity test failed for profile '$new_profile'"
+    if [ -d .terraform ] && command_exists terraform; then
+        if ! terraform validate -no-color >/dev/null 2>&1; then
+            terraform validate -no-color >&2 || true
+            errors=$((errors + 1))
         fi
+    fi
+
+    if [ "$errors" -gt 0 ]; then
+        print_error "$errors problem(s) found"
+        return 1
+    fi
+    print_success "Workspace configuration is valid"
+}
+
+# ============================================================================
+# LINT
+# ============================================================================
+#
+# Unlike validate (which rejects broken config), lint looks for config that works but is
+# risky or wasteful and suggests a better setup. Findings are ranked high > medium > low.
+
+lint_add() {
+    local IFS=$'\t'
+    LINT_FINDINGS+=("$*")
+}
+
+# World-open ingress: any protocol/port (high), non-web ports (high), SSH (low)
+lint_firewall_rules() {
+    local file="" line lineno=0 i dir proto ports cidrs port
+    local -a rules=() linenos=() odd=()
+    if [ -f "$FIREWALL_RULES_FILE" ]; then
+        file="$FIREWALL_RULES_FILE"
+        while IFS= read -r line; do
+            lineno=$((lineno + 1))
+            line=$(echo "$line" | sed 's/#.*//;s/^[[:space:]]*//;s/[[:space:]]*$//')
+            [ -n "$line" ] || continue
+            rules+=("$line")
+            linenos+=("$lineno")
+        done < "$FIREWALL_RULES_FILE"
     else
-        # If existing config was invalid, automatically fix it
-        if [ "$existing_config_invalid" -eq 1 ]; then
-            print_warning "Detected invalid or incomplete OCI config file - AUTOMATICALLY DELETING AND FORCING FRESH AUTHENTICATION"
-            
-            # IMMEDIATE DELETE: Remove corrupted config without prompting
-            if [ -f "$OCI_CONFIG_FILE" ]; then
-                print_status "Backing up corrupted config to $OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)"
-                cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)" 2>/dev/null || true
-                print_status "Forcibly deleting corrupted config file: $OCI_CONFIG_FILE"
-                rm -f "$OCI_CONFIG_FILE"
-            fi
-            
-            # Delete any temp config files to start completely fresh
-            rm -f "$HOME/.oci/config.session_auth" 2>/dev/null || true
-            
-            # Create completely new profile with session auth
-            new_profile="DEFAULT"
-            print_status "Creating fresh OCI configuration with browser-based authentication for profile '$new_profile'..."
-            print_status "This will open your browser to log into Oracle Cloud."
-            print_status ""
-            print_status "Using region '$auth_region' for authentication"
-            print_status ""
-            
-            # Use the default config location (let OCI CLI create it fresh)
-            OCI_CONFIG_FILE="$HOME/.oci/config"
-            OCI_PROFILE="$new_profile"
-            unset OCI_CLI_CONFIG_FILE
-            
-            if is_wsl; then
-                if auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1); then
-                    echo "$auth_out"
-                    local url
-                    url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
-                    if [ -n "$url" ]; then
-                        print_status "Opening browser for login URL (WSL)..."
-                        open_url_best_effort "$url" || true
-                        print_status ""
-                        print_status "After completing browser authentication, press Enter to continue..."
-                        read -r
-                    fi
-                    auth_method="security_token"
-                    if test_oci_connectivity; then
-                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
-                        return 0
-                    else
-                        print_warning "Session auth completed but connectivity test failed"
-                    fi
-                else
-                    echo "$auth_out" >&2
-                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
-                    return 1
-                fi
+        load_firewall_rules
+        rules=("${FIREWALL_RULES[@]}")
+    fi
+
+    for i in "${!rules[@]}"; do
+        read -r dir proto ports cidrs _ <<< "${rules[$i]}"
+        [ "$dir" = "ingress" ] || continue
+        [[ ",$cidrs," =~ ,(0\.0\.0\.0/0|::/0), ]] || continue
+        lineno="${linenos[$i]:-}"
+        case "$proto" in
+            icmp)
+                continue
+                ;;
+            all)
+                lint_add high L001 "$file" "$lineno" "All protocols and ports are open to the internet" \
+                    "Open only the ports you serve (e.g. 'ingress tcp 80,443 0.0.0.0/0,::/0') and reach everything else over SSH or a VPN"
+                continue
+                ;;
+        esac
+        odd=()
+        for port in ${ports//,/ }; do
+            case "$port" in
+                22)
+                    lint_add low L005 "$file" "$lineno" "SSH is reachable from the whole internet" \
+                        "Restrict port 22 to your own CIDRs, or use NETWORK_TOPOLOGY=two-tier so only the bastion is exposed"
+                    ;;
+                80|443) ;;
+                *) odd+=("$port") ;;
+            esac
+        done
+        if [ ${#odd[@]} -gt 0 ]; then
+            lint_add high L002 "$file" "$lineno" "$proto port(s) ${odd[*]} open to 0.0.0.0/0 or ::/0" \
+                "Limit the source CIDRs, or put the service behind a reverse proxy on 80/443 (databases and admin UIs should never be public)"
+        fi
+    done
+}
+
+# Neither application backups nor volume backup policies are configured
+lint_backups() {
+    local rules=0
+    if [ -f "$BACKUP_SPEC_FILE" ]; then
+        rules=$(sed 's/#.*//' "$BACKUP_SPEC_FILE" | grep -c '[^[:space:]]' || true)
+    fi
+    if [ "$rules" -eq 0 ] && [ -z "$VOLUME_BACKUP_POLICY" ]; then
+        lint_add medium L003 "" "" "No backups are configured - a lost or reclaimed instance loses all its data" \
+            "Add rules to $BACKUP_SPEC_FILE (restic to Object Storage) or set VOLUME_BACKUP_POLICY=custom VOLUME_BACKUP_SCHEDULE=weekly:1"
+    fi
+    if [ -n "$VOLUME_BACKUP_POLICY" ] && [ "$VOLUME_BACKUP_VOLUMES" = "boot" ] && [ "$rules" -eq 0 ]; then
+        local host grouped
+        local -a uncovered=()
+        grouped=$(volume_group_hosts)
+        for host in "${amd_micro_hostnames[@]:0:$amd_micro_instance_count}" "${arm_flex_hostnames[@]:0:$arm_flex_instance_count}"; do
+            [ "$(instance_block_spec "$host")" != "0" ] && ! grep -qxF "$host" <<< "$grouped" && uncovered+=("$host")
+        done
+        if [ ${#uncovered[@]} -gt 0 ]; then
+            lint_add medium L004 "" "" "Block volumes of ${uncovered[*]} are not backed up (only boot volumes are)" \
+                "Set VOLUME_GROUPS=all to back up each instance's volumes together, VOLUME_BACKUP_VOLUMES=all, or back up the data paths via $BACKUP_SPEC_FILE"
+        fi
+    fi
+}
+
+# ARM instances with several OCPUs/GBs of RAM on a minimum-size boot volume and no block volume
+lint_instance_sizing() {
+    [ -f variables.tf ] || return 0
+    local lineno i
+    local -a ocpus memory boot
+    lineno=$(grep -n 'arm_flex_boot_volume_size_gb\s*=' variables.tf | head -1 | cut -d: -f1)
+    read -r -a ocpus <<< "$arm_flex_ocpus_per_instance"
+    read -r -a memory <<< "$arm_flex_memory_per_instance"
+    read -r -a boot <<< "$arm_flex_boot_volume_size_gb"
+    for ((i=0; i<arm_flex_instance_count; i++)); do
+        [ "${boot[$i]:-0}" -le 50 ] || continue
+        [ "${ocpus[$i]:-0}" -ge 2 ] || [ "${memory[$i]:-0}" -ge 12 ] || continue
+        [ "${arm_flex_block_volumes[$i]:-0}" = "0" ] || continue
+        lint_add medium L006 variables.tf "$lineno" \
+            "${arm_flex_hostnames[$i]:-arm instance $((i + 1))} has ${ocpus[$i]} OCPUs/${memory[$i]}GB RAM but only a ${boot[$i]}GB boot volume" \
+            "Container images, logs and swap fill 50GB fast: raise the boot volume to 100GB+ or add a block volume (--arm-block-volumes)"
+    done
+}
+
+# Every instance sits in the first availability domain
+lint_placement() {
+    [ -f main.tf ] || return 0
+    [ $((amd_micro_instance_count + arm_flex_instance_count)) -gt 1 ] || return 0
+    grep -q 'availability_domains\[[1-9]' main.tf && return 0
+    lint_add low L007 main.tf "$(grep -n 'availability_domains\[0\]' main.tf | head -1 | cut -d: -f1)" \
+        "All $((amd_micro_instance_count + arm_flex_instance_count)) instances are placed in the same availability domain" \
+        "In multi-AD regions one AD outage takes every instance down; keep backups in region-wide Object Storage ($BACKUP_SPEC_FILE) so you can rebuild elsewhere"
+}
+
+# lint [--format text|json|github] [--strict]: ranked best-practice suggestions
+# (exit 2 on high findings, or on any finding with --strict)
+lint_workspace() {
+    local format=text strict=false
+    [ "${GITHUB_ACTIONS:-}" = "true" ] && format=github
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --format)
+                format="${2:-}"
+                shift 2 || true
+                ;;
+            --json)
+                format=json
+                shift
+                ;;
+            --strict)
+                strict=true
+                shift
+                ;;
+            *)
+                print_error "Usage: lint [--format text|json|github] [--strict]"
+                return 2
+                ;;
+        esac
+    done
+    if [[ ! "$format" =~ ^(text|json|github)$ ]]; then
+        print_error "--format must be text, json or github"
+        return 2
+    fi
+
+    load_existing_config >/dev/null 2>&1 || true
+    load_block_volume_specs
+    LINT_FINDINGS=()
+    lint_firewall_rules
+    lint_backups
+    lint_instance_sizing
+    lint_placement
+
+    local report
+    report=$(printf '%s\n' "${LINT_FINDINGS[@]}" | jq -Rn -c '
+        [inputs | select(length > 0) | split("\t")
+            | {severity: .[0], code: .[1], file: .[2], line: (.[3] | tonumber? // null), message: .[4], suggestion: .[5]}]
+        | sort_by({high: 0, medium: 1, low: 2}[.severity], .code)')
+
+    case "$format" in
+        json)
+            jq . <<< "$report"
+            ;;
+        github)
+            jq -r '.[] | "::\({high: "error", medium: "warning", low: "notice"}[.severity]) \(if .file != "" then "file=\(.file),\(if .line then "line=\(.line)," else "" end)" else "" end)title=\(.code)::\(.message). \(.suggestion)"' <<< "$report"
+            ;;
+        text)
+            print_subheader "Lint"
+            if [ "$(jq 'length' <<< "$report")" -eq 0 ]; then
+                print_success "No suggestions - the configuration follows the recommended practices"
             else
-                if oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
-                    auth_method="security_token"
-                    if test_oci_connectivity; then
-                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
-                        return 0
-                    else
-                        print_warning "Session auth completed but connectivity test failed"
-                    fi
-                else
-                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
-                    return 1
-                fi
+                local severity code file lineno message suggestion color
+                while IFS=$'\x1f' read -r severity code file lineno message suggestion; do
+                    case "$severity" in
+                        high) color="$RED" ;;
+                        medium) color="$YELLOW" ;;
+                        *) color="$BLUE" ;;
+                    esac
+                    echo -e "  ${color}${severity^^}${NC} $code${file:+ $file${lineno:+:$lineno}}: $message"
+                    echo "       -> $suggestion"
+                done < <(jq -r '.[] | [.severity, .code, .file, (.line // "" | tostring), .message, .suggestion] | join("\u001f")' <<< "$report")
+                echo ""
+                print_status "$(jq -r '. as $f | [("high", "medium", "low") as $s | [$f[] | select(.severity == $s)] | select(length > 0) | "\(length) \($s)"] | join(", ")' <<< "$report")"
             fi
-        fi
-        # Interactive authenticate (may open browser)
-        print_status "Using profile '$OCI_PROFILE' for interactive session authenticate..."
+            ;;
+    esac
 
-        print_status "Using region '$auth_region' for authentication"
-        if is_wsl; then
-            local auth_out
-            auth_out=$(oci session authenticate --no-browser --profile-name "$OCI_PROFILE" --region "$auth_region" --session-expiration-in-minutes 60 2>&1) || {
-                echo "$auth_out" >&2
-                if echo "$auth_out" | grep -i -E "config file.*is invalid|Config Errors|user .*missing" >/dev/null 2>&1; then
-                    print_warning "OCI CLI reports the config file is invalid or missing required fields. Offering repair options..."
-                    existing_config_invalid=1
-                else
-                    print_error "Authentication failed"
-                    return 1
-                fi
-            }
-            if [ "$existing_config_invalid" -ne 1 ]; then
-                echo "$auth_out"
-                local url
-                url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
-                if [ -n "$url" ]; then
-                    print_status "Opening browser for login URL (WSL)..."
-                    open_url_best_effort "$url" || true
+    if jq -e 'any(.[]; .severity == "high")' <<< "$report" >/dev/null; then
+        return 2
+    fi
+    if [ "$strict" = "true" ] && [ "$(jq 'length' <<< "$report")" -gt 0 ]; then
+        return 2
+    fi
+    return 0
+}
+
+# ============================================================================
+# SPEC VALIDATION SERVER
+# ============================================================================
+#
+# The spec is the saved configuration (variables.tf) plus the line-based config files.
+# 'spec serve-validation' speaks a small subset of the Language Server Protocol over
+# stdio (Content-Length framed JSON-RPC), so editors can show problems while you type:
+# syntax errors from 'validate' and Free Tier quota violations against the live usage
+# of everything the spec doesn't manage.
+
+# LSP diagnostic covering one line: spec_diagnostic LINE(1-based) SEVERITY(1 error, 2 warning) CODE MESSAGE
+spec_diagnostic() {
+    jq -n -c --argjson line "$1" --argjson severity "$2" --arg code "$3" --arg message "$4" \
+        '{range: {start: {line: ([$line - 1, 0] | max), character: 0}, end: {line: ([$line - 1, 0] | max), character: 1000}},
+          severity: $severity, code: $code, source: "cloudcradle", message: $message}'
+}
+
+# Line of the first "key =" assignment in variables.tf (1 when missing)
+spec_line_of() {
+    local lineno
+    lineno=$(grep -nE "^[[:space:]]*$1[[:space:]]*=" variables.tf | head -1 | cut -d: -f1)
+    echo "${lineno:-1}"
+}
+
+# Quota checks of a variables.tf in the current directory, as diagnostics
+spec_quota_diagnostics() {
+    load_existing_config >/dev/null 2>&1 || return 0
+    local key code message
+    free_tier_violations | while IFS=$'\t' read -r key code message; do
+        spec_diagnostic "$(spec_line_of "$key")" 1 "$code" "$message"
+    done
+}
+
+# Diagnostics (JSON array) for a document: spec_diagnostics PATH TEXT_FILE
+spec_diagnostics() {
+    local name tmp
+    name=$(basename "$1")
+    tmp=$(mktemp -d)
+    cp "$2" "$tmp/$name"
+    (
+        cd "$tmp" || exit 0
+        case "$name" in
+            variables.tf)
+                spec_quota_diagnostics
+                ;;
+            "$(basename "$FIREWALL_RULES_FILE")"|"$(basename "$INSTANCE_LABELS_FILE")"|"$(basename "$READINESS_CHECKS_FILE")"|"$(basename "$BACKUP_SPEC_FILE")"|"$(basename "$POWER_STATE_FILE")"|"$(basename "$SUBNETS_FILE")"|"$(basename "$CLOUD_INIT_FILE")"|"$(basename "$PROVISIONERS_FILE")"|"$(basename "$SITES_FILE")"|"$(basename "$SECRETS_FILE")"|"$(basename "$USERS_FILE")"|"$(basename "$HARDENING_FILE")")
+                # Re-use validate on the buffer alone and keep its "<file>:<line>: message" errors
+                FIREWALL_RULES_FILE=$(basename "$FIREWALL_RULES_FILE")
+                INSTANCE_LABELS_FILE=$(basename "$INSTANCE_LABELS_FILE")
+                READINESS_CHECKS_FILE=$(basename "$READINESS_CHECKS_FILE")
+                BACKUP_SPEC_FILE=$(basename "$BACKUP_SPEC_FILE")
+                POWER_STATE_FILE=$(basename "$POWER_STATE_FILE")
+                SUBNETS_FILE=$(basename "$SUBNETS_FILE")
+                CLOUD_INIT_FILE=$(basename "$CLOUD_INIT_FILE")
+                PROVISIONERS_FILE=$(basename "$PROVISIONERS_FILE")
+                SITES_FILE=$(basename "$SITES_FILE")
+                SECRETS_FILE=$(basename "$SECRETS_FILE")
+                USERS_FILE=$(basename "$USERS_FILE")
+                HARDENING_FILE=$(basename "$HARDENING_FILE")
+                local line lineno
+                validate_workspace 2>&1 | sed 's/\x1b\[[0-9;]*m//g' | grep -F "[ERROR] $name:" | while IFS= read -r line; do
+                    line=${line#*"$name:"}
+                    lineno=${line%%:*}
+                    spec_diagnostic "$lineno" 1 validate "${line#*: }"
+                done
+                if [ "$name" = "$(basename "$FIREWALL_RULES_FILE")" ]; then
+                    LINT_FINDINGS=()
+                    lint_firewall_rules
+                    printf '%s\n' "${LINT_FINDINGS[@]}" | while IFS=$'\t' read -r severity code _ lineno line suggestion; do
+                        [ -n "$code" ] || continue
+                        spec_diagnostic "${lineno:-1}" "$([ "$severity" = "high" ] && echo 1 || echo 2)" "$code" "$line. $suggestion"
+                    done
                 fi
-            fi
+                ;;
+        esac
+    ) 2>/dev/null | jq -s -c '.'
+    rm -rf "$tmp"
+}
+
+# Write one JSON-RPC message to the editor (fd 3)
+spec_send() {
+    local LC_ALL=C
+    printf 'Content-Length: %d\r\n\r\n%s' "${#1}" "$1" >&3
+}
+
+# Read one Content-Length framed message into SPEC_MESSAGE (returns 1 at end of input)
+spec_read_message() {
+    local LC_ALL=C header length=""
+    SPEC_MESSAGE=""
+    while :; do
+        IFS= read -r header || return 1
+        header=${header%$'\r'}
+        [ -n "$header" ] || break
+        if [[ "${header,,}" =~ ^content-length:[[:space:]]*([0-9]+)$ ]]; then
+            length=${BASH_REMATCH[1]}
+        fi
+    done
+    [ -n "$length" ] || return 1
+    IFS= read -r -N "$length" SPEC_MESSAGE || [ ${#SPEC_MESSAGE} -eq "$length" ]
+}
+
+# Path of a file:// URI
+spec_uri_path() {
+    local path="${1#file://}"
+    printf '%b' "${path//%/\\x}"
+}
+
+# spec serve-validation [--offline]: validation server on stdin/stdout. Requests:
+# initialize, shutdown and cloudcradle/validate {uri, text} -> diagnostics; notifications
+# textDocument/didOpen|didChange|didSave|didClose -> textDocument/publishDiagnostics.
+spec_serve_validation() {
+    local offline=false
+    case "${1:-}" in
+        --offline) offline=true ;;
+        "") ;;
+        *)
+            print_error "Usage: spec serve-validation [--offline]"
+            return 2
+            ;;
+    esac
+
+    # stdout carries the protocol; everything the script prints goes to stderr
+    exec 3>&1 1>&2
+    if [ "$offline" = "false" ]; then
+        # stdin belongs to the editor, so authentication must not prompt
+        NON_INTERACTIVE=true
+        if prepare_oci_session </dev/null >/dev/null 2>&1; then
+            {
+                inventory_section compute
+                inventory_section storage
+            } </dev/null >/dev/null 2>&1 || print_warning "Inventory failed - checking against the bare Free Tier limits"
         else
-            # Capture output so we can detect invalid-config errors and offer remediation
-            auth_out=$(oci session authenticate --profile-name "$OCI_PROFILE" --region "$auth_region" --session-expiration-in-minutes 60 2>&1) || {
-                echo "$auth_out" >&2
-                if echo "$auth_out" | grep -i -E "config file.*is invalid|Config Errors|user .*missing" >/dev/null 2>&1; then
-                    print_warning "OCI CLI reports the config file is invalid or missing required fields. Offering repair options..."
-                    existing_config_invalid=1
-                else
-                    print_error "Browser authentication failed or was cancelled"
-                    return 1
-                fi
-            }
+            print_warning "No OCI session - checking against the bare Free Tier limits"
+        fi
+    fi
+
+    # Open documents: one buffer file per URI
+    local docs id method uri buffer diagnostics shutdown=false SPEC_MESSAGE
+    docs=$(mktemp -d)
+    while spec_read_message; do
+        if ! jq -e 'type == "object"' <<< "$SPEC_MESSAGE" >/dev/null 2>&1; then
+            spec_send '{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error"}}'
+            continue
         fi
+        id=$(jq -c '.id // empty' <<< "$SPEC_MESSAGE")
+        method=$(jq -r '.method // ""' <<< "$SPEC_MESSAGE")
+        uri=$(jq -r '.params.textDocument.uri // .params.uri // ""' <<< "$SPEC_MESSAGE")
+        buffer="$docs/$(printf '%s' "$uri" | sha256_stdin | cut -c1-32)"
 
-        # SHARED REPAIR FLOW: runs for both WSL and non-WSL when existing_config_invalid is set
-        if [ "$existing_config_invalid" -eq 1 ]; then
-            print_warning "Detected invalid or incomplete OCI config file - AUTOMATICALLY DELETING AND FORCING FRESH AUTHENTICATION"
-            
-            # IMMEDIATE DELETE: Remove corrupted config without prompting
-            if [ -f "$OCI_CONFIG_FILE" ]; then
-                print_status "Backing up corrupted config to $OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)"
-                cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.corrupted.$(date +%Y%m%d_%H%M%S)" 2>/dev/null || true
-                print_status "Forcibly deleting corrupted config file: $OCI_CONFIG_FILE"
-                rm -f "$OCI_CONFIG_FILE"
-            fi
-            
-            # Delete any temp config files to start completely fresh
-            rm -f "$HOME/.oci/config.session_auth" 2>/dev/null || true
-            
-            # Create completely new profile with session auth
-            new_profile="DEFAULT"
-            print_status "Creating fresh OCI configuration with browser-based authentication for profile '$new_profile'..."
-            print_status "This will open your browser to log into Oracle Cloud."
-            print_status ""
-            print_status "Using region '$auth_region' for authentication"
-            print_status ""
-            
-            # Use the default config location (let OCI CLI create it fresh)
-            OCI_CONFIG_FILE="$HOME/.oci/config"
-            OCI_PROFILE="$new_profile"
-            unset OCI_CLI_CONFIG_FILE
-            
-            if is_wsl; then
-                if auth_out=$(oci session authenticate --no-browser --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60 2>&1); then
-                    echo "$auth_out"
-                    local url
-                    url=$(echo "$auth_out" | grep -Eo 'https://[^ ]+' | head -1 || true)
-                    if [ -n "$url" ]; then
-                        print_status "Opening browser for login URL (WSL)..."
-                        open_url_best_effort "$url" || true
-                        print_status ""
-                        print_status "After completing browser authentication, press Enter to continue..."
-                        read -r
-                    fi
-                    auth_method="security_token"
-                    if test_oci_connectivity; then
-                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
-                        return 0
-                    else
-                        print_warning "Session auth completed but connectivity test failed"
-                    fi
-                else
-                    echo "$auth_out" >&2
-                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
-                    return 1
+        case "$method" in
+            initialize)
+                spec_send "$(jq -n -c --argjson id "$id" '{jsonrpc: "2.0", id: $id, result: {
+                    capabilities: {textDocumentSync: {openClose: true, change: 1, save: {includeText: false}}},
+                    serverInfo: {name: "cloudcradle-spec"}}}')"
+                ;;
+            textDocument/didOpen|textDocument/didChange|textDocument/didSave)
+                if [ "$method" != "textDocument/didSave" ]; then
+                    jq -j '.params.textDocument.text // .params.contentChanges[-1].text // ""' <<< "$SPEC_MESSAGE" > "$buffer"
+                elif [ ! -f "$buffer" ]; then
+                    cat "$(spec_uri_path "$uri")" > "$buffer" 2>/dev/null || : > "$buffer"
                 fi
-            else
-                if oci session authenticate --profile-name "$new_profile" --region "$auth_region" --session-expiration-in-minutes 60; then
-                    auth_method="security_token"
-                    if test_oci_connectivity; then
-                        print_success "Fresh session authentication succeeded for profile '$new_profile'"
-                        return 0
-                    else
-                        print_warning "Session auth completed but connectivity test failed"
-                    fi
-                else
-                    print_error "Browser-based authentication failed. Please verify your Oracle Cloud credentials and try again."
-                    return 1
+                diagnostics=$(spec_diagnostics "$(spec_uri_path "$uri")" "$buffer")
+                spec_send "$(jq -n -c --arg uri "$uri" --argjson d "$diagnostics" \
+                    '{jsonrpc: "2.0", method: "textDocument/publishDiagnostics", params: {uri: $uri, diagnostics: $d}}')"
+                ;;
+            textDocument/didClose)
+                rm -f "$buffer"
+                spec_send "$(jq -n -c --arg uri "$uri" '{jsonrpc: "2.0", method: "textDocument/publishDiagnostics", params: {uri: $uri, diagnostics: []}}')"
+                ;;
+            cloudcradle/validate)
+                # Text from the request, else the open buffer, else the file on disk
+                if jq -e '.params.text | type == "string"' <<< "$SPEC_MESSAGE" >/dev/null; then
+                    buffer="$docs/request"
+                    jq -j '.params.text' <<< "$SPEC_MESSAGE" > "$buffer"
+                elif [ ! -f "$buffer" ]; then
+                    buffer="$(spec_uri_path "$uri")"
+                fi
+                diagnostics=$(spec_diagnostics "$(spec_uri_path "$uri")" "$buffer")
+                spec_send "$(jq -n -c --argjson id "$id" --argjson d "$diagnostics" '{jsonrpc: "2.0", id: $id, result: $d}')"
+                ;;
+            shutdown)
+                shutdown=true
+                spec_send "$(jq -n -c --argjson id "$id" '{jsonrpc: "2.0", id: $id, result: null}')"
+                ;;
+            exit)
+                break
+                ;;
+            *)
+                # Unknown notifications (initialized, $/cancelRequest, ...) are ignored
+                if [ -n "$id" ]; then
+                    spec_send "$(jq -n -c --argjson id "$id" --arg m "$method" \
+                        '{jsonrpc: "2.0", id: $id, error: {code: -32601, message: "Method not found: \($m)"}}')"
                 fi
+                ;;
+        esac
+    done
+    rm -rf "$docs"
+    # LSP: exit without a preceding shutdown is an error
+    [ "$method" != "exit" ] || [ "$shutdown" = "true" ]
+}
+
+# spec show: the spec as JSON - the instances saved in variables.tf and the line-based
+# config files present next to it
+spec_show() {
+    if ! load_existing_config >/dev/null 2>&1; then
+        print_error "No variables.tf here - run the setup (or 'init') first" >&2
+        return 1
+    fi
+    local i file
+    local -a files=() ocpus memory boots
+    for file in "$FIREWALL_RULES_FILE" "$INSTANCE_LABELS_FILE" "$READINESS_CHECKS_FILE" "$BACKUP_SPEC_FILE" \
+        "$POWER_STATE_FILE" "$SUBNETS_FILE" "$CLOUD_INIT_FILE" "$PROVISIONERS_FILE" "$SITES_FILE" \
+        "$SECRETS_FILE" "$USERS_FILE" "$HARDENING_FILE"; do
+        [ ! -f "$file" ] || files+=("$file")
+    done
+    read -r -a ocpus <<< "$arm_flex_ocpus_per_instance"
+    read -r -a memory <<< "$arm_flex_memory_per_instance"
+    read -r -a boots <<< "$arm_flex_boot_volume_size_gb"
+
+    {
+        for ((i = 0; i < amd_micro_instance_count; i++)); do
+            jq -nc --arg host "${amd_micro_hostnames[$i]:-}" --argjson boot "${amd_micro_boot_volume_size_gb:-50}" \
+                --arg blocks "${amd_block_volumes[$i]:-0}" \
+                '{kind: "amd", hostname: $host, boot_volume_gb: $boot,
+                  block_volumes_gb: ($blocks | split("+") | map(tonumber) | map(select(. > 0)))}'
+        done
+        for ((i = 0; i < arm_flex_instance_count; i++)); do
+            jq -nc --arg host "${arm_flex_hostnames[$i]:-}" --argjson ocpus "${ocpus[$i]:-1}" --argjson memory "${memory[$i]:-6}" \
+                --argjson boot "${boots[$i]:-50}" --arg blocks "${arm_flex_block_volumes[$i]:-0}" \
+                '{kind: "arm", hostname: $host, ocpus: $ocpus, memory_gb: $memory, boot_volume_gb: $boot,
+                  block_volumes_gb: ($blocks | split("+") | map(tonumber) | map(select(. > 0)))}'
+        done
+    } | jq -s --arg amd "$FREE_TIER_AMD_SHAPE" --arg arm "$FREE_TIER_ARM_SHAPE" \
+        --argjson files "$(printf '%s\n' "${files[@]}" | jq -R . | jq -s -c 'map(select(length > 0))')" \
+        '{version: 1, shapes: {amd: $amd, arm: $arm}, instances: ., config_files: $files}'
+}
+
+# ============================================================================
+# WHAT-IF CALCULATOR
+# ============================================================================
+#
+# Free Tier utilization of a hypothetical configuration: start from variables.tf (when
+# there is one), change counts, OCPUs or volumes and see the usage and any violations.
+# Nothing is generated or written, so it works in an empty or read-only directory.
+
+# Expand a comma-separated list to COUNT values: a single value applies to every instance,
+# missing ones get DEFAULT. Prints the values space-separated.
+whatif_expand_list() {
+    local list="${1// /}" count="$2" default="$3" i
+    local -a values=()
+    [ -n "$list" ] && IFS=',' read -r -a values <<< "$list"
+    if [ ${#values[@]} -eq 1 ] && [ "$count" -gt 1 ]; then
+        default="${values[0]}"
+    fi
+    for ((i=${#values[@]}; i<count; i++)); do
+        values+=("$default")
+    done
+    echo "${values[*]:0:$count}"
+}
+
+# Fit the per-instance lists and hostnames to the instance counts
+whatif_fit_lists() {
+    local i
+    arm_flex_ocpus_per_instance=$(whatif_expand_list "$(tr ' ' ',' <<< "$arm_flex_ocpus_per_instance")" "$arm_flex_instance_count" 1)
+    arm_flex_memory_per_instance=$(whatif_expand_list "$(tr ' ' ',' <<< "$arm_flex_memory_per_instance")" "$arm_flex_instance_count" 6)
+    arm_flex_boot_volume_size_gb=$(whatif_expand_list "$(tr ' ' ',' <<< "$arm_flex_boot_volume_size_gb")" "$arm_flex_instance_count" 50)
+    for ((i=${#amd_micro_hostnames[@]}; i<amd_micro_instance_count; i++)); do
+        amd_micro_hostnames+=("amd-instance-$((i + 1))")
+    done
+    for ((i=${#arm_flex_hostnames[@]}; i<arm_flex_instance_count; i++)); do
+        arm_flex_hostnames+=("arm-instance-$((i + 1))")
+    done
+    for ((i=${#amd_block_volumes[@]}; i<amd_micro_instance_count; i++)); do
+        amd_block_volumes+=(0)
+    done
+    for ((i=${#arm_flex_block_volumes[@]}; i<arm_flex_instance_count; i++)); do
+        arm_flex_block_volumes+=(0)
+    done
+}
+
+# Apply one change: whatif_set KEY VALUE (keys as the whatif flags without "--")
+whatif_set() {
+    local key="$1" value="${2// /}"
+    local -a specs
+    case "$key" in
+        amd|arm|amd-boot)
+            if [[ ! "$value" =~ ^[0-9]+$ ]]; then
+                print_error "--$key needs a number (got '$value')" >&2
+                return 1
             fi
-        fi
+            ;;
+        arm-ocpus|arm-memory|arm-boot)
+            if [[ ! "$value" =~ ^[0-9]+(,[0-9]+)*$ ]]; then
+                print_error "--$key needs a number or comma-separated numbers per instance (got '$value')" >&2
+                return 1
+            fi
+            ;;
+        amd-block-volumes|arm-block-volumes)
+            if [[ ! "$value" =~ ^[0-9]+(\+[0-9]+)*(,[0-9]+(\+[0-9]+)*)*$ ]]; then
+                print_error "--$key needs per-instance sizes like 100+50,0 (got '$value')" >&2
+                return 1
+            fi
+            ;;
+        backup-policy)
+            if [[ ! "$value" =~ ^(|none|bronze|silver|gold|custom)$ ]]; then
+                print_error "--backup-policy must be none, bronze, silver, gold or custom (got '$value')" >&2
+                return 1
+            fi
+            ;;
+        backup-schedule)
+            ;;
+        *)
+            print_error "Unknown what-if setting: $key" >&2
+            return 1
+            ;;
+    esac
 
+    case "$key" in
+        amd) amd_micro_instance_count="$value" ;;
+        arm) arm_flex_instance_count="$value" ;;
+        amd-boot) amd_micro_boot_volume_size_gb="$value" ;;
+        arm-ocpus) arm_flex_ocpus_per_instance=$(whatif_expand_list "$value" "$arm_flex_instance_count" 1) ;;
+        arm-memory) arm_flex_memory_per_instance=$(whatif_expand_list "$value" "$arm_flex_instance_count" 6) ;;
+        arm-boot) arm_flex_boot_volume_size_gb=$(whatif_expand_list "$value" "$arm_flex_instance_count" 50) ;;
+        amd-block-volumes)
+            read -r -a specs <<< "$(whatif_expand_list "$value" "$amd_micro_instance_count" 0)"
+            amd_block_volumes=("${specs[@]}")
+            ;;
+        arm-block-volumes)
+            read -r -a specs <<< "$(whatif_expand_list "$value" "$arm_flex_instance_count" 0)"
+            arm_flex_block_volumes=("${specs[@]}")
+            ;;
+        backup-policy) VOLUME_BACKUP_POLICY="${value/none/}" ;;
+        backup-schedule) VOLUME_BACKUP_SCHEDULE="$value" ;;
+    esac
+    whatif_fit_lists
+}
 
-        # If we got here without returning, then authentication succeeded but connectivity might have issues
-        # Let's continue anyway since the auth was successful
-        auth_method="security_token"
+# The whatif flags that reproduce the current configuration
+whatif_flags() {
+    printf -- '--amd %s --amd-boot %s --arm %s' "$amd_micro_instance_count" "$amd_micro_boot_volume_size_gb" "$arm_flex_instance_count"
+    if [ "$arm_flex_instance_count" -gt 0 ]; then
+        printf -- ' --arm-ocpus %s --arm-memory %s --arm-boot %s' "$(tr ' ' ',' <<< "$arm_flex_ocpus_per_instance")" \
+            "$(tr ' ' ',' <<< "$arm_flex_memory_per_instance")" "$(tr ' ' ',' <<< "$arm_flex_boot_volume_size_gb")"
+    fi
+    [ "$amd_micro_instance_count" -gt 0 ] && printf -- ' --amd-block-volumes %s' "$(IFS=,; echo "${amd_block_volumes[*]:0:$amd_micro_instance_count}")"
+    [ "$arm_flex_instance_count" -gt 0 ] && printf -- ' --arm-block-volumes %s' "$(IFS=,; echo "${arm_flex_block_volumes[*]:0:$arm_flex_instance_count}")"
+    [ -n "$VOLUME_BACKUP_POLICY" ] && printf -- ' --backup-policy %s' "$VOLUME_BACKUP_POLICY"
+    [ "$VOLUME_BACKUP_POLICY" = "custom" ] && printf -- ' --backup-schedule %s' "$VOLUME_BACKUP_SCHEDULE"
+    echo
+}
 
-        # Verify the new configuration
-        if test_oci_connectivity; then
-            print_success "OCI authentication configured successfully"
-            return 0
+# Usage of the configuration plus everything outside it, as JSON:
+# {"usage": [{resource, used, limit, unit}], "violations": [{code, message}]}
+whatif_report_json() {
+    local ocpus=0 memory=0 boot size block backups=0 violations
+    for size in $arm_flex_ocpus_per_instance; do ocpus=$((ocpus + size)); done
+    for size in $arm_flex_memory_per_instance; do memory=$((memory + size)); done
+    boot=$((amd_micro_instance_count * amd_micro_boot_volume_size_gb))
+    for size in $arm_flex_boot_volume_size_gb; do boot=$((boot + size)); done
+    block=$(block_volume_total_gb "${amd_block_volumes[@]:0:$amd_micro_instance_count}" "${arm_flex_block_volumes[@]:0:$arm_flex_instance_count}")
+    if [ -n "$VOLUME_BACKUP_POLICY" ]; then
+        backups=$(( $(volume_backup_volume_count) * $(volume_backups_retained_per_volume) ))
+    fi
+
+    violations=$({
+        free_tier_violations | cut -f2-
+        if [ "$backups" -gt "$FREE_TIER_MAX_VOLUME_BACKUPS" ]; then
+            printf 'volume-backups\t%s\n' "The backup policy keeps ~$backups volume backups, but only $FREE_TIER_MAX_VOLUME_BACKUPS are free (the rest are billed)"
+        fi
+    } | jq -Rn -c '[inputs | split("\t") | {code: .[0], message: .[1]}]')
+
+    jq -n -c --argjson violations "$violations" \
+        --argjson amd "$((amd_micro_instance_count + UNMANAGED_AMD_INSTANCES))" \
+        --argjson arm "$arm_flex_instance_count" \
+        --argjson ocpus "$((ocpus + UNMANAGED_ARM_OCPUS))" \
+        --argjson memory "$((memory + UNMANAGED_ARM_MEMORY_GB))" \
+        --argjson storage "$((boot + block + FREE_TIER_MAX_STORAGE_GB - $(storage_budget_gb)))" \
+        --argjson backups "$backups" \
+        --argjson max_amd "$FREE_TIER_MAX_AMD_INSTANCES" --argjson max_arm "$FREE_TIER_MAX_ARM_INSTANCES" \
+        --argjson max_ocpus "$FREE_TIER_MAX_ARM_OCPUS" --argjson max_memory "$FREE_TIER_MAX_ARM_MEMORY_GB" \
+        --argjson max_storage "$FREE_TIER_MAX_STORAGE_GB" --argjson max_backups "$FREE_TIER_MAX_VOLUME_BACKUPS" \
+        '{usage: [
+            {resource: "AMD instances", used: $amd, limit: $max_amd, unit: ""},
+            {resource: "ARM instances", used: $arm, limit: $max_arm, unit: ""},
+            {resource: "ARM OCPUs", used: $ocpus, limit: $max_ocpus, unit: ""},
+            {resource: "ARM memory", used: $memory, limit: $max_memory, unit: "GB"},
+            {resource: "Storage", used: $storage, limit: $max_storage, unit: "GB"},
+            {resource: "Volume backups", used: $backups, limit: $max_backups, unit: ""}
+          ], violations: $violations}'
+}
+
+whatif_report() {
+    local report resource used limit unit percent bar color line
+    report=$(whatif_report_json)
+    local amd="none" arm="none"
+    [ "$amd_micro_instance_count" -gt 0 ] && amd="${amd_micro_instance_count}x, ${amd_micro_boot_volume_size_gb}GB boot, block volumes ${amd_block_volumes[*]:0:$amd_micro_instance_count}"
+    [ "$arm_flex_instance_count" -gt 0 ] && arm="${arm_flex_instance_count}x, OCPUs $arm_flex_ocpus_per_instance, memory ${arm_flex_memory_per_instance}GB, boot ${arm_flex_boot_volume_size_gb}GB, block volumes ${arm_flex_block_volumes[*]:0:$arm_flex_instance_count}"
+    echo -e "${BOLD}AMD:${NC} $amd"
+    echo -e "${BOLD}ARM:${NC} $arm"
+    echo ""
+    while IFS=$'\t' read -r resource used limit unit; do
+        percent=$((used * 100 / limit))
+        bar=$(printf '%*s' "$(( (percent > 100 ? 100 : percent) / 5 ))" '' | tr ' ' '#')
+        if [ "$used" -gt "$limit" ]; then
+            color="$RED"
+        elif [ "$percent" -ge 80 ]; then
+            color="$YELLOW"
+        else
+            color="$GREEN"
         fi
+        printf "  %-16s %5s / %-6s ${color}[%-20s]${NC} %3d%%\n" "$resource" "$used$unit" "$limit$unit" "$bar" "$percent"
+    done < <(jq -r '.usage[] | [.resource, .used, .limit, .unit] | @tsv' <<< "$report")
+    echo ""
+    if [ "$(jq '.violations | length' <<< "$report")" -eq 0 ]; then
+        print_success "Fits the Always Free limits"
+    else
+        jq -r '.violations[].message' <<< "$report" | while IFS= read -r line; do
+            print_error "$line"
+        done
     fi
+    [ "$UNMANAGED_STORAGE_GB$UNMANAGED_AMD_INSTANCES$UNMANAGED_ARM_OCPUS" = "000" ] \
+        || print_status "Includes usage outside this configuration (--live)"
+}
 
-    print_error "OCI configuration verification failed"
-    return 1
+# Interactive what-if: pick a setting, enter a value, see the result right away
+whatif_tui() {
+    local choice key current value
+    while true; do
+        [ -t 1 ] && printf '\033[H\033[2J'
+        print_header "WHAT-IF CALCULATOR"
+        whatif_report
+        echo ""
+        echo "  1) AMD instances      2) AMD boot GB        3) AMD block volumes"
+        echo "  4) ARM instances      5) ARM OCPUs          6) ARM memory GB"
+        echo "  7) ARM boot GB        8) ARM block volumes  9) Backup policy"
+        echo "  q) Quit"
+        echo -ne "${BLUE}Change: ${NC}" >&2
+        read -r choice || break
+        case "$choice" in
+            1) key=amd current=$amd_micro_instance_count ;;
+            2) key=amd-boot current=$amd_micro_boot_volume_size_gb ;;
+            3) key=amd-block-volumes current=$(IFS=,; echo "${amd_block_volumes[*]:0:$amd_micro_instance_count}") ;;
+            4) key=arm current=$arm_flex_instance_count ;;
+            5) key=arm-ocpus current=$(tr ' ' ',' <<< "$arm_flex_ocpus_per_instance") ;;
+            6) key=arm-memory current=$(tr ' ' ',' <<< "$arm_flex_memory_per_instance") ;;
+            7) key=arm-boot current=$(tr ' ' ',' <<< "$arm_flex_boot_volume_size_gb") ;;
+            8) key=arm-block-volumes current=$(IFS=,; echo "${arm_flex_block_volumes[*]:0:$arm_flex_instance_count}") ;;
+            9) key=backup-policy current=${VOLUME_BACKUP_POLICY:-none} ;;
+            q|Q) break ;;
+            *) continue ;;
+        esac
+        value=$(prompt_with_default "  $key" "$current")
+        if ! whatif_set "$key" "$value"; then
+            read -r -p "Press Enter to continue " _ || break
+        elif [ "$key" = "backup-policy" ] && [ "$VOLUME_BACKUP_POLICY" = "custom" ]; then
+            whatif_set backup-schedule "$(prompt_with_default "  backup-schedule" "$VOLUME_BACKUP_SCHEDULE")"
+        fi
+    done
+    echo ""
+    print_status "Same result from the command line: $0 whatif $(whatif_flags)"
 }
 
-test_oci_connectivity() {
-    print_status "Testing OCI API connectivity..."
-    
-    # Method 1: List regions (simplest test)
-    print_status "Checking IAM region list (timeout ${OCI_CMD_TIMEOUT}s)..."
-    if oci_cmd "iam region list" >/dev/null 2>&1; then
-        print_debug "Connectivity test passed (region list)"
-        return 0
+# whatif [--amd N] [--amd-boot GB] [--arm N] [--arm-ocpus LIST] [--arm-memory LIST]
+#        [--arm-boot LIST] [--amd-block-volumes SPEC] [--arm-block-volumes SPEC]
+#        [--backup-policy P] [--backup-schedule S] [--live] [--json] [--interactive]
+# Lists are per instance, comma-separated; a single value applies to every instance.
+whatif() {
+    local live=false format=text interactive=false
+    local -a changes=()
+    [ -n "$AMD_BLOCK_VOLUMES" ] && changes+=(amd-block-volumes "$AMD_BLOCK_VOLUMES")
+    [ -n "$ARM_BLOCK_VOLUMES" ] && changes+=(arm-block-volumes "$ARM_BLOCK_VOLUMES")
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --amd|--amd-boot|--arm|--arm-ocpus|--arm-memory|--arm-boot|--amd-block-volumes|--arm-block-volumes|--backup-policy|--backup-schedule)
+                if [ $# -lt 2 ]; then
+                    print_error "$1 requires a value"
+                    return 2
+                fi
+                changes+=("${1#--}" "$2")
+                shift 2
+                ;;
+            --live)
+                live=true
+                shift
+                ;;
+            --json)
+                format=json
+                shift
+                ;;
+            -i|--interactive)
+                interactive=true
+                shift
+                ;;
+            *)
+                print_error "Unknown whatif option: $1 (see $0 help)"
+                return 2
+                ;;
+        esac
+    done
+    # Without changes in a terminal, open the interactive calculator
+    if [ ${#changes[@]} -eq 0 ] && [ "$format" = "text" ] && [ -t 0 ] && [ -t 1 ]; then
+        interactive=true
+    fi
+
+    if [ -f variables.tf ]; then
+        load_existing_config >/dev/null 2>&1 || true
     else
-        print_warning "Region list query failed or timed out"
+        amd_micro_instance_count=0 amd_micro_boot_volume_size_gb=50 arm_flex_instance_count=0
     fi
-    
-    # Method 2: Get tenancy info if we have it
-    local test_tenancy
-    test_tenancy=$(grep -oP '(?<=tenancy=).*' "$OCI_CONFIG_FILE" 2>/dev/null | head -1)
-    
-    if [ -n "$test_tenancy" ]; then
-        print_status "Checking IAM tenancy get (timeout ${OCI_CMD_TIMEOUT}s)..."
-        if oci_cmd "iam tenancy get --tenancy-id $test_tenancy" >/dev/null 2>&1; then
-            print_debug "Connectivity test passed (tenancy get)"
-            return 0
+    if [ "$live" = "true" ]; then
+        NON_INTERACTIVE=true
+        if prepare_oci_session </dev/null >/dev/null 2>&1; then
+            { inventory_section compute; inventory_section storage; inventory_section backups; } </dev/null >/dev/null 2>&1 \
+                || print_warning "Inventory failed - using the bare Free Tier limits" >&2
         else
-            print_warning "Tenancy get failed or timed out"
+            print_warning "No OCI session - using the bare Free Tier limits" >&2
         fi
     fi
-    
-    print_debug "All connectivity tests failed"
-    return 1
+
+    # Counts first, so per-instance lists expand to the new number of instances
+    local i pass
+    for pass in counts lists; do
+        for ((i=0; i<${#changes[@]}; i+=2)); do
+            case "${changes[$i]}" in
+                amd|arm) [ "$pass" = "counts" ] || continue ;;
+                *) [ "$pass" = "lists" ] || continue ;;
+            esac
+            whatif_set "${changes[$i]}" "${changes[$((i + 1))]}" || return 2
+        done
+    done
+    whatif_fit_lists
+
+    if [ "$interactive" = "true" ]; then
+        whatif_tui
+        return 0
+    fi
+    if [ "$format" = "json" ]; then
+        whatif_report_json | jq --arg flags "$(whatif_flags)" '. + {flags: $flags}'
+    else
+        whatif_report
+    fi
+    # Exit 1 when the configuration would not fit
+    [ "$(whatif_report_json | jq '.violations | length')" -eq 0 ]
 }
 
 # ============================================================================
-# OCI RESOURCE DISCOVERY FUNCTIONS
+# BENCHMARKS
 # ============================================================================
+#
+# Hidden 'bench' command guarding the hot paths against performance regressions: the
+# inventory over a synthetic tenancy (OCI_CLI_FIXTURES_DIR), Terraform file generation
+# and parsing the generated HCL back. Each run happens in a subshell in a scratch
+# directory, so nothing leaks into the caller's workspace or globals.
 
-fetch_oci_config_values() {
-    print_subheader "Fetching OCI Configuration"
-    
-    # Tenancy OCID
-    tenancy_ocid=$(grep -oP '(?<=tenancy=).*' ~/.oci/config | head -1)
-    if [ -z "$tenancy_ocid" ]; then
-        print_error "Failed to fetch tenancy OCID from config"
-        return 1
-    fi
-    print_status "Tenancy OCID: $tenancy_ocid"
-    
-    # User OCID
-    user_ocid=$(grep -P '^\s*user\s*=' ~/.oci/config | sed -E 's/^\s*user\s*=\s*//' | head -1)
-    if [ -z "$user_ocid" ]; then
-        # Try to get from API for session token auth
-        local user_info
-        user_info=$(oci_cmd "iam user list --compartment-id $tenancy_ocid --limit 1")
-        user_ocid=$(safe_jq "$user_info" '.data[0].id')
-    fi
-    print_status "User OCID: ${user_ocid:-N/A (session token auth)}"
-    
-    # Region
-    region=$(grep -oP '(?<=region=).*' ~/.oci/config | head -1)
-    if [ -z "$region" ]; then
-        print_error "Failed to fetch region from config"
-        return 1
-    fi
-    print_status "Region: $region"
-    
-    # Fingerprint (only for API key auth)
-    if [ "$auth_method" = "security_token" ]; then
-        fingerprint="session_token_auth"
+BENCH_TOLERANCE=${BENCH_TOLERANCE:-25}    # % a median may exceed the --baseline one
+
+# Write fixtures for a tenancy with SIZE instances, SIZE boot and block volumes,
+# SIZE/10 VCNs (each with subnets, gateways, route tables and security lists) and backups
+bench_synthetic_tenancy() {
+    local dir="$1" size="$2" vcns i
+    mkdir -p "$dir"
+    vcns=$(( size / 10 > 0 ? size / 10 : 1 ))
+    jq -n --argjson n "$size" --arg amd "$FREE_TIER_AMD_SHAPE" --arg arm "$FREE_TIER_ARM_SHAPE" \
+        '[range($n) | {id: "ocid1.instance.oc1..bench\(.)", name: "bench-\(.)", state: "RUNNING",
+          shape: ([$amd, $arm, "VM.Standard.E4.Flex"][. % 3]), ad: "AD-1", created: "2025-01-01T00:00:00Z", tags: {}}]' \
+        > "$dir/compute_instance_list.json"
+    echo '{"data": {"shape-config": {"ocpus": 2, "memory-in-gbs": 12}}}' > "$dir/compute_instance_get.json"
+    echo '[{"vnic-id": "ocid1.vnic.oc1..bench"}]' > "$dir/compute_vnic_attachment_list.json"
+    echo '{"data": {"public-ip": "203.0.113.10", "private-ip": "10.0.1.10", "ipv6-addresses": ["2603:c020::10"]}}' \
+        > "$dir/network_vnic_get.json"
+    jq -n --argjson n "$vcns" '[range($n) | {id: "ocid1.vcn.oc1..bench\(.)", name: "vcn-\(.)", cidr: "10.\(.).0.0/16", tags: {},
+          rt: "ocid1.routetable.oc1..bench\(.)x0", sl: "ocid1.securitylist.oc1..bench\(.)x0"}]' \
+        > "$dir/network_vcn_list.json"
+    for ((i = 0; i < vcns; i++)); do
+        jq -n --argjson v "$i" '[range(3) | {id: "ocid1.subnet.oc1..bench\($v)x\(.)", name: "subnet-\(.)",
+            cidr: "10.\($v).\(.).0/24", dns: "sub\(.)", private: (. == 2)}]' > "$dir/network_subnet_list.ocid1.vcn.oc1..bench$i.json"
+        jq -n --argjson v "$i" '[{id: "ocid1.internetgateway.oc1..bench\($v)", name: "igw"}]' \
+            > "$dir/network_internet_gateway_list.ocid1.vcn.oc1..bench$i.json"
+        jq -n --argjson v "$i" '[range(2) | {id: "ocid1.routetable.oc1..bench\($v)x\(.)", name: "rt-\(.)"}]' \
+            > "$dir/network_route_table_list.ocid1.vcn.oc1..bench$i.json"
+        jq -n --argjson v "$i" '[range(2) | {id: "ocid1.securitylist.oc1..bench\($v)x\(.)", name: "sl-\(.)"}]' \
+            > "$dir/network_security_list_list.ocid1.vcn.oc1..bench$i.json"
+        jq -n --argjson v "$i" '[{id: "ocid1.networksecuritygroup.oc1..bench\($v)", name: "nsg"}]' \
+            > "$dir/network_nsg_list.ocid1.vcn.oc1..bench$i.json"
+    done
+    jq -n --argjson n "$size" '[range($n) | {id: "ocid1.publicip.oc1..bench\(.)", name: "bench-\(.)-public-ip",
+        ip: "203.0.113.\(. % 250)", assigned: null}]' > "$dir/network_public_ip_list.json"
+    jq -n --argjson n "$size" '[range($n) | {id: "ocid1.bootvolume.oc1..bench\(.)", name: "boot-\(.)", size: 50}]' \
+        > "$dir/bv_boot_volume_list.json"
+    jq -n --argjson n "$size" '[range($n) | {id: "ocid1.volume.oc1..bench\(.)", name: "block-\(.)", size: 50, tags: {}}]' \
+        > "$dir/bv_volume_list.json"
+    jq -n --argjson n "$size" '[range($n) | if . % 2 == 0 then "SCHEDULED" else "MANUAL" end]' > "$dir/bv_boot_volume_backup_list.json"
+    cp "$dir/bv_boot_volume_backup_list.json" "$dir/bv_backup_list.json"
+    echo '[{"id": "ocid1.autonomousdatabase.oc1..bench", "name": "benchdb", "workload": "OLTP", "state": "AVAILABLE", "tags": {}}]' \
+        > "$dir/db_autonomous_database_list.json"
+}
+
+# The largest Always Free configuration plus SIZE firewall rules, for file generation
+bench_configure() {
+    local size="$1" i
+    tenancy_ocid="ocid1.tenancy.oc1..bench"
+    region="us-ashburn-1"
+    availability_domain="AD-1"
+    ubuntu_image_ocid="ocid1.image.oc1..benchamd"
+    ubuntu_arm_flex_image_ocid="ocid1.image.oc1..bencharm"
+    ssh_public_key="ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA bench"
+    amd_micro_instance_count=2
+    amd_micro_hostnames=(amd-1 amd-2)
+    amd_block_volumes=(0 0)
+    arm_flex_instance_count=4
+    arm_flex_hostnames=(arm-1 arm-2 arm-3 arm-4)
+    arm_flex_ocpus_per_instance="1 1 1 1"
+    arm_flex_memory_per_instance="6 6 6 6"
+    arm_flex_boot_volume_size_gb="50 50 50 50"
+    arm_flex_block_volumes=(0 0 0 0)
+    for ((i = 0; i < size; i++)); do
+        echo "ingress tcp $((10000 + i)) 198.51.100.$((i % 250))/32 bench rule $i"
+    done > "$FIREWALL_RULES_FILE"
+}
+
+bench_inventory() {
+    OCI_CLI_FIXTURES_DIR="$1"
+    tenancy_ocid="ocid1.tenancy.oc1..bench"
+    availability_domain="AD-1"
+    INVENTORY_CACHE=refresh inventory_all_resources
+}
+
+bench_generate() {
+    bench_configure "$1"
+    # The per-instance cloud-init check shells out to terraform; it is not what is measured
+    validate_cloud_init() { :; }
+    create_terraform_files
+}
+
+bench_parse() {
+    load_existing_config
+    load_firewall_rules
+    terraform_dependency_edges . >/dev/null
+}
+
+# Run "$@" ITERATIONS times in DIR; prints the wall time of each run in milliseconds
+bench_time() {
+    local iterations="$1" dir="$2" i start end
+    shift 2
+    for ((i = 0; i < iterations; i++)); do
+        start=$(epoch_us)
+        if ! (cd "$dir" && set +e && "$@") >/dev/null 2>&1; then
+            return 1
+        fi
+        end=$(epoch_us)
+        echo $(( (end - start) / 1000 ))
+    done
+}
+
+# bench [--size N] [--iterations N] [--json] [--baseline FILE]: time inventory,
+# generation and HCL parsing on a synthetic tenancy (exit 2 when slower than the baseline)
+run_bench() {
+    local size=100 iterations=3 json=false baseline="" scratch name times report
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --size|--iterations)
+                if [[ ! "${2:-}" =~ ^[1-9][0-9]*$ ]]; then
+                    print_error "$1 requires a positive integer"
+                    return 2
+                fi
+                [ "$1" = "--size" ] && size="$2" || iterations="$2"
+                shift 2
+                ;;
+            --json)
+                json=true
+                shift
+                ;;
+            --baseline)
+                baseline="${2:-}"
+                if [ ! -f "$baseline" ]; then
+                    print_error "--baseline requires the JSON of an earlier 'bench --json' run"
+                    return 2
+                fi
+                shift 2
+                ;;
+            *)
+                print_error "Usage: bench [--size N] [--iterations N] [--json] [--baseline FILE]"
+                return 2
+                ;;
+        esac
+    done
+
+    scratch=$(mktemp -d)
+    bench_synthetic_tenancy "$scratch/fixtures" "$size"
+    mkdir -p "$scratch/workspace"
+    [ "$json" = "true" ] || print_status "Benchmarking with $size synthetic resources per kind, $iterations iteration(s)..." >&2
+
+    report="[]"
+    for name in inventory generate parse; do
+        case "$name" in
+            inventory) times=$(bench_time "$iterations" "$scratch/workspace" bench_inventory "$scratch/fixtures") ;;
+            generate) times=$(bench_time "$iterations" "$scratch/workspace" bench_generate "$size") ;;
+            parse) times=$(bench_time "$iterations" "$scratch/workspace" bench_parse) ;;
+        esac || {
+            rm -rf "$scratch"
+            print_error "Benchmark '$name' failed - run it without output redirection to debug" >&2
+            return 1
+        }
+        report=$(jq -c --arg name "$name" --argjson size "$size" --argjson t "$(jq -s -c 'sort' <<< "$times")" \
+            '. + [{name: $name, size: $size, iterations: ($t | length), min_ms: $t[0], median_ms: $t[($t | length) / 2 | floor], max_ms: $t[-1]}]' \
+            <<< "$report")
+    done
+    rm -rf "$scratch"
+
+    if [ "$json" = "true" ]; then
+        jq . <<< "$report"
     else
-        fingerprint=$(grep -oP '(?<=fingerprint=).*' ~/.oci/config | head -1)
+        printf '  %-10s %8s %10s %8s\n' BENCHMARK MIN MEDIAN MAX
+        jq -r '.[] | [.name, "\(.min_ms)ms", "\(.median_ms)ms", "\(.max_ms)ms"] | @tsv' <<< "$report" \
+            | while IFS=$'\t' read -r name min median max; do
+                printf '  %-10s %8s %10s %8s\n' "$name" "$min" "$median" "$max"
+            done
     fi
-    print_debug "Auth fingerprint: $fingerprint"
-    
-    print_success "OCI configuration values fetched"
+
+    [ -n "$baseline" ] || return 0
+    local regressions
+    regressions=$(jq -r --slurpfile base "$baseline" --argjson tol "$BENCH_TOLERANCE" '
+        ($base[0] | map({(.name): .}) | add) as $b
+        | .[] | select($b[.name] and .median_ms > $b[.name].median_ms * (1 + $tol / 100) and .median_ms - $b[.name].median_ms >= 50)
+        | "\(.name): \($b[.name].median_ms)ms -> \(.median_ms)ms"' <<< "$report")
+    if [ -n "$regressions" ]; then
+        print_error "Slower than the baseline by more than ${BENCH_TOLERANCE}%:" >&2
+        sed 's/^/  /' <<< "$regressions" >&2
+        return 2
+    fi
+    [ "$json" = "true" ] || print_success "Within ${BENCH_TOLERANCE}% of the baseline"
+}
+
+# ============================================================================
+# SCHEMA EXPORT
+# ============================================================================
+#
+# JSON Schemas (draft 2020-12) for the JSON this script writes or reads, so other tools
+# and editors can validate it. tests/validate_schemas.sh checks each one against what the
+# code actually writes, so a jq change that breaks a schema fails CI.
+
+readonly SCHEMA_NAMES="spec result event capacity-event capacity-stats drift lint fleet-packages backup-status ssh-users-cache image-lock"
+
+json_schema() {
+    case "$1" in
+        spec)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:spec",
+  "title": "spec show",
+  "description": "The spec: the instances saved in variables.tf and the line-based config files present",
+  "type": "object",
+  "required": ["version", "shapes", "instances", "config_files"],
+  "additionalProperties": false,
+  "properties": {
+    "version": {"const": 1},
+    "shapes": {
+      "type": "object",
+      "required": ["amd", "arm"],
+      "additionalProperties": false,
+      "properties": {"amd": {"type": "string"}, "arm": {"type": "string"}}
+    },
+    "instances": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["kind", "hostname", "boot_volume_gb", "block_volumes_gb"],
+        "additionalProperties": false,
+        "properties": {
+          "kind": {"enum": ["amd", "arm"]},
+          "hostname": {"type": "string"},
+          "ocpus": {"type": "number", "exclusiveMinimum": 0, "description": "arm only"},
+          "memory_gb": {"type": "number", "exclusiveMinimum": 0, "description": "arm only"},
+          "boot_volume_gb": {"type": "integer", "minimum": 47},
+          "block_volumes_gb": {"type": "array", "items": {"type": "integer", "minimum": 50}}
+        },
+        "if": {"properties": {"kind": {"const": "arm"}}},
+        "then": {"required": ["ocpus", "memory_gb"]}
+      }
+    },
+    "config_files": {"type": "array", "items": {"type": "string"}, "uniqueItems": true}
+  }
+}
+EOF
+            ;;
+        result)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:result",
+  "title": "Run result",
+  "description": "RESULT_FILE (e.g. result.json): written when a run exits",
+  "type": "object",
+  "required": ["version", "run", "tool_version", "command", "status", "exit_code", "duration_ms", "started", "finished", "dry_run", "phases", "failed_phase"],
+  "additionalProperties": false,
+  "properties": {
+    "version": {"const": 1},
+    "run": {"type": "string", "description": "Run id, as in the provenance lines of generated files"},
+    "tool_version": {"type": "string"},
+    "command": {"type": "string", "description": "Subcommand, or \"setup\" for the full run"},
+    "status": {"enum": ["ok", "error"]},
+    "exit_code": {"type": "integer", "minimum": 0, "maximum": 255},
+    "duration_ms": {"type": "integer", "minimum": 0},
+    "started": {"type": "string", "format": "date-time"},
+    "finished": {"type": "string", "format": "date-time"},
+    "dry_run": {"type": "boolean"},
+    "phases": {
+      "description": "Phases in the order they ended",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name", "status", "duration_ms"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string"},
+          "status": {"enum": ["ok", "error"]},
+          "duration_ms": {"type": "integer", "minimum": 0}
+        }
+      }
+    },
+    "failed_phase": {"type": ["string", "null"], "description": "Last phase that ended with an error"}
+  }
+}
+EOF
+            ;;
+        event)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:event",
+  "title": "Run event",
+  "description": "One line of EVENTS_FILE: run_start, phase_start, phase_end or run_end",
+  "type": "object",
+  "required": ["ts", "run", "event"],
+  "properties": {
+    "ts": {"type": "string", "format": "date-time"},
+    "run": {"type": "string"},
+    "event": {"enum": ["run_start", "phase_start", "phase_end", "run_end"]},
+    "command": {"type": "string"},
+    "version": {"type": "string"},
+    "phase": {"type": "string"},
+    "status": {"enum": ["ok", "error"]},
+    "exit_code": {"type": "integer", "minimum": 0, "maximum": 255},
+    "duration_ms": {"type": "integer", "minimum": 0}
+  },
+  "oneOf": [
+    {"properties": {"event": {"const": "run_start"}}, "required": ["command", "version"], "maxProperties": 5},
+    {"properties": {"event": {"const": "phase_start"}}, "required": ["phase"], "maxProperties": 4},
+    {"properties": {"event": {"const": "phase_end"}}, "required": ["phase", "status", "duration_ms"], "maxProperties": 6},
+    {"properties": {"event": {"const": "run_end"}}, "required": ["command", "status", "exit_code", "duration_ms"], "maxProperties": 7}
+  ]
+}
+EOF
+            ;;
+        capacity-event)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:capacity-event",
+  "title": "Capacity event",
+  "description": "One line of CAPACITY_HISTORY_FILE (.capacity-history.jsonl): the outcome of launching a shape",
+  "type": "object",
+  "required": ["ts", "hour", "result", "region", "ad", "shape"],
+  "additionalProperties": false,
+  "properties": {
+    "ts": {"type": "string", "format": "date-time"},
+    "hour": {"type": "integer", "minimum": 0, "maximum": 23, "description": "UTC hour of ts"},
+    "result": {"enum": ["success", "out_of_capacity"]},
+    "region": {"type": "string"},
+    "ad": {"type": "string", "description": "Availability domain, or \"unknown\""},
+    "shape": {"type": "string"}
+  }
+}
+EOF
+            ;;
+        capacity-stats)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:capacity-stats",
+  "title": "capacity-stats --json",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["shape", "attempts", "successes", "failures", "last_success", "best_window"],
+    "properties": {
+      "shape": {"type": "string"},
+      "attempts": {"type": "integer", "minimum": 0},
+      "successes": {"type": "integer", "minimum": 0},
+      "failures": {"type": "integer", "minimum": 0},
+      "last_success": {"type": ["string", "null"], "format": "date-time"},
+      "best_window": {
+        "description": "3-hour UTC window with the most successes (null without any)",
+        "type": ["object", "null"],
+        "required": ["start", "end", "successes", "ad"],
+        "properties": {
+          "start": {"type": "integer", "minimum": 0, "maximum": 23},
+          "end": {"type": "integer", "minimum": 0, "maximum": 23},
+          "successes": {"type": "integer", "minimum": 1},
+          "ad": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+EOF
+            ;;
+        drift)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:drift",
+  "title": "drift --json",
+  "description": "Resources whose live state or config differs from Terraform state",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["address", "drift", "actions", "config_diff", "suggestion"],
+    "additionalProperties": false,
+    "properties": {
+      "address": {"type": "string", "description": "Terraform resource address"},
+      "drift": {"type": "array", "items": {"type": "string"}, "description": "Attributes changed outside Terraform"},
+      "actions": {"type": "array", "items": {"enum": ["no-op", "create", "read", "update", "delete"]}},
+      "config_diff": {"type": "array", "items": {"type": "string"}, "description": "Attributes the next apply changes"},
+      "suggestion": {"type": "string"}
+    }
+  }
+}
+EOF
+            ;;
+        lint)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:lint",
+  "title": "lint --json",
+  "description": "Findings ranked high > medium > low",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["severity", "code", "file", "line", "message", "suggestion"],
+    "additionalProperties": false,
+    "properties": {
+      "severity": {"enum": ["high", "medium", "low"]},
+      "code": {"type": "string", "pattern": "^L[0-9]{3}$"},
+      "file": {"type": "string", "description": "Empty when the finding is not tied to a file"},
+      "line": {"type": ["integer", "null"], "minimum": 1},
+      "message": {"type": "string"},
+      "suggestion": {"type": "string"}
+    }
+  }
+}
+EOF
+            ;;
+        fleet-packages)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:fleet-packages",
+  "title": "fleet packages --json",
+  "type": "object",
+  "required": ["hosts", "latest", "stragglers"],
+  "additionalProperties": false,
+  "properties": {
+    "hosts": {
+      "description": "Per instance: package => version (\"-\" when not installed), or why it was skipped",
+      "type": "object",
+      "additionalProperties": {
+        "oneOf": [
+          {"type": "object", "additionalProperties": {"type": "string"}},
+          {"enum": ["stopped", "unreachable"]}
+        ]
+      }
+    },
+    "latest": {
+      "description": "Newest version of each package across the fleet (empty when nowhere installed)",
+      "type": "object",
+      "additionalProperties": {"type": "string"}
+    },
+    "stragglers": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["host", "package", "version", "latest"],
+        "additionalProperties": false,
+        "properties": {
+          "host": {"type": "string"},
+          "package": {"type": "string"},
+          "version": {"type": "string"},
+          "latest": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+EOF
+            ;;
+        backup-status)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:backup-status",
+  "title": "backup status --json",
+  "description": "Per instance: restic repository status, or why there is none",
+  "type": "object",
+  "additionalProperties": {
+    "oneOf": [
+      {"enum": ["not configured", "unreachable"]},
+      {
+        "type": "object",
+        "required": ["paths", "repository", "reachable", "snapshots", "latest", "last_run", "next_run"],
+        "properties": {
+          "paths": {"type": "array", "items": {"type": "string"}},
+          "repository": {"type": "string"},
+          "reachable": {"type": "boolean"},
+          "snapshots": {"type": "integer", "minimum": 0},
+          "latest": {
+            "type": ["object", "null"],
+            "required": ["id", "time"],
+            "properties": {"id": {"type": "string"}, "time": {"type": "string"}}
+          },
+          "last_run": {
+            "type": ["object", "null"],
+            "required": ["time", "result"],
+            "properties": {"time": {"type": "string"}, "result": {"enum": ["ok", "failed"]}}
+          },
+          "next_run": {"type": "string", "description": "Next timer run, empty when unknown"}
+        }
+      }
+    ]
+  }
+}
+EOF
+            ;;
+        ssh-users-cache)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:ssh-users-cache",
+  "title": "SSH_AUTHORIZED_USERS key cache",
+  "description": "SSH_AUTHORIZED_USERS_CACHE (.ssh-authorized-users.json): published keys per github:/gitlab: handle",
+  "type": "object",
+  "propertyNames": {"pattern": "^(github|gitlab):[A-Za-z0-9][A-Za-z0-9_.-]*$"},
+  "additionalProperties": {
+    "type": "array",
+    "items": {"type": "string", "pattern": "^(ssh-|ecdsa-|sk-)"}
+  }
+}
+EOF
+            ;;
+        image-lock)
+            cat <<'EOF'
+{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "urn:cloudcradle:schema:image-lock",
+  "title": "Image lock",
+  "description": "IMAGE_LOCK_FILE (images.lock.json): the image OCIDs pinned per region",
+  "type": "object",
+  "additionalProperties": {
+    "type": "object",
+    "required": ["selection"],
+    "additionalProperties": false,
+    "properties": {
+      "selection": {"type": "string", "description": "What the images were resolved for, e.g. \"ubuntu 24.04 minimal\" or \"rocky\""}
+    },
+    "patternProperties": {
+      "^(amd|arm)$": {
+        "type": "object",
+        "required": ["id", "name"],
+        "additionalProperties": false,
+        "properties": {
+          "id": {"type": "string", "pattern": "^ocid1\\.image\\."},
+          "name": {"type": "string"},
+          "listing": {"type": "string", "description": "Marketplace \"<listing id>|<version>\" (absent for platform images)"}
+        }
+      }
+    }
+  }
+}
+EOF
+            ;;
+        *)
+            return 1
+            ;;
+    esac
 }
 
-fetch_availability_domains() {
-    print_status "Fetching availability domains..."
-    
-    local ad_list
-    ad_list=$(oci_cmd "iam availability-domain list --compartment-id $tenancy_ocid --query 'data[].name' --raw-output")
-    
-    if [ -z "$ad_list" ] || [ "$ad_list" = "null" ]; then
-        print_error "Failed to fetch availability domains"
-        return 1
-    fi
-    
-    # Parse first AD
-    availability_domain=$(echo "$ad_list" | jq -r '.[0]' 2>/dev/null)
-    
-    if [ -z "$availability_domain" ] || [ "$availability_domain" = "null" ]; then
-        print_error "Failed to parse availability domain"
-        return 1
+# schema export [NAME...] [--dir DIR]: print one schema, or write <name>.schema.json files
+# (all of them when no NAME is given) for editors and CI validators
+schema_export() {
+    local dir="" name
+    local -a names=()
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --dir)
+                dir="${2:-}"
+                shift 2 || { print_error "--dir requires a directory"; return 2; }
+                ;;
+            *)
+                names+=("$1")
+                shift
+                ;;
+        esac
+    done
+    if [ ${#names[@]} -eq 0 ]; then
+        read -r -a names <<< "$SCHEMA_NAMES"
     fi
-    
-    print_success "Availability domain: $availability_domain"
-}
+    for name in "${names[@]}"; do
+        if ! json_schema "$name" >/dev/null; then
+            print_error "Unknown schema: $name (available: $SCHEMA_NAMES)" >&2
+            return 2
+        fi
+    done
 
-fetch_ubuntu_images() {
-    print_status "Fetching Ubuntu images for region $region..."
-    
-    # Fetch x86 (AMD64) Ubuntu image
-    print_status "  Looking for x86 Ubuntu image..."
-    local x86_images
-    x86_images=$(oci_cmd "compute image list \
-        --compartment-id $tenancy_ocid \
-        --operating-system 'Canonical Ubuntu' \
-        --shape '$FREE_TIER_AMD_SHAPE' \
-        --sort-by TIMECREATED \
-        --sort-order DESC \
-        --query 'data[].{id:id,name:\"display-name\"}' \
-        --all")
-    
-    ubuntu_image_ocid=$(safe_jq "$x86_images" '.[0].id')
-    local x86_name
-    x86_name=$(safe_jq "$x86_images" '.[0].name')
-    
-    if [ -n "$ubuntu_image_ocid" ] && [ "$ubuntu_image_ocid" != "null" ]; then
-        print_success "  x86 image: $x86_name"
-        print_debug "  x86 OCID: $ubuntu_image_ocid"
-    else
-        print_warning "  No x86 Ubuntu image found - AMD instances disabled"
-        ubuntu_image_ocid=""
+    if [ -z "$dir" ]; then
+        if [ ${#names[@]} -eq 1 ]; then
+            json_schema "${names[0]}" | jq .
+            return 0
+        fi
+        # Several schemas on stdout: one document with each under $defs
+        for name in "${names[@]}"; do
+            json_schema "$name" | jq -c --arg n "$name" '{($n): .}'
+        done | jq -s '{"$schema": "https://json-schema.org/draft/2020-12/schema", "$id": "urn:cloudcradle:schema", "$defs": add}'
+        return 0
     fi
-    
-    # Fetch ARM Ubuntu image
-    print_status "  Looking for ARM Ubuntu image..."
-    local arm_images
-    arm_images=$(oci_cmd "compute image list \
-        --compartment-id $tenancy_ocid \
-        --operating-system 'Canonical Ubuntu' \
-        --shape '$FREE_TIER_ARM_SHAPE' \
-        --sort-by TIMECREATED \
-        --sort-order DESC \
-        --query 'data[].{id:id,name:\"display-name\"}' \
-        --all")
-    
-    ubuntu_arm_flex_image_ocid=$(safe_jq "$arm_images" '.[0].id')
-    local arm_name
-    arm_name=$(safe_jq "$arm_images" '.[0].name')
-    
-    if [ -n "$ubuntu_arm_flex_image_ocid" ] && [ "$ubuntu_arm_flex_image_ocid" != "null" ]; then
-        print_success "  ARM image: $arm_name"
-        print_debug "  ARM OCID: $ubuntu_arm_flex_image_ocid"
-    else
-        print_warning "  No ARM Ubuntu image found - ARM instances disabled"
-        ubuntu_arm_flex_image_ocid=""
+
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would write ${#names[@]} schema(s) to $dir/"
+        return 0
     fi
+    mkdir -p "$dir"
+    for name in "${names[@]}"; do
+        json_schema "$name" | jq . > "$dir/$name.schema.json"
+        print_status "  wrote $dir/$name.schema.json"
+    done
 }
 
-generate_ssh_keys() {
-    print_status "Setting up SSH keys..."
-    
-    local ssh_dir="$PWD/ssh_keys"
-    mkdir -p "$ssh_dir"
-    
-    if [ ! -f "$ssh_dir/id_rsa" ]; then
-        print_status "Generating new SSH key pair..."
-        ssh-keygen -t rsa -b 4096 -f "$ssh_dir/id_rsa" -N "" -q
-        chmod 600 "$ssh_dir/id_rsa"
-        chmod 644 "$ssh_dir/id_rsa.pub"
-        print_success "SSH key pair generated at $ssh_dir/"
-    else
-        print_status "Using existing SSH key pair at $ssh_dir/"
+# Write stdin to a file only if it does not exist yet (init never clobbers user files)
+scaffold_file() {
+    local path="$1"
+    if [ -e "$path" ]; then
+        cat > /dev/null
+        print_status "  kept     $path"
+        return 0
     fi
-    
-    # shellcheck disable=SC2034  # exported for Terraform/template consumption
-    ssh_public_key=$(cat "$ssh_dir/id_rsa.pub")
+    cat > "$path"
+    print_status "  created  $path"
 }
 
-# ============================================================================
-# COMPREHENSIVE RESOURCE INVENTORY
-# ============================================================================
+# .gitignore of a workspace
+workspace_gitignore() {
+    cat << 'GITIGNORE'
+# Terraform state and caches (may contain secrets)
+*.tfstate
+*.tfstate.*
+.terraform/
+tfplan
+*.tfplan
+.tfplan.cache
+.cloudcradle/
+crash.log
 
-inventory_all_resources() {
-    print_header "COMPREHENSIVE RESOURCE INVENTORY"
-    print_status "Scanning all existing OCI resources in tenancy..."
-    print_status "This ensures we never create duplicate resources."
-    echo ""
-    
-    inventory_compute_instances
-    inventory_networking_resources
-    inventory_storage_resources
-    
-    display_resource_inventory
+# Credentials
+ssh_keys/
+backend.tf
+
+# Backups written when regenerating files
+*.bak.*
+
+# Runtime artefacts
+.metrics/
+artifacts/
+.terragrunt-cache/
+terraform-mirror/
+readiness-report.json
+.extra-tf-files
+.capacity-history.jsonl
+upgrade-os-*.log
+resize-*.log
+rebalance.log
+rename-*.log
+
+# user_data of renamed instances (contains the DDNS and Tailscale tokens)
+.pinned-user-data.json
+
+# Backup repository passwords (keep a copy elsewhere)
+.backup-passwords/
+.backup-password
+
+# Autonomous Database ADMIN password and connection wallets
+.adb-admin-password
+wallets/
+GITIGNORE
 }
 
-inventory_compute_instances() {
-    print_status "Inventorying compute instances..."
-    
-    # Get ALL instances (including terminated for awareness)
-    local all_instances
-    all_instances=$(oci_cmd "compute instance list \
-        --compartment-id $tenancy_ocid \
-        --query 'data[?\"lifecycle-state\"!=\`TERMINATED\`].{id:id,name:\"display-name\",state:\"lifecycle-state\",shape:shape,ad:\"availability-domain\",created:\"time-created\"}' \
-        --all" 2>/dev/null) || all_instances="[]"
-    
-    if [ -z "$all_instances" ] || [ "$all_instances" = "null" ]; then
-        all_instances="[]"
-    fi
-    
-    # Clear existing tracking
-    EXISTING_AMD_INSTANCES=()
-    EXISTING_ARM_INSTANCES=()
-    
-    local instance_count
-    instance_count=$(echo "$all_instances" | jq 'length' 2>/dev/null) || instance_count=0
-    
-    if [ "$instance_count" -eq 0 ]; then
-        print_status "  No existing compute instances found"
+# Patterns .gitignore must have, each with a path it has to cover: the private key, state,
+# saved plans, provider caches and the files holding passwords or tokens
+readonly GITIGNORE_REQUIRED="ssh_keys/:ssh_keys/id_rsa *.tfstate:terraform.tfstate *.tfstate.*:terraform.tfstate.backup
+tfplan:tfplan .terraform/:.terraform/providers backend.tf:backend.tf .backup-password:.backup-password
+.backup-passwords/:.backup-passwords/amd-1 .adb-admin-password:.adb-admin-password .pinned-user-data.json:.pinned-user-data.json"
+
+# Create .gitignore when generating files, or append what an existing one is missing
+ensure_gitignore() {
+    [ "$GIT_HYGIENE" = "true" ] || return 0
+
+    if [ ! -f .gitignore ]; then
+        if [ "$DRY_RUN" = "true" ]; then
+            print_status "[dry-run] Would create .gitignore"
+        else
+            workspace_gitignore > .gitignore
+            print_status "Created .gitignore (ssh_keys/, state, plans, .terraform/, password files)"
+        fi
         return 0
     fi
-    
-    # Parse each instance
-    while IFS= read -r instance; do
-        local id name state shape
-        id=$(safe_jq "$instance" '.id')
-        name=$(safe_jq "$instance" '.name')
-        state=$(safe_jq "$instance" '.state')
-        shape=$(safe_jq "$instance" '.shape')
-        
-        if [ -z "$id" ] || [ "$id" = "null" ]; then
-            continue
-        fi
-        
-        # Get VNIC information for IP addresses
-        local vnic_attachments public_ip private_ip
-        vnic_attachments=$(oci_cmd "compute vnic-attachment list \
-            --compartment-id $tenancy_ocid \
-            --instance-id $id \
-            --query 'data[?\"lifecycle-state\"==\`ATTACHED\`]'" 2>/dev/null) || vnic_attachments="[]"
-        
-        if [ -n "$vnic_attachments" ] && [ "$vnic_attachments" != "[]" ] && [ "$vnic_attachments" != "null" ]; then
-            local vnic_id
-            vnic_id=$(safe_jq "$vnic_attachments" '.[0]."vnic-id"')
-            
-            if [ -n "$vnic_id" ] && [ "$vnic_id" != "null" ]; then
-                local vnic_details
-                vnic_details=$(oci_cmd "network vnic get --vnic-id $vnic_id" 2>/dev/null)
-                public_ip=$(safe_jq "$vnic_details" '.data."public-ip"' "none")
-                private_ip=$(safe_jq "$vnic_details" '.data."private-ip"' "none")
-            fi
-        fi
-        
-        # Categorize by shape
-        if [ "$shape" = "$FREE_TIER_AMD_SHAPE" ]; then
-            EXISTING_AMD_INSTANCES["$id"]="$name|$state|$shape|${public_ip:-none}|${private_ip:-none}"
-            print_status "  Found AMD instance: $name ($state) - IP: ${public_ip:-none}"
-        elif [ "$shape" = "$FREE_TIER_ARM_SHAPE" ]; then
-            # Get shape config for ARM instances
-            local instance_details ocpus memory
-            instance_details=$(oci_cmd "compute instance get --instance-id $id" 2>/dev/null)
-            ocpus=$(safe_jq "$instance_details" '.data."shape-config".ocpus' "0")
-            memory=$(safe_jq "$instance_details" '.data."shape-config"."memory-in-gbs"' "0")
-            
-            EXISTING_ARM_INSTANCES["$id"]="$name|$state|$shape|${public_ip:-none}|${private_ip:-none}|$ocpus|$memory"
-            print_status "  Found ARM instance: $name ($state, ${ocpus}OCPUs, ${memory}GB) - IP: ${public_ip:-none}"
+
+    local entry pattern probe use_git=false
+    local -a missing=()
+    command_exists git && git rev-parse --is-inside-work-tree >/dev/null 2>&1 && use_git=true
+    for entry in $GITIGNORE_REQUIRED; do
+        pattern="${entry%%:*}" probe="${entry#*:}"
+        if [ "$use_git" = "true" ]; then
+            git check-ignore -q --no-index "$probe" 2>/dev/null && continue
         else
-            print_debug "  Found non-free-tier instance: $name ($shape)"
+            grep -qxF -e "$pattern" -e "/$pattern" -e "${pattern%/}" .gitignore && continue
         fi
-    done <<< "$(echo "$all_instances" | jq -c '.[]' 2>/dev/null)"
-    
-    print_status "  AMD instances: ${#EXISTING_AMD_INSTANCES[@]}/${FREE_TIER_MAX_AMD_INSTANCES}"
-    print_status "  ARM instances: ${#EXISTING_ARM_INSTANCES[@]}/${FREE_TIER_MAX_ARM_INSTANCES}"
-}
+        missing+=("$pattern")
+    done
+    [ ${#missing[@]} -gt 0 ] || return 0
 
-inventory_networking_resources() {
-    print_status "Inventorying networking resources..."
-    
-    # Clear existing tracking
-    EXISTING_VCNS=()
-    EXISTING_SUBNETS=()
-    EXISTING_INTERNET_GATEWAYS=()
-    EXISTING_ROUTE_TABLES=()
-    EXISTING_SECURITY_LISTS=()
-    
-    # Get VCNs
-    local vcn_list
-    vcn_list=$(oci_cmd "network vcn list \
-        --compartment-id $tenancy_ocid \
-        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",cidr:\"cidr-block\"}' \
-        --all" 2>/dev/null) || vcn_list="[]"
-    
-    if [ -z "$vcn_list" ] || [ "$vcn_list" = "null" ]; then
-        vcn_list="[]"
+    if [ "$DRY_RUN" = "true" ]; then
+        print_status "[dry-run] Would add to .gitignore: ${missing[*]}"
+        return 0
     fi
-    
-    while IFS= read -r vcn; do
-        local vcn_id vcn_name vcn_cidr
-        vcn_id=$(safe_jq "$vcn" '.id')
-        vcn_name=$(safe_jq "$vcn" '.name')
-        vcn_cidr=$(safe_jq "$vcn" '.cidr')
-        
-        if [ -z "$vcn_id" ] || [ "$vcn_id" = "null" ]; then
-            continue
+    {
+        echo ""
+        echo "# Added by $(basename "$0"): secrets and Terraform state"
+        printf '%s\n' "${missing[@]}"
+    } >> .gitignore
+    print_status "Added to .gitignore: ${missing[*]}"
+}
+
+# Warn before apply when git tracks the private key, state, plans or password files.
+# .gitignore does not untrack a file that was already committed.
+check_git_hygiene() {
+    [ "$GIT_HYGIENE" = "true" ] || return 0
+    command_exists git && git rev-parse --is-inside-work-tree >/dev/null 2>&1 || return 0
+
+    local tracked
+    tracked=$(git ls-files -- ssh_keys '*.tfstate' '*.tfstate.*' tfplan '*.tfplan' backend.tf \
+        "$BACKUP_PASSWORD_FILE" "$BACKUP_PASSWORDS_DIR" "$ADB_ADMIN_PASSWORD_FILE" "$PINNED_USER_DATA_FILE" 2>/dev/null) || tracked=""
+    [ -n "$tracked" ] || return 0
+
+    print_warning "git tracks files with secrets in $(git rev-parse --show-toplevel):"
+    sed 's/^/  /' <<< "$tracked"
+    print_warning "Untrack them (they stay on disk) and commit:"
+    echo "  git rm -r --cached -- $(paste -sd' ' <<< "$tracked")"
+    print_warning "Earlier commits still contain them: rotate the SSH key and tokens or rewrite the history"
+}
+
+# init [DIR]: scaffold a project directory with config skeletons, .gitignore and a
+# pre-commit hook running `validate`
+scaffold_workspace() {
+    local dir="${1:-.}"
+    local script
+    script="$(cd "$(dirname "$0")" && pwd)/$(basename "$0")"
+
+    print_header "INITIALISING WORKSPACE: $dir"
+    mkdir -p "$dir/$EXTRA_TF_DIR" "$dir/ssh_keys"
+    chmod 700 "$dir/ssh_keys"
+    (
+        cd "$dir" || exit 1
+
+        workspace_gitignore | scaffold_file .gitignore
+
+        scaffold_file "$FIREWALL_RULES_FILE" <<'FIREWALL'
+# <ingress|egress> <tcp|udp|icmp|all> <ports|icmp-type|-> <cidr[,cidr...]> [description]
+ingress tcp  22      0.0.0.0/0,::/0  SSH
+ingress tcp  80,443  0.0.0.0/0,::/0  HTTP/HTTPS
+ingress icmp -       0.0.0.0/0,::/0  ICMP
+egress  all  -       0.0.0.0/0,::/0  All outbound
+FIREWALL
+
+        scaffold_file "$SUBNETS_FILE" <<'SUBNETS'
+# <name> <cidr> <public|private> [hostname,...]   (private needs NETWORK_TOPOLOGY=two-tier)
+# web 10.0.3.0/24 public arm-1
+SUBNETS
+
+        scaffold_file "$CLOUD_INIT_FILE" <<'CLOUDINIT'
+# timezone <zone> | package <name...> | var <name> <value> | runcmd <command>
+# | file <path> <mode> <local template>   (${hostname} and ${vars.<name>} are rendered per instance)
+# timezone Europe/Berlin
+# package docker.io
+# var domain example.com
+# runcmd echo "${hostname}.${vars.domain}" > /etc/cloudcradle/fqdn
+CLOUDINIT
+
+        scaffold_file "$INSTANCE_LABELS_FILE" <<'LABELS'
+# <hostname> key=value ...   (applied as freeform tags, usable as --selector)
+# arm-1 role=web env=prod
+LABELS
+
+        scaffold_file "$READINESS_CHECKS_FILE" <<'CHECKS'
+# <target> <tcp|http|ssh> <argument>   target: hostname, amd, arm, * or a selector
+*  tcp  22
+CHECKS
+
+        scaffold_file "$BACKUP_SPEC_FILE" <<'BACKUPS'
+# <target> <schedule> <path...>   schedule: systemd OnCalendar, "_" for spaces
+# role=db  daily           /var/lib/postgresql/backups
+# arm-1    Mon..Fri_02:30  /srv /etc/myapp
+BACKUPS
+
+        scaffold_file "$PROVISIONERS_FILE" <<'PROVISIONERS'
+# <target> <module...>   modules: docker k3s tailscale wireguard caddy traefik node_exporter
+# *       node_exporter
+# role=web docker caddy
+PROVISIONERS
+
+        scaffold_file "$SITES_FILE" <<'SITES'
+# <target> <domain> <upstream>   served with automatic HTTPS by REVERSE_PROXY (caddy | traefik)
+# arm-1  app.example.com   localhost:8080
+# arm-1  grafana.example.com  localhost:3000
+SITES
+
+        scaffold_file "$SECRETS_FILE" <<'SECRETS'
+# <target> <name> <path> [mode]   values: setup_oci_terraform.sh secrets set NAME
+# role=web  stripe-api-key  /etc/myapp/stripe.key  0640
+SECRETS
+
+        scaffold_file "$USERS_FILE" <<'USERS'
+# <name> <sudo|nosudo> <shell|-> <key-source...>   sources: github:<handle>, gitlab:<handle>, key file
+# alice  sudo    -         github:alice
+# bob    nosudo  /bin/zsh  keys/bob.pub gitlab:bob
+USERS
+
+        scaffold_file "$HARDENING_FILE" <<'HARDENING'
+# <target> <minimal|standard|strict>   overrides HARDENING_PROFILE; the last matching line wins
+# role=web  strict
+# arm-1     minimal
+HARDENING
+
+        scaffold_file "$EXTRA_TF_DIR/README.md" <<'EXTRA'
+Terraform files in this directory are copied into the workspace verbatim on every run
+and are never overwritten by the generator.
+EXTRA
+
+        if command_exists git && [ ! -d .git ]; then
+            git init -q && print_status "  created  .git/"
         fi
-        
-        EXISTING_VCNS["$vcn_id"]="$vcn_name|$vcn_cidr"
-        print_status "  Found VCN: $vcn_name ($vcn_cidr)"
-        
-        # Get subnets for this VCN
-        local subnet_list
-        subnet_list=$(oci_cmd "network subnet list \
-            --compartment-id $tenancy_ocid \
-            --vcn-id $vcn_id \
-            --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",cidr:\"cidr-block\"}'" 2>/dev/null) || subnet_list="[]"
-        
-        while IFS= read -r subnet; do
-            local subnet_id subnet_name subnet_cidr
-            subnet_id=$(safe_jq "$subnet" '.id')
-            subnet_name=$(safe_jq "$subnet" '.name')
-            subnet_cidr=$(safe_jq "$subnet" '.cidr')
-            
-            if [ -n "$subnet_id" ] && [ "$subnet_id" != "null" ]; then
-                EXISTING_SUBNETS["$subnet_id"]="$subnet_name|$subnet_cidr|$vcn_id"
-                print_debug "    Subnet: $subnet_name ($subnet_cidr)"
-            fi
-        done <<< "$(echo "$subnet_list" | jq -c '.[]' 2>/dev/null)"
-        
-        # Get internet gateways
-        local ig_list
-        ig_list=$(oci_cmd "network internet-gateway list \
-            --compartment-id $tenancy_ocid \
-            --vcn-id $vcn_id \
-            --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\"}'" 2>/dev/null) || ig_list="[]"
-        
-        while IFS= read -r ig; do
-            local ig_id ig_name
-            ig_id=$(safe_jq "$ig" '.id')
-            ig_name=$(safe_jq "$ig" '.name')
-            
-            if [ -n "$ig_id" ] && [ "$ig_id" != "null" ]; then
-                EXISTING_INTERNET_GATEWAYS["$ig_id"]="$ig_name|$vcn_id"
-            fi
-        done <<< "$(echo "$ig_list" | jq -c '.[]' 2>/dev/null)"
-        
-        # Get route tables
-        local rt_list
-        rt_list=$(oci_cmd "network route-table list \
-            --compartment-id $tenancy_ocid \
-            --vcn-id $vcn_id \
-            --query 'data[].{id:id,name:\"display-name\"}'" 2>/dev/null) || rt_list="[]"
-        
-        while IFS= read -r rt; do
-            local rt_id rt_name
-            rt_id=$(safe_jq "$rt" '.id')
-            rt_name=$(safe_jq "$rt" '.name')
-            
-            if [ -n "$rt_id" ] && [ "$rt_id" != "null" ]; then
-                EXISTING_ROUTE_TABLES["$rt_id"]="$rt_name|$vcn_id"
-            fi
-        done <<< "$(echo "$rt_list" | jq -c '.[]' 2>/dev/null)"
-        
-        # Get security lists
-        local sl_list
-        sl_list=$(oci_cmd "network security-list list \
-            --compartment-id $tenancy_ocid \
-            --vcn-id $vcn_id \
-            --query 'data[].{id:id,name:\"display-name\"}'" 2>/dev/null) || sl_list="[]"
-        
-        while IFS= read -r sl; do
-            local sl_id sl_name
-            sl_id=$(safe_jq "$sl" '.id')
-            sl_name=$(safe_jq "$sl" '.name')
-            
-            if [ -n "$sl_id" ] && [ "$sl_id" != "null" ]; then
-                EXISTING_SECURITY_LISTS["$sl_id"]="$sl_name|$vcn_id"
-            fi
-        done <<< "$(echo "$sl_list" | jq -c '.[]' 2>/dev/null)"
-        
-    done <<< "$(echo "$vcn_list" | jq -c '.[]' 2>/dev/null)"
-    
-    print_status "  VCNs: ${#EXISTING_VCNS[@]}/${FREE_TIER_MAX_VCNS}"
-    print_status "  Subnets: ${#EXISTING_SUBNETS[@]}"
-    print_status "  Internet Gateways: ${#EXISTING_INTERNET_GATEWAYS[@]}"
+        if [ -d .git ]; then
+            mkdir -p .git/hooks
+            scaffold_file .git/hooks/pre-commit <<HOOK
+#!/usr/bin/env bash
+# Reject commits with invalid CloudCradle configuration
+exec "$script" validate
+HOOK
+            chmod +x .git/hooks/pre-commit
+        fi
+    )
+
+    echo ""
+    print_success "Workspace ready. Next: cd $dir && $script"
+}
+
+# ============================================================================
+# TENANCY WORKSPACES
+# ============================================================================
+#
+# A tenancy workspace is an ordinary workspace with a .tenancy file naming its OCI CLI
+# profile. TENANCIES_DIR/<name> is the workspace itself, or a symlink to an existing one
+# registered with `tenancy add NAME --dir DIR`. TENANCIES_DIR/.current holds the default.
+
+# Value of KEY in a .tenancy file
+tenancy_value() {
+    local file="$1" key="$2"
+    [ -f "$file" ] || return 0
+    sed -n "s/^$key=//p" "$file" | tail -1
 }
 
-inventory_storage_resources() {
-    print_status "Inventorying storage resources..."
-    
-    EXISTING_BOOT_VOLUMES=()
-    EXISTING_BLOCK_VOLUMES=()
-    
-    # Get boot volumes
-    local boot_list
-    boot_list=$(oci_cmd "bv boot-volume list \
-        --compartment-id $tenancy_ocid \
-        --availability-domain $availability_domain \
-        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",size:\"size-in-gbs\"}' \
-        --all" 2>/dev/null) || boot_list="[]"
-    
-    local total_boot_gb=0
-    
-    while IFS= read -r boot; do
-        local boot_id boot_name boot_size
-        boot_id=$(safe_jq "$boot" '.id')
-        boot_name=$(safe_jq "$boot" '.name')
-        boot_size=$(safe_jq "$boot" '.size' "0")
-        
-        if [ -n "$boot_id" ] && [ "$boot_id" != "null" ]; then
-            EXISTING_BOOT_VOLUMES["$boot_id"]="$boot_name|$boot_size"
-            total_boot_gb=$((total_boot_gb + boot_size))
+# Name of the `tenancy switch` default, empty when none
+current_tenancy() {
+    if [ -f "$TENANCIES_DIR/.current" ]; then
+        head -1 "$TENANCIES_DIR/.current"
+    fi
+}
+
+# Registered name of a workspace directory (symlinks resolved), else its basename
+tenancy_name_of() {
+    local dir target entry
+    target=$(cd "$1" && pwd -P)
+    for entry in "$TENANCIES_DIR"/*/; do
+        dir=$(cd "$entry" 2>/dev/null && pwd -P) || continue
+        if [ "$dir" = "$target" ]; then
+            basename "$entry"
+            return 0
         fi
-    done <<< "$(echo "$boot_list" | jq -c '.[]' 2>/dev/null)"
-    
-    # Get block volumes
-    local block_list
-    block_list=$(oci_cmd "bv volume list \
-        --compartment-id $tenancy_ocid \
-        --availability-domain $availability_domain \
-        --query 'data[?\"lifecycle-state\"==\`AVAILABLE\`].{id:id,name:\"display-name\",size:\"size-in-gbs\"}' \
-        --all" 2>/dev/null) || block_list="[]"
-    
-    local total_block_gb=0
-    
-    while IFS= read -r block; do
-        local block_id block_name block_size
-        block_id=$(safe_jq "$block" '.id')
-        block_name=$(safe_jq "$block" '.name')
-        block_size=$(safe_jq "$block" '.size' "0")
-        
-        if [ -n "$block_id" ] && [ "$block_id" != "null" ]; then
-            EXISTING_BLOCK_VOLUMES["$block_id"]="$block_name|$block_size"
-            total_block_gb=$((total_block_gb + block_size))
+    done
+    basename "$target"
+}
+
+# True when the current directory is a workspace of its own (with or without .tenancy)
+is_workspace_dir() {
+    [ -f "$TENANCY_FILE" ] || [ -f variables.tf ] || [ -f terraform.tfstate ] || [ -f backend.tf ]
+}
+
+# Bind this run to a tenancy: --tenancy/CLOUDCRADLE_TENANCY, else the current directory
+# when it is a workspace, else the `tenancy switch` default. Changes into the workspace
+# and uses the profile from its .tenancy file; without any of these nothing changes.
+enter_tenancy() {
+    local name="$CLOUDCRADLE_TENANCY" dir=""
+    if [ -z "$name" ]; then
+        if [ -f "$TENANCY_FILE" ]; then
+            dir="$PWD"
+        elif ! is_workspace_dir; then
+            name=$(current_tenancy)
         fi
-    done <<< "$(echo "$block_list" | jq -c '.[]' 2>/dev/null)"
-    
-    local total_storage=$((total_boot_gb + total_block_gb))
-    
-    print_status "  Boot volumes: ${#EXISTING_BOOT_VOLUMES[@]} (${total_boot_gb}GB)"
-    print_status "  Block volumes: ${#EXISTING_BLOCK_VOLUMES[@]} (${total_block_gb}GB)"
-    print_status "  Total storage: ${total_storage}GB/${FREE_TIER_MAX_STORAGE_GB}GB"
+    fi
+    if [ -n "$name" ]; then
+        dir="$TENANCIES_DIR/$name"
+        if [ ! -f "$dir/$TENANCY_FILE" ]; then
+            print_error "Unknown tenancy '$name' (see: $0 tenancy list)"
+            return 1
+        fi
+    fi
+    [ -n "$dir" ] || return 0
+
+    # Keep using the OCI CLI virtualenv of the directory the script was started from
+    # shellcheck disable=SC1091
+    if [ -f ".venv/bin/activate" ] && [ ! -f "$dir/.venv/bin/activate" ]; then
+        source .venv/bin/activate
+    fi
+    cd "$dir" || return 1
+
+    local profile
+    profile=$(tenancy_value "$TENANCY_FILE" profile)
+    if [ -n "$profile" ] && [ "$OCI_PROFILE_FLAG" != "true" ]; then
+        OCI_PROFILE="$profile"
+        OCI_PROFILE_PINNED=true
+    fi
+    CLOUDCRADLE_TENANCY="${name:-$(tenancy_name_of .)}"
+    print_status "Tenancy: $CLOUDCRADLE_TENANCY (profile $OCI_PROFILE, $PWD)" >&2
 }
 
-display_resource_inventory() {
-    echo ""
-    print_header "RESOURCE INVENTORY SUMMARY"
-    
-    # Calculate totals
-    local total_amd=${#EXISTING_AMD_INSTANCES[@]}
-    local total_arm=${#EXISTING_ARM_INSTANCES[@]}
-    local total_arm_ocpus=0
-    local total_arm_memory=0
-    
-    for instance_data in "${EXISTING_ARM_INSTANCES[@]}"; do
-        local ocpus memory
-        ocpus=$(echo "$instance_data" | cut -d'|' -f6)
-        memory=$(echo "$instance_data" | cut -d'|' -f7)
-        total_arm_ocpus=$((total_arm_ocpus + ocpus))
-        total_arm_memory=$((total_arm_memory + memory))
-    done
-    
-    local total_boot_gb=0
-    for boot_data in "${EXISTING_BOOT_VOLUMES[@]}"; do
-        local size
-        size=$(echo "$boot_data" | cut -d'|' -f2)
-        total_boot_gb=$((total_boot_gb + size))
+# Number of instances in a workspace's local state, "-" without one (or with a remote backend)
+tenancy_instance_count() {
+    local dir="$1"
+    if [ ! -f "$dir/terraform.tfstate" ] || [ -f "$dir/backend.tf" ]; then
+        echo "-"
+        return 0
+    fi
+    jq -r '[.resources[]? | select(.mode == "managed" and .type == "oci_core_instance") | .instances | length] | add // 0' \
+        "$dir/terraform.tfstate" 2>/dev/null || echo "-"
+}
+
+tenancy_list() {
+    local current dir name profile region marker found=false
+    current=$(current_tenancy)
+    print_subheader "Tenancies ($TENANCIES_DIR)"
+    printf '  %-20s %-16s %-16s %-10s %s\n' "NAME" "PROFILE" "REGION" "INSTANCES" "DIRECTORY"
+    for dir in "$TENANCIES_DIR"/*/; do
+        dir="${dir%/}"
+        [ -f "$dir/$TENANCY_FILE" ] || continue
+        found=true
+        name=$(basename "$dir")
+        profile=$(tenancy_value "$dir/$TENANCY_FILE" profile)
+        region=$(read_oci_config_value region "$OCI_CONFIG_FILE" "${profile:-DEFAULT}" 2>/dev/null || true)
+        marker=" "
+        [ "$name" = "$current" ] && marker="*"
+        printf '%s %-20s %-16s %-16s %-10s %s\n' "$marker" "$name" "${profile:-DEFAULT}" "${region:--}" \
+            "$(tenancy_instance_count "$dir")" "$(cd "$dir" && pwd -P)"
     done
-    
-    local total_block_gb=0
-    for block_data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
-        local size
-        size=$(echo "$block_data" | cut -d'|' -f2)
-        total_block_gb=$((total_block_gb + size))
+    if [ "$found" != "true" ]; then
+        print_status "No tenancies yet - add one with: $0 tenancy add NAME [--profile PROFILE] [--dir DIR]"
+    elif [ -z "$current" ]; then
+        print_status "No default tenancy; runs outside a workspace need --tenancy NAME (or: tenancy switch NAME)"
+    fi
+}
+
+# tenancy add NAME [--profile PROFILE] [--dir DIR]: a new workspace under TENANCIES_DIR,
+# or an existing workspace DIR registered under NAME
+tenancy_add() {
+    local name="${1:-}" profile="$OCI_PROFILE" existing=""
+    shift || true
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --profile) profile="${2:-}"; shift 2 || true ;;
+            --dir) existing="${2:-}"; shift 2 || true ;;
+            *) print_error "Unknown option: $1"; return 2 ;;
+        esac
     done
-    
-    local total_storage=$((total_boot_gb + total_block_gb))
-    
-    echo -e "${BOLD}Compute Resources:${NC}"
-    echo "  ┌─────────────────────────────────────────────────────────────┐"
-    echo "  │ AMD Micro Instances:  $total_amd / $FREE_TIER_MAX_AMD_INSTANCES (Free Tier limit)          │"
-    echo "  │ ARM A1 Instances:     $total_arm / $FREE_TIER_MAX_ARM_INSTANCES (up to)                    │"
-    echo "  │ ARM OCPUs Used:       $total_arm_ocpus / $FREE_TIER_MAX_ARM_OCPUS                           │"
-    echo "  │ ARM Memory Used:      ${total_arm_memory}GB / ${FREE_TIER_MAX_ARM_MEMORY_GB}GB                         │"
-    echo "  └─────────────────────────────────────────────────────────────┘"
-    echo ""
-    echo -e "${BOLD}Storage Resources:${NC}"
-    echo "  ┌─────────────────────────────────────────────────────────────┐"
-    echo "  │ Boot Volumes:         ${total_boot_gb}GB                                    │"
-    echo "  │ Block Volumes:        ${total_block_gb}GB                                    │"
-    printf "  │ Total Storage:        %3dGB / %3dGB Free Tier limit          │\n" "$total_storage" "$FREE_TIER_MAX_STORAGE_GB"
-    echo "  └─────────────────────────────────────────────────────────────┘"
-    echo ""
-    echo -e "${BOLD}Networking Resources:${NC}"
-    echo "  ┌─────────────────────────────────────────────────────────────┐"
-    echo "  │ VCNs:                 ${#EXISTING_VCNS[@]} / $FREE_TIER_MAX_VCNS (Free Tier limit)             │"
-    echo "  │ Subnets:              ${#EXISTING_SUBNETS[@]}                                       │"
-    echo "  │ Internet Gateways:    ${#EXISTING_INTERNET_GATEWAYS[@]}                                       │"
-    echo "  └─────────────────────────────────────────────────────────────┘"
-    echo ""
-    
-    # Warnings for near-limit resources
-    if [ "$total_amd" -ge "$FREE_TIER_MAX_AMD_INSTANCES" ]; then
-        print_warning "AMD instance limit reached - cannot create more AMD instances"
+    if [[ ! "$name" =~ ^[A-Za-z0-9][A-Za-z0-9_.-]*$ ]]; then
+        print_error "Usage: tenancy add NAME [--profile PROFILE] [--dir DIR] (NAME: letters, digits, . _ -)"
+        return 2
     fi
-    if [ "$total_arm_ocpus" -ge "$FREE_TIER_MAX_ARM_OCPUS" ]; then
-        print_warning "ARM OCPU limit reached - cannot allocate more ARM OCPUs"
+    if [ -z "$profile" ]; then
+        print_error "--profile requires a profile name"
+        return 2
     fi
-    if [ "$total_arm_memory" -ge "$FREE_TIER_MAX_ARM_MEMORY_GB" ]; then
-        print_warning "ARM memory limit reached - cannot allocate more ARM memory"
+    local dir="$TENANCIES_DIR/$name"
+    if [ -e "$dir" ] || [ -L "$dir" ]; then
+        print_error "Tenancy '$name' already exists: $dir"
+        return 1
     fi
-    if [ "$total_storage" -ge "$FREE_TIER_MAX_STORAGE_GB" ]; then
-        print_warning "Storage limit reached - cannot create more volumes"
+    if [ -f "$OCI_CONFIG_FILE" ] && ! grep -q "^\[$profile\]" "$OCI_CONFIG_FILE"; then
+        print_warning "Profile [$profile] is not in $OCI_CONFIG_FILE yet; the first run authenticates it"
     fi
-    if [ "${#EXISTING_VCNS[@]}" -ge "$FREE_TIER_MAX_VCNS" ]; then
-        print_warning "VCN limit reached - cannot create more VCNs"
+
+    mkdir -p "$TENANCIES_DIR"
+    if [ -n "$existing" ]; then
+        if [ ! -d "$existing" ]; then
+            print_error "Not a directory: $existing"
+            return 1
+        fi
+        if [ -f "$existing/$TENANCY_FILE" ]; then
+            print_error "$existing already belongs to a tenancy (profile $(tenancy_value "$existing/$TENANCY_FILE" profile))"
+            return 1
+        fi
+        ln -s "$(cd "$existing" && pwd -P)" "$dir"
+    else
+        scaffold_workspace "$dir"
+    fi
+    {
+        echo "# CloudCradle tenancy workspace: the OCI CLI profile used for this directory"
+        echo "profile=$profile"
+    } > "$dir/$TENANCY_FILE"
+    print_success "Added tenancy '$name' (profile $profile): $(cd "$dir" && pwd -P)"
+    print_status "Use it with: $0 --tenancy $name   or make it the default: $0 tenancy switch $name"
+}
+
+# tenancy switch NAME|none
+tenancy_switch() {
+    local name="${1:-}"
+    if [ -z "$name" ]; then
+        print_error "Usage: tenancy switch NAME|none"
+        return 2
+    fi
+    if [ "$name" = "none" ]; then
+        rm -f "$TENANCIES_DIR/.current"
+        print_success "No default tenancy; the current directory is used again"
+        return 0
+    fi
+    if [ ! -f "$TENANCIES_DIR/$name/$TENANCY_FILE" ]; then
+        print_error "Unknown tenancy '$name' (see: $0 tenancy list)"
+        return 1
+    fi
+    echo "$name" > "$TENANCIES_DIR/.current"
+    print_success "Default tenancy: $name (profile $(tenancy_value "$TENANCIES_DIR/$name/$TENANCY_FILE" profile))"
+}
+
+tenancy_current() {
+    local name
+    name=$(current_tenancy)
+    if [ -f "$TENANCY_FILE" ]; then
+        echo "$(tenancy_name_of .) (this directory, profile $(tenancy_value "$TENANCY_FILE" profile))"
+    elif is_workspace_dir; then
+        echo "none (this directory, profile $OCI_PROFILE)"
+    elif [ -n "$name" ]; then
+        echo "$name ($TENANCIES_DIR/$name)"
+    else
+        echo "none"
     fi
 }
 
 # ============================================================================
-# FREE TIER LIMIT VALIDATION
+# TERRAGRUNT EXPORT
 # ============================================================================
+#
+# The generated configuration as a Terragrunt unit: DIR/terragrunt.hcl and the Terraform
+# files as a module in DIR/modules/cloudcradle. Each local of variables.tf whose value is
+# a plain literal becomes a module variable set from the unit's inputs; expressions stay
+# locals (so are literals with interpolation). Provider and backend come from generate blocks.
 
-calculate_available_resources() {
-    # Calculate what's still available within Free Tier limits
-    local used_amd=${#EXISTING_AMD_INSTANCES[@]}
-    local used_arm_ocpus=0
-    local used_arm_memory=0
-    local used_storage=0
-    
-    for instance_data in "${EXISTING_ARM_INSTANCES[@]}"; do
-        local ocpus memory
-        ocpus=$(echo "$instance_data" | cut -d'|' -f6)
-        memory=$(echo "$instance_data" | cut -d'|' -f7)
-        used_arm_ocpus=$((used_arm_ocpus + ocpus))
-        used_arm_memory=$((used_arm_memory + memory))
-    done
-    
-    for boot_data in "${EXISTING_BOOT_VOLUMES[@]}"; do
-        local size
-        size=$(echo "$boot_data" | cut -d'|' -f2)
-        used_storage=$((used_storage + size))
-    done
-    
-    for block_data in "${EXISTING_BLOCK_VOLUMES[@]}"; do
-        local size
-        size=$(echo "$block_data" | cut -d'|' -f2)
-        used_storage=$((used_storage + size))
-    done
-    
-    # Export available resources
-    export AVAILABLE_AMD_INSTANCES=$((FREE_TIER_MAX_AMD_INSTANCES - used_amd))
-    export AVAILABLE_ARM_OCPUS=$((FREE_TIER_MAX_ARM_OCPUS - used_arm_ocpus))
-    export AVAILABLE_ARM_MEMORY=$((FREE_TIER_MAX_ARM_MEMORY_GB - used_arm_memory))
-    export AVAILABLE_STORAGE=$((FREE_TIER_MAX_STORAGE_GB - used_storage))
-    export USED_ARM_INSTANCES=${#EXISTING_ARM_INSTANCES[@]}
-    
-    print_debug "Available: AMD=$AVAILABLE_AMD_INSTANCES, ARM_OCPU=$AVAILABLE_ARM_OCPUS, ARM_MEM=$AVAILABLE_ARM_MEMORY, Storage=$AVAILABLE_STORAGE"
+# "name<TAB>value" for each entry of the first locals block of FILE (line breaks as \x1f)
+terraform_locals_entries() {
+    awk '
+        function depth(s,  opened) { opened = gsub(/[[{(]/, "", s); return opened - gsub(/[]})]/, "", s) }
+        function emit() { printf "%s\t%s\n", name, value; name = "" }
+        state == 0 && /^locals \{/ { state = 1; next }
+        state != 1 { next }
+        name != "" { value = value "\x1f" $0; level += depth($0); if (level <= 0) emit(); next }
+        /^\}/ { state = 2; next }
+        match($0, /^  [A-Za-z0-9_]+[[:space:]]*=/) {
+            name = substr($0, 3, RLENGTH - 3); sub(/[[:space:]]+$/, "", name)
+            value = substr($0, RLENGTH + 1); sub(/^[[:space:]]+/, "", value)
+            level = depth(value)
+            if (level <= 0) emit()
+        }
+    ' "$1"
 }
 
-validate_proposed_config() {
-    local proposed_amd=$1
-    # shellcheck disable=SC2034  # keep argument for future checks
-    local proposed_arm=$2
-    local proposed_arm_ocpus=$3
-    local proposed_arm_memory=$4
-    local proposed_storage=$5
-    
-    local errors=0
-    
-    if [ "$proposed_amd" -gt "$AVAILABLE_AMD_INSTANCES" ]; then
-        print_error "Cannot create $proposed_amd AMD instances - only $AVAILABLE_AMD_INSTANCES available"
-        errors=$((errors + 1))
+# FILE's locals with the NAMES entries replaced by var.<name>
+terraform_locals_to_vars() {
+    awk -v names=" $2 " '
+        function depth(s,  opened) { opened = gsub(/[[{(]/, "", s); return opened - gsub(/[]})]/, "", s) }
+        state == 0 && /^locals \{/ { state = 1; print; next }
+        state != 1 { print; next }
+        skip { level += depth($0); if (level <= 0) skip = 0; next }
+        /^\}/ { state = 2; print; next }
+        match($0, /^  [A-Za-z0-9_]+[[:space:]]*=/) {
+            name = substr($0, 3, RLENGTH - 3); sub(/[[:space:]]+$/, "", name)
+            if (index(names, " " name " ")) {
+                print "  " name " = var." name
+                level = depth(substr($0, RLENGTH + 1))
+                skip = level > 0
+                next
+            }
+        }
+        { print }
+    ' "$1"
+}
+
+# Escape Terragrunt interpolation in text embedded in a heredoc
+terragrunt_escape() {
+    sed 's/\$[{]/$${/g; s/%[{]/%%{/g'
+}
+
+# export terragrunt [--dir DIR]
+export_terragrunt() {
+    local dir="$TERRAGRUNT_DIR"
+    if [ "${1:-}" = "--dir" ]; then
+        dir="${2:-}"
+        [ -n "$dir" ] || { print_error "--dir requires a directory"; return 2; }
     fi
-    
-    if [ "$proposed_arm_ocpus" -gt "$AVAILABLE_ARM_OCPUS" ]; then
-        print_error "Cannot allocate $proposed_arm_ocpus ARM OCPUs - only $AVAILABLE_ARM_OCPUS available"
-        errors=$((errors + 1))
+    if [ ! -f variables.tf ] || [ ! -f main.tf ]; then
+        print_error "No generated Terraform files here - run the setup first"
+        return 1
     fi
-    
-    if [ "$proposed_arm_memory" -gt "$AVAILABLE_ARM_MEMORY" ]; then
-        print_error "Cannot allocate ${proposed_arm_memory}GB ARM memory - only ${AVAILABLE_ARM_MEMORY}GB available"
-        errors=$((errors + 1))
+
+    local module="$dir/modules/cloudcradle" name value literal="" file
+    local -a inputs=()
+    while IFS=$'\t' read -r name value; do
+        value="${value//$'\x1f'/$'\n'}"
+        if [ "$name" = "ssh_pubkey_data" ] && [ -f ssh_keys/id_rsa.pub ]; then
+            value=$(jq -Rs . < ssh_keys/id_rsa.pub)
+        elif [[ "$value" == *'${'* || "$value" == *'%{'* ]] || ! jq . <<< "$value" >/dev/null 2>&1; then
+            continue
+        fi
+        literal+=" $name"
+        inputs+=("  $name = $value")
+    done < <(terraform_locals_entries variables.tf)
+
+    print_status "Exporting the Terraform files as a Terragrunt unit in $dir/..."
+    rm -rf "$module"
+    mkdir -p "$module"
+    for file in *.tf; do
+        case "$file" in
+            provider.tf|backend.tf|variables.tf) ;;
+            *) cp "$file" "$module/" ;;
+        esac
+    done
+    for file in cloud-init.yaml "$PINNED_USER_DATA_FILE"; do
+        [ -f "$file" ] && cp "$file" "$module/"
+    done
+    # Terragrunt runs the module from its cache, so the SSH key paths must be absolute
+    {
+        terraform_locals_to_vars variables.tf "$literal" | sed "s#pathexpand(\"\\./ssh_keys/#pathexpand(\"$PWD/ssh_keys/#"
+        echo ""
+        echo "# Settings passed in as Terragrunt inputs (see terragrunt.hcl)"
+        for name in $literal; do
+            printf 'variable "%s" {\n  type = any\n}\n\n' "$name"
+        done
+    } > "$module/variables.tf"
+
+    {
+        echo "# Terragrunt unit exported by CloudCradle from $PWD ($(date -u +%Y-%m-%dT%H:%M:%SZ))"
+        echo "# Generated - re-export after changing the configuration: $0 export terragrunt"
+        echo ""
+        echo 'terraform {'
+        echo '  source = "${get_terragrunt_dir()}/modules/cloudcradle"'
+        echo '}'
+        echo ""
+        echo 'generate "provider" {'
+        echo '  path      = "provider.tf"'
+        echo '  if_exists = "overwrite_terragrunt"'
+        echo '  contents  = <<EOF'
+        terragrunt_escape < provider.tf
+        echo 'EOF'
+        echo '}'
+        echo ""
+        echo 'generate "backend" {'
+        echo '  path      = "backend.tf"'
+        echo '  if_exists = "overwrite_terragrunt"'
+        echo '  contents  = <<EOF'
+        if [ -f backend.tf ]; then
+            terragrunt_escape < backend.tf
+        else
+            echo 'terraform {'
+            echo '  backend "local" {'
+            echo '    path = "${get_terragrunt_dir()}/terraform.tfstate"'
+            echo '  }'
+            echo '}'
+        fi
+        echo 'EOF'
+        echo '}'
+        echo ""
+        echo 'inputs = {'
+        printf '%s\n' "${inputs[@]}"
+        echo '}'
+    } > "$dir/terragrunt.hcl"
+
+    print_success "Terragrunt unit written: $dir/terragrunt.hcl (${#inputs[@]} inputs) and $module/"
+    if [ ! -f backend.tf ] && [ -f terraform.tfstate ] && [ ! -f "$dir/terraform.tfstate" ]; then
+        print_warning "This workspace's state is ./terraform.tfstate; the unit keeps its state in $dir/terraform.tfstate."
+        print_warning "Move it there before the first terragrunt plan: mv terraform.tfstate '$dir/'"
     fi
-    
-    if [ "$proposed_storage" -gt "$AVAILABLE_STORAGE" ]; then
-        print_error "Cannot use ${proposed_storage}GB storage - only ${AVAILABLE_STORAGE}GB available"
-        errors=$((errors + 1))
+}
+
+# Commands that take the exported unit from here (LAYOUT=terragrunt)
+terragrunt_next_steps() {
+    local i entry
+    local -a ordered=()
+
+    IMPORT_QUEUE=()
+    import_existing_resources || true
+
+    print_header "NEXT STEPS (TERRAGRUNT)"
+    echo "  cd '$PWD/$TERRAGRUNT_DIR'"
+    [ -f "$ADB_ADMIN_PASSWORD_FILE" ] && echo "  export TF_VAR_adb_admin_password=\"\$(cat '$PWD/$ADB_ADMIN_PASSWORD_FILE')\""
+    [ -n "${TF_VAR_ddns_token:-}" ] && echo "  export TF_VAR_ddns_token=...         # your DDNS_TOKEN"
+    [ -n "${TF_VAR_tailscale_auth_key:-}" ] && echo "  export TF_VAR_tailscale_auth_key=... # your TAILSCALE_AUTH_KEY"
+    state_encryption_enabled && echo "  export TF_VAR_state_passphrase=...   # state encryption key (TOFU_STATE_ENCRYPTION)"
+    echo "  terragrunt init -input=false"
+    if [ ${#IMPORT_QUEUE[@]} -gt 0 ]; then
+        mapfile -t ordered < <(import_queue_order "$(terraform_dependency_edges .)")
+        for i in "${ordered[@]}"; do
+            entry="${IMPORT_QUEUE[$i]}"
+            echo "  terragrunt import -input=false '${entry%%|*}' '$(echo "$entry" | cut -d'|' -f2)'"
+        done
     fi
-    
-    return $errors
+    echo "  terragrunt plan -input=false -out=tfplan $(terraform_plan_args)"
+    echo "  terragrunt apply $(terraform_apply_args) tfplan"
+    echo ""
+    print_status "Fleet commands (ssh, exec, outputs, ...) read Terraform outputs from this directory and"
+    print_status "need the flat layout; re-run with LAYOUT=flat after moving the state back to use them."
+}
+
+# ============================================================================
+# ACCOUNT ACTIVATION STATE
+# ============================================================================
+
+# Account states and the service errors that signal them, as "<state>|<code>|<message ERE>".
+# The code must match exactly; the message is matched case-insensitively. A plain
+# LimitExceeded (an Always Free shape at its limit) is not an account state.
+readonly ACCOUNT_STATE_ERRORS=(
+    "provisioning|NotAuthorized|(tenancy|account) (is )?(still )?(being|not yet( been)?) (provisioned|created|activated|set up)"
+    "provisioning|NotAuthorizedOrNotFound|tenancy (is )?(still )?(being|not yet( been)?) (provisioned|activated)"
+    "verification|NotAuthorized|(payment|identity|account) verification|not (yet )?(been )?verified"
+    "suspended|NotAuthorized|(tenancy|account) (is |has been )?(suspended|terminated|deactivated)"
+    "suspended|NotAuthenticated|(tenancy|tenant|account) (is |has been )?(suspended|terminated|deactivated)"
+    "trial_ended|LimitExceeded|free trial|trial (period )?(has )?(ended|expired)|upgrade (your account|to pay as you go)"
+)
+
+# "<code>|<message>" of the service error in TEXT: the CLI's "ServiceError:" JSON block or
+# the Terraform provider's "Error: <status>-<code>, <message>" line; fails without one
+oci_service_error() {
+    local text="$1" pair
+    if grep -q '^ServiceError:' <<< "$text"; then
+        pair=$(sed -n '/^ServiceError:/,/^}/p' <<< "$text" | tail -n +2 \
+            | jq -r 'select(.code) | "\(.code)|\(.message // "" | gsub("\n"; " "))"' 2>/dev/null)
+    else
+        pair=$(grep -oE '[0-9]{3}-[A-Za-z]+, .*' <<< "$text" | head -1 | sed -E 's/^[0-9]{3}-([A-Za-z]+), /\1|/')
+    fi
+    [ -n "$pair" ] && echo "$pair"
+}
+
+# Classify an OCI/Terraform error caused by the tenancy's account state
+# (provisioning | verification | suspended | trial_ended); fails for anything else
+account_state_from_error() {
+    local pair code message entry state pattern
+    pair=$(oci_service_error "$1") || return 1
+    code="${pair%%|*}" message="${pair#*|}"
+    for entry in "${ACCOUNT_STATE_ERRORS[@]}"; do
+        state="${entry%%|*}" entry="${entry#*|}" pattern="${entry#*|}"
+        if [ "$code" = "${entry%%|*}" ] && grep -qiE "$pattern" <<< "$message"; then
+            echo "$state"
+            return 0
+        fi
+    done
+    return 1
 }
 
-# ============================================================================
-# CONFIGURATION FUNCTIONS
-# ============================================================================
+explain_account_state() {
+    case "$1" in
+        provisioning)
+            print_warning "Your Oracle Cloud account is still being provisioned."
+            print_status "  New sign-ups usually finish within 30 minutes but can take up to a day."
+            print_status "  Nothing is wrong with your configuration; the API rejects requests until it is done."
+            ;;
+        verification)
+            print_warning "Your Oracle Cloud account is waiting for payment/identity verification."
+            print_status "  Oracle verifies the card used at sign-up before enabling the tenancy (no charge is made"
+            print_status "  for Always Free resources). Check your email and the Billing page in the OCI console."
+            ;;
+        suspended)
+            print_warning "Your Oracle Cloud tenancy is suspended."
+            print_status "  Only Oracle support can reactivate it - see the notification email or open a support request."
+            ;;
+        trial_ended)
+            print_warning "Your Oracle Cloud free trial has ended (the account is in its grace period)."
+            print_status "  Always Free resources keep working; paid resources are stopped and new ones beyond the"
+            print_status "  Always Free limits are refused until you upgrade to Pay As You Go."
+            ;;
+    esac
+}
 
-load_existing_config() {
-    if [ ! -f "variables.tf" ]; then
-        return 1
-    fi
-    
-    print_status "Loading existing configuration from variables.tf..."
-    
-    # Load basic counts
-    amd_micro_instance_count=$(grep -oP 'amd_micro_instance_count\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || amd_micro_instance_count=0
-    amd_micro_boot_volume_size_gb=$(grep -oP 'amd_micro_boot_volume_size_gb\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || amd_micro_boot_volume_size_gb=50
-    arm_flex_instance_count=$(grep -oP 'arm_flex_instance_count\s*=\s*\K[0-9]+' variables.tf 2>/dev/null | head -1) || arm_flex_instance_count=0
-    
-    # Load ARM arrays
-    local ocpus_str memory_str boot_str
-    ocpus_str=$(grep -oP 'arm_flex_ocpus_per_instance\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || ocpus_str=""
-    memory_str=$(grep -oP 'arm_flex_memory_per_instance\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || memory_str=""
-    boot_str=$(grep -oP 'arm_flex_boot_volume_size_gb\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || boot_str=""
-    
-    arm_flex_ocpus_per_instance=$(echo "$ocpus_str" | tr ',' ' ' | tr -s ' ')
-    arm_flex_memory_per_instance=$(echo "$memory_str" | tr ',' ' ' | tr -s ' ')
-    arm_flex_boot_volume_size_gb=$(echo "$boot_str" | tr ',' ' ' | tr -s ' ')
-    
-    # Load hostnames
-    local amd_hostnames_str arm_hostnames_str
-    amd_hostnames_str=$(grep -oP 'amd_micro_hostnames\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || amd_hostnames_str=""
-    arm_hostnames_str=$(grep -oP 'arm_flex_hostnames\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | head -1) || arm_hostnames_str=""
-    
-    amd_micro_hostnames=()
-    arm_flex_hostnames=()
-    
-    if [ -n "$amd_hostnames_str" ]; then
-        while IFS= read -r hostname; do
-            hostname=$(echo "$hostname" | tr -d '"' | tr -d ' ')
-            [ -n "$hostname" ] && amd_micro_hostnames+=("$hostname")
-        done <<< "$(echo "$amd_hostnames_str" | tr ',' '\n')"
-    fi
-    
-    if [ -n "$arm_hostnames_str" ]; then
-        while IFS= read -r hostname; do
-            hostname=$(echo "$hostname" | tr -d '"' | tr -d ' ')
-            [ -n "$hostname" ] && arm_flex_hostnames+=("$hostname")
-        done <<< "$(echo "$arm_hostnames_str" | tr ',' '\n')"
+# Explain an account-state error once per run (oci_cmd usually runs in a subshell, so
+# the "already reported" flag lives in a file keyed by the main process)
+report_account_state() {
+    local state marker="${TMPDIR:-/tmp}/cloudcradle-account-state.$$"
+    state=$(account_state_from_error "$1") || return 1
+    if [ "$(cat "$marker" 2>/dev/null)" != "$state" ]; then
+        echo "$state" > "$marker" 2>/dev/null || true
+        explain_account_state "$state"
+        if [ "$WAIT_FOR_ACTIVATION" != "true" ] && { [ "$state" = "provisioning" ] || [ "$state" = "verification" ]; }; then
+            print_status "  Re-run with --wait-for-activation to poll until the tenancy is active."
+        fi
     fi
-    
-    print_success "Loaded configuration: ${amd_micro_instance_count}x AMD, ${arm_flex_instance_count}x ARM"
     return 0
 }
 
-prompt_configuration() {
-    print_header "INSTANCE CONFIGURATION"
-    
-    calculate_available_resources
-    
-    echo -e "${BOLD}Available Free Tier Resources:${NC}"
-    echo "  • AMD instances:  $AVAILABLE_AMD_INSTANCES available (max $FREE_TIER_MAX_AMD_INSTANCES)"
-    echo "  • ARM OCPUs:      $AVAILABLE_ARM_OCPUS available (max $FREE_TIER_MAX_ARM_OCPUS)"
-    echo "  • ARM Memory:     ${AVAILABLE_ARM_MEMORY}GB available (max ${FREE_TIER_MAX_ARM_MEMORY_GB}GB)"
-    echo "  • Storage:        ${AVAILABLE_STORAGE}GB available (max ${FREE_TIER_MAX_STORAGE_GB}GB)"
-    echo ""
-    
-    # Check if we have existing config
-    local has_existing_config=false
-    if load_existing_config; then
-        has_existing_config=true
-    fi
-    
-    print_status "Configuration options:"
-    echo "  1) Use existing instances (manage what's already deployed)"
-    if [ "$has_existing_config" = "true" ]; then
-        echo "  2) Use saved configuration from variables.tf"
-    else
-        echo "  2) Use saved configuration from variables.tf (not available)"
+# Probe a compute call the way the rest of the run will; echoes the account state
+# and fails while the tenancy is not usable yet
+check_tenancy_activation() {
+    if oci_cmd "compute shape list --compartment-id $tenancy_ocid --limit 1" >/dev/null; then
+        return 0
     fi
-    echo "  3) Configure new instances (respecting Free Tier limits)"
-    echo "  4) Maximum Free Tier configuration (use all available resources)"
-    echo ""
-    
-    local choice
+    account_state_from_error "$OCI_LAST_ERROR" || return 0
+    return 1
+}
+
+# --wait-for-activation: poll until the tenancy accepts requests
+wait_for_tenancy_activation() {
+    local started state
+    started=$(date +%s)
     while true; do
-        if [ "$AUTO_USE_EXISTING" = "true" ]; then
-            choice=1
-            print_status "Auto mode: Using existing instances"
-        elif [ "$NON_INTERACTIVE" = "true" ]; then
-            choice=1
-            print_status "Non-interactive mode: Using existing instances"
-        else
-            # Use prompt_with_default so the user sees the default inline (e.g. "[1]") as requested
-            raw_choice=$(prompt_with_default "Choose configuration (1-4)" "1")
-            # Normalize input (remove CR and trim whitespace)
-            raw_choice=$(echo "$raw_choice" | tr -d '\r' | sed 's/^[[:space:]]*//;s/[[:space:]]*$//')
-            # Validate numeric range
-            if [[ "$raw_choice" =~ ^[0-9]+$ ]] && [ "$raw_choice" -ge 1 ] && [ "$raw_choice" -le 4 ]; then
-                choice=$raw_choice
-            else
-                print_error "Please enter a number between 1 and 4 (received: '$raw_choice')"
-                continue
-            fi
+        if state=$(check_tenancy_activation); then
+            print_success "Tenancy is active"
+            return 0
         fi
-        
-        case $choice in
-            1)
-                configure_from_existing_instances
-                break
-                ;;
-            2)
-                if [ "$has_existing_config" = "true" ]; then
-                    print_success "Using saved configuration"
-                    break
-                else
-                    print_error "No saved configuration available"
-                    continue
-                fi
-                ;;
-            3)
-                configure_custom_instances
-                break
-                ;;
-            4)
-                configure_maximum_free_tier
-                break
-                ;;
-            *)
-                print_error "Invalid choice"
-                continue
-                ;;
-        esac
+        if [ "$state" = "suspended" ] || [ "$state" = "trial_ended" ]; then
+            explain_account_state "$state"
+            print_error "Waiting will not help in this state"
+            return 1
+        fi
+        if [ $(( $(date +%s) - started )) -ge "$ACTIVATION_WAIT_TIMEOUT" ]; then
+            print_error "Tenancy still not active after ${ACTIVATION_WAIT_TIMEOUT}s"
+            return 1
+        fi
+        print_status "Tenancy not active yet ($state) - checking again in ${ACTIVATION_POLL_INTERVAL}s ($(date '+%H:%M:%S'))"
+        sleep "$ACTIVATION_POLL_INTERVAL"
     done
 }
 
-configure_from_existing_instances() {
-    print_status "Configuring based on existing instances..."
-    
-    # Use existing AMD instances
-    amd_micro_instance_count=${#EXISTING_AMD_INSTANCES[@]}
-    amd_micro_hostnames=()
-    
-    for instance_data in "${EXISTING_AMD_INSTANCES[@]}"; do
-        local name
-        name=$(echo "$instance_data" | cut -d'|' -f1)
-        amd_micro_hostnames+=("$name")
-    done
-    
-    # Use existing ARM instances
-    arm_flex_instance_count=${#EXISTING_ARM_INSTANCES[@]}
-    arm_flex_hostnames=()
-    arm_flex_ocpus_per_instance=""
-    arm_flex_memory_per_instance=""
-    arm_flex_boot_volume_size_gb=""
-    arm_flex_block_volumes=()
-    
-    for instance_data in "${EXISTING_ARM_INSTANCES[@]}"; do
-        local name ocpus memory
-        name=$(echo "$instance_data" | cut -d'|' -f1)
-        ocpus=$(echo "$instance_data" | cut -d'|' -f6)
-        memory=$(echo "$instance_data" | cut -d'|' -f7)
-        
-        arm_flex_hostnames+=("$name")
-        arm_flex_ocpus_per_instance+="$ocpus "
-        arm_flex_memory_per_instance+="$memory "
-        arm_flex_boot_volume_size_gb+="50 "  # Default, will be updated from state
-        arm_flex_block_volumes+=(0)
-    done
-    
-    # Trim trailing spaces
-    arm_flex_ocpus_per_instance=$(echo "$arm_flex_ocpus_per_instance" | xargs)
-    arm_flex_memory_per_instance=$(echo "$arm_flex_memory_per_instance" | xargs)
-    arm_flex_boot_volume_size_gb=$(echo "$arm_flex_boot_volume_size_gb" | xargs)
-    
-    # Set defaults if no instances exist
-    if [ "$amd_micro_instance_count" -eq 0 ] && [ "$arm_flex_instance_count" -eq 0 ]; then
-        print_status "No existing instances found, using default configuration"
-        amd_micro_instance_count=0
-        arm_flex_instance_count=1
-        arm_flex_ocpus_per_instance="4"
-        arm_flex_memory_per_instance="24"
-        arm_flex_boot_volume_size_gb="200"
-        arm_flex_hostnames=("arm-instance-1")
-        arm_flex_block_volumes=(0)
-    fi
-    
-    amd_micro_boot_volume_size_gb=50
-    
-    print_success "Configuration: ${amd_micro_instance_count}x AMD, ${arm_flex_instance_count}x ARM"
+# ============================================================================
+# PERMISSION PREFLIGHT
+# ============================================================================
+
+# Numeric rank of an IAM verb; a grant satisfies any need of equal or lower rank
+iam_verb_rank() {
+    case "$1" in
+        inspect) echo 1 ;;
+        read) echo 2 ;;
+        use) echo 3 ;;
+        manage) echo 4 ;;
+        *) echo 0 ;;
+    esac
 }
 
-configure_custom_instances() {
-    print_status "Custom instance configuration..."
-    
-    # AMD instances
-    amd_micro_instance_count=$(prompt_int_range "Number of AMD instances (0-$AVAILABLE_AMD_INSTANCES)" "0" "0" "$AVAILABLE_AMD_INSTANCES")
-    
-    amd_micro_hostnames=()
-    if [ "$amd_micro_instance_count" -gt 0 ]; then
-        amd_micro_boot_volume_size_gb=$(prompt_int_range "AMD boot volume size GB (50-100)" "50" "50" "100")
-        
-        for ((i=1; i<=amd_micro_instance_count; i++)); do
-            echo -n -e "${BLUE}Hostname for AMD instance $i [amd-instance-$i]: ${NC}"
-            read -r hostname
-            hostname=${hostname:-"amd-instance-$i"}
-            amd_micro_hostnames+=("$hostname")
-        done
-    else
-        amd_micro_boot_volume_size_gb=50
+# OCID of the calling user: config "user", else the session token subject
+preflight_user_ocid() {
+    local user
+    user=$(read_oci_config_value "user" 2>/dev/null || true)
+    if [ -z "$user" ] && [ "$auth_method" = "security_token" ]; then
+        local payload
+        payload=$(cut -d. -f2 "$(session_token_file)" 2>/dev/null | tr '_-' '/+')
+        while [ $(( ${#payload} % 4 )) -ne 0 ]; do payload="${payload}="; done
+        user=$(echo "$payload" | base64 -d 2>/dev/null | jq -r '.sub // empty' 2>/dev/null)
     fi
-    
-    # ARM instances
-    if [ -n "$ubuntu_arm_flex_image_ocid" ] && [ "$AVAILABLE_ARM_OCPUS" -gt 0 ]; then
-        arm_flex_instance_count=$(prompt_int_range "Number of ARM instances (0-4)" "1" "0" "4")
-        
-        arm_flex_hostnames=()
-        arm_flex_ocpus_per_instance=""
-        arm_flex_memory_per_instance=""
-        arm_flex_boot_volume_size_gb=""
-        arm_flex_block_volumes=()
-        
-        local remaining_ocpus=$AVAILABLE_ARM_OCPUS
-        local remaining_memory=$AVAILABLE_ARM_MEMORY
-        
-        for ((i=1; i<=arm_flex_instance_count; i++)); do
-            echo ""
-            print_status "ARM instance $i configuration (remaining: ${remaining_ocpus} OCPUs, ${remaining_memory}GB RAM):"
-            
-            echo -n -e "${BLUE}  Hostname [arm-instance-$i]: ${NC}"
-            read -r hostname
-            hostname=${hostname:-"arm-instance-$i"}
-            arm_flex_hostnames+=("$hostname")
+    echo "$user"
+}
 
-            ocpus=$(prompt_int_range "  OCPUs (1-$remaining_ocpus)" "$remaining_ocpus" "1" "$remaining_ocpus")
-            arm_flex_ocpus_per_instance+="$ocpus "
-            remaining_ocpus=$((remaining_ocpus - ocpus))
-            
-            local max_memory=$((ocpus * 6))  # 6GB per OCPU max
-            [ $max_memory -gt $remaining_memory ] && max_memory=$remaining_memory
+# The aggregate resource types (families) an IAM resource type belongs to, one per line.
+# A grant on the family covers every member; volume-attachments is in two families.
+iam_resource_families() {
+    case "$1" in
+        instances|instance-images|instance-configurations|instance-pools|instance-console-connection|console-histories|app-catalog-listing|vnic-attachments)
+            echo instance-family ;;
+        volume-attachments)
+            printf '%s\n' instance-family volume-family ;;
+        volumes|volume-backups|boot-volume-backups|backup-policies|backup-policy-assignments|volume-groups|volume-group-backups)
+            echo volume-family ;;
+        vcns|subnets|route-tables|network-security-groups|security-lists|dhcp-options|private-ips|public-ips|ipv6s|internet-gateways|nat-gateways|service-gateways|local-peering-gateways|drgs|drg-attachments|vnics)
+            echo virtual-network-family ;;
+        buckets|objects)
+            echo object-family ;;
+        autonomous-databases|autonomous-backups|autonomous-container-databases)
+            echo autonomous-database-family ;;
+        secrets|secret-bundles)
+            echo secret-family ;;
+    esac
+}
+
+# True when a policy statement list (one per line, lowercased) grants verb on resource
+# to one of the groups (lowercased, one per line) in the tenancy root compartment. A
+# grant on the resource's family or on all-resources counts too.
+policy_grants() {
+    local statements="$1" groups="$2" verb="$3" resource="$4"
+    local need_rank
+    need_rank=$(iam_verb_rank "$verb")
+
+    local statement subjects granted_verb granted_resource group
+    while IFS= read -r statement; do
+        [[ "$statement" =~ ^allow[[:space:]]+(group[[:space:]]+(.+)|any-user)[[:space:]]+to[[:space:]]+([a-z]+)[[:space:]]+([a-z-]+)[[:space:]]+in[[:space:]]+tenancy ]] || continue
+        subjects="${BASH_REMATCH[2]}"
+        granted_verb="${BASH_REMATCH[3]}"
+        granted_resource="${BASH_REMATCH[4]}"
+        [ "$(iam_verb_rank "$granted_verb")" -ge "$need_rank" ] || continue
+        [ "$granted_resource" = "$resource" ] || [ "$granted_resource" = "all-resources" ] \
+            || iam_resource_families "$resource" | grep -qxF "$granted_resource" || continue
+        [ "${BASH_REMATCH[1]}" = "any-user" ] && return 0
+        while IFS= read -r group; do
+            [ -n "$group" ] || continue
+            # Subjects may be "a, b" or identity-domain qualified ('Default'/'a')
+            if echo "$subjects" | tr -d "'\"" | tr ',' '\n' | sed 's/^[[:space:]]*//;s/[[:space:]]*$//;s|^.*/||' | grep -qxF "$group"; then
+                return 0
+            fi
+        done <<< "$groups"
+    done <<< "$statements"
+    return 1
+}
 
-            memory=$(prompt_int_range "  Memory GB (1-$max_memory)" "$max_memory" "1" "$max_memory")
-            arm_flex_memory_per_instance+="$memory "
-            remaining_memory=$((remaining_memory - memory))
+# preflight: verify the current principal can do what each phase needs and print the
+# exact grants that are missing instead of failing halfway through an apply
+run_permission_preflight() {
+    print_subheader "Permission Preflight"
 
-            boot=$(prompt_int_range "  Boot volume GB (50-200)" "50" "50" "200")
-            arm_flex_boot_volume_size_gb+="$boot "
-            
-            arm_flex_block_volumes+=(0)
-        done
-        
-        arm_flex_ocpus_per_instance=$(echo "$arm_flex_ocpus_per_instance" | xargs)
-        arm_flex_memory_per_instance=$(echo "$arm_flex_memory_per_instance" | xargs)
-        arm_flex_boot_volume_size_gb=$(echo "$arm_flex_boot_volume_size_gb" | xargs)
+    local -a missing=()
+    local unknown=false
+
+    # Read access: probe with the cheapest call each phase makes
+    local probe phase need cmd
+    local probes=(
+        "discovery|read instance-images|compute image list --compartment-id $tenancy_ocid --limit 1"
+        "inventory|inspect instances|compute instance list --compartment-id $tenancy_ocid --limit 1"
+        "inventory|read virtual-network-family|network vcn list --compartment-id $tenancy_ocid --limit 1"
+        "inventory|inspect volumes|bv volume list --compartment-id $tenancy_ocid --limit 1"
+        "inventory|inspect boot-volumes|bv boot-volume list --compartment-id $tenancy_ocid --availability-domain $availability_domain --limit 1"
+    )
+    [ -n "$AUTONOMOUS_DATABASES" ] && probes+=(
+        "inventory|inspect autonomous-databases|db autonomous-database list --compartment-id $tenancy_ocid --limit 1"
+    )
+    for probe in "${probes[@]}"; do
+        IFS='|' read -r phase need cmd <<< "$probe"
+        if oci_cmd "$cmd" >/dev/null 2>&1; then
+            printf "  ${GREEN}✓${NC} %-10s %s\n" "$phase" "$need"
+        else
+            printf "  ${RED}✗${NC} %-10s %s\n" "$phase" "$need"
+            missing+=("$need")
+        fi
+    done
+
+    # Write access cannot be probed without side effects: read the policies instead
+    local manage_needs=("instance-family" "virtual-network-family" "volume-family")
+    [ "$TF_BACKEND" = "oci" ] && manage_needs+=("objects")
+    [ -n "$AUTONOMOUS_DATABASES" ] && manage_needs+=("autonomous-database-family")
+    [ "$(budget_alert_email)" != "none" ] && manage_needs+=("usage-budgets")
+
+    local user groups="" group_names="" statements=""
+    user=$(preflight_user_ocid)
+    if is_principal_auth; then
+        print_status "  $auth_method auth: dynamic-group grants cannot be introspected, skipping manage checks"
+        unknown=true
+    elif [ -z "$user" ]; then
+        unknown=true
     else
-        arm_flex_instance_count=0
-        arm_flex_ocpus_per_instance=""
-        arm_flex_memory_per_instance=""
-        arm_flex_boot_volume_size_gb=""
-        arm_flex_block_volumes=()
-        arm_flex_hostnames=()
+        local group_ids
+        group_ids=$(oci_cmd "iam user-group-membership list --compartment-id $tenancy_ocid --user-id $user --all \
+            --query 'data[].\"group-id\"'" 2>/dev/null) || group_ids=""
+        statements=$(oci_cmd "iam policy list --compartment-id $tenancy_ocid --all --query 'data[].statements[]'" 2>/dev/null \
+            | jq -r '.[]?' 2>/dev/null | tr '[:upper:]' '[:lower:]') || statements=""
+        if [ -z "$group_ids" ] || [ -z "$statements" ]; then
+            unknown=true
+        else
+            group_names=$(oci_cmd "iam group list --compartment-id $tenancy_ocid --all --query 'data[].{id:id,name:name}'" 2>/dev/null \
+                | jq -r --argjson ids "$group_ids" '.[]? | select(.id | IN($ids[])) | .name' 2>/dev/null)
+            groups=$(echo "$group_names" | tr '[:upper:]' '[:lower:]')
+        fi
     fi
-}
 
-configure_maximum_free_tier() {
-    print_status "Configuring maximum Free Tier utilization..."
-    
-    # Use all available AMD instances
-    amd_micro_instance_count=$AVAILABLE_AMD_INSTANCES
-    amd_micro_boot_volume_size_gb=50
-    amd_micro_hostnames=()
-    for ((i=1; i<=amd_micro_instance_count; i++)); do
-        amd_micro_hostnames+=("amd-instance-$i")
+    local resource
+    for resource in "${manage_needs[@]}"; do
+        if [ "$unknown" = "true" ]; then
+            printf "  ${YELLOW}?${NC} %-10s %s\n" "apply" "manage $resource"
+        elif echo "$groups" | grep -qx "administrators" || policy_grants "$statements" "$groups" manage "$resource"; then
+            printf "  ${GREEN}✓${NC} %-10s %s\n" "apply" "manage $resource"
+        else
+            printf "  ${RED}✗${NC} %-10s %s\n" "apply" "manage $resource"
+            missing+=("manage $resource")
+        fi
     done
-    
-    # Use all available ARM resources
-    if [ -n "$ubuntu_arm_flex_image_ocid" ] && [ "$AVAILABLE_ARM_OCPUS" -gt 0 ]; then
-        arm_flex_instance_count=1
-        arm_flex_ocpus_per_instance="$AVAILABLE_ARM_OCPUS"
-        arm_flex_memory_per_instance="$AVAILABLE_ARM_MEMORY"
-        
-        # Calculate boot volume size to use remaining storage
-        local used_by_amd=$((amd_micro_instance_count * amd_micro_boot_volume_size_gb))
-        local remaining_storage=$((AVAILABLE_STORAGE - used_by_amd))
-        [ $remaining_storage -lt $FREE_TIER_MIN_BOOT_VOLUME_GB ] && remaining_storage=$FREE_TIER_MIN_BOOT_VOLUME_GB
-        
-        arm_flex_boot_volume_size_gb="$remaining_storage"
-        arm_flex_hostnames=("arm-instance-1")
-        arm_flex_block_volumes=(0)
-    else
-        arm_flex_instance_count=0
-        arm_flex_ocpus_per_instance=""
-        arm_flex_memory_per_instance=""
-        arm_flex_boot_volume_size_gb=""
-        arm_flex_hostnames=()
-        arm_flex_block_volumes=()
+
+    echo ""
+    if [ ${#missing[@]} -eq 0 ]; then
+        if [ "$unknown" = "true" ]; then
+            print_warning "Read access OK; manage grants could not be verified (policies not readable)"
+        else
+            print_success "All required permissions are granted"
+        fi
+        return 0
     fi
-    
-    print_success "Maximum config: ${amd_micro_instance_count}x AMD, ${arm_flex_instance_count}x ARM ($AVAILABLE_ARM_OCPUS OCPUs, ${AVAILABLE_ARM_MEMORY}GB)"
+
+    local group_hint
+    group_hint=$(echo "$group_names" | head -1)
+    print_error "Missing permissions. Ask a tenancy administrator to add:"
+    local grant
+    for grant in "${missing[@]}"; do
+        echo "  Allow group ${group_hint:-<your-group>} to $grant in tenancy"
+    done
+    return 1
 }
 
 # ============================================================================
-# TERRAFORM FILE GENERATION
+# IAM BOOTSTRAP
 # ============================================================================
 
-create_terraform_files() {
-    print_header "GENERATING TERRAFORM FILES"
-    
-    create_terraform_provider
-    create_terraform_variables
-    create_terraform_datasources
-    create_terraform_main
-    create_terraform_block_volumes
-    create_cloud_init
-    
-    print_success "All Terraform files generated successfully"
+# Policy statements for everything the tool and generated Terraform touch. Resources
+# live in the tenancy root compartment, so grants are scoped to it.
+iam_bootstrap_statements() {
+    local group="$1"
+    local statements=(
+        "Allow group $group to manage instance-family in tenancy"
+        "Allow group $group to manage virtual-network-family in tenancy"
+        "Allow group $group to manage volume-family in tenancy"
+        "Allow group $group to inspect compartments in tenancy"
+        "Allow group $group to inspect limits in tenancy"
+    )
+    if [ "$TF_BACKEND" = "oci" ] && [ -n "$TF_BACKEND_BUCKET" ]; then
+        statements+=(
+            "Allow group $group to read buckets in tenancy where target.bucket.name='$TF_BACKEND_BUCKET'"
+            "Allow group $group to manage objects in tenancy where target.bucket.name='$TF_BACKEND_BUCKET'"
+        )
+    fi
+    if [ -n "$AUTONOMOUS_DATABASES" ]; then
+        statements+=("Allow group $group to manage autonomous-database-family in tenancy")
+    fi
+    if [ "$(budget_alert_email)" != "none" ]; then
+        statements+=("Allow group $group to manage usage-budgets in tenancy")
+    fi
+    if [ -f "$BACKUP_SPEC_FILE" ]; then
+        statements+=("Allow group $group to manage buckets in tenancy where target.bucket.name='$BACKUP_BUCKET'")
+    fi
+    if instance_access_kinds | grep -qx secrets; then
+        statements+=(
+            "Allow group $group to manage vaults in tenancy"
+            "Allow group $group to manage keys in tenancy"
+            "Allow group $group to manage secret-family in tenancy"
+        )
+    fi
+    # Tagging instances is all the operators do for instance access: the dynamic groups and
+    # their policies are created by a tenancy admin (iam_bootstrap_instance_access)
+    if [ -n "$(instance_access_kinds)" ]; then
+        statements+=("Allow group $group to use tag-namespaces in tenancy where target.tag-namespace.name='$INSTANCE_TAG_NAMESPACE'")
+    fi
+    printf '%s\n' "${statements[@]}" | jq -R . | jq -sc .
 }
 
-create_terraform_provider() {
-    print_status "Creating provider.tf..."
-
-    # Configure terraform backend if requested (may create backend.tf)
-    configure_terraform_backend || true
-    
-    [ -f "provider.tf" ] && cp provider.tf "provider.tf.bak.$(date +%Y%m%d_%H%M%S)"
-    
-    cat > provider.tf << EOF
-# Terraform Provider Configuration for Oracle Cloud Infrastructure
-# Generated: $(date)
-# Region: $region
-
-terraform {
-  required_version = ">= 1.0"
-  required_providers {
-    oci = {
-      source  = "oracle/oci"
-      version = "~> 6.0"
-    }
-  }
+# Instance access in use, one of "backup" and "secrets" per line
+instance_access_kinds() {
+    [ ! -f "$BACKUP_SPEC_FILE" ] || echo backup
+    # Backup hosts read their repository password from the vault
+    [ ! -f "$SECRETS_FILE" ] && [ ! -f "$BACKUP_SPEC_FILE" ] || echo secrets
 }
 
-# OCI Provider with session token authentication
-provider "oci" {
-  auth                = "SecurityToken"
-  config_file_profile = "DEFAULT"
-  region              = "$region"
+# Dynamic group and policy statements of one instance access kind as "<name>|<description>|<statements JSON>";
+# empty while the resource they grant access to cannot be named yet
+instance_access_grants() {
+    local kind="$1" name vault_id
+    case "$kind" in
+        backup)
+            name="${BACKUP_BUCKET}-writers"
+            printf '%s|%s|%s\n' "$name" "CloudCradle instances writing backups to $BACKUP_BUCKET" "$(printf '%s\n' \
+                "Allow dynamic-group $name to read buckets in tenancy where target.bucket.name = '$BACKUP_BUCKET'" \
+                "Allow dynamic-group $name to manage objects in tenancy where target.bucket.name = '$BACKUP_BUCKET'" \
+                | jq -R . | jq -sc .)"
+            ;;
+        secrets)
+            # Scoped to the vault, which exists once Terraform has created it
+            vault_id=$(secrets_vault_output | jq -r '.id // empty' 2>/dev/null) || vault_id=""
+            [ -n "$vault_id" ] || return 0
+            name="${SECRETS_VAULT_NAME}-readers"
+            printf '%s|%s|%s\n' "$name" "CloudCradle instances reading secrets from $SECRETS_VAULT_NAME" "$(printf '%s\n' \
+                "Allow dynamic-group $name to read secret-bundles in tenancy where target.vault.id = '$vault_id'" \
+                | jq -R . | jq -sc .)"
+            ;;
+    esac
 }
-EOF
-    
-    print_success "provider.tf created"
+
+# Matching rule of the dynamic group of KIND: instances of the compartment carrying the
+# <namespace>.<kind> defined tag, which Terraform sets only where the access is needed
+instance_access_matching_rule() {
+    echo "ALL {instance.compartment.id = '$tenancy_ocid', tag.$INSTANCE_TAG_NAMESPACE.$1.value = 'true'}"
 }
 
-create_terraform_variables() {
-    print_status "Creating variables.tf..."
-    
-    [ -f "variables.tf" ] && cp variables.tf "variables.tf.bak.$(date +%Y%m%d_%H%M%S)"
-    
-    # Build array strings for Terraform
-    local amd_hostnames_tf="["
-    for ((i=0; i<${#amd_micro_hostnames[@]}; i++)); do
-        [ $i -gt 0 ] && amd_hostnames_tf+=", "
-        amd_hostnames_tf+="\"${amd_micro_hostnames[$i]}\""
-    done
-    amd_hostnames_tf+="]"
-    
-    local arm_hostnames_tf="["
-    for ((i=0; i<${#arm_flex_hostnames[@]}; i++)); do
-        [ $i -gt 0 ] && arm_hostnames_tf+=", "
-        arm_hostnames_tf+="\"${arm_flex_hostnames[$i]}\""
-    done
-    arm_hostnames_tf+="]"
-    
-    local arm_ocpus_tf="["
-    local arm_memory_tf="["
-    local arm_boot_tf="["
-    local arm_block_tf="["
-    
-    if [ "$arm_flex_instance_count" -gt 0 ]; then
-        # Split space-separated strings safely into arrays
-        IFS=' ' read -r -a ocpu_arr <<< "$arm_flex_ocpus_per_instance"
-        IFS=' ' read -r -a memory_arr <<< "$arm_flex_memory_per_instance"
-        IFS=' ' read -r -a boot_arr <<< "$arm_flex_boot_volume_size_gb"
-        
-        for ((i=0; i<${#ocpu_arr[@]}; i++)); do
-            [ $i -gt 0 ] && arm_ocpus_tf+=", " && arm_memory_tf+=", " && arm_boot_tf+=", " && arm_block_tf+=", "
-            arm_ocpus_tf+="${ocpu_arr[$i]}"
-            arm_memory_tf+="${memory_arr[$i]}"
-            arm_boot_tf+="${boot_arr[$i]}"
-            arm_block_tf+="${arm_flex_block_volumes[$i]:-0}"
-        done
+# Create (or update) the policy NAME in the tenancy with the statements of a JSON list
+iam_upsert_policy() {
+    local name="$1" description="$2" statements="$3" policy_id statements_file rc=0
+    statements_file=$(mktemp)
+    echo "$statements" > "$statements_file"
+    policy_id=$(iam_find_by_name policy "$name")
+    if [ -z "$policy_id" ]; then
+        oci_cmd "iam policy create --compartment-id $tenancy_ocid --name $name \
+            --description '$description' --statements file://$statements_file" >/dev/null && \
+            print_success "Created policy $name" || rc=1
+    else
+        oci_cmd "iam policy update --policy-id $policy_id --statements file://$statements_file --force" >/dev/null && \
+            print_success "Updated policy $name" || rc=1
     fi
-    
-    arm_ocpus_tf+="]"
-    arm_memory_tf+="]"
-    arm_boot_tf+="]"
-    arm_block_tf+="]"
-    
-    cat > variables.tf << EOF
-# Oracle Cloud Infrastructure Terraform Variables
-# Generated: $(date)
-# Configuration: ${amd_micro_instance_count}x AMD + ${arm_flex_instance_count}x ARM instances
-
-locals {
-  # Core identifiers
-  tenancy_ocid    = "$tenancy_ocid"
-  compartment_id  = "$tenancy_ocid"
-  user_ocid       = "$user_ocid"
-  region          = "$region"
-  
-  # Ubuntu Images (region-specific)
-  ubuntu_x86_image_ocid = "$ubuntu_image_ocid"
-  ubuntu_arm_image_ocid = "$ubuntu_arm_flex_image_ocid"
-  
-  # SSH Configuration
-  ssh_pubkey_path      = pathexpand("./ssh_keys/id_rsa.pub")
-  ssh_pubkey_data      = file(pathexpand("./ssh_keys/id_rsa.pub"))
-  ssh_private_key_path = pathexpand("./ssh_keys/id_rsa")
-  
-  # AMD x86 Micro Instances Configuration
-  amd_micro_instance_count      = $amd_micro_instance_count
-  amd_micro_boot_volume_size_gb = $amd_micro_boot_volume_size_gb
-  amd_micro_hostnames           = $amd_hostnames_tf
-  amd_block_volume_size_gb      = 0
-  
-  # ARM A1 Flex Instances Configuration
-  arm_flex_instance_count       = $arm_flex_instance_count
-  arm_flex_ocpus_per_instance   = $arm_ocpus_tf
-  arm_flex_memory_per_instance  = $arm_memory_tf
-  arm_flex_boot_volume_size_gb  = $arm_boot_tf
-  arm_flex_hostnames            = $arm_hostnames_tf
-  arm_block_volume_sizes        = $arm_block_tf
-  
-  # Storage calculations
-  total_amd_storage = local.amd_micro_instance_count * local.amd_micro_boot_volume_size_gb
-  total_arm_storage = local.arm_flex_instance_count > 0 ? sum(local.arm_flex_boot_volume_size_gb) : 0
-  total_block_storage = (local.amd_micro_instance_count * local.amd_block_volume_size_gb) + (local.arm_flex_instance_count > 0 ? sum(local.arm_block_volume_sizes) : 0)
-  total_storage = local.total_amd_storage + local.total_arm_storage + local.total_block_storage
+    rm -f "$statements_file"
+    [ "$rc" -eq 0 ] || print_error "Failed to write policy $name"
+    return "$rc"
 }
 
-# Free Tier Limits
-variable "free_tier_max_storage_gb" {
-  description = "Maximum storage for Oracle Free Tier"
-  type        = number
-  default     = $FREE_TIER_MAX_STORAGE_GB
+# Tag namespace INSTANCE_TAG_NAMESPACE with one key per instance access kind
+iam_ensure_instance_tags() {
+    local namespace_id kind
+    namespace_id=$(iam_find_by_name tag-namespace "$INSTANCE_TAG_NAMESPACE")
+    if [ -z "$namespace_id" ]; then
+        namespace_id=$(oci_cmd "iam tag-namespace create --compartment-id $tenancy_ocid --name $INSTANCE_TAG_NAMESPACE \
+            --description 'CloudCradle instance access' --query 'data.id' --raw-output") || {
+            print_error "Failed to create tag namespace $INSTANCE_TAG_NAMESPACE"; return 1; }
+        print_success "Created tag namespace $INSTANCE_TAG_NAMESPACE"
+    fi
+    for kind in backup secrets; do
+        oci_cmd "iam tag get --tag-namespace-id $namespace_id --tag-name $kind" >/dev/null 2>&1 && continue
+        oci_cmd "iam tag create --tag-namespace-id $namespace_id --name $kind \
+            --description 'Set to true on instances granted $kind access'" >/dev/null || {
+            print_error "Failed to create tag $INSTANCE_TAG_NAMESPACE.$kind"; return 1; }
+        print_success "Created tag $INSTANCE_TAG_NAMESPACE.$kind"
+    done
 }
 
-variable "free_tier_max_arm_ocpus" {
-  description = "Maximum ARM OCPUs for Oracle Free Tier"
-  type        = number
-  default     = $FREE_TIER_MAX_ARM_OCPUS
+# Dynamic groups and policies letting the tagged instances reach the backup bucket and the
+# secrets vault through instance principals. Writing them takes IAM administration rights,
+# so they are set up here from the admin session rather than by Terraform.
+iam_bootstrap_instance_access() {
+    local kind grant name description statements group_id rule
+    [ -n "$(instance_access_kinds)" ] || return 0
+    iam_ensure_instance_tags || return 1
+    for kind in $(instance_access_kinds); do
+        grant=$(instance_access_grants "$kind")
+        if [ -z "$grant" ]; then
+            print_warning "No secrets vault yet: apply first, then run '$0 bootstrap-iam --instance-access' again"
+            print_warning "with tenancy-admin credentials to let the instances read it"
+            continue
+        fi
+        IFS='|' read -r name description statements <<< "$grant"
+        rule=$(instance_access_matching_rule "$kind")
+        group_id=$(iam_find_by_name dynamic-group "$name")
+        if [ -z "$group_id" ]; then
+            oci_cmd "iam dynamic-group create --compartment-id $tenancy_ocid --name $name \
+                --description '$description' --matching-rule \"$rule\"" >/dev/null || {
+                print_error "Failed to create dynamic group $name"; return 1; }
+            print_success "Created dynamic group $name"
+        else
+            oci_cmd "iam dynamic-group update --dynamic-group-id $group_id --matching-rule \"$rule\" --force" >/dev/null || {
+                print_error "Failed to update dynamic group $name"; return 1; }
+            print_success "Updated dynamic group $name"
+        fi
+        iam_upsert_policy "$name" "$kind access for $name" "$statements" || return 1
+    done
 }
 
-variable "free_tier_max_arm_memory_gb" {
-  description = "Maximum ARM memory for Oracle Free Tier"
-  type        = number
-  default     = $FREE_TIER_MAX_ARM_MEMORY_GB
+# Print the OCID of the named IAM user/group/policy in the tenancy (empty if absent)
+iam_find_by_name() {
+    local kind="$1" name="$2" id
+    id=$(oci_cmd "iam $kind list --compartment-id $tenancy_ocid --all \
+        --query 'data[?name==\`$name\`].id | [0]' --raw-output" 2>/dev/null) || id=""
+    [ "$id" = "null" ] && id=""
+    echo "$id"
 }
 
-# Validation checks
-check "storage_limit" {
-  assert {
-    condition     = local.total_storage <= var.free_tier_max_storage_gb
-    error_message = "Total storage (\${local.total_storage}GB) exceeds Free Tier limit (\${var.free_tier_max_storage_gb}GB)"
-  }
+# True when the user is a member of the group
+iam_group_has_user() {
+    local group_id="$1" user_id="$2" ids
+    ids=$(oci_cmd "iam group list-users --group-id $group_id --all --query 'data[].id'" 2>/dev/null) || return 1
+    jq -e --arg u "$user_id" 'index($u) != null' <<< "$ids" >/dev/null 2>&1
 }
 
-check "arm_ocpu_limit" {
-  assert {
-    condition     = local.arm_flex_instance_count == 0 || sum(local.arm_flex_ocpus_per_instance) <= var.free_tier_max_arm_ocpus
-    error_message = "Total ARM OCPUs exceed Free Tier limit (\${var.free_tier_max_arm_ocpus})"
-  }
+# Replace (or add) a profile section in the OCI config file
+write_oci_config_profile() {
+    local profile="$1"
+    shift
+    cp "$OCI_CONFIG_FILE" "$OCI_CONFIG_FILE.bak.$(date +%Y%m%d_%H%M%S)"
+    awk -v profile="[$profile]" '
+        /^[[:space:]]*\[/ { skip = ($0 == profile) }
+        !skip
+    ' "$OCI_CONFIG_FILE" > "$OCI_CONFIG_FILE.tmp"
+    {
+        echo ""
+        echo "[$profile]"
+        printf '%s\n' "$@"
+    } >> "$OCI_CONFIG_FILE.tmp"
+    mv "$OCI_CONFIG_FILE.tmp" "$OCI_CONFIG_FILE"
+    chmod 600 "$OCI_CONFIG_FILE"
 }
 
-check "arm_memory_limit" {
-  assert {
-    condition     = local.arm_flex_instance_count == 0 || sum(local.arm_flex_memory_per_instance) <= var.free_tier_max_arm_memory_gb
-    error_message = "Total ARM memory exceeds Free Tier limit (\${var.free_tier_max_arm_memory_gb}GB)"
-  }
-}
-EOF
-    
-    print_success "variables.tf created"
-}
+# bootstrap-iam: create a dedicated user/group/policy with an API key from the current
+# (tenancy admin) session, then switch the tool and provider.tf to that identity
+bootstrap_iam() {
+    print_header "IAM BOOTSTRAP"
 
-create_terraform_datasources() {
-    print_status "Creating data_sources.tf..."
-    
-    [ -f "data_sources.tf" ] && cp data_sources.tf "data_sources.tf.bak.$(date +%Y%m%d_%H%M%S)"
-    
-    cat > data_sources.tf << 'EOF'
-# OCI Data Sources
-# Fetches dynamic information from Oracle Cloud
+    local instance_access_only=false
+    if [ "${1:-}" = "--instance-access" ]; then
+        instance_access_only=true
+    elif [ $# -gt 0 ]; then
+        print_error "Usage: bootstrap-iam [--instance-access]"
+        return 2
+    fi
+
+    local statements kind grant
+    statements=$(iam_bootstrap_statements "$IAM_BOOTSTRAP_GROUP")
+    if [ "$instance_access_only" != "true" ]; then
+        print_status "User:   $IAM_BOOTSTRAP_USER"
+        print_status "Group:  $IAM_BOOTSTRAP_GROUP"
+        print_status "Policy: $IAM_BOOTSTRAP_POLICY"
+        jq -r '.[] | "  " + .' <<< "$statements"
+    fi
+    for kind in $(instance_access_kinds); do
+        grant=$(instance_access_grants "$kind")
+        [ -n "$grant" ] || continue
+        print_status "Dynamic group: ${grant%%|*} ($(instance_access_matching_rule "$kind"))"
+        jq -r '.[] | "  " + .' <<< "${grant##*|}"
+    done
+
+    if [ "$DRY_RUN" = "true" ]; then
+        if [ "$instance_access_only" = "true" ]; then
+            print_status "[dry-run] Would create the tag namespace $INSTANCE_TAG_NAMESPACE and the dynamic groups above"
+        else
+            print_status "[dry-run] Would create the identity above, upload an API key and add profile [$IAM_BOOTSTRAP_PROFILE] to $OCI_CONFIG_FILE"
+        fi
+        return 0
+    fi
+    if [ "$instance_access_only" = "true" ]; then
+        confirm_action "Create the instance access above using the current ($OCI_PROFILE) credentials?" "N" || return 1
+        iam_bootstrap_instance_access
+        return
+    fi
+    if ! confirm_action "Create this identity using the current ($OCI_PROFILE) credentials?" "N"; then
+        return 1
+    fi
+
+    local group_id user_id
+    group_id=$(iam_find_by_name group "$IAM_BOOTSTRAP_GROUP")
+    if [ -z "$group_id" ]; then
+        group_id=$(oci_cmd "iam group create --compartment-id $tenancy_ocid --name $IAM_BOOTSTRAP_GROUP \
+            --description 'CloudCradle operators' --query 'data.id' --raw-output") || {
+            print_error "Failed to create group $IAM_BOOTSTRAP_GROUP"; return 1; }
+        print_success "Created group $IAM_BOOTSTRAP_GROUP"
+    else
+        print_status "Group $IAM_BOOTSTRAP_GROUP already exists"
+    fi
+
+    user_id=$(iam_find_by_name user "$IAM_BOOTSTRAP_USER")
+    if [ -z "$user_id" ]; then
+        local email_arg=""
+        [ -n "$IAM_BOOTSTRAP_EMAIL" ] && email_arg="--email $IAM_BOOTSTRAP_EMAIL"
+        user_id=$(oci_cmd "iam user create --compartment-id $tenancy_ocid --name $IAM_BOOTSTRAP_USER $email_arg \
+            --description 'CloudCradle automation user' --query 'data.id' --raw-output") || {
+            print_error "Failed to create user $IAM_BOOTSTRAP_USER (identity-domain tenancies need IAM_BOOTSTRAP_EMAIL)"; return 1; }
+        print_success "Created user $IAM_BOOTSTRAP_USER"
+    else
+        print_status "User $IAM_BOOTSTRAP_USER already exists"
+    fi
+
+    if ! iam_group_has_user "$group_id" "$user_id"; then
+        oci_cmd "iam group add-user --group-id $group_id --user-id $user_id" >/dev/null 2>&1 || true
+        if ! iam_group_has_user "$group_id" "$user_id"; then
+            print_error "Failed to add $IAM_BOOTSTRAP_USER to group $IAM_BOOTSTRAP_GROUP"
+            return 1
+        fi
+        print_success "Added $IAM_BOOTSTRAP_USER to group $IAM_BOOTSTRAP_GROUP"
+    fi
 
-# Availability Domains
-data "oci_identity_availability_domains" "ads" {
-  compartment_id = local.tenancy_ocid
-}
+    iam_upsert_policy "$IAM_BOOTSTRAP_POLICY" "Least-privilege access for CloudCradle" "$statements" || return 1
+    iam_bootstrap_instance_access || return 1
 
-# Tenancy Information
-data "oci_identity_tenancy" "tenancy" {
-  tenancy_id = local.tenancy_ocid
-}
+    # API signing key for the new user
+    local key_file="$OCI_DIR/${IAM_BOOTSTRAP_USER}_api_key.pem"
+    local key_fingerprint
+    if [ ! -f "$key_file" ]; then
+        openssl genrsa -out "$key_file" 2048 2>/dev/null
+        chmod 600 "$key_file"
+    fi
+    openssl rsa -pubout -in "$key_file" -out "${key_file%.pem}_public.pem" 2>/dev/null
+    key_fingerprint=$(openssl rsa -pubout -outform DER -in "$key_file" 2>/dev/null | openssl md5 -c | awk '{print $NF}')
+    if ! oci_cmd "iam user api-key list --user-id $user_id --query 'data[].fingerprint'" 2>/dev/null | grep -q "$key_fingerprint"; then
+        oci_cmd "iam user api-key upload --user-id $user_id --key-file ${key_file%.pem}_public.pem" >/dev/null || {
+            print_error "Failed to upload API key (users may hold at most 3 keys)"; return 1; }
+        print_success "Uploaded API key $key_fingerprint"
+    fi
 
-# Available Regions
-data "oci_identity_regions" "regions" {}
+    write_oci_config_profile "$IAM_BOOTSTRAP_PROFILE" \
+        "user=$user_id" "fingerprint=$key_fingerprint" "key_file=$(oci_native_path "$key_file")" \
+        "tenancy=$tenancy_ocid" "region=$region"
+    print_success "Added profile [$IAM_BOOTSTRAP_PROFILE] to $OCI_CONFIG_FILE"
 
-# Region Subscriptions
-data "oci_identity_region_subscriptions" "subscriptions" {
-  tenancy_id = local.tenancy_ocid
-}
-EOF
-    
-    print_success "data_sources.tf created"
-}
+    # Switch this session (and provider.tf) to the new identity; new keys and policies can
+    # take a minute. Listing instances needs the policy, unlike listing regions.
+    OCI_PROFILE="$IAM_BOOTSTRAP_PROFILE"
+    OCI_CLI_AUTH="api_key"
+    auth_method="api_key"
+    local attempt verified=false
+    for attempt in 1 2 3 4 5 6; do
+        if oci_cmd "compute instance list --compartment-id $tenancy_ocid --limit 1" >/dev/null 2>&1; then
+            verified=true
+            break
+        fi
+        print_debug "New credentials or policy not in effect yet (attempt $attempt)"
+        sleep 10
+    done
+    if [ "$verified" = "true" ]; then
+        print_success "Verified that $IAM_BOOTSTRAP_USER can list instances under the new policy"
+    else
+        print_warning "New credentials or policy not in effect yet; IAM changes can take a few minutes to propagate"
+    fi
+    if [ -f provider.tf ]; then
+        create_terraform_provider
+    fi
 
-create_terraform_main() {
-    print_status "Creating main.tf..."
-    
-    [ -f "main.tf" ] && cp main.tf "main.tf.bak.$(date +%Y%m%d_%H%M%S)"
-    
-    cat > main.tf << 'EOFMAIN'
-# Oracle Cloud Infrastructure - Main Configuration
-# Always Free Tier Optimized
+    echo ""
+    print_status "Use the new identity from now on with:"
+    echo "  export OCI_CLI_PROFILE=$IAM_BOOTSTRAP_PROFILE OCI_CLI_AUTH=api_key"
+    print_status "Tenancy-admin credentials are no longer needed for day-to-day runs."
+}
 
 # ============================================================================
-# NETWORKING
+# PLAN CACHE
 # ============================================================================
 
-resource "oci_core_vcn" "main" {
-  compartment_id = local.compartment_id
-  cidr_blocks    = ["10.0.0.0/16"]
-  display_name   = "main-vcn"
-  dns_label      = "mainvcn"
-  is_ipv6enabled = true
-  
-  freeform_tags = {
-    "Purpose" = "AlwaysFreeTier"
-    "Managed" = "Terraform"
-  }
+sha256_stdin() {
+    if command_exists sha256sum; then
+        sha256sum | awk '{print $1}'
+    else
+        shasum -a 256 | awk '{print $1}'
+    fi
 }
 
-resource "oci_core_internet_gateway" "main" {
-  compartment_id = local.compartment_id
-  vcn_id         = oci_core_vcn.main.id
-  display_name   = "main-igw"
-  enabled        = true
+# Modification time of a file in epoch seconds (GNU stat, then BSD stat)
+file_mtime() {
+    stat -c %Y "$1" 2>/dev/null || stat -f %m "$1" 2>/dev/null
 }
 
-resource "oci_core_default_route_table" "main" {
-  manage_default_resource_id = oci_core_vcn.main.default_route_table_id
-  display_name               = "main-rt"
-  
-  route_rules {
-    destination       = "0.0.0.0/0"
-    destination_type  = "CIDR_BLOCK"
-    network_entity_id = oci_core_internet_gateway.main.id
-  }
-  
-  route_rules {
-    destination       = "::/0"
-    destination_type  = "CIDR_BLOCK"
-    network_entity_id = oci_core_internet_gateway.main.id
-  }
+# Current time in epoch microseconds; bash before 5.0 has no EPOCHREALTIME, so whole seconds
+epoch_us() {
+    if [ -n "${EPOCHREALTIME:-}" ]; then
+        echo "${EPOCHREALTIME/[.,]/}"
+    else
+        echo "$(date +%s)000000"
+    fi
 }
 
-resource "oci_core_default_security_list" "main" {
-  manage_default_resource_id = oci_core_vcn.main.default_security_list_id
-  display_name               = "main-sl"
-  
-  # Allow all egress
-  egress_security_rules {
-    destination = "0.0.0.0/0"
-    protocol    = "all"
-  }
-  
-  egress_security_rules {
-    destination = "::/0"
-    protocol    = "all"
-  }
-  
-  # SSH (IPv4)
-  ingress_security_rules {
-    protocol = "6"
-    source   = "0.0.0.0/0"
-    tcp_options {
-      min = 22
-      max = 22
-    }
-  }
-  # SSH (IPv6)
-  ingress_security_rules {
-    protocol = "6"
-    source   = "::/0"
-    tcp_options {
-      min = 22
-      max = 22
-    }
-  }
-  
-  # HTTP (IPv4)
-  ingress_security_rules {
-    protocol = "6"
-    source   = "0.0.0.0/0"
-    tcp_options {
-      min = 80
-      max = 80
-    }
-  }
-  # HTTP (IPv6)
-  ingress_security_rules {
-    protocol = "6"
-    source   = "::/0"
-    tcp_options {
-      min = 80
-      max = 80
-    }
-  }
-  
-  # HTTPS (IPv4)
-  ingress_security_rules {
-    protocol = "6"
-    source   = "0.0.0.0/0"
-    tcp_options {
-      min = 443
-      max = 443
-    }
-  }
-  # HTTPS (IPv6)
-  ingress_security_rules {
-    protocol = "6"
-    source   = "::/0"
-    tcp_options {
-      min = 443
-      max = 443
-    }
-  }
-  
-  # ICMP (IPv4)
-  ingress_security_rules {
-    protocol = "1"
-    source   = "0.0.0.0/0"
-  }
-  # ICMP (IPv6)
-  ingress_security_rules {
-    protocol = "1"
-    source   = "::/0"
-  }
+# Stable, sorted dump of the discovered tenancy resources
+dump_inventory() {
+    local id
+    {
+        for id in "${!EXISTING_VCNS[@]}"; do echo "vcn $id ${EXISTING_VCNS[$id]}"; done
+        for id in "${!EXISTING_SUBNETS[@]}"; do echo "subnet $id ${EXISTING_SUBNETS[$id]}"; done
+        for id in "${!EXISTING_INTERNET_GATEWAYS[@]}"; do echo "igw $id ${EXISTING_INTERNET_GATEWAYS[$id]}"; done
+        for id in "${!EXISTING_ROUTE_TABLES[@]}"; do echo "rt $id ${EXISTING_ROUTE_TABLES[$id]}"; done
+        for id in "${!EXISTING_SECURITY_LISTS[@]}"; do echo "sl $id ${EXISTING_SECURITY_LISTS[$id]}"; done
+        for id in "${!EXISTING_NSGS[@]}"; do echo "nsg $id ${EXISTING_NSGS[$id]}"; done
+        for id in "${!EXISTING_RESERVED_IPS[@]}"; do echo "rip $id ${EXISTING_RESERVED_IPS[$id]}"; done
+        for id in "${!EXISTING_AMD_INSTANCES[@]}"; do echo "amd $id ${EXISTING_AMD_INSTANCES[$id]}"; done
+        for id in "${!EXISTING_ARM_INSTANCES[@]}"; do echo "arm $id ${EXISTING_ARM_INSTANCES[$id]}"; done
+        for id in "${!EXISTING_BOOT_VOLUMES[@]}"; do echo "boot $id ${EXISTING_BOOT_VOLUMES[$id]}"; done
+        for id in "${!EXISTING_BLOCK_VOLUMES[@]}"; do echo "block $id ${EXISTING_BLOCK_VOLUMES[$id]}"; done
+    } | sort
 }
 
-resource "oci_core_subnet" "main" {
-  compartment_id = local.compartment_id
-  vcn_id         = oci_core_vcn.main.id
-  cidr_block     = "10.0.1.0/24"
-  display_name   = "main-subnet"
-  dns_label      = "mainsubnet"
-  
-  route_table_id    = oci_core_default_route_table.main.id
-  security_list_ids = [oci_core_default_security_list.main.id]
-  
-  # IPv6 - use first /64 block from VCN's /56
-  ipv6cidr_blocks = [cidrsubnet(oci_core_vcn.main.ipv6cidr_blocks[0], 8, 0)]
+# Hash of everything that determines the plan: generated config (minus timestamps),
+# the tenancy inventory and the plan options
+compute_plan_cache_key() {
+    local f
+    {
+        for f in *.tf cloud-init.yaml; do
+            [ -f "$f" ] || continue
+            echo "== $f"
+            grep -v -e '^# Generated:' -e '# cloudcradle: ' "$f"
+        done
+        echo "== inventory"
+        dump_inventory
+        echo "== options"
+        terraform_plan_args
+    } | sha256_stdin
 }
 
-# ============================================================================
-# COMPUTE INSTANCES
-# ============================================================================
-
-# AMD x86 Micro Instances
-resource "oci_core_instance" "amd" {
-  count = local.amd_micro_instance_count
-  
-  availability_domain = data.oci_identity_availability_domains.ads.availability_domains[0].name
-  compartment_id      = local.compartment_id
-  display_name        = local.amd_micro_hostnames[count.index]
-  shape               = "VM.Standard.E2.1.Micro"
-  
-  create_vnic_details {
-    subnet_id        = oci_core_subnet.main.id
-    display_name     = "${local.amd_micro_hostnames[count.index]}-vnic"
-    assign_public_ip = true
-    assign_ipv6ip    = true
-    hostname_label   = local.amd_micro_hostnames[count.index]
-  }
-  
-  source_details {
-    source_type             = "image"
-    source_id               = local.ubuntu_x86_image_ocid
-    boot_volume_size_in_gbs = local.amd_micro_boot_volume_size_gb
-  }
-  
-  metadata = {
-    ssh_authorized_keys = local.ssh_pubkey_data
-    user_data = base64encode(templatefile("${path.module}/cloud-init.yaml", {
-      hostname = local.amd_micro_hostnames[count.index]
-    }))
-  }
-  
-  freeform_tags = {
-    "Purpose"      = "AlwaysFreeTier"
-    "InstanceType" = "AMD-Micro"
-    "Managed"      = "Terraform"
-  }
-  
-  lifecycle {
-    ignore_changes = [
-      source_details[0].source_id,  # Ignore image updates
-      defined_tags,
-    ]
-  }
+# Lineage and serial identify the exact state a saved plan was created against
+terraform_state_fingerprint() {
+    terraform state pull 2>/dev/null | jq -r '"\(.lineage // ""):\(.serial // "")"' 2>/dev/null || echo ":"
 }
 
-# ARM A1 Flex Instances
-resource "oci_core_instance" "arm" {
-  count = local.arm_flex_instance_count
-  
-  availability_domain = data.oci_identity_availability_domains.ads.availability_domains[0].name
-  compartment_id      = local.compartment_id
-  display_name        = local.arm_flex_hostnames[count.index]
-  shape               = "VM.Standard.A1.Flex"
-  
-  shape_config {
-    ocpus         = local.arm_flex_ocpus_per_instance[count.index]
-    memory_in_gbs = local.arm_flex_memory_per_instance[count.index]
-  }
-  
-  create_vnic_details {
-    subnet_id        = oci_core_subnet.main.id
-    display_name     = "${local.arm_flex_hostnames[count.index]}-vnic"
-    assign_public_ip = true
-    assign_ipv6ip    = true
-    hostname_label   = local.arm_flex_hostnames[count.index]
-  }
-  
-  source_details {
-    source_type             = "image"
-    source_id               = local.ubuntu_arm_image_ocid
-    boot_volume_size_in_gbs = local.arm_flex_boot_volume_size_gb[count.index]
-  }
-  
-  metadata = {
-    ssh_authorized_keys = local.ssh_pubkey_data
-    user_data = base64encode(templatefile("${path.module}/cloud-init.yaml", {
-      hostname = local.arm_flex_hostnames[count.index]
-    }))
-  }
-  
-  freeform_tags = {
-    "Purpose"      = "AlwaysFreeTier"
-    "InstanceType" = "ARM-A1-Flex"
-    "Managed"      = "Terraform"
-  }
-  
-  lifecycle {
-    ignore_changes = [
-      source_details[0].source_id,
-      defined_tags,
-    ]
-  }
-}
+plan_cache_is_valid() {
+    local key="$1"
 
-# ============================================================================
-# PER-INSTANCE IPv6: Reserve an IPv6 for each instance VNIC
-# Docs: "Creates an IPv6 for the specified VNIC." and "lifetime: Ephemeral | Reserved" (OCI Terraform provider)
-# ============================================================================
+    [ "$TF_PLAN_CACHE" = "true" ] || return 1
+    [ -f tfplan ] && [ -f "$TF_PLAN_CACHE_FILE" ] || return 1
 
-data "oci_core_vnic_attachments" "amd_vnics" {
-  count = local.amd_micro_instance_count
-  compartment_id = local.compartment_id
-  instance_id    = oci_core_instance.amd[count.index].id
-}
+    local cached_key cached_state
+    cached_key=$(jq -r '.key // ""' "$TF_PLAN_CACHE_FILE" 2>/dev/null) || return 1
+    cached_state=$(jq -r '.state // ""' "$TF_PLAN_CACHE_FILE" 2>/dev/null) || return 1
 
-resource "oci_core_ipv6" "amd_ipv6" {
-  count = local.amd_micro_instance_count
-  vnic_id = data.oci_core_vnic_attachments.amd_vnics[count.index].vnic_attachments[0].vnic_id
-  lifetime = "RESERVED"
-  subnet_id = oci_core_subnet.main.id
-  route_table_id = oci_core_default_route_table.main.id
-  display_name = "amd-${local.amd_micro_hostnames[count.index]}-ipv6"
-  freeform_tags = {
-    "Purpose" = "AlwaysFreeTier"
-    "Managed" = "Terraform"
-  }
+    if [ "$cached_key" != "$key" ]; then
+        print_debug "Plan cache miss: config/inventory hash changed"
+        return 1
+    fi
+    if [ "$cached_state" != "$(terraform_state_fingerprint)" ]; then
+        print_debug "Plan cache miss: state serial changed since plan was created"
+        return 1
+    fi
+    return 0
 }
 
-data "oci_core_vnic_attachments" "arm_vnics" {
-  count = local.arm_flex_instance_count
-  compartment_id = local.compartment_id
-  instance_id    = oci_core_instance.arm[count.index].id
+save_plan_cache() {
+    [ "$TF_PLAN_CACHE" = "true" ] || return 0
+    jq -n --arg key "$1" --arg state "$(terraform_state_fingerprint)" --arg created "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+        '{key: $key, state: $state, created: $created}' > "$TF_PLAN_CACHE_FILE"
 }
 
-resource "oci_core_ipv6" "arm_ipv6" {
-  count = local.arm_flex_instance_count
-  vnic_id = data.oci_core_vnic_attachments.arm_vnics[count.index].vnic_attachments[0].vnic_id
-  lifetime = "RESERVED"
-  subnet_id = oci_core_subnet.main.id
-  route_table_id = oci_core_default_route_table.main.id
-  display_name = "arm-${local.arm_flex_hostnames[count.index]}-ipv6"
-  freeform_tags = {
-    "Purpose" = "AlwaysFreeTier"
-    "Managed" = "Terraform"
-  }
+terraform_menu() {
+    while true; do
+        echo ""
+        print_header "TERRAFORM MANAGEMENT"
+        echo "  1) Full workflow (init → import → plan → apply)"
+        echo "  2) Plan only"
+        echo "  3) Apply existing plan"
+        echo "  4) Import existing resources"
+        echo "  5) Show current state"
+        echo "  6) Destroy infrastructure"
+        echo "  7) Reconfigure"
+        echo "  8) Exit"
+        echo ""
+        
+        if [ "$AUTO_DEPLOY" = "true" ] || [ "$NON_INTERACTIVE" = "true" ]; then
+            choice=1
+            print_status "Auto mode: Running full workflow"
+        else
+            echo -n -e "${BLUE}Choose option [1]: ${NC}"
+            read -r choice
+            choice=${choice:-1}
+        fi
+        
+        case $choice in
+            1)
+                run_terraform_workflow
+                [ "$AUTO_DEPLOY" = "true" ] && return 0
+                ;;
+            2)
+                # shellcheck disable=SC2046  # intentional word splitting of option list
+                terraform init -input=false && prepare_terraform_selection \
+                    && terraform plan -input=false $(terraform_plan_args) "${TF_SELECTION_ARGS[@]}"
+                ;;
+            3)
+                if [ -f "tfplan" ]; then
+                    local changes
+                    changes=$(plan_changes tfplan)
+                    plan_summary "$changes"
+                    confirm_plan_destroy "$changes" || continue
+                    # shellcheck disable=SC2046  # intentional word splitting of option list
+                    terraform apply $(terraform_apply_args) tfplan && { store_backup_passwords || true; }
+                else
+                    print_error "No plan file found"
+                fi
+                ;;
+            4)
+                import_existing_resources
+                ;;
+            5)
+                if terraform state list 2>/dev/null && show_deployment_outputs; then
+                    :
+                else
+                    print_status "No state found"
+                fi
+                ;;
+            6)
+                if grep -qs 'prevent_destroy = true' main.tf block_volumes.tf modules/*/main.tf; then
+                    print_warning "Instances and block volumes are protected (PREVENT_DESTROY) - Terraform will refuse."
+                    print_status "Regenerate without the protection first: $0 --no-prevent-destroy --emit-only"
+                fi
+                if confirm_action "DESTROY all infrastructure?" "N"; then
+                    # shellcheck disable=SC2046  # intentional word splitting of option list
+                    terraform destroy $(terraform_plan_args)
+                fi
+                ;;
+            7)
+                return 1  # Signal to reconfigure
+                ;;
+            8)
+                return 0
+                ;;
+            *)
+                print_error "Invalid choice"
+                ;;
+        esac
+        
+        if [ "$NON_INTERACTIVE" = "true" ]; then
+            return 0
+        fi
+        
+        echo ""
+        echo -n -e "${BLUE}Press Enter to continue...${NC}"
+        read -r
+    done
 }
 
 # ============================================================================
-# OUTPUTS
+# SHELL COMPLETION AND REFERENCE DOCS
 # ============================================================================
 
-output "amd_instances" {
-  description = "AMD instance information"
-  value = local.amd_micro_instance_count > 0 ? {
-    for i in range(local.amd_micro_instance_count) : local.amd_micro_hostnames[i] => {
-      id         = oci_core_instance.amd[i].id
-      public_ip  = oci_core_instance.amd[i].public_ip
-      private_ip = oci_core_instance.amd[i].private_ip
-      ipv6       = oci_core_ipv6.amd_ipv6[i].ip_address
-      state      = oci_core_instance.amd[i].state
-      ssh        = "ssh -i ./ssh_keys/id_rsa ubuntu@${oci_core_instance.amd[i].public_ip}"
-    }
-  } : {}
-}
-
-output "arm_instances" {
-  description = "ARM instance information"
-  value = local.arm_flex_instance_count > 0 ? {
-    for i in range(local.arm_flex_instance_count) : local.arm_flex_hostnames[i] => {
-      id         = oci_core_instance.arm[i].id
-      public_ip  = oci_core_instance.arm[i].public_ip
-      private_ip = oci_core_instance.arm[i].private_ip
-      ipv6       = oci_core_ipv6.arm_ipv6[i].ip_address
-      state      = oci_core_instance.arm[i].state
-      ocpus      = local.arm_flex_ocpus_per_instance[i]
-      memory_gb  = local.arm_flex_memory_per_instance[i]
-      ssh        = "ssh -i ./ssh_keys/id_rsa ubuntu@${oci_core_instance.arm[i].public_ip}"
-    }
-  } : {}
+# Entries of a print_usage section ("Options" or "Commands"), one "synopsis<TAB>description"
+# line each. Completion and docs both read the help text, so they never drift from it.
+usage_entries() {
+    local section="$1" name
+    name=$(basename "$0")
+    print_usage | while IFS= read -r line; do printf '%s\n' "${line//"$0"/$name}"; done \
+        | awk -v section="$1:" -v col="$([ "$section" = "Options" ] && echo 22 || echo 18)" '
+            function flush() {
+                if (synopsis != "") print synopsis "\t" description
+                synopsis = ""; description = ""
+            }
+            $0 == section { on = 1; next }
+            on && /^[A-Z][A-Za-z]*:/ { flush(); on = 0 }
+            !on { next }
+            /^[[:space:]]*$/ { flush(); next }
+            /^  [^ ]/ {
+                flush()
+                line = substr($0, 3)
+                split_at = index(line, "  ")
+                if (split_at > 0) {
+                    synopsis = substr(line, 1, split_at - 1)
+                    description = substr(line, split_at)
+                    sub(/^ +/, "", description)
+                } else {
+                    synopsis = line
+                }
+                next
+            }
+            {
+                match($0, /^ */)
+                text = substr($0, RLENGTH + 1)
+                if (RLENGTH < col) synopsis = synopsis " " text
+                else description = (description == "" ? text : description " " text)
+            }
+            END { flush() }'
 }
 
-output "network" {
-  description = "Network information"
-  value = {
-    vcn_id     = oci_core_vcn.main.id
-    vcn_cidr   = oci_core_vcn.main.cidr_blocks[0]
-    subnet_id  = oci_core_subnet.main.id
-    subnet_cidr = oci_core_subnet.main.cidr_block
-  }
+# Command names from the help text ("stop|start|reboot" gives three)
+usage_commands() {
+    usage_entries Commands | cut -f1 | awk '{ print $1 }' | tr '|' '\n' | grep -v '^(none)$' | awk '!seen[$0]++'
 }
 
-output "summary" {
-  description = "Infrastructure summary"
-  value = {
-    region          = local.region
-    total_amd       = local.amd_micro_instance_count
-    total_arm       = local.arm_flex_instance_count
-    total_storage   = local.total_storage
-    free_tier_limit = 200
-  }
-}
-EOFMAIN
-    
-    print_success "main.tf created"
+# Synopses of one command ("backup" has several)
+usage_command_synopses() {
+    usage_entries Commands | cut -f1 | awk -v c="$1" '{ n = split($1, names, "|"); for (i = 1; i <= n; i++) if (names[i] == c) { print; break } }'
 }
 
-create_terraform_block_volumes() {
-    print_status "Creating block_volumes.tf..."
-    
-    [ -f "block_volumes.tf" ] && cp block_volumes.tf "block_volumes.tf.bak.$(date +%Y%m%d_%H%M%S)"
-    
-    cat > block_volumes.tf << 'EOF'
-# Block Volume Resources (Optional)
-# Block volumes provide additional storage beyond boot volumes
-
-# AMD Block Volumes
-resource "oci_core_volume" "amd_block" {
-  count = local.amd_block_volume_size_gb > 0 ? local.amd_micro_instance_count : 0
-  
-  compartment_id      = local.compartment_id
-  availability_domain = data.oci_identity_availability_domains.ads.availability_domains[0].name
-  display_name        = "${local.amd_micro_hostnames[count.index]}-block"
-  size_in_gbs         = local.amd_block_volume_size_gb
-  
-  freeform_tags = {
-    "Purpose" = "AlwaysFreeTier"
-    "Type"    = "BlockVolume"
-    "Managed" = "Terraform"
-  }
+# Values a flag takes, from its synopsis: "choices a b c", a placeholder such as "PROFILE",
+# or nothing for a switch
+usage_flag_value() {
+    local flag="$1"
+    { usage_entries Options; usage_entries Commands; } | cut -f1 | tr -d '[]' | awk -v f="$flag" '
+        { for (i = 1; i <= NF; i++) {
+            word = $i; sub(/,$/, "", word)
+            if (word != f) continue
+            next_word = (i < NF ? $(i + 1) : ""); sub(/,$/, "", next_word)
+            if (next_word == "" || next_word ~ /^-/) { print ""; exit }
+            if (next_word ~ /^[a-z0-9.-]+(\|[a-z0-9.-]+)+$/) { gsub(/\|/, " ", next_word); print "choices " next_word; exit }
+            print next_word; exit
+        } }'
 }
 
-resource "oci_core_volume_attachment" "amd_block" {
-  count = local.amd_block_volume_size_gb > 0 ? local.amd_micro_instance_count : 0
-  
-  attachment_type = "paravirtualized"
-  instance_id     = oci_core_instance.amd[count.index].id
-  volume_id       = oci_core_volume.amd_block[count.index].id
+# Instance hostnames of the workspace's variables.tf
+completion_instances() {
+    grep -oP '(amd_micro|arm_flex)_hostnames\s*=\s*\[\K[^\]]+' variables.tf 2>/dev/null | tr ',' '\n' | tr -d '" ' | grep -v '^$'
 }
 
-# ARM Block Volumes
-resource "oci_core_volume" "arm_block" {
-  count = local.arm_flex_instance_count > 0 ? length([for s in local.arm_block_volume_sizes : s if s > 0]) : 0
-  
-  compartment_id      = local.compartment_id
-  availability_domain = data.oci_identity_availability_domains.ads.availability_domains[0].name
-  display_name        = "${local.arm_flex_hostnames[count.index]}-block"
-  size_in_gbs         = [for s in local.arm_block_volume_sizes : s if s > 0][count.index]
-  
-  freeform_tags = {
-    "Purpose" = "AlwaysFreeTier"
-    "Type"    = "BlockVolume"
-    "Managed" = "Terraform"
-  }
+completion_profiles() {
+    sed -n 's/^[[:space:]]*\[\(.*\)\][[:space:]]*$/\1/p' "$OCI_CONFIG_FILE" 2>/dev/null
 }
 
-resource "oci_core_volume_attachment" "arm_block" {
-  count = local.arm_flex_instance_count > 0 ? length([for s in local.arm_block_volume_sizes : s if s > 0]) : 0
-  
-  attachment_type = "paravirtualized"
-  instance_id     = oci_core_instance.arm[count.index].id
-  volume_id       = oci_core_volume.arm_block[count.index].id
-}
-EOF
-    
-    print_success "block_volumes.tf created"
+completion_tenancies() {
+    local dir
+    for dir in "$TENANCIES_DIR"/*/; do
+        [ -f "$dir$TENANCY_FILE" ] && basename "$dir"
+    done
 }
 
-create_cloud_init() {
-    print_status "Creating cloud-init.yaml..."
-    
-    [ -f "cloud-init.yaml" ] && cp cloud-init.yaml "cloud-init.yaml.bak.$(date +%Y%m%d_%H%M%S)"
-    
-    cat > cloud-init.yaml << 'EOF'
-#cloud-config
-hostname: ${hostname}
-fqdn: ${hostname}.local
-manage_etc_hosts: true
-
-package_update: true
-package_upgrade: true
-
-packages:
-  - curl
-  - wget
-  - git
-  - htop
-  - vim
-  - unzip
-  - jq
-  - tmux
-  - net-tools
-  - iotop
-  - ncdu
-
-runcmd:
-  - echo "Instance ${hostname} initialized at $(date)" >> /var/log/cloud-init-complete.log
-  - systemctl enable --now fail2ban || true
-
-# Basic security hardening
-write_files:
-  - path: /etc/ssh/sshd_config.d/hardening.conf
-    content: |
-      PermitRootLogin no
-      PasswordAuthentication no
-      MaxAuthTries 3
-      ClientAliveInterval 300
-      ClientAliveCountMax 2
-
-timezone: UTC
-ssh_pwauth: false
-
-final_message: "Instance ${hostname} ready after $UPTIME seconds"
-EOF
-    
-    print_success "cloud-init.yaml created"
+# Candidates for a value placeholder or flag
+completion_values() {
+    local flag="$1" spec="$2"
+    case "$flag" in
+        --profile) completion_profiles; return ;;
+        --region) tr ' ' '\n' <<< "$OCI_PUBLIC_REGIONS" | grep -v '^$'; return ;;
+        --tenancy) completion_tenancies; return ;;
+        --os) tr ' ' '\n' <<< "$SUPPORTED_OSES"; return ;;
+        --ubuntu-version) tr ' ' '\n' <<< "$SUPPORTED_UBUNTU_VERSIONS"; return ;;
+        --provision) tr ' ' '\n' <<< "$PROVISIONER_MODULES none"; return ;;
+    esac
+    case "$spec" in
+        choices\ *) tr ' ' '\n' <<< "${spec#choices }" ;;
+        INSTANCE|INSTANCE,*) completion_instances ;;
+    esac
 }
 
-# ============================================================================
-# TERRAFORM IMPORT AND STATE MANAGEMENT
-# ============================================================================
+# __complete WORD...: candidates for the last word of a command line (the words after the
+# script name), used by the scripts 'completion' prints
+complete_command_line() {
+    local -a words=("$@")
+    [ ${#words[@]} -gt 0 ] || words=("")
+    local current="${words[-1]}" command="" sub="" spec i word
+    local -a positional=()
 
-import_existing_resources() {
-    print_header "IMPORTING EXISTING RESOURCES"
-    
-    if [ ${#EXISTING_VCNS[@]} -eq 0 ] && [ ${#EXISTING_AMD_INSTANCES[@]} -eq 0 ] && [ ${#EXISTING_ARM_INSTANCES[@]} -eq 0 ]; then
-        print_status "No existing resources to import"
-        return 0
-    fi
-    
-    # Initialize Terraform first
-    print_status "Initializing Terraform..."
-    if ! retry_with_backoff "terraform init -input=false" >/dev/null 2>&1; then
-        print_error "Terraform init failed after retries"
-        return 1
-    fi
-    
-    local imported=0
-    local failed=0
-    
-    # Import VCN
-    if [ ${#EXISTING_VCNS[@]} -gt 0 ]; then
-        local first_vcn_id
-        first_vcn_id=$(echo "${!EXISTING_VCNS[@]}" | tr ' ' '\n' | head -1)
-        
-        if [ -n "$first_vcn_id" ]; then
-            local vcn_name
-            vcn_name=$(echo "${EXISTING_VCNS[$first_vcn_id]}" | cut -d'|' -f1)
-            print_status "Importing VCN: $vcn_name"
-            
-            if terraform state show oci_core_vcn.main >/dev/null 2>&1; then
-                print_status "  Already in state"
-            elif run_cmd_with_retries_and_check "terraform import oci_core_vcn.main \"$first_vcn_id\"" >/dev/null 2>&1; then
-                print_success "  Imported successfully"
-                imported=$((imported + 1))
-                
-                # Import related networking resources
-                import_vcn_components "$first_vcn_id"
-            else
-                print_warning "  Failed to import (see logs above)"
-                failed=$((failed + 1))
-            fi
-        fi
-    fi
-    
-    # Import AMD instances
-    local amd_index=0
-    for instance_id in "${!EXISTING_AMD_INSTANCES[@]}"; do
-        local instance_name
-        instance_name=$(echo "${EXISTING_AMD_INSTANCES[$instance_id]}" | cut -d'|' -f1)
-        print_status "Importing AMD instance: $instance_name"
-        
-        if terraform state show "oci_core_instance.amd[$amd_index]" >/dev/null 2>&1; then
-            print_status "  Already in state"
-        elif run_cmd_with_retries_and_check "terraform import \"oci_core_instance.amd[$amd_index]\" \"$instance_id\"" >/dev/null 2>&1; then
-            print_success "  Imported successfully"
-            imported=$((imported + 1))
-        else
-            print_warning "  Failed to import (see logs above)"
-            failed=$((failed + 1))
+    # The command is the first word that is neither a flag nor a flag's value
+    for ((i = 0; i < ${#words[@]} - 1; i++)); do
+        word="${words[$i]}"
+        if [[ "$word" == --* ]]; then
+            [[ "$word" == *=* ]] && continue
+            [ -n "$(usage_flag_value "$word")" ] && i=$((i + 1))
+            continue
         fi
-        
-        amd_index=$((amd_index + 1))
-        [ "$amd_index" -ge "$amd_micro_instance_count" ] && break
-    done
-    
-    # Import ARM instances
-    local arm_index=0
-    for instance_id in "${!EXISTING_ARM_INSTANCES[@]}"; do
-        local instance_name
-        instance_name=$(echo "${EXISTING_ARM_INSTANCES[$instance_id]}" | cut -d'|' -f1)
-        print_status "Importing ARM instance: $instance_name"
-        
-        if terraform state show "oci_core_instance.arm[$arm_index]" >/dev/null 2>&1; then
-            print_status "  Already in state"
-        elif run_cmd_with_retries_and_check "terraform import \"oci_core_instance.arm[$arm_index]\" \"$instance_id\"" >/dev/null 2>&1; then
-            print_success "  Imported successfully"
-            imported=$((imported + 1))
+        if [ -z "$command" ]; then
+            command="$word"
         else
-            print_warning "  Failed to import (see logs above)"
-            failed=$((failed + 1))
+            positional+=("$word")
         fi
-        
-        arm_index=$((arm_index + 1))
-        [ "$arm_index" -ge "$arm_flex_instance_count" ] && break
     done
-    
-    print_status ""
-    print_success "Import complete: $imported imported, $failed failed"
-}
+    [ ${#positional[@]} -gt 0 ] && sub="${positional[0]}"
 
-import_vcn_components() {
-    local vcn_id="$1"
-    
-    # Import Internet Gateway
-    for ig_id in "${!EXISTING_INTERNET_GATEWAYS[@]}"; do
-        local ig_vcn
-        ig_vcn=$(echo "${EXISTING_INTERNET_GATEWAYS[$ig_id]}" | cut -d'|' -f2)
-        if [ "$ig_vcn" = "$vcn_id" ]; then
-            if ! terraform state show oci_core_internet_gateway.main >/dev/null 2>&1; then
-                terraform import oci_core_internet_gateway.main "$ig_id" 2>/dev/null && \
-                    print_status "    Imported Internet Gateway" || true
-            fi
-            break
-        fi
-    done
-    
-    # Import Subnet
-    for subnet_id in "${!EXISTING_SUBNETS[@]}"; do
-        local subnet_vcn
-        subnet_vcn=$(echo "${EXISTING_SUBNETS[$subnet_id]}" | cut -d'|' -f3)
-        if [ "$subnet_vcn" = "$vcn_id" ]; then
-            if ! terraform state show oci_core_subnet.main >/dev/null 2>&1; then
-                terraform import oci_core_subnet.main "$subnet_id" 2>/dev/null && \
-                    print_status "    Imported Subnet" || true
-            fi
-            break
-        fi
-    done
-    
-    # Import Route Table (default)
-    for rt_id in "${!EXISTING_ROUTE_TABLES[@]}"; do
-        local rt_vcn rt_name
-        rt_vcn=$(echo "${EXISTING_ROUTE_TABLES[$rt_id]}" | cut -d'|' -f2)
-        rt_name=$(echo "${EXISTING_ROUTE_TABLES[$rt_id]}" | cut -d'|' -f1)
-        if [ "$rt_vcn" = "$vcn_id" ] && [[ "$rt_name" == *"Default"* || "$rt_name" == *"default"* ]]; then
-            if ! terraform state show oci_core_default_route_table.main >/dev/null 2>&1; then
-                terraform import oci_core_default_route_table.main "$rt_id" 2>/dev/null && \
-                    print_status "    Imported Route Table" || true
+    {
+        if [[ "$current" == --*=* ]]; then
+            spec=$(usage_flag_value "${current%%=*}")
+            completion_values "${current%%=*}" "$spec" | sed "s|^|${current%%=*}=|"
+        elif [ ${#words[@]} -ge 2 ] && [[ "${words[-2]}" == --* ]] && [[ "${words[-2]}" != *=* ]] \
+            && spec=$(usage_flag_value "${words[-2]}") && [ -n "$spec" ]; then
+            completion_values "${words[-2]}" "$spec"
+        elif [[ "$current" == -* ]]; then
+            usage_entries Options | cut -f1 | grep -oE -- '--[a-z0-9-]+'
+            [ -n "$command" ] && usage_command_synopses "$command" | grep -oE -- '--[a-z0-9-]+'
+        elif [ -z "$command" ]; then
+            usage_commands
+        else
+            local synopses subs
+            synopses=$(usage_command_synopses "$command")
+            # Second words that are subcommands: "backup status", "tenancy list|current"
+            subs=$(awk '$2 ~ /^[a-z][a-z|-]*$/ { print $2 }' <<< "$synopses" | tr '|' '\n')
+            if [ -n "$subs" ] && [ -z "$sub" ]; then
+                echo "$subs"
+                synopses=""
+            elif [ -n "$subs" ]; then
+                synopses=$(awk -v s="$sub" '{ n = split($2, names, "|"); for (i = 1; i <= n; i++) if (names[i] == s) { print; break } }' <<< "$synopses")
             fi
-            break
-        fi
-    done
-    
-    # Import Security List (default)
-    for sl_id in "${!EXISTING_SECURITY_LISTS[@]}"; do
-        local sl_vcn sl_name
-        sl_vcn=$(echo "${EXISTING_SECURITY_LISTS[$sl_id]}" | cut -d'|' -f2)
-        sl_name=$(echo "${EXISTING_SECURITY_LISTS[$sl_id]}" | cut -d'|' -f1)
-        if [ "$sl_vcn" = "$vcn_id" ] && [[ "$sl_name" == *"Default"* || "$sl_name" == *"default"* ]]; then
-            if ! terraform state show oci_core_default_security_list.main >/dev/null 2>&1; then
-                terraform import oci_core_default_security_list.main "$sl_id" 2>/dev/null && \
-                    print_status "    Imported Security List" || true
+            if [ "$command" = "tenancy" ] && [ "$sub" = "switch" ]; then
+                completion_tenancies
+                echo none
+            elif grep -qE '(^| |\[)(INSTANCE|OLD|TARGETS)( |\]|$)' <<< "$synopses"; then
+                completion_instances
             fi
-            break
         fi
-    done
+    } | awk -v p="$current" 'index($0, p) == 1 && !seen[$0]++'
 }
 
-# ============================================================================
-# TERRAFORM WORKFLOW
-# ============================================================================
-
-run_terraform_workflow() {
-    print_header "TERRAFORM WORKFLOW"
-    
-    # Step 1: Initialize
-    print_status "Step 1: Initializing Terraform..."
-    if ! retry_with_backoff "terraform init -input=false -upgrade" >/dev/null 2>&1; then
-        print_error "Terraform init failed after retries"
-        return 1
-    fi
-    print_success "Terraform initialized"
-    
-    # Step 2: Import existing resources
-    if [ ${#EXISTING_VCNS[@]} -gt 0 ] || [ ${#EXISTING_AMD_INSTANCES[@]} -gt 0 ] || [ ${#EXISTING_ARM_INSTANCES[@]} -gt 0 ]; then
-        print_status "Step 2: Importing existing resources..."
-        import_existing_resources
+# completion bash|zsh|fish|powershell: a completion script that asks the script itself for
+# commands, flags, flag values, instance names, profiles and tenancies
+completion_script() {
+    local shell="${1:-}" name path
+    name=$(basename "$0")
+    path=$(cd "$(dirname "$0")" && pwd -P)/$name
+    case "$shell" in
+        bash)
+            cat <<EOS
+# bash completion for $name: source <($name completion bash)
+_cloudcradle() {
+    local IFS=\$'\\n'
+    COMPREPLY=(\$("\${COMP_WORDS[0]}" __complete "\${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _cloudcradle $name ./$name cloudcradle
+EOS
+            ;;
+        zsh)
+            cat <<EOS
+#compdef $name cloudcradle
+# zsh completion for $name: source <($name completion zsh)
+_cloudcradle() {
+    local -a candidates
+    candidates=("\${(@f)\$(\${words[1]} __complete "\${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [ \${#candidates[@]} -gt 0 ] && [ -n "\${candidates[1]}" ]; then
+        compadd -a candidates
     else
-        print_status "Step 2: No existing resources to import"
-    fi
-    
-    # Step 3: Validate
-    print_status "Step 3: Validating configuration..."
-    if ! terraform validate; then
-        print_error "Terraform validation failed"
-        return 1
+        _files
     fi
-    print_success "Configuration valid"
-    
-    # Step 4: Plan
-    print_status "Step 4: Creating execution plan..."
-    if ! terraform plan -out=tfplan -input=false; then
-        print_error "Terraform plan failed"
-        return 1
-    fi
-    print_success "Plan created successfully"
-    
-    # Show plan summary
-    echo ""
-    print_status "Plan summary:"
-    terraform show -no-color tfplan | grep -E "^(Plan:|  #|will be)" | head -20 || true
-    echo ""
-    
-    # Step 5: Apply (with confirmation)
-    if [ "$AUTO_DEPLOY" = "true" ] || [ "$NON_INTERACTIVE" = "true" ]; then
-        print_status "Step 5: Auto-applying plan..."
-        apply_choice="Y"
+}
+compdef _cloudcradle $name ./$name cloudcradle
+EOS
+            ;;
+        fish)
+            cat <<EOS
+# fish completion for $name: $name completion fish > ~/.config/fish/completions/$name.fish
+function __cloudcradle_complete
+    set -l words (commandline -opc) (commandline -ct)
+    \$words[1] __complete \$words[2..-1] 2>/dev/null
+end
+complete -c $name -f -a '(__cloudcradle_complete)'
+complete -c cloudcradle -f -a '(__cloudcradle_complete)'
+EOS
+            ;;
+        powershell)
+            cat <<EOS
+# PowerShell completion for $name: $name completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName '$name', 'cloudcradle' -ScriptBlock {
+    param(\$wordToComplete, \$commandAst, \$cursorPosition)
+    \$words = @(\$commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { \$_.ToString() })
+    if (\$wordToComplete -eq '') { \$words += '' }
+    & bash '$path' __complete @words 2>\$null | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new(\$_, \$_, 'ParameterValue', \$_)
+    }
+}
+EOS
+            ;;
+        *)
+            print_error "Usage: $0 completion bash|zsh|fish|powershell"
+            return 2
+            ;;
+    esac
+}
+
+# Escape text for roff: backslashes, and a leading dot or quote
+roff_escape() {
+    sed -e 's/\\/\\e/g' -e "s/^\\([.']\\)/\\\\\\&\\1/" -e 's/-/\\-/g'
+}
+
+# One command's page (or, without a command, the main page) as markdown or man
+docs_page() {
+    local format="$1" command="${2:-}" name synopsis description flag
+    name=$(basename "$0")
+    local entries
+    if [ -n "$command" ]; then
+        entries=$(usage_entries Commands | awk -F'\t' -v c="$command" '{ split($1, w, " "); n = split(w[1], names, "|"); for (i = 1; i <= n; i++) if (names[i] == c) { print; break } }')
     else
-        echo -n -e "${BLUE}Apply this plan? [y/N]: ${NC}"
-        read -r apply_choice
-        apply_choice=${apply_choice:-N}
+        entries=$(usage_entries Commands)
     fi
-    
-    if [[ "$apply_choice" =~ ^[Yy]$ ]]; then
-        print_status "Applying Terraform plan..."
-        if out_of_capacity_auto_apply; then
-            print_success "Infrastructure deployed successfully!"
-            rm -f tfplan
-            
-            # Show outputs
-            echo ""
-            print_header "DEPLOYMENT COMPLETE"
-            terraform output -json 2>/dev/null | jq '.' || terraform output
-        else
-            print_error "Terraform apply failed"
-            return 1
+
+    if [ "$format" = "markdown" ]; then
+        echo "# $name${command:+ $command}"
+        echo ""
+        if [ -n "$command" ]; then
+            while IFS=$'\t' read -r synopsis description; do
+                printf '```\n%s [options] %s\n```\n\n%s\n\n' "$name" "$synopsis" "$description"
+            done <<< "$entries"
+            echo "Global options: see [${name%.sh}](${name%.sh}.md#options)."
+            return 0
         fi
+        printf '```\n%s [options] [command]\n```\n\n## Options\n\n| Option | Description |\n|--------|-------------|\n' "$name"
+        usage_entries Options | while IFS=$'\t' read -r synopsis description; do
+            printf '| `%s` | %s |\n' "$synopsis" "${description//|/\\|}"
+        done
+        printf '\n## Commands\n\n| Command | Description |\n|---------|-------------|\n'
+        while IFS=$'\t' read -r synopsis description; do
+            printf '| `%s` | %s |\n' "${synopsis//|/\\|}" "${description//|/\\|}"
+        done <<< "$entries"
+        return 0
+    fi
+
+    local title="${name%.sh}${command:+-$command}"
+    printf '.TH %s 1 "%s" "%s" "User Commands"\n' "${title^^}" "$(date +%Y-%m-%d)" "$name"
+    printf '.SH NAME\n%s \\- %s\n' "$(roff_escape <<< "$title")" \
+        "$(if [ -n "$command" ]; then head -1 <<< "$entries" | cut -f2 | roff_escape; else echo "set up and manage Oracle Cloud Always Free infrastructure with Terraform"; fi)"
+    printf '.SH SYNOPSIS\n'
+    if [ -n "$command" ]; then
+        cut -f1 <<< "$entries" | while IFS= read -r synopsis; do
+            printf '.B %s\n[options] %s\n.br\n' "$name" "$(roff_escape <<< "$synopsis")"
+        done
     else
-        print_status "Plan saved as 'tfplan' - apply later with: terraform apply tfplan"
+        printf '.B %s\n[options] [command]\n' "$name"
+    fi
+    if [ -z "$command" ]; then
+        printf '.SH OPTIONS\n'
+        usage_entries Options | while IFS=$'\t' read -r synopsis description; do
+            printf '.TP\n.B %s\n%s\n' "$(roff_escape <<< "$synopsis")" "$(roff_escape <<< "$description")"
+        done
+    fi
+    printf '.SH %s\n' "$([ -n "$command" ] && echo DESCRIPTION || echo COMMANDS)"
+    while IFS=$'\t' read -r synopsis description; do
+        printf '.TP\n.B %s\n%s\n' "$(roff_escape <<< "$synopsis")" "$(roff_escape <<< "$description")"
+    done <<< "$entries"
+    if [ -n "$command" ]; then
+        printf '.SH SEE ALSO\n.BR %s (1)\n' "${name%.sh}"
     fi
-    
-    return 0
 }
 
-terraform_menu() {
-    while true; do
-        echo ""
-        print_header "TERRAFORM MANAGEMENT"
-        echo "  1) Full workflow (init → import → plan → apply)"
-        echo "  2) Plan only"
-        echo "  3) Apply existing plan"
-        echo "  4) Import existing resources"
-        echo "  5) Show current state"
-        echo "  6) Destroy infrastructure"
-        echo "  7) Reconfigure"
-        echo "  8) Exit"
-        echo ""
-        
-        if [ "$AUTO_DEPLOY" = "true" ] || [ "$NON_INTERACTIVE" = "true" ]; then
-            choice=1
-            print_status "Auto mode: Running full workflow"
-        else
-            echo -n -e "${BLUE}Choose option [1]: ${NC}"
-            read -r choice
-            choice=${choice:-1}
+# docs [--format markdown|man] [--dir DIR]: reference pages generated from the help text;
+# one page on stdout, or with --dir the main page plus one page per command
+docs_command() {
+    local format=markdown dir="" name command ext
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --format)
+                if [[ ! "${2:-}" =~ ^(markdown|man)$ ]]; then
+                    print_error "--format requires markdown or man"
+                    return 2
+                fi
+                format="$2"
+                shift 2
+                ;;
+            --dir)
+                dir="${2:-}"
+                [ -n "$dir" ] || { print_error "--dir requires a directory"; return 2; }
+                shift 2
+                ;;
+            *) print_error "Usage: $0 docs [--format markdown|man] [--dir DIR]"; return 2 ;;
+        esac
+    done
+
+    if [ -z "$dir" ]; then
+        docs_page "$format"
+        return 0
+    fi
+    name=$(basename "$0")
+    name="${name%.sh}"
+    ext=$([ "$format" = "man" ] && echo 1 || echo md)
+    mkdir -p "$dir" || return 1
+    docs_page "$format" > "$dir/$name.$ext"
+    while IFS= read -r command; do
+        docs_page "$format" "$command" > "$dir/$name-$command.$ext"
+    done < <(usage_commands)
+    print_success "Wrote $(( $(usage_commands | wc -l) + 1 )) $format page(s) to $dir/"
+}
+
+# ============================================================================
+# SUBCOMMANDS
+# ============================================================================
+
+print_usage() {
+    cat <<EOF
+Usage: $0 [options] [command]
+
+Options:
+  --parallelism N     Terraform -parallelism for plan/apply (default: $TF_PARALLELISM)
+  --no-refresh        Plan with -refresh=false (trust state, skip refresh)
+  --allow-destroy     Let unattended runs apply plans that destroy or replace resources
+  --prevent-destroy, --no-prevent-destroy
+                      Add (or remove) lifecycle prevent_destroy on instances and block
+                      volumes (PREVENT_DESTROY)
+  --target ADDR, --replace ADDR
+                      Limit the plan to a resource (and its dependencies), or force its
+                      replacement; ADDR is a resource address or an instance hostname,
+                      checked against state and the configuration (repeatable;
+                      TF_TARGETS / TF_REPLACE)
+  --refresh-only      Only record changes made outside Terraform in state (TF_REFRESH_ONLY)
+  --cached, --refresh
+                      Reuse the tenancy inventory cached in $INVENTORY_CACHE_FILE when it is
+                      under ${INVENTORY_CACHE_TTL}s old, or always scan the tenancy again; by default
+                      only subcommands reuse it (INVENTORY_CACHE / INVENTORY_CACHE_TTL)
+  --lock-timeout DUR  Terraform -lock-timeout (default: $TF_LOCK_TIMEOUT)
+  --proxy URL         HTTP(S) proxy for the oci CLI, terraform, curl and installers, over
+                      HTTPS_PROXY/HTTP_PROXY; 'none' ignores those (PROXY)
+  --provider-mirror DIR
+                      Install providers only from this filesystem mirror, for machines
+                      without registry access (PROVIDER_MIRROR_DIR; see 'mirror')
+  --terraform-version CONSTRAINT, --provider-version CONSTRAINT
+                      Pin required_version and the oci provider version in provider.tf,
+                      e.g. "= 1.9.8" and "~> 6.18" (TF_REQUIRED_VERSION / OCI_PROVIDER_VERSION)
+  --dry-run           Discover and preview only: show file diffs, imports and the
+                      plan without writing files, importing or applying
+  --emit-only         Generate the files, then print the init/import/plan/apply
+                      commands instead of running them (automatic without Terraform)
+  --wait-for-activation
+                      Poll until a new tenancy finishes provisioning/verification
+  --amd-block-volumes SPEC, --arm-block-volumes SPEC
+                      Block volumes per instance, comma-separated in instance order:
+                      0 = none, 100+50 = two volumes (min ${FREE_TIER_MIN_BLOCK_VOLUME_GB}GB each)
+  --os OS             Instance operating system: ubuntu (default), oracle-linux,
+                      almalinux, rocky or debian (Marketplace) (INSTANCE_OS)
+  --ubuntu-version VER, --ubuntu-variant standard|minimal
+                      Ubuntu release (${SUPPORTED_UBUNTU_VERSIONS// /, }) and image variant
+                      (UBUNTU_VERSION / UBUNTU_VARIANT, default: the pinned one)
+  --update-images     Resolve the newest images again instead of the ones pinned
+                      in $IMAGE_LOCK_FILE (IMAGE_UPDATE=true)
+  --amd-image OCID, --arm-image OCID
+                      Custom image for that architecture instead of the newest
+                      image of the OS (AMD_IMAGE_OCID / ARM_IMAGE_OCID)
+  --provision MODULE  Provisioner module for every instance, e.g. docker (repeatable;
+                      saved in variables.tf, 'none' removes them) (PROVISION)
+  --profile NAME, --region REGION
+                      OCI CLI profile and region for this run; without them the
+                      interactive setup offers the config's profiles and the
+                      tenancy's subscribed regions (OCI_PROFILE / OCI_REGION)
+  --engine auto|terraform|tofu
+                      Terraform or OpenTofu (TF_ENGINE); tofu enables TOFU_STATE_ENCRYPTION
+  --layout flat|modules|terragrunt
+                      modules: generate modules/{network,compute-amd,compute-arm,storage}
+                      under a thin root main.tf; terragrunt: also export a Terragrunt unit
+                      to $TERRAGRUNT_DIR/ and print the terragrunt commands instead of
+                      running Terraform (LAYOUT)
+  --allow-non-home-region
+                      Only warn when the region is not the tenancy's home region,
+                      for paid resources elsewhere (ALLOW_NON_HOME_REGION=true)
+  --tenancy NAME      Run in that tenancy's workspace with its OCI profile
+                      (CLOUDCRADLE_TENANCY; default: 'tenancy switch' outside a workspace)
+
+Commands:
+  (none)          Interactive setup: auth, inventory, generate Terraform, deploy
+  plan            Plan the generated files as they are (no inventory or regeneration)
+                  into tfplan, with --target, --replace and --refresh-only
+  apply [--yes]   Plan like 'plan', then apply after confirmation:
+                  $0 apply --replace arm-2 rebuilds one instance and nothing else
+  serve-metrics   Export free-tier usage as Prometheus metrics
+  check           Run readiness checks against deployed instances
+  verify-ssh      Confirm cloud-init sshd hardening by logging in (cancels its auto-revert)
+  ssh INSTANCE [-4|-6] [CMD]
+                  Open an SSH session (IPv6 with -6 or SSH_ADDRESS_FAMILY=ipv6)
+  console INSTANCE [--print] [--delete]
+                  Serial console through an instance console connection (for instances
+                  unreachable over SSH); --print only shows the ssh command
+  exec TARGETS -- CMD   Run a command over SSH on matching instances
+  fleet packages [TARGETS] [--packages "a b"] [--json]
+                  Compare docker/kernel/openssl (FLEET_PACKAGES) versions across
+                  instances and highlight stragglers (exit 2 if any; default --all)
+  grant-access --user github:NAME|gitlab:NAME [--ttl 48h] [--sudo] [TARGETS]
+                  Add a user's published keys (default --all) and remove them again
+                  after the TTL (default: $GRANT_ACCESS_DEFAULT_TTL); recorded in $AUDIT_LOG
+  revoke-access USER [TARGETS]
+                  End a temporary grant early
+  backup status [TARGETS] [--json]
+                  Snapshots, last and next run of application data backups
+  backup now [TARGETS]
+                  Take a backup immediately
+  backup restore INSTANCE [--snapshot ID] [--path P]... [--in-place]
+                  Restore into /var/restore/<time> (or over the originals)
+  backup passwords
+                  Store the instances' repository passwords missing from the vault
+                  (done after every apply)
+  adb list        Always Free Autonomous Databases and their state
+  adb wallet NAME [--dir DIR]
+                  Download and unpack a connection wallet (default: $ADB_WALLET_DIR/NAME)
+  secrets list    Secrets declared in $SECRETS_FILE and whether a value is stored
+  secrets set NAME [--from-file FILE]
+                  Store a secret in the vault (value from FILE, stdin or a prompt)
+  drift [--json]  Report resources changed outside Terraform (exit 2 if any)
+  inventory [--output text|csv|markdown] [--table usage|instances|volumes|network]
+                  Tenancy inventory: the usage summary, or tables of usage against the
+                  Always Free limits, instances, volumes and network resources
+  reconcile [--json]
+                  Compare the inventory with Terraform state: resources only in OCI (with
+                  their import command), only in state (with a state rm) and in both
+                  (exit 2 if the two disagree)
+  capacity-stats [--json]
+                  Summarise recorded capacity successes/failures by shape, AD and hour
+  init [DIR]      Scaffold a project directory (.gitignore, config skeletons, git hook)
+  validate        Check firewall, label and readiness config (used by the git hook)
+  lock [--platform os_arch]...
+                  Record provider checksums in .terraform.lock.hcl for every platform
+                  (default: TF_LOCK_PLATFORMS), so the lock file verifies everywhere
+  mirror [--dir DIR] [--platform os_arch]...
+                  Download the oci provider for every platform into a filesystem mirror
+                  (default: terraform-mirror/) for runs without registry access
+                  (PROVIDER_MIRROR_DIR=DIR)
+  lint [--format text|json|github] [--strict]
+                  Ranked best-practice suggestions for the config (exit 2 on high
+                  findings, or any with --strict; github = workflow annotations)
+  whatif [--amd N] [--arm N] [--arm-ocpus LIST] [--arm-memory LIST] [--amd-boot GB]
+         [--arm-boot LIST] [--amd-block-volumes SPEC] [--arm-block-volumes SPEC]
+         [--backup-policy P] [--live] [--json] [--interactive]
+                  Free Tier utilization and violations of a hypothetical config,
+                  starting from variables.tf; writes nothing (no options = TUI)
+  spec show       The spec (instances in variables.tf, config files present) as JSON
+  spec serve-validation [--offline]
+                  Validation server for editors (LSP over stdio): diagnostics for
+                  variables.tf and the config files, checked against live quota usage
+  schema export [NAME...] [--dir DIR]
+                  JSON Schemas of the JSON formats (--json outputs, capacity history,
+                  key cache); 'schema list' shows the names
+  usage [show [--json] | enable | disable | reset | submit [--yes]]
+                  Opt-in local usage statistics (off by default; submit only sends
+                  to USAGE_STATS_SUBMIT_URL after showing the payload)
+  preflight       Check IAM permissions needed by each phase
+  bootstrap-iam [--instance-access]
+                  Create a least-privilege user/group/policy + API key and switch to it,
+                  and the dynamic groups for backups/secrets (--instance-access: only those)
+  cleanup [--force]
+                  Delete unattached volumes and reserved IPs not in Terraform state
+  outputs [--json]
+                  Instances (addresses, state, OCIDs), SSH commands and network IDs
+                  from the Terraform outputs
+  export terragrunt [--dir DIR]
+                  The generated files as a Terragrunt unit: terragrunt.hcl with the
+                  settings as inputs plus the module (default: $TERRAGRUNT_DIR/)
+  artifacts [--dir DIR]
+                  Write instances.json, instances.env and an Ansible inventory.ini
+                  to $ARTIFACTS_DIR/ (done after every apply unless ARTIFACTS=false)
+  env INSTANCE [--prefix P]
+                  Print export statements: eval "\$($0 env arm-1)"
+  upgrade-os [TARGETS] [--to VERSION] [--strategy in-place|replace] [--yes]
+                  Move instances (default --all) to a new Ubuntu release one at a time,
+                  with readiness checks after each; stops at the first failure
+  resize INSTANCE [--ocpus N] [--memory GB] [--boot GB] [--no-expand] [--yes]
+                  Reshape an ARM instance or grow a boot volume in place within the
+                  Always Free limits left by the rest of the tenancy (targeted apply);
+                  the root filesystem is grown over SSH unless --no-expand
+  rebalance [--instances N | --ocpus LIST --memory LIST] [--yes]
+                  Redistribute the ARM allowance over 1-$FREE_TIER_MAX_ARM_INSTANCES instances: shows what is
+                  reshaped, destroyed and created, then shrinks before it grows
+                  (no options: list the even splits)
+  rename OLD NEW [--yes]
+                  Change an instance's hostname without replacing it: updates the
+                  config files, moves state keyed by hostname, then sets the hostname
+                  and dynamic DNS name on the instance over SSH
+  stop|start|reboot TARGETS
+                  Power actions on matching instances
+  tenancy list|current
+                  Tenancy workspaces (profile, region, instances); * = default
+  tenancy add NAME [--profile P] [--dir DIR]
+                  New workspace for an OCI profile in $TENANCIES_DIR,
+                  or register an existing workspace DIR
+  tenancy switch NAME|none
+                  Default tenancy for runs outside a workspace
+
+  completion bash|zsh|fish|powershell
+                  Shell completion script: commands, flags and their values, instance
+                  names, OCI profiles and tenancies (source <($0 completion bash))
+  docs [--format markdown|man] [--dir DIR]
+                  Reference pages generated from this help: one page on stdout, or
+                  with --dir a main page plus one per command
+  help            Show this help
+
+Targets: --selector key=value[,key!=value] | --all | hostname...
+  Labels come from $INSTANCE_LABELS_FILE; "name" and "kind" (amd|arm) are implicit.
+EOF
+}
+
+# Consume leading --options; remaining arguments are left in REMAINING_ARGS
+parse_global_flags() {
+    REMAINING_ARGS=()
+    while [ $# -gt 0 ]; do
+        # Accept --flag=value as well as --flag value
+        if [[ "$1" == --*=* ]]; then
+            set -- "${1%%=*}" "${1#*=}" "${@:2}"
         fi
-        
-        case $choice in
-            1)
-                run_terraform_workflow
-                [ "$AUTO_DEPLOY" = "true" ] && return 0
+
+        case "$1" in
+            --parallelism)
+                if [[ ! "${2:-}" =~ ^[0-9]+$ ]] || [ "$2" -lt 1 ]; then
+                    print_error "--parallelism requires a positive integer"
+                    exit 2
+                fi
+                TF_PARALLELISM="$2"
+                shift 2
                 ;;
-            2)
-                terraform init -input=false && terraform plan
+            --allow-destroy)
+                ALLOW_DESTROY=true
+                shift
                 ;;
-            3)
-                if [ -f "tfplan" ]; then
-                    terraform apply tfplan
+            --prevent-destroy)
+                PREVENT_DESTROY=true
+                shift
+                ;;
+            --no-prevent-destroy)
+                PREVENT_DESTROY=false
+                shift
+                ;;
+            --no-refresh)
+                TF_REFRESH=false
+                shift
+                ;;
+            --cached|--refresh)
+                if [ "$1" = "--cached" ]; then
+                    INVENTORY_CACHE=cached
                 else
-                    print_error "No plan file found"
+                    INVENTORY_CACHE=refresh
                 fi
+                shift
                 ;;
-            4)
-                import_existing_resources
+            --refresh-only)
+                TF_REFRESH_ONLY=true
+                shift
                 ;;
-            5)
-                if terraform state list 2>/dev/null && terraform output 2>/dev/null; then
-                    :
+            --target|--replace)
+                if [ -z "${2:-}" ]; then
+                    print_error "$1 requires a resource address or instance hostname"
+                    exit 2
+                fi
+                if [ "$1" = "--target" ]; then
+                    TF_TARGETS="${TF_TARGETS:+$TF_TARGETS }$2"
                 else
-                    print_status "No state found"
+                    TF_REPLACE="${TF_REPLACE:+$TF_REPLACE }$2"
                 fi
+                shift 2
                 ;;
-            6)
-                if confirm_action "DESTROY all infrastructure?" "N"; then
-                    terraform destroy
+            --dry-run)
+                DRY_RUN=true
+                shift
+                ;;
+            --emit-only)
+                EMIT_ONLY=true
+                shift
+                ;;
+            --engine)
+                if [[ ! "${2:-}" =~ ^(auto|terraform|tofu)$ ]]; then
+                    print_error "--engine requires auto, terraform or tofu"
+                    exit 2
                 fi
+                TF_ENGINE="$2"
+                shift 2
                 ;;
-            7)
-                return 1  # Signal to reconfigure
+            --layout)
+                if [[ ! "${2:-}" =~ ^(flat|modules|terragrunt)$ ]]; then
+                    print_error "--layout requires flat, modules or terragrunt"
+                    exit 2
+                fi
+                LAYOUT="$2"
+                shift 2
                 ;;
-            8)
-                return 0
+            --allow-non-home-region)
+                ALLOW_NON_HOME_REGION=true
+                shift
+                ;;
+            --wait-for-activation)
+                WAIT_FOR_ACTIVATION=true
+                shift
+                ;;
+            --amd-block-volumes|--arm-block-volumes)
+                if [ -z "${2:-}" ]; then
+                    print_error "$1 requires per-instance sizes (e.g. 100+50,0)"
+                    exit 2
+                fi
+                if [ "$1" = "--amd-block-volumes" ]; then
+                    AMD_BLOCK_VOLUMES="$2"
+                else
+                    ARM_BLOCK_VOLUMES="$2"
+                fi
+                shift 2
+                ;;
+            --os)
+                if [ -z "${2:-}" ]; then
+                    print_error "--os requires one of: $SUPPORTED_OSES"
+                    exit 2
+                fi
+                INSTANCE_OS="$2"
+                shift 2
+                ;;
+            --ubuntu-version|--ubuntu-variant)
+                if [ -z "${2:-}" ]; then
+                    print_error "$1 requires a value"
+                    exit 2
+                fi
+                if [ "$1" = "--ubuntu-version" ]; then
+                    UBUNTU_VERSION="$2"
+                else
+                    UBUNTU_VARIANT="$2"
+                fi
+                shift 2
+                ;;
+            --update-images)
+                IMAGE_UPDATE=true
+                shift
+                ;;
+            --amd-image|--arm-image)
+                if [ -z "${2:-}" ]; then
+                    print_error "$1 requires an image OCID"
+                    exit 2
+                fi
+                if [ "$1" = "--amd-image" ]; then
+                    AMD_IMAGE_OCID="$2"
+                else
+                    ARM_IMAGE_OCID="$2"
+                fi
+                shift 2
+                ;;
+            --lock-timeout)
+                if [ -z "${2:-}" ]; then
+                    print_error "--lock-timeout requires a duration (e.g. 120s)"
+                    exit 2
+                fi
+                TF_LOCK_TIMEOUT="$2"
+                shift 2
+                ;;
+            --proxy)
+                if [[ ! "${2:-}" =~ ^(none|[a-z0-9]+://.+)$ ]]; then
+                    print_error "--proxy requires a URL (e.g. http://proxy.corp:3128) or none"
+                    exit 2
+                fi
+                PROXY="$2"
+                shift 2
+                ;;
+            --provider-mirror)
+                if [ -z "${2:-}" ]; then
+                    print_error "--provider-mirror requires a directory"
+                    exit 2
+                fi
+                PROVIDER_MIRROR_DIR="$2"
+                shift 2
+                ;;
+            --terraform-version|--provider-version)
+                if [[ ! "${2:-}" =~ [0-9] ]]; then
+                    print_error "$1 requires a version constraint (e.g. \"~> 1.9\")"
+                    exit 2
+                fi
+                if [ "$1" = "--terraform-version" ]; then
+                    TF_REQUIRED_VERSION="$2"
+                else
+                    OCI_PROVIDER_VERSION="$2"
+                fi
+                shift 2
+                ;;
+            --provision)
+                if [[ ! " $PROVISIONER_MODULES none " == *" ${2:-} "* ]]; then
+                    print_error "--provision requires a module ($PROVISIONER_MODULES) or none"
+                    exit 2
+                fi
+                if [ "$2" = "none" ] || [ "$PROVISION" = "none" ]; then
+                    PROVISION="$2"
+                else
+                    PROVISION="${PROVISION:+$PROVISION,}$2"
+                fi
+                shift 2
+                ;;
+            --profile|--region)
+                if [ -z "${2:-}" ]; then
+                    print_error "$1 requires a value"
+                    exit 2
+                fi
+                if [ "$1" = "--profile" ]; then
+                    OCI_PROFILE="$2"
+                    OCI_PROFILE_PINNED=true
+                    OCI_PROFILE_FLAG=true
+                else
+                    OCI_REGION="$2"
+                    OCI_REGION_PINNED=true
+                fi
+                shift 2
+                ;;
+            --tenancy)
+                if [ -z "${2:-}" ]; then
+                    print_error "--tenancy requires a name (see: $0 tenancy list)"
+                    exit 2
+                fi
+                CLOUDCRADLE_TENANCY="$2"
+                shift 2
+                ;;
+            --chaos)
+                # Development/CI only, deliberately not listed in --help
+                if [ -z "${2:-}" ]; then
+                    print_error "--chaos requires a spec (e.g. throttle=0.2,auth=0.05 or 0.1)"
+                    exit 2
+                fi
+                CHAOS="$2"
+                shift 2
+                ;;
+            --chaos-seed)
+                CHAOS_SEED="${2:-}"
+                shift 2 || { print_error "--chaos-seed requires a value"; exit 2; }
+                ;;
+            --)
+                # After a subcommand, -- still separates its own arguments from a command
+                # (exec --selector role=web -- sudo systemctl ...), so it is kept
+                [ ${#REMAINING_ARGS[@]} -eq 0 ] || REMAINING_ARGS+=("--")
+                shift
+                REMAINING_ARGS+=("$@")
+                break
                 ;;
             *)
-                print_error "Invalid choice"
+                REMAINING_ARGS+=("$1")
+                shift
                 ;;
         esac
-        
-        if [ "$NON_INTERACTIVE" = "true" ]; then
-            return 0
-        fi
-        
-        echo ""
-        echo -n -e "${BLUE}Press Enter to continue...${NC}"
-        read -r
     done
 }
 
+# Runs once when the script exits (normal completion, error or Ctrl+C)
+cleanup_on_exit() {
+    local rc=$?
+    if [ -n "$METRICS_SERVER_PID" ]; then
+        kill "$METRICS_SERVER_PID" 2>/dev/null || true
+    fi
+    if [ -n "$DRY_RUN_DIR" ]; then
+        rm -rf "$DRY_RUN_DIR"
+    fi
+    rm -f "${TMPDIR:-/tmp}/cloudcradle-account-state.$$"
+    if [ -n "$RATE_LIMIT_FILE" ]; then
+        rm -rf "$RATE_LIMIT_FILE" "$RATE_LIMIT_FILE.lock" "$RATE_LIMIT_FILE.lock.d"
+    fi
+    [ -z "$RETRY_TOKEN_VERBS_FILE" ] || rm -f "$RETRY_TOKEN_VERBS_FILE"
+    if [ -n "$KEYCHAIN_MATERIALIZED" ]; then
+        file_locked "$KEYCHAIN_MATERIALIZED" keychain_release_ssh_key "$KEYCHAIN_MATERIALIZED" || true
+    fi
+    chaos_summary
+    run_report_finish "$rc"
+    usage_record "$rc"
+    trace_flush "$rc"
+}
+
+# Authenticate and load tenancy facts without regenerating Terraform files
+prepare_oci_session() {
+    # shellcheck disable=SC1091
+    [ -f ".venv/bin/activate" ] && source .venv/bin/activate
+
+    if [ -z "$OCI_CLI_FIXTURES_DIR" ] && ! command_exists "$OCI_CLI_BIN"; then
+        print_error "OCI CLI not found - run $0 without arguments first to install prerequisites"
+        return 1
+    fi
+
+    setup_oci_config || return 1
+    fetch_oci_config_values || return 1
+    if [ "$WAIT_FOR_ACTIVATION" = "true" ]; then
+        wait_for_tenancy_activation || return 1
+    fi
+    fetch_availability_domains || return 1
+    fetch_service_limits
+}
+
+run_subcommand() {
+    local command="$1"
+    shift
+    USAGE_FEATURE="$command"
+
+    case "$command" in
+        serve-metrics)
+            prepare_oci_session || return 1
+            serve_metrics "$@"
+            ;;
+        plan|apply)
+            plan_apply_command "$command" "$@"
+            ;;
+        check)
+            run_readiness_checks
+            ;;
+        verify-ssh)
+            verify_ssh_hardening
+            ;;
+        ssh)
+            fleet_ssh "$@"
+            ;;
+        console)
+            prepare_oci_session >&2 || return 1
+            fleet_console "$@"
+            ;;
+        exec)
+            fleet_exec "$@"
+            ;;
+        backup)
+            case "${1:-}" in
+                status)
+                    shift
+                    backup_status "$@"
+                    ;;
+                now)
+                    shift
+                    backup_now "$@"
+                    ;;
+                restore)
+                    shift
+                    backup_restore "$@"
+                    ;;
+                passwords)
+                    prepare_oci_session || return 1
+                    store_backup_passwords
+                    ;;
+                *)
+                    print_error "Usage: backup status|now|restore|passwords ..."
+                    return 2
+                    ;;
+            esac
+            ;;
+        adb)
+            case "${1:-}" in
+                list)
+                    adb_list
+                    ;;
+                wallet)
+                    shift
+                    prepare_oci_session || return 1
+                    adb_wallet "$@"
+                    ;;
+                *)
+                    print_error "Usage: adb list | adb wallet NAME [--dir DIR]"
+                    return 2
+                    ;;
+            esac
+            ;;
+        upgrade-os)
+            upgrade_os "$@"
+            ;;
+        resize)
+            resize_instance "$@"
+            ;;
+        rebalance)
+            rebalance "$@"
+            ;;
+        rename)
+            rename_instance "$@"
+            ;;
+        outputs)
+            show_deployment_outputs "$@"
+            ;;
+        export)
+            case "${1:-}" in
+                terragrunt)
+                    shift
+                    export_terragrunt "$@"
+                    ;;
+                *)
+                    print_error "Usage: export terragrunt [--dir DIR]"
+                    return 2
+                    ;;
+            esac
+            ;;
+        artifacts)
+            write_apply_artifacts "$@"
+            ;;
+        tenancy)
+            case "${1:-}" in
+                list|"")
+                    tenancy_list
+                    ;;
+                add)
+                    shift
+                    tenancy_add "$@"
+                    ;;
+                switch)
+                    shift
+                    tenancy_switch "$@"
+                    ;;
+                current)
+                    tenancy_current
+                    ;;
+                *)
+                    print_error "Usage: tenancy list | tenancy add NAME [--profile P] [--dir DIR] | tenancy switch NAME|none | tenancy current"
+                    return 2
+                    ;;
+            esac
+            ;;
+        secrets)
+            case "${1:-}" in
+                list)
+                    prepare_oci_session || return 1
+                    secrets_list
+                    ;;
+                set)
+                    shift
+                    prepare_oci_session || return 1
+                    secrets_set "$@"
+                    ;;
+                *)
+                    print_error "Usage: secrets list | secrets set NAME [--from-file FILE]"
+                    return 2
+                    ;;
+            esac
+            ;;
+        fleet)
+            case "${1:-}" in
+                packages)
+                    shift
+                    fleet_packages "$@"
+                    ;;
+                *)
+                    print_error "Usage: fleet packages [TARGETS] [--packages \"a b\"] [--json]"
+                    return 2
+                    ;;
+            esac
+            ;;
+        grant-access)
+            grant_access "$@"
+            ;;
+        revoke-access)
+            revoke_access "$@"
+            ;;
+        env)
+            fleet_env "$@"
+            ;;
+        drift)
+            prepare_oci_session >&2 || return 1
+            detect_drift "$@"
+            ;;
+        inventory)
+            prepare_oci_session >&2 || return 1
+            inventory_command "$@"
+            ;;
+        reconcile)
+            prepare_oci_session >&2 || return 1
+            reconcile_inventory "$@"
+            ;;
+        init)
+            scaffold_workspace "$@"
+            ;;
+        validate)
+            validate_workspace
+            ;;
+        mirror)
+            mirror_command "$@"
+            ;;
+        lock)
+            [ -f provider.tf ] || { print_error "No provider.tf here - run the setup first"; return 1; }
+            check_terraform_version || true
+            if [ ! -d .terraform ] && ! retry_with_backoff "terraform init -input=false" >/dev/null 2>&1; then
+                print_error "Terraform init failed after retries"
+                return 1
+            fi
+            terraform_lock_platforms "$@"
+            ;;
+        lint)
+            lint_workspace "$@"
+            ;;
+        whatif)
+            whatif "$@"
+            ;;
+        spec)
+            case "${1:-}" in
+                serve-validation)
+                    shift
+                    spec_serve_validation "$@"
+                    ;;
+                show)
+                    spec_show
+                    ;;
+                *)
+                    print_error "Usage: spec show | spec serve-validation [--offline]"
+                    return 2
+                    ;;
+            esac
+            ;;
+        usage)
+            usage_command "$@"
+            ;;
+        bench)
+            # Development/CI only, deliberately not listed in --help
+            run_bench "$@"
+            ;;
+        schema)
+            case "${1:-}" in
+                export)
+                    shift
+                    schema_export "$@"
+                    ;;
+                list)
+                    printf '%s\n' $SCHEMA_NAMES
+                    ;;
+                *)
+                    print_error "Usage: schema export [NAME...] [--dir DIR] | schema list"
+                    return 2
+                    ;;
+            esac
+            ;;
+        preflight)
+            prepare_oci_session || return 1
+            run_permission_preflight
+            ;;
+        bootstrap-iam)
+            prepare_oci_session || return 1
+            bootstrap_iam "$@"
+            ;;
+        cleanup)
+            prepare_oci_session || return 1
+            cleanup_orphaned_resources "$@"
+            ;;
+        capacity-stats)
+            show_capacity_stats "$@"
+            ;;
+        stop|start|reboot)
+            prepare_oci_session || return 1
+            fleet_power_action "$command" "$@"
+            ;;
+        completion)
+            completion_script "$@"
+            ;;
+        docs)
+            docs_command "$@"
+            ;;
+        help|-h|--help)
+            print_usage
+            ;;
+        *)
+            USAGE_FEATURE="unknown"
+            print_error "Unknown command: $command"
+            print_usage
+            return 2
+            ;;
+    esac
+}
+
 # ============================================================================
 # MAIN EXECUTION
 # ============================================================================
 
 main() {
+    # Completion callbacks run on every <Tab>: no flags, traps, tenancy output or side effects
+    if [ "${1:-}" = "__complete" ]; then
+        shift
+        enter_tenancy >/dev/null 2>&1 || true
+        complete_command_line "$@"
+        return 0
+    fi
+
+    parse_global_flags "$@"
+    configure_proxy
+    # Global flags recognised by parse_global_flags, by name only
+    local arg
+    for arg in "$@"; do
+        [[ "$arg" == --?* ]] && [[ " ${REMAINING_ARGS[*]} " != *" $arg "* ]] && USAGE_FLAGS+=("${arg%%=*}")
+    done
+    set -- "${REMAINING_ARGS[@]}"
+
+    trap cleanup_on_exit EXIT
+    trap 'exit 130' INT TERM
+
+    case "${1:-}" in
+        tenancy|init|help|-h|--help|completion|docs) ;;
+        *) enter_tenancy || exit 1 ;;
+    esac
+
+    trace_init "cloudcradle ${1:-setup}"
+    run_report_start "${1:-setup}"
+    rate_limit_init
+    retry_token_init
+    chaos_init
+    use_terraform_engine
+    use_ssh_client
+    use_provider_mirror
+    case "${1:-}" in
+        tenancy|init|help|-h|--help|schema|completion|docs) ;;
+        *) keychain_load_secrets ;;
+    esac
+
+    if [ "$DRY_RUN" = "true" ]; then
+        DRY_RUN_DIR=$(mktemp -d)
+    fi
+
+    if [ $# -gt 0 ]; then
+        case "$1" in
+            tenancy|init|help|-h|--help|schema|completion|docs) ;;
+            *) [ ! -f encryption.tf ] || prepare_state_encryption || exit 1 ;;
+        esac
+        run_subcommand "$@"
+        return $?
+    fi
+
     print_header "OCI TERRAFORM SETUP - IDEMPOTENT EDITION"
     print_status "This script safely manages Oracle Cloud Free Tier resources"
     print_status "Safe to run multiple times - will detect and reuse existing resources"
     echo ""
     
+    # Phases are traced with trace_start/trace_end rather than trace_run so that
+    # set -e still aborts inside them; spans left open are closed by trace_flush.
+
     # Phase 1: Prerequisites
-    install_prerequisites
-    install_terraform
-    install_oci_cli
+    trace_start "prereqs"
+    if [ "$DRY_RUN" = "true" ]; then
+        print_warning "DRY RUN: nothing will be installed, written, imported or applied"
+        local cmd
+        for cmd in jq terraform "$OCI_CLI_BIN"; do
+            if ! command_exists "$cmd"; then
+                print_error "Dry run requires '$cmd' to be installed"
+                return 1
+            fi
+        done
+    else
+        install_prerequisites
+        if ! install_terraform; then
+            if [ "$EMIT_ONLY" != "true" ]; then
+                print_warning "Neither Terraform nor OpenTofu is available - continuing in emit-only mode:"
+                print_warning "files are generated and the remaining commands are printed at the end"
+            fi
+            EMIT_ONLY=true
+        fi
+        install_oci_cli
+    fi
+    trace_end
     
     # Activate virtual environment if it exists
     # shellcheck disable=SC1091
     [ -f ".venv/bin/activate" ] && source .venv/bin/activate
     
     # Phase 2: Authentication
+    trace_start "auth"
+    pick_oci_profile
     setup_oci_config
+    trace_end
     
     # Phase 3: Fetch OCI information
+    trace_start "discovery"
     fetch_oci_config_values
+    pick_oci_region || exit 1
+    check_home_region || exit 1
     fetch_availability_domains
-    fetch_ubuntu_images
+    fetch_service_limits
+    fetch_instance_images
     generate_ssh_keys
+    prepare_state_encryption || exit 1
+    trace_end
     
+    if [ "$WAIT_FOR_ACTIVATION" = "true" ]; then
+        trace_run "activation" wait_for_tenancy_activation || exit 1
+    elif ! check_tenancy_activation >/dev/null; then
+        confirm_action "Continue anyway?" "N" || exit 1
+    fi
+
+    if [ "$PREFLIGHT_CHECKS" = "true" ] && ! trace_run "preflight" run_permission_preflight; then
+        confirm_action "Continue despite missing permissions?" "N" || exit 1
+    fi
+
     # Phase 4: Resource inventory (CRITICAL for idempotency)
+    trace_start "inventory"
     inventory_all_resources
+    trace_end
     
     # Phase 5: Configuration
+    trace_start "configure"
     if [ "$SKIP_CONFIG" != "true" ]; then
         prompt_configuration
     else
         load_existing_config || configure_from_existing_instances
+        configure_network_cidrs || exit 1
     fi
+    apply_block_volume_overrides || exit 1
+    check_free_tier_eligibility || exit 1
+    validate_autonomous_databases || exit 1
+    check_volume_backup_allowance || exit 1
+    trace_end
     
     # Phase 6: Generate Terraform files
+    trace_start "filegen"
     create_terraform_files
+    trace_end
     
+    if [ "$DRY_RUN" = "true" ]; then
+        trace_run "terraform preview" dry_run_terraform_preview
+        return
+    fi
+
+    if [ "$LAYOUT" = "terragrunt" ]; then
+        trace_run "terragrunt export" export_terragrunt || exit 1
+        terragrunt_next_steps
+        return
+    fi
+
+    if [ "$EMIT_ONLY" = "true" ]; then
+        trace_run "emit-only" emit_only_next_steps
+        return
+    fi
+
     # Phase 7: Terraform management
+    trace_start "terraform"
     while true; do
         if terraform_menu; then
             break
@@ -3038,8 +18702,10 @@ main() {
 
         # Reconfigure requested
         prompt_configuration
+        apply_block_volume_overrides && check_free_tier_eligibility || continue
         create_terraform_files
     done
+    trace_end
     
     print_header "SETUP COMPLETE"
     print_success "Oracle Cloud Free Tier infrastructure managed successfully"
@@ -3048,6 +18714,7 @@ main() {
     print_status "  • provider.tf - OCI provider configuration"
     print_status "  • variables.tf - Instance configuration"
     print_status "  • main.tf - Infrastructure resources"
+    print_status "  • outputs.tf - Addresses, OCIDs and SSH commands"
     print_status "  • data_sources.tf - OCI data sources"
     print_status "  • block_volumes.tf - Storage volumes"
     print_status "  • cloud-init.yaml - Instance initialization"
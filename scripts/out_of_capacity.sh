@@ -3,6 +3,7 @@
 # Helper: Retry Terraform apply on transient 'Out of Capacity' errors
 # Usage:
 #   ./scripts/out_of_capacity.sh [--max-attempts N] [--base-delay S] [--plan tfplan]
+#                                [--parallelism N] [--lock-timeout DUR]
 #
 # If a plan file is present (default: ./tfplan) it will run `terraform apply <plan>`.
 # Otherwise it will run `terraform apply -auto-approve`.
@@ -18,6 +19,9 @@ MAX_ATTEMPTS=8
 BASE_DELAY=15
 PLAN_FILE="tfplan"
 LOGFILE="scripts/out_of_capacity.log"
+# Lower than Terraform's default of 10 to avoid OCI 429s during launch bursts
+PARALLELISM="${TF_PARALLELISM:-4}"
+LOCK_TIMEOUT="${TF_LOCK_TIMEOUT:-60s}"
 
 # Parse args
 while [ "$#" -gt 0 ]; do
@@ -28,6 +32,10 @@ while [ "$#" -gt 0 ]; do
       BASE_DELAY="$2"; shift 2 ;;
     --plan)
       PLAN_FILE="$2"; shift 2 ;;
+    --parallelism)
+      PARALLELISM="$2"; shift 2 ;;
+    --lock-timeout)
+      LOCK_TIMEOUT="$2"; shift 2 ;;
     -h|--help)
       sed -n '1,120p' "$0"
       exit 0 ;;
@@ -37,7 +45,7 @@ while [ "$#" -gt 0 ]; do
 done
 
 echo "[INFO] Out-of-capacity auto-apply helper" | tee -a "$LOGFILE"
-echo "[INFO] Max attempts=$MAX_ATTEMPTS, base delay=${BASE_DELAY}s, plan=${PLAN_FILE}" | tee -a "$LOGFILE"
+echo "[INFO] Max attempts=$MAX_ATTEMPTS, base delay=${BASE_DELAY}s, plan=${PLAN_FILE}, parallelism=${PARALLELISM}" | tee -a "$LOGFILE"
 
 attempt=1
 while [ $attempt -le $MAX_ATTEMPTS ]; do
@@ -45,10 +53,10 @@ while [ $attempt -le $MAX_ATTEMPTS ]; do
 
   if [ -f "$PLAN_FILE" ]; then
     echo "[INFO] Applying plan file: $PLAN_FILE" | tee -a "$LOGFILE"
-    out=$(terraform apply -input=false "$PLAN_FILE" 2>&1) && rc=0 || rc=$?
+    out=$(terraform apply -input=false -parallelism="$PARALLELISM" -lock-timeout="$LOCK_TIMEOUT" "$PLAN_FILE" 2>&1) && rc=0 || rc=$?
   else
     echo "[INFO] Applying with -auto-approve" | tee -a "$LOGFILE"
-    out=$(terraform apply -input=false -auto-approve 2>&1) && rc=0 || rc=$?
+    out=$(terraform apply -input=false -auto-approve -parallelism="$PARALLELISM" -lock-timeout="$LOCK_TIMEOUT" 2>&1) && rc=0 || rc=$?
   fi
 
   echo "$out" | tee -a "$LOGFILE"
@@ -0,0 +1,56 @@
+# Helpers for the tests: pull single functions out of setup_oci_terraform.sh so they can
+# run against stubs and fixtures, without a tenancy or the rest of the script
+
+TESTS_DIR=$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)
+SCRIPT="$TESTS_DIR/../setup_oci_terraform.sh"
+FIXTURES="$TESTS_DIR/fixtures"
+
+# load_functions NAME...: define the named top-level functions from the script
+load_functions() {
+    local name body
+    for name in "$@"; do
+        body=$(awk -v f="$name" '$0 ~ "^"f"\\(\\) \\{" {p=1} p {print} p && /^}/ {exit}' "$SCRIPT")
+        [ -n "$body" ] || { echo "no function $name in $SCRIPT" >&2; return 1; }
+        eval "$body"
+    done
+}
+
+# load_constants NAME...: define the named constants and top-level defaults (scalars,
+# arrays, or strings spanning several lines): the definition is read until it parses
+load_constants() {
+    local name start body line
+    for name in "$@"; do
+        start=$(grep -nE "^(readonly )?$name=" "$SCRIPT" | head -1 | cut -d: -f1)
+        [ -n "$start" ] || { echo "no constant $name in $SCRIPT" >&2; return 1; }
+        body=""
+        while IFS= read -r line; do
+            body+="${body:+$'\n'}$line"
+            bash -n <<< "$body" 2>/dev/null && break
+        done < <(tail -n +"$start" "$SCRIPT")
+        eval "${body#readonly }"
+    done
+}
+
+# Output helpers as plain lines, so tests can match on them
+print_status() { echo "[INFO] $1"; }
+print_warning() { echo "[WARNING] $1"; }
+print_error() { echo "[ERROR] $1"; }
+print_success() { echo "[SUCCESS] $1"; }
+print_debug() { :; }
+print_subheader() { echo "== $1"; }
+print_header() { echo "== $1"; }
+
+fail() {
+    echo "    $*" >&2
+    return 1
+}
+
+# assert_eq EXPECTED ACTUAL [WHAT]
+assert_eq() {
+    [ "$1" = "$2" ] || fail "${3:-value}: expected '$1', got '$2'"
+}
+
+# assert_contains HAYSTACK NEEDLE [WHAT]
+assert_contains() {
+    grep -qF -- "$2" <<< "$1" || fail "${3:-output} does not contain '$2'"$'\n'"$1"
+}
@@ -0,0 +1,33 @@
+#!/usr/bin/env bash
+# Run every tests/test_*.sh (or the files given): each test_* function runs in its own
+# subshell and temporary directory, and the run fails if any of them does
+set -uo pipefail
+
+TESTS_DIR=$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)
+passed=0
+failed=0
+
+files=("$@")
+[ ${#files[@]} -gt 0 ] || files=("$TESTS_DIR"/test_*.sh)
+
+for file in "${files[@]}"; do
+    file=$(cd "$(dirname "$file")" && pwd)/${file##*/}
+    echo "${file##*/}"
+    tests=$(bash -c 'source "$1"; source "$2"; declare -F | awk "\$3 ~ /^test_/ {print \$3}"' _ "$TESTS_DIR/lib.sh" "$file")
+    for test in $tests; do
+        dir=$(mktemp -d)
+        # A separate shell, so set -e applies inside the test (it is ignored under "if")
+        if bash -euo pipefail -c 'cd "$1"; source "$2"; source "$3"; "$4"' _ "$dir" "$TESTS_DIR/lib.sh" "$file" "$test"; then
+            echo "  ok    $test"
+            passed=$((passed + 1))
+        else
+            echo "  FAIL  $test"
+            failed=$((failed + 1))
+        fi
+        rm -rf "$dir"
+    done
+done
+
+echo ""
+echo "$passed passed, $failed failed"
+[ "$failed" -eq 0 ]
@@ -0,0 +1,31 @@
+# account_state_from_error against OCI CLI and Terraform provider error output. Fixtures
+# are named "<expected state>--<case>.txt"; "none" means not an account state.
+
+load_constants ACCOUNT_STATE_ERRORS
+load_functions oci_service_error account_state_from_error
+
+test_fixtures_classify_to_their_state() {
+    local fixture expected actual rc=0
+    for fixture in "$FIXTURES"/account_state/*.txt; do
+        expected=$(basename "$fixture")
+        expected="${expected%%--*}"
+        actual=$(account_state_from_error "$(cat "$fixture")") || actual="none"
+        assert_eq "$expected" "$actual" "$(basename "$fixture")" || rc=1
+    done
+    return $rc
+}
+
+test_every_state_has_a_fixture() {
+    local state
+    for state in provisioning verification suspended trial_ended; do
+        compgen -G "$FIXTURES/account_state/$state--*.txt" >/dev/null || fail "no fixture for $state"
+    done
+}
+
+test_service_error_pairs() {
+    assert_eq "LimitExceeded|The following service limits were exceeded: standard-a1-core-count. Request a service limit increase from the service limits page in the console. " \
+        "$(oci_service_error "$(cat "$FIXTURES/account_state/none--terraform-limit-exceeded.txt")")" "terraform"
+    assert_eq "NotAuthenticated|The tenancy has been suspended." \
+        "$(oci_service_error "$(cat "$FIXTURES/account_state/suspended--cli-not-authenticated.txt")")" "cli"
+    ! oci_service_error "Error: something else went wrong" || fail "free text has no service error"
+}
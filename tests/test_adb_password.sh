@@ -0,0 +1,24 @@
+# The Autonomous Database ADMIN password is generated once and reused, never regenerated
+
+load_functions ensure_adb_admin_password
+
+ADB_ADMIN_PASSWORD_FILE=.adb-admin-password DRY_RUN=false
+
+test_existing_password_file_is_reused() {
+    unset TF_VAR_adb_admin_password
+    echo -n "Cc1Existing0password" > "$ADB_ADMIN_PASSWORD_FILE"
+    ensure_adb_admin_password
+    assert_eq "Cc1Existing0password" "$TF_VAR_adb_admin_password" "TF_VAR_adb_admin_password"
+    assert_eq "Cc1Existing0password" "$(cat "$ADB_ADMIN_PASSWORD_FILE")" "password file"
+}
+
+test_generated_once_when_absent() {
+    unset TF_VAR_adb_admin_password
+    ensure_adb_admin_password >/dev/null
+    local first="$TF_VAR_adb_admin_password"
+    [[ "$first" =~ ^Cc1[A-Za-z0-9]{20}$ ]] || fail "unexpected password shape: $first"
+    assert_eq 600 "$(stat -c %a "$ADB_ADMIN_PASSWORD_FILE" 2>/dev/null || stat -f %Lp "$ADB_ADMIN_PASSWORD_FILE")" "file mode"
+    unset TF_VAR_adb_admin_password
+    ensure_adb_admin_password
+    assert_eq "$first" "$TF_VAR_adb_admin_password" "second run"
+}
@@ -0,0 +1,22 @@
+# IAM bootstrap: group membership is confirmed by listing the group's users
+
+load_functions iam_group_has_user
+
+oci_cmd() {
+    echo "$1" >> oci.log
+    case "$1" in
+        "iam group list-users --group-id ocid1.group.ops "*) echo '["ocid1.user.a", "ocid1.user.b"]' ;;
+        "iam group list-users --group-id ocid1.group.empty "*) echo '[]' ;;
+        *) return 1 ;;
+    esac
+}
+
+test_member_found() {
+    iam_group_has_user ocid1.group.ops ocid1.user.b || fail "member not found"
+}
+
+test_missing_member_and_failed_listing() {
+    ! iam_group_has_user ocid1.group.ops ocid1.user.c || fail "non-member found"
+    ! iam_group_has_user ocid1.group.empty ocid1.user.a || fail "member of an empty group"
+    ! iam_group_has_user ocid1.group.denied ocid1.user.a || fail "failed listing counted as membership"
+}
@@ -0,0 +1,100 @@
+# cleanup: orphans across availability domains, what is never offered (attached, in state,
+# untagged), and failing closed when something cannot be read
+
+load_constants MANAGED_TAG_JQ
+load_functions workspace_state terraform_state_ids availability_domain_names oci_list_json \
+    find_orphaned_resources delete_orphaned_resource cleanup_orphaned_resources
+
+tenancy_ocid=ocid1.tenancy.oc1..t MANAGED_TAG="" DRY_RUN=false NON_INTERACTIVE=true
+INVENTORY_CACHE_FILE="$PWD/inventory.json"
+terraform_available() { return 0; }
+
+# Two availability domains. AD-1 has an attached boot volume, an orphaned one and an
+# attached block volume; AD-2 a boot volume in state and an orphaned block volume. Of the
+# unassigned reserved IPs one is in state. Set FAIL to a pattern to make that call fail.
+FAIL=""
+oci_cmd() {
+    echo "$1" >> oci.log
+    [ -z "$FAIL" ] || [[ "$1" != *$FAIL* ]] || return 1
+    local tagged='"tags": {"cloudcradle": "true"}'
+    case "$1" in
+        *"availability-domain list"*) echo '["AD-1", "AD-2"]' ;;
+        *"boot-volume-attachment list"*AD-1*) echo '["ocid1.bootvolume.attached"]' ;;
+        *"boot-volume-attachment list"*AD-2*) echo "" ;;
+        *"boot-volume list"*AD-1*)
+            echo "[{\"id\": \"ocid1.bootvolume.attached\", \"name\": \"arm-1 (Boot Volume)\", \"size\": 50, $tagged},
+                   {\"id\": \"ocid1.bootvolume.orphan\", \"name\": \"old (Boot Volume)\", \"size\": 47, $tagged}]" ;;
+        *"boot-volume list"*AD-2*) echo '[{"id": "ocid1.bootvolume.tracked", "name": "amd-1 (Boot Volume)", "size": 50}]' ;;
+        *"volume-attachment list"*) echo '["ocid1.volume.attached"]' ;;
+        *"volume list"*AD-1*) echo "[{\"id\": \"ocid1.volume.attached\", \"name\": \"arm-1-block\", \"size\": 50, $tagged}]" ;;
+        *"volume list"*AD-2*) echo '[{"id": "ocid1.volume.orphan", "name": "scratch", "size": 100}]' ;;
+        *"public-ip list"*)
+            echo "[{\"id\": \"ocid1.publicip.orphan\", \"name\": \"old-ip\", \"ip\": \"192.0.2.7\", $tagged},
+                   {\"id\": \"ocid1.publicip.tracked\", \"name\": \"amd-1-ip\", \"ip\": \"192.0.2.8\"}]" ;;
+        *" delete "*) ;;
+        *) return 1 ;;
+    esac
+}
+
+# The Terraform state tracks the reserved IP and boot volume of amd-1
+setup_state() {
+    echo '{"version": 4, "resources": [
+    {"mode": "managed", "type": "oci_core_public_ip", "name": "amd_reserved", "instances": [{"attributes": {"id": "ocid1.publicip.tracked"}}]},
+    {"mode": "managed", "type": "oci_core_instance", "name": "amd", "instances": [{"attributes": {"id": "ocid1.instance.a", "boot_volume_id": "ocid1.bootvolume.tracked"}}]},
+    {"mode": "managed", "type": "oci_core_boot_volume", "name": "amd", "instances": [{"attributes": {"id": "ocid1.bootvolume.tracked"}}]}]}' > terraform.tfstate
+}
+
+test_orphans_in_every_availability_domain() {
+    setup_state
+    assert_eq 'boot-volume|ocid1.bootvolume.orphan|old (Boot Volume)|47
+volume|ocid1.volume.orphan|scratch|100
+public-ip|ocid1.publicip.orphan|old-ip (192.0.2.7)|0' "$(find_orphaned_resources)" "orphans"
+}
+
+test_managed_tag_limits_the_candidates() {
+    setup_state
+    MANAGED_TAG=cloudcradle=true
+    assert_eq 'boot-volume|ocid1.bootvolume.orphan|old (Boot Volume)|47
+public-ip|ocid1.publicip.orphan|old-ip (192.0.2.7)|0' "$(find_orphaned_resources)" "orphans"
+}
+
+test_force_deletes_every_orphan() {
+    setup_state
+    local out
+    out=$(cleanup_orphaned_resources --force)
+    assert_contains "$out" "[SUCCESS] Deleted volume 'scratch'"
+    assert_contains "$out" "Reclaimed 147GB"
+    assert_eq "bv boot-volume delete --boot-volume-id ocid1.bootvolume.orphan --force
+bv volume delete --volume-id ocid1.volume.orphan --force
+network public-ip delete --public-ip-id ocid1.publicip.orphan --force" "$(grep ' delete ' oci.log)" "delete calls"
+}
+
+test_dry_run_and_non_interactive_delete_nothing() {
+    setup_state
+    DRY_RUN=true
+    assert_contains "$(cleanup_orphaned_resources)" "Would offer to delete 3 resource(s)"
+    DRY_RUN=false
+    assert_contains "$(cleanup_orphaned_resources)" "nothing deleted (use 'cleanup --force')"
+    ! grep -qs ' delete ' oci.log || fail "deleted something"
+}
+
+test_unreadable_listings_fail_closed() {
+    setup_state
+    local pattern out
+    for pattern in "availability-domain list" "boot-volume-attachment list" "compute volume-attachment list" "bv volume list" "public-ip list"; do
+        FAIL="$pattern"
+        out=$(cleanup_orphaned_resources --force 2>&1) && fail "cleanup succeeded when '$pattern' failed"
+        assert_contains "$out" "nothing deleted" "output when '$pattern' failed"
+    done
+    ! grep -qs ' delete ' oci.log || fail "deleted something"
+}
+
+test_unreadable_state_fails_closed() {
+    setup_state
+    mkdir .terraform
+    terraform() { return 1; }
+    local out
+    out=$(cleanup_orphaned_resources --force 2>&1) && fail "cleanup succeeded without a state"
+    assert_contains "$out" "Cannot read the Terraform state"
+    ! grep -qs ' delete ' oci.log || fail "deleted something"
+}
@@ -0,0 +1,44 @@
+# drift: exit 0 without drift, 2 with drift, and 1 (never a clean report) when the plan
+# cannot be produced or read
+
+load_functions drift_records_from_plan_json detect_drift
+
+TF_PARALLELISM=10
+PLAN_JSON="$FIXTURES/plan/drift.json"
+terraform() {
+    case "$1" in
+        plan) return 0 ;;
+        show) cat "$PLAN_JSON" ;;
+    esac
+}
+
+test_drift_exits_2() {
+    local rc=0
+    detect_drift --json > records.json 2>/dev/null || rc=$?
+    assert_eq 2 "$rc" "exit code"
+    [ "$(jq 'length' records.json)" -gt 0 ] || fail "no records"
+}
+
+test_no_drift_exits_0() {
+    echo '{"format_version": "1.2", "resource_changes": []}' > empty.json
+    PLAN_JSON=empty.json
+    assert_contains "$(detect_drift 2>&1)" "No drift"
+}
+
+test_unreadable_plan_is_an_error() {
+    local out rc
+    for PLAN_JSON in /nonexistent not-json.json; do
+        echo "{ truncated" > not-json.json
+        out=$(detect_drift 2>&1) && rc=0 || rc=$?
+        assert_eq 1 "$rc" "exit code for $PLAN_JSON"
+        assert_contains "$out" "[ERROR] Could not read the plan"
+        [[ "$out" != *"No drift"* ]] || fail "reported no drift for $PLAN_JSON"
+    done
+}
+
+test_failed_plan_is_an_error() {
+    terraform() { return 1; }
+    local rc=0
+    detect_drift >/dev/null 2>&1 || rc=$?
+    assert_eq 1 "$rc" "exit code"
+}
@@ -0,0 +1,59 @@
+# parse_global_flags: flag forms, accumulating flags, value checks, and what is left for
+# the subcommand
+
+load_constants SUPPORTED_OSES PROVISIONER_MODULES
+load_functions parse_global_flags
+
+TF_TARGETS="" TF_REPLACE="" PROVISION="" DRY_RUN=false TF_PARALLELISM=10 LAYOUT=flat
+
+test_value_after_the_flag_or_after_equals() {
+    parse_global_flags --parallelism 4 --layout=modules
+    assert_eq 4 "$TF_PARALLELISM" "--parallelism"
+    assert_eq modules "$LAYOUT" "--layout="
+}
+
+test_subcommand_arguments_are_left() {
+    parse_global_flags --dry-run plan --target arm-1 extra
+    assert_eq true "$DRY_RUN" "--dry-run"
+    assert_eq "plan extra" "${REMAINING_ARGS[*]}" "REMAINING_ARGS"
+}
+
+test_targets_and_replacements_accumulate() {
+    parse_global_flags --target arm-1 --target=amd-1 --replace oci_core_instance.arm
+    assert_eq "arm-1 amd-1" "$TF_TARGETS" "TF_TARGETS"
+    assert_eq "oci_core_instance.arm" "$TF_REPLACE" "TF_REPLACE"
+}
+
+test_provision_accumulates_until_none() {
+    parse_global_flags --provision docker --provision=caddy
+    assert_eq "docker,caddy" "$PROVISION" "two modules"
+    parse_global_flags --provision none
+    assert_eq none "$PROVISION" "none"
+    parse_global_flags --provision tailscale
+    assert_eq tailscale "$PROVISION" "after none"
+}
+
+test_profile_and_region_are_pinned() {
+    parse_global_flags --profile work --region=eu-frankfurt-1
+    assert_eq "work true true" "$OCI_PROFILE $OCI_PROFILE_PINNED $OCI_PROFILE_FLAG" "--profile"
+    assert_eq "eu-frankfurt-1 true" "$OCI_REGION $OCI_REGION_PINNED" "--region"
+}
+
+test_double_dash_is_kept_after_a_subcommand() {
+    parse_global_flags exec --selector role=web -- sudo systemctl --now restart app
+    assert_eq "exec --selector role=web -- sudo systemctl --now restart app" "${REMAINING_ARGS[*]}" "after exec"
+    parse_global_flags -- --dry-run
+    assert_eq "--dry-run" "${REMAINING_ARGS[*]}" "leading --"
+    assert_eq false "$DRY_RUN" "DRY_RUN"
+}
+
+test_invalid_values_exit_2() {
+    local args rc out
+    for args in "--parallelism 0" "--parallelism x" "--layout nested" "--engine opentf" "--target" \
+        "--proxy corp:3128" "--provision ansible" "--terraform-version latest" "--profile"; do
+        # shellcheck disable=SC2086
+        out=$( (parse_global_flags $args) 2>&1 ) && rc=0 || rc=$?
+        assert_eq 2 "$rc" "exit code of $args"
+        assert_contains "$out" "[ERROR] ${args%% *}" "error for $args"
+    done
+}
@@ -0,0 +1,42 @@
+# grant-access: expiry shown in UTC and keys sent to each running instance
+
+load_functions ttl_seconds grant_access
+load_constants GRANT_ACCESS_DEFAULT_TTL GRANT_ACCESS_MAX_TTL
+
+DRY_RUN=false
+
+ssh_authorized_user_name() { echo "${1#*:}"; }
+parse_fleet_targets() { FLEET_TARGETS=(web-1 web-2); }
+fetch_ssh_user_keys() { printf '%s\n' "ssh-ed25519 AAAAC3one alice@laptop" "ssh-ed25519 AAAAC3two alice@desk"; }
+power_state_of() { [ "$1" = web-2 ] && echo STOPPED || echo RUNNING; }
+fleet_ssh_host() { echo 192.0.2.10; }
+audit_log() { echo "$*" >> audit.log; }
+access_grant_remote() {
+    printf '%s\n' "$@" > remote.args
+    echo "granted until later"
+}
+
+test_expiry_is_utc_iso8601() {
+    local out
+    out=$(grant_access --user github:alice --ttl 2h)
+    [[ "$out" =~ access\ until\ [0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}Z ]] \
+        || fail "expiry not in UTC ISO 8601"$'\n'"$out"
+    assert_contains "$(cat audit.log)" "hosts=web-1" "audit entry"
+}
+
+test_expiry_matches_ttl() {
+    local out expires_at expires before
+    before=$(date +%s)
+    out=$(grant_access --user github:alice --ttl 90m)
+    expires_at=$(grep -o 'until [0-9T:Z-]*' <<< "$out" | head -1 | cut -d' ' -f2)
+    expires=$(jq -n --arg t "$expires_at" '$t | fromdate')
+    [ $((expires - before)) -ge 5400 ] && [ $((expires - before)) -le 5402 ] \
+        || fail "expires $expires_at is not 90 minutes after $before"
+}
+
+test_keys_sent_as_one_base64_line() {
+    grant_access --user github:alice --sudo web-1 >/dev/null
+    assert_eq 6 "$(wc -l < remote.args | tr -d ' ')" "remote arguments"
+    assert_eq "192.0.2.10 grant alice true" "$(sed -n '1p;2p;3p;5p' remote.args | paste -sd' ' -)" "grant arguments"
+    assert_eq "$(fetch_ssh_user_keys)" "$(sed -n 6p remote.args | base64 -d)" "decoded keys"
+}
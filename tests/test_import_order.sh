@@ -0,0 +1,36 @@
+# Import ordering: dependency edges of the generated config, flat or split into modules/
+
+load_functions terraform_dependency_edges import_queue_order
+
+write_config() {
+    cat > "$1" <<'HCL'
+resource "oci_core_vcn" "main" {
+  cidr_block = "10.0.0.0/16"
+}
+
+resource "oci_core_subnet" "public" {
+  vcn_id = oci_core_vcn.main.id # parent
+}
+HCL
+}
+
+test_flat_layout_without_modules() {
+    write_config main.tf
+    local edges
+    edges=$(terraform_dependency_edges .) || fail "edges failed without modules/"
+    assert_contains "$edges" "oci_core_vcn.main oci_core_subnet.public" "edges"
+}
+
+test_modules_layout_and_order() {
+    mkdir -p modules/network
+    write_config modules/network/main.tf
+    echo 'locals { }' > main.tf
+    IMPORT_QUEUE=("oci_core_subnet.public|ocid1.subnet|subnet" "oci_core_vcn.main|ocid1.vcn|vcn")
+    local edges
+    edges=$(terraform_dependency_edges .)
+    assert_eq "1 0" "$(import_queue_order "$edges" | paste -sd' ' -)" "import order"
+}
+
+test_empty_directory() {
+    assert_eq "" "$(terraform_dependency_edges .)" "edges"
+}
@@ -0,0 +1,117 @@
+# Inventory and Free Tier limits against a hand-written tenancy: the real oci_cmd replays
+# tests/fixtures/oci (OCI_CLI_FIXTURES_DIR). The tenancy has amd-1 and arm-1 (2 OCPUs,
+# 12GB) tagged cloudcradle=true, an untagged manual-arm (1 OCPU, 6GB), a paid E4 instance,
+# a detached boot volume, and a tagged and an untagged 50GB block volume.
+
+load_constants MANAGED_TAG_JQ FREE_TIER_AMD_SHAPE FREE_TIER_ARM_SHAPE FREE_TIER_MIN_BLOCK_VOLUME_GB \
+    FREE_TIER_MAX_VOLUME_BACKUPS FREE_TIER_MAX_AMD_INSTANCES FREE_TIER_MAX_ARM_OCPUS \
+    FREE_TIER_MAX_ARM_MEMORY_GB FREE_TIER_MAX_STORAGE_GB FREE_TIER_MAX_ARM_INSTANCES FREE_TIER_MAX_VCNS
+load_functions command_exists oci_command_verb is_retryable_create_verb with_retry_token \
+    oci_fixture_response ensure_session_token_fresh rate_limit_wait chaos_oci_fault oci_cmd safe_jq \
+    has_managed_tag inventory_parallel inventory_instance_lookup inventory_compute_instances \
+    inventory_storage_resources inventory_volume_backups calculate_available_resources boot_volume_gb \
+    orphaned_block_volume_gb storage_budget_gb block_volumes_tf block_volume_spec_error \
+    block_volume_total_gb free_tier_violation free_tier_violations free_tier_tenancy_violations
+
+chaos_enabled() { return 1; }
+tracing_enabled() { return 1; }
+report_account_state() { :; }
+fetch_region_subscriptions() { home_region=us-ashburn-1; }
+
+OCI_CLI_FIXTURES_DIR="$FIXTURES/oci" OCI_CLI_BIN=false OCI_RETRY_TOKENS=true OCI_RATE_LIMIT=0
+OCI_CONFIG_FILE=config OCI_PROFILE=DEFAULT OCI_CLI_AUTH="" auth_method=api_key OCI_REGION=""
+OCI_CLI_CONNECTION_TIMEOUT=10 OCI_CLI_READ_TIMEOUT=60 OCI_CLI_MAX_RETRIES=3 OCI_CMD_TIMEOUT=30
+OCI_LAST_ERROR="" SESSION_TOKEN_MTIME="" SESSION_TOKEN_REFRESHING=false RATE_LIMIT_FILE=""
+CHAOS_SEED="" INVENTORY_CONCURRENCY=4 MANAGED_TAG="" SERVICE_LIMITS=free ALLOW_NON_HOME_REGION=false
+tenancy_ocid=ocid1.tenancy.oc1..t region=us-ashburn-1 availability_domain="Uocm:US-ASHBURN-AD-1"
+declare -A EXISTING_AMD_INSTANCES=() EXISTING_ARM_INSTANCES=() OTHER_INSTANCES=() INSTANCE_SHAPES=()
+declare -A EXISTING_BOOT_VOLUMES=() EXISTING_BLOCK_VOLUMES=() EXISTING_VCNS=()
+UNMANAGED_VCNS=0
+
+# The configuration: amd-1, and arm-1 with 2 OCPUs, 12GB and a 50GB block volume
+amd_micro_instance_count=1 amd_micro_hostnames=(amd-1) amd_micro_boot_volume_size_gb=50 amd_block_volumes=(0)
+arm_flex_instance_count=1 arm_flex_hostnames=(arm-1) arm_flex_block_volumes=(50)
+arm_flex_ocpus_per_instance="2" arm_flex_memory_per_instance="12" arm_flex_boot_volume_size_gb="50"
+
+inventory() {
+    inventory_compute_instances >/dev/null
+    inventory_storage_resources >/dev/null
+    inventory_volume_backups >/dev/null
+}
+
+# violation_codes: "<key>:<code>" of each Free Tier violation, sorted
+violation_codes() {
+    { free_tier_violations; free_tier_tenancy_violations; } | cut -f1,2 | tr '\t' ':' | sort | tr '\n' ' '
+}
+
+test_instances_counted_by_shape() {
+    inventory
+    assert_eq 1 "${#EXISTING_AMD_INSTANCES[@]}" "AMD instances"
+    assert_eq 2 "${#EXISTING_ARM_INSTANCES[@]}" "ARM instances"
+    assert_eq "paid-1|RUNNING|VM.Standard.E4.Flex|1|16" "${OTHER_INSTANCES[ocid1.instance.oc1.iad.paid1]}" "paid instance"
+    assert_eq "amd-1|RUNNING|VM.Standard.E2.1.Micro|192.0.2.11|10.0.1.11|2603:c020:4000:1a00::11" \
+        "${EXISTING_AMD_INSTANCES[ocid1.instance.oc1.iad.amd1]}" "amd-1 with its VNIC"
+    assert_eq "arm-1|RUNNING|VM.Standard.A1.Flex|192.0.2.12|10.0.1.12|2|12|2603:c020:4000:1a00::12" \
+        "${EXISTING_ARM_INSTANCES[ocid1.instance.oc1.iad.arm1]}" "arm-1 with its shape config"
+    assert_eq "0 0 0" "$UNMANAGED_AMD_INSTANCES $UNMANAGED_ARM_OCPUS $UNMANAGED_ARM_MEMORY_GB" "unmanaged usage"
+}
+
+test_storage_and_backup_totals() {
+    inventory
+    assert_eq 5 "${#EXISTING_BOOT_VOLUMES[@]}" "boot volumes"
+    assert_eq "old (Boot Volume)|47|none" "${EXISTING_BOOT_VOLUMES[ocid1.bootvolume.oc1.iad.old]}" "detached boot volume"
+    assert_eq "147 50 47" "$(boot_volume_gb eligible) $(boot_volume_gb other) $(boot_volume_gb detached)" "boot GB eligible/other/detached"
+    assert_eq 2 "${#EXISTING_BLOCK_VOLUMES[@]}" "block volumes"
+    assert_eq 50 "$(orphaned_block_volume_gb)" "block GB not in the configuration"
+    # 200GB - 50GB unplanned block volume - 97GB of boot volumes of the paid and no instance
+    assert_eq 53 "$(storage_budget_gb)" "storage budget"
+    assert_eq "2 1" "$VOLUME_BACKUPS_SCHEDULED $VOLUME_BACKUPS_MANUAL" "backups scheduled/manual"
+}
+
+test_available_resources() {
+    inventory
+    calculate_available_resources
+    assert_eq "1 1 6 -144" "$AVAILABLE_AMD_INSTANCES $AVAILABLE_ARM_OCPUS $AVAILABLE_ARM_MEMORY $AVAILABLE_STORAGE" \
+        "available AMD/OCPUs/memory/storage"
+    assert_eq 2 "$USED_ARM_INSTANCES" "used ARM instances"
+}
+
+test_untagged_resources_count_as_unmanaged() {
+    MANAGED_TAG=cloudcradle=true
+    inventory
+    assert_eq "1 1" "${#EXISTING_AMD_INSTANCES[@]} ${#EXISTING_ARM_INSTANCES[@]}" "managed AMD/ARM instances"
+    assert_eq "0 1 6" "$UNMANAGED_AMD_INSTANCES $UNMANAGED_ARM_OCPUS $UNMANAGED_ARM_MEMORY_GB" "unmanaged usage"
+    assert_eq 50 "$UNMANAGED_STORAGE_GB" "unmanaged storage"
+    assert_eq 1 "${#EXISTING_BLOCK_VOLUMES[@]}" "managed block volumes"
+    # manual-arm's boot volume now lies outside the configuration too
+    assert_eq 6 "$(storage_budget_gb)" "storage budget"
+    calculate_available_resources
+    assert_eq "1 1 6" "$AVAILABLE_AMD_INSTANCES $AVAILABLE_ARM_OCPUS $AVAILABLE_ARM_MEMORY" "available AMD/OCPUs/memory"
+}
+
+test_violations_of_the_configuration() {
+    inventory
+    # 100GB boot + 50GB block against a 53GB budget; A1.Flex is not in the shape list
+    assert_eq "arm_flex_instance_count:shape-ad block_volumes:quota-storage " "$(violation_codes)" "violations"
+    assert_contains "$(free_tier_violations)" "100GB boot + 50GB block volumes, but only 53GB of 200GB storage is available"
+}
+
+test_violations_with_unmanaged_usage() {
+    MANAGED_TAG=cloudcradle=true
+    inventory
+    arm_flex_ocpus_per_instance="4" arm_flex_memory_per_instance="24"
+    UNMANAGED_VCNS=2
+    assert_eq "arm_flex_instance_count:shape-ad arm_flex_memory_per_instance:quota-arm-memory arm_flex_ocpus_per_instance:quota-arm-ocpus block_volumes:quota-storage vcn_cidrs:quota-vcn " \
+        "$(violation_codes)" "violations"
+    assert_contains "$(free_tier_violations)" "4 ARM OCPUs, but only 3 of 4 are available"
+    assert_contains "$(free_tier_violations)" "24GB ARM memory, but only 18GB of 24GB is available"
+}
+
+test_configuration_within_limits() {
+    inventory
+    # arm-1 alone, with a tenancy storage limit (SERVICE_LIMITS=tenancy) that leaves room
+    # next to the 197GB of volumes outside the configuration
+    amd_micro_instance_count=0 arm_flex_block_volumes=(0)
+    FREE_TIER_MAX_STORAGE_GB=300
+    assert_eq "" "$(free_tier_violations)" "violations"
+}
@@ -0,0 +1,73 @@
+# The SSH key materialized from the keychain is shared by concurrent runs in a workspace
+# and removed by the last one to exit
+
+load_functions command_exists file_locked keychain_hold_ssh_key keychain_release_ssh_key keychain_materialize_ssh_key
+
+keychain_lookup() { echo "PRIVATE KEY"; }
+keychain_backend() { echo fake; }
+
+setup_workspace() {
+    KEYCHAIN_MATERIALIZED=""
+    mkdir -p ssh_keys
+    echo "PUBLIC KEY" > ssh_keys/id_rsa.pub
+}
+
+test_materializes_and_removes_on_release() {
+    setup_workspace
+    keychain_materialize_ssh_key
+    assert_eq "PRIVATE KEY" "$(cat ssh_keys/id_rsa)" "materialized key"
+    assert_eq "$PWD/ssh_keys/id_rsa" "$KEYCHAIN_MATERIALIZED" "KEYCHAIN_MATERIALIZED"
+    file_locked "$KEYCHAIN_MATERIALIZED" keychain_release_ssh_key "$KEYCHAIN_MATERIALIZED"
+    [ ! -e ssh_keys/id_rsa ] || fail "key left behind"
+    [ ! -e ssh_keys/id_rsa.holders ] || fail "holders left behind"
+}
+
+test_key_stays_while_another_run_holds_it() {
+    setup_workspace
+    sleep 30 &
+    local other=$!
+    mkdir -p ssh_keys/id_rsa.holders
+    echo "PRIVATE KEY" > ssh_keys/id_rsa
+    : > "ssh_keys/id_rsa.holders/$other"
+
+    keychain_materialize_ssh_key
+    assert_eq "$PWD/ssh_keys/id_rsa" "$KEYCHAIN_MATERIALIZED" "joined the other run"
+    file_locked "$KEYCHAIN_MATERIALIZED" keychain_release_ssh_key "$KEYCHAIN_MATERIALIZED"
+    [ -f ssh_keys/id_rsa ] || fail "key removed while the other run holds it"
+
+    kill "$other"
+    wait "$other" 2>/dev/null || true
+    : > "ssh_keys/id_rsa.holders/$$"
+    keychain_release_ssh_key "$PWD/ssh_keys/id_rsa"
+    [ ! -e ssh_keys/id_rsa ] || fail "key kept for a run that is gone"
+}
+
+test_users_own_key_file_is_left_alone() {
+    setup_workspace
+    echo "USER KEY" > ssh_keys/id_rsa
+    keychain_materialize_ssh_key
+    assert_eq "" "$KEYCHAIN_MATERIALIZED" "KEYCHAIN_MATERIALIZED"
+    assert_eq "USER KEY" "$(cat ssh_keys/id_rsa)" "key file"
+}
+
+test_missing_keychain_entry_warns() {
+    setup_workspace
+    keychain_lookup() { return 1; }
+    local out
+    out=$(keychain_materialize_ssh_key 2>&1)
+    assert_contains "$out" "not in the fake keychain"
+    [ ! -e ssh_keys/id_rsa ] || fail "empty key file left behind"
+}
+
+test_security_gets_the_value_on_stdin() {
+    load_functions keychain_store keychain_account
+    keychain_backend() { echo security; }
+    security() { echo "$*" > args; cat > stdin; }
+    SECRET_STORE_SERVICE=cloudcradle
+    printf 'secret value' | keychain_store tf-backend-secret-key
+    local encoded
+    encoded=$(printf 'secret value' | base64)
+    ! grep -qF "$encoded" args || fail "value passed as an argument: $(cat args)"
+    assert_eq "-w" "$(awk '{print $NF}' args)" "last argument"
+    assert_eq "$encoded"$'\n'"$encoded" "$(cat stdin)" "stdin"
+}
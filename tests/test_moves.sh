@@ -0,0 +1,88 @@
+# moves.tf and renames.tf: moved blocks from position-indexed state to hostname keys, and
+# from an old hostname to a new one
+
+load_functions workspace_state state_indexed_resources positional_resources configured_hostnames \
+    moved_block block_volumes_tf create_terraform_moves renamed_moved_blocks tf_address
+
+write_generated_file() { cat > "$1"; }
+terraform_available() { return 0; }
+
+LAYOUT=flat
+amd_micro_instance_count=1 amd_micro_hostnames=(amd-1) amd_block_volumes=(0)
+arm_flex_instance_count=2 arm_flex_hostnames=(arm-1 arm-2) arm_flex_block_volumes=(50 0)
+
+# state RESOURCE... with RESOURCE "<type.name>|<index>|<display name>|<id>[|<asset id>]":
+# a terraform.tfstate holding those instances
+state() {
+    printf '%s\n' "$@" | jq -Rn '{version: 4, resources: [inputs | split("|")
+        | {mode: "managed", type: (.[0] | split(".")[0]), name: (.[0] | split(".")[1]),
+           instances: [{index_key: (.[1] | tonumber? // .), attributes: {display_name: .[2], id: .[3], asset_id: .[4]}}]}]}' > terraform.tfstate
+}
+
+# moves: "from -> to" per moved block in moves.tf
+moves() {
+    awk '/from =/ {from=$3} /to   =/ {print from " -> " $3}' "${1:-moves.tf}"
+}
+
+test_positions_move_to_display_name_or_hostname() {
+    state "oci_core_instance.amd|0|amd-1|ocid1.instance.a" "oci_core_ipv6.amd_ipv6|0||ocid1.ipv6.a" \
+        "oci_core_instance.arm|0|arm-1|ocid1.instance.b" "oci_core_instance.arm|1|old-name|ocid1.instance.c"
+    create_terraform_moves >/dev/null
+    assert_eq 'oci_core_instance.amd[0] -> oci_core_instance.amd["amd-1"]
+oci_core_ipv6.amd_ipv6[0] -> oci_core_ipv6.amd_ipv6["amd-1"]
+oci_core_instance.arm[0] -> oci_core_instance.arm["arm-1"]
+oci_core_instance.arm[1] -> oci_core_instance.arm["arm-2"]' "$(moves)" "moves"
+}
+
+test_display_names_win_over_positions() {
+    state "oci_core_instance.arm|0|arm-2|ocid1.instance.b" "oci_core_instance.arm|1|arm-1|ocid1.instance.c"
+    create_terraform_moves >/dev/null
+    assert_eq 'oci_core_instance.arm[0] -> oci_core_instance.arm["arm-2"]
+oci_core_instance.arm[1] -> oci_core_instance.arm["arm-1"]' "$(moves)" "moves"
+}
+
+test_block_volume_and_its_backup_assignment_follow_the_instance() {
+    state "oci_core_instance.arm|0|arm-1|ocid1.instance.b" "oci_core_volume.arm_block|0|data|ocid1.volume.d" \
+        "oci_core_volume_attachment.arm_block|0||ocid1.attachment.d" \
+        "oci_core_volume_backup_policy_assignment.volumes|data|data|ocid1.assignment.d|ocid1.volume.d"
+    create_terraform_moves >/dev/null
+    assert_eq 'oci_core_instance.arm[0] -> oci_core_instance.arm["arm-1"]
+oci_core_volume.arm_block[0] -> oci_core_volume.block["arm-1-block"]
+oci_core_volume_attachment.arm_block[0] -> oci_core_volume_attachment.block["arm-1-block"]
+oci_core_volume_backup_policy_assignment.volumes["data"] -> oci_core_volume_backup_policy_assignment.volumes["arm-1-block"]' "$(moves)" "moves"
+}
+
+test_keyed_state_needs_no_moves() {
+    state 'oci_core_instance.arm|arm-1|arm-1|ocid1.instance.b'
+    create_terraform_moves >/dev/null
+    assert_eq "" "$(moves)" "moves"
+}
+
+test_unreadable_state_moves_by_position() {
+    mkdir .terraform
+    terraform() { return 1; }
+    local out
+    out=$(create_terraform_moves)
+    assert_contains "$out" "[WARNING] Terraform state not readable"
+    assert_eq 'oci_core_instance.amd[0] -> oci_core_instance.amd["amd-1"]
+oci_core_ipv6.amd_ipv6[0] -> oci_core_ipv6.amd_ipv6["amd-1"]
+oci_core_instance.arm[0] -> oci_core_instance.arm["arm-1"]
+oci_core_ipv6.arm_ipv6[0] -> oci_core_ipv6.arm_ipv6["arm-1"]
+oci_core_instance.arm[1] -> oci_core_instance.arm["arm-2"]
+oci_core_ipv6.arm_ipv6[1] -> oci_core_ipv6.arm_ipv6["arm-2"]
+oci_core_volume.arm_block[0] -> oci_core_volume.block["arm-1-block"]
+oci_core_volume_attachment.arm_block[0] -> oci_core_volume_attachment.block["arm-1-block"]' "$(moves)" "moves"
+}
+
+test_rename_moves_every_resource_keyed_by_hostname() {
+    arm_flex_hostnames=(web-1 arm-2) arm_flex_block_volumes=("50+20" 0)
+    renamed_moved_blocks arm-1 web-1 > renames.tf
+    local out
+    out=$(moves renames.tf)
+    assert_contains "$out" 'oci_core_instance.arm["arm-1"] -> oci_core_instance.arm["web-1"]'
+    assert_contains "$out" 'oci_core_public_ip.arm_reserved["arm-1"] -> oci_core_public_ip.arm_reserved["web-1"]'
+    assert_contains "$out" 'oci_core_volume_backup_policy_assignment.volumes["arm-1-boot"] -> oci_core_volume_backup_policy_assignment.volumes["web-1-boot"]'
+    assert_contains "$out" 'oci_core_volume.block["arm-1-block"] -> oci_core_volume.block["web-1-block"]'
+    assert_contains "$out" 'oci_core_volume_attachment.block["arm-1-block-2"] -> oci_core_volume_attachment.block["web-1-block-2"]'
+    assert_eq 15 "$(wc -l <<< "$out")" "moved blocks"
+}
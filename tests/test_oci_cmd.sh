@@ -0,0 +1,116 @@
+# oci_cmd: canned responses from OCI_CLI_FIXTURES_DIR, and the arguments and error
+# handling around a real CLI (a stub that records how it was called)
+
+load_functions command_exists sha256_stdin oci_command_verb is_retryable_create_verb retry_token_init \
+    retry_token_supported with_retry_token \
+    oci_fixture_response ensure_session_token_fresh rate_limit_init epoch_us rate_limit_reserve \
+    rate_limit_throttled rate_limit_locked file_locked rate_limit_wait chaos_oci_fault oci_cmd
+
+chaos_enabled() { return 1; }
+tracing_enabled() { return 1; }
+session_token_file() { echo "$PWD/no-token"; }
+report_account_state() { echo "$1" > account-state; }
+
+OCI_CONFIG_FILE="$PWD/config" OCI_PROFILE=DEFAULT OCI_CLI_AUTH="" auth_method=api_key OCI_REGION=""
+OCI_CLI_CONNECTION_TIMEOUT=10 OCI_CLI_READ_TIMEOUT=60 OCI_CLI_MAX_RETRIES=3 OCI_CMD_TIMEOUT=30
+OCI_CLI_FIXTURES_DIR="" OCI_RETRY_TOKENS=true OCI_RETRY_TOKEN_SEED=seed OCI_RATE_LIMIT=0
+OCI_LAST_ERROR="" SESSION_TOKEN_MTIME="" SESSION_TOKEN_REFRESHING=false RATE_LIMIT_FILE="" RETRY_TOKEN_VERBS_FILE=""
+
+# fake_oci [EXIT] [OUTPUT]: an OCI CLI that logs its arguments to oci.log, offers
+# --opc-retry-token in its help (long, like the real one, and logged to help.log), and
+# otherwise prints OUTPUT and exits with EXIT
+fake_oci() {
+    cat > oci <<STUB
+#!/usr/bin/env bash
+[ "\${*: -1}" != "--help" ] || { echo "\$*" >> "$PWD/help.log"; echo "  --opc-retry-token TEXT"; seq 1 50000; exit 0; }
+printf '%s\n' "\$*" >> "$PWD/oci.log"
+printf '%s\n' '${2:-[]}'
+exit ${1:-0}
+STUB
+    chmod +x oci
+    OCI_CLI_BIN="$PWD/oci"
+}
+
+test_fixture_for_the_verb() {
+    OCI_CLI_FIXTURES_DIR="$FIXTURES/oci"
+    local out
+    out=$(oci_cmd "compute instance list --compartment-id ocid1.tenancy.oc1..t --all")
+    assert_eq "amd-1 arm-1 manual-arm paid-1" "$(jq -r '[.[].name] | join(" ")' <<< "$out")"
+}
+
+test_fixture_for_the_resource_wins() {
+    OCI_CLI_FIXTURES_DIR="$FIXTURES/oci"
+    assert_eq arm-1 "$(oci_cmd "compute instance get --instance-id ocid1.instance.oc1.iad.arm1" | jq -r '.data."display-name"')" "arm-1"
+    assert_eq unknown "$(oci_cmd "compute instance get --instance-id ocid1.instance.oc1.iad.other" | jq -r '.data."display-name"')" "other"
+}
+
+test_missing_fixture_fails_like_an_api_error() {
+    OCI_CLI_FIXTURES_DIR="$FIXTURES/oci"
+    ! oci_cmd "network vcn list --compartment-id ocid1.tenancy.oc1..t" >/dev/null || fail "succeeded without a fixture"
+}
+
+test_passes_config_profile_auth_and_region() {
+    fake_oci 0 '{"data": []}'
+    OCI_PROFILE=work OCI_REGION=eu-frankfurt-1 auth_method=security_token
+    assert_eq '{"data": []}' "$(oci_cmd "iam region list")" "output"
+    local call
+    call=$(cat oci.log)
+    assert_contains "$call" "--config-file $PWD/config --profile work"
+    assert_contains "$call" "--auth security_token"
+    assert_contains "$call" "--region eu-frankfurt-1"
+    assert_contains "$call" "iam region list"
+}
+
+test_oci_cli_auth_overrides_the_detected_method() {
+    fake_oci
+    OCI_CLI_AUTH=instance_principal auth_method=api_key
+    oci_cmd "iam region list" >/dev/null
+    assert_contains "$(cat oci.log)" "--auth instance_principal"
+}
+
+test_create_calls_get_a_stable_retry_token() {
+    fake_oci
+    oci_cmd "compute instance launch --display-name arm-1" >/dev/null
+    oci_cmd "compute instance launch --display-name arm-1" >/dev/null
+    oci_cmd "compute instance list" >/dev/null
+    local tokens
+    tokens=$(grep -o -- '--opc-retry-token [0-9a-f]*' oci.log | sort -u | wc -l)
+    assert_eq 1 "$tokens" "distinct tokens for the repeated launch"
+    ! sed -n 3p oci.log | grep -q -- --opc-retry-token || fail "list call got a retry token"
+}
+
+test_failure_keeps_the_error_and_reports_the_account_state() {
+    fake_oci 1 'ServiceError: {"code": "NotAuthorizedOrNotFound", "status": 404}'
+    ! oci_cmd "compute instance list" >/dev/null || fail "failed call succeeded"
+    assert_contains "$OCI_LAST_ERROR" "NotAuthorizedOrNotFound" "OCI_LAST_ERROR"
+    assert_contains "$(cat account-state)" "NotAuthorizedOrNotFound" "account state input"
+}
+
+test_rate_limit_bucket_is_private_and_emptied_by_429() {
+    export TMPDIR="$PWD"
+    OCI_RATE_LIMIT=5 OCI_RATE_BURST=2
+    rate_limit_init
+    [ -f "$RATE_LIMIT_FILE" ] && [ ! -L "$RATE_LIMIT_FILE" ] || fail "no bucket file"
+    [[ "$RATE_LIMIT_FILE" != *".$$" ]] || fail "bucket named after the PID: $RATE_LIMIT_FILE"
+    assert_eq 600 "$(stat -c %a "$RATE_LIMIT_FILE")" "bucket mode"
+
+    fake_oci 0
+    oci_cmd "iam region list" >/dev/null
+    [ "$(cut -d' ' -f1 "$RATE_LIMIT_FILE")" -gt 0 ] || fail "first call did not leave tokens"
+    fake_oci 1 'ServiceError: {"code": "TooManyRequests", "status": 429}'
+    ! oci_cmd "iam region list" >/dev/null || fail "throttled call succeeded"
+    assert_eq -5000000 "$(cut -d' ' -f1 "$RATE_LIMIT_FILE")" "tokens after a 429"
+}
+
+test_retry_token_support_is_looked_up_once_per_verb() {
+    export TMPDIR="$PWD"
+    retry_token_init
+    fake_oci
+    oci_cmd "compute instance launch --display-name arm-1" >/dev/null
+    oci_cmd "compute instance launch --display-name arm-2" >/dev/null
+    (oci_cmd "compute instance launch --display-name arm-3" >/dev/null)
+    oci_cmd "bv volume create --display-name data" >/dev/null
+    assert_eq "compute instance launch --help
+bv volume create --help" "$(cat help.log)" "help lookups"
+    assert_eq 4 "$(grep -c -- '--opc-retry-token' oci.log)" "calls with a retry token"
+}
@@ -0,0 +1,26 @@
+# Permission preflight: which tenancy policy statements grant a verb on a resource type
+
+load_functions iam_verb_rank iam_resource_families policy_grants
+
+test_family_grant_covers_member_types() {
+    local statements="allow group ops to manage object-family in tenancy
+allow group ops to manage virtual-network-family in tenancy"
+    policy_grants "$statements" ops manage objects || fail "object-family does not cover objects"
+    policy_grants "$statements" ops manage subnets || fail "virtual-network-family does not cover subnets"
+    policy_grants "$statements" ops manage virtual-network-family || fail "exact family grant"
+    ! policy_grants "$statements" ops manage instances || fail "object-family covers instances"
+}
+
+test_volume_attachments_in_both_families() {
+    policy_grants "allow group ops to use instance-family in tenancy" ops use volume-attachments \
+        || fail "instance-family does not cover volume-attachments"
+    policy_grants "allow group ops to manage volume-family in tenancy" ops manage volume-attachments \
+        || fail "volume-family does not cover volume-attachments"
+}
+
+test_weaker_verb_and_other_group_do_not_count() {
+    ! policy_grants "allow group ops to read object-family in tenancy" ops manage objects || fail "read grants manage"
+    ! policy_grants "allow group dev to manage object-family in tenancy" ops manage objects || fail "other group"
+    policy_grants "allow group 'Default'/'ops' to manage all-resources in tenancy" ops manage objects \
+        || fail "identity-domain qualified all-resources grant"
+}
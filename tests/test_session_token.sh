@@ -0,0 +1,33 @@
+# Session tokens: expiry warnings and the on-disk change check, without GNU-only date or stat
+
+load_functions file_mtime session_token_expiry ensure_session_token_fresh
+
+auth_method=security_token SESSION_TOKEN_REFRESHING=false OCI_CLI_FIXTURES_DIR="" OCI_PROFILE=DEFAULT
+SESSION_TOKEN_AUTO_REFRESH=false SESSION_TOKEN_REFRESH_MARGIN=600 SESSION_TOKEN_MTIME=""
+
+session_token_file() { echo "$PWD/token"; }
+
+# write_token EXP: an unsigned JWT whose payload expires at EXP
+write_token() {
+    printf 'e30.%s.sig' "$(printf '{"exp":%s}' "$1" | base64 | tr -d '\n=' | tr '/+' '_-')" > token
+}
+
+test_file_mtime() {
+    touch -t 202001020304.05 token
+    assert_eq "$(date -d '2020-01-02 03:04:05' +%s 2>/dev/null || date -j -f '%Y-%m-%d %H:%M:%S' '2020-01-02 03:04:05' +%s)" \
+        "$(file_mtime token)" "mtime"
+    ! file_mtime missing || fail "mtime of a missing file"
+}
+
+test_expired_token_warns_with_utc_time() {
+    write_token 1000000000
+    local out
+    out=$(ensure_session_token_fresh 2>&1)
+    assert_contains "$out" "expired at 2001-09-09T01:46:40Z"
+}
+
+test_records_token_mtime() {
+    write_token $(( $(date +%s) + 3600 ))
+    ensure_session_token_fresh
+    assert_eq "$(file_mtime token)" "$SESSION_TOKEN_MTIME" "recorded mtime"
+}
@@ -0,0 +1,19 @@
+# Usage statistics: recording a run keeps the opt-in choice stored by "usage enable/disable"
+
+load_functions usage_stats_enabled usage_record
+
+USAGE_STATS_FILE="$PWD/usage.json" USAGE_FEATURE=setup USAGE_FLAGS=(--dry-run) USAGE_PHASES=(prereqs)
+
+test_forced_run_keeps_usage_disabled() {
+    echo '{"enabled": false}' > "$USAGE_STATS_FILE"
+    USAGE_STATS=true usage_record 0
+    assert_eq false "$(jq '.enabled' "$USAGE_STATS_FILE")" "enabled"
+    assert_eq 1 "$(jq '.runs' "$USAGE_STATS_FILE")" "runs"
+    ! USAGE_STATS="" usage_stats_enabled || fail "collection re-enabled"
+}
+
+test_first_run_enables_and_counts() {
+    USAGE_STATS=true usage_record 1
+    assert_eq "true 1 1" "$(jq -r '"\(.enabled) \(.runs) \(.failures)"' "$USAGE_STATS_FILE")" "enabled runs failures"
+    assert_eq 1 "$(jq '.phases.prereqs.failures' "$USAGE_STATS_FILE")" "failed phase"
+}
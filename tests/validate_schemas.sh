@@ -0,0 +1,180 @@
+#!/usr/bin/env bash
+# Validate every JSON format the script emits against its schema from 'schema export'.
+# The samples come from the real code: whole subcommands where they run offline, single
+# functions with SSH, OCI and Terraform stubbed otherwise. A schema without a sample fails.
+# Needs check-jsonschema (pip install check-jsonschema).
+set -euo pipefail
+
+source "$(dirname "${BASH_SOURCE[0]}")/lib.sh"
+
+if ! command -v check-jsonschema >/dev/null 2>&1; then
+    echo "check-jsonschema not found (pip install check-jsonschema)" >&2
+    exit 2
+fi
+
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+samples="$work/samples"
+ws="$work/workspace"
+mkdir -p "$samples" "$ws"
+# Usage statistics and other per-user state stay out of the real home
+export HOME="$work"
+
+# sample NAME [--lines]: store stdin as the next sample of NAME, or each line as one
+sample() {
+    local name="$1" line n
+    if [ "${2:-}" = "--lines" ]; then
+        while IFS= read -r line; do
+            [ -z "$line" ] || sample "$name" <<< "$line"
+        done
+        return 0
+    fi
+    n=$(find "$samples" -name "$name.*.json" | wc -l)
+    cat > "$samples/$name.$((n + 1)).json"
+}
+
+cat > "$ws/variables.tf" <<'EOF'
+  amd_micro_instance_count = 1
+  amd_micro_boot_volume_size_gb = 50
+  arm_flex_instance_count = 2
+  arm_flex_ocpus_per_instance = [2, 2]
+  arm_flex_memory_per_instance = [12, 12]
+  arm_flex_boot_volume_size_gb = [50, 50]
+  amd_micro_hostnames = ["amd-1"]
+  arm_flex_hostnames = ["arm-1", "arm-2"]
+  block_volumes = {"arm-1-block":{"kind":"arm","index":0,"size_gb":50}}
+EOF
+echo "ingress tcp 22 0.0.0.0/0" > "$ws/firewall.conf"
+
+# Subcommands that need no tenancy: spec, lint, capacity-stats, and the run reports
+(
+    cd "$ws"
+    RESULT_FILE="$work/result.json" EVENTS_FILE="$work/events.jsonl" "$SCRIPT" spec show | sample spec
+    sample result < "$work/result.json"
+    RESULT_FILE="$work/result.json" EVENTS_FILE="$work/events.jsonl" "$SCRIPT" spec nonsense >/dev/null 2>&1 || true
+    sample result < "$work/result.json"
+    "$SCRIPT" lint --format json | sample lint || [ $? -eq 2 ]
+)
+
+# A run with phases, through the tracing hooks the main flow uses
+(
+    load_functions usage_phase tracing_enabled trace_start trace_end trace_run run_reports_enabled run_now_ms \
+        event_emit run_report_start run_phase_start run_phase_end run_report_finish
+    TRACE_SPANS_FILE="" CLOUDCRADLE_RUN_ID="20260101T000000Z-1" CLOUDCRADLE_VERSION="test" USAGE_FEATURE=setup DRY_RUN=false
+    USAGE_PHASES=() RUN_PHASE_NAMES=() RUN_PHASE_STARTS=() RUN_PHASE_RESULTS=()
+    RESULT_FILE="$work/result.json" EVENTS_FILE="$work/events.jsonl"
+    run_report_start setup
+    trace_start prereqs
+    trace_end
+    trace_run "terraform plan" true
+    trace_run "terraform apply" false || true
+    trace_start discovery
+    run_report_finish 1
+    sample result < "$RESULT_FILE"
+)
+sample event --lines < "$work/events.jsonl"
+
+# Capacity history and its statistics
+(
+    load_functions record_capacity_event
+    region=us-ashburn-1 availability_domain="Uocm:US-ASHBURN-AD-1" CAPACITY_HISTORY_FILE="$work/capacity.jsonl"
+    record_capacity_event out_of_capacity VM.Standard.A1.Flex VM.Standard.E2.1.Micro
+    record_capacity_event success VM.Standard.A1.Flex
+)
+sample capacity-event --lines < "$work/capacity.jsonl"
+CAPACITY_HISTORY_FILE="$work/capacity.jsonl" "$SCRIPT" capacity-stats --json | sample capacity-stats
+
+# Drift from a saved plan
+(
+    load_functions drift_records_from_plan_json
+    drift_records_from_plan_json < "$FIXTURES/plan/drift.json" | sample drift
+)
+
+# Fleet package versions: one current host, one behind, one unreachable, one stopped
+(
+    load_constants FLEET_PACKAGES_PROBE
+    load_functions fleet_packages
+    parse_fleet_targets() { FLEET_TARGETS=(amd-1 arm-1 arm-2 arm-3); }
+    power_state_of() { [ "$1" = arm-3 ] && echo STOPPED || echo RUNNING; }
+    fleet_ssh_host() { echo "$1"; }
+    ssh_instance() {
+        case "$1" in
+            amd-1) printf 'docker\t27.3.1\nopenssl\t3.0.13\n' ;;
+            arm-1) printf 'docker\t26.1.3\nopenssl\t-\n' ;;
+            *) return 255 ;;
+        esac
+    }
+    DRY_RUN=false FLEET_PACKAGES="docker openssl"
+    fleet_packages --json | sample fleet-packages || [ $? -eq 2 ]
+)
+
+# Backup status: the on-instance script's status with restic stubbed, then the fleet view
+(
+    mkdir -p "$work/instance/bin" "$work/instance/etc" "$work/instance/var"
+    awk '/^  - path: \/usr\/local\/sbin\/cloudcradle-backup$/ {p=1; next} p && /^  - / {exit} p && /^      / {print substr($0, 7)}' "$SCRIPT" \
+        | sed -e "s|/etc/cloudcradle|$work/instance/etc|g" -e "s|/var/lib/cloudcradle|$work/instance/var|g" > "$work/instance/backup"
+    printf 'RESTIC_REPOSITORY=rclone:cloudcradle:backups/amd-1\nRESTIC_PASSWORD_FILE=%s\nBACKUP_PATHS="/srv /etc/app"\n' \
+        "$work/instance/etc/restic.password" > "$work/instance/etc/backup.env"
+    echo '{"time": "2026-01-01T03:00:00+00:00", "result": "ok"}' > "$work/instance/var/backup-last.json"
+    printf '#!/bin/sh\necho %s\n' "'[{\"short_id\": \"4f2a9c1e\", \"time\": \"2026-01-01T03:00:12Z\"}]'" > "$work/instance/bin/restic"
+    printf '#!/bin/sh\necho "Thu 2026-01-02 03:04:00 UTC"\n' > "$work/instance/bin/systemctl"
+    chmod +x "$work/instance/bin/"*
+    status=$(PATH="$work/instance/bin:$PATH" bash "$work/instance/backup" status)
+
+    load_functions backup_status
+    parse_fleet_targets() { FLEET_TARGETS=(amd-1 arm-1 arm-2); }
+    fleet_ssh_host() { echo "$1"; }
+    backup_remote() {
+        case "$1" in
+            amd-1) echo "$status" ;;
+            arm-1) return 3 ;;
+            *) return 255 ;;
+        esac
+    }
+    backup_status --json | sample backup-status || true
+)
+
+# Published SSH keys cache
+(
+    load_functions ssh_user_entries ssh_authorized_users_tf
+    fetch_ssh_user_keys() { printf 'ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample %s\n' "$1"; }
+    USERS_FILE="$work/users.conf" SSH_AUTHORIZED_USERS="" SSH_AUTHORIZED_USERS_CACHE="$work/ssh-users.json"
+    SSH_AUTHORIZED_USERS_REFRESH=false DRY_RUN=false
+    echo "alice sudo - github:alice gitlab:alice.b" > "$USERS_FILE"
+    ssh_authorized_users_tf >/dev/null 2>&1
+    sample ssh-users-cache < "$SSH_AUTHORIZED_USERS_CACHE"
+)
+
+# Image lock: a platform image for amd, a Marketplace listing for arm
+(
+    load_functions resolve_instance_image write_image_lock
+    locked_image() { return 1; }
+    resolve_os_image() {
+        RESOLVED_IMAGE_OCID="ocid1.image.oc1.iad.example$1" RESOLVED_IMAGE_NAME="Canonical-Ubuntu-24.04-Minimal-2025.01.31-0" RESOLVED_LISTING=""
+        [ "$1" != VM.Standard.A1.Flex ] || RESOLVED_LISTING="ocid1.appcataloglisting.oc1..example|1.0"
+    }
+    region=us-ashburn-1 DRY_RUN=false IMAGE_LOCK_FILE="$work/images.lock.json"
+    IMAGE_LOCK_ENTRY='{"selection": "ubuntu 24.04 minimal"}'
+    resolve_instance_image amd VM.Standard.E2.1.Micro
+    resolve_instance_image arm VM.Standard.A1.Flex
+    write_image_lock >/dev/null
+    sample image-lock < "$IMAGE_LOCK_FILE"
+)
+
+"$SCRIPT" schema export --dir "$work/schemas" >/dev/null
+failed=0
+for schema in "$work"/schemas/*.schema.json; do
+    name=$(basename "$schema" .schema.json)
+    files=("$samples/$name".*.json)
+    if [ ! -e "${files[0]}" ]; then
+        echo "FAIL  $name: no sample"
+        failed=$((failed + 1))
+    elif check-jsonschema --schemafile "$schema" "${files[@]}" > "$work/errors" 2>&1; then
+        echo "ok    $name (${#files[@]} sample(s))"
+    else
+        echo "FAIL  $name"
+        sed 's/^/      /' "$work/errors"
+        failed=$((failed + 1))
+    fi
+done
+[ "$failed" -eq 0 ]